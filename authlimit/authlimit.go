@@ -0,0 +1,203 @@
+// Package authlimit slows down and then locks out clients which keep failing
+// to log in, like bots trying lists of passwords. failures are counted by
+// address and by username, and are forgotten over time. only addresses are
+// locked out, so that anyone can't lock a user out by failing to log in as
+// them, they're only slowed down. the methods of a nil *Limiter do nothing, so
+// that logins don't need to check if it's turned on
+package authlimit
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrLockedOut = errors.New("too many failed logins")
+
+type Options struct {
+	// MaxFailures within Window locks logins from the address out for the
+	// Window
+	MaxFailures int
+	Window      time.Duration
+	// DelayAfter failures, each login waits for Delay first
+	DelayAfter int
+	Delay      time.Duration
+}
+
+// DefaultOptions lock out after 10 failures in 15 minutes, and delay logins
+// by a second after 3
+func DefaultOptions() Options {
+	return Options{
+		MaxFailures: 10,
+		Window:      15 * time.Minute,
+		DelayAfter:  3,
+		Delay:       time.Second,
+	}
+}
+
+type Limiter struct {
+	opts Options
+	now  func() time.Time
+
+	mu        sync.Mutex
+	addrs     map[string]*counter
+	users     map[string]*counter
+	lastSweep time.Time
+}
+
+// counter is the failures of an address or username. they decay, so that
+// MaxFailures are forgotten over a Window, one at a time
+type counter struct {
+	failures    int
+	updated     time.Time
+	lockedUntil time.Time
+}
+
+// New returns a Limiter with opts, or nil if MaxFailures or Window is 0
+func New(opts Options) *Limiter {
+	if opts.MaxFailures <= 0 || opts.Window <= 0 {
+		return nil
+	}
+	return &Limiter{
+		opts:  opts,
+		now:   time.Now,
+		addrs: map[string]*counter{},
+		users: map[string]*counter{},
+	}
+}
+
+// decay forgets the failures which are old enough, as of now
+func (l *Limiter) decay(c *counter, now time.Time) {
+	every := l.opts.Window / time.Duration(l.opts.MaxFailures)
+	if every <= 0 {
+		every = 1
+	}
+	n := now.Sub(c.updated) / every
+	if n <= 0 {
+		return
+	}
+	if int64(n) >= int64(c.failures) {
+		c.failures = 0
+		c.updated = now
+		return
+	}
+	c.failures -= int(n)
+	c.updated = c.updated.Add(n * every)
+}
+
+// get returns the decayed counter for key, or nil if there isn't one
+func (l *Limiter) get(m map[string]*counter, key string, now time.Time) *counter {
+	if key == "" {
+		return nil
+	}
+	c, ok := m[key]
+	if !ok {
+		return nil
+	}
+	l.decay(c, now)
+	return c
+}
+
+// check is how long a login from addr to user waits, or ErrLockedOut
+func (l *Limiter) check(addr, user string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var failures int
+	for _, c := range []*counter{l.get(l.addrs, addr, now), l.get(l.users, user, now)} {
+		if c == nil {
+			continue
+		}
+		if now.Before(c.lockedUntil) {
+			return 0, ErrLockedOut
+		}
+		if c.failures > failures {
+			failures = c.failures
+		}
+	}
+	if l.opts.Delay > 0 && failures >= l.opts.DelayAfter {
+		return l.opts.Delay, nil
+	}
+	return 0, nil
+}
+
+// Wait is called before a login from addr to user is checked. it waits if
+// there have been a few failures, or returns ErrLockedOut if there have been
+// too many, without waiting
+func (l *Limiter) Wait(ctx context.Context, addr, user string) error {
+	if l == nil {
+		return nil
+	}
+	delay, err := l.check(addr, user)
+	if err != nil || delay == 0 {
+		return err
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Fail counts a failed login from addr to user, and locks addr out if it's
+// reached MaxFailures
+func (l *Limiter) Fail(addr, user string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	l.fail(l.addrs, addr, now, true)
+	l.fail(l.users, user, now, false)
+}
+
+func (l *Limiter) fail(m map[string]*counter, key string, now time.Time, lock bool) {
+	if key == "" {
+		return
+	}
+	c := l.get(m, key, now)
+	if c == nil {
+		c = &counter{updated: now}
+		m[key] = c
+	}
+	c.failures++
+	if lock && c.failures >= l.opts.MaxFailures && !now.Before(c.lockedUntil) {
+		c.lockedUntil = now.Add(l.opts.Window)
+		log.Printf("locking out logins from address %q for %v after too many failures", key, l.opts.Window)
+	}
+}
+
+// Succeed forgets the failures of addr and user, after they logged in
+func (l *Limiter) Succeed(addr, user string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.addrs, addr)
+	delete(l.users, user)
+}
+
+// sweep removes the counters which have decayed to nothing and aren't locked,
+// at most once a Window, so that they don't pile up
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.opts.Window {
+		return
+	}
+	l.lastSweep = now
+	for _, m := range []map[string]*counter{l.addrs, l.users} {
+		for key, c := range m {
+			l.decay(c, now)
+			if c.failures == 0 && !now.Before(c.lockedUntil) {
+				delete(m, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package authlimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func newTestLimiter(now *time.Time) *Limiter {
+	l := New(Options{
+		MaxFailures: 4,
+		Window:      time.Minute,
+		DelayAfter:  2,
+		Delay:       time.Millisecond,
+	})
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestLockout(t *testing.T) {
+	is := is.New(t)
+	now := time.Unix(1660000000, 0)
+	l := newTestLimiter(&now)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		is.NoErr(l.Wait(ctx, "10.0.0.1", "alice"))
+		l.Fail("10.0.0.1", "alice")
+	}
+	delay, err := l.check("10.0.0.1", "alice")
+	is.NoErr(err)
+	is.Equal(delay, time.Millisecond) // slowed down
+	l.Fail("10.0.0.1", "alice")
+
+	is.True(errors.Is(l.Wait(ctx, "10.0.0.1", "bob"), ErrLockedOut)) // the address
+	delay, err = l.check("10.0.0.2", "alice")
+	is.NoErr(err)                     // but not the user, from anywhere else
+	is.Equal(delay, time.Millisecond) // who's only slowed down
+	is.NoErr(l.Wait(ctx, "10.0.0.2", "bob"))
+	now = now.Add(time.Minute)
+	is.NoErr(l.Wait(ctx, "10.0.0.1", "alice")) // until the window is over
+	delay, err = l.check("10.0.0.1", "alice")
+	is.NoErr(err)
+	is.Equal(delay, time.Duration(0)) // and the failures have decayed
+}
+
+func TestDecay(t *testing.T) {
+	is := is.New(t)
+	now := time.Unix(1660000000, 0)
+	l := newTestLimiter(&now)
+
+	// a failure is forgotten every 15s, so 3 failures a minute never lock out
+	for i := 0; i < 10; i++ {
+		l.Fail("10.0.0.1", "alice")
+		now = now.Add(20 * time.Second)
+		_, err := l.check("10.0.0.1", "alice")
+		is.NoErr(err)
+	}
+}
+
+func TestSucceed(t *testing.T) {
+	is := is.New(t)
+	now := time.Unix(1660000000, 0)
+	l := newTestLimiter(&now)
+
+	for i := 0; i < 3; i++ {
+		l.Fail("10.0.0.1", "alice")
+	}
+	l.Succeed("10.0.0.1", "alice")
+	l.Fail("10.0.0.1", "alice")
+	delay, err := l.check("10.0.0.1", "alice")
+	is.NoErr(err)
+	is.Equal(delay, time.Duration(0)) // counted from the start again
+}
+
+func TestSweep(t *testing.T) {
+	is := is.New(t)
+	now := time.Unix(1660000000, 0)
+	l := newTestLimiter(&now)
+
+	for i := 0; i < 100; i++ {
+		l.Fail(fmt.Sprintf("10.0.0.%d", i), "")
+	}
+	now = now.Add(2 * time.Minute)
+	l.Fail("10.0.1.1", "")
+	is.Equal(len(l.addrs), 1)
+	is.Equal(len(l.users), 0)
+}
+
+func TestConcurrent(t *testing.T) {
+	is := is.New(t)
+	l := New(Options{MaxFailures: 50, Window: time.Minute})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_ = l.Wait(context.Background(), "10.0.0.1", "alice")
+				l.Fail("10.0.0.1", "alice")
+			}
+		}()
+	}
+	wg.Wait()
+	is.True(errors.Is(l.Wait(context.Background(), "10.0.0.1", "alice"), ErrLockedOut))
+}
+
+func TestNil(t *testing.T) {
+	is := is.New(t)
+	l := New(Options{})
+	is.True(l == nil) // off
+	is.NoErr(l.Wait(context.Background(), "10.0.0.1", "alice"))
+	l.Fail("10.0.0.1", "alice")
+	l.Succeed("10.0.0.1", "alice")
+}
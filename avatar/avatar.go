@@ -0,0 +1,136 @@
+// Package avatar resizes uploaded user avatars, and generates identicons for
+// users who haven't uploaded one
+package avatar
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+
+	"github.com/disintegration/imaging"
+
+	"go.senan.xyz/gonic/db"
+)
+
+// SettingPublic lets users fetch each other's avatars, not just their own
+const SettingPublic = "public_avatars"
+
+// Sizes are the square sizes an upload is stored at
+var Sizes = []int{64, 128, 256}
+
+const DefaultSize = 128
+
+// uploads bigger than MaxUploadSize bytes, or with more than maxPixels, aren't
+// decoded, since a small file can still decode to a huge image
+const (
+	MaxUploadSize = 10 * 1000 * 1000
+	maxPixels     = 40 * 1000 * 1000
+)
+
+var ErrTooBig = errors.New("image is too big")
+
+// Resize decodes an uploaded image, and encodes it as a png for each of Sizes
+func Resize(r io.Reader) (map[int][]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxUploadSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("read image: %w", err)
+	}
+	if len(data) > MaxUploadSize {
+		return nil, fmt.Errorf("%w, the most is %d MB", ErrTooBig, MaxUploadSize/1000/1000)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, fmt.Errorf("%w, %dx%d pixels", ErrTooBig, config.Width, config.Height)
+	}
+	src, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, fmt.Errorf("decode image: %w", err)
+	}
+	resized := map[int][]byte{}
+	for _, size := range Sizes {
+		var buff bytes.Buffer
+		img := imaging.Fill(src, size, size, imaging.Center, imaging.Lanczos)
+		if err := png.Encode(&buff, img); err != nil {
+			return nil, fmt.Errorf("encode size %d: %w", size, err)
+		}
+		resized[size] = buff.Bytes()
+	}
+	return resized, nil
+}
+
+// PickSize finds the smallest of Sizes which is at least want, or the largest
+func PickSize(want int) int {
+	for _, size := range Sizes {
+		if size >= want {
+			return size
+		}
+	}
+	return Sizes[len(Sizes)-1]
+}
+
+// Image returns the png for user's avatar at the closest stored size to size,
+// or their identicon if they haven't uploaded one
+func Image(dbc *db.DB, user *db.User, size int) ([]byte, error) {
+	size = PickSize(size)
+	if avatar := dbc.GetAvatar(user.ID, size); avatar != nil {
+		return avatar.Image, nil
+	}
+	return Identicon(user.Name, size)
+}
+
+const identiconCells = 5
+
+// Identicon draws a symmetric 5x5 pattern coloured from a hash of seed, so the
+// same username always gets the same image
+func Identicon(seed string, size int) ([]byte, error) {
+	hash := sha256.Sum256([]byte(seed))
+	fg := color.RGBA{R: hash[0], G: hash[1], B: hash[2], A: 0xff}
+	bg := color.RGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}
+
+	// leave half a cell of padding on each side
+	cell := size / (identiconCells + 1)
+	if cell < 1 {
+		cell = 1
+	}
+	pad := (size - cell*identiconCells) / 2
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.Set(x, y, bg)
+		}
+	}
+	for row := 0; row < identiconCells; row++ {
+		for col := 0; col < (identiconCells+1)/2; col++ {
+			// one bit per cell from the rest of the hash, mirrored left to right
+			i := row*identiconCells + col
+			if hash[3+i/8]>>(i%8)&1 == 0 {
+				continue
+			}
+			for _, c := range []int{col, identiconCells - 1 - col} {
+				fill(img, pad+c*cell, pad+row*cell, cell, fg)
+			}
+		}
+	}
+	var buff bytes.Buffer
+	if err := png.Encode(&buff, img); err != nil {
+		return nil, fmt.Errorf("encode identicon: %w", err)
+	}
+	return buff.Bytes(), nil
+}
+
+func fill(img *image.RGBA, x0, y0, size int, c color.Color) {
+	for y := y0; y < y0+size; y++ {
+		for x := x0; x < x0+size; x++ {
+			img.Set(x, y, c)
+		}
+	}
+}
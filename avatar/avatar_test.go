@@ -0,0 +1,101 @@
+package avatar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestIdenticon(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	a, err := Identicon("alice", 128)
+	is.NoErr(err)
+	again, err := Identicon("alice", 128)
+	is.NoErr(err)
+	b, err := Identicon("bob", 128)
+	is.NoErr(err)
+	is.True(bytes.Equal(a, again)) // same name, same image
+	is.True(!bytes.Equal(a, b))    // different name, different image
+
+	img, err := png.Decode(bytes.NewReader(a))
+	is.NoErr(err)
+	is.Equal(img.Bounds().Dx(), 128)
+	is.Equal(img.Bounds().Dy(), 128)
+
+	// mirrored left to right, compared at the middle of each cell
+	cell := 128 / (identiconCells + 1)
+	pad := (128 - cell*identiconCells) / 2
+	at := func(row, col int) color.Color {
+		return img.At(pad+col*cell+cell/2, pad+row*cell+cell/2)
+	}
+	for row := 0; row < identiconCells; row++ {
+		for col := 0; col < identiconCells/2; col++ {
+			is.Equal(at(row, col), at(row, identiconCells-1-col))
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	src := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for x := 0; x < 300; x++ {
+		for y := 0; y < 200; y++ {
+			src.Set(x, y, color.RGBA{R: 0xff, A: 0xff})
+		}
+	}
+	var buff bytes.Buffer
+	is.NoErr(jpeg.Encode(&buff, src, nil))
+
+	resized, err := Resize(&buff)
+	is.NoErr(err)
+	is.Equal(len(resized), len(Sizes))
+	for _, size := range Sizes {
+		img, err := png.Decode(bytes.NewReader(resized[size]))
+		is.NoErr(err)
+		is.Equal(img.Bounds().Dx(), size) // cropped square
+		is.Equal(img.Bounds().Dy(), size)
+	}
+
+	_, err = Resize(bytes.NewReader([]byte("not an image")))
+	is.True(err != nil)
+	_, err = Resize(bytes.NewReader(make([]byte, MaxUploadSize+1)))
+	is.True(errors.Is(err, ErrTooBig))
+}
+
+func TestResizeTooManyPixels(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	// a tiny png which says it's 100000x100000, fixing up the header's crc
+	var buff bytes.Buffer
+	is.NoErr(png.Encode(&buff, image.NewGray(image.Rect(0, 0, 1, 1))))
+	data := buff.Bytes()
+	const ihdr = 8 // after the signature, the length, type, and data of the first chunk
+	binary.BigEndian.PutUint32(data[ihdr+8:], 100000)
+	binary.BigEndian.PutUint32(data[ihdr+12:], 100000)
+	binary.BigEndian.PutUint32(data[ihdr+8+13:], crc32.ChecksumIEEE(data[ihdr+4:ihdr+8+13]))
+
+	_, err := Resize(bytes.NewReader(data))
+	is.True(errors.Is(err, ErrTooBig))
+}
+
+func TestPickSize(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	is.Equal(PickSize(0), 64)
+	is.Equal(PickSize(64), 64)
+	is.Equal(PickSize(100), 128)
+	is.Equal(PickSize(1000), 256)
+}
@@ -0,0 +1,170 @@
+// Package backup writes consistent copies of the database while gonic is
+// running, on demand and on a schedule. backups aren't made during a scan,
+// since the copy would have half of it
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+)
+
+// Keep is how many of the scheduled backups are kept, the oldest are removed
+// first
+const Keep = 7
+
+const (
+	prefix     = "gonic-"
+	suffix     = ".db"
+	timeFormat = "20060102-150405"
+)
+
+var (
+	ErrScanning = errors.New("a scan is running, try again after it")
+	ErrRunning  = errors.New("a backup is already running")
+	ErrNoDir    = errors.New("no backup path is set")
+)
+
+// Scanner says whether anyone is scanning. see scanner.Scanner
+type Scanner interface {
+	IsScanning() bool
+	ActiveLeases() ([]*db.ScanLease, error)
+}
+
+// File is a backup in the dir
+type File struct {
+	Name string
+	Size int64
+	Time time.Time
+}
+
+type Backups struct {
+	db      *db.DB
+	scanner Scanner
+	dir     string
+
+	mu      sync.Mutex
+	running bool
+}
+
+// New makes Backups which are written to dir, or only on demand if dir is ""
+func New(dbc *db.DB, scanner Scanner, dir string) *Backups {
+	return &Backups{
+		db:      dbc,
+		scanner: scanner,
+		dir:     dir,
+	}
+}
+
+// Dir is where backups are written to, or "" if they aren't
+func (b *Backups) Dir() string {
+	return b.dir
+}
+
+// WriteTo writes a backup to path, which mustn't exist yet
+func (b *Backups) WriteTo(path string) error {
+	b.mu.Lock()
+	if b.running {
+		b.mu.Unlock()
+		return ErrRunning
+	}
+	b.running = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.running = false
+		b.mu.Unlock()
+	}()
+
+	if b.scanner.IsScanning() {
+		return ErrScanning
+	}
+	// scans from other processes sharing the db
+	leases, err := b.scanner.ActiveLeases()
+	if err != nil {
+		return fmt.Errorf("find scans: %w", err)
+	}
+	if len(leases) > 0 {
+		return ErrScanning
+	}
+	return b.db.Backup(path)
+}
+
+// Write writes a backup into the dir, named for now, and removes all but the
+// newest Keep
+func (b *Backups) Write(now time.Time) (*File, error) {
+	if b.dir == "" {
+		return nil, ErrNoDir
+	}
+	if err := os.MkdirAll(b.dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("create dir: %w", err)
+	}
+	name := FileName(now)
+	if err := b.WriteTo(filepath.Join(b.dir, name)); err != nil {
+		return nil, err
+	}
+	files, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+	for i, file := range files {
+		if i < Keep {
+			continue
+		}
+		if err := os.Remove(filepath.Join(b.dir, file.Name)); err != nil {
+			return nil, fmt.Errorf("remove old backup: %w", err)
+		}
+	}
+	for _, file := range files {
+		if file.Name == name {
+			return file, nil
+		}
+	}
+	return nil, fmt.Errorf("find new backup %q", name)
+}
+
+// List returns the backups in the dir, newest first
+func (b *Backups) List() ([]*File, error) {
+	if b.dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(b.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+	var files []*File
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		stamp, err := time.ParseInLocation(timeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), time.Local)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("stat %q: %w", name, err)
+		}
+		files = append(files, &File{Name: name, Size: info.Size(), Time: stamp})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Time.After(files[j].Time)
+	})
+	return files, nil
+}
+
+// FileName is the name of a backup made at t
+func FileName(t time.Time) string {
+	return prefix + t.Format(timeFormat) + suffix
+}
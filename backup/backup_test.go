@@ -0,0 +1,122 @@
+package backup
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+type scanner struct {
+	scanning bool
+	leases   []*db.ScanLease
+}
+
+func (s *scanner) IsScanning() bool                       { return s.scanning }
+func (s *scanner) ActiveLeases() ([]*db.ScanLease, error) { return s.leases, nil }
+
+func newDB(t *testing.T) *db.DB {
+	t.Helper()
+	is := is.New(t)
+	dbc, err := db.New(filepath.Join(t.TempDir(), "gonic.db"), nil)
+	is.NoErr(err)
+	t.Cleanup(func() { dbc.Close() })
+	is.NoErr(dbc.Migrate(db.MigrationContext{}))
+	is.NoErr(dbc.Create(&db.Genre{Name: "Rock"}).Error)
+	return dbc
+}
+
+func TestWriteTo(t *testing.T) {
+	is := is.New(t)
+	backups := New(newDB(t), &scanner{}, "")
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	is.NoErr(backups.WriteTo(path))
+
+	// the copy is a db of its own, with the rows of the original
+	copied, err := db.New(path, nil)
+	is.NoErr(err)
+	defer copied.Close()
+	var genre db.Genre
+	is.NoErr(copied.Where("name=?", "Rock").First(&genre).Error)
+}
+
+func TestWriteToScanning(t *testing.T) {
+	is := is.New(t)
+	scanner := &scanner{scanning: true}
+	backups := New(newDB(t), scanner, "")
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	is.True(errors.Is(backups.WriteTo(path), ErrScanning))
+	_, err := os.Stat(path)
+	is.True(errors.Is(err, os.ErrNotExist))
+
+	// or scanning from another process
+	scanner.scanning = false
+	scanner.leases = []*db.ScanLease{{Dir: "/music"}}
+	is.True(errors.Is(backups.WriteTo(path), ErrScanning))
+
+	scanner.leases = nil
+	is.NoErr(backups.WriteTo(path))
+}
+
+func TestWriteToMemory(t *testing.T) {
+	is := is.New(t)
+	dbc, err := db.NewMock()
+	is.NoErr(err)
+	defer dbc.Close()
+	backups := New(dbc, &scanner{}, "")
+	is.True(errors.Is(backups.WriteTo(filepath.Join(t.TempDir(), "backup.db")), db.ErrBackupMemory))
+}
+
+func TestWrite(t *testing.T) {
+	is := is.New(t)
+	dir := filepath.Join(t.TempDir(), "backups")
+	backups := New(newDB(t), &scanner{}, dir)
+
+	files, err := backups.List()
+	is.NoErr(err)
+	is.Equal(len(files), 0) // no dir yet
+
+	start := time.Date(2022, 8, 1, 12, 0, 0, 0, time.Local)
+	for i := 0; i < Keep+2; i++ {
+		file, err := backups.Write(start.Add(time.Duration(i) * time.Hour))
+		is.NoErr(err)
+		is.True(file.Size > 0)
+	}
+
+	// the oldest are removed
+	files, err = backups.List()
+	is.NoErr(err)
+	is.Equal(len(files), Keep)
+	is.Equal(files[0].Name, FileName(start.Add(time.Duration(Keep+1)*time.Hour)))
+	is.Equal(files[Keep-1].Name, FileName(start.Add(2*time.Hour)))
+	is.True(files[0].Time.Equal(start.Add(time.Duration(Keep+1) * time.Hour)))
+
+	// other files in the dir are left alone
+	is.NoErr(os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0600))
+	_, err = backups.Write(start.Add(24 * time.Hour))
+	is.NoErr(err)
+	_, err = os.Stat(filepath.Join(dir, "notes.txt"))
+	is.NoErr(err)
+}
+
+func TestWriteNoDir(t *testing.T) {
+	is := is.New(t)
+	backups := New(newDB(t), &scanner{}, "")
+	_, err := backups.Write(time.Now())
+	is.True(errors.Is(err, ErrNoDir))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/scanner"
+)
+
+// command is run instead of the server when it's named after the flags, like
+// `gonic -config-path gonic.conf create-admin alice`. commands use the same
+// config and db as the server
+type command struct {
+	args string
+	help string
+	run  func(dbc *db.DB, args []string, stdin io.Reader) error
+}
+
+var commands = map[string]command{
+	"create-admin": {
+		args: "<username>",
+		help: "create an admin, or make a user one, with a password read from stdin",
+		run:  cmdCreateAdmin,
+	},
+	"set-lastfm-keys": {
+		args: "<api-key> <secret>",
+		help: "set the last.fm api key and secret used for scrobbling and artist info",
+		run:  cmdSetLastFMKeys,
+	},
+	"check-db": {
+		args: "[-repair]",
+		help: "check the database for damage, like rows left pointing at removed ones after a power loss. with -repair, remove or clear them",
+		run:  cmdCheckDB,
+	},
+}
+
+func runCommand(dbc *db.DB, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q. the commands are\n%s", args[0], commandsHelp())
+	}
+	// args in brackets are optional
+	var required, optional int
+	for _, arg := range strings.Fields(cmd.args) {
+		if strings.HasPrefix(arg, "[") {
+			optional++
+			continue
+		}
+		required++
+	}
+	if got := len(args) - 1; got < required || got > required+optional {
+		return fmt.Errorf("usage: %s %s", args[0], cmd.args)
+	}
+	return cmd.run(dbc, args[1:], os.Stdin)
+}
+
+func commandsHelp() string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var help strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&help, "    %s %s\n        %s\n", name, commands[name].args, commands[name].help)
+	}
+	return help.String()
+}
+
+func cmdCreateAdmin(dbc *db.DB, args []string, stdin io.Reader) error {
+	username := args[0]
+	fmt.Fprintf(os.Stderr, "password for %s: ", username)
+	password, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("read password: %w", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("please enter a password")
+	}
+	user := dbc.GetUserByName(username)
+	if user == nil {
+		user = &db.User{Name: username}
+	}
+	user.Password = password
+	user.IsAdmin = true
+	if err := dbc.Save(user).Error; err != nil {
+		return fmt.Errorf("save user: %w", err)
+	}
+	return nil
+}
+
+func cmdSetLastFMKeys(dbc *db.DB, args []string, _ io.Reader) error {
+	if err := dbc.SetSetting("lastfm_api_key", args[0]); err != nil {
+		return fmt.Errorf("set api key: %w", err)
+	}
+	if err := dbc.SetSetting("lastfm_secret", args[1]); err != nil {
+		return fmt.Errorf("set secret: %w", err)
+	}
+	return nil
+}
+
+func cmdCheckDB(dbc *db.DB, args []string, _ io.Reader) error {
+	check := dbc.CheckIntegrity
+	if len(args) > 0 {
+		if args[0] != "-repair" {
+			return fmt.Errorf("unknown option %q, did you mean -repair", args[0])
+		}
+		check = dbc.RepairIntegrity
+		// a scan could be adding the rows a repair would remove
+		leases, err := dbc.GetScanLeases()
+		if err != nil {
+			return fmt.Errorf("find scan leases: %w", err)
+		}
+		for _, lease := range leases {
+			if !lease.IsStale(scanner.LeaseStaleAfter) {
+				return fmt.Errorf("%q is being scanned by %q, please repair once it's done", lease.Dir, lease.Holder)
+			}
+		}
+	}
+	report, err := check()
+	if err != nil {
+		return err
+	}
+	if report.OK() {
+		fmt.Println("no problems found")
+		return nil
+	}
+	for _, line := range report.Lines() {
+		fmt.Println(line)
+	}
+	if len(report.SQLite) > 0 {
+		return errors.New("the database file is damaged, which can't be repaired. restore a backup instead")
+	}
+	if len(args) == 0 {
+		return errors.New("problems found, run again with -repair to repair them")
+	}
+	return nil
+}
@@ -3,22 +3,34 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	_ "github.com/jinzhu/gorm/dialects/postgres"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/oklog/run"
 	"github.com/peterbourgon/ff"
 
 	"go.senan.xyz/gonic"
+	"go.senan.xyz/gonic/authlimit"
 	"go.senan.xyz/gonic/server"
+	"go.senan.xyz/gonic/server/ctrlbase"
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/jukebox"
+	"go.senan.xyz/gonic/notify"
+	"go.senan.xyz/gonic/transcode"
 )
 
 const (
@@ -29,21 +41,69 @@ const (
 
 func main() {
 	set := flag.NewFlagSet(gonic.Name, flag.ExitOnError)
-	confListenAddr := set.String("listen-addr", "0.0.0.0:4747", "listen address (optional)")
+	confListenAddr := set.String("listen-addr", "0.0.0.0:4747", "listen address, or the path of a unix socket like 'unix:/run/gonic/gonic.sock' (optional)")
+	confListenSocketMode := set.String("listen-socket-mode", "0660", "permissions of the unix socket when listen-addr is one (optional)")
 	confTLSCert := set.String("tls-cert", "", "path to TLS certificate (optional)")
 	confTLSKey := set.String("tls-key", "", "path to TLS private key (optional)")
 	confPodcastPath := set.String("podcast-path", "", "path to podcasts")
+	confPodcastRefreshInterval := set.Duration("podcast-refresh-interval", time.Hour, "how often to refresh podcast feeds. ones which keep failing are refreshed less often (optional)")
+	confPlaylistsPath := set.String("playlists-path", "", "path to m3u and pls playlists, which are imported after each scan, and where changed playlists are written as m3u8. imported ones belong to the first admin (optional)")
 	confCachePath := set.String("cache-path", "", "path to cache")
-	confDBPath := set.String("db-path", "gonic.db", "path to database (optional)")
+	confDBPath := set.String("db-path", "gonic.db", "path to database, or a postgres:// url (optional)")
+	confDBBackupPath := set.String("db-backup-path", "", "path to write backups of the database to, on the db-backup-interval or from the web interface (optional)")
+	confDBBackupInterval := set.Duration("db-backup-interval", 0, "how often to back up the database to db-backup-path, eg. '24h'. 0 disables scheduled backups (optional)")
 	confScanInterval := set.Int("scan-interval", 0, "interval (in minutes) to automatically scan music (optional)")
 	confJukeboxEnabled := set.Bool("jukebox-enabled", false, "whether the subsonic jukebox api should be enabled (optional)")
+	confJukeboxReplayGain := set.String("jukebox-replay-gain", "", "apply each track's replaygain in the jukebox, either track or album (optional)")
+	confJukeboxDevice := set.String("jukebox-device", "", "audio device for the jukebox to play to, from -jukebox-list-devices. empty uses the default one (optional)")
+	confJukeboxListDevices := set.Bool("jukebox-list-devices", false, "list the audio devices the jukebox can play to")
+	confJukeboxPreBuffer := set.Duration("jukebox-pre-buffer", jukebox.DefaultPreBuffer, "how much of the next track the jukebox decodes before the current one ends, for gapless playback. 0 disables it (optional)")
 	confProxyPrefix := set.String("proxy-prefix", "", "url path prefix to use if behind proxy. eg '/gonic' (optional)")
 	confGenreSplit := set.String("genre-split", "\n", "character or string to split genre tag data on (optional)")
 	confHTTPLog := set.Bool("http-log", true, "http request logging (optional)")
+	confLogFormat := set.String("log-format", "plain", "format of the request and slow query logs, either plain or json (optional)")
+	confLogSlowRequest := set.Duration("log-slow-request", 0, "log requests which take longer than this even without http-log, eg. '2s'. 0 disables it (optional)")
+	confLogSlowQuery := set.Duration("log-slow-query", 0, "log database queries which take longer than this, with where they were run from, eg. '500ms'. 0 disables it (optional)")
+	confNoWebUI := set.Bool("no-webui", false, "turn off the web interface, for when gonic is only used through the subsonic api. see the commands for what it did (optional)")
+	confCoverArchiveWriteMusicDir := set.Bool("cover-archive-write-music-dir", false, "save covers fetched from the cover art archive into album folders, instead of the cache (optional)")
+	confChatHistoryMax := set.Int("chat-history-max", 1000, "number of chat messages to keep, oldest are removed first. 0 keeps all (optional)")
+	confTranscodeCacheSize := set.Int("transcode-cache-size", 0, "size (in megabytes) of the transcode cache, least recently used transcodes are removed first. 0 keeps all (optional)")
+	confTranscodeWarmWorkers := set.Int("transcode-warm-workers", 1, "number of transcodes to run at once when warming the transcode cache (optional)")
+	confTranscodeMax := set.Int("transcode-max", 0, "number of transcodes to run at once, others wait for one to finish. 0 uses half the cpus (optional)")
+	confTranscodeMaxWait := set.Duration("transcode-max-wait", 5*time.Second, "how long to wait for a transcode to finish before streaming raw instead (optional)")
+	confScanTiming := set.Bool("scan-timing", false, "log the time spent walking, reading tags, and writing the database for each top level folder after a scan (optional)")
+	confNotifyWebhookURL := set.String("notify-webhook-url", "", "url to post notifications to as json (optional)")
+	confNotifyNtfyURL := set.String("notify-ntfy-url", "", "ntfy topic url to send notifications to. eg 'https://ntfy.sh/my-gonic' (optional)")
+	confNotifyGotifyURL := set.String("notify-gotify-url", "", "gotify server url to send notifications to (optional)")
+	confNotifyGotifyToken := set.String("notify-gotify-token", "", "gotify application token (optional)")
+	confNotifySMTPAddr := set.String("notify-smtp-addr", "", "smtp server to email notifications with. eg 'mail.example.com:587' (optional)")
+	confNotifySMTPUsername := set.String("notify-smtp-username", "", "smtp username (optional)")
+	confNotifySMTPPassword := set.String("notify-smtp-password", "", "smtp password (optional)")
+	confNotifySMTPFrom := set.String("notify-smtp-from", "", "address to email notifications from (optional)")
+	confNotifySMTPTo := set.String("notify-smtp-to", "", "comma separated addresses to email notifications to (optional)")
+	confNotifyEvents := set.String("notify-events", "", "comma separated events to notify about, from scan_failed, disk_low, scrobbler_auth, podcast_downloads. empty means all (optional)")
+	confNotifyThrottle := set.Duration("notify-throttle", notify.DefaultThrottle, "how long to wait before notifying about the same event again (optional)")
+	confNotifyDiskMin := set.Int("notify-disk-min", 1000, "notify when less than this many megabytes are free for the cache or podcasts. 0 disables the check (optional)")
+	confMetricsEnabled := set.Bool("metrics-enabled", false, "record metrics for prometheus, which admins can see at /admin/metrics (optional)")
+	confMetricsListenAddr := set.String("metrics-listen-addr", "", "listen address to serve metrics at /metrics without auth, eg. '127.0.0.1:9747'. enables metrics (optional)")
+	confTrustedProxies := set.String("trusted-proxies", "", "comma separated addresses or cidrs of reverse proxies whose X-Forwarded-For has the client's address, eg. '127.0.0.1,10.0.0.0/8'. without it, failed logins through a proxy count against the proxy's address, so every client is locked out together (optional)")
+	confProxyAuthHeader := set.String("proxy-auth-header", "", "header with the username from a reverse proxy which has logged the user in already, eg. 'Remote-User'. only trusted from proxy-auth-trusted (optional)")
+	confProxyAuthTrusted := set.String("proxy-auth-trusted", "", "comma separated addresses or cidrs of the proxies to trust proxy-auth-header from, eg. '127.0.0.1,10.0.0.0/8'. their X-Forwarded-For is trusted for the client's address too (optional)")
+	confProxyAuthSubsonic := set.Bool("proxy-auth-subsonic", false, "trust proxy-auth-header for the subsonic api too, not only the web interface (optional)")
+	confProxyAuthCreateUsers := set.Bool("proxy-auth-create-users", false, "create users from proxy-auth-header who don't exist yet, as non admins (optional)")
+	authLimit := authlimit.DefaultOptions()
+	confAuthMaxFailures := set.Int("auth-max-failures", authLimit.MaxFailures, "number of failed logins from an address within auth-failure-window before it's locked out for it. logins to a user are only slowed down. 0 disables it (optional)")
+	confAuthFailureWindow := set.Duration("auth-failure-window", authLimit.Window, "how long failed logins are counted for, and how long a lockout lasts (optional)")
+	confAuthDelayAfter := set.Int("auth-delay-after", authLimit.DelayAfter, "number of failed logins before logins are delayed by auth-delay (optional)")
+	confAuthDelay := set.Duration("auth-delay", authLimit.Delay, "how long to delay logins after a few failures (optional)")
+	confCORSOrigins := set.String("cors-origins", "", "comma separated origins of browser clients which can use the subsonic api, eg. 'https://feishin.example.com', or '*' for any (optional)")
+	confShutdownTimeout := set.Duration("shutdown-timeout", 30*time.Second, "how long to let streams and scans finish when stopping, before they're cut off (optional)")
 	confShowVersion := set.Bool("version", false, "show gonic version")
 
 	var confMusicPaths musicPaths
-	set.Var(&confMusicPaths, "music-path", "path to music")
+	set.Var(&confMusicPaths, "music-path", "path to music, optionally named like Name=/path (optional)")
+	var confScanIntervalFolders scanIntervals
+	set.Var(&confScanIntervalFolders, "scan-interval-folder", "interval (in minutes) to automatically scan one music path instead of with scan-interval, like Name=60. the name is the music path's, or its base name (optional)")
 
 	_ = set.String("config-path", "", "path to config (optional)")
 
@@ -59,11 +119,24 @@ func main() {
 		fmt.Println(gonic.Version)
 		os.Exit(0)
 	}
+	if *confJukeboxListDevices {
+		devices, err := jukebox.Devices()
+		if err != nil {
+			log.Fatalf("error listing audio devices: %v", err)
+		}
+		for _, device := range devices {
+			fmt.Printf("%s\t%s\n", device.ID, device.Name)
+		}
+		os.Exit(0)
+	}
 
 	log.Printf("starting gonic %s\n", gonic.Version)
 	log.Printf("provided config\n")
 	set.VisitAll(func(f *flag.Flag) {
 		value := strings.ReplaceAll(f.Value.String(), "\n", "")
+		if value != "" && (strings.Contains(f.Name, "password") || strings.Contains(f.Name, "token")) {
+			value = "<redacted>"
+		}
 		log.Printf("    %-15s %s\n", f.Name, value)
 	})
 
@@ -71,18 +144,109 @@ func main() {
 		log.Fatalf("please provide a music directory")
 	}
 	for _, confMusicPath := range confMusicPaths {
-		if _, err := os.Stat(confMusicPath); os.IsNotExist(err) {
-			log.Fatalf("music directory %q not found", confMusicPath)
+		if _, err := os.Stat(confMusicPath.Path); os.IsNotExist(err) {
+			log.Fatalf("music directory %q not found", confMusicPath.Path)
 		}
 	}
+	if err := confScanIntervalFolders.apply(confMusicPaths); err != nil {
+		log.Fatalf("error setting folder scan intervals: %v", err)
+	}
 	if _, err := os.Stat(*confPodcastPath); os.IsNotExist(err) {
 		log.Fatal("please provide a valid podcast directory")
 	}
+	if *confDBBackupInterval > 0 && *confDBBackupPath == "" {
+		log.Fatal("please provide a db backup path to back up to on an interval")
+	}
+	if *confPodcastRefreshInterval <= 0 {
+		log.Fatal("please provide a podcast refresh interval above 0")
+	}
+	if *confPlaylistsPath != "" {
+		if _, err := os.Stat(*confPlaylistsPath); os.IsNotExist(err) {
+			log.Fatalf("playlists directory %q not found", *confPlaylistsPath)
+		}
+	}
 
 	if *confCachePath == "" {
 		log.Fatal("please provide a cache directory")
 	}
 
+	switch mode := transcode.ReplayGainMode(*confJukeboxReplayGain); mode {
+	case transcode.ReplayGainOff, transcode.ReplayGainTrack, transcode.ReplayGainAlbum:
+	default:
+		log.Fatalf("unknown jukebox replay gain %q, please use track or album", mode)
+	}
+
+	if *confLogFormat != "plain" && *confLogFormat != "json" {
+		log.Fatalf("unknown log format %q, please use plain or json", *confLogFormat)
+	}
+	logJSON := *confLogFormat == "json"
+
+	trusted, err := ctrlbase.ParseTrustedProxies(*confTrustedProxies)
+	if err != nil {
+		log.Fatalf("error parsing trusted proxies: %v", err)
+	}
+	authTrusted, err := ctrlbase.ParseTrustedProxies(*confProxyAuthTrusted)
+	if err != nil {
+		log.Fatalf("error parsing proxy auth trusted proxies: %v", err)
+	}
+	// proxies trusted with logins are trusted with the client's address too
+	trusted = append(trusted, authTrusted...)
+	var proxyAuth *ctrlbase.ProxyAuth
+	if *confProxyAuthHeader != "" {
+		if len(authTrusted) == 0 && !strings.HasPrefix(*confListenAddr, server.UnixPrefix) {
+			log.Fatalf("please provide the addresses of the proxies to trust with proxy-auth-trusted")
+		}
+		proxyAuth = &ctrlbase.ProxyAuth{
+			Header:      *confProxyAuthHeader,
+			Trusted:     authTrusted,
+			Subsonic:    *confProxyAuthSubsonic,
+			CreateUsers: *confProxyAuthCreateUsers,
+		}
+	}
+	var corsOrigins []string
+	for _, origin := range strings.Split(*confCORSOrigins, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			corsOrigins = append(corsOrigins, origin)
+		}
+	}
+	listenSocketMode, err := strconv.ParseUint(*confListenSocketMode, 8, 32)
+	if err != nil || listenSocketMode > 0o777 {
+		log.Fatalf("invalid listen socket mode %q, please use octal permissions like 0660", *confListenSocketMode)
+	}
+
+	var notifyEvents []notify.EventType
+	for _, name := range splitList(*confNotifyEvents) {
+		typ, err := notify.ParseEventType(name)
+		if err != nil {
+			log.Fatalf("error parsing notify events: %v", err)
+		}
+		notifyEvents = append(notifyEvents, typ)
+	}
+	var notifySinks []notify.Sink
+	if *confNotifyWebhookURL != "" {
+		notifySinks = append(notifySinks, &notify.Webhook{URL: *confNotifyWebhookURL})
+	}
+	if *confNotifyNtfyURL != "" {
+		notifySinks = append(notifySinks, &notify.Ntfy{URL: *confNotifyNtfyURL})
+	}
+	if *confNotifyGotifyURL != "" {
+		notifySinks = append(notifySinks, &notify.Gotify{URL: *confNotifyGotifyURL, Token: *confNotifyGotifyToken})
+	}
+	if *confNotifySMTPAddr != "" {
+		to := splitList(*confNotifySMTPTo)
+		if *confNotifySMTPFrom == "" || len(to) == 0 {
+			log.Fatal("please provide notify-smtp-from and notify-smtp-to for email notifications")
+		}
+		notifySinks = append(notifySinks, &notify.Email{
+			Addr:     *confNotifySMTPAddr,
+			Username: *confNotifySMTPUsername,
+			Password: *confNotifySMTPPassword,
+			From:     *confNotifySMTPFrom,
+			To:       to,
+		})
+	}
+	notifier := notify.New(notifySinks, notifyEvents, *confNotifyThrottle)
+
 	cacheDirAudio := path.Join(*confCachePath, cachePrefixAudio)
 	cacheDirCovers := path.Join(*confCachePath, cachePrefixCovers)
 	if _, err := os.Stat(cacheDirAudio); os.IsNotExist(err) {
@@ -101,14 +265,28 @@ func main() {
 		log.Fatalf("error opening database: %v\n", err)
 	}
 	defer dbc.Close()
+	dbc.LogSlowQueries(*confLogSlowQuery, logJSON)
 
 	err = dbc.Migrate(db.MigrationContext{
-		OriginalMusicPath: confMusicPaths[0],
+		OriginalMusicPath: confMusicPaths[0].Path,
+		MusicPaths:        confMusicPaths.paths(),
 	})
 	if err != nil {
 		log.Panicf("error migrating database: %v\n", err)
 	}
 
+	if set.NArg() > 0 {
+		if err := runCommand(dbc, set.Args()); err != nil {
+			log.Fatalf("error running command: %v", err)
+		}
+		return
+	}
+
+	listener, err := server.Listen(*confListenAddr, os.FileMode(listenSocketMode))
+	if err != nil {
+		log.Panicf("error listening: %v\n", err)
+	}
+
 	proxyPrefixExpr := regexp.MustCompile(`^\/*(.*?)\/*$`)
 	*confProxyPrefix = proxyPrefixExpr.ReplaceAllString(*confProxyPrefix, `/$1`)
 	server, err := server.New(server.Options{
@@ -120,36 +298,190 @@ func main() {
 		GenreSplit:     *confGenreSplit,
 		PodcastPath:    *confPodcastPath,
 		HTTPLog:        *confHTTPLog,
+		SlowRequest:    *confLogSlowRequest,
+		LogJSON:        logJSON,
 		JukeboxEnabled: *confJukeboxEnabled,
+		NoWebUI:        *confNoWebUI,
+
+		JukeboxReplayGain:         transcode.ReplayGainMode(*confJukeboxReplayGain),
+		JukeboxPreBuffer:          *confJukeboxPreBuffer,
+		JukeboxDevice:             *confJukeboxDevice,
+		CoverArchiveWriteMusicDir: *confCoverArchiveWriteMusicDir,
+		ChatHistoryMax:            *confChatHistoryMax,
+		ScanTiming:                *confScanTiming,
+		PlaylistsPath:             *confPlaylistsPath,
+		TranscodeCacheLimit:       int64(*confTranscodeCacheSize) * 1000 * 1000,
+		TranscodeWarmWorkers:      *confTranscodeWarmWorkers,
+		TranscodeLimit:            *confTranscodeMax,
+		TranscodeMaxWait:          *confTranscodeMaxWait,
+		Notifier:                  notifier,
+		DiskMinFree:               uint64(*confNotifyDiskMin) * 1000 * 1000,
+		DBBackupPath:              *confDBBackupPath,
+		Metrics:                   *confMetricsEnabled || *confMetricsListenAddr != "",
+		ShutdownTimeout:           *confShutdownTimeout,
+		ProxyAuth:                 proxyAuth,
+		TrustedProxies:            trusted,
+		AuthLimit: authlimit.Options{
+			MaxFailures: *confAuthMaxFailures,
+			Window:      *confAuthFailureWindow,
+			DelayAfter:  *confAuthDelayAfter,
+			Delay:       *confAuthDelay,
+		},
+		CORSOrigins: corsOrigins,
 	})
 	if err != nil {
 		log.Panicf("error creating server: %v\n", err)
 	}
 
 	var g run.Group
-	g.Add(server.StartHTTP(*confListenAddr, *confTLSCert, *confTLSKey))
-	g.Add(server.StartSessionClean(cleanTimeDuration))
-	g.Add(server.StartPodcastRefresher(time.Hour))
-	if *confScanInterval > 0 {
+	g.Add(server.StartHTTP(listener, *confTLSCert, *confTLSKey))
+	if !*confNoWebUI {
+		g.Add(server.StartSessionClean(cleanTimeDuration))
+	}
+	g.Add(server.StartPodcastRefresher(*confPodcastRefreshInterval))
+	g.Add(server.StartTogetherUpdater(time.Hour))
+	g.Add(server.StartScrobbleRetrier(time.Minute))
+	g.Add(server.StartTranscodeWarmer())
+	g.Add(server.StartScanStopper())
+	// folders with an interval of their own are scanned on their own, the rest
+	// together
+	var scanDirs []string
+	for _, folder := range confMusicPaths {
+		if folder.ScanInterval > 0 {
+			g.Add(server.StartScanTicker(folder.ScanInterval, folder.Path))
+			continue
+		}
+		scanDirs = append(scanDirs, folder.Path)
+	}
+	if *confScanInterval > 0 && len(scanDirs) > 0 {
+		if len(scanDirs) == len(confMusicPaths) {
+			// a scan of every dir also cleans the ones which aren't music dirs any more
+			scanDirs = nil
+		}
 		tickerDur := time.Duration(*confScanInterval) * time.Minute
-		g.Add(server.StartScanTicker(tickerDur))
+		g.Add(server.StartScanTicker(tickerDur, scanDirs...))
 	}
 	if *confJukeboxEnabled {
 		g.Add(server.StartJukebox())
 	}
+	if len(notifySinks) > 0 && *confNotifyDiskMin > 0 {
+		g.Add(server.StartDiskCheck(cleanTimeDuration))
+	}
+	if *confDBBackupInterval > 0 {
+		g.Add(server.StartDBBackup(*confDBBackupInterval))
+	}
+	if *confMetricsListenAddr != "" {
+		g.Add(server.StartMetricsHTTP(*confMetricsListenAddr))
+	}
 
-	if err := g.Run(); err != nil {
-		log.Panicf("error in job: %v", err)
+	g.Add(run.SignalHandler(context.Background(), os.Interrupt, syscall.SIGTERM))
+
+	// the jobs have stopped once Run returns, so what's left can be finished
+	// before the db is closed
+	runErr := g.Run()
+	ctx, cancel := context.WithTimeout(context.Background(), *confShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("error shutting down: %v", err)
+	}
+	var sig run.SignalError
+	if runErr != nil && !errors.As(runErr, &sig) {
+		log.Panicf("error in job: %v", runErr)
 	}
+	log.Printf("stopped")
 }
 
-type musicPaths []string
+type musicPaths []db.MusicFolder
 
 func (m musicPaths) String() string {
-	return strings.Join(m, ", ")
+	var strs []string
+	for _, folder := range m {
+		if folder.Name != "" {
+			strs = append(strs, folder.Name+"="+folder.Path)
+			continue
+		}
+		strs = append(strs, folder.Path)
+	}
+	return strings.Join(strs, ", ")
 }
 
+// Set takes a path, or a name for it and the path like Name=/path
 func (m *musicPaths) Set(value string) error {
-	*m = append(*m, value)
+	folder := db.MusicFolder{Path: value}
+	if i := strings.Index(value, "="); i > 0 && !strings.ContainsRune(value[:i], filepath.Separator) {
+		folder.Name, folder.Path = value[:i], value[i+1:]
+	}
+	folder.Path = filepath.Clean(folder.Path)
+	*m = append(*m, folder)
+	return nil
+}
+
+func (m musicPaths) paths() []string {
+	paths := make([]string, 0, len(m))
+	for _, folder := range m {
+		paths = append(paths, folder.Path)
+	}
+	return paths
+}
+
+// scanIntervals are the music paths' own scan intervals, by their names
+type scanIntervals map[string]time.Duration
+
+func (s scanIntervals) String() string {
+	var strs []string
+	for name, interval := range s {
+		strs = append(strs, fmt.Sprintf("%s=%d", name, int(interval/time.Minute)))
+	}
+	sort.Strings(strs)
+	return strings.Join(strs, ", ")
+}
+
+// Set takes a music path's name and its interval in minutes, like Name=60
+func (s *scanIntervals) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("%q isn't like Name=60", value)
+	}
+	minutes, err := strconv.Atoi(value[i+1:])
+	if err != nil || minutes <= 0 {
+		return fmt.Errorf("%q isn't a number of minutes", value[i+1:])
+	}
+	if *s == nil {
+		*s = scanIntervals{}
+	}
+	(*s)[value[:i]] = time.Duration(minutes) * time.Minute
 	return nil
 }
+
+// apply sets the interval of each folder which has one. the name is matched
+// against the folder's own name, or else its base name
+func (s scanIntervals) apply(folders musicPaths) error {
+	matched := map[string]bool{}
+	for i := range folders {
+		name := folders[i].Name
+		if name == "" {
+			name = filepath.Base(folders[i].Path)
+		}
+		if interval, ok := s[name]; ok {
+			folders[i].ScanInterval = interval
+			matched[name] = true
+		}
+	}
+	for name := range s {
+		if !matched[name] {
+			return fmt.Errorf("no music path named %q", name)
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated flag, ignoring empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
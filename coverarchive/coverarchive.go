@@ -0,0 +1,275 @@
+// Package coverarchive fetches front covers from the musicbrainz cover art
+// archive, for albums with a release mbid but no cover in their folder
+package coverarchive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.senan.xyz/gonic"
+	"go.senan.xyz/gonic/db"
+)
+
+const (
+	BaseURL = "https://coverartarchive.org"
+	Source  = "coverartarchive"
+
+	// SettingEnabled is toggled from the admin page
+	SettingEnabled = "cover_archive_enabled"
+
+	// the archive has no hard limit, but asks to be treated like musicbrainz,
+	// which allows one request per second
+	defaultInterval = time.Second
+
+	// how long to wait before looking again for a release with no front cover
+	notFoundRetry = 30 * 24 * time.Hour
+	// the first wait after a failed request. it doubles with every attempt
+	errorRetry    = time.Hour
+	errorRetryMax = 7 * 24 * time.Hour
+	// how long to stop for if we're asked to slow down without a Retry-After
+	slowDownRetry = 5 * time.Minute
+)
+
+var (
+	ErrNotFound        = errors.New("release has no front cover")
+	ErrAlreadyFetching = errors.New("already fetching covers")
+	ErrDisabled        = errors.New("cover archive fetching is disabled")
+	errSlowDown        = errors.New("asked to slow down")
+	errNotImage        = errors.New("response isn't a supported image")
+)
+
+type Fetcher struct {
+	db *db.DB
+	// dir is where fetched covers are kept, unless writeMusicDir is set
+	dir           string
+	writeMusicDir bool
+	client        *http.Client
+	baseURL       string
+	interval      time.Duration
+	running       *int32
+	// pausedUntil is a unix time, set when the archive tells us to slow down
+	pausedUntil *int64
+}
+
+// New creates a fetcher which keeps covers in dir. if writeMusicDir is set, a
+// cover.jpg is written into the album's folder instead
+func New(dbc *db.DB, dir string, writeMusicDir bool) *Fetcher {
+	return &Fetcher{
+		db:            dbc,
+		dir:           dir,
+		writeMusicDir: writeMusicDir,
+		client:        &http.Client{Timeout: 30 * time.Second},
+		baseURL:       BaseURL,
+		interval:      defaultInterval,
+		running:       new(int32),
+		pausedUntil:   new(int64),
+	}
+}
+
+func (f *Fetcher) IsEnabled() bool {
+	enabled, _ := f.db.GetSetting(SettingEnabled)
+	return enabled == "true"
+}
+
+// FetchMissing looks up every album which has a release mbid and no cover, and
+// which is due a lookup. it returns early if the archive asks us to slow down
+func (f *Fetcher) FetchMissing(ctx context.Context) error {
+	if !f.IsEnabled() {
+		return ErrDisabled
+	}
+	if !atomic.CompareAndSwapInt32(f.running, 0, 1) {
+		return ErrAlreadyFetching
+	}
+	defer atomic.StoreInt32(f.running, 0)
+
+	if paused := time.Unix(atomic.LoadInt64(f.pausedUntil), 0); time.Now().Before(paused) {
+		log.Printf("skipping cover archive fetch until %s", paused.Format(time.RFC3339))
+		return nil
+	}
+
+	var albums []*db.Album
+	err := f.db.
+		Select("albums.*").
+		Joins("LEFT JOIN fetched_covers ON fetched_covers.album_id=albums.id").
+		Where("coalesce(albums.cover, '')='' AND coalesce(albums.tag_brainz_id, '')!=''").
+		Where("fetched_covers.album_id IS NULL OR (coalesce(fetched_covers.path, '')='' AND fetched_covers.next_attempt<=?)", time.Now()).
+		Order("albums.id").
+		Find(&albums).
+		Error
+	if err != nil {
+		return fmt.Errorf("find albums missing covers: %w", err)
+	}
+	if len(albums) == 0 {
+		return nil
+	}
+	log.Printf("fetching covers for %d albums from the cover art archive", len(albums))
+
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	var fetched int
+	for i, album := range albums {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+		}
+		err := f.fetchAlbum(ctx, album)
+		var slowDown *slowDownError
+		switch {
+		case errors.As(err, &slowDown):
+			atomic.StoreInt64(f.pausedUntil, slowDown.until.Unix())
+			log.Printf("cover art archive asked us to slow down, stopping until %s", slowDown.until.Format(time.RFC3339))
+			return nil
+		case err != nil:
+			log.Printf("error fetching cover for album %d: %v", album.ID, err)
+		default:
+			fetched++
+		}
+	}
+	log.Printf("fetched %d/%d covers from the cover art archive", fetched, len(albums))
+	return nil
+}
+
+func (f *Fetcher) fetchAlbum(ctx context.Context, album *db.Album) error {
+	record := &db.FetchedCover{AlbumID: album.ID}
+	if err := f.db.Where(db.FetchedCover{AlbumID: album.ID}).FirstOrInit(record).Error; err != nil {
+		return fmt.Errorf("find previous attempt: %w", err)
+	}
+	record.Source = Source
+	record.SourceURL = fmt.Sprintf("%s/release/%s/front-1200", f.baseURL, album.TagBrainzID)
+
+	err := f.download(ctx, album, record)
+	if errors.As(err, new(*slowDownError)) {
+		// not the release's fault, try it again next time
+		return err
+	}
+	now := time.Now()
+	record.Attempts++
+	switch {
+	case errors.Is(err, ErrNotFound):
+		record.Error = err.Error()
+		record.NextAttempt = now.Add(notFoundRetry)
+	case err != nil:
+		record.Error = err.Error()
+		record.NextAttempt = now.Add(retryAfter(record.Attempts))
+	default:
+		record.Error = ""
+		record.FetchedAt = &now
+	}
+	if err := f.db.Save(record).Error; err != nil {
+		return fmt.Errorf("save fetched cover: %w", err)
+	}
+	return err
+}
+
+func retryAfter(attempts int) time.Duration {
+	wait := errorRetry
+	for i := 1; i < attempts && wait < errorRetryMax; i++ {
+		wait *= 2
+	}
+	if wait > errorRetryMax {
+		wait = errorRetryMax
+	}
+	return wait
+}
+
+type slowDownError struct {
+	until time.Time
+}
+
+func (e *slowDownError) Error() string {
+	return fmt.Sprintf("%v until %s", errSlowDown, e.until.Format(time.RFC3339))
+}
+
+func (f *Fetcher) download(ctx context.Context, album *db.Album, record *db.FetchedCover) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, record.SourceURL, nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("%s/%s", gonic.Name, gonic.Version))
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("get cover: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		wait := slowDownRetry
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			wait = time.Duration(secs) * time.Second
+		}
+		return &slowDownError{until: time.Now().Add(wait)}
+	default:
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
+	var ext string
+	switch resp.Header.Get("Content-Type") {
+	case "image/jpeg":
+		ext = ".jpg"
+	case "image/png":
+		ext = ".png"
+	default:
+		return fmt.Errorf("%w: %q", errNotImage, resp.Header.Get("Content-Type"))
+	}
+
+	if f.writeMusicDir {
+		name := "cover" + ext
+		absPath := filepath.Join(album.RootDir, album.LeftPath, album.RightPath, name)
+		if err := writeFile(absPath, resp.Body); err != nil {
+			return err
+		}
+		// the scanner would find it next time anyway, but show it straight away
+		if err := f.db.Model(album).UpdateColumn("cover", name).Error; err != nil {
+			return fmt.Errorf("update album cover: %w", err)
+		}
+		record.Path = ""
+		return nil
+	}
+
+	name := album.TagBrainzID + ext
+	if err := os.MkdirAll(f.dir, os.ModePerm); err != nil {
+		return fmt.Errorf("create covers dir: %w", err)
+	}
+	if err := writeFile(filepath.Join(f.dir, name), resp.Body); err != nil {
+		return err
+	}
+	record.Path = name
+	return nil
+}
+
+// writeFile writes to a temporary file first, so that a half downloaded cover
+// is never served
+func writeFile(absPath string, r io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(absPath), ".cover-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write cover: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close cover: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), absPath); err != nil {
+		return fmt.Errorf("rename cover: %w", err)
+	}
+	return nil
+}
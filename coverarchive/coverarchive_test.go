@@ -0,0 +1,165 @@
+package coverarchive
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/mockfs"
+)
+
+type archiveMock struct {
+	requests int32
+}
+
+func (a *archiveMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&a.requests, 1)
+	switch mbid := strings.Split(r.URL.Path, "/")[2]; mbid {
+	case "found":
+		w.Header().Set("Content-Type", "image/jpeg")
+		_, _ = w.Write([]byte("jpeg"))
+	case "slow":
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFetcher(t *testing.T, m *mockfs.MockFS, writeMusicDir bool) (*Fetcher, *archiveMock) {
+	t.Helper()
+	archive := &archiveMock{}
+	server := httptest.NewServer(archive)
+	t.Cleanup(server.Close)
+
+	f := New(m.DB(), filepath.Join(m.TmpDir(), "covers"), writeMusicDir)
+	f.baseURL = server.URL
+	f.interval = time.Millisecond
+	if err := m.DB().SetSetting(SettingEnabled, "true"); err != nil {
+		t.Fatalf("enable: %v", err)
+	}
+	return f, archive
+}
+
+// setMBIDs gives the first albums with tracks the release ids in order
+func setMBIDs(t *testing.T, m *mockfs.MockFS, mbids ...string) []*db.Album {
+	t.Helper()
+	var albums []*db.Album
+	err := m.DB().
+		Where("tag_artist_id IS NOT NULL").
+		Order("id").
+		Limit(len(mbids)).
+		Find(&albums).
+		Error
+	if err != nil {
+		t.Fatalf("find albums: %v", err)
+	}
+	for i, album := range albums {
+		if err := m.DB().Model(album).UpdateColumn("tag_brainz_id", mbids[i]).Error; err != nil {
+			t.Fatalf("set mbid: %v", err)
+		}
+		album.TagBrainzID = mbids[i]
+	}
+	return albums
+}
+
+func TestFetchMissing(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+	m.AddItems()
+	m.ScanAndClean()
+
+	f, archive := newFetcher(t, m, false)
+	albums := setMBIDs(t, m, "found", "missing")
+	is.NoErr(f.FetchMissing(context.Background()))
+	is.Equal(atomic.LoadInt32(&archive.requests), int32(2))
+
+	var found db.FetchedCover
+	is.NoErr(m.DB().Where("album_id=?", albums[0].ID).First(&found).Error)
+	is.Equal(found.Source, Source)
+	is.Equal(found.Path, "found.jpg")
+	is.True(found.FetchedAt != nil)
+	data, err := os.ReadFile(filepath.Join(m.TmpDir(), "covers", "found.jpg"))
+	is.NoErr(err)
+	is.Equal(string(data), "jpeg")
+
+	var missing db.FetchedCover
+	is.NoErr(m.DB().Where("album_id=?", albums[1].ID).First(&missing).Error)
+	is.Equal(missing.Path, "")
+	is.Equal(missing.Attempts, 1)
+	is.True(missing.NextAttempt.After(time.Now().Add(notFoundRetry - time.Hour))) // not looked up again for a while
+
+	// nothing is due now
+	is.NoErr(f.FetchMissing(context.Background()))
+	is.Equal(atomic.LoadInt32(&archive.requests), int32(2))
+
+	// the folder's own cover is never replaced
+	var album db.Album
+	is.NoErr(m.DB().First(&album, albums[0].ID).Error)
+	is.Equal(album.Cover, "")
+}
+
+func TestFetchMissingSlowDown(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+	m.AddItems()
+	m.ScanAndClean()
+
+	f, archive := newFetcher(t, m, false)
+	setMBIDs(t, m, "slow", "found")
+	is.NoErr(f.FetchMissing(context.Background()))
+	is.Equal(atomic.LoadInt32(&archive.requests), int32(1)) // stopped after being told to slow down
+
+	var count int
+	is.NoErr(m.DB().Model(&db.FetchedCover{}).Count(&count).Error)
+	is.Equal(count, 0) // and the release isn't blamed
+
+	is.NoErr(f.FetchMissing(context.Background()))
+	is.Equal(atomic.LoadInt32(&archive.requests), int32(1)) // still paused
+}
+
+func TestFetchMissingWriteMusicDir(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+	m.AddItems()
+	m.ScanAndClean()
+
+	f, _ := newFetcher(t, m, true)
+	albums := setMBIDs(t, m, "found")
+	is.NoErr(f.FetchMissing(context.Background()))
+
+	var album db.Album
+	is.NoErr(m.DB().First(&album, albums[0].ID).Error)
+	is.Equal(album.Cover, "cover.jpg")
+	_, err := os.Stat(filepath.Join(album.RootDir, album.LeftPath, album.RightPath, "cover.jpg"))
+	is.NoErr(err)
+}
+
+func TestFetchMissingDisabled(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+	f := New(m.DB(), m.TmpDir(), false)
+	is.True(errors.Is(f.FetchMissing(context.Background()), ErrDisabled))
+}
+
+func TestRetryAfter(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	is.Equal(retryAfter(1), errorRetry)
+	is.Equal(retryAfter(2), 2*errorRetry)
+	is.Equal(retryAfter(100), errorRetryMax)
+}
@@ -1,11 +1,17 @@
 package db
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/matryer/is"
@@ -50,3 +56,393 @@ func TestMain(m *testing.M) {
 	log.SetOutput(io.Discard)
 	os.Exit(m.Run())
 }
+
+func TestScanLease(t *testing.T) {
+	is := is.New(t)
+
+	testDB, err := NewMock()
+	if err != nil {
+		t.Fatalf("error creating db: %v", err)
+	}
+	if err := testDB.Migrate(MigrationContext{}); err != nil {
+		t.Fatalf("error migrating db: %v", err)
+	}
+
+	prev, err := testDB.AcquireScanLease("/music", "a", time.Minute)
+	is.NoErr(err)
+	is.Equal(prev, "")
+
+	_, err = testDB.AcquireScanLease("/music", "b", time.Minute)
+	is.True(errors.Is(err, ErrScanLeaseHeld)) // a still holds it
+	is.NoErr(testDB.HeartbeatScanLease("/music", "a"))
+	is.True(errors.Is(testDB.HeartbeatScanLease("/music", "b"), ErrScanLeaseLost))
+
+	stale := time.Now().UTC().Add(-2 * time.Minute)
+	is.NoErr(testDB.Model(&ScanLease{}).Update("heartbeat_at", stale).Error)
+
+	prev, err = testDB.AcquireScanLease("/music", "b", time.Minute)
+	is.NoErr(err)
+	is.Equal(prev, "a") // b took over from a
+	is.True(errors.Is(testDB.HeartbeatScanLease("/music", "a"), ErrScanLeaseLost))
+
+	is.NoErr(testDB.ReleaseScanLease("/music", "a")) // a can't release b's lease
+	is.Equal(testDB.GetScanLease("/music").Holder, "b")
+	is.NoErr(testDB.ReleaseScanLease("/music", "b"))
+	is.True(testDB.GetScanLease("/music") == nil)
+}
+
+func TestScanLeasePerDir(t *testing.T) {
+	is := is.New(t)
+
+	testDB, err := NewMock()
+	if err != nil {
+		t.Fatalf("error creating db: %v", err)
+	}
+	if err := testDB.Migrate(MigrationContext{}); err != nil {
+		t.Fatalf("error migrating db: %v", err)
+	}
+
+	_, err = testDB.AcquireScanLease("/ssd", "a", time.Minute)
+	is.NoErr(err)
+	_, err = testDB.AcquireScanLease("/hdd", "b", time.Minute)
+	is.NoErr(err) // another dir can be scanned at the same time
+	_, err = testDB.AcquireScanLease("/hdd", "a", time.Minute)
+	is.True(errors.Is(err, ErrScanLeaseHeld))
+	is.True(errors.Is(testDB.HeartbeatScanLease("/hdd", "a"), ErrScanLeaseLost))
+
+	leases, err := testDB.GetScanLeases()
+	is.NoErr(err)
+	is.Equal(len(leases), 2)
+	is.Equal(leases[0].Dir, "/hdd")
+	is.Equal(leases[0].Holder, "b")
+
+	is.NoErr(testDB.ReleaseScanLease("/ssd", "a"))
+	is.True(testDB.GetScanLease("/ssd") == nil)
+	is.Equal(testDB.GetScanLease("/hdd").Holder, "b")
+}
+
+func TestRawRuleMatches(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		kind, pattern, path string
+		matches             bool
+	}{
+		{RawRuleExtension, "dsf", "artist/album/track.dsf", true},
+		{RawRuleExtension, ".dsf", "artist/album/track.DSF", true},
+		{RawRuleExtension, "dsf", "artist/album/track.flac", false},
+		{RawRuleExtension, "dsf", "artist/album.dsf/track.flac", false},
+		{RawRulePath, "hi-res/*/*.flac", "hi-res/album/track.flac", true},
+		{RawRulePath, "hi-res/*/*.flac", "hi-res/artist/album/track.flac", false},
+		{RawRulePath, "hi-res/**", "hi-res/artist/album/track.flac", true},
+		{RawRulePath, "hi-res/**", "hi-res-not/track.flac", false},
+		{"unknown", "dsf", "track.dsf", false},
+	}
+	for _, tc := range cases {
+		rule := &RawRule{Kind: tc.kind, Pattern: tc.pattern}
+		if actual := rule.Matches(tc.path); actual != tc.matches {
+			t.Errorf("%s %q on %q: expected %t, got %t", tc.kind, tc.pattern, tc.path, tc.matches, actual)
+		}
+	}
+}
+
+func TestPlaylistSetItems(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	added := func(p *Playlist) []int64 {
+		var ret []int64
+		for _, at := range p.GetItemsAddedAt() {
+			ret = append(ret, at.Unix())
+		}
+		return ret
+	}
+
+	p := &Playlist{Items: "1,2,1", ItemsAddedAt: "10,20,30"}
+	p.SetItems([]int{1, 1, 2}) // reordered, and repeats keep their own times in order
+	is.Equal(p.GetItems(), []int{1, 1, 2})
+	is.Equal(added(p), []int64{10, 30, 20})
+
+	p.SetItems([]int{2, 3})
+	is.Equal(p.TrackCount, 2)
+	is.Equal(added(p)[0], int64(20))
+	is.True(added(p)[1] >= time.Now().Add(-time.Minute).Unix()) // new
+}
+
+func TestCompareAndSetSetting(t *testing.T) {
+	is := is.New(t)
+	testDB, err := NewMock()
+	is.NoErr(err)
+	is.NoErr(testDB.Migrate(MigrationContext{}))
+
+	key := randKey()
+	ok, err := testDB.CompareAndSetSetting(key, "", "a") // never set
+	is.NoErr(err)
+	is.True(ok)
+	ok, err = testDB.CompareAndSetSetting(key, "", "b") // set since
+	is.NoErr(err)
+	is.True(!ok)
+	ok, err = testDB.CompareAndSetSetting(key, "a", "b")
+	is.NoErr(err)
+	is.True(ok)
+	ok, err = testDB.CompareAndSetSetting(key, "a", "c") // stale
+	is.NoErr(err)
+	is.True(!ok)
+	value, err := testDB.GetSetting(key)
+	is.NoErr(err)
+	is.Equal(value, "b")
+}
+
+func TestEditSettings(t *testing.T) {
+	is := is.New(t)
+	testDB, err := NewMock()
+	is.NoErr(err)
+	is.NoErr(testDB.Migrate(MigrationContext{}))
+
+	is.NoErr(testDB.SetSetting("key", "k0"))
+	is.NoErr(testDB.SetSetting("secret", "s0"))
+	get := func(key string) string {
+		value, err := testDB.GetSetting(key)
+		is.NoErr(err)
+		return value
+	}
+
+	// two admins render the same form
+	v := func(value string) string { return SettingVersion(value) }
+	formA := []SettingEdit{{"key", v("k0"), "k0"}, {"secret", v("s0"), "s0"}}
+	formB := []SettingEdit{{"key", v("k0"), "k0"}, {"secret", v("s0"), "s0"}}
+
+	// a changes the key, b changes the secret. they don't conflict
+	formA[0].Value = "kA"
+	_, err = testDB.EditSettings(formA)
+	is.NoErr(err)
+	formB[1].Value = "sB"
+	_, err = testDB.EditSettings(formB)
+	is.NoErr(err)
+	is.Equal(get("key"), "kA")
+	is.Equal(get("secret"), "sB")
+
+	// b, still with the old form, changes the key too
+	formB[0].Value = "kB"
+	formB[1].Value = "s0"
+	conflicts, err := testDB.EditSettings(formB)
+	is.True(errors.Is(err, ErrSettingConflict))
+	is.Equal(conflicts, []SettingConflict{{Key: "key", Current: "kA", Value: "kB"}})
+	is.Equal(get("key"), "kA")
+
+	// when one field conflicts, the others aren't saved either
+	formC := []SettingEdit{{"key", v("kA"), "kC"}, {"secret", v("sB"), "sC"}}
+	is.NoErr(testDB.SetSetting("key", "kX"))
+	conflicts, err = testDB.EditSettings(formC)
+	is.True(errors.Is(err, ErrSettingConflict))
+	is.Equal(conflicts, []SettingConflict{{Key: "key", Current: "kX", Value: "kC"}})
+	is.Equal(get("secret"), "sB")
+
+	// making the same change someone else made isn't a conflict
+	_, err = testDB.EditSettings([]SettingEdit{{"key", v("k0"), "kX"}})
+	is.NoErr(err)
+
+	// without a version, the edit always applies
+	_, err = testDB.EditSettings([]SettingEdit{{"key", "", "kC"}})
+	is.NoErr(err)
+	is.Equal(get("key"), "kC")
+}
+
+func TestSyncMusicFolders(t *testing.T) {
+	is := is.New(t)
+
+	testDB, err := NewMock()
+	if err != nil {
+		t.Fatalf("error creating db: %v", err)
+	}
+	// folders which were configured before get their indexes
+	if err := testDB.Migrate(MigrationContext{MusicPaths: []string{"/mnt/a/music", "/mnt/b/music"}}); err != nil {
+		t.Fatalf("error migrating db: %v", err)
+	}
+
+	folders, err := testDB.SyncMusicFolders([]MusicFolder{
+		{Path: "/mnt/c/music"},
+		{Path: "/mnt/b/music", Name: "Lossless"},
+		{Path: "/mnt/a/music"},
+	})
+	is.NoErr(err)
+	is.Equal(folders, []*MusicFolder{
+		{ID: 2, Path: "/mnt/c/music", Name: "music"},
+		{ID: 1, Path: "/mnt/b/music", Name: "Lossless"},
+		{ID: 0, Path: "/mnt/a/music", Name: "music"},
+	})
+
+	// and keep them, even when they're removed for a while
+	folders, err = testDB.SyncMusicFolders([]MusicFolder{{Path: "/mnt/c/music"}})
+	is.NoErr(err)
+	is.Equal(folders[0].ID, 2)
+	folders, err = testDB.SyncMusicFolders([]MusicFolder{{Path: "/mnt/d/music"}})
+	is.NoErr(err)
+	is.Equal(folders[0].ID, 3)
+}
+
+func TestBeginRetry(t *testing.T) {
+	is := is.New(t)
+	defer func(retries int, backoff time.Duration) {
+		busyRetries, busyBackoff = retries, backoff
+	}(busyRetries, busyBackoff)
+	busyRetries, busyBackoff = 3, 20*time.Millisecond
+
+	options := DefaultOptions()
+	options.Set("_busy_timeout", "10")
+	testDB, err := New(filepath.Join(t.TempDir(), "gonic.db"), options)
+	is.NoErr(err)
+	defer testDB.Close()
+	is.NoErr(testDB.Migrate(MigrationContext{}))
+	testDB.LogMode(false)
+
+	// another writer holds the lock for longer than the busy timeout
+	writer := testDB.Begin()
+	is.NoErr(writer.Error)
+	is.True(IsBusy(testDB.Begin().Error))
+	// but not for longer than the retries
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		writer.Commit()
+	}()
+	tx, err := testDB.BeginRetry()
+	is.NoErr(err)
+	is.NoErr(tx.SetSetting("retried", "true"))
+	is.NoErr(tx.Commit().Error)
+
+	// reads don't wait for the writer
+	writer = testDB.Begin()
+	is.NoErr(writer.Error)
+	defer writer.Rollback()
+	value, err := testDB.GetSetting("retried")
+	is.NoErr(err)
+	is.Equal(value, "true")
+}
+
+func TestPlayQueueRemoveItems(t *testing.T) {
+	is := is.New(t)
+	gone := map[int]struct{}{2: {}, 3: {}}
+	tcases := []struct {
+		items       []int
+		current     int
+		expItems    []int
+		expCurrent  int
+		expPosition int
+		expRemoved  int
+	}{
+		{[]int{1, 2, 3, 4}, 1, []int{1, 4}, 1, 30, 2}, // current is kept
+		{[]int{1, 2, 3, 4}, 2, []int{1, 4}, 4, 0, 2},  // the next one left
+		{[]int{1, 2, 3}, 3, []int{1}, 1, 0, 2},        // or the one before
+		{[]int{2, 3}, 2, []int{}, 0, 0, 2},            // or none
+		{[]int{1, 4}, 1, []int{1, 4}, 1, 30, 0},
+	}
+	for _, tc := range tcases {
+		queue := &PlayQueue{Current: tc.current, Position: 30}
+		queue.SetItems(tc.items)
+		is.Equal(queue.RemoveItems(gone), tc.expRemoved)
+		is.Equal(queue.GetItems(), tc.expItems)
+		is.Equal(queue.Current, tc.expCurrent)
+		is.Equal(queue.Position, tc.expPosition)
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	is := is.New(t)
+	testDB, err := NewMock()
+	is.NoErr(err)
+	defer testDB.Close()
+	is.NoErr(testDB.Migrate(MigrationContext{}))
+
+	artist := &Artist{Name: "artist"}
+	is.NoErr(testDB.Create(artist).Error)
+	root := &Album{RootDir: "/music", LeftPath: "", RightPath: "."}
+	is.NoErr(testDB.Create(root).Error)
+	album := &Album{RootDir: "/music", LeftPath: "a/", RightPath: "album", ParentID: root.ID, TagArtistID: artist.ID}
+	is.NoErr(testDB.Create(album).Error)
+	track := &Track{AlbumID: album.ID, ArtistID: artist.ID, Filename: "track.flac"}
+	is.NoErr(testDB.Create(track).Error)
+
+	report, err := testDB.CheckIntegrity()
+	is.NoErr(err)
+	is.True(report.OK())
+
+	// like rows left behind after a power loss
+	is.NoErr(testDB.Exec("PRAGMA foreign_keys=OFF").Error)
+	ghost := &Album{RootDir: "/music", LeftPath: "b/", RightPath: "ghost", ParentID: 900}
+	is.NoErr(testDB.Create(ghost).Error)
+	ghostChild := &Album{RootDir: "/music", LeftPath: "b/ghost/", RightPath: "cd1", ParentID: ghost.ID, TagArtistID: artist.ID}
+	is.NoErr(testDB.Create(ghostChild).Error)
+	ghostTrack := &Track{AlbumID: ghostChild.ID, ArtistID: artist.ID, Filename: "track.flac"}
+	is.NoErr(testDB.Create(ghostTrack).Error)
+	noArtist := &Album{RootDir: "/music", LeftPath: "c/", RightPath: "album", ParentID: root.ID, TagArtistID: 901}
+	is.NoErr(testDB.Create(noArtist).Error)
+	noAlbumTrack := &Track{AlbumID: 902, ArtistID: artist.ID, Filename: "track.flac"}
+	is.NoErr(testDB.Create(noAlbumTrack).Error)
+	noArtistTrack := &Track{AlbumID: album.ID, ArtistID: 903, Filename: "other.flac"}
+	is.NoErr(testDB.Create(noArtistTrack).Error)
+
+	report, err = testDB.CheckIntegrity()
+	is.NoErr(err)
+	is.True(!report.OK())
+	is.Equal(len(report.SQLite), 0)
+	found := map[string][]int{}
+	for _, check := range report.Checks {
+		found[check.Name] = check.IDs
+		is.Equal(check.Repaired, 0)
+	}
+	is.Equal(found["folders with a missing parent"], []int{ghost.ID})
+	is.Equal(found["albums with a missing artist"], []int{noArtist.ID})
+	is.Equal(found["tracks with a missing album"], []int{noAlbumTrack.ID})
+	is.Equal(found["tracks with a missing artist"], []int{noArtistTrack.ID})
+
+	// the ghost's folders and tracks go too, even without the foreign keys
+	report, err = testDB.RepairIntegrity()
+	is.NoErr(err)
+	repaired := map[string]int{}
+	for _, check := range report.Checks {
+		repaired[check.Name] = check.Repaired
+	}
+	is.Equal(repaired["folders with a missing parent"], 2)
+	is.Equal(repaired["albums with a missing artist"], 1)
+	is.Equal(repaired["tracks with a missing album"], 2)
+	is.Equal(repaired["tracks with a missing artist"], 1)
+
+	report, err = testDB.CheckIntegrity()
+	is.NoErr(err)
+	is.True(report.OK())
+	var cleared Album
+	is.NoErr(testDB.First(&cleared, noArtist.ID).Error)
+	is.Equal(cleared.TagArtistID, 0)
+	var tracks []*Track
+	is.NoErr(testDB.Find(&tracks).Error)
+	is.Equal(len(tracks), 1)
+	is.Equal(tracks[0].ID, track.ID)
+}
+
+func TestLogSlowQueries(t *testing.T) {
+	// not parallel, since it takes over the log
+	is := is.New(t)
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(io.Discard)
+
+	testDB, err := NewMock()
+	is.NoErr(err)
+	defer testDB.Close()
+	testDB.LogSlowQueries(time.Hour, true)
+	is.NoErr(testDB.Migrate(MigrationContext{}))
+	is.True(!strings.Contains(out.String(), "slow query")) // nothing is that slow
+
+	out.Reset()
+	testDB.LogSlowQueries(time.Nanosecond, true)
+	is.NoErr(testDB.SetSetting("key", "secret"))
+	var line struct {
+		Msg    string `json:"msg"`
+		Source string `json:"source"`
+		SQL    string `json:"sql"`
+	}
+	is.NoErr(json.NewDecoder(&out).Decode(&line))
+	is.Equal(line.Msg, "slow query")
+	is.True(strings.Contains(line.Source, "db.go:"))   // where the query was run
+	is.True(strings.Contains(line.SQL, "settings"))    // the query
+	is.True(!strings.Contains(out.String(), "secret")) // but not its values
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/jinzhu/gorm"
+)
+
+// IntegrityReport is what CheckIntegrity found wrong with the db
+type IntegrityReport struct {
+	// SQLite is what sqlite's integrity_check found wrong with the db file. gonic
+	// can't repair these, a backup has to be restored instead
+	SQLite []string
+	Checks []*IntegrityCheck
+}
+
+// IntegrityCheck is one of the checks for rows which point at rows which don't
+// exist, like after a power loss
+type IntegrityCheck struct {
+	Name string
+	// IDs are the rows found, and Repaired how many of them were repaired
+	IDs      []int
+	Repaired int
+}
+
+// OK is true if nothing was found wrong
+func (r *IntegrityReport) OK() bool {
+	if len(r.SQLite) > 0 {
+		return false
+	}
+	for _, check := range r.Checks {
+		if len(check.IDs) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Lines describes what was found, a line for each problem
+func (r *IntegrityReport) Lines() []string {
+	var lines []string
+	for _, problem := range r.SQLite {
+		lines = append(lines, fmt.Sprintf("sqlite: %s", problem))
+	}
+	for _, check := range r.Checks {
+		if len(check.IDs) == 0 {
+			continue
+		}
+		line := fmt.Sprintf("%d %s", len(check.IDs), check.Name)
+		if check.Repaired > 0 {
+			line += fmt.Sprintf(", %d repaired", check.Repaired)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// integrityCheck finds the rows of table which match where. a repair removes
+// them, or sets column to null if it has one
+type integrityCheck struct {
+	name   string
+	table  string
+	where  string
+	column string
+}
+
+// the checks are repaired in order, so that folders are removed before their
+// tracks are checked
+var integrityChecks = []integrityCheck{
+	{
+		name:  "folders with a missing parent",
+		table: "albums",
+		where: "parent_id IS NOT NULL AND parent_id NOT IN (SELECT id FROM albums)",
+	},
+	{
+		name:   "albums with a missing artist",
+		table:  "albums",
+		where:  "tag_artist_id IS NOT NULL AND tag_artist_id NOT IN (SELECT id FROM artists)",
+		column: "tag_artist_id",
+	},
+	{
+		name:  "tracks with a missing album",
+		table: "tracks",
+		where: "album_id NOT IN (SELECT id FROM albums)",
+	},
+	{
+		name:  "tracks with a missing artist",
+		table: "tracks",
+		where: "artist_id NOT IN (SELECT id FROM artists)",
+	},
+}
+
+// integrityRounds is how many times a check is repaired before giving up. each
+// round repairs a level of folders whose parents were removed by the last
+const integrityRounds = 100
+
+var errIntegrityRounds = errors.New("too many rounds of repairs")
+
+// CheckIntegrity checks the db file, and for rows which point at rows which
+// don't exist
+func (db *DB) CheckIntegrity() (*IntegrityReport, error) {
+	return db.checkIntegrity(false)
+}
+
+// RepairIntegrity is CheckIntegrity, which also removes the rows it finds, or
+// clears what they point at. albums which lose their artist are tagged again
+// by a full scan, and removed folders and tracks are added again by any scan
+func (db *DB) RepairIntegrity() (*IntegrityReport, error) {
+	return db.checkIntegrity(true)
+}
+
+func (db *DB) checkIntegrity(repair bool) (*IntegrityReport, error) {
+	report := &IntegrityReport{}
+	if !IsPostgres(db.DB) {
+		problems, err := db.sqliteIntegrity()
+		if err != nil {
+			return nil, fmt.Errorf("sqlite integrity check: %w", err)
+		}
+		report.SQLite = problems
+	}
+	for _, check := range integrityChecks {
+		result := &IntegrityCheck{Name: check.name}
+		report.Checks = append(report.Checks, result)
+		for round := 0; ; round++ {
+			if round == integrityRounds {
+				return nil, fmt.Errorf("repair %s: %w", check.name, errIntegrityRounds)
+			}
+			var ids []int
+			if err := db.Table(check.table).Where(check.where).Order("id").Pluck("id", &ids).Error; err != nil {
+				return nil, fmt.Errorf("check %s: %w", check.name, err)
+			}
+			result.IDs = append(result.IDs, ids...)
+			if !repair || len(ids) == 0 {
+				break
+			}
+			repaired, err := db.repairIntegrity(check, ids)
+			if err != nil {
+				return nil, fmt.Errorf("repair %s: %w", check.name, err)
+			}
+			result.Repaired += repaired
+		}
+	}
+	return report, nil
+}
+
+func (db *DB) sqliteIntegrity() ([]string, error) {
+	rows, err := db.Raw("PRAGMA integrity_check(100)").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var problem string
+		if err := rows.Scan(&problem); err != nil {
+			return nil, err
+		}
+		if problem != "ok" {
+			problems = append(problems, problem)
+		}
+	}
+	return problems, rows.Err()
+}
+
+func (db *DB) repairIntegrity(check integrityCheck, ids []int) (int, error) {
+	chunk := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		chunk = append(chunk, int64(id))
+	}
+	var repaired int
+	err := db.TransactionChunked(chunk, func(tx *gorm.DB, ids []int64) error {
+		// only the rows which are still broken, a folder's tracks may have been
+		// removed with it
+		query := fmt.Sprintf("DELETE FROM %s WHERE id IN (?) AND %s", check.table, check.where)
+		if check.column != "" {
+			query = fmt.Sprintf("UPDATE %s SET %s=NULL WHERE id IN (?) AND %s", check.table, check.column, check.where)
+		}
+		q := tx.Exec(query, ids)
+		if err := q.Error; err != nil {
+			return err
+		}
+		repaired += int(q.RowsAffected)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		if check.column != "" {
+			log.Printf("integrity repair: cleared %s of %s %d, one of the %s", check.column, check.table, id, check.name)
+			continue
+		}
+		log.Printf("integrity repair: removed %s %d, one of the %s", check.table, id, check.name)
+	}
+	return repaired, nil
+}
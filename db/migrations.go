@@ -1,7 +1,6 @@
 package db
 
 import (
-	"errors"
 	"fmt"
 	"log"
 
@@ -11,6 +10,8 @@ import (
 
 type MigrationContext struct {
 	OriginalMusicPath string
+	// MusicPaths are the configured music paths, in order
+	MusicPaths []string
 }
 
 func (db *DB) Migrate(ctx MigrationContext) error {
@@ -43,11 +44,54 @@ func (db *DB) Migrate(ctx MigrationContext) error {
 		construct(ctx, "202202241218", migratePublicPlaylist),
 		construct(ctx, "202204270903", migratePodcastDropUserID),
 		construct(ctx, "202206011628", migrateInternetRadioStations),
+		construct(ctx, "202206101425", migrateScanLease),
+		construct(ctx, "202206121940", migrateAlbumReleaseType),
+		construct(ctx, "202206151112", migrateStarsAndRatings),
+		construct(ctx, "202206171034", migrateAPIKeys),
+		construct(ctx, "202206181507", migrateUserArtistIndex),
+		construct(ctx, "202206191120", migrateGenreIDX),
+		construct(ctx, "202206201310", migrateUserStreamKey),
+		construct(ctx, "202206221045", migrateFetchedCovers),
+		construct(ctx, "202206231530", migrateAvatars),
+		construct(ctx, "202206241120", migrateRawRules),
+		construct(ctx, "202206251430", migrateChatMessages),
+		construct(ctx, "202206261105", migratePlaylistChangedAt),
+		construct(ctx, "202206271015", migratePlaylistImages),
+		construct(ctx, "202206281140", migrateListens),
+		construct(ctx, "202206291030", migrateTranscodePreferenceWarm),
+		construct(ctx, "202207011040", migrateUserLocale),
+		construct(ctx, "202207041120", migrateReplayGain),
+		construct(ctx, "202207081530", migratePodcastChapters),
+		construct(ctx, "202207121040", migrateDynamicRange),
+		construct(ctx, "202207141120", migrateMusicFolders),
+		construct(ctx, "202207181300", migrateBrainzIDs),
+		construct(ctx, "202207201130", migrateScanLeaseDirs),
+		construct(ctx, "202207221015", migratePlaylistFiles),
+		construct(ctx, "202207251040", migrateSmartPlaylists),
+		construct(ctx, "202207271030", migratePodcastAutoDownloadKeep),
+		construct(ctx, "202207291015", migratePodcastRefresh),
+		construct(ctx, "202208011030", migrateScrobbleRetries),
+		construct(ctx, "202208031040", migrateMaloja),
+		construct(ctx, "202208051120", migrateHistoryImports),
+		construct(ctx, "202208081030", migrateTrackPlays),
+		construct(ctx, "202208101040", migratePostgresNoCase),
+		construct(ctx, "202208121030", migrateLibraryIndexes),
+		construct(ctx, "202208121045", migrateTrackSearch),
+		construct(ctx, "202208151030", migrateUserMusicFolders),
+		construct(ctx, "202208171100", migrateUserReadOnly),
+		construct(ctx, "202208191000", migratePlaylistFileExported),
+		construct(ctx, "202208191200", migrateUserAnnotatedAt),
+		construct(ctx, "202208191400", migrateDropTrackSearch),
+		construct(ctx, "202208191600", migratePodcastEpisodeAutoDownloaded),
 	}
 
-	return gormigrate.
-		New(db.DB, options, migrations).
-		Migrate()
+	if err := gormigrate.New(db.DB, options, migrations).Migrate(); err != nil {
+		return err
+	}
+	if err := db.migrateSearch(); err != nil {
+		return fmt.Errorf("search index: %w", err)
+	}
+	return nil
 }
 
 func construct(ctx MigrationContext, id string, f func(*gorm.DB, MigrationContext) error) *gormigrate.Migration {
@@ -68,42 +112,29 @@ func construct(ctx MigrationContext, id string, f func(*gorm.DB, MigrationContex
 	}
 }
 
+// migrateInitSchema creates tables before the ones which reference them, which
+// postgres needs and sqlite doesn't mind
 func migrateInitSchema(tx *gorm.DB, _ MigrationContext) error {
 	return tx.AutoMigrate(
 		Genre{},
-		TrackGenre{},
-		AlbumGenre{},
-		Track{},
 		Artist{},
 		User{},
 		Setting{},
-		Play{},
 		Album{},
+		Track{},
+		TrackGenre{},
+		AlbumGenre{},
+		Play{},
 		Playlist{},
 		PlayQueue{},
 	).
 		Error
 }
 
-func migrateCreateInitUser(tx *gorm.DB, _ MigrationContext) error {
-	const (
-		initUsername = "admin"
-		initPassword = "admin"
-	)
-	err := tx.
-		Where("name=?", initUsername).
-		First(&User{}).
-		Error
-	if !errors.Is(err, gorm.ErrRecordNotFound) {
-		return nil
-	}
-
-	return tx.Create(&User{
-		Name:     initUsername,
-		Password: initPassword,
-		IsAdmin:  true,
-	}).
-		Error
+// migrateCreateInitUser used to create an admin with the password admin. new
+// installs create their first admin from the setup page instead
+func migrateCreateInitUser(_ *gorm.DB, _ MigrationContext) error {
+	return nil
 }
 
 func migrateMergePlaylist(tx *gorm.DB, _ MigrationContext) error {
@@ -141,14 +172,7 @@ func migrateAddGenre(tx *gorm.DB, _ MigrationContext) error {
 }
 
 func migrateUpdateTranscodePrefIDX(tx *gorm.DB, _ MigrationContext) error {
-	var hasIDX int
-	tx.
-		Select("1").
-		Table("sqlite_master").
-		Where("type = ?", "index").
-		Where("name = ?", "idx_user_id_client").
-		Count(&hasIDX)
-	if hasIDX == 1 {
+	if tx.Dialect().HasIndex("transcode_preferences", "idx_user_id_client") {
 		// index already exists
 		return nil
 	}
@@ -363,3 +387,407 @@ func migrateInternetRadioStations(tx *gorm.DB, _ MigrationContext) error {
 	).
 		Error
 }
+
+func migrateScanLease(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		ScanLease{},
+	).
+		Error
+}
+
+func migrateAlbumReleaseType(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		Album{},
+	).
+		Error
+}
+
+func migrateStarsAndRatings(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		ArtistStar{},
+		AlbumStar{},
+		TrackStar{},
+		ArtistRating{},
+		AlbumRating{},
+		TrackRating{},
+	).
+		Error
+}
+
+func migrateAPIKeys(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		APIKey{},
+	).
+		Error
+}
+
+func migrateUserArtistIndex(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		User{},
+	).
+		Error
+}
+
+func migrateGenreIDX(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		TrackGenre{},
+		AlbumGenre{},
+	).
+		Error
+}
+
+func migrateUserStreamKey(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		User{},
+	).
+		Error
+}
+
+func migrateFetchedCovers(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		FetchedCover{},
+	).
+		Error
+}
+
+func migrateAvatars(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		Avatar{},
+	).
+		Error
+}
+
+func migrateRawRules(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		RawRule{},
+	).
+		Error
+}
+
+func migrateUserMusicFolders(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		UserMusicFolder{},
+	).
+		Error
+}
+
+func migrateUserReadOnly(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		User{},
+	).
+		Error
+}
+
+func migratePlaylistFileExported(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		Playlist{},
+	).
+		Error
+}
+
+func migratePodcastEpisodeAutoDownloaded(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		PodcastEpisode{},
+	).
+		Error
+}
+
+func migrateUserAnnotatedAt(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		User{},
+	).
+		Error
+}
+
+func migrateChatMessages(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		ChatMessage{},
+	).
+		Error
+}
+
+func migratePlaylistChangedAt(tx *gorm.DB, _ MigrationContext) error {
+	step := tx.AutoMigrate(
+		Playlist{},
+	)
+	if err := step.Error; err != nil {
+		return fmt.Errorf("step auto migrate: %w", err)
+	}
+
+	// we don't know when existing tracks were added, the playlist's last update
+	// is the best guess
+	var playlists []*Playlist
+	if err := tx.Find(&playlists).Error; err != nil {
+		return fmt.Errorf("step find playlists: %w", err)
+	}
+	for _, playlist := range playlists {
+		addedAt := make([]int, len(playlist.GetItems()))
+		for i := range addedAt {
+			addedAt[i] = int(playlist.UpdatedAt.Unix())
+		}
+		step = tx.Model(playlist).UpdateColumns(map[string]interface{}{
+			"items_added_at": joinInt(addedAt, ","),
+			"changed_at":     playlist.UpdatedAt,
+		})
+		if err := step.Error; err != nil {
+			return fmt.Errorf("step backfill playlist %d: %w", playlist.ID, err)
+		}
+	}
+	return nil
+}
+
+func migratePlaylistImages(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		PlaylistImage{},
+	).
+		Error
+}
+
+func migrateListens(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		Listen{},
+		AlbumPair{},
+	).
+		Error
+}
+
+func migrateTranscodePreferenceWarm(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		TranscodePreference{},
+	).
+		Error
+}
+
+func migrateUserLocale(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		User{},
+	).
+		Error
+}
+
+func migrateReplayGain(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		Track{},
+		User{},
+	).
+		Error
+}
+
+func migratePodcastChapters(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		PodcastEpisode{},
+		PodcastChapter{},
+	).
+		Error
+}
+
+func migrateDynamicRange(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		Track{},
+		Album{},
+	).
+		Error
+}
+
+func migratePlaylistFiles(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		Playlist{},
+	).
+		Error
+}
+
+func migrateSmartPlaylists(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		Playlist{},
+	).
+		Error
+}
+
+// migratePodcastAutoDownloadKeep makes "latest" keep a number of episodes.
+// it used to download every new one, which is "all" now
+func migratePodcastAutoDownloadKeep(tx *gorm.DB, _ MigrationContext) error {
+	step := tx.AutoMigrate(
+		Podcast{},
+	)
+	if err := step.Error; err != nil {
+		return fmt.Errorf("step auto migrate: %w", err)
+	}
+	step = tx.Exec(`
+		UPDATE podcasts SET auto_download=? WHERE auto_download=?;
+	`, PodcastAutoDownloadAll, PodcastAutoDownloadLatest)
+	if err := step.Error; err != nil {
+		return fmt.Errorf("step update latest: %w", err)
+	}
+	return nil
+}
+
+func migratePodcastRefresh(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		Podcast{},
+	).
+		Error
+}
+
+func migrateScrobbleRetries(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		ScrobbleRetry{},
+	).
+		Error
+}
+
+func migrateMaloja(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		User{},
+	).
+		Error
+}
+
+func migrateHistoryImports(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		HistoryImport{},
+	).
+		Error
+}
+
+// migrateTrackPlays starts every track with no plays, since album plays don't
+// say which tracks were played. album plays are left as they are
+func migrateTrackPlays(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		TrackPlay{},
+	).
+		Error
+}
+
+// migratePostgresNoCase adds sqlite's NOCASE collation to postgres, so that
+// queries can sort and compare names with COLLATE NOCASE on either
+func migratePostgresNoCase(tx *gorm.DB, _ MigrationContext) error {
+	if !IsPostgres(tx) {
+		return nil
+	}
+	return tx.Exec(`
+		CREATE COLLATION IF NOT EXISTS nocase (provider = icu, locale = 'und-u-ks-level2', deterministic = false);
+	`).
+		Error
+}
+
+// migrateLibraryIndexes adds the indexes which big libraries were missing. a
+// track's album and artist were only found by reading every track, and the
+// newest albums by sorting all of them. albums(left_path, right_path) and
+// albums(tag_artist_id) are already covered by idx_album_abs_path and
+// idx_albums_tag_artist_id
+func migrateLibraryIndexes(tx *gorm.DB, _ MigrationContext) error {
+	return tx.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_tracks_album_id_filename ON tracks (album_id, filename);
+		CREATE INDEX IF NOT EXISTS idx_tracks_artist_id ON tracks (artist_id);
+		CREATE INDEX IF NOT EXISTS idx_albums_created_at ON albums (created_at);
+		CREATE INDEX IF NOT EXISTS idx_plays_user_id_album_id ON plays (user_id, album_id);
+	`).
+		Error
+}
+
+// migrateTrackSearch adds a full text index of the tracks' titles and artists on
+// sqlite, which triggers keep up to date. a LIKE '%term%' can't use an index,
+// so searches read every track. postgres carries on with ILIKE
+func migrateTrackSearch(tx *gorm.DB, _ MigrationContext) error {
+	if IsPostgres(tx) {
+		return nil
+	}
+	return tx.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS tracks_search USING fts4 (
+			content="tracks", tokenize=unicode61,
+			tag_title, tag_title_u_dec, tag_track_artist
+		);
+		CREATE TRIGGER IF NOT EXISTS tracks_search_before_update
+		BEFORE UPDATE OF tag_title, tag_title_u_dec, tag_track_artist ON tracks BEGIN
+			DELETE FROM tracks_search WHERE docid=old.id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS tracks_search_before_delete
+		BEFORE DELETE ON tracks BEGIN
+			DELETE FROM tracks_search WHERE docid=old.id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS tracks_search_after_update
+		AFTER UPDATE OF tag_title, tag_title_u_dec, tag_track_artist ON tracks BEGIN
+			INSERT INTO tracks_search (docid, tag_title, tag_title_u_dec, tag_track_artist)
+			VALUES (new.id, new.tag_title, new.tag_title_u_dec, new.tag_track_artist);
+		END;
+		CREATE TRIGGER IF NOT EXISTS tracks_search_after_insert
+		AFTER INSERT ON tracks BEGIN
+			INSERT INTO tracks_search (docid, tag_title, tag_title_u_dec, tag_track_artist)
+			VALUES (new.id, new.tag_title, new.tag_title_u_dec, new.tag_track_artist);
+		END;
+		INSERT INTO tracks_search (tracks_search) VALUES ('rebuild');
+	`).
+		Error
+}
+
+// migrateDropTrackSearch drops the tracks' full text index, and the triggers
+// which kept it up to date. the search index covers tracks too, so with fts5
+// there were two of them to keep up to date
+func migrateDropTrackSearch(tx *gorm.DB, _ MigrationContext) error {
+	if IsPostgres(tx) {
+		return nil
+	}
+	return tx.Exec(`
+		DROP TRIGGER IF EXISTS tracks_search_before_update;
+		DROP TRIGGER IF EXISTS tracks_search_before_delete;
+		DROP TRIGGER IF EXISTS tracks_search_after_update;
+		DROP TRIGGER IF EXISTS tracks_search_after_insert;
+		DROP TABLE IF EXISTS tracks_search;
+	`).
+		Error
+}
+
+// migrateScanLeaseDirs gives each music dir a lease of its own, and a last scan
+// time. the old lease was for every dir, so it's dropped, along with any scan
+// it guarded
+func migrateScanLeaseDirs(tx *gorm.DB, _ MigrationContext) error {
+	step := tx.Exec(`
+		DROP TABLE IF EXISTS scan_leases;
+	`)
+	if err := step.Error; err != nil {
+		return fmt.Errorf("step drop leases: %w", err)
+	}
+	return tx.AutoMigrate(
+		ScanLease{},
+		MusicFolder{},
+	).
+		Error
+}
+
+func migrateBrainzIDs(tx *gorm.DB, _ MigrationContext) error {
+	return tx.AutoMigrate(
+		Artist{},
+		Album{},
+		Track{},
+	).
+		Error
+}
+
+// migrateMusicFolders gives the configured music paths the IDs they had as
+// indexes, so that clients can keep using them. paths which albums are still
+// in but aren't configured any more get the IDs after
+func migrateMusicFolders(tx *gorm.DB, ctx MigrationContext) error {
+	step := tx.AutoMigrate(
+		MusicFolder{},
+	)
+	if err := step.Error; err != nil {
+		return fmt.Errorf("step auto migrate: %w", err)
+	}
+	paths := append([]string(nil), ctx.MusicPaths...)
+	var rootDirs []string
+	step = tx.
+		Model(Album{}).
+		Where("root_dir IS NOT NULL").
+		Order("root_dir").
+		Pluck("DISTINCT root_dir", &rootDirs)
+	if err := step.Error; err != nil {
+		return fmt.Errorf("step find root dirs: %w", err)
+	}
+	paths = append(paths, rootDirs...)
+	for _, path := range paths {
+		if _, err := addMusicFolder(tx, path); err != nil {
+			return fmt.Errorf("step add folder %q: %w", path, err)
+		}
+	}
+	return nil
+}
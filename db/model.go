@@ -47,7 +47,10 @@ type Artist struct {
 	NameUDec   string   `sql:"default: null"`
 	Albums     []*Album `gorm:"foreignkey:TagArtistID"`
 	AlbumCount int      `sql:"-"`
+	TrackCount int      `sql:"-"`
 	Cover      string   `sql:"default: null"`
+	// BrainzID is the musicbrainz id of the artist, from an album artist tag
+	BrainzID string `sql:"default: null"`
 }
 
 func (a *Artist) SID() *specid.ID {
@@ -98,6 +101,13 @@ type Track struct {
 	TagTrackNumber int      `sql:"default: null"`
 	TagDiscNumber  int      `sql:"default: null"`
 	TagBrainzID    string   `sql:"default: null"`
+	// the musicbrainz id of the first of the track's artists
+	TagArtistBrainzID string `sql:"default: null"`
+	// in dB, or nil if the file isn't tagged
+	TagReplayGainTrack *float64 `sql:"default: null"`
+	TagReplayGainAlbum *float64 `sql:"default: null"`
+	// the DR value, or nil if the file isn't tagged
+	TagDynamicRange *int `sql:"default: null"`
 }
 
 func (t *Track) AudioLength() int  { return t.Length }
@@ -171,14 +181,60 @@ type User struct {
 	LastFMSession     string `sql:"default: null"`
 	ListenBrainzURL   string `sql:"default: null"`
 	ListenBrainzToken string `sql:"default: null"`
+	MalojaURL         string `sql:"default: null"`
+	MalojaAPIKey      string `sql:"default: null"`
 	IsAdmin           bool   `sql:"default: null"`
+	// ArtistIndex controls which artists are listed when browsing by tags
+	ArtistIndex           string `sql:"default: null"`
+	ArtistIndexMinCredits int    `sql:"default: null"`
+	// StreamKey is mixed into signed stream URLs. rotating it revokes them all
+	StreamKey string `sql:"default: null"`
+	// Locale is the web UI's language, and how names are sorted when browsing.
+	// see package locale
+	Locale string `sql:"default: null"`
+	// ReplayGain is the gain applied to the user's transcodes. see
+	// transcode.ReplayGainMode
+	ReplayGain string `sql:"default: null"`
+	// IsReadOnly users can browse, search, and stream, but can't change
+	// anything like playlists, the jukebox, or their settings
+	IsReadOnly bool `sql:"default: null"`
+	// AnnotatedAt is when the user last played, starred, or rated something,
+	// which changes the responses with their plays and such
+	AnnotatedAt time.Time `sql:"default: null"`
+}
+
+// CanWrite is false for read only users. admins can always write
+func (u *User) CanWrite() bool {
+	return u.IsAdmin || !u.IsReadOnly
 }
 
+const (
+	// list every artist
+	ArtistIndexAll = ""
+	// only list artists with albums of their own
+	ArtistIndexAlbumArtists = "album_artists"
+	// list album artists, and artists credited on at least ArtistIndexMinCredits tracks
+	ArtistIndexCredited = "credited"
+)
+
 type Setting struct {
 	Key   string `gorm:"not null; primary_key; auto_increment:false" sql:"default: null"`
 	Value string `sql:"default: null"`
 }
 
+// MusicFolder is one of the music paths. its ID is kept in the db, so that it
+// doesn't change when the paths are reordered
+type MusicFolder struct {
+	ID   int    `gorm:"primary_key; auto_increment:false"`
+	Path string `gorm:"not null; unique_index" sql:"default: null"`
+	// LastScanAt is when a scan of the folder last finished
+	LastScanAt time.Time `sql:"default: null"`
+	// Name is from the config, or the path's base name, and ScanInterval is how
+	// often it's scanned, if it has an interval of its own
+	Name         string        `gorm:"-"`
+	ScanInterval time.Duration `gorm:"-"`
+}
+
 type Play struct {
 	ID      int `gorm:"primary_key"`
 	User    *User
@@ -189,28 +245,94 @@ type Play struct {
 	Count   int
 }
 
+// TrackPlay is how often a user played a track, and when they last did. Play
+// has the same for the track's album
+type TrackPlay struct {
+	ID      int `gorm:"primary_key"`
+	UserID  int `gorm:"not null; unique_index:idx_track_play" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	TrackID int `gorm:"not null; unique_index:idx_track_play" sql:"default: null; type:int REFERENCES tracks(id) ON DELETE CASCADE"`
+	Time    time.Time
+	Count   int
+}
+
+// Listen is a single play of an album, kept so that albums played in the same
+// listening session can be found. Play only has the latest
+type Listen struct {
+	ID      int       `gorm:"primary_key"`
+	UserID  int       `gorm:"not null; index" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	AlbumID int       `gorm:"not null" sql:"default: null; type:int REFERENCES albums(id) ON DELETE CASCADE"`
+	Time    time.Time `gorm:"not null; index" sql:"default: null"`
+}
+
+// HistoryImport is how far an import of a user's listening history from a
+// scrobbler got, so that running it again carries on from LastTime. Matched
+// and Unmatched count the listens of the latest run
+type HistoryImport struct {
+	ID        int `gorm:"primary_key"`
+	UpdatedAt time.Time
+	UserID    int    `gorm:"not null; unique_index:idx_history_import" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	Source    string `gorm:"not null; unique_index:idx_history_import" sql:"default: null"`
+	LastTime  time.Time
+	Matched   int
+	Unmatched int
+	Error     string
+}
+
+// ScrobbleRetry is a scrobble which a scrobbler failed to submit, to submit
+// again later. Scrobbler is the scrobbler's name
+type ScrobbleRetry struct {
+	ID          int `gorm:"primary_key"`
+	CreatedAt   time.Time
+	User        *User
+	UserID      int `gorm:"not null; unique_index:idx_scrobble_retry" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	Track       *Track
+	TrackID     int       `gorm:"not null; unique_index:idx_scrobble_retry" sql:"default: null; type:int REFERENCES tracks(id) ON DELETE CASCADE"`
+	Time        time.Time `gorm:"not null; unique_index:idx_scrobble_retry" sql:"default: null"`
+	Scrobbler   string    `gorm:"not null; unique_index:idx_scrobble_retry" sql:"default: null"`
+	Attempts    int
+	NextAttempt time.Time `gorm:"not null; index" sql:"default: null"`
+	Error       string
+}
+
+// AlbumPair scores how often two albums are played in the same listening
+// session. each pair is stored both ways round. see package together
+type AlbumPair struct {
+	AlbumID      int     `gorm:"primary_key; auto_increment:false" sql:"type:int REFERENCES albums(id) ON DELETE CASCADE"`
+	OtherAlbumID int     `gorm:"primary_key; auto_increment:false" sql:"type:int REFERENCES albums(id) ON DELETE CASCADE"`
+	Score        float64 `gorm:"not null" sql:"default: 0"`
+}
+
 type Album struct {
-	ID            int `gorm:"primary_key"`
-	CreatedAt     time.Time
-	UpdatedAt     time.Time
-	ModifiedAt    time.Time
-	LeftPath      string `gorm:"unique_index:idx_album_abs_path"`
-	RightPath     string `gorm:"not null; unique_index:idx_album_abs_path" sql:"default: null"`
-	RightPathUDec string `sql:"default: null"`
-	Parent        *Album
-	ParentID      int      `sql:"default: null; type:int REFERENCES albums(id) ON DELETE CASCADE"`
-	RootDir       string   `gorm:"unique_index:idx_album_abs_path" sql:"default: null"`
-	Genres        []*Genre `gorm:"many2many:album_genres"`
-	Cover         string   `sql:"default: null"`
-	TagArtist     *Artist
-	TagArtistID   int    `gorm:"index" sql:"default: null; type:int REFERENCES artists(id) ON DELETE CASCADE"`
-	TagTitle      string `sql:"default: null"`
-	TagTitleUDec  string `sql:"default: null"`
-	TagBrainzID   string `sql:"default: null"`
-	TagYear       int    `sql:"default: null"`
-	Tracks        []*Track
-	ChildCount    int `sql:"-"`
-	Duration      int `sql:"-"`
+	ID             int `gorm:"primary_key"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	ModifiedAt     time.Time
+	LeftPath       string `gorm:"unique_index:idx_album_abs_path"`
+	RightPath      string `gorm:"not null; unique_index:idx_album_abs_path" sql:"default: null"`
+	RightPathUDec  string `sql:"default: null"`
+	Parent         *Album
+	ParentID       int      `sql:"default: null; type:int REFERENCES albums(id) ON DELETE CASCADE"`
+	RootDir        string   `gorm:"unique_index:idx_album_abs_path" sql:"default: null"`
+	Genres         []*Genre `gorm:"many2many:album_genres"`
+	Cover          string   `sql:"default: null"`
+	TagArtist      *Artist
+	TagArtistID    int    `gorm:"index" sql:"default: null; type:int REFERENCES artists(id) ON DELETE CASCADE"`
+	TagTitle       string `sql:"default: null"`
+	TagTitleUDec   string `sql:"default: null"`
+	TagBrainzID    string `sql:"default: null"`
+	TagYear        int    `sql:"default: null"`
+	TagReleaseType string `sql:"default: null"`
+	// TagReleaseGroupBrainzID is the musicbrainz id of the album's release
+	// group, which is the same for each release of it
+	TagReleaseGroupBrainzID string `sql:"default: null"`
+	// DynamicRange is the album's DR value from its tags, or else estimated
+	// from its tracks'. nil if none of them are tagged
+	DynamicRange          *int `sql:"default: null"`
+	DynamicRangeEstimated bool `sql:"default: false"`
+	Tracks                []*Track
+	ChildCount            int `sql:"-"`
+	Duration              int `sql:"-"`
+	PlayCount             int `sql:"-"`
 }
 
 func (a *Album) SID() *specid.ID {
@@ -228,6 +350,61 @@ func (a *Album) IndexRightPath() string {
 	return a.RightPath
 }
 
+// IsCompilation is true if the album's release type says it's a compilation
+func (a *Album) IsCompilation() bool {
+	for _, t := range ReleaseTypes(a.TagReleaseType) {
+		if t == "compilation" {
+			return true
+		}
+	}
+	return false
+}
+
+// the groups of an artist's discography, in the order they're listed
+const (
+	ReleaseGroupAlbums       = "albums"
+	ReleaseGroupEPsSingles   = "eps_singles"
+	ReleaseGroupLive         = "live"
+	ReleaseGroupCompilations = "compilations"
+	ReleaseGroupAppearsOn    = "appears_on"
+)
+
+var ReleaseGroups = []string{
+	ReleaseGroupAlbums,
+	ReleaseGroupEPsSingles,
+	ReleaseGroupLive,
+	ReleaseGroupCompilations,
+	ReleaseGroupAppearsOn,
+}
+
+// ReleaseGroup buckets the album's release type into a group of its artist's
+// discography. albums the artist only appears on are ReleaseGroupAppearsOn,
+// which is up to the caller to know
+func (a *Album) ReleaseGroup() string {
+	group := ReleaseGroupAlbums
+	for _, t := range ReleaseTypes(a.TagReleaseType) {
+		switch t {
+		case "compilation":
+			return ReleaseGroupCompilations
+		case "live":
+			group = ReleaseGroupLive
+		case "ep", "single":
+			if group == ReleaseGroupAlbums {
+				group = ReleaseGroupEPsSingles
+			}
+		}
+	}
+	return group
+}
+
+// ReleaseTypes splits a musicbrainz release type, which may have secondary
+// types such as "album; live" or "album/compilation"
+func ReleaseTypes(releaseType string) []string {
+	return strings.FieldsFunc(strings.ToLower(releaseType), func(r rune) bool {
+		return r == ';' || r == '/' || r == ',' || r == ' '
+	})
+}
+
 func (a *Album) GenreStrings() []string {
 	strs := make([]string, 0, len(a.Genres))
 	for _, genre := range a.Genres {
@@ -247,17 +424,93 @@ type Playlist struct {
 	TrackCount int
 	Items      string
 	IsPublic   bool `sql:"default: null"`
+	// ItemsAddedAt has the unix time each of Items was added
+	ItemsAddedAt string
+	// ChangedAt only moves when the playlist or its tracks change, unlike
+	// UpdatedAt which moves on every save
+	ChangedAt time.Time
+	// File is the file in the playlists dir the playlist was imported from or
+	// exported to, if any. FileModTime is its mod time when it was, and
+	// FileUnresolved the number of its entries which weren't found in the
+	// library
+	File           string    `gorm:"index" sql:"default: null"`
+	FileModTime    time.Time `sql:"default: null"`
+	FileUnresolved int       `sql:"default: null"`
+	// FileExported is set for playlists which were made by a client and then
+	// exported, rather than imported from their file. they aren't deleted
+	// when the file is
+	FileExported bool `sql:"default: null"`
+	// IsSmart is set for playlists built from the rules of their file, which
+	// can't be changed by hand
+	IsSmart bool `sql:"default: null"`
+}
+
+// PlaylistImage is an image uploaded for a playlist, which is used as its cover
+// instead of a mosaic of its albums' covers
+type PlaylistImage struct {
+	PlaylistID int `gorm:"primary_key; auto_increment:false" sql:"type:int REFERENCES playlists(id) ON DELETE CASCADE"`
+	Playlist   *Playlist
+	Image      []byte
+	UpdatedAt  time.Time
 }
 
 func (p *Playlist) GetItems() []int {
 	return splitInt(p.Items, ",")
 }
 
+// GetItemsAddedAt returns when each of the playlist's tracks was added
+func (p *Playlist) GetItemsAddedAt() []time.Time {
+	items := p.GetItems()
+	addedAt := splitInt(p.ItemsAddedAt, ",")
+	ret := make([]time.Time, len(items))
+	for i := range items {
+		if i < len(addedAt) {
+			ret[i] = time.Unix(int64(addedAt[i]), 0)
+		}
+	}
+	return ret
+}
+
+// SetItems replaces the playlist's tracks. tracks which were already in the
+// playlist keep the time they were added, so that a reorder isn't an addition
 func (p *Playlist) SetItems(items []int) {
+	prevAddedAt := map[int][]time.Time{}
+	prevItems := p.GetItems()
+	for i, addedAt := range p.GetItemsAddedAt() {
+		prevAddedAt[prevItems[i]] = append(prevAddedAt[prevItems[i]], addedAt)
+	}
+	now := int(time.Now().Unix())
+	addedAt := make([]int, 0, len(items))
+	for _, id := range items {
+		if prev := prevAddedAt[id]; len(prev) > 0 {
+			addedAt = append(addedAt, int(prev[0].Unix()))
+			prevAddedAt[id] = prev[1:]
+			continue
+		}
+		addedAt = append(addedAt, now)
+	}
 	p.Items = joinInt(items, ",")
+	p.ItemsAddedAt = joinInt(addedAt, ",")
 	p.TrackCount = len(items)
 }
 
+// RemoveItems removes the tracks in ids from the playlist, and returns how many
+// items it removed
+func (p *Playlist) RemoveItems(ids map[int]struct{}) int {
+	items := p.GetItems()
+	kept := make([]int, 0, len(items))
+	for _, id := range items {
+		if _, ok := ids[id]; !ok {
+			kept = append(kept, id)
+		}
+	}
+	if len(kept) == len(items) {
+		return 0
+	}
+	p.SetItems(kept)
+	return len(items) - len(kept)
+}
+
 type PlayQueue struct {
 	ID        int `gorm:"primary_key"`
 	CreatedAt time.Time
@@ -282,32 +535,119 @@ func (p *PlayQueue) SetItems(items []int) {
 	p.Items = joinInt(items, ",")
 }
 
+// RemoveItems removes the tracks in ids from the queue, and returns how many
+// items it removed. if the current track is removed, the queue carries on from
+// the start of the next track left, or the one before if it was last
+func (p *PlayQueue) RemoveItems(ids map[int]struct{}) int {
+	items := p.GetItems()
+	kept := make([]int, 0, len(items))
+	next := -1
+	for _, id := range items {
+		if id == p.Current && next == -1 {
+			next = len(kept)
+		}
+		if _, ok := ids[id]; !ok {
+			kept = append(kept, id)
+		}
+	}
+	if len(kept) == len(items) {
+		return 0
+	}
+	if _, ok := ids[p.Current]; ok {
+		p.Position = 0
+		switch {
+		case next == -1 || len(kept) == 0:
+			p.Current = 0
+		case next < len(kept):
+			p.Current = kept[next]
+		default:
+			p.Current = kept[len(kept)-1]
+		}
+	}
+	p.SetItems(kept)
+	return len(items) - len(kept)
+}
+
 type TranscodePreference struct {
 	User    *User
 	UserID  int    `gorm:"not null; unique_index:idx_user_id_client" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
 	Client  string `gorm:"not null; unique_index:idx_user_id_client" sql:"default: null"`
 	Profile string `gorm:"not null" sql:"default: null"`
+	// Warm transcodes new tracks with Profile ahead of time
+	Warm bool `sql:"default: null"`
 }
 
 type TrackGenre struct {
 	Track   *Track
 	TrackID int `gorm:"not null; unique_index:idx_track_id_genre_id" sql:"default: null; type:int REFERENCES tracks(id) ON DELETE CASCADE"`
 	Genre   *Genre
-	GenreID int `gorm:"not null; unique_index:idx_track_id_genre_id" sql:"default: null; type:int REFERENCES genres(id) ON DELETE CASCADE"`
+	GenreID int `gorm:"not null; unique_index:idx_track_id_genre_id; index" sql:"default: null; type:int REFERENCES genres(id) ON DELETE CASCADE"`
 }
 
 type AlbumGenre struct {
 	Album   *Album
 	AlbumID int `gorm:"not null; unique_index:idx_album_id_genre_id" sql:"default: null; type:int REFERENCES albums(id) ON DELETE CASCADE"`
 	Genre   *Genre
-	GenreID int `gorm:"not null; unique_index:idx_album_id_genre_id" sql:"default: null; type:int REFERENCES genres(id) ON DELETE CASCADE"`
+	GenreID int `gorm:"not null; unique_index:idx_album_id_genre_id; index" sql:"default: null; type:int REFERENCES genres(id) ON DELETE CASCADE"`
+}
+
+type ArtistStar struct {
+	User     *User
+	UserID   int `gorm:"not null; unique_index:idx_artist_star_user_id_artist_id" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	Artist   *Artist
+	ArtistID int `gorm:"not null; unique_index:idx_artist_star_user_id_artist_id" sql:"default: null; type:int REFERENCES artists(id) ON DELETE CASCADE"`
+	StarDate time.Time
+}
+
+type AlbumStar struct {
+	User     *User
+	UserID   int `gorm:"not null; unique_index:idx_album_star_user_id_album_id" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	Album    *Album
+	AlbumID  int `gorm:"not null; unique_index:idx_album_star_user_id_album_id" sql:"default: null; type:int REFERENCES albums(id) ON DELETE CASCADE"`
+	StarDate time.Time
+}
+
+type TrackStar struct {
+	User     *User
+	UserID   int `gorm:"not null; unique_index:idx_track_star_user_id_track_id" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	Track    *Track
+	TrackID  int `gorm:"not null; unique_index:idx_track_star_user_id_track_id" sql:"default: null; type:int REFERENCES tracks(id) ON DELETE CASCADE"`
+	StarDate time.Time
+}
+
+type ArtistRating struct {
+	User     *User
+	UserID   int `gorm:"not null; unique_index:idx_artist_rating_user_id_artist_id" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	Artist   *Artist
+	ArtistID int `gorm:"not null; unique_index:idx_artist_rating_user_id_artist_id" sql:"default: null; type:int REFERENCES artists(id) ON DELETE CASCADE"`
+	Rating   int `gorm:"not null"`
+}
+
+type AlbumRating struct {
+	User    *User
+	UserID  int `gorm:"not null; unique_index:idx_album_rating_user_id_album_id" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	Album   *Album
+	AlbumID int `gorm:"not null; unique_index:idx_album_rating_user_id_album_id" sql:"default: null; type:int REFERENCES albums(id) ON DELETE CASCADE"`
+	Rating  int `gorm:"not null"`
+}
+
+type TrackRating struct {
+	User    *User
+	UserID  int `gorm:"not null; unique_index:idx_track_rating_user_id_track_id" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	Track   *Track
+	TrackID int `gorm:"not null; unique_index:idx_track_rating_user_id_track_id" sql:"default: null; type:int REFERENCES tracks(id) ON DELETE CASCADE"`
+	Rating  int `gorm:"not null"`
 }
 
 type PodcastAutoDownload string
 
 const (
+	// PodcastAutoDownloadLatest downloads the newest of the new episodes, and
+	// keeps AutoDownloadKeep downloaded at most
 	PodcastAutoDownloadLatest PodcastAutoDownload = "latest"
-	PodcastAutoDownloadNone   PodcastAutoDownload = "none"
+	// PodcastAutoDownloadAll downloads every new episode, and keeps them all
+	PodcastAutoDownloadAll  PodcastAutoDownload = "all"
+	PodcastAutoDownloadNone PodcastAutoDownload = "none"
 )
 
 type Podcast struct {
@@ -322,6 +662,16 @@ type Podcast struct {
 	Error        string
 	Episodes     []*PodcastEpisode
 	AutoDownload PodcastAutoDownload
+	// AutoDownloadKeep is how many episodes PodcastAutoDownloadLatest keeps
+	AutoDownloadKeep int
+	// ETag and LastModified are from the last fetch of the feed, so that it's
+	// only downloaded again if it changed
+	ETag         string
+	LastModified string
+	// RefreshFailures is how many refreshes in a row failed, and Error why the
+	// last did. the feed isn't refreshed on schedule until RefreshAfter
+	RefreshFailures int
+	RefreshAfter    *time.Time
 }
 
 func (p *Podcast) SID() *specid.ID {
@@ -355,6 +705,27 @@ type PodcastEpisode struct {
 	Filename    string
 	Status      PodcastEpisodeStatus
 	Error       string
+	// from the feed's itunes tags, 0 if it doesn't number its episodes
+	EpisodeNumber int
+	SeasonNumber  int
+	// ChaptersURL is the feed's podcast:chapters json, fetched when the episode
+	// is new in a refresh, and when it's downloaded
+	ChaptersURL string
+	Chapters    []*PodcastChapter
+	// AutoDownloaded is true if the podcast's auto download setting downloaded
+	// the episode, rather than someone by hand. only those are deleted to keep
+	// the latest few
+	AutoDownloaded bool
+}
+
+// PodcastChapter is a chapter of a podcast episode, in the order they're played
+type PodcastChapter struct {
+	ID               int     `gorm:"primary_key"`
+	PodcastEpisodeID int     `gorm:"not null; index" sql:"default: null; type:int REFERENCES podcast_episodes(id) ON DELETE CASCADE"`
+	StartTime        float64 // in seconds
+	Title            string
+	URL              string
+	ImageURL         string
 }
 
 func (pe *PodcastEpisode) AudioLength() int  { return pe.Length }
@@ -407,3 +778,106 @@ type InternetRadioStation struct {
 func (ir *InternetRadioStation) SID() *specid.ID {
 	return &specid.ID{Type: specid.InternetRadioStation, Value: ir.ID}
 }
+
+// ScanLease guards the scan of a music dir across processes, with a row for each
+// dir being scanned. the holder must keep HeartbeatAt fresh while scanning,
+// otherwise the lease is considered stale and may be taken over by another
+// scanner
+type ScanLease struct {
+	ID          int    `gorm:"primary_key"`
+	Dir         string `gorm:"not null; unique_index" sql:"default: null"`
+	Holder      string
+	AcquiredAt  time.Time
+	HeartbeatAt time.Time
+}
+
+func (sl *ScanLease) IsStale(after time.Duration) bool {
+	return time.Since(sl.HeartbeatAt) > after
+}
+
+// APIKey lets a user authenticate without their password. only a hash of the
+// key is stored, the key itself is shown once when it's created
+type APIKey struct {
+	ID        int `gorm:"primary_key"`
+	User      *User
+	UserID    int    `gorm:"not null; index" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	Name      string `gorm:"not null" sql:"default: null"`
+	KeyHash   string `gorm:"not null; unique_index" sql:"default: null"`
+	CreatedAt time.Time
+	LastUsed  *time.Time
+}
+
+// FetchedCover is a cover for an album which had none in its folder, found
+// from an outside source such as the cover art archive. albums which couldn't
+// be fetched get a row too, so they aren't looked up again until NextAttempt
+type FetchedCover struct {
+	AlbumID     int `gorm:"primary_key; auto_increment:false" sql:"type:int REFERENCES albums(id) ON DELETE CASCADE"`
+	Album       *Album
+	Source      string `sql:"default: null"`
+	SourceURL   string `sql:"default: null"`
+	Path        string `sql:"default: null"`
+	FetchedAt   *time.Time
+	Attempts    int       `sql:"default: null"`
+	NextAttempt time.Time `gorm:"index"`
+	Error       string    `sql:"default: null"`
+}
+
+// Avatar is a user's uploaded avatar, stored as a png at each of a few sizes
+type Avatar struct {
+	User      *User
+	UserID    int `gorm:"not null; unique_index:idx_avatar_user_id_size" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	Size      int `gorm:"not null; unique_index:idx_avatar_user_id_size" sql:"default: null"`
+	Image     []byte
+	UpdatedAt time.Time
+}
+
+const (
+	// RawRuleExtension patterns are file extensions, eg. "dsf"
+	RawRuleExtension = "extension"
+	// RawRulePath patterns are globs matched against the path inside the music
+	// or podcasts dir, eg. "hi-res/*/*.flac". a trailing "/**" matches anything
+	// below a directory
+	RawRulePath = "path"
+)
+
+// RawRule marks files which are always streamed as they are, never transcoded,
+// no matter the client's transcode preference or requested bitrate
+type RawRule struct {
+	ID        int    `gorm:"primary_key"`
+	Kind      string `gorm:"not null" sql:"default: null"`
+	Pattern   string `gorm:"not null" sql:"default: null"`
+	CreatedAt time.Time
+}
+
+func (r *RawRule) Matches(relPath string) bool {
+	switch r.Kind {
+	case RawRuleExtension:
+		return strings.EqualFold(path.Ext(relPath), "."+strings.TrimPrefix(r.Pattern, "."))
+	case RawRulePath:
+		if dir := strings.TrimSuffix(r.Pattern, "/**"); dir != r.Pattern {
+			return strings.HasPrefix(relPath, dir+"/")
+		}
+		ok, _ := path.Match(r.Pattern, relPath)
+		return ok
+	default:
+		return false
+	}
+}
+
+type ChatMessage struct {
+	ID        int `gorm:"primary_key"`
+	User      *User
+	UserID    int       `sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	Message   string    `gorm:"not null" sql:"default: null"`
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// UserMusicFolder grants a user one of the music folders. users who haven't
+// been granted any can see all of them
+type UserMusicFolder struct {
+	User        *User
+	UserID      int `gorm:"not null; unique_index:idx_user_id_music_folder_id" sql:"default: null; type:int REFERENCES users(id) ON DELETE CASCADE"`
+	MusicFolder *MusicFolder
+	// MusicFolderID has no null default, since the first folder's is 0
+	MusicFolderID int `gorm:"not null; unique_index:idx_user_id_music_folder_id" sql:"type:int REFERENCES music_folders(id) ON DELETE CASCADE"`
+}
@@ -0,0 +1,155 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// the kinds of row in the search index. a row's rowid is its ref*4+kind, so
+// that a row can be found without the index
+const (
+	SearchArtist = 1
+	SearchAlbum  = 2
+	SearchTrack  = 3
+)
+
+const settingSearchStale = "search_stale"
+
+// SearchRowID is the rowid in the search index of kind's ref
+func SearchRowID(kind, ref int) int {
+	return ref*4 + kind
+}
+
+// HasSearch is true if the db has the full text search index of artists, albums,
+// and tracks. it needs sqlite built with fts5, like with `-tags sqlite_fts5`
+func (db *DB) HasSearch() bool {
+	if IsPostgres(db.DB) || !hasFTS5(db.DB) {
+		return false
+	}
+	var count int
+	if err := db.Raw("SELECT count(*) FROM sqlite_master WHERE type='table' AND name='search'").Row().Scan(&count); err != nil {
+		return false
+	}
+	return count > 0
+}
+
+func hasFTS5(tx *gorm.DB) bool {
+	var used int
+	if err := tx.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Row().Scan(&used); err != nil {
+		return false
+	}
+	return used == 1
+}
+
+// migrateSearch makes the search index, if sqlite has fts5. which isn't known
+// until gonic is running, so it isn't a migration. a build without fts5 can't
+// keep the index up to date, so it marks it stale, and the next build with
+// fts5 makes it again
+func (db *DB) migrateSearch() error {
+	if IsPostgres(db.DB) {
+		return nil
+	}
+	var count int
+	if err := db.Raw("SELECT count(*) FROM sqlite_master WHERE type='table' AND name='search'").Row().Scan(&count); err != nil {
+		return fmt.Errorf("find index: %w", err)
+	}
+	if !hasFTS5(db.DB) {
+		if count > 0 {
+			return db.SetSetting(settingSearchStale, "true")
+		}
+		return nil
+	}
+	stale, err := db.GetSetting(settingSearchStale)
+	if err != nil {
+		return fmt.Errorf("get stale: %w", err)
+	}
+	if count > 0 && stale == "" {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		step := tx.Exec(`
+			DROP TABLE IF EXISTS search;
+			CREATE VIRTUAL TABLE search USING fts5 (
+				name, name_u_dec, artist, artist_u_dec,
+				tokenize='unicode61 remove_diacritics 2'
+			);
+			-- a match in the name is worth more than one in the artist
+			INSERT INTO search (search, rank) VALUES ('rank', 'bm25(2.0, 2.0, 1.0, 1.0)');
+			INSERT INTO search (rowid, name, name_u_dec)
+			SELECT id*4+?, name, name_u_dec
+			FROM artists;
+			INSERT INTO search (rowid, name, name_u_dec, artist, artist_u_dec)
+			SELECT albums.id*4+?, albums.tag_title, albums.tag_title_u_dec, artists.name, artists.name_u_dec
+			FROM albums
+			JOIN artists ON artists.id=albums.tag_artist_id;
+			INSERT INTO search (rowid, name, name_u_dec, artist, artist_u_dec)
+			SELECT tracks.id*4+?, tracks.tag_title, tracks.tag_title_u_dec, tracks.tag_track_artist, artists.name_u_dec
+			FROM tracks
+			JOIN artists ON artists.id=tracks.artist_id;
+		`, SearchArtist, SearchAlbum, SearchTrack)
+		if err := step.Error; err != nil {
+			return fmt.Errorf("step create: %w", err)
+		}
+		return tx.Where("key=?", settingSearchStale).Delete(&Setting{}).Error
+	})
+}
+
+// IndexArtist, IndexAlbum, and IndexTrack set the row of the artist, album, or
+// track in the search index. the scanner calls them if HasSearch
+func IndexArtist(tx *gorm.DB, artist *Artist) error {
+	return setSearchRow(tx, SearchArtist, artist.ID, artist.Name, artist.NameUDec, "", "")
+}
+
+func IndexAlbum(tx *gorm.DB, album *Album, artist *Artist) error {
+	return setSearchRow(tx, SearchAlbum, album.ID, album.TagTitle, album.TagTitleUDec, artist.Name, artist.NameUDec)
+}
+
+func IndexTrack(tx *gorm.DB, track *Track, artist *Artist) error {
+	return setSearchRow(tx, SearchTrack, track.ID, track.TagTitle, track.TagTitleUDec, track.TagTrackArtist, artist.NameUDec)
+}
+
+func setSearchRow(tx *gorm.DB, kind, ref int, name, nameUDec, artist, artistUDec string) error {
+	rowID := SearchRowID(kind, ref)
+	if err := tx.Exec("DELETE FROM search WHERE rowid=?", rowID).Error; err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	err := tx.
+		Exec("INSERT INTO search (rowid, name, name_u_dec, artist, artist_u_dec) VALUES (?, ?, ?, ?, ?)",
+			rowID, name, nameUDec, artist, artistUDec).
+		Error
+	if err != nil {
+		return fmt.Errorf("insert: %w", err)
+	}
+	return nil
+}
+
+// Unindex removes kind's refs from the search index
+func Unindex(tx *gorm.DB, kind int, refs []int64) error {
+	if len(refs) == 0 {
+		return nil
+	}
+	rowIDs := make([]int64, 0, len(refs))
+	for _, ref := range refs {
+		rowIDs = append(rowIDs, int64(SearchRowID(kind, int(ref))))
+	}
+	return tx.Exec("DELETE FROM search WHERE rowid IN (?)", rowIDs).Error
+}
+
+// SearchJoin joins the search index's rows of kind to the rows with the id
+// column
+func SearchJoin(kind int, column string) string {
+	return fmt.Sprintf("JOIN search ON %s=search.rowid/4 AND search.rowid%%4=%d", column, kind)
+}
+
+// SearchMatch is a MATCH expression for the search index, for rows with words
+// starting with every term, in any order. the terms are quoted, so that
+// punctuation in them isn't read as syntax
+func SearchMatch(terms []string) string {
+	phrases := make([]string, 0, len(terms))
+	for _, term := range terms {
+		phrases = append(phrases, fmt.Sprintf(`"%s"*`, strings.ReplaceAll(term, `"`, `""`)))
+	}
+	return strings.Join(phrases, " ")
+}
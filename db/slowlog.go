@@ -0,0 +1,77 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// gormLogger is the interface of gorm's loggers, which isn't exported
+type gormLogger interface {
+	Print(v ...interface{})
+}
+
+// slowLogger logs queries which take at least min, and passes everything else
+// gorm logs, like errors, to next
+type slowLogger struct {
+	min  time.Duration
+	json bool
+	next gormLogger
+}
+
+type slowQueryJSON struct {
+	Time       time.Time `json:"time"`
+	Msg        string    `json:"msg"`
+	DurationMS float64   `json:"duration_ms"`
+	Source     string    `json:"source"`
+	SQL        string    `json:"sql"`
+}
+
+// Print gets values like "sql", source, duration, sql, vars, rows affected for
+// each query. the vars aren't logged, they can have passwords and such
+func (l *slowLogger) Print(v ...interface{}) {
+	if len(v) < 4 || v[0] != "sql" {
+		l.next.Print(v...)
+		return
+	}
+	took, _ := v[2].(time.Duration)
+	if took < l.min {
+		return
+	}
+	source := fmt.Sprint(v[1])
+	query := fmt.Sprint(v[3])
+	if !l.json {
+		log.Printf("slow query in %v from %s: %s", took.Round(time.Millisecond), source, query)
+		return
+	}
+	data, err := json.Marshal(slowQueryJSON{
+		Time:       time.Now(),
+		Msg:        "slow query",
+		DurationMS: float64(took.Microseconds()) / 1000,
+		Source:     source,
+		SQL:        query,
+	})
+	if err != nil {
+		log.Printf("error marshalling slow query: %v", err)
+		return
+	}
+	fmt.Fprintln(log.Writer(), string(data))
+}
+
+// LogSlowQueries logs queries which take at least min, with the file and line
+// which ran them, like the handler. it's as json lines if asJSON. it should be
+// called before the db is used
+func (db *DB) LogSlowQueries(min time.Duration, asJSON bool) {
+	if min <= 0 {
+		return
+	}
+	db.SetLogger(&slowLogger{
+		min:  min,
+		json: asJSON,
+		next: gormLog,
+	})
+	// gorm only times queries in its detailed mode, whose queries go to the
+	// logger above instead of being printed
+	db.LogMode(true)
+}
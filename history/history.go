@@ -0,0 +1,327 @@
+// Package history imports users' listening history from scrobblers, so that
+// what they played before using gonic counts towards their play stats, like
+// getAlbumList?type=frequent
+package history
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/scrobble/lastfm"
+	"go.senan.xyz/gonic/trackmatch"
+)
+
+const (
+	SourceLastFM       = "lastfm"
+	SourceListenBrainz = "listenbrainz"
+)
+
+// batchSize is how many listens are imported before where the import got to
+// is saved
+const batchSize = 500
+
+// pageWait is how long to wait between pages of last.fm history, to stay
+// under its rate limit
+var pageWait = 250 * time.Millisecond
+
+var ErrRunning = errors.New("an import is already running")
+
+// Listen is a play of a track in a scrobbler's history
+type Listen struct {
+	Time  time.Time
+	Query trackmatch.Query
+}
+
+// Status is the latest import from a source
+type Status struct {
+	*db.HistoryImport
+	Running bool
+}
+
+type importKey struct {
+	userID int
+	source string
+}
+
+type Importer struct {
+	db *db.DB
+	// recentTracks is lastfm.UserGetRecentTracks, except in tests
+	recentTracks func(apiKey, username string, from, to time.Time, page int) (lastfm.RecentTracks, error)
+
+	mu      sync.Mutex
+	running map[importKey]struct{}
+}
+
+func New(dbc *db.DB) *Importer {
+	return &Importer{
+		db:           dbc,
+		recentTracks: lastfm.UserGetRecentTracks,
+		running:      map[importKey]struct{}{},
+	}
+}
+
+// Statuses are the user's imports, by source
+func (im *Importer) Statuses(userID int) ([]*Status, error) {
+	var imports []*db.HistoryImport
+	if err := im.db.Where("user_id=?", userID).Order("source").Find(&imports).Error; err != nil {
+		return nil, fmt.Errorf("find imports: %w", err)
+	}
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	statuses := make([]*Status, 0, len(imports))
+	for _, imp := range imports {
+		_, running := im.running[importKey{userID, imp.Source}]
+		statuses = append(statuses, &Status{HistoryImport: imp, Running: running})
+	}
+	return statuses, nil
+}
+
+// StartLastFM imports the scrobbles of the last.fm user username, in the
+// background. they're fetched from where the last import got to
+func (im *Importer) StartLastFM(userID int, apiKey, username string) error {
+	imp, err := im.start(userID, SourceLastFM)
+	if err != nil {
+		return err
+	}
+	go im.run(imp, func() error {
+		return im.importLastFM(imp, apiKey, username)
+	})
+	return nil
+}
+
+// StartListenBrainz imports the listens of a listenbrainz export, in the
+// background. ones from before where the last import got to are skipped
+func (im *Importer) StartListenBrainz(userID int, listens []Listen) error {
+	imp, err := im.start(userID, SourceListenBrainz)
+	if err != nil {
+		return err
+	}
+	go im.run(imp, func() error {
+		var todo []Listen
+		for _, listen := range listens {
+			if !listen.Time.Before(imp.LastTime) {
+				todo = append(todo, listen)
+			}
+		}
+		sort.SliceStable(todo, func(i, j int) bool {
+			return todo[i].Time.Before(todo[j].Time)
+		})
+		m := newMatcher(im.db)
+		for len(todo) > 0 {
+			n := len(todo)
+			if n > batchSize {
+				n = batchSize
+			}
+			if err := im.apply(imp, m, todo[:n]); err != nil {
+				return err
+			}
+			todo = todo[n:]
+		}
+		return nil
+	})
+	return nil
+}
+
+func (im *Importer) start(userID int, source string) (*db.HistoryImport, error) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	key := importKey{userID, source}
+	if _, ok := im.running[key]; ok {
+		return nil, ErrRunning
+	}
+	imp := &db.HistoryImport{}
+	err := im.db.
+		Where(db.HistoryImport{UserID: userID, Source: source}).
+		FirstOrCreate(imp).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("find import: %w", err)
+	}
+	imp.Matched = 0
+	imp.Unmatched = 0
+	imp.Error = ""
+	if err := im.db.Save(imp).Error; err != nil {
+		return nil, fmt.Errorf("save import: %w", err)
+	}
+	im.running[key] = struct{}{}
+	return imp, nil
+}
+
+func (im *Importer) run(imp *db.HistoryImport, importFunc func() error) {
+	err := importFunc()
+	if err != nil {
+		log.Printf("error importing %s history for user %d: %v", imp.Source, imp.UserID, err)
+		imp.Error = err.Error()
+		if err := im.db.Save(imp).Error; err != nil {
+			log.Printf("error saving import: %v", err)
+		}
+	}
+	log.Printf("imported %s history for user %d, %d listens matched, %d unmatched", imp.Source, imp.UserID, imp.Matched, imp.Unmatched)
+	im.mu.Lock()
+	delete(im.running, importKey{imp.UserID, imp.Source})
+	im.mu.Unlock()
+}
+
+// importLastFM goes through the pages of scrobbles from the oldest, so that
+// where it got to can be saved as it goes
+func (im *Importer) importLastFM(imp *db.HistoryImport, apiKey, username string) error {
+	to := time.Now()
+	first, err := im.recentTracks(apiKey, username, imp.LastTime, to, 1)
+	if err != nil {
+		return fmt.Errorf("get page 1: %w", err)
+	}
+	m := newMatcher(im.db)
+	for page := first.TotalPages; page >= 1; page-- {
+		resp := first
+		if page > 1 {
+			time.Sleep(pageWait)
+			if resp, err = im.recentTracks(apiKey, username, imp.LastTime, to, page); err != nil {
+				return fmt.Errorf("get page %d: %w", page, err)
+			}
+		}
+		var listens []Listen
+		for i := len(resp.Tracks) - 1; i >= 0; i-- {
+			track := resp.Tracks[i]
+			if track.NowPlaying || track.Date.UTS == 0 {
+				continue
+			}
+			listens = append(listens, Listen{
+				Time: time.Unix(track.Date.UTS, 0),
+				Query: trackmatch.Query{
+					RecordingMBID: track.MBID,
+					Artist:        track.Artist.Name,
+					Title:         track.Name,
+				},
+			})
+		}
+		if err := im.apply(imp, m, listens); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply adds the listens which matched to the user's play stats, and saves
+// how far the import got. listens which were already added, like ones which
+// were scrobbled through gonic, are skipped
+func (im *Importer) apply(imp *db.HistoryImport, m *matcher, listens []Listen) error {
+	// matched before the transaction, so that it isn't held open, keeping other
+	// writers waiting, while the library is searched
+	tracks := make([]*db.Track, len(listens))
+	for i, listen := range listens {
+		track, err := m.match(listen.Query)
+		if err != nil {
+			return err
+		}
+		tracks[i] = track
+	}
+	// imp only changes if the transaction is committed, so that a failed
+	// batch is tried again next time
+	next := *imp
+	err := im.db.Transaction(func(tx *gorm.DB) error {
+		for i, listen := range listens {
+			if listen.Time.After(next.LastTime) {
+				next.LastTime = listen.Time
+			}
+			if tracks[i] == nil {
+				next.Unmatched++
+				continue
+			}
+			next.Matched++
+			if err := addListen(tx, next.UserID, tracks[i], listen.Time); err != nil {
+				return err
+			}
+		}
+		if err := tx.Save(&next).Error; err != nil {
+			return fmt.Errorf("save import: %w", err)
+		}
+		if err := db.UserAnnotated(tx, next.UserID); err != nil {
+			return fmt.Errorf("save user: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*imp = next
+	return nil
+}
+
+// addListen counts a play of the track and its album, unless there already
+// is one at that second. scrobblers only keep seconds, but gonic's own
+// listens can have more
+func addListen(tx *gorm.DB, userID int, track *db.Track, stamp time.Time) error {
+	albumID := track.AlbumID
+	var count int
+	err := tx.
+		Model(&db.Listen{}).
+		Where("user_id=? AND album_id=? AND time>=? AND time<?", userID, albumID, stamp, stamp.Add(time.Second)).
+		Count(&count).
+		Error
+	if err != nil {
+		return fmt.Errorf("find listen: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	if err := tx.Create(&db.Listen{UserID: userID, AlbumID: albumID, Time: stamp}).Error; err != nil {
+		return fmt.Errorf("save listen: %w", err)
+	}
+	play := db.Play{UserID: userID, AlbumID: albumID}
+	if err := tx.Where(play).First(&play).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("find stat: %w", err)
+	}
+	play.Count++
+	if stamp.After(play.Time) {
+		play.Time = stamp
+	}
+	if err := tx.Save(&play).Error; err != nil {
+		return fmt.Errorf("save stat: %w", err)
+	}
+	trackPlay := db.TrackPlay{UserID: userID, TrackID: track.ID}
+	if err := tx.Where(trackPlay).First(&trackPlay).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("find track stat: %w", err)
+	}
+	trackPlay.Count++
+	if stamp.After(trackPlay.Time) {
+		trackPlay.Time = stamp
+	}
+	if err := tx.Save(&trackPlay).Error; err != nil {
+		return fmt.Errorf("save track stat: %w", err)
+	}
+	return nil
+}
+
+// matcher remembers the tracks it found, since history has the same tracks
+// over and over
+type matcher struct {
+	db     *db.DB
+	tracks map[trackmatch.Query]*db.Track
+}
+
+func newMatcher(dbc *db.DB) *matcher {
+	return &matcher{db: dbc, tracks: map[trackmatch.Query]*db.Track{}}
+}
+
+// match is the track for q, or nil if there's none
+func (m *matcher) match(q trackmatch.Query) (*db.Track, error) {
+	if track, ok := m.tracks[q]; ok {
+		return track, nil
+	}
+	track, err := trackmatch.Match(m.db, q)
+	switch {
+	case errors.Is(err, trackmatch.ErrNoMatch):
+		track = nil
+	case err != nil:
+		return nil, fmt.Errorf("match %q: %w", q, err)
+	}
+	m.tracks[q] = track
+	return track, nil
+}
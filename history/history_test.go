@@ -0,0 +1,256 @@
+package history
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/mockfs"
+	"go.senan.xyz/gonic/scrobble/lastfm"
+	"go.senan.xyz/gonic/trackmatch"
+)
+
+func TestMain(m *testing.M) {
+	pageWait = 0
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func newLibrary(t *testing.T) (*mockfs.MockFS, *db.User, *db.Album, *db.Album) {
+	t.Helper()
+	is := is.New(t)
+	m := mockfs.New(t)
+	setTags := func(path, artist, album, title, mbid string) {
+		m.AddTrack(path)
+		m.SetTags(path, func(tags *mockfs.Tags) error {
+			tags.RawArtist = artist
+			tags.RawAlbumArtist = artist
+			tags.RawAlbum = album
+			tags.RawTitle = title
+			tags.RawBrainzID = mbid
+			return nil
+		})
+	}
+	setTags("a/a.flac", "Aphex Twin", "Windowlicker", "Windowlicker", "mbid-a")
+	setTags("b/b.flac", "Sigur Rós", "Takk...", "Hoppípolla", "")
+	m.ScanAndClean()
+
+	user := m.DB().GetUserByName("admin")
+	is.True(user != nil)
+	var a, b db.Album
+	is.NoErr(m.DB().Where("tag_title=?", "Windowlicker").First(&a).Error)
+	is.NoErr(m.DB().Where("tag_title=?", "Takk...").First(&b).Error)
+	return m, user, &a, &b
+}
+
+func waitForImport(t *testing.T, im *Importer, userID int, source string) *Status {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		statuses, err := im.Statuses(userID)
+		if err != nil {
+			t.Fatalf("get statuses: %v", err)
+		}
+		for _, status := range statuses {
+			if status.Source == source && !status.Running {
+				return status
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("import didn't finish")
+	return nil
+}
+
+func playCount(t *testing.T, dbc *db.DB, userID, albumID int) int {
+	t.Helper()
+	var play db.Play
+	err := dbc.Where("user_id=? AND album_id=?", userID, albumID).First(&play).Error
+	if err != nil {
+		return 0
+	}
+	return play.Count
+}
+
+// fakeLastFM pages scrobbles like user.getRecentTracks, two at a time
+type fakeLastFM struct {
+	mu        sync.Mutex
+	scrobbles []lastfm.RecentTrack // newest first
+	froms     []time.Time
+}
+
+func (f *fakeLastFM) add(stamp time.Time, artist, title, mbid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var track lastfm.RecentTrack
+	track.Name = title
+	track.MBID = mbid
+	track.Artist.Name = artist
+	track.Date.UTS = stamp.Unix()
+	f.scrobbles = append([]lastfm.RecentTrack{track}, f.scrobbles...)
+}
+
+func (f *fakeLastFM) recentTracks(_, _ string, from, to time.Time, page int) (lastfm.RecentTracks, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.froms = append(f.froms, from)
+	var tracks []lastfm.RecentTrack
+	for _, track := range f.scrobbles {
+		if track.Date.UTS >= from.Unix() && track.Date.UTS <= to.Unix() {
+			tracks = append(tracks, track)
+		}
+	}
+	var nowPlaying lastfm.RecentTrack
+	nowPlaying.NowPlaying = true
+	nowPlaying.Name = "Windowlicker"
+	nowPlaying.Artist.Name = "Aphex Twin"
+	resp := lastfm.RecentTracks{Page: page, Total: len(tracks), TotalPages: (len(tracks) + 1) / 2}
+	if page == 1 {
+		resp.Tracks = append(resp.Tracks, nowPlaying)
+	}
+	for i := (page - 1) * 2; i < len(tracks) && i < page*2; i++ {
+		resp.Tracks = append(resp.Tracks, tracks[i])
+	}
+	return resp, nil
+}
+
+func TestImportLastFM(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m, user, a, b := newLibrary(t)
+	dbc := m.DB()
+
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	fake := &fakeLastFM{}
+	fake.add(base, "Aphex Twin", "Windowlicker", "mbid-a")
+	fake.add(base.Add(10*time.Minute), "sigur ros", "hoppipolla", "")
+	fake.add(base.Add(20*time.Minute), "Boards of Canada", "Roygbiv", "")
+	fake.add(base.Add(30*time.Minute), "Sigur Rós", "Hoppípolla", "")
+
+	// the first was played through gonic too, with more than seconds
+	is.NoErr(dbc.Create(&db.Listen{UserID: user.ID, AlbumID: a.ID, Time: base.Add(300 * time.Millisecond)}).Error)
+	is.NoErr(dbc.Create(&db.Play{UserID: user.ID, AlbumID: a.ID, Time: base, Count: 1}).Error)
+
+	im := New(dbc)
+	im.recentTracks = fake.recentTracks
+	is.NoErr(im.StartLastFM(user.ID, "key", "user"))
+	status := waitForImport(t, im, user.ID, SourceLastFM)
+	is.Equal(status.Error, "")
+	is.Equal(status.Matched, 3)
+	is.Equal(status.Unmatched, 1)
+	is.Equal(status.LastTime.Unix(), base.Add(30*time.Minute).Unix())
+	is.Equal(playCount(t, dbc, user.ID, a.ID), 1) // not counted twice
+	is.Equal(playCount(t, dbc, user.ID, b.ID), 2)
+	is.True(fake.froms[0].IsZero())
+
+	// again, from where it got to
+	fake.add(base.Add(40*time.Minute), "Aphex Twin", "Windowlicker", "")
+	is.NoErr(im.StartLastFM(user.ID, "key", "user"))
+	status = waitForImport(t, im, user.ID, SourceLastFM)
+	is.Equal(status.Error, "")
+	is.Equal(fake.froms[len(fake.froms)-1].Unix(), base.Add(30*time.Minute).Unix())
+	is.Equal(playCount(t, dbc, user.ID, a.ID), 2)
+	is.Equal(playCount(t, dbc, user.ID, b.ID), 2)
+
+	var listens int
+	is.NoErr(dbc.Model(&db.Listen{}).Where("user_id=?", user.ID).Count(&listens).Error)
+	is.Equal(listens, 4)
+}
+
+func TestImportListenBrainz(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m, user, a, b := newLibrary(t)
+	dbc := m.DB()
+
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	listens := []Listen{
+		{Time: base.Add(10 * time.Minute), Query: trackmatch.Query{Artist: "Sigur Rós", Title: "Hoppípolla"}},
+		{Time: base, Query: trackmatch.Query{RecordingMBID: "mbid-a"}},
+		{Time: base.Add(20 * time.Minute), Query: trackmatch.Query{Artist: "Aphex Twin", Title: "Xtal"}},
+	}
+	im := New(dbc)
+	is.NoErr(im.StartListenBrainz(user.ID, listens))
+	status := waitForImport(t, im, user.ID, SourceListenBrainz)
+	is.Equal(status.Matched, 2)
+	is.Equal(status.Unmatched, 1)
+	is.Equal(status.LastTime.Unix(), base.Add(20*time.Minute).Unix())
+	is.Equal(playCount(t, dbc, user.ID, a.ID), 1)
+	is.Equal(playCount(t, dbc, user.ID, b.ID), 1)
+
+	// the same export again, with a newer listen
+	listens = append(listens, Listen{Time: base.Add(30 * time.Minute), Query: trackmatch.Query{RecordingMBID: "mbid-a"}})
+	is.NoErr(im.StartListenBrainz(user.ID, listens))
+	status = waitForImport(t, im, user.ID, SourceListenBrainz)
+	is.Equal(status.Matched, 1)
+	is.Equal(status.Unmatched, 1) // the last one again, from the same second
+	is.Equal(playCount(t, dbc, user.ID, a.ID), 2)
+	is.Equal(playCount(t, dbc, user.ID, b.ID), 1)
+}
+
+func TestImportRunning(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m, user, _, _ := newLibrary(t)
+
+	block := make(chan struct{})
+	im := New(m.DB())
+	im.recentTracks = func(_, _ string, _, _ time.Time, _ int) (lastfm.RecentTracks, error) {
+		<-block
+		return lastfm.RecentTracks{}, errors.New("offline")
+	}
+	is.NoErr(im.StartLastFM(user.ID, "key", "user"))
+	is.True(errors.Is(im.StartLastFM(user.ID, "key", "user"), ErrRunning))
+	is.NoErr(im.StartListenBrainz(user.ID, nil)) // another source is fine
+	close(block)
+	status := waitForImport(t, im, user.ID, SourceLastFM)
+	is.True(strings.Contains(status.Error, "offline"))
+}
+
+const listenBrainzListen = `{"listened_at": 1600000000, "track_metadata": {"artist_name": "Aphex Twin", "track_name": "Windowlicker", "additional_info": {"recording_mbid": "mbid-a"}}}`
+const listenBrainzMapped = `{"listened_at": 1600000060, "track_metadata": {"artist_name": "Sigur Rós", "track_name": "Hoppípolla", "additional_info": {}, "mbid_mapping": {"recording_mbid": "mbid-b"}}}`
+
+func TestReadListenBrainz(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	expected := []Listen{
+		{Time: time.Unix(1600000000, 0), Query: trackmatch.Query{RecordingMBID: "mbid-a", Artist: "Aphex Twin", Title: "Windowlicker"}},
+		{Time: time.Unix(1600000060, 0), Query: trackmatch.Query{RecordingMBID: "mbid-b", Artist: "Sigur Rós", Title: "Hoppípolla"}},
+	}
+
+	// older exports are an array
+	listens, err := ReadListenBrainz(strings.NewReader("\n[" + listenBrainzListen + ",\n" + listenBrainzMapped + "]"))
+	is.NoErr(err)
+	is.Equal(listens, expected)
+
+	// newer ones are a zip of a listen per line
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	f, err := archive.Create("listens/2020/9.jsonl")
+	is.NoErr(err)
+	_, err = io.WriteString(f, listenBrainzListen+"\n"+listenBrainzMapped+"\n")
+	is.NoErr(err)
+	f, err = archive.Create("user.json")
+	is.NoErr(err)
+	_, err = io.WriteString(f, `{"user_name": "user"}`)
+	is.NoErr(err)
+	is.NoErr(archive.Close())
+	listens, err = ReadListenBrainz(&buf)
+	is.NoErr(err)
+	is.Equal(listens, expected)
+
+	_, err = ReadListenBrainz(strings.NewReader("[]"))
+	is.True(errors.Is(err, ErrNoListens))
+	_, err = ReadListenBrainz(strings.NewReader("<html>"))
+	is.True(err != nil)
+}
@@ -0,0 +1,145 @@
+package history
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"go.senan.xyz/gonic/trackmatch"
+)
+
+var ErrNoListens = errors.New("no listens found")
+
+type exportListen struct {
+	ListenedAt    int64 `json:"listened_at"`
+	TrackMetadata struct {
+		ArtistName     string `json:"artist_name"`
+		TrackName      string `json:"track_name"`
+		AdditionalInfo struct {
+			RecordingMBID string `json:"recording_mbid"`
+			TrackMBID     string `json:"track_mbid"`
+		} `json:"additional_info"`
+		MBIDMapping struct {
+			RecordingMBID string `json:"recording_mbid"`
+		} `json:"mbid_mapping"`
+	} `json:"track_metadata"`
+}
+
+// ReadListenBrainz reads the listens of a listenbrainz export. that's a zip
+// with a file of listens for each month, or from older exports, a json array
+// of them
+func ReadListenBrainz(r io.Reader) ([]Listen, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read export: %w", err)
+	}
+	var listens []Listen
+	if bytes.HasPrefix(data, []byte("PK")) {
+		listens, err = readListenBrainzZip(data)
+	} else {
+		listens, err = readListenBrainzJSON(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(listens) == 0 {
+		return nil, ErrNoListens
+	}
+	return listens, nil
+}
+
+func readListenBrainzZip(data []byte) ([]Listen, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("open zip: %w", err)
+	}
+	var listens []Listen
+	for _, file := range archive.File {
+		if ext := path.Ext(file.Name); ext != ".jsonl" && ext != ".json" {
+			continue
+		}
+		f, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("open %q: %w", file.Name, err)
+		}
+		fileListens, err := readListenBrainzJSON(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read %q: %w", file.Name, err)
+		}
+		listens = append(listens, fileListens...)
+	}
+	return listens, nil
+}
+
+// readListenBrainzJSON reads a json array of listens, or one listen per line
+func readListenBrainzJSON(r io.Reader) ([]Listen, error) {
+	br := bufio.NewReader(r)
+	var first byte
+	for {
+		b, err := br.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			first = b
+			break
+		}
+	}
+	if err := br.UnreadByte(); err != nil {
+		return nil, err
+	}
+
+	var exported []exportListen
+	decoder := json.NewDecoder(br)
+	if first == '[' {
+		if err := decoder.Decode(&exported); err != nil {
+			return nil, fmt.Errorf("decode listens: %w", err)
+		}
+	} else {
+		for {
+			var listen exportListen
+			err := decoder.Decode(&listen)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("decode listen: %w", err)
+			}
+			exported = append(exported, listen)
+		}
+	}
+
+	listens := make([]Listen, 0, len(exported))
+	for _, listen := range exported {
+		if listen.ListenedAt == 0 {
+			continue
+		}
+		meta := listen.TrackMetadata
+		mbid := meta.MBIDMapping.RecordingMBID
+		if mbid == "" {
+			mbid = meta.AdditionalInfo.RecordingMBID
+		}
+		if mbid == "" {
+			mbid = meta.AdditionalInfo.TrackMBID
+		}
+		listens = append(listens, Listen{
+			Time: time.Unix(listen.ListenedAt, 0),
+			Query: trackmatch.Query{
+				RecordingMBID: mbid,
+				Artist:        meta.ArtistName,
+				Title:         meta.TrackName,
+			},
+		})
+	}
+	return listens, nil
+}
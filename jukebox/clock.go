@@ -0,0 +1,71 @@
+package jukebox
+
+import (
+	"sync"
+	"time"
+)
+
+// speakerBuffer is how much the speaker reads ahead of what's audible
+const speakerBuffer = time.Second / 2
+
+// clock is how far into a track playback has audibly got. the speaker reads
+// a buffer at a time, so what's been read runs ahead of what's been heard. the
+// clock runs while the track is read from, and stops while it's paused or the
+// decoder is behind. it's kept within a buffer behind what's been read, so
+// that it can't drift from it, and never goes backwards
+type clock struct {
+	mu sync.Mutex
+	// pos is where the clock was at since, and running is whether it has
+	// carried on from there
+	pos     time.Duration
+	since   time.Time
+	running bool
+	// last is the last position given, which is never gone back on
+	last time.Duration
+}
+
+func newClock(start time.Duration) *clock {
+	return &clock{pos: start, last: start}
+}
+
+// run starts the clock, if it isn't already running
+func (c *clock) run(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running {
+		return
+	}
+	c.since, c.running = now, true
+}
+
+// stop stops the clock at where it's got to, if it's running
+func (c *clock) stop(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return
+	}
+	c.pos += now.Sub(c.since)
+	c.since, c.running = now, false
+}
+
+// position is where playback is at now, given how far it's been read
+func (c *clock) position(now time.Time, read time.Duration) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pos := c.pos
+	if c.running {
+		pos += now.Sub(c.since)
+	}
+	if pos > read {
+		pos = read
+	}
+	if floor := read - speakerBuffer; pos < floor {
+		pos = floor
+	}
+	if pos < c.last {
+		pos = c.last
+	}
+	c.last = pos
+	return pos
+}
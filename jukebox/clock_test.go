@@ -0,0 +1,59 @@
+package jukebox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestClock(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	start := time.Now()
+	at := func(n int) time.Time { return start.Add(ms(n)) }
+
+	c := newClock(ms(2000)) // started 2s into the track
+	// the speaker reads a buffer ahead, which isn't audible yet
+	c.run(at(0))
+	is.Equal(c.position(at(0), ms(2500)), ms(2000))
+	is.Equal(c.position(at(200), ms(2500)), ms(2200))
+
+	// paused mid-read, the position holds however long it's paused for
+	c.stop(at(300))
+	is.Equal(c.position(at(300), ms(2500)), ms(2300))
+	is.Equal(c.position(at(60000), ms(2500)), ms(2300))
+	c.run(at(60000))
+	is.Equal(c.position(at(60100), ms(2500)), ms(2400))
+
+	// it doesn't get ahead of what's been read, when the decoder's behind
+	is.Equal(c.position(at(60400), ms(2500)), ms(2500))
+	// or fall further behind it than the speaker's buffer
+	is.Equal(c.position(at(60400), ms(4000)), ms(3500))
+	// and never goes backwards
+	c.stop(at(60400))
+	is.Equal(c.position(at(60400), ms(3600)), ms(3500))
+}
+
+func TestPositionPaused(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	j := withTracks(1)
+	j.playing = true
+	j.current = levelTrack(j, 0, 10*time.Second, 0.1, 0)
+
+	// a second read, and paused straight after. the speaker's buffer of it
+	// wasn't played
+	play(j, time.Second)
+	j.Stop()
+	pos := j.current.audible(j.sr, time.Now())
+	is.True(pos >= time.Second-speakerBuffer)
+	is.True(pos < time.Second)
+
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		is.Equal(j.current.audible(j.sr, time.Now()), pos)
+	}
+	is.Equal(j.GetStatus().Position, 1)
+}
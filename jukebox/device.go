@@ -0,0 +1,36 @@
+package jukebox
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrDevicesUnsupported is returned when the platform's audio backend can't
+// play through anything but its default device
+var ErrDevicesUnsupported = errors.New("choosing an audio device isn't supported on this platform")
+
+// Device is somewhere the jukebox can play to
+type Device struct {
+	// ID is what's given to SetDevice
+	ID   string
+	Name string
+}
+
+// DeviceDefault is the name reported when no device is chosen
+const DeviceDefault = "default"
+
+// findDevice finds the device with the id or name given, so that either from
+// the list can be used
+func findDevice(devices []Device, id string) (Device, error) {
+	for _, device := range devices {
+		if device.ID == id || strings.EqualFold(device.Name, id) {
+			return device, nil
+		}
+	}
+	ids := make([]string, 0, len(devices))
+	for _, device := range devices {
+		ids = append(ids, device.ID)
+	}
+	return Device{}, fmt.Errorf("audio device %q not found, available devices are %s", id, strings.Join(ids, ", "))
+}
@@ -0,0 +1,58 @@
+package jukebox
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+)
+
+// the first line of each card in /proc/asound/cards, like
+//
+//	1 [HDMI           ]: HDA-Intel - HDA ATI HDMI
+var cardExpr = regexp.MustCompile(`^\s*\d+\s+\[(\S+)\s*\]:\s*(.*)$`)
+
+// Devices lists the ALSA sound cards
+func Devices() ([]Device, error) {
+	f, err := os.Open("/proc/asound/cards")
+	if err != nil {
+		return nil, fmt.Errorf("open sound cards: %w", err)
+	}
+	defer f.Close()
+	return parseCards(f)
+}
+
+func parseCards(r io.Reader) ([]Device, error) {
+	var devices []Device
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		match := cardExpr.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		devices = append(devices, Device{ID: match[1], Name: match[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read sound cards: %w", err)
+	}
+	return devices, nil
+}
+
+// useDevice makes the speaker open the sound card id. the audio backend always
+// opens ALSA's default device, so the card is chosen for it with ALSA_CARD.
+// this needs to happen before the speaker is inited
+func useDevice(id string) (Device, error) {
+	devices, err := Devices()
+	if err != nil {
+		return Device{}, err
+	}
+	device, err := findDevice(devices, id)
+	if err != nil {
+		return Device{}, err
+	}
+	if err := os.Setenv("ALSA_CARD", device.ID); err != nil {
+		return Device{}, fmt.Errorf("set card: %w", err)
+	}
+	return device, nil
+}
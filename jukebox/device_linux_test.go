@@ -0,0 +1,33 @@
+package jukebox
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestParseCards(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	devices, err := parseCards(strings.NewReader(`
+ 0 [PCH            ]: HDA-Intel - HDA Intel PCH
+                      HDA Intel PCH at 0xf7f10000 irq 32
+ 1 [HDMI           ]: HDA-Intel - HDA ATI HDMI
+                      HDA ATI HDMI at 0xf7e60000 irq 33
+`))
+	is.NoErr(err)
+	is.Equal(devices, []Device{
+		{ID: "PCH", Name: "HDA-Intel - HDA Intel PCH"},
+		{ID: "HDMI", Name: "HDA-Intel - HDA ATI HDMI"},
+	})
+
+	device, err := findDevice(devices, "HDMI")
+	is.NoErr(err)
+	is.Equal(device.ID, "HDMI")
+	device, err = findDevice(devices, "hda-intel - hda intel pch")
+	is.NoErr(err)
+	is.Equal(device.ID, "PCH")
+	_, err = findDevice(devices, "USB")
+	is.True(strings.Contains(err.Error(), "available devices are PCH, HDMI"))
+}
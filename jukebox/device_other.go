@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package jukebox
+
+// Devices lists where the jukebox can play to
+func Devices() ([]Device, error) {
+	return nil, ErrDevicesUnsupported
+}
+
+func useDevice(id string) (Device, error) {
+	return Device{}, ErrDevicesUnsupported
+}
@@ -3,18 +3,20 @@
 package jukebox
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os"
+	"math"
+	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/faiface/beep"
-	"github.com/faiface/beep/flac"
-	"github.com/faiface/beep/mp3"
+	"github.com/faiface/beep/effects"
 	"github.com/faiface/beep/speaker"
 
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/transcode"
 )
 
 type Status struct {
@@ -22,49 +24,151 @@ type Status struct {
 	Playing      bool
 	Gain         float64
 	Position     int
+	Shuffle      bool
+	Repeat       RepeatMode
+	// Ended is true when the last track finished. the playlist is kept, and
+	// Start plays it again from the beginning
+	Ended bool
+	// Stalled is true when the audio device has stopped taking what's played
+	Stalled bool
+	// Crossfade is how many seconds tracks are crossfaded for
+	Crossfade int
+	// Device is the name of the audio device played to
+	Device string
+	// Error is why playback stopped on its own, if it did
+	Error string
+	// ReplayGain is which of each track's replaygain tags are applied
+	ReplayGain transcode.ReplayGainMode
 }
 
+// PlaylistItem is a track in the playlist, and why it couldn't be played if
+// it couldn't
+type PlaylistItem struct {
+	Track *db.Track
+	Error string
+	// ReplayGain is the gain in dB applied to the track for its replaygain
+	ReplayGain float64
+}
+
+// maxFailures is how many tracks in a row can fail to load before the jukebox
+// stops, instead of skipping on to the next
+const maxFailures = 3
+
+// RepeatMode is what's played when a track finishes
+type RepeatMode string
+
+const (
+	// RepeatOff plays the next track, and stops after the last
+	RepeatOff RepeatMode = "off"
+	// RepeatOne plays the same track again
+	RepeatOne RepeatMode = "one"
+	// RepeatAll plays the next track, and the first again after the last
+	RepeatAll RepeatMode = "all"
+)
+
+// RepeatModes are the modes a client can choose
+var RepeatModes = []RepeatMode{RepeatOff, RepeatOne, RepeatAll}
+
 type Jukebox struct {
 	playlist []*db.Track
 	index    int
 	playing  bool
+	ended    bool
 	sr       beep.SampleRate
-	// used to notify the player to re read the members
-	quit    chan struct{}
-	done    chan bool
-	info    *strmInfo
+	// speaker has what Listen should play next. it holds one request, which a
+	// newer one replaces, so asking never waits for Listen, or needs it running
 	speaker chan updateSpeaker
+	// ctx is done when the jukebox quits, which stops Listen. cancelLoad and
+	// cancelNext stop waiting to load the track to play now and the next one
+	ctx        context.Context
+	cancel     context.CancelFunc
+	cancelLoad context.CancelFunc
+	cancelNext context.CancelFunc
+	// ctrl pauses the speaker's stream, which plays current and then next
+	ctrl    *beep.Ctrl
+	current *trackStream
+	next    *trackStream
+	// preloading is true once the next track has started loading. preloadGen
+	// changes when what plays next does, so an old load can be dropped
+	preloading bool
+	preloadGen int
+	preBuffer  time.Duration
+	crossfade  time.Duration
+	limiter    *transcode.Limiter
+	// device is the id of the audio device to play to, or empty for the
+	// default one. deviceName is its name once the speaker is inited
+	device     string
+	deviceName string
+	// which of each track's replaygain tags are applied as tracks are
+	// decoded, and the gain applied on top of them as they're played
+	replayGain transcode.ReplayGainMode
+	gain       float64
+	// when shuffled, tracks are played in the order of the playlist indexes
+	// in order, instead of the playlist's own order
+	shuffle bool
+	order   []int
+	rand    *rand.Rand
+	repeat  RepeatMode
+	// dbc is where the playlist is saved, if it's set. a restored playlist
+	// starts from resume seconds into the current track
+	dbc      *db.DB
+	saveMu   sync.Mutex
+	restored bool
+	resume   int
+	// failed has why each track which couldn't be loaded couldn't be. failures
+	// is how many have failed in a row, and err is set once they stop playback
+	failed   map[*db.Track]string
+	failures int
+	err      string
 	sync.Mutex
 }
 
-type strmInfo struct {
-	ctrlStrmr beep.Ctrl
-	strm      beep.StreamSeekCloser
-	format    beep.Format
-}
-
 type updateSpeaker struct {
 	index  int
 	offset int
+	// advance plays the track after index, instead of index itself
+	advance bool
 }
 
-func New() *Jukebox {
+// New makes a Jukebox which takes a slot from limiter for each track it
+// decodes, if limiter isn't nil
+func New(limiter *transcode.Limiter) *Jukebox {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Jukebox{
-		sr:      beep.SampleRate(48000),
-		speaker: make(chan updateSpeaker, 1),
-		done:    make(chan bool),
-		quit:    make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+		sr:        beep.SampleRate(48000),
+		speaker:   make(chan updateSpeaker, 1),
+		limiter:   limiter,
+		repeat:    RepeatOff,
+		preBuffer: DefaultPreBuffer,
+		gain:      1,
 	}
 }
 
 func (j *Jukebox) Listen() error {
-	if err := speaker.Init(j.sr, j.sr.N(time.Second/2)); err != nil {
+	if j.device != "" {
+		device, err := useDevice(j.device)
+		if err != nil {
+			return fmt.Errorf("choosing audio device: %w", err)
+		}
+		j.Lock()
+		j.deviceName = device.Name
+		j.Unlock()
+	}
+	if err := speaker.Init(j.sr, j.sr.N(speakerBuffer)); err != nil {
 		return fmt.Errorf("initing speaker: %w", err)
 	}
+	j.listen()
+	return nil
+}
+
+// listen plays what's asked for, until the jukebox quits
+func (j *Jukebox) listen() {
 	for {
 		select {
-		case <-j.quit:
-			return nil
+		case <-j.ctx.Done():
+			return
 		case speaker := <-j.speaker:
 			if err := j.doUpdateSpeaker(speaker); err != nil {
 				log.Printf("error in jukebox: %v", err)
@@ -73,57 +177,275 @@ func (j *Jukebox) Listen() error {
 	}
 }
 
+// Quit stops Listen, if it's running
 func (j *Jukebox) Quit() {
-	j.quit <- struct{}{}
+	j.save()
+	j.cancel()
+}
+
+// request asks Listen to play su, replacing a request it hasn't got to yet, so
+// that it never waits. j must be locked
+func (j *Jukebox) request(su updateSpeaker) {
+	select {
+	case <-j.speaker:
+	default:
+	}
+	j.speaker <- su
+}
+
+// stopLoading stops waiting to load tracks, and stops the current one. j must
+// be locked
+func (j *Jukebox) stopLoading() {
+	if j.cancelLoad != nil {
+		j.cancelLoad()
+		j.cancelLoad = nil
+	}
+	j.closeCurrent()
+	j.cancelPreload()
 }
 
 func (j *Jukebox) doUpdateSpeaker(su updateSpeaker) error {
+	speaker.Clear()
+	// give back the last track's slot before waiting for one for the next, so
+	// that the jukebox only needs two while the next is preloaded
 	j.Lock()
-	defer j.Unlock()
+	j.stopLoading()
+	if su.advance {
+		su.index = j.nextIndex(su.index)
+	}
 	if su.index >= len(j.playlist) {
 		j.playing = false
-		speaker.Clear()
+		j.ended = true
+		j.index = j.firstIndex()
+		j.Unlock()
+		return nil
+	}
+	track := j.playlist[su.index]
+	ctx, cancel := context.WithCancel(j.ctx)
+	j.cancelLoad = cancel
+	j.Unlock()
+
+	cur, err := j.load(ctx, track, su.index, su.offset)
+	skipped := ctx.Err() != nil
+	cancel()
+	if skipped {
+		// something else was asked for while this loaded
+		if cur != nil {
+			cur.close()
+		}
 		return nil
 	}
-	j.index = su.index
-	f, err := os.Open(j.playlist[su.index].AbsPath())
 	if err != nil {
-		return err
+		return j.loadFailed(track, su.index, err)
+	}
+
+	j.Lock()
+	delete(j.failed, track)
+	j.failures = 0
+	j.err = ""
+	j.index = su.index
+	j.ended = false
+	j.restored = false
+	j.resume = 0
+	j.current = cur
+	j.ctrl = &beep.Ctrl{Streamer: &playlistStream{j: j}}
+	ctrl := j.ctrl
+	j.Unlock()
+	// the speaker is never used while j is locked, since the stream locks j
+	speaker.Play(ctrl)
+	j.save()
+	return nil
+}
+
+// loadFailed marks the track at index as unplayable, and asks for the one
+// after it. after maxFailures in a row, playback stops instead
+func (j *Jukebox) loadFailed(track *db.Track, index int, err error) error {
+	j.Lock()
+	defer j.Unlock()
+	if j.failed == nil {
+		j.failed = map[*db.Track]string{}
 	}
-	var streamer beep.Streamer
-	var format beep.Format
-	switch j.playlist[su.index].Ext() {
-	case "mp3":
-		streamer, format, err = mp3.Decode(f)
-	case "flac":
-		streamer, format, err = flac.Decode(f)
+	j.failed[track] = err.Error()
+	j.failures++
+	j.index = index
+	if j.failures >= maxFailures {
+		j.playing = false
+		j.err = fmt.Sprintf("stopped after %d tracks in a row couldn't be played", j.failures)
+		return fmt.Errorf("loading track %d: %w", index, err)
 	}
-	if err != nil {
-		return err
-	}
-	j.info = &strmInfo{}
-	j.info.strm = streamer.(beep.StreamSeekCloser)
-	if su.offset != 0 {
-		samples := format.SampleRate.N(time.Second * time.Duration(su.offset))
-		if err := j.info.strm.Seek(samples); err != nil {
-			return err
-		}
+	log.Printf("skipping jukebox track %d: %v", index, err)
+	// unless something else was asked for since
+	if len(j.speaker) == 0 {
+		j.request(updateSpeaker{index: index, advance: true})
 	}
-	j.info.ctrlStrmr.Streamer = beep.Resample(
-		4, format.SampleRate,
-		j.sr, j.info.strm,
-	)
-	j.info.format = format
-	speaker.Play(beep.Seq(&j.info.ctrlStrmr, beep.Callback(func() {
-		j.speaker <- updateSpeaker{index: su.index + 1}
-	})))
 	return nil
 }
 
-func (j *Jukebox) SetTracks(tracks []*db.Track) {
+// resetFailures forgets tracks failing in a row, when playback is asked for
+// again. j must be locked
+func (j *Jukebox) resetFailures() {
+	j.failures = 0
+	j.err = ""
+}
+
+// replayGainDB is the gain in dB applied to track for mode. there's no
+// loudnorm in the jukebox, so tracks without tags are played as they are
+func replayGainDB(mode transcode.ReplayGainMode, track *db.Track) float64 {
+	gain := transcode.ReplayGain(mode, track.TagReplayGainTrack, track.TagReplayGainAlbum)
+	if gain.Loudnorm {
+		return 0
+	}
+	return gain.DB
+}
+
+// withReplayGain scales s by the track's replaygain for mode
+func withReplayGain(s beep.Streamer, mode transcode.ReplayGainMode, track *db.Track) beep.Streamer {
+	gain := replayGainDB(mode, track)
+	if gain == 0 {
+		return s
+	}
+	return &effects.Gain{Streamer: s, Gain: math.Pow(10, gain/20) - 1}
+}
+
+// SetReplayGainMode applies mode to tracks from the next one played. the track
+// which is playing has already been decoded with the last mode
+func (j *Jukebox) SetReplayGainMode(mode transcode.ReplayGainMode) {
+	j.Lock()
+	defer j.Unlock()
+	if mode == j.replayGain {
+		return
+	}
+	j.replayGain = mode
+	j.cancelPreload()
+}
+
+// SetGain sets the volume from 0 to 1, which is applied on top of each track's
+// replaygain as it's played, so that it changes straight away
+func (j *Jukebox) SetGain(gain float64) {
+	j.Lock()
+	defer j.Unlock()
+	j.gain = math.Max(0, math.Min(1, gain))
+}
+
+// SetPreBuffer sets how much of the next track is decoded before the current
+// one ends. 0 loads the next track only after the current one, with a gap
+func (j *Jukebox) SetPreBuffer(d time.Duration) {
+	j.Lock()
+	defer j.Unlock()
+	j.preBuffer = d
+}
+
+// SetCrossfade fades each track into the next over its last d, when it plays
+// to its end. 0 turns it off. the next track has to be preloaded to fade into
+// it, so it needs a pre buffer
+func (j *Jukebox) SetCrossfade(d time.Duration) {
+	j.Lock()
+	defer j.Unlock()
+	j.crossfade = d
+}
+
+// SetDevice plays to the audio device with the id or name given by Devices,
+// instead of the default one. it must be set before Listen
+func (j *Jukebox) SetDevice(id string) {
+	j.Lock()
+	defer j.Unlock()
+	j.device = id
+}
+
+// SetShuffle plays the playlist in a random order, starting from the current
+// track, or in its own order again
+func (j *Jukebox) SetShuffle(shuffle bool) {
+	j.Lock()
+	defer j.Unlock()
+	j.cancelPreload()
+	j.shuffle = shuffle
+	j.order = nil
+	if shuffle {
+		j.reshuffle(j.index)
+	}
+}
+
+// SetRepeat sets what's played when a track finishes
+func (j *Jukebox) SetRepeat(mode RepeatMode) {
 	j.Lock()
 	defer j.Unlock()
+	j.cancelPreload()
+	j.repeat = mode
+}
+
+// nextIndex is the index of the track to play after i, or the length of the
+// playlist if there isn't one. j must be locked
+func (j *Jukebox) nextIndex(i int) int {
+	end := len(j.playlist)
+	if i < 0 || i >= end {
+		return end
+	}
+	if j.repeat == RepeatOne {
+		return i
+	}
+	if !j.shuffle {
+		switch {
+		case i+1 < end:
+			return i + 1
+		case j.repeat == RepeatAll:
+			return 0
+		}
+		return end
+	}
+	pos := indexOf(j.order, i)
+	switch {
+	case pos+1 < len(j.order):
+		return j.order[pos+1]
+	case j.repeat == RepeatAll && len(j.order) > 0:
+		return j.order[0]
+	}
+	return end
+}
+
+// reshuffle makes a new random order, starting with the playlist index first.
+// j must be locked
+func (j *Jukebox) reshuffle(first int) {
+	j.order = j.perm(len(j.playlist))
+	if pos := indexOf(j.order, first); pos > 0 {
+		j.order[0], j.order[pos] = j.order[pos], j.order[0]
+	}
+}
+
+// firstIndex is the index of the track the playlist starts with. j must be locked
+func (j *Jukebox) firstIndex() int {
+	if j.shuffle && len(j.order) > 0 {
+		return j.order[0]
+	}
+	return 0
+}
+
+// perm is a random order of n indexes. j must be locked
+func (j *Jukebox) perm(n int) []int {
+	if j.rand == nil {
+		j.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return j.rand.Perm(n)
+}
+
+func indexOf(order []int, i int) int {
+	for pos, oi := range order {
+		if oi == i {
+			return pos
+		}
+	}
+	return -1
+}
+
+func (j *Jukebox) SetTracks(tracks []*db.Track) {
+	j.Lock()
+	j.cancelPreload()
 	j.playlist = tracks
+	j.failed = nil
+	if j.shuffle {
+		j.reshuffle(j.index)
+	}
+	j.Unlock()
+	j.save()
 }
 
 func (j *Jukebox) AddTracks(tracks []*db.Track) {
@@ -131,75 +453,281 @@ func (j *Jukebox) AddTracks(tracks []*db.Track) {
 	if len(j.playlist) == 0 {
 		j.playlist = tracks
 		j.playing = true
+		j.ended = false
 		j.index = 0
+		j.resetFailures()
+		if j.shuffle {
+			j.reshuffle(0)
+		}
+		j.request(updateSpeaker{index: 0})
 		j.Unlock()
-		j.speaker <- updateSpeaker{index: 0}
+		j.save()
 		return
 	}
+	// new tracks are shuffled in after the ones already queued
+	j.cancelPreload()
+	start := len(j.playlist)
 	j.playlist = append(j.playlist, tracks...)
+	if j.shuffle {
+		for _, i := range j.perm(len(tracks)) {
+			j.order = append(j.order, start+i)
+		}
+	}
+	j.Unlock()
+	j.save()
+}
+
+// InsertTracks inserts tracks before the track at index, or at the end if
+// index is the playlist's length. other indexes are ignored, as with
+// RemoveTrack. when shuffled, they're played after the ones already queued
+func (j *Jukebox) InsertTracks(index int, tracks []*db.Track) {
+	j.Lock()
+	if index < 0 || index > len(j.playlist) || len(tracks) == 0 {
+		j.Unlock()
+		return
+	}
+	if len(j.playlist) == 0 {
+		j.Unlock()
+		j.AddTracks(tracks)
+		return
+	}
+	j.cancelPreload()
+	n := len(tracks)
+	j.reindex(func(i int) int {
+		if i >= index {
+			return i + n
+		}
+		return i
+	})
+	playlist := make([]*db.Track, 0, len(j.playlist)+n)
+	playlist = append(playlist, j.playlist[:index]...)
+	playlist = append(playlist, tracks...)
+	playlist = append(playlist, j.playlist[index:]...)
+	j.playlist = playlist
+	if j.shuffle {
+		for _, i := range j.perm(n) {
+			j.order = append(j.order, index+i)
+		}
+	}
 	j.Unlock()
+	j.save()
+}
+
+// MoveTrack moves the track at from to to, shifting the ones between them.
+// indexes outside of the playlist are ignored, as with RemoveTrack
+func (j *Jukebox) MoveTrack(from, to int) {
+	j.Lock()
+	if from < 0 || from >= len(j.playlist) || to < 0 || to >= len(j.playlist) || from == to {
+		j.Unlock()
+		return
+	}
+	j.cancelPreload()
+	j.reindex(func(i int) int {
+		switch {
+		case i == from:
+			return to
+		case from < to && i > from && i <= to:
+			return i - 1
+		case from > to && i >= to && i < from:
+			return i + 1
+		}
+		return i
+	})
+	playlist := make([]*db.Track, 0, len(j.playlist))
+	for i, track := range j.playlist {
+		if i == from {
+			continue
+		}
+		playlist = append(playlist, track)
+	}
+	moved := j.playlist[from]
+	playlist = append(playlist[:to], append([]*db.Track{moved}, playlist[to:]...)...)
+	j.playlist = playlist
+	j.Unlock()
+	j.save()
+}
+
+// reindex moves the current track, and the shuffled order, to where the
+// playlist's tracks are after it's edited. at maps each old index to its new
+// one. j must be locked
+func (j *Jukebox) reindex(at func(int) int) {
+	j.index = at(j.index)
+	if j.current != nil {
+		j.current.index = at(j.current.index)
+	}
+	for k, i := range j.order {
+		j.order[k] = at(i)
+	}
 }
 
 func (j *Jukebox) RemoveTrack(i int) {
 	j.Lock()
-	defer j.Unlock()
 	if i < 0 || i >= len(j.playlist) {
+		j.Unlock()
 		return
 	}
+	j.cancelPreload()
+	delete(j.failed, j.playlist[i])
 	j.playlist = append(j.playlist[:i], j.playlist[i+1:]...)
+	if j.shuffle {
+		order := j.order[:0]
+		for _, oi := range j.order {
+			switch {
+			case oi < i:
+				order = append(order, oi)
+			case oi > i:
+				order = append(order, oi-1)
+			}
+		}
+		j.order = order
+	}
+	j.Unlock()
+	j.save()
 }
 
+// Skip plays the track at index i, from offset seconds. when shuffled, the
+// tracks after it are shuffled again. it doesn't wait for the track to load
 func (j *Jukebox) Skip(i int, offset int) {
 	speaker.Clear()
 	j.Lock()
+	j.stopLoading()
 	j.index = i
 	j.playing = true
+	j.ended = false
+	j.resetFailures()
+	if j.shuffle {
+		j.reshuffle(i)
+	}
+	j.request(updateSpeaker{index: i, offset: offset})
 	j.Unlock()
-	j.speaker <- updateSpeaker{index: j.index, offset: offset}
+	j.save()
 }
 
 func (j *Jukebox) ClearTracks() {
 	speaker.Clear()
 	j.Lock()
-	defer j.Unlock()
+	j.stopLoading()
 	j.playing = false
+	j.ended = false
+	j.restored = false
+	j.resume = 0
 	j.playlist = []*db.Track{}
+	j.order = nil
+	j.failed = nil
+	j.resetFailures()
+	j.Unlock()
+	j.save()
 }
 
 func (j *Jukebox) Stop() {
 	j.Lock()
-	defer j.Unlock()
-	if j.info != nil {
+	ctrl, cur := j.ctrl, j.current
+	if ctrl != nil {
 		j.playing = false
-		j.info.ctrlStrmr.Paused = true
 	}
+	j.Unlock()
+	if ctrl != nil {
+		speaker.Lock()
+		ctrl.Paused = true
+		speaker.Unlock()
+	}
+	// nothing is read while paused, so the clock is stopped here instead
+	if cur != nil {
+		cur.clock.stop(time.Now())
+	}
+	j.save()
 }
 
+// Start resumes the current track, or plays the playlist from the beginning
+// if it ended
 func (j *Jukebox) Start() {
-	if j.info != nil {
+	j.Lock()
+	if j.err != "" {
+		// playback stopped on failures, and carries on from the last one
+		j.resetFailures()
 		j.playing = true
-		j.info.ctrlStrmr.Paused = false
+		j.request(updateSpeaker{index: j.index, advance: true})
+		j.Unlock()
+		return
+	}
+	if j.restored {
+		j.restored = false
+		j.playing = true
+		j.request(updateSpeaker{index: j.index, offset: j.resume})
+		j.Unlock()
+		return
+	}
+	if j.ended {
+		j.ended = false
+		j.playing = true
+		j.request(updateSpeaker{index: j.firstIndex()})
+		j.Unlock()
+		return
+	}
+	ctrl := j.ctrl
+	if ctrl != nil {
+		j.playing = true
+	}
+	j.Unlock()
+	if ctrl != nil {
+		speaker.Lock()
+		ctrl.Paused = false
+		speaker.Unlock()
 	}
 }
 
 func (j *Jukebox) GetStatus() Status {
 	j.Lock()
 	defer j.Unlock()
-	position := 0
-	if j.info != nil {
-		length := j.info.format.SampleRate.D(j.info.strm.Position())
-		position = int(length.Round(time.Millisecond).Seconds())
+	repeat := j.repeat
+	if repeat == "" {
+		repeat = RepeatOff
+	}
+	device := j.deviceName
+	if device == "" {
+		device = DeviceDefault
 	}
 	return Status{
 		CurrentIndex: j.index,
 		Playing:      j.playing,
-		Gain:         0.9,
-		Position:     position,
+		Gain:         j.gain,
+		Position:     j.position(),
+		Shuffle:      j.shuffle,
+		Repeat:       repeat,
+		Ended:        j.ended,
+		Stalled:      j.playing && j.current != nil && j.current.ring.stalled(time.Now()),
+		Crossfade:    int(j.crossfade / time.Second),
+		Device:       device,
+		Error:        j.err,
+		ReplayGain:   j.replayGain,
 	}
 }
 
+// position is how many seconds into the current track playback is. j must be locked
+func (j *Jukebox) position() int {
+	if j.current == nil {
+		return j.resume
+	}
+	return int(j.current.audible(j.sr, time.Now()).Round(time.Second) / time.Second)
+}
+
 func (j *Jukebox) GetTracks() []*db.Track {
 	j.Lock()
 	defer j.Unlock()
 	return j.playlist
 }
+
+// GetItems is the playlist, with why each track couldn't be played if it couldn't
+func (j *Jukebox) GetItems() []PlaylistItem {
+	j.Lock()
+	defer j.Unlock()
+	items := make([]PlaylistItem, len(j.playlist))
+	for i, track := range j.playlist {
+		items[i] = PlaylistItem{
+			Track:      track,
+			Error:      j.failed[track],
+			ReplayGain: replayGainDB(j.replayGain, track),
+		}
+	}
+	return items
+}
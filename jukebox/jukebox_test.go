@@ -0,0 +1,556 @@
+package jukebox
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/faiface/beep"
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/transcode"
+)
+
+func withTracks(n int) *Jukebox {
+	j := New(nil)
+	for i := 0; i < n; i++ {
+		j.playlist = append(j.playlist, &db.Track{ID: i})
+	}
+	return j
+}
+
+// playOrder follows nextIndex from start until the playlist ends, or n tracks
+func playOrder(j *Jukebox, start, n int) []int {
+	order := []int{start}
+	for i := start; len(order) < n; {
+		if i = j.nextIndex(i); i >= len(j.playlist) {
+			break
+		}
+		order = append(order, i)
+	}
+	return order
+}
+
+func TestNextIndex(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	j := withTracks(3)
+	is.Equal(playOrder(j, 0, 10), []int{0, 1, 2})
+	j.SetRepeat(RepeatAll)
+	is.Equal(playOrder(j, 1, 5), []int{1, 2, 0, 1, 2})
+	j.SetRepeat(RepeatOne)
+	is.Equal(playOrder(j, 1, 3), []int{1, 1, 1})
+}
+
+func TestShuffle(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	j := withTracks(10)
+	j.index = 4
+	j.SetShuffle(true)
+
+	// starts at the current track, and plays each once
+	order := playOrder(j, 4, 20)
+	is.Equal(order[0], 4)
+	is.Equal(order, j.order)
+	sorted := append([]int(nil), order...)
+	sort.Ints(sorted)
+	is.Equal(sorted, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+
+	// the playlist keeps its own order
+	for i, track := range j.GetTracks() {
+		is.Equal(track.ID, i)
+	}
+
+	// repeating all starts the same order again
+	j.SetRepeat(RepeatAll)
+	is.Equal(playOrder(j, 4, 11)[10], 4)
+
+	j.SetShuffle(false)
+	is.Equal(j.nextIndex(4), 5)
+}
+
+func TestShuffleReanchor(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	j := withTracks(10)
+	j.SetShuffle(true)
+	j.reshuffle(7) // as Skip does
+	is.Equal(j.order[0], 7)
+	is.Equal(len(playOrder(j, 7, 20)), 10)
+}
+
+func TestShuffleEdits(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	j := withTracks(5)
+	j.SetShuffle(true)
+
+	j.AddTracks([]*db.Track{{ID: 5}, {ID: 6}})
+	is.Equal(len(j.order), 7)
+	added := append([]int(nil), j.order[5:]...)
+	sort.Ints(added)
+	is.Equal(added, []int{5, 6}) // queued after the others
+
+	j.RemoveTrack(2)
+	is.Equal(len(j.order), 6)
+	sorted := append([]int(nil), j.order...)
+	sort.Ints(sorted)
+	is.Equal(sorted, []int{0, 1, 2, 3, 4, 5})
+}
+
+func TestEndOfPlaylist(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	j := withTracks(3)
+	j.index, j.playing = 2, true
+
+	// the last track finishing
+	is.NoErr(j.doUpdateSpeaker(updateSpeaker{index: 2, advance: true}))
+	status := j.GetStatus()
+	is.True(status.Ended)
+	is.True(!status.Playing)
+	is.Equal(status.CurrentIndex, 0)
+	is.Equal(len(j.GetTracks()), 3) // playlist is kept
+
+	// start plays from the beginning
+	j.Start()
+	is.Equal(<-j.speaker, updateSpeaker{index: 0})
+	status = j.GetStatus()
+	is.True(!status.Ended)
+	is.True(status.Playing)
+}
+
+// level is a decoded track where every sample is the same
+type level struct {
+	value    float64
+	pos, len int
+}
+
+func (l *level) Stream(samples [][2]float64) (int, bool) {
+	var n int
+	for ; n < len(samples) && l.pos < l.len; n++ {
+		samples[n] = [2]float64{l.value, l.value}
+		l.pos++
+	}
+	return n, n > 0
+}
+
+func (l *level) Err() error       { return nil }
+func (l *level) Len() int         { return l.len }
+func (l *level) Position() int    { return l.pos }
+func (l *level) Seek(p int) error { l.pos = p; return nil }
+func (l *level) Close() error     { return nil }
+
+// levelTrack decodes a track of level into a ring of size samples, or the
+// whole track if size is 0, and waits for the ring to fill
+func levelTrack(j *Jukebox, index int, length time.Duration, value float64, size int) *trackStream {
+	strm := &level{value: value, len: j.sr.N(length)}
+	if size == 0 {
+		size = strm.len
+	}
+	format := beep.Format{SampleRate: j.sr, NumChannels: 2, Precision: 2}
+	t := j.startDecoding(index, strm, format, strm, 0, size)
+	for t.ring.len() < size {
+		time.Sleep(time.Millisecond)
+	}
+	return t
+}
+
+// play streams d of the playlist, the way the speaker does
+func play(j *Jukebox, d time.Duration) [][2]float64 {
+	var out [][2]float64
+	strm := &playlistStream{j: j}
+	buf := make([][2]float64, 512)
+	for want := j.sr.N(d); len(out) < want; {
+		if left := want - len(out); left < len(buf) {
+			buf = buf[:left]
+		}
+		n, ok := strm.Stream(buf)
+		out = append(out, buf[:n]...)
+		if !ok {
+			break
+		}
+	}
+	return out
+}
+
+func TestGapless(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	j := withTracks(3)
+	j.preBuffer = 0
+	j.playing = true
+	j.current = levelTrack(j, 0, time.Second, 0.1, 0)
+	j.next = levelTrack(j, 1, 3*time.Second, 0.2, 0)
+
+	out := play(j, 2*time.Second)
+	is.Equal(len(out), j.sr.N(2*time.Second)) // no gap
+	for i, sample := range out {
+		want := 0.2
+		if i < j.sr.N(time.Second) {
+			want = 0.1
+		}
+		is.Equal(sample[0], want)
+	}
+	status := j.GetStatus()
+	is.Equal(status.CurrentIndex, 1)
+	is.Equal(status.Position, 1)
+	is.True(status.Playing)
+}
+
+func TestGaplessNotLoaded(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	j := withTracks(3)
+	j.preBuffer = 0
+	j.playing = true
+	j.current = levelTrack(j, 0, time.Second, 0.1, 0)
+
+	// without the next track, it's loaded after the current one ends
+	out := play(j, 2*time.Second)
+	is.Equal(len(out), j.sr.N(time.Second))
+	is.Equal(<-j.speaker, updateSpeaker{index: 0, advance: true})
+}
+
+func TestSkipStalled(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	j := withTracks(3)
+	j.playing = true
+	// the speaker never reads, so the decoder is left waiting on a full ring
+	cur := levelTrack(j, 0, time.Minute, 0.1, j.sr.N(time.Second))
+	j.current = cur
+	is.True(!j.GetStatus().Stalled)
+	cur.ring.mu.Lock()
+	cur.ring.fullSince = time.Now().Add(-2 * stallAfter)
+	cur.ring.mu.Unlock()
+	is.True(j.GetStatus().Stalled)
+
+	skipped := make(chan struct{})
+	go func() {
+		j.Skip(1, 0)
+		close(skipped)
+	}()
+	select {
+	case <-skipped:
+	case <-time.After(time.Second):
+		t.Fatal("skip waited on the decoder")
+	}
+	select {
+	case <-cur.decoded:
+	case <-time.After(time.Second):
+		t.Fatal("decoder wasn't stopped")
+	}
+	is.Equal(<-j.speaker, updateSpeaker{index: 1})
+	is.True(!j.GetStatus().Stalled)
+}
+
+func TestSkipWhileLoading(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	limiter := transcode.NewLimiter(nil, 1, time.Minute)
+	release, err := limiter.Acquire(context.Background())
+	is.NoErr(err)
+	defer release()
+
+	j := withTracks(3)
+	j.limiter = limiter
+	loaded := make(chan error)
+	go func() {
+		loaded <- j.doUpdateSpeaker(updateSpeaker{index: 0})
+	}()
+	for limiter.Queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// waiting for a slot is given up on, instead of holding up the next track
+	j.Skip(1, 0)
+	select {
+	case err := <-loaded:
+		is.NoErr(err)
+	case <-time.After(time.Second):
+		t.Fatal("load wasn't cancelled")
+	}
+	is.Equal(<-j.speaker, updateSpeaker{index: 1})
+}
+
+func TestCrossfade(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	j := withTracks(3)
+	j.preBuffer = 0
+	j.playing = true
+	j.SetCrossfade(time.Second)
+	j.current = levelTrack(j, 0, 3*time.Second, 1, 0)
+	j.next = levelTrack(j, 1, 3*time.Second, 0.5, 0)
+
+	out := play(j, 4*time.Second)
+	is.Equal(len(out), j.sr.N(4*time.Second))
+	near := func(got, want float64) bool { return math.Abs(got-want) < 0.001 }
+	is.Equal(out[j.sr.N(time.Second)][0], 1.0)                 // before the fade
+	is.True(near(out[j.sr.N(2*time.Second)][0], 1))            // fading out from the start
+	is.True(near(out[j.sr.N(2500*time.Millisecond)][1], 0.75)) // half of each
+	is.True(near(out[j.sr.N(3*time.Second)-1][0], 0.5))        // all of the next
+	is.Equal(out[j.sr.N(3500*time.Millisecond)][0], 0.5)       // which carries on
+	status := j.GetStatus()
+	is.Equal(status.CurrentIndex, 1)
+	is.Equal(status.Crossfade, 1)
+	// a second during the fade, less what's before the first chunk in it, and
+	// one after
+	is.True(math.Abs(j.current.position(j.sr).Seconds()-2) < 0.02)
+}
+
+func TestCrossfadeAfterSeek(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	j := withTracks(3)
+	j.SetCrossfade(time.Second)
+	strm := &level{len: j.sr.N(3 * time.Second)}
+	format := beep.Format{SampleRate: j.sr, NumChannels: 2, Precision: 2}
+	// skipped to half a second from the end
+	j.current = j.startDecoding(0, strm, format, strm, 2500*time.Millisecond, strm.len)
+	j.next = levelTrack(j, 1, 3*time.Second, 0.5, 0)
+	next, _ := j.fading(j.current)
+	is.True(next == nil)
+
+	j.current.offset = 0
+	next, _ = j.fading(j.current)
+	is.True(next == nil) // not near the end yet
+}
+
+func TestWithoutListen(t *testing.T) {
+	t.Parallel()
+	j := withTracks(3)
+
+	// nothing takes the requests, but asking never waits for it
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				j.Skip(i%3, 0)
+			}(i)
+			go func() {
+				defer wg.Done()
+				j.SetTracks([]*db.Track{{ID: 0}, {ID: 1}, {ID: 2}})
+			}()
+		}
+		wg.Wait()
+		j.GetStatus()
+		j.Quit()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("jukebox calls blocked without Listen")
+	}
+	if su := <-j.speaker; su.index < 0 || su.index > 2 {
+		t.Fatalf("unexpected request %v", su)
+	}
+}
+
+func TestQuitStopsListen(t *testing.T) {
+	t.Parallel()
+	j := New(nil)
+	listened := make(chan struct{})
+	go func() {
+		j.listen()
+		close(listened)
+	}()
+	j.Quit()
+	select {
+	case <-listened:
+	case <-time.After(time.Second):
+		t.Fatal("listen didn't stop")
+	}
+}
+
+func TestSkipMissing(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	// none of the tracks have files
+	j := withTracks(5)
+	j.playing = true
+
+	// each is marked and skipped, until too many have failed in a row
+	su := updateSpeaker{index: 0}
+	for i := 0; i < maxFailures-1; i++ {
+		is.NoErr(j.doUpdateSpeaker(su))
+		su = <-j.speaker
+		is.Equal(su, updateSpeaker{index: i, advance: true})
+		is.True(j.GetStatus().Playing)
+	}
+	is.True(j.doUpdateSpeaker(su) != nil)
+	status := j.GetStatus()
+	is.True(!status.Playing)
+	is.True(status.Error != "")
+	is.Equal(status.CurrentIndex, maxFailures-1)
+
+	items := j.GetItems()
+	for i, item := range items {
+		is.Equal(item.Error != "", i < maxFailures) // only the tracks tried
+	}
+
+	// starting again carries on after the last one, with a clean slate
+	j.Start()
+	is.Equal(<-j.speaker, updateSpeaker{index: maxFailures - 1, advance: true})
+	status = j.GetStatus()
+	is.True(status.Playing)
+	is.Equal(status.Error, "")
+}
+
+func TestSkipMissingAfterSkip(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	j := withTracks(5)
+	j.Skip(3, 0)
+	is.Equal(<-j.speaker, updateSpeaker{index: 3})
+	j.Skip(4, 0)
+	// a failure doesn't replace what was asked for after it
+	is.NoErr(j.doUpdateSpeaker(updateSpeaker{index: 3}))
+	is.Equal(<-j.speaker, updateSpeaker{index: 4})
+}
+
+// gainTrack decodes a second of level with the track's replaygain for mode
+func gainTrack(j *Jukebox, index int, value float64, mode transcode.ReplayGainMode, track *db.Track) *trackStream {
+	strm := &level{value: value, len: j.sr.N(time.Second)}
+	format := beep.Format{SampleRate: j.sr, NumChannels: 2, Precision: 2}
+	t := j.startDecoding(index, strm, format, withReplayGain(strm, mode, track), 0, strm.len)
+	for t.ring.len() < strm.len {
+		time.Sleep(time.Millisecond)
+	}
+	return t
+}
+
+func TestGain(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	near := func(got, want float64) bool { return math.Abs(got-want) < 0.0001 }
+	trackGain, albumGain := -6.0206, 6.0206 // half, and double
+	track := &db.Track{TagReplayGainTrack: &trackGain, TagReplayGainAlbum: &albumGain}
+
+	j := withTracks(1)
+	j.playing = true
+	is.Equal(j.GetStatus().Gain, 1.0)
+
+	// replaygain is applied as the track's decoded
+	j.current = gainTrack(j, 0, 0.4, transcode.ReplayGainTrack, track)
+	is.True(near(play(j, time.Millisecond)[0][0], 0.2))
+	j.current = gainTrack(j, 0, 0.4, transcode.ReplayGainAlbum, track)
+	is.True(near(play(j, time.Millisecond)[0][1], 0.8))
+	j.current = gainTrack(j, 0, 0.4, transcode.ReplayGainOff, track)
+	is.True(near(play(j, time.Millisecond)[0][0], 0.4))
+
+	// and the gain on top of it as it's played, straight away
+	j.current = gainTrack(j, 0, 0.4, transcode.ReplayGainTrack, track)
+	j.SetGain(0.5)
+	is.True(near(play(j, time.Millisecond)[0][0], 0.1))
+	j.SetGain(2)
+	is.Equal(j.GetStatus().Gain, 1.0) // clamped
+	is.True(near(play(j, time.Millisecond)[0][0], 0.2))
+
+	// items show what's applied for the mode
+	j.playlist[0] = track
+	j.SetReplayGainMode(transcode.ReplayGainAlbum)
+	is.True(near(j.GetItems()[0].ReplayGain, albumGain))
+	j.SetReplayGainMode(transcode.ReplayGainOff)
+	is.Equal(j.GetItems()[0].ReplayGain, 0.0)
+	is.Equal(j.GetItems()[0].Track, track)
+}
+
+func trackIDs(j *Jukebox) []int {
+	var ids []int
+	for _, track := range j.GetTracks() {
+		ids = append(ids, track.ID)
+	}
+	return ids
+}
+
+func TestInsertMove(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	j := withTracks(5)
+	j.index = 2
+	j.current = &trackStream{index: 2, clock: newClock(0)}
+
+	// before the current track pushes it along
+	j.InsertTracks(1, []*db.Track{{ID: 10}, {ID: 11}})
+	is.Equal(trackIDs(j), []int{0, 10, 11, 1, 2, 3, 4})
+	is.Equal(j.GetStatus().CurrentIndex, 4)
+	is.Equal(j.current.index, 4)
+	// after it doesn't, and the end is the playlist's length
+	j.InsertTracks(7, []*db.Track{{ID: 12}})
+	is.Equal(trackIDs(j), []int{0, 10, 11, 1, 2, 3, 4, 12})
+	is.Equal(j.GetStatus().CurrentIndex, 4)
+
+	// moving the current track
+	j.MoveTrack(4, 0)
+	is.Equal(trackIDs(j), []int{2, 0, 10, 11, 1, 3, 4, 12})
+	is.Equal(j.GetStatus().CurrentIndex, 0)
+	// moving one from after it to before it, and back again
+	j.MoveTrack(5, 0)
+	is.Equal(trackIDs(j), []int{3, 2, 0, 10, 11, 1, 4, 12})
+	is.Equal(j.GetStatus().CurrentIndex, 1)
+	j.MoveTrack(0, 7)
+	is.Equal(trackIDs(j), []int{2, 0, 10, 11, 1, 4, 12, 3})
+	is.Equal(j.GetStatus().CurrentIndex, 0)
+	// and one which doesn't cross it
+	j.MoveTrack(3, 6)
+	is.Equal(trackIDs(j), []int{2, 0, 10, 1, 4, 12, 11, 3})
+	is.Equal(j.GetStatus().CurrentIndex, 0)
+	is.Equal(j.current.index, 0)
+
+	// indexes outside the playlist are ignored, as with remove
+	j.InsertTracks(9, []*db.Track{{ID: 13}})
+	j.InsertTracks(-1, []*db.Track{{ID: 13}})
+	j.MoveTrack(0, 8)
+	j.MoveTrack(-1, 2)
+	is.Equal(trackIDs(j), []int{2, 0, 10, 1, 4, 12, 11, 3})
+}
+
+func TestInsertMoveShuffled(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	j := withTracks(5)
+	j.index = 3
+	j.SetShuffle(true)
+	playing := func() int { return j.GetTracks()[j.GetStatus().CurrentIndex].ID }
+
+	// the order still has each track once, starting at the current one
+	check := func() {
+		t.Helper()
+		is.Equal(j.order[0], j.index)
+		sorted := append([]int(nil), j.order...)
+		sort.Ints(sorted)
+		for i := range sorted {
+			is.Equal(sorted[i], i)
+		}
+		is.Equal(len(sorted), len(j.GetTracks()))
+	}
+	before := func() []int {
+		ids := make([]int, len(j.order))
+		for k, i := range j.order {
+			ids[k] = j.GetTracks()[i].ID
+		}
+		return ids
+	}
+
+	order := before()
+	j.MoveTrack(3, 0)
+	is.Equal(playing(), 3)
+	is.Equal(before(), order) // the same tracks in the same order
+	check()
+
+	j.InsertTracks(0, []*db.Track{{ID: 5}, {ID: 6}})
+	is.Equal(playing(), 3)
+	is.Equal(before()[:5], order) // and the new ones after them
+	check()
+}
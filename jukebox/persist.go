@@ -0,0 +1,129 @@
+package jukebox
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"go.senan.xyz/gonic/db"
+)
+
+// SettingState is where the playlist is saved, so that it's kept over restarts
+const SettingState = "jukebox_state"
+
+// restoreBatch is how many tracks are found per query, under sqlite's limit
+// on the number of parameters
+const restoreBatch = 500
+
+type savedState struct {
+	TrackIDs []int `json:"trackIds"`
+	Index    int   `json:"index"`
+	Position int   `json:"position"`
+}
+
+// Restore loads the playlist saved in dbc, paused at where it was, and saves
+// it there whenever it changes from now on. tracks which have gone since are
+// dropped
+func (j *Jukebox) Restore(dbc *db.DB) error {
+	j.Lock()
+	j.dbc = dbc
+	j.Unlock()
+
+	value, err := dbc.GetSetting(SettingState)
+	if err != nil {
+		return fmt.Errorf("get saved state: %w", err)
+	}
+	if value == "" {
+		return nil
+	}
+	var state savedState
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		return fmt.Errorf("parse saved state: %w", err)
+	}
+
+	found := map[int]*db.Track{}
+	for start := 0; start < len(state.TrackIDs); start += restoreBatch {
+		end := start + restoreBatch
+		if end > len(state.TrackIDs) {
+			end = len(state.TrackIDs)
+		}
+		var tracks []*db.Track
+		err := dbc.
+			Preload("Album").
+			Where("id IN (?)", state.TrackIDs[start:end]).
+			Find(&tracks).
+			Error
+		if err != nil {
+			return fmt.Errorf("find tracks: %w", err)
+		}
+		for _, track := range tracks {
+			found[track.ID] = track
+		}
+	}
+
+	index, position := state.Index, state.Position
+	playlist := make([]*db.Track, 0, len(state.TrackIDs))
+	for i, id := range state.TrackIDs {
+		track, ok := found[id]
+		if !ok {
+			log.Printf("dropping track %d from the jukebox playlist, it's gone", id)
+			switch {
+			case i < state.Index:
+				index--
+			case i == state.Index:
+				// the track after it plays instead, from the start
+				position = 0
+			}
+			continue
+		}
+		playlist = append(playlist, track)
+	}
+	if index >= len(playlist) {
+		index, position = 0, 0
+	}
+
+	j.Lock()
+	defer j.Unlock()
+	j.playlist = playlist
+	j.index = index
+	j.resume = position
+	j.restored = len(playlist) > 0
+	j.playing = false
+	j.ended = false
+	if j.shuffle {
+		j.reshuffle(index)
+	}
+	return nil
+}
+
+// save writes the playlist to the db, if it's kept there. saves are one at a
+// time, and each has the state from when it started, so the last is the newest
+func (j *Jukebox) save() {
+	j.saveMu.Lock()
+	defer j.saveMu.Unlock()
+
+	j.Lock()
+	dbc := j.dbc
+	if dbc == nil {
+		j.Unlock()
+		return
+	}
+	state := savedState{
+		TrackIDs: make([]int, 0, len(j.playlist)),
+		Index:    j.index,
+		Position: j.position(),
+	}
+	for _, track := range j.playlist {
+		state.TrackIDs = append(state.TrackIDs, track.ID)
+	}
+	j.Unlock()
+
+	value, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("error encoding jukebox state: %v", err)
+		return
+	}
+	if err := dbc.SetSetting(SettingState, string(value)); err != nil {
+		log.Printf("error saving jukebox state: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package jukebox
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/faiface/beep"
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+)
+
+func TestRestore(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dbc, err := db.NewMock()
+	is.NoErr(err)
+	is.NoErr(dbc.Migrate(db.MigrationContext{}))
+	t.Cleanup(func() { dbc.Close() })
+
+	artist := &db.Artist{Name: "artist"}
+	is.NoErr(dbc.Create(artist).Error)
+	album := &db.Album{RootDir: "/music", RightPath: "album", TagArtistID: artist.ID}
+	is.NoErr(dbc.Create(album).Error)
+	var tracks []*db.Track
+	for i := 0; i < 4; i++ {
+		track := &db.Track{Filename: fmt.Sprintf("%d.flac", i), AlbumID: album.ID, ArtistID: artist.ID}
+		is.NoErr(dbc.Create(track).Error)
+		tracks = append(tracks, track)
+	}
+
+	j := New(nil)
+	is.NoErr(j.Restore(dbc)) // nothing saved yet
+	is.Equal(len(j.GetTracks()), 0)
+	j.SetTracks(tracks)
+	j.Skip(2, 0)
+	is.Equal(<-j.speaker, updateSpeaker{index: 2})
+	// as if the track had started 42 seconds in
+	strm := &level{len: j.sr.N(time.Minute)}
+	format := beep.Format{SampleRate: j.sr, NumChannels: 2, Precision: 2}
+	j.Lock()
+	j.current = j.startDecoding(2, strm, format, strm, 42*time.Second, 1)
+	j.Unlock()
+	j.Stop()
+	j.Lock()
+	j.closeCurrent()
+	j.Unlock()
+
+	// a track before the current one is gone after the restart
+	is.NoErr(dbc.Delete(tracks[0]).Error)
+	j = New(nil)
+	is.NoErr(j.Restore(dbc))
+	restored := j.GetTracks()
+	is.Equal(len(restored), 3)
+	is.Equal(restored[1].ID, tracks[2].ID)
+	is.Equal(restored[1].AbsPath(), "/music/album/2.flac")
+	status := j.GetStatus()
+	is.Equal(status.CurrentIndex, 1)
+	is.Equal(status.Position, 42)
+	is.True(!status.Playing) // paused until started
+
+	j.Start()
+	is.Equal(<-j.speaker, updateSpeaker{index: 1, offset: 42})
+	is.True(j.GetStatus().Playing)
+}
@@ -0,0 +1,471 @@
+package jukebox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/faiface/beep"
+	"github.com/faiface/beep/flac"
+	"github.com/faiface/beep/mp3"
+
+	"go.senan.xyz/gonic/db"
+)
+
+// DefaultPreBuffer is how much of the next track is decoded before the current
+// one ends, so that there's no gap between them
+const DefaultPreBuffer = 2 * time.Second
+
+// preloadAhead is how long before the end of a track the next one is loaded
+const preloadAhead = 10 * time.Second
+
+// ringSize is how much of a track is decoded ahead of the speaker. the decoder
+// waits while the ring is full and the speaker plays silence while it's empty,
+// so that neither can hold the other up
+const ringSize = 2 * time.Second
+
+// stallAfter is how long the ring can stay full without the speaker reading
+// from it before the player is reported stalled
+const stallAfter = 5 * time.Second
+
+// ring is a bounded buffer of decoded samples between a track's decoder and
+// the speaker
+type ring struct {
+	mu       sync.Mutex
+	buf      [][2]float64
+	start, n int
+	done     bool
+	// fullSince is when the ring filled up, or zero if it's been read since
+	fullSince time.Time
+	// space is signalled when samples are read, for a decoder that's waiting
+	space chan struct{}
+}
+
+func newRing(size int) *ring {
+	return &ring{buf: make([][2]float64, size), space: make(chan struct{}, 1)}
+}
+
+// write copies in all of samples, waiting for the speaker while the ring is
+// full, unless ctx is done first
+func (r *ring) write(ctx context.Context, samples [][2]float64) error {
+	for {
+		r.mu.Lock()
+		for len(samples) > 0 && r.n < len(r.buf) {
+			r.buf[(r.start+r.n)%len(r.buf)] = samples[0]
+			samples = samples[1:]
+			r.n++
+		}
+		if r.n == len(r.buf) && r.fullSince.IsZero() {
+			r.fullSince = time.Now()
+		}
+		r.mu.Unlock()
+		if len(samples) == 0 {
+			return nil
+		}
+		select {
+		case <-r.space:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// read copies out what's buffered, up to len(samples), without waiting.
+// drained is true once the decoder has finished and everything is read
+func (r *ring) read(samples [][2]float64) (n int, drained bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for n < len(samples) && r.n > 0 {
+		samples[n] = r.buf[r.start]
+		r.start = (r.start + 1) % len(r.buf)
+		r.n--
+		n++
+	}
+	if n > 0 {
+		r.fullSince = time.Time{}
+		select {
+		case r.space <- struct{}{}:
+		default:
+		}
+	}
+	return n, r.done && r.n == 0
+}
+
+// finish marks that nothing more will be written
+func (r *ring) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done = true
+}
+
+func (r *ring) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.n
+}
+
+// stalled is true if the ring has been full and unread since before stallAfter
+func (r *ring) stalled(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.fullSince.IsZero() && now.Sub(r.fullSince) > stallAfter
+}
+
+// trackStream is a track being decoded into a ring, either playing or loaded
+// to play next
+type trackStream struct {
+	index  int
+	length time.Duration
+	// offset is where in the track it started, and played is how many samples
+	// have been read from the ring since. played is accessed atomically
+	offset time.Duration
+	played int64
+	ring   *ring
+	// clock is how far playback has audibly got
+	clock *clock
+	// cancel stops the decoder, and decoded is closed once it has
+	cancel  context.CancelFunc
+	decoded chan struct{}
+	strm    beep.StreamSeekCloser
+	release func()
+}
+
+// startDecoding decodes out, which is read from strm, into a ring of size
+// samples in the background
+func (j *Jukebox) startDecoding(index int, strm beep.StreamSeekCloser, format beep.Format, out beep.Streamer, offset time.Duration, size int) *trackStream {
+	ctx, cancel := context.WithCancel(j.ctx)
+	t := &trackStream{
+		index:   index,
+		length:  format.SampleRate.D(strm.Len()),
+		offset:  offset,
+		ring:    newRing(size),
+		clock:   newClock(offset),
+		cancel:  cancel,
+		decoded: make(chan struct{}),
+		strm:    strm,
+	}
+	go t.decode(ctx, out)
+	return t
+}
+
+func (t *trackStream) decode(ctx context.Context, out beep.Streamer) {
+	defer close(t.decoded)
+	defer t.ring.finish()
+	buf := make([][2]float64, 512)
+	for {
+		n, ok := out.Stream(buf)
+		if err := t.ring.write(ctx, buf[:n]); err != nil {
+			return
+		}
+		if !ok {
+			if err := out.Err(); err != nil {
+				log.Printf("error decoding jukebox track: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// Stream reads what's been decoded so far. it's never held up by the decoder,
+// and returns ok until the track has been read to its end
+func (t *trackStream) Stream(samples [][2]float64) (int, bool) {
+	n, drained := t.ring.read(samples)
+	atomic.AddInt64(&t.played, int64(n))
+	if n > 0 {
+		t.clock.run(time.Now())
+	} else {
+		t.clock.stop(time.Now())
+	}
+	return n, !drained
+}
+
+func (t *trackStream) Err() error {
+	return nil
+}
+
+// position is how far into the track has been read, where sr is the jukebox's
+// rate. it's ahead of what's audible by what the speaker has buffered
+func (t *trackStream) position(sr beep.SampleRate) time.Duration {
+	return t.offset + sr.D(int(atomic.LoadInt64(&t.played)))
+}
+
+// audible is how far into the track playback has audibly got at now
+func (t *trackStream) audible(sr beep.SampleRate, now time.Time) time.Duration {
+	return t.clock.position(now, t.position(sr))
+}
+
+// remaining is how much of the track there is left to play
+func (t *trackStream) remaining(sr beep.SampleRate) time.Duration {
+	return t.length - t.position(sr)
+}
+
+// close stops the decoder. the decoder is closed and the track's limiter slot
+// given back once it has stopped, without waiting for it here
+func (t *trackStream) close() {
+	t.cancel()
+	go func() {
+		<-t.decoded
+		_ = t.strm.Close()
+		if t.release != nil {
+			t.release()
+		}
+	}()
+}
+
+// load opens track, from offset seconds, and starts decoding it. ctx is for
+// waiting on a limiter slot
+func (j *Jukebox) load(ctx context.Context, track *db.Track, index, offset int) (_ *trackStream, err error) {
+	// decoding counts as a transcode, so a track holds a slot while it's loaded
+	var release func()
+	if j.limiter != nil {
+		if release, err = j.limiter.Acquire(ctx); err != nil {
+			return nil, fmt.Errorf("waiting to decode: %w", err)
+		}
+	}
+	defer func() {
+		if err != nil && release != nil {
+			release()
+		}
+	}()
+
+	f, err := os.Open(track.AbsPath())
+	if err != nil {
+		return nil, err
+	}
+	var strm beep.StreamSeekCloser
+	var format beep.Format
+	switch ext := track.Ext(); ext {
+	case "mp3":
+		strm, format, err = mp3.Decode(f)
+	case "flac":
+		strm, format, err = flac.Decode(f)
+	default:
+		err = fmt.Errorf("can't decode %q files", ext)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if offset != 0 {
+		if err := strm.Seek(format.SampleRate.N(time.Second * time.Duration(offset))); err != nil {
+			_ = strm.Close()
+			return nil, err
+		}
+	}
+
+	j.Lock()
+	replayGain, size := j.replayGain, ringSize
+	if j.preBuffer > size {
+		size = j.preBuffer
+	}
+	j.Unlock()
+	out := withReplayGain(beep.Resample(4, format.SampleRate, j.sr, strm), replayGain, track)
+	t := j.startDecoding(index, strm, format, out, time.Duration(offset)*time.Second, j.sr.N(size))
+	t.release = release
+	return t, nil
+}
+
+// playlistStream is what the speaker plays. it streams the current track, and
+// then carries straight on with the next one if it was loaded in time
+type playlistStream struct {
+	j *Jukebox
+	// fadeIn is a buffer for the next track while crossfading
+	fadeIn [][2]float64
+}
+
+func (p *playlistStream) Stream(samples [][2]float64) (int, bool) {
+	n, ok := p.stream(samples)
+	if gain := p.j.currentGain(); gain != 1 {
+		for i := range samples[:n] {
+			samples[i][0] *= gain
+			samples[i][1] *= gain
+		}
+	}
+	return n, ok
+}
+
+func (p *playlistStream) stream(samples [][2]float64) (int, bool) {
+	var filled int
+	for filled < len(samples) {
+		cur := p.j.currentStream()
+		if cur == nil {
+			return filled, filled > 0
+		}
+		var n int
+		var ok bool
+		if next, fade := p.j.fading(cur); next != nil {
+			n, ok = p.mix(cur, next, fade, samples[filled:])
+		} else {
+			n, ok = cur.Stream(samples[filled:])
+		}
+		filled += n
+		if !ok {
+			if !p.j.finished(cur) {
+				return filled, filled > 0
+			}
+			continue
+		}
+		p.j.preloadNext(cur)
+		if filled < len(samples) {
+			// the decoder is behind, so play silence instead of waiting for it
+			for i := range samples[filled:] {
+				samples[filled+i] = [2]float64{}
+			}
+			filled = len(samples)
+		}
+	}
+	return filled, true
+}
+
+func (p *playlistStream) Err() error {
+	return nil
+}
+
+// mix streams the end of cur fading out linearly over fade, and the start of
+// next fading in under it
+func (p *playlistStream) mix(cur, next *trackStream, fade time.Duration, samples [][2]float64) (int, bool) {
+	left := p.j.sr.N(cur.remaining(p.j.sr))
+	n, ok := cur.Stream(samples)
+	if len(p.fadeIn) < n {
+		p.fadeIn = make([][2]float64, n)
+	}
+	fadeIn := p.fadeIn[:n]
+	in, _ := next.Stream(fadeIn)
+	length := float64(p.j.sr.N(fade))
+	for i := range samples[:n] {
+		gain := float64(left-i) / length
+		switch {
+		case gain < 0:
+			gain = 0
+		case gain > 1:
+			gain = 1
+		}
+		var from [2]float64
+		if i < in {
+			from = fadeIn[i]
+		}
+		samples[i][0] = samples[i][0]*gain + from[0]*(1-gain)
+		samples[i][1] = samples[i][1]*gain + from[1]*(1-gain)
+	}
+	return n, ok
+}
+
+func (j *Jukebox) currentStream() *trackStream {
+	j.Lock()
+	defer j.Unlock()
+	return j.current
+}
+
+func (j *Jukebox) currentGain() float64 {
+	j.Lock()
+	defer j.Unlock()
+	return j.gain
+}
+
+// finished moves on from cur, which has played to its end. it returns true if
+// the next track was loaded in time for the stream to carry on with it, or
+// else asks for the next one to be loaded now
+func (j *Jukebox) finished(cur *trackStream) bool {
+	j.Lock()
+	defer j.Unlock()
+	if j.current != cur {
+		return false
+	}
+	cur.close()
+	j.current = nil
+	next := j.next
+	j.next = nil
+	j.cancelPreload()
+	if next != nil && next.index == j.nextIndex(cur.index) {
+		j.current = next
+		j.index = next.index
+		go j.save()
+		return true
+	}
+	if next != nil {
+		next.close()
+	}
+	j.request(updateSpeaker{index: cur.index, advance: true})
+	return false
+}
+
+// fading returns the next track if it should be crossfaded in under the end of
+// cur, and how long the fade is. there's no crossfade into a track after a skip,
+// or out of one that was started too close to its end
+func (j *Jukebox) fading(cur *trackStream) (*trackStream, time.Duration) {
+	j.Lock()
+	defer j.Unlock()
+	fade, next := j.crossfade, j.next
+	if fade <= 0 || j.current != cur || next == nil || next.index != j.nextIndex(cur.index) {
+		return nil, 0
+	}
+	if cur.offset > cur.length-fade || next.length <= fade || cur.remaining(j.sr) > fade {
+		return nil, 0
+	}
+	return next, fade
+}
+
+// preloadNext starts loading the track after cur once cur is nearly done
+func (j *Jukebox) preloadNext(cur *trackStream) {
+	j.Lock()
+	defer j.Unlock()
+	if cur.remaining(j.sr) > preloadAhead+j.crossfade {
+		return
+	}
+	if j.current != cur || j.next != nil || j.preloading || j.preBuffer <= 0 {
+		return
+	}
+	index := j.nextIndex(cur.index)
+	if index >= len(j.playlist) {
+		return
+	}
+	j.preloading = true
+	ctx, cancel := context.WithCancel(j.ctx)
+	j.cancelNext = cancel
+	track, gen := j.playlist[index], j.preloadGen
+	go func() {
+		next, err := j.load(ctx, track, index, 0)
+		cancel()
+		j.Lock()
+		defer j.Unlock()
+		if gen != j.preloadGen {
+			if next != nil {
+				next.close()
+			}
+			return
+		}
+		// a failed track isn't retried, it's loaded again when it's played
+		if err != nil {
+			log.Printf("error loading next jukebox track: %v", err)
+			return
+		}
+		j.next = next
+	}()
+}
+
+// cancelPreload drops the next track, if it's loaded or loading, since what
+// plays next has changed. j must be locked
+func (j *Jukebox) cancelPreload() {
+	j.preloadGen++
+	j.preloading = false
+	if j.cancelNext != nil {
+		j.cancelNext()
+		j.cancelNext = nil
+	}
+	if j.next != nil {
+		j.next.close()
+		j.next = nil
+	}
+}
+
+// closeCurrent stops the current track. j must be locked
+func (j *Jukebox) closeCurrent() {
+	if j.current != nil {
+		j.current.close()
+		j.current = nil
+	}
+}
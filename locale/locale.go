@@ -0,0 +1,179 @@
+// Package locale has what changes with a user's language: the web UI's
+// messages, how dates are shown, and how names are sorted and indexed
+package locale
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// Default is used when a user hasn't chosen a locale
+var Default = language.English
+
+// Choice is a locale a user can choose, with its name in itself
+type Choice struct {
+	Tag  language.Tag
+	Name string
+}
+
+// Supported is each locale a user can choose
+var Supported = []Choice{
+	{language.English, "English"},
+	{language.German, "Deutsch"},
+	{language.Swedish, "Svenska"},
+	{language.Turkish, "Türkçe"},
+}
+
+var matcher = language.NewMatcher(supportedTags())
+
+func supportedTags() []language.Tag {
+	tags := make([]language.Tag, 0, len(Supported))
+	for _, s := range Supported {
+		tags = append(tags, s.Tag)
+	}
+	return tags
+}
+
+// Parse finds the supported locale closest to s, or Default if there isn't one
+func Parse(s string) language.Tag {
+	if s == "" {
+		return Default
+	}
+	tag, err := language.Parse(s)
+	if err != nil {
+		return Default
+	}
+	_, i, conf := matcher.Match(tag)
+	if conf == language.No {
+		return Default
+	}
+	return Supported[i].Tag
+}
+
+// IsSupported returns true if s is one of Supported's tags exactly
+func IsSupported(s string) bool {
+	for _, supported := range Supported {
+		if supported.Tag.String() == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Locale formats messages and dates for a user. it isn't safe for concurrent use
+type Locale struct {
+	tag     language.Tag
+	printer *message.Printer
+}
+
+// New makes a Locale for the supported locale closest to s
+func New(s string) *Locale {
+	tag := Parse(s)
+	return &Locale{
+		tag:     tag,
+		printer: message.NewPrinter(tag, message.Catalog(messages)),
+	}
+}
+
+// Tag returns the supported locale which was chosen
+func (l *Locale) Tag() string {
+	return l.tag.String()
+}
+
+// T translates an english message, formatting it with args like fmt.Sprintf.
+// messages without a translation are shown in english
+func (l *Locale) T(key string, args ...interface{}) string {
+	return l.printer.Sprintf(key, args...)
+}
+
+// Date formats a day, like "jan 02, 2006" in english or "02.01.2006" in german
+func (l *Locale) Date(t time.Time) string {
+	return strings.ToLower(t.Format(l.T(dateLayout)))
+}
+
+// DateHuman formats a time relative to now, like "3 weeks ago"
+func (l *Locale) DateHuman(t time.Time) string {
+	rel, ok := relTimes[l.tag]
+	if !ok {
+		return humanize.Time(t)
+	}
+	return humanize.CustomRelTime(t, time.Now(), rel.ago, rel.fromNow, rel.magnitudes)
+}
+
+// Sorter orders and indexes names the way a locale's alphabet does, ignoring
+// case. it isn't safe for concurrent use
+type Sorter struct {
+	coll  *collate.Collator
+	loose *collate.Collator
+	buf   collate.Buffer
+}
+
+func (l *Locale) Sorter() *Sorter {
+	return NewSorter(l.tag)
+}
+
+func NewSorter(tag language.Tag) *Sorter {
+	return &Sorter{
+		coll:  collate.New(tag, collate.IgnoreCase),
+		loose: collate.New(tag, collate.Loose),
+	}
+}
+
+// Slice stably sorts x, which must be a slice, by name(i) for each element i
+func (s *Sorter) Slice(x interface{}, name func(i int) string) {
+	n := reflect.ValueOf(x).Len()
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = s.coll.KeyFromString(&s.buf, name(i))
+	}
+	sort.Stable(&byKey{keys: keys, swap: reflect.Swapper(x)})
+	s.buf.Reset()
+}
+
+type byKey struct {
+	keys [][]byte
+	swap func(i, j int)
+}
+
+func (b *byKey) Len() int           { return len(b.keys) }
+func (b *byKey) Less(i, j int) bool { return string(b.keys[i]) < string(b.keys[j]) }
+func (b *byKey) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	b.swap(i, j)
+}
+
+// IndexKey is the lower case letter a name is listed under, or "#" if it
+// doesn't start with one. translit is the name in ascii, for names which
+// aren't in the latin alphabet.
+//
+// a letter with an accent is listed under the letter without it, unless it's
+// a letter of its own in the locale's alphabet. so "Öberg" is under "o" in
+// german, but "ö" in swedish
+func (s *Sorter) IndexKey(name, translit string) string {
+	first, _ := utf8.DecodeRuneInString(name)
+	first = unicode.ToLower(first)
+	base, _ := utf8.DecodeRuneInString(translit)
+	base = unicode.ToLower(base)
+	switch {
+	case first == base && unicode.IsLetter(first):
+		return string(first)
+	case !unicode.Is(unicode.Latin, first):
+		if base < utf8.RuneSelf && unicode.IsLetter(base) {
+			return string(base)
+		}
+		return "#"
+	case unicode.IsLetter(base) && s.loose.CompareString(string(first), string(base)) == 0:
+		return string(base)
+	default:
+		return string(first)
+	}
+}
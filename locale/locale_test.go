@@ -0,0 +1,89 @@
+package locale
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"golang.org/x/text/language"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	is.Equal(Parse(""), language.English)
+	is.Equal(Parse("de"), language.German)
+	is.Equal(Parse("de-AT"), language.German)
+	is.Equal(Parse("sv-FI"), language.Swedish)
+	is.Equal(Parse("ja"), language.English)
+	is.Equal(Parse("not a locale"), language.English)
+	is.True(IsSupported("tr"))
+	is.True(!IsSupported("tr-CY"))
+}
+
+func TestSort(t *testing.T) {
+	t.Parallel()
+	names := []string{"Zappa", "Öberg", "oasis", "Abba", "Ärzte", "Irmak", "İlhan", "Cem", "Çelik"}
+	tcs := []struct {
+		locale string
+		exp    []string
+	}{
+		{"en", []string{"Abba", "Ärzte", "Çelik", "Cem", "İlhan", "Irmak", "oasis", "Öberg", "Zappa"}},
+		// umlauts sort with their vowel
+		{"de", []string{"Abba", "Ärzte", "Çelik", "Cem", "İlhan", "Irmak", "oasis", "Öberg", "Zappa"}},
+		// å, ä, and ö are letters of their own after z
+		{"sv", []string{"Abba", "Çelik", "Cem", "İlhan", "Irmak", "oasis", "Zappa", "Ärzte", "Öberg"}},
+		// ç comes after c, and the dotless I before the dotted İ
+		{"tr", []string{"Abba", "Ärzte", "Cem", "Çelik", "Irmak", "İlhan", "oasis", "Öberg", "Zappa"}},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.locale, func(t *testing.T) {
+			t.Parallel()
+			got := append([]string(nil), names...)
+			New(tc.locale).Sorter().Slice(got, func(i int) string { return got[i] })
+			is.New(t).Equal(got, tc.exp)
+		})
+	}
+}
+
+func TestIndexKey(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		locale, name, translit string
+		exp                    string
+	}{
+		{"en", "Öberg", "Oberg", "o"},
+		{"de", "Öberg", "Oberg", "o"},
+		{"sv", "Öberg", "Oberg", "ö"},
+		{"sv", "Ångström", "Angstrom", "å"},
+		{"tr", "Çelik", "Celik", "ç"},
+		{"tr", "Öberg", "Oberg", "ö"},
+		{"de", "Çelik", "Celik", "c"},
+		{"en", "abba", "abba", "a"},
+		{"en", "2pac", "2pac", "#"},
+		{"en", "坂本龍一", "Ban Ben Long Yi", "b"},
+		{"en", "...", "...", "#"},
+	}
+	for _, tc := range tcs {
+		s := New(tc.locale).Sorter()
+		if got := s.IndexKey(tc.name, tc.translit); got != tc.exp {
+			t.Errorf("%s: index key of %q = %q, want %q", tc.locale, tc.name, got, tc.exp)
+		}
+	}
+}
+
+func TestMessages(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	day := time.Date(2022, time.July, 4, 12, 0, 0, 0, time.UTC)
+	is.Equal(New("").Date(day), "jul 04, 2022")
+	is.Equal(New("de").Date(day), "04.07.2022")
+	is.Equal(New("sv").Date(day), "2022-07-04")
+	is.Equal(New("de").T("welcome %s", "senan"), "willkommen senan")
+	is.Equal(New("").T("welcome %s", "senan"), "welcome senan")
+	is.Equal(New("").T("language details"), english["language details"])
+	is.Equal(New("de").DateHuman(time.Now().Add(-3*24*time.Hour)), "vor 3 tagen")
+	is.Equal(New("tr").DateHuman(time.Now().Add(-3*24*time.Hour)), "3 gün önce")
+	is.Equal(New("").DateHuman(time.Now().Add(-3*24*time.Hour)), "3 days ago")
+}
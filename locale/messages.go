@@ -0,0 +1,220 @@
+package locale
+
+import (
+	"math"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message/catalog"
+)
+
+// dateLayout is translated to each locale's layout for time.Format
+const dateLayout = "Jan 02, 2006"
+
+// translations are keyed by the english message. messages are lower case, like
+// the rest of the web UI
+var translations = map[language.Tag]map[string]string{
+	language.German: {
+		dateLayout: "02.01.2006",
+		// navigation
+		"welcome %s": "willkommen %s",
+		"home":       "startseite",
+		"logout":     "abmelden",
+		// settings
+		"stats":                "statistik",
+		"artists:":             "künstler:",
+		"albums:":              "alben:",
+		"tracks:":              "titel:",
+		"language":             "sprache",
+		"language details":     "die sprache dieser seite, wie datumsangaben angezeigt werden, und wie künstler und ordner beim browsen in clients sortiert werden. nach namen sortierte albumlisten sind nur ungefähr sortiert",
+		"update":               "aktualisieren",
+		"artist index":         "künstlerverzeichnis",
+		"artist index details": "wähle, welche künstler aufgelistet werden, wenn clients nach tags, oder nach ordnern mit dem namen eines künstlers, browsen. die suche findet immer alle künstler",
+		"all artists":          "alle künstler",
+		"album artists only":   "nur albumkünstler",
+		"album artists, and artists credited on at least": "albumkünstler, und künstler genannt auf mindestens",
+		"tracks":          "titel",
+		"your account":    "dein konto",
+		"change username": "benutzernamen ändern",
+		"change password": "passwort ändern",
+		// albums
+		"recent folders": "neue ordner",
+		"no folders yet": "noch keine ordner",
+		"scanned %s":     "gescannt %s",
+		"created %s":     "erstellt %s",
+		"used %s":        "benutzt %s",
+		// artist page
+		"no albums yet":   "noch keine alben",
+		"albums":          "alben",
+		"eps and singles": "eps und singles",
+		"live":            "live",
+		"compilations":    "compilations",
+		"appears on":      "erscheint auf",
+	},
+	language.Swedish: {
+		dateLayout: "2006-01-02",
+		// navigation
+		"welcome %s": "välkommen %s",
+		"home":       "hem",
+		"logout":     "logga ut",
+		// settings
+		"stats":                "statistik",
+		"artists:":             "artister:",
+		"albums:":              "album:",
+		"tracks:":              "spår:",
+		"language":             "språk",
+		"language details":     "språket på den här sidan, hur datum visas, och hur artister och mappar sorteras när klienter bläddrar. albumlistor sorterade efter namn är bara ungefär sorterade",
+		"update":               "uppdatera",
+		"artist index":         "artistindex",
+		"artist index details": "välj vilka artister som listas när klienter bläddrar efter taggar, eller efter mappar med en artists namn. sökningar hittar alltid alla artister",
+		"all artists":          "alla artister",
+		"album artists only":   "endast albumartister",
+		"album artists, and artists credited on at least": "albumartister, och artister krediterade på minst",
+		"tracks":          "spår",
+		"your account":    "ditt konto",
+		"change username": "byt användarnamn",
+		"change password": "byt lösenord",
+		// albums
+		"recent folders": "senaste mappar",
+		"no folders yet": "inga mappar än",
+		"scanned %s":     "skannad %s",
+		"created %s":     "skapad %s",
+		"used %s":        "använd %s",
+		// artist page
+		"no albums yet":   "inga album än",
+		"albums":          "album",
+		"eps and singles": "ep-skivor och singlar",
+		"live":            "live",
+		"compilations":    "samlingar",
+		"appears on":      "medverkar på",
+	},
+	language.Turkish: {
+		dateLayout: "02.01.2006",
+		// navigation
+		"welcome %s": "hoş geldin %s",
+		"home":       "ana sayfa",
+		"logout":     "çıkış yap",
+		// settings
+		"stats":                "istatistikler",
+		"artists:":             "sanatçılar:",
+		"albums:":              "albümler:",
+		"tracks:":              "parçalar:",
+		"language":             "dil",
+		"language details":     "bu sayfanın dili, tarihlerin nasıl gösterileceği, ve istemciler gezinirken sanatçıların ve klasörlerin nasıl sıralanacağı. ada göre sıralanan albüm listeleri yalnızca yaklaşık olarak sıralanır",
+		"update":               "güncelle",
+		"artist index":         "sanatçı dizini",
+		"artist index details": "istemciler etiketlere veya sanatçı adını taşıyan klasörlere göre gezinirken hangi sanatçıların listeleneceğini seçin. arama her zaman tüm sanatçıları bulur",
+		"all artists":          "tüm sanatçılar",
+		"album artists only":   "yalnızca albüm sanatçıları",
+		"album artists, and artists credited on at least": "albüm sanatçıları, ve en az şu kadar parçada adı geçen sanatçılar",
+		"tracks":          "parça",
+		"your account":    "hesabın",
+		"change username": "kullanıcı adını değiştir",
+		"change password": "şifreyi değiştir",
+		// albums
+		"recent folders": "son klasörler",
+		"no folders yet": "henüz klasör yok",
+		"scanned %s":     "%s tarandı",
+		"created %s":     "%s oluşturuldu",
+		"used %s":        "%s kullanıldı",
+		// artist page
+		"no albums yet":   "henüz albüm yok",
+		"albums":          "albümler",
+		"eps and singles": "ep'ler ve single'lar",
+		"live":            "canlı",
+		"compilations":    "derlemeler",
+		"appears on":      "yer aldığı albümler",
+	},
+}
+
+// english is what messages with a longer key say in english
+var english = map[string]string{
+	"language details":     "choose the language of this page, how dates are shown, and how artists and folders are sorted when clients browse. album lists sorted by name are only roughly sorted",
+	"artist index details": "choose which artists are listed when clients browse by tags, or by folders named after artists. searching will always find every artist",
+}
+
+var messages = newCatalog()
+
+func newCatalog() catalog.Catalog {
+	builder := catalog.NewBuilder(catalog.Fallback(Default))
+	for key, msg := range english {
+		_ = builder.SetString(Default, key, msg)
+	}
+	for tag, msgs := range translations {
+		for key, msg := range msgs {
+			_ = builder.SetString(tag, key, msg)
+		}
+	}
+	return builder
+}
+
+type relTime struct {
+	ago, fromNow string
+	magnitudes   []humanize.RelTimeMagnitude
+}
+
+func magnitude(d time.Duration, format string, divBy time.Duration) humanize.RelTimeMagnitude {
+	return humanize.RelTimeMagnitude{D: d, Format: format, DivBy: divBy}
+}
+
+// relTimes are for DateHuman, like humanize's defaults. english uses those
+var relTimes = map[language.Tag]relTime{
+	language.German: {"vor", "in", []humanize.RelTimeMagnitude{
+		magnitude(time.Second, "jetzt", time.Second),
+		magnitude(2*time.Second, "%s 1 sekunde", 1),
+		magnitude(time.Minute, "%s %d sekunden", time.Second),
+		magnitude(2*time.Minute, "%s 1 minute", 1),
+		magnitude(time.Hour, "%s %d minuten", time.Minute),
+		magnitude(2*time.Hour, "%s 1 stunde", 1),
+		magnitude(humanize.Day, "%s %d stunden", time.Hour),
+		magnitude(2*humanize.Day, "%s 1 tag", 1),
+		magnitude(humanize.Week, "%s %d tagen", humanize.Day),
+		magnitude(2*humanize.Week, "%s 1 woche", 1),
+		magnitude(humanize.Month, "%s %d wochen", humanize.Week),
+		magnitude(2*humanize.Month, "%s 1 monat", 1),
+		magnitude(humanize.Year, "%s %d monaten", humanize.Month),
+		magnitude(18*humanize.Month, "%s 1 jahr", 1),
+		magnitude(2*humanize.Year, "%s 2 jahren", 1),
+		magnitude(humanize.LongTime, "%s %d jahren", humanize.Year),
+		magnitude(math.MaxInt64, "%s langer zeit", 1),
+	}},
+	language.Swedish: {"sedan", "från nu", []humanize.RelTimeMagnitude{
+		magnitude(time.Second, "nu", time.Second),
+		magnitude(2*time.Second, "1 sekund %s", 1),
+		magnitude(time.Minute, "%d sekunder %s", time.Second),
+		magnitude(2*time.Minute, "1 minut %s", 1),
+		magnitude(time.Hour, "%d minuter %s", time.Minute),
+		magnitude(2*time.Hour, "1 timme %s", 1),
+		magnitude(humanize.Day, "%d timmar %s", time.Hour),
+		magnitude(2*humanize.Day, "1 dag %s", 1),
+		magnitude(humanize.Week, "%d dagar %s", humanize.Day),
+		magnitude(2*humanize.Week, "1 vecka %s", 1),
+		magnitude(humanize.Month, "%d veckor %s", humanize.Week),
+		magnitude(2*humanize.Month, "1 månad %s", 1),
+		magnitude(humanize.Year, "%d månader %s", humanize.Month),
+		magnitude(18*humanize.Month, "1 år %s", 1),
+		magnitude(2*humanize.Year, "2 år %s", 1),
+		magnitude(humanize.LongTime, "%d år %s", humanize.Year),
+		magnitude(math.MaxInt64, "länge %s", 1),
+	}},
+	language.Turkish: {"önce", "sonra", []humanize.RelTimeMagnitude{
+		magnitude(time.Second, "şimdi", time.Second),
+		magnitude(2*time.Second, "1 saniye %s", 1),
+		magnitude(time.Minute, "%d saniye %s", time.Second),
+		magnitude(2*time.Minute, "1 dakika %s", 1),
+		magnitude(time.Hour, "%d dakika %s", time.Minute),
+		magnitude(2*time.Hour, "1 saat %s", 1),
+		magnitude(humanize.Day, "%d saat %s", time.Hour),
+		magnitude(2*humanize.Day, "1 gün %s", 1),
+		magnitude(humanize.Week, "%d gün %s", humanize.Day),
+		magnitude(2*humanize.Week, "1 hafta %s", 1),
+		magnitude(humanize.Month, "%d hafta %s", humanize.Week),
+		magnitude(2*humanize.Month, "1 ay %s", 1),
+		magnitude(humanize.Year, "%d ay %s", humanize.Month),
+		magnitude(18*humanize.Month, "1 yıl %s", 1),
+		magnitude(2*humanize.Year, "2 yıl %s", 1),
+		magnitude(humanize.LongTime, "%d yıl %s", humanize.Year),
+		magnitude(math.MaxInt64, "uzun zaman %s", 1),
+	}},
+}
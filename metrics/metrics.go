@@ -0,0 +1,147 @@
+// Package metrics counts what gonic is doing, for prometheus to scrape and
+// graph. the methods of a nil *Metrics do nothing, so that whatever records
+// them doesn't need to check if metrics are turned on
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are gonic's counters and gauges
+type Metrics struct {
+	registry     *prometheus.Registry
+	handler      http.Handler
+	requests     *prometheus.CounterVec
+	streamBytes  *prometheus.CounterVec
+	scanDuration prometheus.Gauge
+	scanLast     prometheus.Gauge
+	library      *prometheus.GaugeVec
+	scrobbles    *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	r := prometheus.NewRegistry()
+	m := &Metrics{
+		registry: r,
+		handler:  promhttp.HandlerFor(r, promhttp.HandlerOpts{}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gonic_subsonic_requests_total",
+			Help: "Subsonic API requests by view, and whether they were ok or failed.",
+		}, []string{"view", "status"}),
+		streamBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gonic_stream_bytes_total",
+			Help: "Bytes of audio served by view, like stream or download.",
+		}, []string{"view"}),
+		scanDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gonic_scan_duration_seconds",
+			Help: "How long the last scan took.",
+		}),
+		scanLast: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gonic_scan_last_timestamp_seconds",
+			Help: "When the last scan finished, as a unix time.",
+		}),
+		library: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gonic_library_items",
+			Help: "Tracks, albums, and artists in the library as of the last scan.",
+		}, []string{"kind"}),
+		scrobbles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gonic_scrobbles_total",
+			Help: "Scrobbles sent by target, and whether they succeeded or failed.",
+		}, []string{"target", "result"}),
+	}
+	r.MustRegister(m.requests, m.streamBytes, m.scanDuration, m.scanLast, m.library, m.scrobbles)
+	return m
+}
+
+// Request records a subsonic request for view
+func (m *Metrics) Request(view string, ok bool) {
+	if m == nil {
+		return
+	}
+	status := "ok"
+	if !ok {
+		status = "failed"
+	}
+	m.requests.WithLabelValues(view, status).Inc()
+}
+
+// StreamBytes records n bytes of audio served by view
+func (m *Metrics) StreamBytes(view string, n int64) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.streamBytes.WithLabelValues(view).Add(float64(n))
+}
+
+// Scan records a scan which took dur, and finished at
+func (m *Metrics) Scan(dur time.Duration, at time.Time) {
+	if m == nil {
+		return
+	}
+	m.scanDuration.Set(dur.Seconds())
+	m.scanLast.Set(float64(at.Unix()))
+}
+
+// Library records the library's totals
+func (m *Metrics) Library(tracks, albums, artists int) {
+	if m == nil {
+		return
+	}
+	m.library.WithLabelValues("tracks").Set(float64(tracks))
+	m.library.WithLabelValues("albums").Set(float64(albums))
+	m.library.WithLabelValues("artists").Set(float64(artists))
+}
+
+// Scrobble records a scrobble sent to target, which failed if err isn't nil
+func (m *Metrics) Scrobble(target string, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.scrobbles.WithLabelValues(target, result).Inc()
+}
+
+// TranscodesActive reports how many transcodes are running, from fn
+func (m *Metrics) TranscodesActive(fn func() int) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gonic_transcodes_active",
+		Help: "Transcodes running now.",
+	}, func() float64 {
+		return float64(fn())
+	}))
+}
+
+// JukeboxPlaying reports whether the jukebox is playing, from fn
+func (m *Metrics) JukeboxPlaying(fn func() bool) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gonic_jukebox_playing",
+		Help: "1 if the jukebox is playing, or else 0.",
+	}, func() float64 {
+		if fn() {
+			return 1
+		}
+		return 0
+	}))
+}
+
+// ServeHTTP writes the metrics for prometheus
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	m.handler.ServeHTTP(w, r)
+}
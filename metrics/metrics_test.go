@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestMetrics(t *testing.T) {
+	is := is.New(t)
+	m := New()
+	m.Request("ping", true)
+	m.Request("getAlbum", false)
+	m.StreamBytes("stream", 1000)
+	m.StreamBytes("stream", 24)
+	m.Scan(90*time.Second, time.Unix(1660000000, 0))
+	m.Library(10, 2, 1)
+	m.Scrobble("lastfm", nil)
+	m.Scrobble("lastfm", errors.New("no"))
+	m.TranscodesActive(func() int { return 3 })
+	m.JukeboxPlaying(func() bool { return true })
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	is.True(strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain"))
+	body := rr.Body.String()
+	for _, line := range []string{
+		`gonic_subsonic_requests_total{status="ok",view="ping"} 1`,
+		`gonic_subsonic_requests_total{status="failed",view="getAlbum"} 1`,
+		`gonic_stream_bytes_total{view="stream"} 1024`,
+		`gonic_scan_duration_seconds 90`,
+		`gonic_scan_last_timestamp_seconds 1.66e+09`,
+		`gonic_library_items{kind="tracks"} 10`,
+		`gonic_library_items{kind="albums"} 2`,
+		`gonic_library_items{kind="artists"} 1`,
+		`gonic_scrobbles_total{result="success",target="lastfm"} 1`,
+		`gonic_scrobbles_total{result="failure",target="lastfm"} 1`,
+		`gonic_transcodes_active 3`,
+		`gonic_jukebox_playing 1`,
+	} {
+		is.True(strings.Contains(body, line+"\n")) // missing line
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	is := is.New(t)
+	var m *Metrics
+	m.Request("ping", true)
+	m.StreamBytes("stream", 1)
+	m.Scan(time.Second, time.Now())
+	m.Library(1, 1, 1)
+	m.Scrobble("lastfm", nil)
+	m.TranscodesActive(func() int { return 0 })
+	m.JukeboxPlaying(func() bool { return false })
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	is.Equal(rr.Code, http.StatusNotFound)
+}
@@ -10,6 +10,9 @@ func FromExtension(ext string) (string, bool) {
 		"ogg":  "audio/ogg",
 		"opus": "audio/ogg",
 		"wma":  "audio/x-ms-wma",
+		"wav":  "audio/x-wav",
+		"aif":  "audio/x-aiff",
+		"aiff": "audio/x-aiff",
 	}
 	v, ok := types[ext]
 	return v, ok
@@ -0,0 +1,178 @@
+// Package notify sends admins a message when something goes wrong that they
+// might not see in the logs, like a failed scan, to sinks such as ntfy
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.senan.xyz/gonic/multierr"
+)
+
+type EventType string
+
+const (
+	EventScanFailed       EventType = "scan_failed"
+	EventDiskLow          EventType = "disk_low"
+	EventScrobblerAuth    EventType = "scrobbler_auth"
+	EventPodcastDownloads EventType = "podcast_downloads"
+	// EventTest is sent from the web interface. it's never disabled or throttled
+	EventTest EventType = "test"
+)
+
+// EventTypes are the events which can be enabled, in the order they're shown
+var EventTypes = []EventType{EventScanFailed, EventDiskLow, EventScrobblerAuth, EventPodcastDownloads}
+
+type Event struct {
+	Type    EventType
+	Title   string
+	Message string
+}
+
+// Sink is somewhere to send events, like an ntfy topic
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, event Event) error
+}
+
+// DefaultThrottle is how long to wait before sending an event of the same type
+// again, so that a condition which keeps coming and going isn't sent every time
+const DefaultThrottle = time.Hour
+
+// sendTimeout is how long each sink has to send an event
+const sendTimeout = 10 * time.Second
+
+// Dispatcher sends events to every sink. a nil Dispatcher drops them, so that
+// the rest of gonic doesn't need to know whether notifications are set up
+type Dispatcher struct {
+	sinks    []Sink
+	enabled  map[EventType]bool
+	throttle time.Duration
+
+	mu         sync.Mutex
+	lastSent   map[EventType]time.Time
+	suppressed map[EventType]int
+}
+
+// New sends events of the enabled types to sinks, or events of every type if
+// none are given. events of a type are sent at most once per throttle
+func New(sinks []Sink, enabled []EventType, throttle time.Duration) *Dispatcher {
+	d := &Dispatcher{
+		sinks:      sinks,
+		throttle:   throttle,
+		lastSent:   map[EventType]time.Time{},
+		suppressed: map[EventType]int{},
+	}
+	if len(enabled) > 0 {
+		d.enabled = map[EventType]bool{}
+		for _, typ := range enabled {
+			d.enabled[typ] = true
+		}
+	}
+	return d
+}
+
+// ParseEventType checks name is a type of event that can be enabled
+func ParseEventType(name string) (EventType, error) {
+	for _, typ := range EventTypes {
+		if string(typ) == name {
+			return typ, nil
+		}
+	}
+	return "", fmt.Errorf("unknown event type %q", name)
+}
+
+// Sinks returns the names of where events are sent
+func (d *Dispatcher) Sinks() []string {
+	if d == nil {
+		return nil
+	}
+	names := make([]string, 0, len(d.sinks))
+	for _, sink := range d.sinks {
+		names = append(names, sink.Name())
+	}
+	return names
+}
+
+// Events returns the types of event which are sent
+func (d *Dispatcher) Events() []EventType {
+	if d == nil {
+		return nil
+	}
+	var events []EventType
+	for _, typ := range EventTypes {
+		if d.enabled == nil || d.enabled[typ] {
+			events = append(events, typ)
+		}
+	}
+	return events
+}
+
+// Publish sends event in the background, unless its type is disabled or one
+// was sent recently. failures are logged, so that they never affect whatever
+// published the event
+func (d *Dispatcher) Publish(event Event) {
+	event, ok := d.admit(event, time.Now())
+	if !ok {
+		return
+	}
+	go func() {
+		if err := d.send(context.Background(), event); err != nil {
+			log.Printf("error sending %s notification: %v", event.Type, err)
+		}
+	}()
+}
+
+// Test sends a test event now, and returns which sinks it failed for
+func (d *Dispatcher) Test(ctx context.Context) error {
+	if d == nil || len(d.sinks) == 0 {
+		return fmt.Errorf("no notification sinks are configured")
+	}
+	return d.send(ctx, Event{
+		Type:    EventTest,
+		Title:   "gonic test notification",
+		Message: "notifications from gonic are working",
+	})
+}
+
+// admit decides if event should be sent at now. if others of its type were
+// dropped since the last one, it says how many
+func (d *Dispatcher) admit(event Event, now time.Time) (Event, bool) {
+	if d == nil || len(d.sinks) == 0 {
+		return event, false
+	}
+	if d.enabled != nil && !d.enabled[event.Type] {
+		return event, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if last, ok := d.lastSent[event.Type]; ok && now.Sub(last) < d.throttle {
+		d.suppressed[event.Type]++
+		return event, false
+	}
+	if n := d.suppressed[event.Type]; n > 0 {
+		event.Message += fmt.Sprintf(" (and %d more like this since the last notification)", n)
+	}
+	d.lastSent[event.Type] = now
+	d.suppressed[event.Type] = 0
+	return event, true
+}
+
+func (d *Dispatcher) send(ctx context.Context, event Event) error {
+	var errs multierr.Err
+	for _, sink := range d.sinks {
+		sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+		err := sink.Send(sendCtx, event)
+		cancel()
+		if err != nil {
+			errs.Add(fmt.Errorf("%s: %w", sink.Name(), err))
+		}
+	}
+	if errs.Len() > 0 {
+		return &errs
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+type sinkFunc func(ctx context.Context, event Event) error
+
+func (sinkFunc) Name() string                                  { return "func" }
+func (f sinkFunc) Send(ctx context.Context, event Event) error { return f(ctx, event) }
+func nopSink() Sink                                            { return sinkFunc(func(context.Context, Event) error { return nil }) }
+
+func TestAdmitThrottle(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	d := New([]Sink{nopSink()}, nil, time.Hour)
+	start := time.Now()
+	event := Event{Type: EventScanFailed, Message: "scan failed"}
+
+	_, ok := d.admit(event, start)
+	is.True(ok)
+	_, ok = d.admit(event, start.Add(time.Minute))
+	is.True(!ok) // throttled
+	_, ok = d.admit(event, start.Add(2*time.Minute))
+	is.True(!ok) // throttled
+
+	// other types aren't throttled by this one
+	_, ok = d.admit(Event{Type: EventDiskLow}, start.Add(time.Minute))
+	is.True(ok)
+
+	got, ok := d.admit(event, start.Add(time.Hour))
+	is.True(ok)
+	is.Equal(got.Message, "scan failed (and 2 more like this since the last notification)")
+
+	got, ok = d.admit(event, start.Add(3*time.Hour))
+	is.True(ok)
+	is.Equal(got.Message, "scan failed")
+}
+
+func TestAdmitEnabled(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	d := New([]Sink{nopSink()}, []EventType{EventDiskLow}, time.Hour)
+	_, ok := d.admit(Event{Type: EventScanFailed}, time.Now())
+	is.True(!ok)
+	_, ok = d.admit(Event{Type: EventDiskLow}, time.Now())
+	is.True(ok)
+	is.Equal(d.Events(), []EventType{EventDiskLow})
+
+	// no sinks, nothing to send
+	d = New(nil, nil, time.Hour)
+	_, ok = d.admit(Event{Type: EventDiskLow}, time.Now())
+	is.True(!ok)
+}
+
+func TestNilDispatcher(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	var d *Dispatcher
+	d.Publish(Event{Type: EventScanFailed})
+	is.Equal(d.Sinks(), nil)
+	is.Equal(d.Events(), nil)
+	is.True(d.Test(context.Background()) != nil)
+}
+
+func TestTestReportsFailures(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	var got []Event
+	ok := sinkFunc(func(_ context.Context, event Event) error {
+		got = append(got, event)
+		return nil
+	})
+	bad := &Webhook{URL: "http://127.0.0.1:0"}
+	d := New([]Sink{ok, bad}, []EventType{EventDiskLow}, time.Hour)
+	err := d.Test(context.Background())
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "webhook: "))
+	is.Equal(len(got), 1) // sent to the working sink, and not disabled
+	is.Equal(got[0].Type, EventTest)
+}
+
+func TestSinks(t *testing.T) {
+	t.Parallel()
+	event := Event{Type: EventDiskLow, Title: "low", Message: "disk is low"}
+
+	type request struct {
+		path    string
+		headers http.Header
+		body    string
+	}
+	serve := func(t *testing.T) (string, <-chan request) {
+		reqs := make(chan request, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			reqs <- request{r.URL.Path, r.Header, string(body)}
+		}))
+		t.Cleanup(srv.Close)
+		return srv.URL, reqs
+	}
+
+	t.Run("webhook", func(t *testing.T) {
+		is := is.New(t)
+		url, reqs := serve(t)
+		is.NoErr((&Webhook{URL: url}).Send(context.Background(), event))
+		req := <-reqs
+		var body map[string]string
+		is.NoErr(json.Unmarshal([]byte(req.body), &body))
+		is.Equal(body, map[string]string{"type": "disk_low", "title": "low", "message": "disk is low"})
+	})
+	t.Run("ntfy", func(t *testing.T) {
+		is := is.New(t)
+		url, reqs := serve(t)
+		is.NoErr((&Ntfy{URL: url + "/gonic"}).Send(context.Background(), event))
+		req := <-reqs
+		is.Equal(req.path, "/gonic")
+		is.Equal(req.headers.Get("Title"), "low")
+		is.Equal(req.headers.Get("Tags"), "gonic,disk_low")
+		is.Equal(req.body, "disk is low")
+	})
+	t.Run("gotify", func(t *testing.T) {
+		is := is.New(t)
+		url, reqs := serve(t)
+		is.NoErr((&Gotify{URL: url + "/", Token: "tok"}).Send(context.Background(), event))
+		req := <-reqs
+		is.Equal(req.path, "/message")
+		is.Equal(req.headers.Get("X-Gotify-Key"), "tok")
+		is.True(strings.Contains(req.body, `"message":"disk is low"`))
+	})
+	t.Run("bad status", func(t *testing.T) {
+		is := is.New(t)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer srv.Close()
+		is.True((&Ntfy{URL: srv.URL}).Send(context.Background(), event) != nil)
+	})
+}
+
+func TestEmailMessage(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	email := &Email{From: "gonic@example.com", To: []string{"a@example.com", "b@example.com"}}
+	msg := string(email.message(Event{Title: "bad\r\nBcc: x@example.com", Message: "one\ntwo"}, time.Unix(0, 0).UTC()))
+	is.True(strings.Contains(msg, "To: a@example.com, b@example.com\r\n"))
+	is.True(strings.Contains(msg, "Subject: bad  Bcc: x@example.com\r\n"))
+	is.True(strings.HasSuffix(msg, "\r\n\r\none\r\ntwo\r\n"))
+}
@@ -0,0 +1,170 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Webhook posts events as json, like {"type": "...", "title": "...", "message": "..."}
+type Webhook struct {
+	URL string
+}
+
+func (w *Webhook) Name() string { return "webhook" }
+
+func (w *Webhook) Send(ctx context.Context, event Event) error {
+	body, err := json.Marshal(struct {
+		Type    EventType `json:"type"`
+		Title   string    `json:"title"`
+		Message string    `json:"message"`
+	}{event.Type, event.Title, event.Message})
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+	return post(ctx, w.URL, "application/json", body, nil)
+}
+
+// Ntfy posts events to an ntfy topic, eg. https://ntfy.sh/my-gonic
+type Ntfy struct {
+	URL string
+}
+
+func (n *Ntfy) Name() string { return "ntfy" }
+
+func (n *Ntfy) Send(ctx context.Context, event Event) error {
+	headers := http.Header{}
+	headers.Set("Title", event.Title)
+	headers.Set("Tags", "gonic,"+string(event.Type))
+	return post(ctx, n.URL, "text/plain", []byte(event.Message), headers)
+}
+
+// Gotify posts events to a gotify server, with an application token
+type Gotify struct {
+	URL   string
+	Token string
+}
+
+func (g *Gotify) Name() string { return "gotify" }
+
+func (g *Gotify) Send(ctx context.Context, event Event) error {
+	body, err := json.Marshal(struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+	}{event.Title, event.Message, 5})
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+	headers := http.Header{}
+	headers.Set("X-Gotify-Key", g.Token)
+	return post(ctx, strings.TrimSuffix(g.URL, "/")+"/message", "application/json", body, headers)
+}
+
+func post(ctx context.Context, url, contentType string, body []byte, headers http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	for key, values := range headers {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("post: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("post: status %s", resp.Status)
+	}
+	return nil
+}
+
+// Email sends events with an smtp server. STARTTLS is used if the server
+// supports it, and it's needed for a username and password
+type Email struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+func (e *Email) Name() string { return "email" }
+
+func (e *Email) Send(ctx context.Context, event Event) error {
+	host, _, err := net.SplitHostPort(e.Addr)
+	if err != nil {
+		return fmt.Errorf("parse addr: %w", err)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", e.Addr)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("start session: %w", err)
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+	if e.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", e.Username, e.Password, host)); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+	if err := client.Mail(e.From); err != nil {
+		return fmt.Errorf("mail from: %w", err)
+	}
+	for _, to := range e.To {
+		if err := client.Rcpt(to); err != nil {
+			return fmt.Errorf("rcpt to %q: %w", to, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("data: %w", err)
+	}
+	if _, err := w.Write(e.message(event, time.Now())); err != nil {
+		return fmt.Errorf("write message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("write message: %w", err)
+	}
+	return client.Quit()
+}
+
+func (e *Email) message(event Event, now time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", e.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", oneLine(event.Title))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "\r\n")
+	fmt.Fprintf(&b, "%s\r\n", strings.ReplaceAll(event.Message, "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// oneLine stops a header value from starting new headers
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,198 @@
+package playlists
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Entry is one of a playlist file's tracks. Title and Length are the ones the
+// file gives it, if any. Length is in seconds
+type Entry struct {
+	Path   string
+	Title  string
+	Length int
+}
+
+// IsPlaylist is true for the names of the files Read can read
+func IsPlaylist(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".m3u", ".m3u8", ".pls":
+		return true
+	}
+	return false
+}
+
+// Read reads the entries of an m3u, m3u8, or pls file, going by the extension
+// of its name. files which aren't utf-8 are read as latin-1, which older
+// players write m3u files in
+func Read(r io.Reader, name string) ([]Entry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read playlist: %w", err)
+	}
+	lines, err := readLines(decode(data))
+	if err != nil {
+		return nil, fmt.Errorf("scan playlist: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".m3u", ".m3u8":
+		return readM3U(lines), nil
+	case ".pls":
+		return readPLS(lines), nil
+	}
+	return nil, fmt.Errorf("%q isn't a m3u or pls file", name)
+}
+
+// readM3U reads the paths of an m3u, with the titles from their #EXTINF lines.
+// other lines starting with # are comments
+func readM3U(lines []string) []Entry {
+	var entries []Entry
+	var title string
+	var length int
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			info := strings.TrimPrefix(line, "#EXTINF:")
+			title, length = extinfTitle(info), extinfLength(info)
+		case strings.HasPrefix(line, "#"):
+		default:
+			entries = append(entries, Entry{Path: line, Title: title, Length: length})
+			title, length = "", 0
+		}
+	}
+	return entries
+}
+
+// extinfTitle is the title after the duration and any attributes, eg.
+// `123 tvg-name="a, b",Artist - Title`
+func extinfTitle(info string) string {
+	var quoted bool
+	for i, r := range info {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			return strings.TrimSpace(info[i+1:])
+		}
+	}
+	return ""
+}
+
+// extinfLength is the duration before any attributes and the title. it's -1
+// when it isn't known, which is 0 here
+func extinfLength(info string) int {
+	end := strings.IndexAny(info, " ,")
+	if end < 0 {
+		end = len(info)
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(info[:end]))
+	if err != nil || length < 0 {
+		return 0
+	}
+	return length
+}
+
+// WriteM3U8 writes entries as an extended m3u, with an #EXTINF line for the
+// ones which have a title or length
+func WriteM3U8(w io.Writer, entries []Entry) error {
+	var buff bytes.Buffer
+	buff.WriteString("#EXTM3U\n")
+	for _, entry := range entries {
+		if entry.Title != "" || entry.Length > 0 {
+			length := entry.Length
+			if length <= 0 {
+				length = -1
+			}
+			fmt.Fprintf(&buff, "#EXTINF:%d,%s\n", length, oneLine(entry.Title))
+		}
+		buff.WriteString(oneLine(entry.Path))
+		buff.WriteString("\n")
+	}
+	_, err := w.Write(buff.Bytes())
+	return err
+}
+
+// oneLine keeps a title or path from breaking the line it's on
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// readPLS reads the FileN, TitleN, and LengthN keys of a pls, in the order of
+// their N
+func readPLS(lines []string) []Entry {
+	byNumber := map[int]*Entry{}
+	for _, line := range lines {
+		i := strings.Index(line, "=")
+		if i < 0 {
+			continue
+		}
+		key, value := strings.ToLower(strings.TrimSpace(line[:i])), strings.TrimSpace(line[i+1:])
+		name := strings.TrimRight(key, "0123456789")
+		if name != "file" && name != "title" && name != "length" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(key, name))
+		if err != nil {
+			continue
+		}
+		entry, ok := byNumber[n]
+		if !ok {
+			entry = &Entry{}
+			byNumber[n] = entry
+		}
+		switch name {
+		case "file":
+			entry.Path = value
+		case "title":
+			entry.Title = value
+		case "length":
+			if length, err := strconv.Atoi(value); err == nil && length > 0 {
+				entry.Length = length
+			}
+		}
+	}
+	numbers := make([]int, 0, len(byNumber))
+	for n, entry := range byNumber {
+		if entry.Path != "" {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	entries := make([]Entry, 0, len(numbers))
+	for _, n := range numbers {
+		entries = append(entries, *byNumber[n])
+	}
+	return entries
+}
+
+// readLines returns text's lines which aren't blank, without their spaces
+func readLines(text string) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func decode(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte{0xef, 0xbb, 0xbf})
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	// each byte of latin-1 is the code point of the same number
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
@@ -0,0 +1,608 @@
+// Package playlists keeps the playlists of a directory of m3u and pls files in
+// the db, and writes the playlists which change in the db back to it as m3u8
+package playlists
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+
+	"go.senan.xyz/gonic/db"
+)
+
+var (
+	ErrNoOwner  = errors.New("no admin to own the playlists")
+	ErrDisabled = errors.New("there's no playlists dir")
+	errNotFound = errors.New("not found")
+)
+
+// unresolvedTitle starts the list of a playlist's unresolved entries, in its
+// comment
+const unresolvedTitle = "unresolved tracks, which are added when they're found:"
+
+// fileNameMax is the most bytes of a playlist's name used for its file name,
+// which leaves room for an id and extension
+const fileNameMax = 200
+
+// Syncer imports the playlist files of a directory, and exports playlists to
+// it. an imported playlist is named after its file, and belongs to the first
+// admin. a Syncer without a dir is disabled
+type Syncer struct {
+	db        *db.DB
+	dir       string
+	musicDirs []string
+	mu        sync.Mutex
+}
+
+func New(db *db.DB, dir string, musicDirs []string) *Syncer {
+	return &Syncer{
+		db:        db,
+		dir:       dir,
+		musicDirs: musicDirs,
+	}
+}
+
+type SyncResult struct {
+	Synced     int
+	Deleted    int
+	Unresolved int
+}
+
+// Sync imports the files which changed since they were last imported, or which
+// had entries that weren't found then, since the tracks may have been scanned
+// since. smart playlists are always built again. playlists imported from files
+// in the dir which are gone are deleted, unless some of it couldn't be read
+func (s *Syncer) Sync() (*SyncResult, error) {
+	if s.dir == "" {
+		return nil, ErrDisabled
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var owner db.User
+	err := s.db.
+		Where("is_admin=?", true).
+		Order("id").
+		First(&owner).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNoOwner
+	}
+	if err != nil {
+		return nil, fmt.Errorf("find owner: %w", err)
+	}
+
+	var existing []*db.Playlist
+	// a playlist saved without a file can have an empty one, rather than null
+	if err := s.db.Where("file IS NOT NULL AND file != ''").Find(&existing).Error; err != nil {
+		return nil, fmt.Errorf("find playlists: %w", err)
+	}
+	byFile := map[string]*db.Playlist{}
+	for _, playlist := range existing {
+		byFile[playlist.File] = playlist
+	}
+
+	result := &SyncResult{}
+	seen := map[string]struct{}{}
+	var walkFailed bool
+	err = filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil && path == s.dir {
+			return err
+		}
+		if err != nil {
+			log.Printf("error walking playlists %q: %v", path, err)
+			walkFailed = true
+			return nil
+		}
+		smart := IsSmart(d.Name())
+		if d.IsDir() || !(smart || IsPlaylist(d.Name())) {
+			return nil
+		}
+		// a file we couldn't read this time keeps its playlist
+		seen[path] = struct{}{}
+		info, err := d.Info()
+		if err != nil {
+			log.Printf("error stating playlist %q: %v", path, err)
+			return nil
+		}
+		playlist, ok := byFile[path]
+		if ok && !smart && playlist.FileModTime.Equal(info.ModTime()) && playlist.FileUnresolved == 0 {
+			return nil
+		}
+		if !ok {
+			playlist = &db.Playlist{UserID: owner.ID, File: path}
+		}
+		sync := s.syncFile
+		if smart {
+			sync = s.syncSmart
+		}
+		if err := sync(playlist, info.ModTime()); err != nil {
+			log.Printf("error syncing playlist %q: %v", path, err)
+			return nil
+		}
+		result.Synced++
+		result.Unresolved += playlist.FileUnresolved
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk: %w", err)
+	}
+	// the files we couldn't get to may still be there
+	if walkFailed {
+		return result, nil
+	}
+
+	for _, playlist := range existing {
+		if _, ok := seen[playlist.File]; ok || playlist.FileExported || !inDir(s.dir, playlist.File) {
+			continue
+		}
+		if err := s.db.Delete(playlist).Error; err != nil {
+			return nil, fmt.Errorf("delete playlist %q: %w", playlist.File, err)
+		}
+		result.Deleted++
+	}
+	return result, nil
+}
+
+// syncFile imports the file of playlist. the entries which can't be found are
+// listed in its comment
+func (s *Syncer) syncFile(playlist *db.Playlist, modTime time.Time) error {
+	file, err := os.Open(playlist.File)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer file.Close()
+	entries, err := Read(file, playlist.File)
+	if err != nil {
+		return err
+	}
+
+	var trackIDs []int
+	var unresolved []string
+	for _, entry := range entries {
+		trackID, err := s.resolve(playlist.File, entry.Path)
+		switch {
+		case errors.Is(err, errNotFound):
+			unresolved = append(unresolved, entry.Path)
+			continue
+		case err != nil:
+			return fmt.Errorf("find %q: %w", entry.Path, err)
+		}
+		trackIDs = append(trackIDs, trackID)
+	}
+
+	prev := *playlist
+	if playlist.ID == 0 {
+		// an existing playlist keeps its name, which its exported file's name
+		// may only be a safe version of
+		playlist.Name = fileStem(playlist.File)
+	}
+	playlist.Comment = ""
+	if len(unresolved) > 0 {
+		playlist.Comment = unresolvedTitle + "\n" + strings.Join(unresolved, "\n")
+	}
+	playlist.SetItems(trackIDs)
+	playlist.FileModTime = modTime
+	playlist.FileUnresolved = len(unresolved)
+	if err := s.db.SavePlaylist(prev, playlist); err != nil {
+		return fmt.Errorf("save: %w", err)
+	}
+	// an unchanged playlist isn't saved, but the file's state still is
+	return s.db.
+		Model(playlist).
+		UpdateColumns(map[string]interface{}{
+			"file_mod_time":   playlist.FileModTime,
+			"file_unresolved": playlist.FileUnresolved,
+		}).
+		Error
+}
+
+// syncSmart builds playlist from the rules of its file
+func (s *Syncer) syncSmart(playlist *db.Playlist, modTime time.Time) error {
+	file, err := os.Open(playlist.File)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer file.Close()
+	smart, err := ReadSmart(file)
+	if err != nil {
+		return err
+	}
+	trackIDs, err := smart.TrackIDs(s.db, playlist.UserID)
+	if err != nil {
+		return err
+	}
+
+	prev := *playlist
+	playlist.Name = smart.Name
+	if playlist.Name == "" {
+		playlist.Name = smartName(playlist.File)
+	}
+	playlist.Comment = smart.Comment
+	playlist.IsSmart = true
+	playlist.SetItems(trackIDs)
+	playlist.FileModTime = modTime
+	if err := s.db.SavePlaylist(prev, playlist); err != nil {
+		return fmt.Errorf("save: %w", err)
+	}
+	return s.db.
+		Model(playlist).
+		UpdateColumn("file_mod_time", playlist.FileModTime).
+		Error
+}
+
+// Refresh builds the smart playlist with playlistID again, for plays, stars,
+// and ratings since the last scan
+func (s *Syncer) Refresh(playlistID int) error {
+	if s.dir == "" {
+		return ErrDisabled
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var playlist db.Playlist
+	if err := s.db.First(&playlist, playlistID).Error; err != nil {
+		return fmt.Errorf("find playlist: %w", err)
+	}
+	if !playlist.IsSmart {
+		return fmt.Errorf("playlist %d isn't a smart playlist", playlistID)
+	}
+	info, err := os.Stat(playlist.File)
+	if err != nil {
+		return fmt.Errorf("stat %q: %w", playlist.File, err)
+	}
+	return s.syncSmart(&playlist, info.ModTime())
+}
+
+// resolve finds the track of an entry of the playlist file at playlistPath. a
+// relative path is relative to the file, or else to a music dir. a path from
+// somewhere else, like another machine's music dir, is found by the end of it,
+// then by its file name, whichever matches the most of its folders
+func (s *Syncer) resolve(playlistPath string, entryPath string) (int, error) {
+	if u, err := url.Parse(entryPath); err == nil && u.Scheme == "file" {
+		entryPath = u.Path
+	} else if strings.Contains(entryPath, "://") {
+		return 0, errNotFound
+	}
+	// the separator of playlists from windows
+	entryPath = filepath.FromSlash(strings.ReplaceAll(entryPath, `\`, "/"))
+
+	var candidates []string
+	if filepath.IsAbs(entryPath) {
+		candidates = append(candidates, entryPath)
+	} else {
+		candidates = append(candidates, filepath.Join(filepath.Dir(playlistPath), entryPath))
+	}
+	parts := strings.Split(strings.Trim(filepath.ToSlash(entryPath), "/"), "/")
+	for i := range parts {
+		for _, musicDir := range s.musicDirs {
+			candidates = append(candidates, filepath.Join(musicDir, filepath.Join(parts[i:]...)))
+		}
+	}
+	for _, candidate := range candidates {
+		trackID, err := s.findTrack(filepath.Clean(candidate))
+		if err != nil {
+			return 0, err
+		}
+		if trackID != 0 {
+			return trackID, nil
+		}
+	}
+	return s.resolveFilename(parts)
+}
+
+// findTrack finds the track at an absolute path in one of the music dirs, by
+// its album's path like the scanner stores it, so the lookup uses the index of
+// albums' paths. an album at the root of a music dir has the right path "."
+func (s *Syncer) findTrack(abspath string) (int, error) {
+	dir, filename := filepath.Split(abspath)
+	for _, musicDir := range s.musicDirs {
+		rel, err := filepath.Rel(musicDir, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		leftPath, rightPath := filepath.Split(rel)
+		var track db.Track
+		err = s.db.
+			Select("tracks.id").
+			Joins("JOIN albums ON tracks.album_id=albums.id").
+			Where("albums.root_dir=? AND albums.left_path=? AND albums.right_path=? AND tracks.filename=?",
+				musicDir, leftPath, rightPath, filename).
+			First(&track).
+			Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, err
+		}
+		if track.ID != 0 {
+			return track.ID, nil
+		}
+	}
+	return 0, nil
+}
+
+// resolveFilename finds the track with the file name at the end of parts,
+// ignoring its case and extension, in case it was converted. the track whose
+// folders match the most of parts' is preferred
+func (s *Syncer) resolveFilename(parts []string) (int, error) {
+	filename := parts[len(parts)-1]
+	stem := strings.TrimSuffix(filename, filepath.Ext(filename))
+	if stem == "" {
+		return 0, errNotFound
+	}
+	var tracks []*db.Track
+	err := s.db.
+		Preload("Album").
+		Where(fmt.Sprintf("tracks.filename %s ? ESCAPE '\\'", db.Like(s.db.DB)), escapeLike(stem)+".%").
+		Find(&tracks).
+		Error
+	if err != nil {
+		return 0, err
+	}
+	var best *db.Track
+	var bestScore int
+	for _, track := range tracks {
+		score := matchingFolders(parts[:len(parts)-1], track.Album)
+		if strings.EqualFold(filepath.Ext(track.Filename), filepath.Ext(filename)) {
+			score++
+		}
+		if best == nil || score > bestScore {
+			best, bestScore = track, score
+		}
+	}
+	if best == nil {
+		return 0, errNotFound
+	}
+	return best.ID, nil
+}
+
+// matchingFolders counts the folders at the end of folders which are the same
+// as the ones album is in, ignoring case
+func matchingFolders(folders []string, album *db.Album) int {
+	if album == nil {
+		return 0
+	}
+	albumFolders := strings.Split(strings.Trim(filepath.ToSlash(album.LeftPath+album.RightPath), "/"), "/")
+	var n int
+	for i, j := len(folders)-1, len(albumFolders)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if !strings.EqualFold(folders[i], albumFolders[j]) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// inDir is true if path is somewhere in dir
+func inDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Export writes the playlist with playlistID to an m3u8 in the dir, after it
+// changed. the paths in it are relative to it. the file is named after the
+// playlist, and renamed with it, unless it was imported from a file of another
+// format, which is left as it is. an unchanged file isn't written, so that it
+// isn't imported again
+func (s *Syncer) Export(playlistID int) error {
+	if s.dir == "" {
+		return ErrDisabled
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var playlist db.Playlist
+	if err := s.db.First(&playlist, playlistID).Error; err != nil {
+		return fmt.Errorf("find playlist: %w", err)
+	}
+	if playlist.File != "" && !strings.EqualFold(filepath.Ext(playlist.File), ".m3u8") {
+		return nil
+	}
+	path := s.exportPath(&playlist)
+	entries, err := Entries(s.db, &playlist, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	var buff bytes.Buffer
+	if err := WriteM3U8(&buff, entries); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if existing, err := os.ReadFile(path); err != nil || !bytes.Equal(existing, buff.Bytes()) {
+		if err := writeFile(path, buff.Bytes()); err != nil {
+			return fmt.Errorf("write %q: %w", path, err)
+		}
+	}
+	if playlist.File != "" && playlist.File != path {
+		if err := os.Remove(playlist.File); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("remove old file: %w", err)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat %q: %w", path, err)
+	}
+	// the playlist itself hasn't changed, so its ChangedAt doesn't move. one
+	// without a file before was made by a client, so it's kept without it
+	return s.db.
+		Model(&playlist).
+		UpdateColumns(map[string]interface{}{
+			"file":            path,
+			"file_mod_time":   info.ModTime(),
+			"file_unresolved": len(unresolvedPaths(playlist.Comment)),
+			"file_exported":   playlist.FileExported || playlist.File == "",
+		}).
+		Error
+}
+
+// Remove deletes the file of the playlist with playlistID, before the playlist
+// is deleted, so that it isn't imported again
+func (s *Syncer) Remove(playlistID int) error {
+	if s.dir == "" {
+		return ErrDisabled
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var playlist db.Playlist
+	if err := s.db.First(&playlist, playlistID).Error; err != nil {
+		return fmt.Errorf("find playlist: %w", err)
+	}
+	if playlist.File == "" {
+		return nil
+	}
+	if err := os.Remove(playlist.File); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove %q: %w", playlist.File, err)
+	}
+	return nil
+}
+
+// exportPath is the file playlist is written to. it's named after the
+// playlist, or its id too if another file has that name
+func (s *Syncer) exportPath(playlist *db.Playlist) string {
+	name := FileName(playlist.Name)
+	if playlist.File != "" && fileStem(playlist.File) == name {
+		return playlist.File
+	}
+	path := filepath.Join(s.dir, name+".m3u8")
+	if _, err := os.Lstat(path); err == nil && path != playlist.File {
+		path = filepath.Join(s.dir, fmt.Sprintf("%s (%d).m3u8", name, playlist.ID))
+	}
+	return path
+}
+
+// Entries are the tracks of playlist, with their paths relative to dir, or to
+// their music dir if dir is empty, so that the server's paths aren't given
+// away. entries which weren't found when it was imported come last, as they
+// were in its file
+func Entries(dbc *db.DB, playlist *db.Playlist, dir string) ([]Entry, error) {
+	trackIDs := playlist.GetItems()
+	var found []*db.Track
+	err := dbc.
+		Preload("Album").
+		Where("id IN (?)", trackIDs).
+		Find(&found).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("find tracks: %w", err)
+	}
+	byID := make(map[int]*db.Track, len(found))
+	for _, track := range found {
+		byID[track.ID] = track
+	}
+	entries := make([]Entry, 0, len(trackIDs))
+	for _, id := range trackIDs {
+		track, ok := byID[id]
+		if !ok {
+			continue
+		}
+		path := filepath.FromSlash(track.RelPath())
+		if dir != "" {
+			path = filepath.FromSlash(track.AbsPath())
+			if rel, err := filepath.Rel(dir, path); err == nil {
+				path = rel
+			}
+		}
+		entries = append(entries, Entry{
+			Path:   filepath.ToSlash(path),
+			Title:  entryTitle(track),
+			Length: track.Length,
+		})
+	}
+	for _, path := range unresolvedPaths(playlist.Comment) {
+		entries = append(entries, Entry{Path: path})
+	}
+	return entries, nil
+}
+
+// entryTitle is the "artist - title" players show for an entry
+func entryTitle(track *db.Track) string {
+	title := track.TagTitle
+	if title == "" {
+		title = fileStem(track.Filename)
+	}
+	if track.TagTrackArtist == "" {
+		return title
+	}
+	return track.TagTrackArtist + " - " + title
+}
+
+// unresolvedPaths are the entries listed in a comment written by syncFile
+func unresolvedPaths(comment string) []string {
+	i := strings.Index(comment, unresolvedTitle+"\n")
+	if i < 0 {
+		return nil
+	}
+	return strings.Split(comment[i+len(unresolvedTitle)+1:], "\n")
+}
+
+// FileName makes a playlist's name usable as a file name, without separators
+// which would put it in another dir
+func FileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/', r == '\\':
+			return '_'
+		case r < ' ':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(name))
+	// no hidden files, or "." and ".."
+	name = strings.TrimLeft(name, ".")
+	if len(name) > fileNameMax {
+		end := fileNameMax
+		for end > 0 && !utf8.RuneStart(name[end]) {
+			end--
+		}
+		name = name[:end]
+	}
+	if name = strings.TrimSpace(name); name == "" {
+		return "playlist"
+	}
+	return name
+}
+
+func fileStem(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// writeFile writes data to a temporary file first, so that a sync never reads
+// half of it
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// as readable as the files of other players
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
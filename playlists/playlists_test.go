@@ -0,0 +1,349 @@
+package playlists
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/mockfs"
+)
+
+func TestReadM3U(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	entries, err := Read(strings.NewReader("\ufeff#EXTM3U\r\n"+
+		"#EXTINF:123,Aphex Twin - Xtal\r\n"+
+		"Aphex Twin/Selected Ambient Works/01 Xtal.flac\r\n"+
+		"\r\n"+
+		"# a comment\r\n"+
+		`#EXTINF:-1 tvg-name="a, b",Radio`+"\r\n"+
+		"http://example.com/stream\r\n"+
+		"/music/untitled.mp3\r\n"), "mix.m3u8")
+	is.NoErr(err)
+	is.Equal(entries, []Entry{
+		{Path: "Aphex Twin/Selected Ambient Works/01 Xtal.flac", Title: "Aphex Twin - Xtal", Length: 123},
+		{Path: "http://example.com/stream", Title: "Radio"}, // the comma in quotes isn't the title's
+		{Path: "/music/untitled.mp3"},
+	})
+
+	entries, err = Read(bytes.NewReader([]byte("Bj\xf6rk/Homogenic/J\xf3ga.flac\n")), "old.M3U")
+	is.NoErr(err)
+	is.Equal(entries, []Entry{{Path: "Björk/Homogenic/Jóga.flac"}}) // latin-1
+
+	_, err = Read(strings.NewReader(""), "mix.txt")
+	is.True(err != nil)
+}
+
+func TestReadPLS(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	entries, err := Read(strings.NewReader(`[playlist]
+NumberOfEntries=3
+File2=b.flac
+Title2=B
+File10=c.flac
+File1=a.flac
+Length1=100
+Title3=no file
+Version=2
+`), "mix.pls")
+	is.NoErr(err)
+	is.Equal(entries, []Entry{
+		{Path: "a.flac", Length: 100},
+		{Path: "b.flac", Title: "B"},
+		{Path: "c.flac"}, // ordered by number, not as text
+	})
+}
+
+func TestWriteM3U8(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	entries := []Entry{
+		{Path: "../music/a/01.flac", Title: "A - One", Length: 200},
+		{Path: "b/02.flac", Title: "B - Two\nlines"},
+		{Path: "c/03.flac"},
+	}
+	var buff bytes.Buffer
+	is.NoErr(WriteM3U8(&buff, entries))
+	is.Equal(buff.String(), "#EXTM3U\n"+
+		"#EXTINF:200,A - One\n"+
+		"../music/a/01.flac\n"+
+		"#EXTINF:-1,B - Two lines\n"+
+		"b/02.flac\n"+
+		"c/03.flac\n")
+
+	read, err := Read(&buff, "mix.m3u8")
+	is.NoErr(err)
+	entries[1].Title = "B - Two lines"
+	is.Equal(read, entries)
+}
+
+func TestFileName(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	is.Equal(FileName("mix"), "mix")
+	is.Equal(FileName("AC/DC \\ live"), "AC_DC _ live")
+	is.Equal(FileName("../../etc/passwd"), "_.._etc_passwd")
+	is.Equal(FileName(".."), "playlist")
+	is.Equal(FileName(" \x00 "), "playlist")
+	is.Equal(len(FileName(strings.Repeat("é", 200))), 200)
+}
+
+func TestSync(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.NewWithDirs(t, []string{"music"})
+
+	m.AddItemsPrefix("music")
+	m.AddTrack("music/single/track.flac")
+	m.SetTags("music/single/track.flac", func(tags *mockfs.Tags) error { return nil })
+	m.ScanAndClean()
+	musicDir := filepath.Join(m.TmpDir(), "music")
+	playlistsDir := t.TempDir()
+
+	write := func(name, data string, modTime time.Time) {
+		t.Helper()
+		path := filepath.Join(playlistsDir, name)
+		is.NoErr(os.MkdirAll(filepath.Dir(path), os.ModePerm))
+		is.NoErr(os.WriteFile(path, []byte(data), 0o600))
+		is.NoErr(os.Chtimes(path, modTime, modTime))
+	}
+	find := func(name string) *db.Playlist {
+		t.Helper()
+		var playlist db.Playlist
+		is.NoErr(m.DB().Where("name=?", name).First(&playlist).Error)
+		return &playlist
+	}
+	trackID := func(path string) int {
+		t.Helper()
+		dir, filename := filepath.Split(path)
+		var track db.Track
+		err := m.DB().
+			Joins("JOIN albums ON albums.id=tracks.album_id").
+			Where("albums.left_path || albums.right_path=? AND tracks.filename=?", filepath.Clean(dir), filename).
+			First(&track).
+			Error
+		is.NoErr(err)
+		return track.ID
+	}
+
+	past := time.Now().Add(-time.Hour)
+	write("mix.m3u", strings.Join([]string{
+		"#EXTM3U",
+		filepath.Join(musicDir, "artist-0/album-0/track-0.flac"), // absolute
+		"artist-1/album-1/track-1.flac",                          // relative to the music dir
+		`C:\Users\me\Music\artist-2\album-2\track-2.flac`,        // from another machine
+		"/elsewhere/artist-0/album-1/TRACK-2.mp3",                // by file name and folders
+		"single/track.flac",                                      // an album in the root of the music dir
+		"artist-9/album-0/new.flac",                              // not in the library yet
+	}, "\n"), past)
+	write("sub/radio.pls", "[playlist]\nFile1=artist-0/album-0/track-1.flac\n", past)
+	write("notes.txt", "not a playlist", past)
+
+	s := New(m.DB(), playlistsDir, []string{musicDir})
+	result, err := s.Sync()
+	is.NoErr(err)
+	is.Equal(result.Synced, 2)
+	is.Equal(result.Unresolved, 1)
+
+	mix := find("mix")
+	is.Equal(mix.UserID, 1) // the admin
+	is.Equal(mix.GetItems(), []int{
+		trackID("artist-0/album-0/track-0.flac"),
+		trackID("artist-1/album-1/track-1.flac"),
+		trackID("artist-2/album-2/track-2.flac"),
+		trackID("artist-0/album-1/track-2.flac"),
+		trackID("single/track.flac"),
+	})
+	is.Equal(mix.FileUnresolved, 1)
+	is.True(strings.HasSuffix(mix.Comment, "\nartist-9/album-0/new.flac")) // kept to be found later
+	is.Equal(find("radio").GetItems(), []int{trackID("artist-0/album-0/track-1.flac")})
+
+	// paths are found by their album's path, not only by file name
+	id, err := s.findTrack(filepath.Join(musicDir, "single/track.flac"))
+	is.NoErr(err)
+	is.Equal(id, trackID("single/track.flac"))
+	id, err = s.findTrack(filepath.Join(musicDir, "artist-0/album-0/track-0.flac"))
+	is.NoErr(err)
+	is.Equal(id, trackID("artist-0/album-0/track-0.flac"))
+	id, err = s.findTrack(filepath.Join(m.TmpDir(), "artist-0/album-0/track-0.flac"))
+	is.NoErr(err)
+	is.Equal(id, 0) // outside the music dir
+
+	// unchanged files are skipped, unless they had entries which weren't found
+	result, err = s.Sync()
+	is.NoErr(err)
+	is.Equal(result.Synced, 1)
+
+	// which are added once they're scanned
+	m.AddTrack("music/artist-9/album-0/new.flac")
+	m.SetTags("music/artist-9/album-0/new.flac", func(tags *mockfs.Tags) error { return nil })
+	m.ScanAndClean()
+	_, err = s.Sync()
+	is.NoErr(err)
+	mix = find("mix")
+	is.Equal(len(mix.GetItems()), 6)
+	is.Equal(mix.FileUnresolved, 0)
+	is.Equal(mix.Comment, "")
+	result, err = s.Sync()
+	is.NoErr(err)
+	is.Equal(result.Synced, 0)
+
+	// a changed file is imported again, and a deleted one's playlist removed
+	write("sub/radio.pls", "[playlist]\nFile1=artist-0/album-0/track-2.flac\n", time.Now())
+	is.NoErr(os.Remove(filepath.Join(playlistsDir, "mix.m3u")))
+	result, err = s.Sync()
+	is.NoErr(err)
+	is.Equal(result.Synced, 1)
+	is.Equal(result.Deleted, 1)
+	is.Equal(find("radio").GetItems(), []int{trackID("artist-0/album-0/track-2.flac")})
+	var count int
+	is.NoErr(m.DB().Model(db.Playlist{}).Count(&count).Error)
+	is.Equal(count, 1)
+
+	// playlists from another dir are left alone
+	elsewhere := &db.Playlist{UserID: 1, Name: "elsewhere", File: filepath.Join(t.TempDir(), "elsewhere.m3u")}
+	is.NoErr(m.DB().Create(elsewhere).Error)
+	result, err = s.Sync()
+	is.NoErr(err)
+	is.Equal(result.Deleted, 0)
+
+	// and a dir which can't be read deletes nothing
+	gone := New(m.DB(), filepath.Join(playlistsDir, "gone"), []string{musicDir})
+	_, err = gone.Sync()
+	is.True(err != nil)
+	is.NoErr(m.DB().Model(db.Playlist{}).Count(&count).Error)
+	is.Equal(count, 2)
+}
+
+func TestExport(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.NewWithDirs(t, []string{"music"})
+
+	m.AddItemsPrefix("music")
+	m.ScanAndClean()
+	musicDir := filepath.Join(m.TmpDir(), "music")
+	playlistsDir := t.TempDir()
+	s := New(m.DB(), playlistsDir, []string{musicDir})
+
+	var tracks []*db.Track
+	is.NoErr(m.DB().Preload("Album").Order("id").Limit(2).Find(&tracks).Error)
+	save := func(playlist *db.Playlist) {
+		t.Helper()
+		prev := *playlist
+		if playlist.ID != 0 {
+			is.NoErr(m.DB().First(&prev, playlist.ID).Error)
+		}
+		is.NoErr(m.DB().SavePlaylist(prev, playlist))
+		is.NoErr(s.Export(playlist.ID))
+	}
+	find := func(id int) *db.Playlist {
+		t.Helper()
+		var playlist db.Playlist
+		is.NoErr(m.DB().First(&playlist, id).Error)
+		return &playlist
+	}
+	files := func() []string {
+		t.Helper()
+		entries, err := os.ReadDir(playlistsDir)
+		is.NoErr(err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	mix := &db.Playlist{UserID: 1, Name: "AC/DC"}
+	mix.SetItems([]int{tracks[0].ID, tracks[1].ID})
+	save(mix)
+	is.Equal(files(), []string{"AC_DC.m3u8"}) // not in a dir of its own
+	data, err := os.ReadFile(filepath.Join(playlistsDir, "AC_DC.m3u8"))
+	is.NoErr(err)
+	is.True(strings.HasPrefix(string(data), "#EXTM3U\n#EXTINF:"))
+	rel, err := filepath.Rel(playlistsDir, tracks[0].AbsPath())
+	is.NoErr(err)
+	is.True(strings.Contains(string(data), "\n"+filepath.ToSlash(rel)+"\n"))
+
+	// importing what was exported changes nothing
+	changedAt := find(mix.ID).ChangedAt
+	result, err := s.Sync()
+	is.NoErr(err)
+	is.Equal(result.Synced, 0)
+	is.NoErr(os.Chtimes(find(mix.ID).File, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+	result, err = s.Sync()
+	is.NoErr(err)
+	is.Equal(result.Synced, 1)
+	imported := find(mix.ID)
+	is.Equal(imported.Name, "AC/DC")
+	is.Equal(imported.GetItems(), []int{tracks[0].ID, tracks[1].ID})
+	is.True(imported.ChangedAt.Equal(changedAt))
+
+	// an unchanged file isn't written again
+	info, err := os.Stat(imported.File)
+	is.NoErr(err)
+	is.NoErr(s.Export(mix.ID))
+	again, err := os.Stat(imported.File)
+	is.NoErr(err)
+	is.True(again.ModTime().Equal(info.ModTime()))
+
+	// another playlist with the same name gets its id too
+	other := &db.Playlist{UserID: 1, Name: "AC\\DC"}
+	other.SetItems([]int{tracks[1].ID})
+	save(other)
+	is.Equal(files(), []string{"AC_DC (2).m3u8", "AC_DC.m3u8"})
+
+	// a renamed playlist's file is renamed too
+	mix = find(mix.ID)
+	mix.Name = "rock"
+	save(mix)
+	is.Equal(files(), []string{"AC_DC (2).m3u8", "rock.m3u8"})
+	result, err = s.Sync()
+	is.NoErr(err)
+	is.Equal(result.Synced, 0)
+	is.Equal(result.Deleted, 0)
+
+	// playlists which aren't exported aren't deleted either
+	noFile := &db.Playlist{UserID: 1, Name: "no file"}
+	is.NoErr(m.DB().SavePlaylist(db.Playlist{}, noFile))
+	is.NoErr(m.DB().Save(noFile).Error) // with an empty file, rather than null
+	result, err = s.Sync()
+	is.NoErr(err)
+	is.Equal(result.Deleted, 0)
+
+	// and a deleted one's is removed
+	is.NoErr(s.Remove(other.ID))
+	is.NoErr(m.DB().Delete(other).Error)
+	is.Equal(files(), []string{"rock.m3u8"})
+
+	// a client's playlist outlives its exported file, which is written again
+	is.True(find(mix.ID).FileExported)
+	is.NoErr(os.Remove(filepath.Join(playlistsDir, "rock.m3u8")))
+	result, err = s.Sync()
+	is.NoErr(err)
+	is.Equal(result.Deleted, 0)
+	save(find(mix.ID))
+	is.Equal(files(), []string{"rock.m3u8"})
+
+	// files of other formats are left alone
+	pls := filepath.Join(playlistsDir, "radio.pls")
+	is.NoErr(os.WriteFile(pls, []byte("[playlist]\nFile1="+tracks[0].AbsPath()+"\n"), 0o600))
+	_, err = s.Sync()
+	is.NoErr(err)
+	var radio db.Playlist
+	is.NoErr(m.DB().Where("file=?", pls).First(&radio).Error)
+	radio.SetItems(nil)
+	save(&radio)
+	is.Equal(files(), []string{"radio.pls", "rock.m3u8"})
+}
@@ -0,0 +1,294 @@
+package playlists
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+)
+
+// smartExt ends the names of smart playlist files
+const smartExt = ".smart.json"
+
+// IsSmart is true for the names of the files ReadSmart can read
+func IsSmart(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), smartExt)
+}
+
+// Smart is a playlist of the tracks which match rules, read from a file like
+//
+//	{
+//	  "name": "recent jazz",
+//	  "all": [
+//	    {"field": "genre", "op": "=", "value": "jazz"},
+//	    {"field": "added", "op": "inTheLast", "value": 30}
+//	  ],
+//	  "sort": "added", "order": "desc", "limit": 100
+//	}
+//
+// a track matches if it matches every rule of All, and any of Any, if there
+// are some. Sort is a field or "random", and Order is "asc" or "desc"
+type Smart struct {
+	Name    string `json:"name"`
+	Comment string `json:"comment"`
+	All     []Rule `json:"all"`
+	Any     []Rule `json:"any"`
+	Sort    string `json:"sort"`
+	Order   string `json:"order"`
+	Limit   int    `json:"limit"`
+}
+
+// Rule compares a field of a track to Value. see fields for the fields, and
+// ops for the ops of each kind of field
+type Rule struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+type fieldKind int
+
+const (
+	kindText fieldKind = iota
+	kindNumber
+	kindDate
+	kindBool
+	// kindGenre is text, compared to any of the track's genres
+	kindGenre
+)
+
+type field struct {
+	kind fieldKind
+	expr string
+}
+
+// fields are the columns of the query in Smart.TrackIDs. plays, stars, and
+// ratings are the playlist owner's
+var fields = map[string]field{
+	"title":       {kindText, "tracks.tag_title"},
+	"artist":      {kindText, "tracks.tag_track_artist"},
+	"album":       {kindText, "albums.tag_title"},
+	"albumArtist": {kindText, "artists.name"},
+	"path":        {kindText, "(albums.left_path || albums.right_path || '/' || tracks.filename)"},
+	"genre":       {kindGenre, ""},
+	"year":        {kindNumber, "albums.tag_year"},
+	"trackNumber": {kindNumber, "tracks.tag_track_number"},
+	"discNumber":  {kindNumber, "tracks.tag_disc_number"},
+	"duration":    {kindNumber, "tracks.length"},
+	"bitrate":     {kindNumber, "tracks.bitrate"},
+	"playCount":   {kindNumber, "COALESCE(track_plays.count, 0)"},
+	"rating":      {kindNumber, "COALESCE(track_ratings.rating, 0)"},
+	"added":       {kindDate, "tracks.created_at"},
+	"lastPlayed":  {kindDate, "track_plays.time"},
+	"starred":     {kindBool, "(track_stars.track_id IS NOT NULL)"},
+}
+
+// ops are the ops of each kind of field. inTheLast and notInTheLast take a
+// number of days, and the other date ops take a date like 2006-01-02
+var ops = map[fieldKind][]string{
+	kindText:   {"=", "!=", "contains", "notContains"},
+	kindGenre:  {"=", "!=", "contains", "notContains"},
+	kindNumber: {"=", "!=", "<", ">", "<=", ">="},
+	kindDate:   {"<", ">", "inTheLast", "notInTheLast"},
+	kindBool:   {"="},
+}
+
+// ReadSmart reads and checks the rules of a smart playlist file
+func ReadSmart(r io.Reader) (*Smart, error) {
+	var smart Smart
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&smart); err != nil {
+		return nil, fmt.Errorf("decode smart playlist: %w", err)
+	}
+	for _, rules := range [][]Rule{smart.All, smart.Any} {
+		for _, rule := range rules {
+			if _, _, err := rule.where(time.Now(), "LIKE"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, err := smart.orderBy(); err != nil {
+		return nil, err
+	}
+	if smart.Limit < 0 {
+		return nil, fmt.Errorf("limit %d is negative", smart.Limit)
+	}
+	return &smart, nil
+}
+
+// TrackIDs evaluates the rules, for the plays, stars, and ratings of the user
+// with userID
+func (s *Smart) TrackIDs(dbc *db.DB, userID int) ([]int, error) {
+	now := time.Now()
+	like := db.Like(dbc.DB)
+	orderBy, err := s.orderBy()
+	if err != nil {
+		return nil, err
+	}
+	q := dbc.
+		Table("tracks").
+		Select("tracks.id").
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Joins("LEFT JOIN artists ON artists.id=albums.tag_artist_id").
+		Joins("LEFT JOIN track_plays ON track_plays.track_id=tracks.id AND track_plays.user_id=?", userID).
+		Joins("LEFT JOIN track_stars ON track_stars.track_id=tracks.id AND track_stars.user_id=?", userID).
+		Joins("LEFT JOIN track_ratings ON track_ratings.track_id=tracks.id AND track_ratings.user_id=?", userID)
+	for _, rule := range s.All {
+		where, args, err := rule.where(now, like)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Where(where, args...)
+	}
+	if len(s.Any) > 0 {
+		var wheres []string
+		var args []interface{}
+		for _, rule := range s.Any {
+			where, ruleArgs, err := rule.where(now, like)
+			if err != nil {
+				return nil, err
+			}
+			wheres = append(wheres, "("+where+")")
+			args = append(args, ruleArgs...)
+		}
+		q = q.Where(strings.Join(wheres, " OR "), args...)
+	}
+	q = q.Order(orderBy)
+	if s.Limit > 0 {
+		q = q.Limit(s.Limit)
+	}
+	var trackIDs []int
+	if err := q.Pluck("tracks.id", &trackIDs).Error; err != nil {
+		return nil, fmt.Errorf("find tracks: %w", err)
+	}
+	return trackIDs, nil
+}
+
+// orderBy is the ORDER BY of Sort and Order. without a Sort, tracks are in the
+// order of their folders
+func (s *Smart) orderBy() (string, error) {
+	var desc bool
+	switch strings.ToLower(s.Order) {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		return "", fmt.Errorf("unknown order %q", s.Order)
+	}
+	var exprs []string
+	switch s.Sort {
+	case "":
+		exprs = []string{"albums.root_dir", "albums.left_path", "albums.right_path", "tracks.tag_disc_number", "tracks.tag_track_number", "tracks.filename"}
+	case "random":
+		return "RANDOM()", nil
+	default:
+		f, ok := fields[s.Sort]
+		if !ok || f.kind == kindGenre {
+			return "", fmt.Errorf("can't sort by %q", s.Sort)
+		}
+		// ties keep the order of the tracks' folders
+		exprs = []string{f.expr, "albums.left_path", "albums.right_path", "tracks.tag_disc_number", "tracks.tag_track_number"}
+	}
+	if desc {
+		for i := range exprs {
+			exprs[i] += " DESC"
+		}
+	}
+	return strings.Join(exprs, ", "), nil
+}
+
+// where is the condition of the rule. now is what inTheLast counts back from,
+// and like is the db's case insensitive LIKE
+func (r *Rule) where(now time.Time, like string) (string, []interface{}, error) {
+	f, ok := fields[r.Field]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown field %q", r.Field)
+	}
+	if !knownOp(f.kind, r.Op) {
+		return "", nil, fmt.Errorf("field %q can't be compared with %q", r.Field, r.Op)
+	}
+	switch f.kind {
+	case kindText, kindGenre:
+		value, ok := r.Value.(string)
+		if !ok {
+			return "", nil, fmt.Errorf("field %q needs a string, not %v", r.Field, r.Value)
+		}
+		col := f.expr
+		if f.kind == kindGenre {
+			col = "genres.name"
+		}
+		var cond, not string
+		var arg interface{} = value
+		switch r.Op {
+		case "=":
+			col, cond = "lower("+col+")", "= lower(?)"
+		case "!=":
+			col, cond, not = "lower("+col+")", "= lower(?)", "NOT "
+		case "contains":
+			cond, arg = like+` ? ESCAPE '\'`, "%"+escapeLike(value)+"%"
+		case "notContains":
+			cond, not, arg = like+` ? ESCAPE '\'`, "NOT ", "%"+escapeLike(value)+"%"
+		}
+		if f.kind == kindGenre {
+			return not + `EXISTS (
+				SELECT 1 FROM track_genres
+				JOIN genres ON genres.id=track_genres.genre_id
+				WHERE track_genres.track_id=tracks.id AND ` + col + " " + cond + ")", []interface{}{arg}, nil
+		}
+		// tracks without the tag don't match either way
+		return fmt.Sprintf("%s%s %s", not, col, cond), []interface{}{arg}, nil
+	case kindNumber:
+		value, ok := r.Value.(float64)
+		if !ok {
+			return "", nil, fmt.Errorf("field %q needs a number, not %v", r.Field, r.Value)
+		}
+		return fmt.Sprintf("COALESCE(%s, 0) %s ?", f.expr, r.Op), []interface{}{value}, nil
+	case kindDate:
+		switch r.Op {
+		case "inTheLast", "notInTheLast":
+			days, ok := r.Value.(float64)
+			if !ok {
+				return "", nil, fmt.Errorf("field %q needs a number of days, not %v", r.Field, r.Value)
+			}
+			since := now.Add(-time.Duration(days * float64(24*time.Hour)))
+			if r.Op == "inTheLast" {
+				return fmt.Sprintf("%s > ?", f.expr), []interface{}{since}, nil
+			}
+			// never is longer ago than any number of days
+			return fmt.Sprintf("(%s IS NULL OR %s <= ?)", f.expr, f.expr), []interface{}{since}, nil
+		}
+		value, _ := r.Value.(string)
+		date, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			return "", nil, fmt.Errorf("field %q needs a date like 2006-01-02, not %v", r.Field, r.Value)
+		}
+		return fmt.Sprintf("%s %s ?", f.expr, r.Op), []interface{}{date}, nil
+	case kindBool:
+		value, ok := r.Value.(bool)
+		if !ok {
+			return "", nil, fmt.Errorf("field %q needs true or false, not %v", r.Field, r.Value)
+		}
+		return fmt.Sprintf("%s = ?", f.expr), []interface{}{value}, nil
+	}
+	return "", nil, fmt.Errorf("unknown field %q", r.Field)
+}
+
+func knownOp(kind fieldKind, op string) bool {
+	for _, known := range ops[kind] {
+		if op == known {
+			return true
+		}
+	}
+	return false
+}
+
+// smartName is the name of a smart playlist without one in its file
+func smartName(path string) string {
+	base := filepath.Base(path)
+	return base[:len(base)-len(smartExt)]
+}
@@ -0,0 +1,224 @@
+package playlists
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/mockfs"
+)
+
+func TestReadSmart(t *testing.T) {
+	t.Parallel()
+
+	tcases := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"ok", `{"all": [{"field": "year", "op": ">=", "value": 1960}], "sort": "added", "order": "desc", "limit": 5}`, ""},
+		{"empty", `{}`, ""},
+		{"unknown field", `{"all": [{"field": "mood", "op": "=", "value": "sad"}]}`, `unknown field "mood"`},
+		{"unknown key", `{"every": []}`, `unknown field "every"`},
+		{"wrong op", `{"any": [{"field": "title", "op": ">", "value": "a"}]}`, `field "title" can't be compared with ">"`},
+		{"wrong value", `{"all": [{"field": "year", "op": "=", "value": "1960"}]}`, `field "year" needs a number`},
+		{"wrong date", `{"all": [{"field": "added", "op": ">", "value": "last week"}]}`, `needs a date`},
+		{"wrong sort", `{"sort": "genre"}`, `can't sort by "genre"`},
+		{"wrong order", `{"sort": "year", "order": "up"}`, `unknown order "up"`},
+		{"wrong limit", `{"limit": -1}`, `negative`},
+	}
+	for _, tc := range tcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			_, err := ReadSmart(strings.NewReader(tc.data))
+			if tc.err == "" {
+				is.NoErr(err)
+				return
+			}
+			is.True(err != nil)
+			is.True(strings.Contains(err.Error(), tc.err)) // the error says what's wrong
+		})
+	}
+}
+
+func TestSmartTrackIDs(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	m.AddItems()
+	for al := 0; al < 3; al++ {
+		for tr := 0; tr < 3; tr++ {
+			m.SetTags(fmt.Sprintf("artist-1/album-%d/track-%d.flac", al, tr), func(tags *mockfs.Tags) error {
+				tags.RawGenres = []string{"Jazz"}
+				return nil
+			})
+		}
+	}
+	for tr := 0; tr < 3; tr++ {
+		m.SetTags(fmt.Sprintf("artist-2/album-0/track-%d.flac", tr), func(tags *mockfs.Tags) error {
+			tags.RawGenres = []string{"Rock", "Jazz Fusion"}
+			return nil
+		})
+	}
+	m.ScanAndClean()
+
+	dbc := m.DB()
+	var tracks []*db.Track
+	is.NoErr(dbc.Preload("Album").Find(&tracks).Error)
+	ids := map[string]int{}
+	for _, track := range tracks {
+		ids[track.RelPath()] = track.ID
+	}
+	idsOf := func(paths ...string) []int {
+		var trackIDs []int
+		for _, path := range paths {
+			id, ok := ids[path]
+			is.True(ok) // a seeded track
+			trackIDs = append(trackIDs, id)
+		}
+		return trackIDs
+	}
+	albumID := func(path string) int {
+		var album db.Album
+		is.NoErr(dbc.Where("left_path || right_path=?", path).First(&album).Error)
+		return album.ID
+	}
+
+	// artist-0/album-0 is old, everything was added two months ago, apart from
+	// artist-0/album-2 which was added today
+	is.NoErr(dbc.Model(db.Album{}).Where("id=?", albumID("artist-0/album-0")).UpdateColumn("tag_year", 1965).Error)
+	past := time.Now().Add(-60 * 24 * time.Hour)
+	is.NoErr(dbc.Model(db.Track{}).UpdateColumn("created_at", past).Error)
+	is.NoErr(dbc.Model(db.Track{}).Where("album_id=?", albumID("artist-0/album-2")).UpdateColumn("created_at", time.Now()).Error)
+	// the admin played two tracks of artist-1/album-1, and starred a track
+	admin := dbc.GetUserByName("admin")
+	is.NoErr(dbc.Create(&db.Play{UserID: admin.ID, AlbumID: albumID("artist-1/album-1"), Count: 3, Time: time.Now()}).Error)
+	for _, path := range []string{"artist-1/album-1/track-0.flac", "artist-1/album-1/track-1.flac"} {
+		is.NoErr(dbc.Create(&db.TrackPlay{UserID: admin.ID, TrackID: idsOf(path)[0], Count: 3, Time: time.Now()}).Error)
+	}
+	is.NoErr(dbc.Create(&db.TrackStar{UserID: admin.ID, TrackID: idsOf("artist-2/album-1/track-2.flac")[0], StarDate: time.Now()}).Error)
+	is.NoErr(dbc.Create(&db.TrackRating{UserID: admin.ID, TrackID: idsOf("artist-2/album-1/track-1.flac")[0], Rating: 4}).Error)
+
+	album := func(path string) []string {
+		return []string{path + "/track-0.flac", path + "/track-1.flac", path + "/track-2.flac"}
+	}
+	concat := func(paths ...[]string) []string {
+		var all []string
+		for _, p := range paths {
+			all = append(all, p...)
+		}
+		return all
+	}
+
+	tcases := []struct {
+		name     string
+		smart    string
+		expected []string
+	}{
+		{"genre", `{"all": [{"field": "genre", "op": "=", "value": "jazz"}]}`,
+			concat(album("artist-1/album-0"), album("artist-1/album-1"), album("artist-1/album-2"))},
+		{"genre contains", `{"all": [{"field": "genre", "op": "contains", "value": "jazz"}, {"field": "albumArtist", "op": "=", "value": "artist-2"}]}`,
+			album("artist-2/album-0")},
+		{"genre and year", `{"all": [{"field": "genre", "op": "!=", "value": "Jazz"}, {"field": "year", "op": "<", "value": 1970}]}`,
+			album("artist-0/album-0")},
+		{"any", `{"any": [{"field": "year", "op": "<", "value": 1970}, {"field": "album", "op": "=", "value": "ALBUM-2"}], "all": [{"field": "artist", "op": "!=", "value": "artist-1"}]}`,
+			concat(album("artist-0/album-0"), album("artist-0/album-2"), album("artist-2/album-2"))},
+		{"added in the last 30 days", `{"all": [{"field": "added", "op": "inTheLast", "value": 30}]}`,
+			album("artist-0/album-2")},
+		{"added before", `{"all": [{"field": "added", "op": "<", "value": "` + time.Now().Add(-30*24*time.Hour).Format("2006-01-02") + `"}, {"field": "path", "op": "contains", "value": "artist-0/"}]}`,
+			concat(album("artist-0/album-0"), album("artist-0/album-1"))},
+		{"never played", `{"all": [{"field": "playCount", "op": "=", "value": 0}, {"field": "artist", "op": "=", "value": "artist-1"}]}`,
+			concat(album("artist-1/album-0"), []string{"artist-1/album-1/track-2.flac"}, album("artist-1/album-2"))},
+		{"played lately", `{"all": [{"field": "lastPlayed", "op": "inTheLast", "value": 1}]}`,
+			[]string{"artist-1/album-1/track-0.flac", "artist-1/album-1/track-1.flac"}},
+		{"not played lately", `{"all": [{"field": "lastPlayed", "op": "notInTheLast", "value": 1}, {"field": "artist", "op": "=", "value": "artist-1"}]}`,
+			concat(album("artist-1/album-0"), []string{"artist-1/album-1/track-2.flac"}, album("artist-1/album-2"))},
+		{"starred or rated", `{"any": [{"field": "starred", "op": "=", "value": true}, {"field": "rating", "op": ">=", "value": 3}]}`,
+			[]string{"artist-2/album-1/track-1.flac", "artist-2/album-1/track-2.flac"}},
+		{"title", `{"all": [{"field": "title", "op": "=", "value": "title-1"}, {"field": "album", "op": "notContains", "value": "1"}], "sort": "albumArtist", "order": "desc", "limit": 4}`,
+			[]string{"artist-2/album-2/track-1.flac", "artist-2/album-0/track-1.flac", "artist-1/album-2/track-1.flac", "artist-1/album-0/track-1.flac"}},
+		{"no match", `{"all": [{"field": "title", "op": "contains", "value": "%"}]}`,
+			nil},
+	}
+	for _, tc := range tcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			smart, err := ReadSmart(strings.NewReader(tc.smart))
+			is.NoErr(err)
+			trackIDs, err := smart.TrackIDs(dbc, admin.ID)
+			is.NoErr(err)
+			var expected []int
+			if tc.expected != nil {
+				expected = idsOf(tc.expected...)
+			}
+			is.Equal(trackIDs, expected)
+		})
+	}
+}
+
+func TestSyncSmart(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.NewWithDirs(t, []string{"music"})
+
+	m.AddItemsPrefix("music")
+	m.ScanAndClean()
+	musicDir := filepath.Join(m.TmpDir(), "music")
+	playlistsDir := t.TempDir()
+	s := New(m.DB(), playlistsDir, []string{musicDir})
+
+	write := func(name, data string) {
+		t.Helper()
+		is.NoErr(os.WriteFile(filepath.Join(playlistsDir, name), []byte(data), 0o600))
+	}
+	write("starred.smart.json", `{"all": [{"field": "starred", "op": "=", "value": true}], "comment": "my stars"}`)
+	write("broken.smart.json", `{"all": [{"field": "mood"}]}`)
+	write("other.json", `{}`)
+
+	result, err := s.Sync()
+	is.NoErr(err)
+	is.Equal(result.Synced, 1)
+
+	var playlists []*db.Playlist
+	is.NoErr(m.DB().Find(&playlists).Error)
+	is.Equal(len(playlists), 1) // not the broken one
+	starred := playlists[0]
+	is.Equal(starred.Name, "starred")
+	is.Equal(starred.Comment, "my stars")
+	is.True(starred.IsSmart)
+	is.Equal(starred.TrackCount, 0)
+
+	// a star shows up after a refresh, or the next sync
+	var track db.Track
+	is.NoErr(m.DB().First(&track).Error)
+	is.NoErr(m.DB().Create(&db.TrackStar{UserID: starred.UserID, TrackID: track.ID, StarDate: time.Now()}).Error)
+	is.NoErr(s.Refresh(starred.ID))
+	is.NoErr(m.DB().First(starred, starred.ID).Error)
+	is.Equal(starred.GetItems(), []int{track.ID})
+
+	// smart playlists aren't exported
+	is.NoErr(s.Export(starred.ID))
+	entries, err := os.ReadDir(playlistsDir)
+	is.NoErr(err)
+	is.Equal(len(entries), 3)
+
+	// and a renamed one keeps its playlist
+	write("starred.smart.json", `{"name": "stars", "all": [{"field": "starred", "op": "=", "value": true}]}`)
+	result, err = s.Sync()
+	is.NoErr(err)
+	is.Equal(result.Synced, 1)
+	is.NoErr(m.DB().First(starred, starred.ID).Error)
+	is.Equal(starred.Name, "stars")
+	is.Equal(starred.GetItems(), []int{track.ID})
+}
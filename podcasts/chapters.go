@@ -0,0 +1,170 @@
+package podcasts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mmcdole/gofeed"
+
+	"go.senan.xyz/gonic/db"
+)
+
+// maxChaptersSize is more than any real chapters file, so that a bad link can't
+// have us read something huge
+const maxChaptersSize = 4 << 20
+
+// chaptersFile is the podcast namespace's json chapters format.
+// https://github.com/Podcastindex-org/podcast-namespace/blob/main/chapters/jsonChapters.md
+type chaptersFile struct {
+	Chapters []struct {
+		StartTime float64 `json:"startTime"`
+		Title     string  `json:"title"`
+		Img       string  `json:"img"`
+		URL       string  `json:"url"`
+		// TOC false means the chapter is only for showing art or a link while
+		// playing, and shouldn't be listed
+		TOC *bool `json:"toc"`
+	} `json:"chapters"`
+}
+
+// itemChaptersURL finds the item's podcast:chapters link, if it has a json one
+func itemChaptersURL(item *gofeed.Item) string {
+	for _, ext := range item.Extensions["podcast"]["chapters"] {
+		if typ := ext.Attrs["type"]; typ != "" && typ != "application/json+chapters" && typ != "application/json" {
+			continue
+		}
+		if url := ext.Attrs["url"]; url != "" {
+			return url
+		}
+	}
+	return ""
+}
+
+// itemPSCChapters reads the item's podlove simple chapters, which are in the
+// feed itself rather than linked.
+// https://podlove.org/simple-chapters/
+func itemPSCChapters(item *gofeed.Item) []*db.PodcastChapter {
+	var chapters []*db.PodcastChapter
+	for _, list := range item.Extensions["psc"]["chapters"] {
+		for _, ext := range list.Children["chapter"] {
+			start, ok := parseClock(ext.Attrs["start"])
+			if !ok {
+				continue
+			}
+			chapters = append(chapters, &db.PodcastChapter{
+				StartTime: start,
+				Title:     ext.Attrs["title"],
+				URL:       ext.Attrs["href"],
+				ImageURL:  ext.Attrs["image"],
+			})
+		}
+	}
+	sort.SliceStable(chapters, func(i, j int) bool {
+		return chapters[i].StartTime < chapters[j].StartTime
+	})
+	return chapters
+}
+
+func parseChapters(r io.Reader) ([]*db.PodcastChapter, error) {
+	var file chaptersFile
+	if err := json.NewDecoder(io.LimitReader(r, maxChaptersSize)).Decode(&file); err != nil {
+		return nil, fmt.Errorf("decode chapters: %w", err)
+	}
+	var chapters []*db.PodcastChapter
+	for _, c := range file.Chapters {
+		if c.TOC != nil && !*c.TOC {
+			continue
+		}
+		if c.StartTime < 0 {
+			return nil, fmt.Errorf("chapter %q has a negative start time", c.Title)
+		}
+		chapters = append(chapters, &db.PodcastChapter{
+			StartTime: c.StartTime,
+			Title:     c.Title,
+			URL:       c.URL,
+			ImageURL:  c.Img,
+		})
+	}
+	sort.SliceStable(chapters, func(i, j int) bool {
+		return chapters[i].StartTime < chapters[j].StartTime
+	})
+	return chapters, nil
+}
+
+// downloadChapters fetches the episode's chapters, if its feed links some, and
+// replaces the ones we have
+func (p *Podcasts) downloadChapters(podcastEpisode *db.PodcastEpisode) error {
+	if podcastEpisode.ChaptersURL == "" {
+		return nil
+	}
+	resp, err := p.client.Get(podcastEpisode.ChaptersURL)
+	if err != nil {
+		return fmt.Errorf("fetch chapters: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch chapters: status %s", resp.Status)
+	}
+	chapters, err := parseChapters(resp.Body)
+	if err != nil {
+		return err
+	}
+	return p.replaceChapters(podcastEpisode.ID, chapters)
+}
+
+// downloadAllChapters is downloadChapters for each of the episodes. it's run
+// in the background, since chapters are only extras
+func (p *Podcasts) downloadAllChapters(podcastEpisodes []*db.PodcastEpisode) {
+	for _, podcastEpisode := range podcastEpisodes {
+		if err := p.downloadChapters(podcastEpisode); err != nil {
+			log.Printf("error downloading podcast chapters, skipping: %v", err)
+		}
+	}
+}
+
+// replaceChapters replaces the episode's chapters with chapters
+func (p *Podcasts) replaceChapters(podcastEpisodeID int, chapters []*db.PodcastChapter) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.
+			Where("podcast_episode_id=?", podcastEpisodeID).
+			Delete(db.PodcastChapter{}).
+			Error
+		if err != nil {
+			return fmt.Errorf("delete old chapters: %w", err)
+		}
+		for _, chapter := range chapters {
+			chapter.PodcastEpisodeID = podcastEpisodeID
+			if err := tx.Create(chapter).Error; err != nil {
+				return fmt.Errorf("save chapter: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// preloadChapters puts preloaded chapters in order
+func preloadChapters(dbc *gorm.DB) *gorm.DB {
+	return dbc.Order("start_time, id")
+}
+
+func (p *Podcasts) GetPodcastEpisodeChapters(podcastEpisodeID int) ([]*db.PodcastChapter, error) {
+	episode := db.PodcastEpisode{}
+	if err := p.db.First(&episode, podcastEpisodeID).Error; err != nil {
+		return nil, fmt.Errorf("find episode by id: %w", err)
+	}
+	chapters := []*db.PodcastChapter{}
+	err := p.db.
+		Where("podcast_episode_id=?", podcastEpisodeID).
+		Order("start_time, id").
+		Find(&chapters).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("find chapters by episode id: %w", err)
+	}
+	return chapters, nil
+}
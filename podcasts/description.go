@@ -0,0 +1,93 @@
+package podcasts
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// allowedTags are the html tags which are kept in episode descriptions. the
+// rest are dropped, but their text is kept
+var allowedTags = map[atom.Atom]bool{
+	atom.A: true, atom.P: true, atom.Br: true,
+	atom.B: true, atom.Strong: true, atom.I: true, atom.Em: true,
+	atom.Ul: true, atom.Ol: true, atom.Li: true,
+	atom.Blockquote: true, atom.Code: true, atom.Pre: true,
+}
+
+// droppedTags are dropped along with everything in them
+var droppedTags = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Iframe: true, atom.Object: true,
+	atom.Noscript: true, atom.Template: true, atom.Head: true, atom.Title: true,
+}
+
+// sanitizeDescription keeps only simple formatting and links from an episode's
+// html description, so that clients can show it as it is. links only keep their
+// href, and only if it's http, https, or mailto
+func sanitizeDescription(in string) string {
+	var out strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(in))
+	var dropping atom.Atom
+	for {
+		tt := tokenizer.Next()
+		if tt == html.ErrorToken {
+			if tokenizer.Err() != io.EOF {
+				return html.EscapeString(in)
+			}
+			break
+		}
+		token := tokenizer.Token()
+		if dropping != 0 {
+			if tt == html.EndTagToken && token.DataAtom == dropping {
+				dropping = 0
+			}
+			continue
+		}
+		switch tt {
+		case html.TextToken:
+			out.WriteString(html.EscapeString(token.Data))
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if droppedTags[token.DataAtom] && tt == html.StartTagToken {
+				dropping = token.DataAtom
+				continue
+			}
+			if !allowedTags[token.DataAtom] {
+				continue
+			}
+			token.Attr = safeAttrs(token)
+			if token.DataAtom == atom.Br {
+				token.Type = html.SelfClosingTagToken
+			}
+			out.WriteString(token.String())
+		case html.EndTagToken:
+			if allowedTags[token.DataAtom] && token.DataAtom != atom.Br {
+				out.WriteString(token.String())
+			}
+		}
+	}
+	return strings.TrimSpace(out.String())
+}
+
+func safeAttrs(token html.Token) []html.Attribute {
+	if token.DataAtom != atom.A {
+		return nil
+	}
+	for _, attr := range token.Attr {
+		if attr.Namespace != "" || attr.Key != "href" {
+			continue
+		}
+		href, err := url.Parse(strings.TrimSpace(attr.Val))
+		if err != nil {
+			return nil
+		}
+		switch strings.ToLower(href.Scheme) {
+		case "http", "https", "mailto":
+			return []html.Attribute{{Key: "href", Val: href.String()}}
+		}
+		return nil
+	}
+	return nil
+}
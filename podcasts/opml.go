@@ -0,0 +1,198 @@
+package podcasts
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+
+	"go.senan.xyz/gonic/db"
+)
+
+// OPMLFeed is a podcast feed listed in an OPML file
+type OPMLFeed struct {
+	Title string
+	URL   string
+}
+
+type opml struct {
+	XMLName xml.Name    `xml:"opml"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"head>title"`
+	Created string      `xml:"head>dateCreated,omitempty"`
+	Body    opmlOutline `xml:"body"`
+}
+
+type opmlOutline struct {
+	Type     string        `xml:"type,attr,omitempty"`
+	Text     string        `xml:"text,attr,omitempty"`
+	Title    string        `xml:"title,attr,omitempty"`
+	XMLURL   string        `xml:"xmlUrl,attr,omitempty"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+// ReadOPML reads the feeds of an OPML file, such as podcast apps export
+// subscriptions as. outlines with an xmlUrl are feeds, and others can group
+// them, to any depth. a feed listed twice is only read once
+func ReadOPML(r io.Reader) ([]OPMLFeed, error) {
+	var doc opml
+	decoder := xml.NewDecoder(r)
+	// some apps say they're iso-8859-1 or such, but are ascii anyway
+	decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode opml: %w", err)
+	}
+	var feeds []OPMLFeed
+	seen := map[string]struct{}{}
+	var walk func(outlines []opmlOutline)
+	walk = func(outlines []opmlOutline) {
+		for _, outline := range outlines {
+			walk(outline.Outlines)
+			feedURL := strings.TrimSpace(outline.XMLURL)
+			if feedURL == "" {
+				continue
+			}
+			if _, ok := seen[feedURL]; ok {
+				continue
+			}
+			seen[feedURL] = struct{}{}
+			title := outline.Title
+			if title == "" {
+				title = outline.Text
+			}
+			feeds = append(feeds, OPMLFeed{Title: title, URL: feedURL})
+		}
+	}
+	walk(doc.Body.Outlines)
+	return feeds, nil
+}
+
+// WriteOPML writes the feeds of podcasts as an OPML file, which ReadOPML and
+// other podcast apps can import
+func WriteOPML(w io.Writer, podcasts []*db.Podcast) error {
+	doc := opml{
+		Version: "2.0",
+		Title:   "gonic podcasts",
+		Created: time.Now().Format(time.RFC1123Z),
+	}
+	for _, podcast := range podcasts {
+		doc.Body.Outlines = append(doc.Body.Outlines, opmlOutline{
+			Type:   "rss",
+			Text:   podcast.Title,
+			Title:  podcast.Title,
+			XMLURL: podcast.URL,
+		})
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return fmt.Errorf("encode opml: %w", err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// ImportStatus is how far along the latest import is
+type ImportStatus struct {
+	Running bool
+	Total   int
+	Done    int
+	Errors  []string
+}
+
+// Import adds a podcast for each of the feeds which isn't one already, and
+// returns how many it skipped. the feeds are fetched in the background, one
+// at a time, each within fetchTimeout, see ImportStatus
+func (p *Podcasts) Import(feeds []OPMLFeed) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.importStatus.Running {
+		return 0, ErrImportRunning
+	}
+	var urls []string
+	if err := p.db.Model(db.Podcast{}).Pluck("url", &urls).Error; err != nil {
+		return 0, fmt.Errorf("find podcasts: %w", err)
+	}
+	existing := map[string]struct{}{}
+	for _, url := range urls {
+		existing[url] = struct{}{}
+	}
+	var todo []OPMLFeed
+	for _, feed := range feeds {
+		if _, ok := existing[feed.URL]; ok {
+			continue
+		}
+		todo = append(todo, feed)
+	}
+	p.importStatus = ImportStatus{Running: len(todo) > 0, Total: len(todo)}
+	if len(todo) > 0 {
+		go p.importFeeds(context.Background(), todo)
+	}
+	return len(feeds) - len(todo), nil
+}
+
+// ImportStatus is a copy of the status of the latest import
+func (p *Podcasts) ImportStatus() ImportStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := p.importStatus
+	status.Errors = append([]string(nil), status.Errors...)
+	return status
+}
+
+func (p *Podcasts) importFeeds(ctx context.Context, feeds []OPMLFeed) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer func() {
+		p.mu.Lock()
+		p.importStatus.Running = false
+		p.mu.Unlock()
+	}()
+	fp := gofeed.NewParser()
+	fp.Client = p.client
+	for _, feed := range feeds {
+		err := p.importFeed(ctx, fp, feed)
+		if err != nil {
+			log.Printf("error importing podcast %q: %v", feed.URL, err)
+		}
+		p.mu.Lock()
+		p.importStatus.Done++
+		if err != nil {
+			p.importStatus.Errors = append(p.importStatus.Errors, fmt.Sprintf("%s: %v", feedName(feed), err))
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *Podcasts) importFeed(ctx context.Context, fp *gofeed.Parser, feed OPMLFeed) error {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+	parsed, err := fp.ParseURLWithContext(feed.URL, ctx)
+	if err != nil {
+		return fmt.Errorf("fetch feed: %w", err)
+	}
+	if parsed.Title == "" {
+		parsed.Title = feedName(feed)
+	}
+	if _, err := p.AddNewPodcast(feed.URL, parsed); err != nil {
+		return fmt.Errorf("add podcast: %w", err)
+	}
+	return nil
+}
+
+func feedName(feed OPMLFeed) string {
+	if feed.Title != "" {
+		return feed.Title
+	}
+	return feed.URL
+}
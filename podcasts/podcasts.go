@@ -1,6 +1,7 @@
 package podcasts
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,8 +12,10 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -21,23 +24,84 @@ import (
 	"go.senan.xyz/gonic/db"
 	gmime "go.senan.xyz/gonic/mime"
 	"go.senan.xyz/gonic/multierr"
+	"go.senan.xyz/gonic/notify"
 	"go.senan.xyz/gonic/scanner/tags"
 )
 
 const downloadAllWaitInterval = 3 * time.Second
 
+// refreshWaitInterval is the wait between fetching one feed and the next, so
+// that a scheduled refresh doesn't fetch them all at once
+const refreshWaitInterval = 2 * time.Second
+
+// fetchTimeout is how long fetching something small, like chapters or an
+// imported feed, can take, so that a server which never answers can't hold
+// anything up
+const fetchTimeout = 30 * time.Second
+
+// a feed which fails to refresh isn't tried again for refreshBackoffMin, which
+// doubles with each failure in a row, up to refreshBackoffMax
+const (
+	refreshBackoffMin = 30 * time.Minute
+	refreshBackoffMax = 7 * 24 * time.Hour
+)
+
+// downloadFailuresNotify is how many downloads in a row can fail before the
+// admin is notified
+const downloadFailuresNotify = 3
+
 type Podcasts struct {
 	db      *db.DB
 	baseDir string
 	tagger  tags.Reader
+	// client fetches the small things, see fetchTimeout
+	client *http.Client
+
+	notifier         *notify.Dispatcher
+	mu               sync.Mutex
+	downloadFailures int
+	importStatus     ImportStatus
+	refreshWait      time.Duration
+	// refreshing are the podcasts being refreshed now
+	refreshing map[int]struct{}
 }
 
+var ErrImportRunning = errors.New("an import is already running")
+
 func New(db *db.DB, base string, tagger tags.Reader) *Podcasts {
 	return &Podcasts{
-		db:      db,
-		baseDir: base,
-		tagger:  tagger,
+		db:          db,
+		baseDir:     base,
+		tagger:      tagger,
+		client:      &http.Client{Timeout: fetchTimeout},
+		refreshWait: refreshWaitInterval,
+		refreshing:  map[int]struct{}{},
+	}
+}
+
+// SetNotifier sends a notification when downloads keep failing
+func (p *Podcasts) SetNotifier(notifier *notify.Dispatcher) {
+	p.notifier = notifier
+}
+
+// downloadDone counts downloads which failed in a row, err is nil for ones
+// which didn't
+func (p *Podcasts) downloadDone(episode *db.PodcastEpisode, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		p.downloadFailures = 0
+		return
+	}
+	p.downloadFailures++
+	if p.downloadFailures < downloadFailuresNotify {
+		return
 	}
+	p.notifier.Publish(notify.Event{
+		Type:    notify.EventPodcastDownloads,
+		Title:   "gonic podcast downloads are failing",
+		Message: fmt.Sprintf("the last %d podcast downloads failed. the latest was %q: %v", p.downloadFailures, episode.Title, err),
+	})
 }
 
 func (p *Podcasts) GetPodcastOrAll(id int, includeEpisodes bool) ([]*db.Podcast, error) {
@@ -67,6 +131,7 @@ func (p *Podcasts) GetPodcastOrAll(id int, includeEpisodes bool) ([]*db.Podcast,
 func (p *Podcasts) GetPodcastEpisodes(podcastID int) ([]*db.PodcastEpisode, error) {
 	episodes := []*db.PodcastEpisode{}
 	err := p.db.
+		Preload("Chapters", preloadChapters).
 		Where("podcast_id=?", podcastID).
 		Order("publish_date DESC").
 		Find(&episodes).
@@ -80,6 +145,7 @@ func (p *Podcasts) GetPodcastEpisodes(podcastID int) ([]*db.PodcastEpisode, erro
 func (p *Podcasts) GetNewestPodcastEpisodes(count int) ([]*db.PodcastEpisode, error) {
 	episodes := []*db.PodcastEpisode{}
 	err := p.db.
+		Preload("Chapters", preloadChapters).
 		Order("publish_date DESC").
 		Limit(count).
 		Find(&episodes).
@@ -93,10 +159,12 @@ func (p *Podcasts) GetNewestPodcastEpisodes(count int) ([]*db.PodcastEpisode, er
 func (p *Podcasts) AddNewPodcast(rssURL string, feed *gofeed.Feed) (*db.Podcast, error) {
 	podcast := db.Podcast{
 		Description: feed.Description,
-		ImageURL:    feed.Image.URL,
 		Title:       feed.Title,
 		URL:         rssURL,
 	}
+	if feed.Image != nil {
+		podcast.ImageURL = feed.Image.URL
+	}
 	podPath := absPath(p.baseDir, &podcast)
 	err := os.Mkdir(podPath, 0755)
 	if err != nil && !os.IsExist(err) {
@@ -108,6 +176,9 @@ func (p *Podcasts) AddNewPodcast(rssURL string, feed *gofeed.Feed) (*db.Podcast,
 	if err := p.AddNewEpisodes(&podcast, feed.Items); err != nil {
 		return nil, err
 	}
+	if podcast.ImageURL == "" {
+		return &podcast, nil
+	}
 	go func() {
 		if err := p.downloadPodcastCover(podPath, &podcast); err != nil {
 			log.Printf("error downloading podcast cover: %v", err)
@@ -116,7 +187,9 @@ func (p *Podcasts) AddNewPodcast(rssURL string, feed *gofeed.Feed) (*db.Podcast,
 	return &podcast, nil
 }
 
-func (p *Podcasts) SetAutoDownload(podcastID int, setting db.PodcastAutoDownload) error {
+// SetAutoDownload sets which new episodes are downloaded when the podcast is
+// refreshed. keep is how many episodes db.PodcastAutoDownloadLatest keeps
+func (p *Podcasts) SetAutoDownload(podcastID int, setting db.PodcastAutoDownload, keep int) error {
 	podcast := db.Podcast{}
 	err := p.db.
 		Where("id=?", podcastID).
@@ -126,6 +199,7 @@ func (p *Podcasts) SetAutoDownload(podcastID int, setting db.PodcastAutoDownload
 		return err
 	}
 	podcast.AutoDownload = setting
+	podcast.AutoDownloadKeep = keep
 	if err := p.db.Save(&podcast).Error; err != nil {
 		return fmt.Errorf("save setting: %w", err)
 	}
@@ -163,39 +237,146 @@ func (p *Podcasts) AddNewEpisodes(podcast *db.Podcast, items []*gofeed.Item) err
 		}
 		return nil
 	}
+	var episodes []*db.PodcastEpisode
 	for _, item := range getEntriesAfterDate(items, *podcastEpisode.PublishDate) {
 		episode, err := p.AddEpisode(podcast.ID, item)
 		if err != nil {
 			return err
 		}
-		if podcast.AutoDownload == db.PodcastAutoDownloadLatest &&
-			(episode.Status != db.PodcastEpisodeStatusCompleted && episode.Status != db.PodcastEpisodeStatusDownloading) {
-			if err := p.DownloadEpisode(episode.ID); err != nil {
-				return err
-			}
+		if episode == nil {
+			continue
+		}
+		episodes = append(episodes, episode)
+	}
+	// only new episodes, so that adding a podcast doesn't fetch them all
+	go p.downloadAllChapters(episodes)
+	return p.autoDownload(podcast, episodes)
+}
+
+// autoDownload downloads the new episodes which the podcast's auto download
+// setting allows. for db.PodcastAutoDownloadLatest, that's the newest few, and
+// older downloads are deleted so that only AutoDownloadKeep are kept
+func (p *Podcasts) autoDownload(podcast *db.Podcast, episodes []*db.PodcastEpisode) error {
+	keep := len(episodes)
+	switch podcast.AutoDownload {
+	case db.PodcastAutoDownloadAll:
+	case db.PodcastAutoDownloadLatest:
+		keep = podcast.AutoDownloadKeep
+		if keep < 1 {
+			keep = 1
+		}
+	default:
+		return nil
+	}
+	sort.SliceStable(episodes, func(i, j int) bool {
+		return publishDate(episodes[i]).After(publishDate(episodes[j]))
+	})
+	for i, episode := range episodes {
+		if i == keep {
+			break
+		}
+		if episode.Status == db.PodcastEpisodeStatusCompleted || episode.Status == db.PodcastEpisodeStatusDownloading {
+			continue
+		}
+		if err := p.downloadEpisode(episode.ID, true); err != nil {
+			return err
+		}
+	}
+	if podcast.AutoDownload != db.PodcastAutoDownloadLatest || len(episodes) == 0 {
+		return nil
+	}
+	return p.deleteDownloadsAfter(podcast.ID, keep)
+}
+
+// deleteDownloadsAfter deletes the podcast's auto downloaded episodes apart
+// from the newest keep. ones still downloading count, but are left alone, and
+// ones downloaded by hand are kept
+func (p *Podcasts) deleteDownloadsAfter(podcastID int, keep int) error {
+	var downloaded []*db.PodcastEpisode
+	err := p.db.
+		Where("podcast_id=? AND status IN (?)", podcastID, []db.PodcastEpisodeStatus{db.PodcastEpisodeStatusCompleted, db.PodcastEpisodeStatusDownloading}).
+		Where("auto_downloaded=?", true).
+		Order("publish_date DESC").
+		Find(&downloaded).
+		Error
+	if err != nil {
+		return fmt.Errorf("find downloaded episodes: %w", err)
+	}
+	if len(downloaded) <= keep {
+		return nil
+	}
+	for _, episode := range downloaded[keep:] {
+		if episode.Status != db.PodcastEpisodeStatusCompleted {
+			continue
+		}
+		if err := p.DeletePodcastEpisode(episode.ID); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("delete old episode %d: %w", episode.ID, err)
+		}
+	}
+	return nil
+}
+
+func publishDate(episode *db.PodcastEpisode) time.Time {
+	if episode.PublishDate == nil {
+		return time.Time{}
+	}
+	return *episode.PublishDate
+}
+
+// RestartDownloads carries on downloading the episodes which were still
+// downloading when gonic last stopped, from where they got to if the server
+// allows it
+func (p *Podcasts) RestartDownloads() error {
+	var interrupted []*db.PodcastEpisode
+	err := p.db.
+		Where("status=?", db.PodcastEpisodeStatusDownloading).
+		Find(&interrupted).
+		Error
+	if err != nil {
+		return fmt.Errorf("find interrupted downloads: %w", err)
+	}
+	errs := &multierr.Err{}
+	for _, episode := range interrupted {
+		episode.Status = db.PodcastEpisodeStatusSkipped
+		if err := p.db.Save(episode).Error; err != nil {
+			errs.Add(fmt.Errorf("reset episode %d: %w", episode.ID, err))
+			continue
 		}
+		if err := p.downloadEpisode(episode.ID, episode.AutoDownloaded); err != nil {
+			errs.Add(fmt.Errorf("restart episode %d: %w", episode.ID, err))
+		}
+	}
+	if errs.Len() > 0 {
+		return errs
 	}
 	return nil
 }
 
+// getSecondsFromString parses a duration from a feed, 0 if it can't
 func getSecondsFromString(time string) int {
-	duration, err := strconv.Atoi(time)
-	if err == nil {
-		return duration
+	seconds, ok := parseClock(time)
+	if !ok {
+		return 0
 	}
-	splitTime := strings.Split(time, ":")
-	if len(splitTime) == 3 {
-		hours, _ := strconv.Atoi(splitTime[0])
-		minutes, _ := strconv.Atoi(splitTime[1])
-		seconds, _ := strconv.Atoi(splitTime[2])
-		return (3600 * hours) + (60 * minutes) + seconds
+	return int(seconds)
+}
+
+// parseClock parses seconds, MM:SS, or HH:MM:SS, any of which can have a
+// fraction of a second, like itunes:duration and psc:chapter start times
+func parseClock(clock string) (float64, bool) {
+	parts := strings.Split(strings.TrimSpace(clock), ":")
+	if len(parts) > 3 {
+		return 0, false
 	}
-	if len(splitTime) == 2 {
-		minutes, _ := strconv.Atoi(splitTime[0])
-		seconds, _ := strconv.Atoi(splitTime[1])
-		return (60 * minutes) + seconds
+	var seconds float64
+	for _, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 {
+			return 0, false
+		}
+		seconds = seconds*60 + v
 	}
-	return 0
+	return seconds, true
 }
 
 func (p *Podcasts) AddEpisode(podcastID int, item *gofeed.Item) (*db.PodcastEpisode, error) {
@@ -213,21 +394,24 @@ func (p *Podcasts) AddEpisode(podcastID int, item *gofeed.Item) (*db.PodcastEpis
 		duration = getSecondsFromString(item.ITunesExt.Duration)
 	}
 
-	if episode, ok := p.findEnclosureAudio(podcastID, duration, item); ok {
-		if err := p.db.Save(episode).Error; err != nil {
-			return nil, err
-		}
-		return episode, nil
+	episode, ok := p.findEnclosureAudio(podcastID, duration, item)
+	if !ok {
+		episode, ok = p.findMediaAudio(podcastID, duration, item)
 	}
-	if episode, ok := p.findMediaAudio(podcastID, duration, item); ok {
-		if err := p.db.Save(episode).Error; err != nil {
+	if !ok {
+		// hopefully shouldnt reach here
+		log.Println("failed to find audio in feed item, skipping")
+		return nil, nil
+	}
+	if err := p.db.Save(episode).Error; err != nil {
+		return nil, err
+	}
+	if chapters := itemPSCChapters(item); len(chapters) > 0 {
+		if err := p.replaceChapters(episode.ID, chapters); err != nil {
 			return nil, err
 		}
-		return episode, nil
 	}
-	// hopefully shouldnt reach here
-	log.Println("failed to find audio in feed item, skipping")
-	return nil, nil
+	return episode, nil
 }
 
 func isAudio(mediaType, url string) bool {
@@ -240,15 +424,36 @@ func isAudio(mediaType, url string) bool {
 
 func itemToEpisode(podcastID, size, duration int, audio string,
 	item *gofeed.Item) *db.PodcastEpisode {
-	return &db.PodcastEpisode{
+	episode := &db.PodcastEpisode{
 		PodcastID:   podcastID,
-		Description: item.Description,
+		Description: sanitizeDescription(itemDescription(item)),
 		Title:       item.Title,
 		Length:      duration,
 		Size:        size,
 		PublishDate: item.PublishedParsed,
 		AudioURL:    audio,
 		Status:      db.PodcastEpisodeStatusSkipped,
+		ChaptersURL: itemChaptersURL(item),
+	}
+	if item.ITunesExt != nil {
+		episode.EpisodeNumber, _ = strconv.Atoi(strings.TrimSpace(item.ITunesExt.Episode))
+		episode.SeasonNumber, _ = strconv.Atoi(strings.TrimSpace(item.ITunesExt.Season))
+	}
+	return episode
+}
+
+// itemDescription finds the item's show notes. the full content:encoded notes
+// are preferred over the description, which is often cut short
+func itemDescription(item *gofeed.Item) string {
+	switch {
+	case item.Content != "":
+		return item.Content
+	case item.Description != "":
+		return item.Description
+	case item.ITunesExt != nil:
+		return item.ITunesExt.Summary
+	default:
+		return ""
 	}
 }
 
@@ -277,35 +482,202 @@ func (p *Podcasts) findMediaAudio(podcastID, duration int, item *gofeed.Item) (*
 	return nil, false
 }
 
+// RefreshPodcasts refreshes every podcast now, even those backing off after
+// failing, which start again from no failures. it's run by hand, with someone
+// waiting, so it doesn't wait between feeds
 func (p *Podcasts) RefreshPodcasts() error {
+	err := p.db.
+		Model(db.Podcast{}).
+		UpdateColumns(map[string]interface{}{"refresh_failures": 0, "refresh_after": nil}).
+		Error
+	if err != nil {
+		return fmt.Errorf("reset backoff: %w", err)
+	}
 	podcasts := []*db.Podcast{}
 	if err := p.db.Find(&podcasts).Error; err != nil {
 		return fmt.Errorf("find podcasts: %w", err)
 	}
 	var errs *multierr.Err
-	if errors.As(p.refreshPodcasts(podcasts), &errs) && errs.Len() > 0 {
+	if errors.As(p.refreshPodcasts(context.Background(), podcasts, 0), &errs) && errs.Len() > 0 {
 		return fmt.Errorf("refresh podcasts: %w", errs)
 	}
 	return nil
 }
 
-func (p *Podcasts) refreshPodcasts(podcasts []*db.Podcast) error {
+// RefreshDuePodcasts refreshes the podcasts which aren't backing off after
+// failing, for the scheduled refresh. it stops between feeds once ctx is done
+func (p *Podcasts) RefreshDuePodcasts(ctx context.Context) error {
+	podcasts := []*db.Podcast{}
+	err := p.db.
+		Where("refresh_after IS NULL OR refresh_after<=?", time.Now()).
+		Find(&podcasts).
+		Error
+	if err != nil {
+		return fmt.Errorf("find podcasts: %w", err)
+	}
+	var errs *multierr.Err
+	if errors.As(p.refreshPodcasts(ctx, podcasts, p.refreshWait), &errs) && errs.Len() > 0 {
+		return fmt.Errorf("refresh podcasts: %w", errs)
+	}
+	return nil
+}
+
+func (p *Podcasts) refreshPodcasts(ctx context.Context, podcasts []*db.Podcast, between time.Duration) error {
 	errs := &multierr.Err{}
-	for _, podcast := range podcasts {
-		fp := gofeed.NewParser()
-		feed, err := fp.ParseURL(podcast.URL)
-		if err != nil {
-			errs.Add(fmt.Errorf("refreshing podcast with url %q: %w", podcast.URL, err))
-			continue
+	for i, podcast := range podcasts {
+		if i > 0 && between > 0 {
+			wait := time.NewTimer(between)
+			select {
+			case <-wait.C:
+			case <-ctx.Done():
+				wait.Stop()
+			}
+		}
+		if ctx.Err() != nil {
+			break
 		}
-		if err = p.AddNewEpisodes(podcast, feed.Items); err != nil {
-			errs.Add(fmt.Errorf("adding episodes: %w", err))
+		if !p.startRefresh(podcast.ID) {
 			continue
 		}
+		err := p.refreshPodcast(podcast)
+		p.finishRefresh(podcast.ID)
+		if err := p.saveRefreshResult(podcast, err); err != nil {
+			errs.Add(err)
+		}
+		if err != nil {
+			errs.Add(fmt.Errorf("refreshing podcast with url %q: %w", podcast.URL, err))
+		}
 	}
 	return errs
 }
 
+// startRefresh is false if the podcast is already being refreshed
+func (p *Podcasts) startRefresh(podcastID int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.refreshing[podcastID]; ok {
+		return false
+	}
+	p.refreshing[podcastID] = struct{}{}
+	return true
+}
+
+func (p *Podcasts) finishRefresh(podcastID int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.refreshing, podcastID)
+}
+
+func (p *Podcasts) refreshPodcast(podcast *db.Podcast) error {
+	feed, err := p.fetchFeed(podcast)
+	if err != nil {
+		return err
+	}
+	if feed == nil {
+		// not modified
+		return nil
+	}
+	if err = p.AddNewEpisodes(podcast, feed.Items); err != nil {
+		return fmt.Errorf("adding episodes: %w", err)
+	}
+	if err := p.refreshPodcastCover(podcast, feed); err != nil {
+		return fmt.Errorf("refreshing cover: %w", err)
+	}
+	return nil
+}
+
+// fetchFeed fetches the podcast's feed, unless it hasn't changed since the
+// last fetch, when the feed is nil. the ETag and Last-Modified of the feed are
+// kept on the podcast to ask next time
+func (p *Podcasts) fetchFeed(podcast *db.Podcast) (*gofeed.Feed, error) {
+	req, err := http.NewRequest(http.MethodGet, podcast.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create feed request: %w", err)
+	}
+	if podcast.ETag != "" {
+		req.Header.Set("If-None-Match", podcast.ETag)
+	}
+	if podcast.LastModified != "" {
+		req.Header.Set("If-Modified-Since", podcast.LastModified)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch feed: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("fetch feed: status %s", resp.Status)
+	}
+	feed, err := gofeed.NewParser().Parse(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("parse feed: %w", err)
+	}
+	podcast.ETag = resp.Header.Get("ETag")
+	podcast.LastModified = resp.Header.Get("Last-Modified")
+	return feed, nil
+}
+
+// saveRefreshResult keeps why the podcast's refresh failed, and when to try
+// again, or clears them if it didn't fail. the feed's ETag and Last-Modified
+// are only kept if it didn't, so that a feed which failed is fetched again
+func (p *Podcasts) saveRefreshResult(podcast *db.Podcast, refreshErr error) error {
+	columns := map[string]interface{}{}
+	if refreshErr == nil {
+		podcast.RefreshFailures = 0
+		podcast.RefreshAfter = nil
+		podcast.Error = ""
+		columns["e_tag"] = podcast.ETag
+		columns["last_modified"] = podcast.LastModified
+	} else {
+		podcast.RefreshFailures++
+		after := time.Now().Add(refreshBackoff(podcast.RefreshFailures))
+		podcast.RefreshAfter = &after
+		podcast.Error = refreshErr.Error()
+	}
+	columns["refresh_failures"] = podcast.RefreshFailures
+	columns["refresh_after"] = podcast.RefreshAfter
+	columns["error"] = podcast.Error
+	err := p.db.
+		Model(podcast).
+		UpdateColumns(columns).
+		Error
+	if err != nil {
+		return fmt.Errorf("save refresh of podcast %d: %w", podcast.ID, err)
+	}
+	return nil
+}
+
+// refreshBackoff is how long to wait after failures failed refreshes in a row
+func refreshBackoff(failures int) time.Duration {
+	backoff := refreshBackoffMin
+	for i := 1; i < failures && backoff < refreshBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > refreshBackoffMax {
+		return refreshBackoffMax
+	}
+	return backoff
+}
+
+// refreshPodcastCover downloads the feed's image again if it has changed, or
+// if we don't have it yet
+func (p *Podcasts) refreshPodcastCover(podcast *db.Podcast, feed *gofeed.Feed) error {
+	if feed.Image == nil || feed.Image.URL == "" {
+		return nil
+	}
+	if feed.Image.URL == podcast.ImageURL && podcast.ImagePath != "" {
+		if _, err := os.Stat(path.Join(p.baseDir, podcast.ImagePath)); err == nil {
+			return nil
+		}
+	}
+	podcast.ImageURL = feed.Image.URL
+	return p.downloadPodcastCover(absPath(p.baseDir, podcast), podcast)
+}
+
 func (p *Podcasts) DownloadPodcastAll(podcastID int) error {
 	podcastEpisodes := []db.PodcastEpisode{}
 	err := p.db.
@@ -332,7 +704,21 @@ func (p *Podcasts) DownloadPodcastAll(podcastID int) error {
 	return nil
 }
 
+// partExt ends the name of an episode which is still downloading, or which
+// failed part way through and can be resumed
+const partExt = ".part"
+
+// DownloadEpisode downloads the episode in the background, for someone asking
+// by hand. what an earlier try left in its part file is resumed if the server
+// allows it. a failed download sets the episode's status to error, and can be
+// tried again
 func (p *Podcasts) DownloadEpisode(episodeID int) error {
+	return p.downloadEpisode(episodeID, false)
+}
+
+// downloadEpisode is DownloadEpisode, which auto says whether the podcast's
+// auto download setting asked for, see db.PodcastEpisode.AutoDownloaded
+func (p *Podcasts) downloadEpisode(episodeID int, auto bool) error {
 	podcastEpisode := db.PodcastEpisode{}
 	podcast := db.Podcast{}
 	err := p.db.
@@ -354,34 +740,129 @@ func (p *Podcasts) DownloadEpisode(episodeID int) error {
 		return nil
 	}
 	podcastEpisode.Status = db.PodcastEpisodeStatusDownloading
+	podcastEpisode.Error = ""
+	podcastEpisode.AutoDownloaded = auto
 	p.db.Save(&podcastEpisode)
+	resp, offset, err := p.requestEpisode(&podcast, &podcastEpisode)
+	if err != nil {
+		p.downloadFailed(&podcastEpisode, err)
+		return err
+	}
+	go func() {
+		err := p.doPodcastDownload(&podcastEpisode, resp, offset)
+		if err != nil {
+			log.Printf("error downloading podcast: %v", err)
+			p.downloadFailed(&podcastEpisode, err)
+			return
+		}
+		p.downloadDone(&podcastEpisode, nil)
+		if err := p.downloadChapters(&podcastEpisode); err != nil {
+			log.Printf("error downloading podcast chapters, skipping: %v", err)
+		}
+	}()
+	return nil
+}
+
+// RetryFailed downloads the podcast's episodes which failed again, and
+// returns how many there were
+func (p *Podcasts) RetryFailed(podcastID int) (int, error) {
+	var failed []*db.PodcastEpisode
+	err := p.db.
+		Where("podcast_id=? AND status=?", podcastID, db.PodcastEpisodeStatusError).
+		Find(&failed).
+		Error
+	if err != nil {
+		return 0, fmt.Errorf("find failed episodes: %w", err)
+	}
+	errs := &multierr.Err{}
+	for _, episode := range failed {
+		if err := p.downloadEpisode(episode.ID, episode.AutoDownloaded); err != nil {
+			errs.Add(fmt.Errorf("retry episode %d: %w", episode.ID, err))
+		}
+	}
+	if errs.Len() > 0 {
+		return len(failed), errs
+	}
+	return len(failed), nil
+}
+
+// downloadFailed keeps the error on the episode, for clients to show
+func (p *Podcasts) downloadFailed(podcastEpisode *db.PodcastEpisode, err error) {
+	podcastEpisode.Status = db.PodcastEpisodeStatusError
+	podcastEpisode.Error = err.Error()
+	if err := p.db.Save(podcastEpisode).Error; err != nil {
+		log.Printf("error saving podcast episode error: %v", err)
+	}
+	p.downloadDone(podcastEpisode, err)
+}
+
+// requestEpisode requests the episode's audio, from offset on if there's a
+// part file to resume. the episode is given a file name the first time
+func (p *Podcasts) requestEpisode(podcast *db.Podcast, podcastEpisode *db.PodcastEpisode) (*http.Response, int64, error) {
+	var offset int64
+	if podcastEpisode.Path != "" {
+		if stat, err := os.Stat(path.Join(p.baseDir, podcastEpisode.Path+partExt)); err == nil {
+			offset = stat.Size()
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, podcastEpisode.AudioURL, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("create podcast audio request: %w", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
 	// nolint: bodyclose
-	resp, err := http.Get(podcastEpisode.AudioURL)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("fetch podcast audio: %w", err)
+		return nil, 0, fmt.Errorf("fetch podcast audio: %w", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 && contentRangeStart(resp.Header.Get("Content-Range")) == offset:
+	case resp.StatusCode == http.StatusOK:
+		// the server doesn't do ranges, so start again
+		offset = 0
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the part file is no good, the audio might have changed
+		resp.Body.Close()
+		if err := os.Remove(path.Join(p.baseDir, podcastEpisode.Path+partExt)); err != nil {
+			return nil, 0, fmt.Errorf("remove part file: %w", err)
+		}
+		return p.requestEpisode(podcast, podcastEpisode)
+	default:
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("fetch podcast audio: status %s", resp.Status)
+	}
+	if podcastEpisode.Path != "" {
+		return resp, offset, nil
 	}
 	filename, ok := getContentDispositionFilename(resp.Header.Get("content-disposition"))
 	if !ok {
 		audioURL, err := url.Parse(podcastEpisode.AudioURL)
 		if err != nil {
-			return fmt.Errorf("parse podcast audio url: %w", err)
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("parse podcast audio url: %w", err)
 		}
 		filename = path.Base(audioURL.Path)
 	}
-	filename = p.findUniqueEpisodeName(&podcast, &podcastEpisode, filename)
-	audioFile, err := os.Create(path.Join(absPath(p.baseDir, &podcast), filename))
-	if err != nil {
-		return fmt.Errorf("create audio file: %w", err)
-	}
+	filename = p.findUniqueEpisodeName(podcast, podcastEpisode, filename)
 	podcastEpisode.Filename = filename
 	podcastEpisode.Path = path.Join(pathSafe(podcast.Title), filename)
-	p.db.Save(&podcastEpisode)
-	go func() {
-		if err := p.doPodcastDownload(&podcastEpisode, audioFile, resp.Body); err != nil {
-			log.Printf("error downloading podcast: %v", err)
-		}
-	}()
-	return nil
+	if err := p.db.Save(podcastEpisode).Error; err != nil {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("save podcast episode path: %w", err)
+	}
+	return resp, offset, nil
+}
+
+// contentRangeStart is the first byte of a Content-Range like
+// "bytes 100-199/200", or -1
+func contentRangeStart(header string) int64 {
+	var start, end int64
+	if _, err := fmt.Sscanf(header, "bytes %d-%d", &start, &end); err != nil {
+		return -1
+	}
+	return start
 }
 
 func (p *Podcasts) findUniqueEpisodeName(podcast *db.Podcast, podcastEpisode *db.PodcastEpisode, filename string) string {
@@ -425,45 +906,94 @@ func (p *Podcasts) downloadPodcastCover(podPath string, podcast *db.Podcast) err
 		return fmt.Errorf("fetch image url: %w", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch image url: status %s", resp.Status)
+	}
 	if ext == "" {
 		contentHeader := resp.Header.Get("content-disposition")
 		filename, _ := getContentDispositionFilename(contentHeader)
 		ext = path.Ext(filename)
 	}
-	coverPath := path.Join(podPath, "cover"+ext)
-	coverFile, err := os.Create(coverPath)
+	// write somewhere else first so that a failed download doesn't replace
+	// the cover we have. the new file's modification time means getCoverArt
+	// resizes it again
+	coverFile, err := os.CreateTemp(podPath, ".cover-*")
 	if err != nil {
 		return fmt.Errorf("creating podcast cover: %w", err)
 	}
-	defer coverFile.Close()
+	defer os.Remove(coverFile.Name())
 	if _, err := io.Copy(coverFile, resp.Body); err != nil {
+		coverFile.Close()
 		return fmt.Errorf("writing podcast cover: %w", err)
 	}
+	if err := coverFile.Close(); err != nil {
+		return fmt.Errorf("writing podcast cover: %w", err)
+	}
+	if err := os.Rename(coverFile.Name(), path.Join(podPath, "cover"+ext)); err != nil {
+		return fmt.Errorf("moving podcast cover: %w", err)
+	}
+	prevImagePath := podcast.ImagePath
 	podcast.ImagePath = path.Join(pathSafe(podcast.Title), fmt.Sprintf("cover%s", ext))
+	if prevImagePath != "" && prevImagePath != podcast.ImagePath {
+		// the feed's image changed format
+		_ = os.Remove(path.Join(p.baseDir, prevImagePath))
+	}
 	if err := p.db.Save(podcast).Error; err != nil {
 		return fmt.Errorf("save podcast: %w", err)
 	}
 	return nil
 }
 
-func (p *Podcasts) doPodcastDownload(podcastEpisode *db.PodcastEpisode, file *os.File, src io.Reader) error {
-	if _, err := io.Copy(file, src); err != nil {
+// doPodcastDownload writes the response to the episode's part file, from
+// offset on. only once the size is right is it moved to the episode's path,
+// and the episode completed
+func (p *Podcasts) doPodcastDownload(podcastEpisode *db.PodcastEpisode, resp *http.Response, offset int64) error {
+	defer resp.Body.Close()
+	podcastPath := path.Join(p.baseDir, podcastEpisode.Path)
+	partPath := podcastPath + partExt
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("open part file: %w", err)
+	}
+	written, err := io.Copy(file, resp.Body)
+	if err != nil {
+		file.Close()
 		return fmt.Errorf("writing podcast episode: %w", err)
 	}
-	defer file.Close()
-	stat, _ := file.Stat()
-	podcastPath := path.Join(p.baseDir, podcastEpisode.Path)
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close part file: %w", err)
+	}
+	// the enclosure's length is only a fallback, feeds often get it wrong
+	size := offset + written
+	var expected int64
+	switch {
+	case resp.ContentLength >= 0:
+		expected = offset + resp.ContentLength
+	case podcastEpisode.Size > 0:
+		expected = int64(podcastEpisode.Size)
+	}
+	if expected > 0 && size != expected {
+		if size > expected {
+			_ = os.Remove(partPath)
+		}
+		return fmt.Errorf("downloaded %d bytes, expected %d", size, expected)
+	}
+	if err := os.Rename(partPath, podcastPath); err != nil {
+		return fmt.Errorf("move part file: %w", err)
+	}
 	podcastTags, err := p.tagger.Read(podcastPath)
 	if err != nil {
-		log.Printf("error parsing podcast audio: %e", err)
-		podcastEpisode.Status = db.PodcastEpisodeStatusError
-		p.db.Save(podcastEpisode)
-		return nil
+		return fmt.Errorf("parsing podcast audio: %w", err)
 	}
 	podcastEpisode.Bitrate = podcastTags.Bitrate()
 	podcastEpisode.Status = db.PodcastEpisodeStatusCompleted
+	podcastEpisode.Error = ""
 	podcastEpisode.Length = podcastTags.Length()
-	podcastEpisode.Size = int(stat.Size())
+	podcastEpisode.Size = int(size)
 	return p.db.Save(podcastEpisode).Error
 }
 
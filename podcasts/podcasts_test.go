@@ -1,11 +1,24 @@
 package podcasts
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/matryer/is"
 	"github.com/mmcdole/gofeed"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/scanner/tags"
 )
 
 func TestGetMoreRecentEpisodes(t *testing.T) {
@@ -27,3 +40,708 @@ func TestGetMoreRecentEpisodes(t *testing.T) {
 		t.Errorf("expected 2 entries, got %d", len(entries))
 	}
 }
+
+func TestRefreshPodcastCover(t *testing.T) {
+	image := "first"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, image)
+	}))
+	defer server.Close()
+
+	dbc, err := db.NewMock()
+	if err != nil {
+		t.Fatalf("create db: %v", err)
+	}
+	defer dbc.Close()
+	if err := dbc.Migrate(db.MigrationContext{}); err != nil {
+		t.Fatalf("migrate db: %v", err)
+	}
+	p := New(dbc, t.TempDir(), nil)
+	podcast := &db.Podcast{Title: "show"}
+	if err := os.Mkdir(absPath(p.baseDir, podcast), 0755); err != nil {
+		t.Fatalf("create podcast dir: %v", err)
+	}
+
+	refresh := func(imageURL string) string {
+		t.Helper()
+		feed := &gofeed.Feed{Image: &gofeed.Image{URL: imageURL}}
+		if err := p.refreshPodcastCover(podcast, feed); err != nil {
+			t.Fatalf("refresh cover: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(p.baseDir, podcast.ImagePath))
+		if err != nil {
+			t.Fatalf("read cover: %v", err)
+		}
+		return string(data)
+	}
+
+	if got := refresh(server.URL + "/a.jpg"); got != "first" {
+		t.Errorf("expected first cover, got %q", got)
+	}
+	// same url, not downloaded again
+	image = "second"
+	if got := refresh(server.URL + "/a.jpg"); got != "first" {
+		t.Errorf("expected first cover to be kept, got %q", got)
+	}
+	// changed url, downloaded again, and the old format is removed
+	if got := refresh(server.URL + "/b.png"); got != "second" {
+		t.Errorf("expected second cover, got %q", got)
+	}
+	if podcast.ImagePath != filepath.Join("show", "cover.png") {
+		t.Errorf("unexpected image path %q", podcast.ImagePath)
+	}
+	if _, err := os.Stat(filepath.Join(p.baseDir, "show", "cover.jpg")); !os.IsNotExist(err) {
+		t.Errorf("expected old cover to be removed, got %v", err)
+	}
+}
+
+func TestSanitizeDescription(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		in  string
+		exp string
+	}{
+		{"plain notes", "plain notes"},
+		{"<p>a <b>bold</b> <a href=\"https://example.com\" onclick=\"x()\">link</a></p>", `<p>a <b>bold</b> <a href="https://example.com">link</a></p>`},
+		{`<a href="javascript:alert(1)">bad</a>`, "<a>bad</a>"},
+		{"before<script>alert(1)</script><style>p {}</style> after", "before after"},
+		{`<div class="x"><img src="x.jpg" onerror="x()">line<br>next</div>`, "line<br/>next"},
+		{"1 &lt; 2 &amp; 3", "1 &lt; 2 &amp; 3"},
+	}
+	for _, tc := range tcs {
+		if got := sanitizeDescription(tc.in); got != tc.exp {
+			t.Errorf("sanitize %q: got %q, want %q", tc.in, got, tc.exp)
+		}
+	}
+}
+
+const itemFeed = `<?xml version="1.0"?>
+<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd" xmlns:podcast="https://podcastindex.org/namespace/1.0">
+<channel>
+<title>show</title>
+<item>
+	<title>numbered</title>
+	<description><![CDATA[<p>notes<script>x()</script></p>]]></description>
+	<enclosure url="https://example.com/a.mp3" length="100" type="audio/mpeg"/>
+	<itunes:duration>1:02:03</itunes:duration>
+	<itunes:episode>12</itunes:episode>
+	<itunes:season>3</itunes:season>
+	<podcast:chapters url="https://example.com/a.json" type="application/json+chapters"/>
+</item>
+<item>
+	<title>plain</title>
+	<enclosure url="https://example.com/b.mp3" length="100" type="audio/mpeg"/>
+</item>
+</channel>
+</rss>`
+
+func TestAddEpisodeMetadata(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	feed, err := gofeed.NewParser().ParseString(itemFeed)
+	is.NoErr(err)
+	is.Equal(len(feed.Items), 2)
+
+	dbc, err := db.NewMock()
+	is.NoErr(err)
+	defer dbc.Close()
+	is.NoErr(dbc.Migrate(db.MigrationContext{}))
+	p := New(dbc, t.TempDir(), nil)
+	podcast := &db.Podcast{Title: "show"}
+	is.NoErr(dbc.Save(podcast).Error)
+
+	numbered, err := p.AddEpisode(podcast.ID, feed.Items[0])
+	is.NoErr(err)
+	is.Equal(numbered.Description, "<p>notes</p>")
+	is.Equal(numbered.Length, 3723)
+	is.Equal(numbered.EpisodeNumber, 12)
+	is.Equal(numbered.SeasonNumber, 3)
+	is.Equal(numbered.ChaptersURL, "https://example.com/a.json")
+
+	// feeds without the extra fields work as before
+	plain, err := p.AddEpisode(podcast.ID, feed.Items[1])
+	is.NoErr(err)
+	is.Equal(plain.Description, "")
+	is.Equal(plain.Length, 0)
+	is.Equal(plain.EpisodeNumber, 0)
+	is.Equal(plain.ChaptersURL, "")
+}
+
+func TestDownloadChapters(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	chapters := map[string]string{
+		"/good.json": `{"version": "1.2.0", "chapters": [
+			{"startTime": 90.5, "title": "second", "url": "https://example.com"},
+			{"startTime": 0, "title": "first", "img": "https://example.com/a.jpg"},
+			{"startTime": 30, "title": "just art", "toc": false}
+		]}`,
+		"/bad.json": `{"version": "1.2.0", "chapters": [{"startTime": "`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, chapters[r.URL.Path])
+	}))
+	defer server.Close()
+
+	dbc, err := db.NewMock()
+	is.NoErr(err)
+	defer dbc.Close()
+	is.NoErr(dbc.Migrate(db.MigrationContext{}))
+	p := New(dbc, t.TempDir(), nil)
+	podcast := &db.Podcast{Title: "show"}
+	is.NoErr(dbc.Save(podcast).Error)
+	episode := &db.PodcastEpisode{PodcastID: podcast.ID, ChaptersURL: server.URL + "/good.json"}
+	is.NoErr(dbc.Save(episode).Error)
+
+	is.NoErr(p.downloadChapters(episode))
+	got, err := p.GetPodcastEpisodeChapters(episode.ID)
+	is.NoErr(err)
+	is.Equal(len(got), 2)
+	is.Equal(got[0].Title, "first")
+	is.Equal(got[0].ImageURL, "https://example.com/a.jpg")
+	is.Equal(got[1].Title, "second")
+	is.Equal(got[1].StartTime, 90.5)
+
+	// the chapters we have are kept when the new ones are malformed
+	episode.ChaptersURL = server.URL + "/bad.json"
+	err = p.downloadChapters(episode)
+	is.True(err != nil && strings.Contains(err.Error(), "decode chapters"))
+	got, err = p.GetPodcastEpisodeChapters(episode.ID)
+	is.NoErr(err)
+	is.Equal(len(got), 2)
+
+	_, err = p.GetPodcastEpisodeChapters(episode.ID + 1)
+	is.True(err != nil)
+
+	// and a server which never answers is given up on
+	hung := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer slow.Close()
+	defer close(hung)
+	p.client.Timeout = 50 * time.Millisecond
+	episode.ChaptersURL = slow.URL
+	err = p.downloadChapters(episode)
+	is.True(err != nil && strings.Contains(err.Error(), "fetch chapters"))
+}
+
+const nestedOPML = `<?xml version="1.0" encoding="ISO-8859-1"?>
+<opml version="1.0">
+<head><title>subscriptions</title></head>
+<body>
+	<outline text="news">
+		<outline type="rss" text="daily" xmlUrl="https://example.com/daily.xml"/>
+		<outline text="tech">
+			<outline type="rss" text="gadgets" title="gadget show" xmlUrl=" https://example.com/gadgets.xml "/>
+		</outline>
+	</outline>
+	<outline type="rss" text="daily again" xmlUrl="https://example.com/daily.xml"/>
+	<outline text="just a heading"/>
+	<outline type="rss" xmlUrl="https://example.com/untitled.xml"/>
+</body>
+</opml>`
+
+func TestReadOPML(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	feeds, err := ReadOPML(strings.NewReader(nestedOPML))
+	is.NoErr(err)
+	is.Equal(feeds, []OPMLFeed{
+		{Title: "daily", URL: "https://example.com/daily.xml"},
+		{Title: "gadget show", URL: "https://example.com/gadgets.xml"},
+		{Title: "", URL: "https://example.com/untitled.xml"},
+	})
+
+	_, err = ReadOPML(strings.NewReader("<opml><body><outline"))
+	is.True(err != nil)
+}
+
+func TestWriteOPML(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	var buff strings.Builder
+	is.NoErr(WriteOPML(&buff, []*db.Podcast{
+		{Title: "a & b", URL: "https://example.com/a.xml?x=1&y=2"},
+		{Title: "c", URL: "https://example.com/c.xml"},
+	}))
+	feeds, err := ReadOPML(strings.NewReader(buff.String()))
+	is.NoErr(err)
+	is.Equal(feeds, []OPMLFeed{
+		{Title: "a & b", URL: "https://example.com/a.xml?x=1&y=2"},
+		{Title: "c", URL: "https://example.com/c.xml"},
+	})
+}
+
+func TestImport(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/good.xml":
+			fmt.Fprint(w, itemFeed)
+		case "/hung.xml":
+			<-hung
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	defer close(hung)
+
+	dbc, err := db.NewMock()
+	is.NoErr(err)
+	defer dbc.Close()
+	is.NoErr(dbc.Migrate(db.MigrationContext{}))
+	p := New(dbc, t.TempDir(), nil)
+	p.client.Timeout = 100 * time.Millisecond
+	is.NoErr(dbc.Save(&db.Podcast{Title: "old", URL: server.URL + "/old.xml"}).Error)
+
+	skipped, err := p.Import([]OPMLFeed{
+		{Title: "old", URL: server.URL + "/old.xml"},
+		{Title: "good", URL: server.URL + "/good.xml"},
+		{Title: "missing", URL: server.URL + "/missing.xml"},
+		{Title: "hung", URL: server.URL + "/hung.xml"},
+	})
+	is.NoErr(err)
+	is.Equal(skipped, 1) // the podcast we already have
+
+	deadline := time.Now().Add(10 * time.Second)
+	status := p.ImportStatus()
+	for status.Running && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		status = p.ImportStatus()
+	}
+	is.True(!status.Running)
+	is.Equal(status.Total, 3)
+	is.Equal(status.Done, 3)
+	is.Equal(len(status.Errors), 2)
+	is.True(strings.HasPrefix(status.Errors[0], "missing: ")) // errors say which feed
+	is.True(strings.HasPrefix(status.Errors[1], "hung: "))    // and the ones which never answer are given up on
+
+	var podcasts []*db.Podcast
+	is.NoErr(dbc.Order("id").Find(&podcasts).Error)
+	is.Equal(len(podcasts), 2)
+	is.Equal(podcasts[1].Title, "show")
+	is.Equal(podcasts[1].URL, server.URL+"/good.xml")
+	var episodes int
+	is.NoErr(dbc.Model(db.PodcastEpisode{}).Where("podcast_id=?", podcasts[1].ID).Count(&episodes).Error)
+	is.Equal(episodes, 2)
+}
+
+// episodeTags are the tags of every downloaded episode
+type episodeTags struct{ tags.Parser }
+
+func (episodeTags) Length() int  { return 60 }
+func (episodeTags) Bitrate() int { return 128 }
+
+type episodeTagReader struct{}
+
+func (episodeTagReader) Read(string) (tags.Parser, error) { return episodeTags{}, nil }
+
+// episodeServer serves a feed of the episodes, newest first, published a day
+// apart. the last is published on the same day in any feed, and each
+// episode's audio is its name, served with support for ranges
+func episodeServer(t *testing.T, names ...string) *httptest.Server {
+	t.Helper()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/feed.xml" {
+			name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".mp3")
+			http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader(name))
+			return
+		}
+		fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>show</title>`)
+		published := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+		for i, name := range names {
+			fmt.Fprintf(w, `<item><title>%s</title><pubDate>%s</pubDate><enclosure url="%s/%s.mp3" type="audio/mpeg"/></item>`,
+				name, published.Add(time.Duration(len(names)-i)*24*time.Hour).Format(time.RFC1123Z), server.URL, name)
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// waitForDownloads waits until none of the podcast's episodes are downloading
+func waitForDownloads(t *testing.T, dbc *db.DB, podcastID int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var downloading int
+		if err := dbc.Model(db.PodcastEpisode{}).Where("podcast_id=? AND status=?", podcastID, db.PodcastEpisodeStatusDownloading).Count(&downloading).Error; err != nil {
+			t.Fatalf("count downloading: %v", err)
+		}
+		if downloading == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("episodes still downloading")
+}
+
+func TestAutoDownload(t *testing.T) {
+	t.Parallel()
+
+	tcases := []struct {
+		setting    db.PodcastAutoDownload
+		keep       int
+		downloaded []string
+	}{
+		{db.PodcastAutoDownloadNone, 0, []string{"old"}},
+		{db.PodcastAutoDownloadAll, 0, []string{"new-3", "new-2", "new-1", "old"}},
+		// the one downloaded by hand is kept
+		{db.PodcastAutoDownloadLatest, 2, []string{"new-3", "new-2", "old"}},
+		{db.PodcastAutoDownloadLatest, 3, []string{"new-3", "new-2", "new-1", "old"}},
+		{db.PodcastAutoDownloadLatest, 5, []string{"new-3", "new-2", "new-1", "old"}},
+	}
+	for _, tc := range tcases {
+		tc := tc
+		t.Run(fmt.Sprintf("%s %d", tc.setting, tc.keep), func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			dbc, err := db.NewMock()
+			is.NoErr(err)
+			defer dbc.Close()
+			is.NoErr(dbc.Migrate(db.MigrationContext{}))
+			p := New(dbc, t.TempDir(), episodeTagReader{})
+
+			// a podcast with one episode, which was downloaded by hand
+			server := episodeServer(t, "old")
+			feed, err := gofeed.NewParser().ParseURL(server.URL + "/feed.xml")
+			is.NoErr(err)
+			podcast, err := p.AddNewPodcast(server.URL+"/feed.xml", feed)
+			is.NoErr(err)
+			is.NoErr(p.SetAutoDownload(podcast.ID, tc.setting, tc.keep))
+			is.NoErr(dbc.First(podcast, podcast.ID).Error)
+			var old db.PodcastEpisode
+			is.NoErr(dbc.Where("podcast_id=?", podcast.ID).First(&old).Error)
+			is.NoErr(p.DownloadEpisode(old.ID))
+			waitForDownloads(t, dbc, podcast.ID)
+
+			// then three more
+			server = episodeServer(t, "new-3", "new-2", "new-1", "old")
+			feed, err = gofeed.NewParser().ParseURL(server.URL + "/feed.xml")
+			is.NoErr(err)
+			is.NoErr(p.AddNewEpisodes(podcast, feed.Items))
+			waitForDownloads(t, dbc, podcast.ID)
+
+			var downloaded []*db.PodcastEpisode
+			is.NoErr(dbc.
+				Where("podcast_id=? AND status=?", podcast.ID, db.PodcastEpisodeStatusCompleted).
+				Order("publish_date DESC").
+				Find(&downloaded).
+				Error)
+			var titles []string
+			for _, episode := range downloaded {
+				titles = append(titles, episode.Title)
+				data, err := os.ReadFile(filepath.Join(p.baseDir, episode.Path))
+				is.NoErr(err)
+				is.Equal(string(data), episode.Title)
+			}
+			is.Equal(titles, tc.downloaded)
+
+			// deleted ones are gone from disk
+			entries, err := os.ReadDir(absPath(p.baseDir, podcast))
+			is.NoErr(err)
+			is.Equal(len(entries), len(tc.downloaded))
+		})
+	}
+}
+
+func TestRestartDownloads(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dbc, err := db.NewMock()
+	is.NoErr(err)
+	defer dbc.Close()
+	is.NoErr(dbc.Migrate(db.MigrationContext{}))
+	p := New(dbc, t.TempDir(), episodeTagReader{})
+
+	server := episodeServer(t, "episode")
+	feed, err := gofeed.NewParser().ParseURL(server.URL + "/feed.xml")
+	is.NoErr(err)
+	podcast, err := p.AddNewPodcast(server.URL+"/feed.xml", feed)
+	is.NoErr(err)
+
+	// gonic stopped part way through
+	var episode db.PodcastEpisode
+	is.NoErr(dbc.Where("podcast_id=?", podcast.ID).First(&episode).Error)
+	episode.Status = db.PodcastEpisodeStatusDownloading
+	episode.Filename = "episode.mp3"
+	episode.Path = filepath.Join(pathSafe(podcast.Title), episode.Filename)
+	is.NoErr(dbc.Save(&episode).Error)
+	is.NoErr(os.WriteFile(filepath.Join(p.baseDir, episode.Path+partExt), []byte("EPI"), 0o600))
+
+	is.NoErr(p.RestartDownloads())
+	waitForDownloads(t, dbc, podcast.ID)
+	is.NoErr(dbc.First(&episode, episode.ID).Error)
+	is.Equal(episode.Status, db.PodcastEpisodeStatusCompleted)
+	is.Equal(episode.Filename, "episode.mp3")
+	data, err := os.ReadFile(filepath.Join(p.baseDir, episode.Path))
+	is.NoErr(err)
+	is.Equal(string(data), "EPIsode") // resumed after what it had
+	_, err = os.Stat(filepath.Join(p.baseDir, episode.Path+partExt))
+	is.True(os.IsNotExist(err))
+}
+
+func TestDownloadEpisodeIntegrity(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dbc, err := db.NewMock()
+	is.NoErr(err)
+	defer dbc.Close()
+	is.NoErr(dbc.Migrate(db.MigrationContext{}))
+	p := New(dbc, t.TempDir(), episodeTagReader{})
+
+	const audio = "0123456789"
+	var flaky, chunked bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case flaky:
+			// the connection drops after half of it
+			w.Header().Set("Content-Length", strconv.Itoa(len(audio)))
+			fmt.Fprint(w, audio[:5])
+		case chunked:
+			// no Content-Length, and the enclosure's length is wrong
+			fmt.Fprint(w, audio[:8])
+			w.(http.Flusher).Flush()
+		default:
+			http.ServeContent(w, r, "a.mp3", time.Time{}, strings.NewReader(audio))
+		}
+	}))
+	defer server.Close()
+
+	podcast := &db.Podcast{Title: "show"}
+	is.NoErr(dbc.Save(podcast).Error)
+	is.NoErr(os.Mkdir(absPath(p.baseDir, podcast), 0o755))
+	publish := time.Now()
+	episode := &db.PodcastEpisode{PodcastID: podcast.ID, Title: "a", AudioURL: server.URL + "/a.mp3", PublishDate: &publish, Size: len(audio)}
+	is.NoErr(dbc.Save(episode).Error)
+
+	download := func() *db.PodcastEpisode {
+		t.Helper()
+		_ = p.DownloadEpisode(episode.ID)
+		waitForDownloads(t, dbc, podcast.ID)
+		var got db.PodcastEpisode
+		is.NoErr(dbc.First(&got, episode.ID).Error)
+		return &got
+	}
+
+	// a truncated download is an error, and nothing is at the episode's path
+	flaky = true
+	got := download()
+	is.Equal(got.Status, db.PodcastEpisodeStatusError)
+	is.True(got.Error != "")
+	_, err = os.Stat(filepath.Join(p.baseDir, got.Path))
+	is.True(os.IsNotExist(err))
+	part, err := os.ReadFile(filepath.Join(p.baseDir, got.Path+partExt))
+	is.NoErr(err)
+	is.Equal(string(part), audio[:5])
+
+	// the enclosure's length is checked when there's no Content-Length
+	flaky, chunked = false, true
+	got = download()
+	is.Equal(got.Status, db.PodcastEpisodeStatusError)
+	is.True(strings.Contains(got.Error, "expected 10"))
+
+	// and a retry finishes it
+	chunked = false
+	is.NoErr(os.WriteFile(filepath.Join(p.baseDir, got.Path+partExt), []byte(audio[:5]), 0o600))
+	got = download()
+	is.Equal(got.Status, db.PodcastEpisodeStatusCompleted)
+	is.Equal(got.Error, "")
+	is.Equal(got.Size, len(audio))
+	data, err := os.ReadFile(filepath.Join(p.baseDir, got.Path))
+	is.NoErr(err)
+	is.Equal(string(data), audio)
+}
+
+func TestGetSecondsFromString(t *testing.T) {
+	t.Parallel()
+	tcases := []struct {
+		in  string
+		exp int
+	}{
+		{"3723", 3723},
+		{"3723.6", 3723},
+		{" 45 ", 45},
+		{"62:03", 3723},
+		{"1:02:03", 3723},
+		{"01:02:03.500", 3723},
+		{"", 0},
+		{"abc", 0},
+		{"-5", 0},
+		{"1:2:3:4", 0},
+	}
+	for _, tc := range tcases {
+		if got := getSecondsFromString(tc.in); got != tc.exp {
+			t.Errorf("seconds of %q: got %d, want %d", tc.in, got, tc.exp)
+		}
+	}
+}
+
+const pscFeed = `<?xml version="1.0"?>
+<rss version="2.0" xmlns:psc="http://podlove.org/simple-chapters">
+<channel>
+<title>show</title>
+<item>
+	<title>chaptered</title>
+	<enclosure url="https://example.com/a.mp3" length="100" type="audio/mpeg"/>
+	<psc:chapters version="1.2">
+		<psc:chapter start="00:01:30.500" title="second" href="https://example.com"/>
+		<psc:chapter start="0" title="first" image="https://example.com/a.jpg"/>
+		<psc:chapter start="soon" title="broken"/>
+	</psc:chapters>
+</item>
+</channel>
+</rss>`
+
+func TestAddEpisodePSCChapters(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	feed, err := gofeed.NewParser().ParseString(pscFeed)
+	is.NoErr(err)
+
+	dbc, err := db.NewMock()
+	is.NoErr(err)
+	defer dbc.Close()
+	is.NoErr(dbc.Migrate(db.MigrationContext{}))
+	p := New(dbc, t.TempDir(), nil)
+	podcast := &db.Podcast{Title: "show"}
+	is.NoErr(dbc.Save(podcast).Error)
+
+	_, err = p.AddEpisode(podcast.ID, feed.Items[0])
+	is.NoErr(err)
+	episodes, err := p.GetPodcastEpisodes(podcast.ID)
+	is.NoErr(err)
+	is.Equal(len(episodes), 1)
+	chapters := episodes[0].Chapters
+	is.Equal(len(chapters), 2) // not the broken one
+	is.Equal(chapters[0].Title, "first")
+	is.Equal(chapters[0].ImageURL, "https://example.com/a.jpg")
+	is.Equal(chapters[1].Title, "second")
+	is.Equal(chapters[1].StartTime, 90.5)
+	is.Equal(chapters[1].URL, "https://example.com")
+}
+
+func TestRefreshPodcasts(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	var mu sync.Mutex
+	var failing bool
+	var fetched, notModified int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetched++
+		switch {
+		case failing:
+			http.Error(w, "down", http.StatusInternalServerError)
+		case r.Header.Get("If-None-Match") == `"v1"`:
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", `"v1"`)
+			fmt.Fprint(w, itemFeed)
+		}
+	}))
+	defer server.Close()
+	setFailing := func(f bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		failing = f
+	}
+	counts := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetched, notModified
+	}
+
+	dbc, err := db.NewMock()
+	is.NoErr(err)
+	defer dbc.Close()
+	is.NoErr(dbc.Migrate(db.MigrationContext{}))
+	p := New(dbc, t.TempDir(), nil)
+	p.refreshWait = 0
+	podcast := &db.Podcast{Title: "show", URL: server.URL}
+	is.NoErr(dbc.Save(podcast).Error)
+	reload := func() {
+		t.Helper()
+		is.NoErr(dbc.First(podcast, podcast.ID).Error)
+	}
+
+	// the first refresh keeps the etag, and the next one sends it
+	is.NoErr(p.RefreshDuePodcasts(context.Background()))
+	reload()
+	is.Equal(podcast.ETag, `"v1"`)
+	is.NoErr(p.RefreshDuePodcasts(context.Background()))
+	f, nm := counts()
+	is.Equal(f, 2)
+	is.Equal(nm, 1)
+
+	// a failure is kept, and the feed backs off
+	setFailing(true)
+	is.True(p.RefreshDuePodcasts(context.Background()) != nil)
+	reload()
+	is.Equal(podcast.RefreshFailures, 1)
+	is.True(strings.Contains(podcast.Error, "500"))
+	is.True(podcast.RefreshAfter != nil && podcast.RefreshAfter.After(time.Now().Add(refreshBackoffMin-time.Minute)))
+	is.NoErr(p.RefreshDuePodcasts(context.Background()))
+	f, _ = counts()
+	is.Equal(f, 3) // not fetched while backing off
+
+	// until it's refreshed by hand
+	is.True(p.RefreshPodcasts() != nil)
+	reload()
+	is.Equal(podcast.RefreshFailures, 1) // started again from none
+	setFailing(false)
+	is.NoErr(p.RefreshPodcasts())
+	reload()
+	is.Equal(podcast.RefreshFailures, 0)
+	is.Equal(podcast.Error, "")
+	is.True(podcast.RefreshAfter == nil)
+
+	// a podcast is only refreshed once at a time
+	is.True(p.startRefresh(podcast.ID))
+	is.NoErr(p.RefreshDuePodcasts(context.Background()))
+	f, _ = counts()
+	is.Equal(f, 5)
+	p.finishRefresh(podcast.ID)
+
+	// or at all once the refresher is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	is.NoErr(p.RefreshDuePodcasts(ctx))
+	f, _ = counts()
+	is.Equal(f, 5)
+
+	// refreshing by hand doesn't wait between feeds
+	is.NoErr(dbc.Save(&db.Podcast{Title: "other", URL: server.URL}).Error)
+	p.refreshWait = time.Hour
+	is.NoErr(p.RefreshPodcasts())
+	f, _ = counts()
+	is.Equal(f, 7)
+}
+
+func TestRefreshBackoff(t *testing.T) {
+	t.Parallel()
+	tcases := []struct {
+		failures int
+		exp      time.Duration
+	}{
+		{1, 30 * time.Minute},
+		{2, time.Hour},
+		{3, 2 * time.Hour},
+		{9, 128 * time.Hour},
+		{10, refreshBackoffMax},
+		{1000, refreshBackoffMax},
+	}
+	for _, tc := range tcases {
+		if got := refreshBackoff(tc.failures); got != tc.exp {
+			t.Errorf("backoff after %d failures: got %v, want %v", tc.failures, got, tc.exp)
+		}
+	}
+}
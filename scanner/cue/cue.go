@@ -0,0 +1,237 @@
+// Package cue reads cue sheets, and splits the audio files they reference into
+// tracks
+package cue
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// framesPerSecond is the number of frames in a second of a cue sheet's times,
+// as on a CD
+const framesPerSecond = 75
+
+// Encodings a cue sheet can be read as
+const (
+	EncodingUTF8    = "utf-8"
+	EncodingUTF16LE = "utf-16le"
+	EncodingUTF16BE = "utf-16be"
+	EncodingLatin1  = "latin-1"
+)
+
+var (
+	errNoFile  = errors.New("track before any file")
+	errNoTrack = errors.New("index before any track")
+	errNoIndex = errors.New("track has no index 01")
+)
+
+type Sheet struct {
+	Title     string
+	Performer string
+	Files     []*File
+	Tracks    []*Track
+	// Encoding is what the sheet was read as, one of the Encoding constants
+	Encoding string
+}
+
+type File struct {
+	Name string
+	Type string
+}
+
+type Track struct {
+	Number    int
+	Title     string
+	Performer string
+	ISRC      string
+	Indexes   []Index
+}
+
+// Index is a point in one of the sheet's files. index 00 is the start of the
+// track's pregap, and index 01 the start of the track itself
+type Index struct {
+	Number int
+	File   int
+	Offset time.Duration
+}
+
+// index returns the track's index with number n, if it has one
+func (t *Track) index(n int) (Index, bool) {
+	for _, index := range t.Indexes {
+		if index.Number == n {
+			return index, true
+		}
+	}
+	return Index{}, false
+}
+
+// Read parses a cue sheet. sheets with a byte order mark are read as utf-8 or
+// utf-16, and others as utf-8 if they're valid, or else latin-1
+func Read(r io.Reader) (*Sheet, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read sheet: %w", err)
+	}
+	text, encoding := decode(data)
+	sheet := &Sheet{Encoding: encoding}
+	var track *Track
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for n := 1; scanner.Scan(); n++ {
+		command, args := splitCommand(scanner.Text())
+		if err := sheet.parseLine(&track, command, args); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan sheet: %w", err)
+	}
+	for _, track := range sheet.Tracks {
+		if _, ok := track.index(1); !ok {
+			return nil, fmt.Errorf("track %d: %w", track.Number, errNoIndex)
+		}
+	}
+	return sheet, nil
+}
+
+func (s *Sheet) parseLine(track **Track, command, args string) error {
+	switch command {
+	case "TITLE":
+		if *track != nil {
+			(*track).Title = unquote(args)
+		} else {
+			s.Title = unquote(args)
+		}
+	case "PERFORMER":
+		if *track != nil {
+			(*track).Performer = unquote(args)
+		} else {
+			s.Performer = unquote(args)
+		}
+	case "FILE":
+		name, typ := splitQuoted(args)
+		s.Files = append(s.Files, &File{Name: name, Type: typ})
+	case "TRACK":
+		if len(s.Files) == 0 {
+			return errNoFile
+		}
+		number, err := strconv.Atoi(strings.Fields(args + " ")[0])
+		if err != nil {
+			return fmt.Errorf("parse track number: %w", err)
+		}
+		*track = &Track{Number: number}
+		s.Tracks = append(s.Tracks, *track)
+	case "ISRC":
+		if *track != nil {
+			(*track).ISRC = unquote(args)
+		}
+	case "INDEX":
+		if *track == nil {
+			return errNoTrack
+		}
+		fields := strings.Fields(args)
+		if len(fields) != 2 {
+			return fmt.Errorf("bad index %q", args)
+		}
+		number, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return fmt.Errorf("parse index number: %w", err)
+		}
+		offset, err := parseTime(fields[1])
+		if err != nil {
+			return err
+		}
+		// an index is in the file named before it, which for a pregap that
+		// ends one file can be before the next file's line
+		(*track).Indexes = append((*track).Indexes, Index{Number: number, File: len(s.Files) - 1, Offset: offset})
+	}
+	// the others, like REM, FLAGS, and PREGAP, which is silence that isn't in
+	// any file, aren't needed to split the files
+	return nil
+}
+
+// decode returns data as a string, and the encoding it was in
+func decode(data []byte) (string, string) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		return string(data[3:]), EncodingUTF8
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		return decodeUTF16(data[2:], func(b []byte) uint16 { return uint16(b[0]) | uint16(b[1])<<8 }), EncodingUTF16LE
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		return decodeUTF16(data[2:], func(b []byte) uint16 { return uint16(b[0])<<8 | uint16(b[1]) }), EncodingUTF16BE
+	case utf8.Valid(data):
+		return string(data), EncodingUTF8
+	}
+	// each byte of latin-1 is the code point of the same number
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes), EncodingLatin1
+}
+
+func decodeUTF16(data []byte, unit func([]byte) uint16) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, unit(data[i:i+2]))
+	}
+	return string(utf16.Decode(units))
+}
+
+func splitCommand(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return strings.ToUpper(line), ""
+	}
+	return strings.ToUpper(line[:i]), strings.TrimSpace(line[i+1:])
+}
+
+// splitQuoted splits args into its first value, quoted or not, and the rest
+func splitQuoted(args string) (string, string) {
+	if strings.HasPrefix(args, `"`) {
+		if end := strings.LastIndex(args, `"`); end > 0 {
+			return args[1:end], strings.TrimSpace(args[end+1:])
+		}
+	}
+	i := strings.LastIndexAny(args, " \t")
+	if i < 0 {
+		return args, ""
+	}
+	return args[:i], strings.TrimSpace(args[i+1:])
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// parseTime parses a time of mm:ss:ff, where ff is frames
+func parseTime(value string) (time.Duration, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("bad time %q", value)
+	}
+	var nums [3]int
+	for i, part := range parts {
+		num, err := strconv.Atoi(part)
+		if err != nil || num < 0 {
+			return 0, fmt.Errorf("bad time %q", value)
+		}
+		nums[i] = num
+	}
+	if nums[1] >= 60 || nums[2] >= framesPerSecond {
+		return 0, fmt.Errorf("bad time %q", value)
+	}
+	frames := (nums[0]*60+nums[1])*framesPerSecond + nums[2]
+	return time.Duration(frames) * time.Second / framesPerSecond, nil
+}
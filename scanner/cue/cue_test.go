@@ -0,0 +1,223 @@
+package cue
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func readSheet(t *testing.T, path string) *Sheet {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open sheet: %v", err)
+	}
+	defer f.Close()
+	sheet, err := Read(f)
+	if err != nil {
+		t.Fatalf("read sheet: %v", err)
+	}
+	return sheet
+}
+
+// span is a Span by its track number, where 0 is the hidden track
+type span struct {
+	file, track int
+	start, end  time.Duration
+}
+
+func spansOf(spans []Span) []span {
+	ret := make([]span, 0, len(spans))
+	for _, s := range spans {
+		number := 0
+		if s.Track != nil {
+			number = s.Track.Number
+		}
+		ret = append(ret, span{s.File, number, s.Start, s.End})
+	}
+	return ret
+}
+
+// spanLengths adds up the spans of each file
+func spanLengths(spans []Span, files int) []time.Duration {
+	lengths := make([]time.Duration, files)
+	for _, s := range spans {
+		lengths[s.File] += s.End - s.Start
+	}
+	return lengths
+}
+
+func frames(mins, secs, n int) time.Duration {
+	return time.Duration((mins*60+secs)*framesPerSecond+n) * time.Second / framesPerSecond
+}
+
+func TestRead(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	sheet := readSheet(t, "testdata/hidden.cue")
+	is.Equal(sheet.Encoding, EncodingUTF8)
+	is.Equal(sheet.Title, "Hidden Things")
+	is.Equal(sheet.Performer, "Some Band")
+	is.Equal(len(sheet.Files), 1)
+	is.Equal(*sheet.Files[0], File{Name: "hidden.flac", Type: "WAVE"})
+	is.Equal(len(sheet.Tracks), 3)
+	is.Equal(sheet.Tracks[1].Performer, "Some Band feat. Someone")
+	is.Equal(sheet.Tracks[2].Title, "Third Without Quotes")
+	is.Equal(sheet.Tracks[2].ISRC, "GBAYE9400001")
+	is.Equal(sheet.Tracks[1].Indexes, []Index{
+		{Number: 0, Offset: frames(3, 0, 0)},
+		{Number: 1, Offset: frames(3, 2, 37)},
+	})
+}
+
+func TestReadErrors(t *testing.T) {
+	t.Parallel()
+	for _, sheet := range []string{
+		"TRACK 01 AUDIO\nINDEX 01 00:00:00",
+		"FILE a.flac WAVE\nINDEX 01 00:00:00",
+		"FILE a.flac WAVE\nTRACK 01 AUDIO\nINDEX 01 00:60:00",
+		"FILE a.flac WAVE\nTRACK 01 AUDIO\nINDEX 01 00:00:75",
+		"FILE a.flac WAVE\nTRACK 01 AUDIO\nINDEX 00 00:00:00",
+	} {
+		if _, err := Read(bytes.NewReader([]byte(sheet))); err == nil {
+			t.Errorf("expected an error for %q", sheet)
+		}
+	}
+}
+
+func TestSplitHiddenTrack(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	sheet := readSheet(t, "testdata/hidden.cue")
+	length := frames(7, 0, 0) + 123*time.Microsecond
+	lengths := []time.Duration{length}
+
+	// by default, the hidden track is the start of track 1, and the gaps are
+	// the end of the tracks before them
+	spans, err := sheet.Split(lengths, Options{})
+	is.NoErr(err)
+	is.Equal(spansOf(spans), []span{
+		{0, 1, 0, frames(3, 2, 37)},
+		{0, 2, frames(3, 2, 37), frames(5, 0, 0)},
+		{0, 3, frames(5, 0, 0), length},
+	})
+	is.Equal(spanLengths(spans, 1), lengths)
+
+	spans, err = sheet.Split(lengths, Options{HiddenTrack: true})
+	is.NoErr(err)
+	is.Equal(spansOf(spans), []span{
+		{0, 0, 0, frames(0, 30, 0)},
+		{0, 1, frames(0, 30, 0), frames(3, 2, 37)},
+		{0, 2, frames(3, 2, 37), frames(5, 0, 0)},
+		{0, 3, frames(5, 0, 0), length},
+	})
+	is.Equal(spanLengths(spans, 1), lengths)
+
+	spans, err = sheet.Split(lengths, Options{HiddenTrack: true, Gaps: GapPrepend})
+	is.NoErr(err)
+	is.Equal(spansOf(spans), []span{
+		{0, 0, 0, frames(0, 30, 0)},
+		{0, 1, frames(0, 30, 0), frames(3, 0, 0)},
+		{0, 2, frames(3, 0, 0), frames(5, 0, 0)},
+		{0, 3, frames(5, 0, 0), length},
+	})
+	is.Equal(spanLengths(spans, 1), lengths)
+}
+
+func TestSplitMultipleFiles(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	sheet := readSheet(t, "testdata/multi_file.cue")
+	is.Equal(len(sheet.Files), 3)
+	is.Equal(sheet.Files[1].Name, "02 - second.flac")
+	// track 2's pregap is at the end of the first file
+	is.Equal(sheet.Tracks[1].Indexes, []Index{
+		{Number: 0, File: 0, Offset: frames(4, 0, 0)},
+		{Number: 1, File: 1, Offset: 0},
+	})
+
+	lengths := []time.Duration{frames(4, 10, 0), frames(6, 0, 0), frames(2, 0, 0)}
+	spans, err := sheet.Split(lengths, Options{})
+	is.NoErr(err)
+	is.Equal(spansOf(spans), []span{
+		{0, 1, 0, lengths[0]},
+		{1, 2, 0, frames(3, 1, 0)},
+		{1, 3, frames(3, 1, 0), lengths[1]},
+		{2, 3, 0, frames(0, 2, 0)}, // track 3 carries on into the next file
+		{2, 4, frames(0, 2, 0), lengths[2]},
+	})
+	is.Equal(spanLengths(spans, 3), lengths)
+
+	spans, err = sheet.Split(lengths, Options{Gaps: GapPrepend})
+	is.NoErr(err)
+	is.Equal(spansOf(spans), []span{
+		{0, 1, 0, lengths[0]}, // track 2's pregap can't be moved to its file
+		{1, 2, 0, frames(3, 0, 0)},
+		{1, 3, frames(3, 0, 0), lengths[1]},
+		{2, 4, 0, lengths[2]},
+	})
+	is.Equal(spanLengths(spans, 3), lengths)
+
+	_, err = sheet.Split(lengths[:2], Options{})
+	is.True(err != nil) // each file's length is needed
+	_, err = sheet.Split([]time.Duration{lengths[0], frames(3, 0, 0), lengths[2]}, Options{})
+	is.True(err != nil) // track 3 is past the end of its file
+}
+
+func TestSplitPregapFile(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	sheet, err := Read(bytes.NewReader([]byte(
+		"FILE pregap.flac WAVE\nTRACK 01 AUDIO\nINDEX 00 00:00:00\nFILE one.flac WAVE\nINDEX 01 00:00:00\n",
+	)))
+	is.NoErr(err)
+	lengths := []time.Duration{frames(0, 20, 0), frames(3, 0, 0)}
+	spans, err := sheet.Split(lengths, Options{})
+	is.NoErr(err)
+	is.Equal(spansOf(spans), []span{
+		{0, 1, 0, lengths[0]},
+		{1, 1, 0, lengths[1]},
+	})
+}
+
+func TestReadEncodings(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	sheet := readSheet(t, "testdata/latin1.cue")
+	is.Equal(sheet.Encoding, EncodingLatin1)
+	is.Equal(sheet.Performer, "Beyoncé")
+	is.Equal(sheet.Title, "Café del Mar")
+	is.Equal(sheet.Files[0].Name, "café.flac")
+	is.Equal(sheet.Tracks[0].Title, "Déjà vu")
+
+	const text = "TITLE \"Café\"\nFILE a.flac WAVE\nTRACK 01 AUDIO\nINDEX 01 00:00:00\n"
+	utf16 := func(bom []byte, le bool) []byte {
+		b := append([]byte(nil), bom...)
+		for _, r := range text {
+			if le {
+				b = append(b, byte(r), byte(r>>8))
+			} else {
+				b = append(b, byte(r>>8), byte(r))
+			}
+		}
+		return b
+	}
+	for _, tc := range []struct {
+		data     []byte
+		encoding string
+	}{
+		{[]byte(text), EncodingUTF8},
+		{append([]byte{0xef, 0xbb, 0xbf}, text...), EncodingUTF8},
+		{utf16([]byte{0xff, 0xfe}, true), EncodingUTF16LE},
+		{utf16([]byte{0xfe, 0xff}, false), EncodingUTF16BE},
+	} {
+		sheet, err := Read(bytes.NewReader(tc.data))
+		is.NoErr(err)
+		is.Equal(sheet.Encoding, tc.encoding)
+		is.Equal(sheet.Title, "Café")
+	}
+}
@@ -0,0 +1,115 @@
+package cue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errLengths = errors.New("need the length of each file")
+
+// GapMode is which track a pregap, the audio between a track's index 00 and
+// its index 01, is played as part of
+type GapMode int
+
+const (
+	// GapAppend plays the pregap at the end of the track before it, which is
+	// how a CD player plays it going from one track to the next
+	GapAppend GapMode = iota
+	// GapPrepend plays the pregap at the start of its own track. a pregap in
+	// the file before its track's is still appended, since a span of a file
+	// can't carry on into the next
+	GapPrepend
+)
+
+type Options struct {
+	Gaps GapMode
+	// HiddenTrack makes the audio before track 1's index 01, the classic
+	// hidden track, a track of its own instead of the start of track 1
+	HiddenTrack bool
+}
+
+// Span is part of one of the sheet's files, played as a track. a track whose
+// audio is in two files has a span in each
+type Span struct {
+	File  int
+	Start time.Duration
+	End   time.Duration
+	// Track is nil for the hidden track
+	Track *Track
+}
+
+// Split splits the sheet's files, which are lengths long, into spans. each
+// file is covered by its spans from start to end, with no gaps or overlaps,
+// so they add up to its length exactly
+func (s *Sheet) Split(lengths []time.Duration, opts Options) ([]Span, error) {
+	if len(lengths) != len(s.Files) {
+		return nil, fmt.Errorf("%w, got %d for %d files", errLengths, len(lengths), len(s.Files))
+	}
+	starts := make([][]Span, len(s.Files))
+	for i, track := range s.Tracks {
+		start, _ := track.index(1)
+		if pregap, ok := track.index(0); ok && opts.Gaps == GapPrepend && pregap.File == start.File {
+			start = pregap
+		}
+		if i == 0 && opts.HiddenTrack {
+			// the hidden track is everything before the track proper
+			start, _ = track.index(1)
+		}
+		if start.Offset > lengths[start.File] {
+			return nil, fmt.Errorf("track %d starts after the end of %q", track.Number, s.Files[start.File].Name)
+		}
+		if prev := starts[start.File]; len(prev) > 0 && prev[len(prev)-1].Start > start.Offset {
+			return nil, fmt.Errorf("track %d starts before the track before it", track.Number)
+		}
+		starts[start.File] = append(starts[start.File], Span{File: start.File, Start: start.Offset, Track: track})
+	}
+
+	var spans []Span
+	// playing is the track which the start of the next file carries on, if
+	// it's the one from before it
+	var playing *Track
+	for file, fileStarts := range starts {
+		length := lengths[file]
+		if len(fileStarts) == 0 {
+			// a file of only a pregap, before any track has played, is the
+			// start of the track it's the pregap of
+			track := playing
+			if track == nil {
+				track = firstAfter(starts[file:])
+			}
+			if track != nil {
+				spans = append(spans, Span{File: file, End: length, Track: track})
+			}
+			continue
+		}
+		if first := fileStarts[0]; first.Start > 0 {
+			switch {
+			case first.Track == s.Tracks[0] && opts.HiddenTrack:
+				spans = append(spans, Span{File: file, End: first.Start})
+			case playing != nil:
+				spans = append(spans, Span{File: file, End: first.Start, Track: playing})
+			default:
+				fileStarts[0].Start = 0
+			}
+		}
+		for i, span := range fileStarts {
+			span.End = length
+			if i+1 < len(fileStarts) {
+				span.End = fileStarts[i+1].Start
+			}
+			spans = append(spans, span)
+		}
+		playing = fileStarts[len(fileStarts)-1].Track
+	}
+	return spans, nil
+}
+
+func firstAfter(starts [][]Span) *Track {
+	for _, fileStarts := range starts {
+		if len(fileStarts) > 0 {
+			return fileStarts[0].Track
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+REM GENRE Rock
+REM DATE 1994
+PERFORMER "Some Band"
+TITLE "Hidden Things"
+FILE "hidden.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "First"
+    INDEX 00 00:00:00
+    INDEX 01 00:30:00
+  TRACK 02 AUDIO
+    TITLE "Second"
+    PERFORMER "Some Band feat. Someone"
+    INDEX 00 03:00:00
+    INDEX 01 03:02:37
+  TRACK 03 AUDIO
+    TITLE Third Without Quotes
+    ISRC GBAYE9400001
+    INDEX 01 05:00:00
@@ -0,0 +1,6 @@
+PERFORMER "Beyonc"
+TITLE "Caf del Mar"
+FILE "caf.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "Dj vu"
+    INDEX 01 00:00:00
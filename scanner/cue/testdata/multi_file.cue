@@ -0,0 +1,20 @@
+PERFORMER "Some Band"
+TITLE "Two Files"
+FILE "01 - first.flac" WAVE
+  TRACK 01 AUDIO
+    TITLE "First"
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    TITLE "Second"
+    INDEX 00 04:00:00
+FILE "02 - second.flac" WAVE
+    INDEX 01 00:00:00
+  TRACK 03 AUDIO
+    TITLE "Third"
+    INDEX 00 03:00:00
+    INDEX 01 03:01:00
+FILE "03 - fourth.flac" WAVE
+  TRACK 04 AUDIO
+    TITLE "Fourth"
+    INDEX 00 00:00:00
+    INDEX 01 00:02:00
@@ -1,16 +1,20 @@
 package scanner
 
 import (
+	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
-	"sync/atomic"
+	"sync"
 	"syscall"
 	"time"
 
@@ -18,14 +22,28 @@ import (
 	"github.com/rainycape/unidecode"
 
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/metrics"
 	"go.senan.xyz/gonic/mime"
 	"go.senan.xyz/gonic/multierr"
+	"go.senan.xyz/gonic/notify"
 	"go.senan.xyz/gonic/scanner/tags"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
 )
 
 var (
 	ErrAlreadyScanning = errors.New("already scanning")
 	ErrReadingTags     = errors.New("could not read tags")
+	ErrUnknownDir      = errors.New("not a music dir")
+	ErrStopped         = errors.New("scanner stopped")
+	ErrPaused          = errors.New("scans are paused")
+)
+
+const (
+	// a scan lease without a heartbeat for this long is considered abandoned,
+	// probably by a scanner which crashed, and can be taken over
+	LeaseStaleAfter = 10 * time.Minute
+	// how often the lease is refreshed during the walk
+	leaseHeartbeatEvery = 30 * time.Second
 )
 
 type Scanner struct {
@@ -33,7 +51,21 @@ type Scanner struct {
 	musicDirs  []string
 	genreSplit string
 	tagger     tags.Reader
-	scanning   *int32
+	holder     string
+	// scanning has the dirs being scanned by this process. different dirs can
+	// be scanned at the same time, but not the same one
+	scanningMu sync.Mutex
+	scanning   map[string]struct{}
+	// paused stops scans from starting, see WithoutScans
+	paused bool
+	// stop is closed by Stop, and running has the scans it waits for
+	stopped    bool
+	stop       chan struct{}
+	running    sync.WaitGroup
+	onDone     []func()
+	logTimings bool
+	notifier   *notify.Dispatcher
+	metrics    *metrics.Metrics
 }
 
 func New(musicDirs []string, db *db.DB, genreSplit string, tagger tags.Reader) *Scanner {
@@ -42,40 +74,336 @@ func New(musicDirs []string, db *db.DB, genreSplit string, tagger tags.Reader) *
 		musicDirs:  musicDirs,
 		genreSplit: genreSplit,
 		tagger:     tagger,
-		scanning:   new(int32),
+		holder:     newHolder(),
+		scanning:   map[string]struct{}{},
+		stop:       make(chan struct{}),
+	}
+}
+
+// Interrupt stops new scans from starting, and the running ones after the
+// folder they're on, before anything is cleaned. it doesn't wait for them
+func (s *Scanner) Interrupt() {
+	s.scanningMu.Lock()
+	defer s.scanningMu.Unlock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stop)
+	}
+}
+
+// Stop is Interrupt, then waits for the running scans until ctx is done
+func (s *Scanner) Stop(ctx context.Context) error {
+	s.Interrupt()
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
+// IsScanning is a fast check for a scan of any dir in this process only, see
+// ActiveLeases for scans from any process sharing the database
 func (s *Scanner) IsScanning() bool {
-	return atomic.LoadInt32(s.scanning) == 1
+	s.scanningMu.Lock()
+	defer s.scanningMu.Unlock()
+	return len(s.scanning) > 0
+}
+
+// IsScanningDir is IsScanning for one music dir
+func (s *Scanner) IsScanningDir(dir string) bool {
+	s.scanningMu.Lock()
+	defer s.scanningMu.Unlock()
+	_, ok := s.scanning[dir]
+	return ok
+}
+
+// ActiveLease returns the scan lease of dir if anyone is currently scanning it,
+// or nil
+func (s *Scanner) ActiveLease(dir string) *db.ScanLease {
+	lease := s.db.GetScanLease(dir)
+	if lease == nil || lease.IsStale(LeaseStaleAfter) {
+		return nil
+	}
+	return lease
+}
+
+// WithoutScans runs fn while no scan is running, in this process or another,
+// and stops new ones from starting until it's done. if one is running, it
+// fails with ErrAlreadyScanning instead of waiting
+func (s *Scanner) WithoutScans(fn func() error) error {
+	s.scanningMu.Lock()
+	switch {
+	case s.paused:
+		s.scanningMu.Unlock()
+		return ErrPaused
+	case len(s.scanning) > 0:
+		s.scanningMu.Unlock()
+		return ErrAlreadyScanning
+	}
+	s.paused = true
+	s.scanningMu.Unlock()
+	defer func() {
+		s.scanningMu.Lock()
+		s.paused = false
+		s.scanningMu.Unlock()
+	}()
+
+	active, err := s.ActiveLeases()
+	if err != nil {
+		return fmt.Errorf("find scan leases: %w", err)
+	}
+	if len(active) > 0 {
+		return fmt.Errorf("%w %q, by %q", ErrAlreadyScanning, active[0].Dir, active[0].Holder)
+	}
+	return fn()
+}
+
+// ActiveLeases returns the scan leases of the dirs anyone is currently scanning
+func (s *Scanner) ActiveLeases() ([]*db.ScanLease, error) {
+	leases, err := s.db.GetScanLeases()
+	if err != nil {
+		return nil, err
+	}
+	var active []*db.ScanLease
+	for _, lease := range leases {
+		if !lease.IsStale(LeaseStaleAfter) {
+			active = append(active, lease)
+		}
+	}
+	return active, nil
+}
+
+// OnDone adds a function to run in the background after every scan, such as
+// post-processing new albums. it should be called before any scans start
+func (s *Scanner) OnDone(fn func()) {
+	s.onDone = append(s.onDone, fn)
+}
+
+// LogTimings prints the time spent in each top level directory after every scan
+func (s *Scanner) LogTimings(enabled bool) {
+	s.logTimings = enabled
+}
+
+// SetNotifier sends a notification when a scan fails, or has errors
+func (s *Scanner) SetNotifier(notifier *notify.Dispatcher) {
+	s.notifier = notifier
+}
+
+// SetMetrics records how long each scan took, and the library's totals after it
+func (s *Scanner) SetMetrics(m *metrics.Metrics) {
+	s.metrics = m
+	// until the next scan, the totals are the last one's
+	if stats, err := LastLibraryStats(s.db); err == nil && stats != nil {
+		m.Library(stats.Tracks, stats.Albums, stats.Artists)
+	}
 }
 
+func (s *Scanner) Holder() string      { return s.holder }
+func (s *Scanner) MusicDirs() []string { return s.musicDirs }
+
 type ScanOptions struct {
 	IsFull bool
+	// Dirs are the music dirs to scan, or all of them if it's empty. only what
+	// was in the dirs scanned is cleaned, so a scan of every dir also cleans the
+	// dirs which aren't music dirs any more
+	Dirs []string
+}
+
+// Start checks that a scan can run, then runs it in the background. problems
+// which stop it from starting, such as an unreadable music dir or a scan which
+// is already running, are returned rather than logged
+func (s *Scanner) Start(opts ScanOptions) error {
+	dirs, release, err := s.begin(opts)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer release()
+		if _, err := s.scan(dirs, opts); err != nil {
+			log.Printf("error while scanning: %v\n", err)
+		}
+	}()
+	return nil
 }
 
 func (s *Scanner) ScanAndClean(opts ScanOptions) (*Context, error) {
-	if s.IsScanning() {
-		return nil, ErrAlreadyScanning
+	dirs, release, err := s.begin(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.scan(dirs, opts)
+}
+
+// begin claims the dirs of opts for this process and their scan leases for the
+// database, after checking they can be read. release must be called once the
+// scan is done
+func (s *Scanner) begin(opts ScanOptions) (dirs []string, release func(), err error) {
+	dirs, err = s.scanDirs(opts.Dirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.claim(dirs); err != nil {
+		return nil, nil, err
+	}
+	claimed := dirs
+	defer func() {
+		if err != nil {
+			s.unclaim(claimed)
+		}
+	}()
+
+	for _, dir := range dirs {
+		if err := checkMusicDir(dir); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var leased []string
+	defer func() {
+		if err != nil {
+			s.releaseLeases(leased)
+		}
+	}()
+	for _, dir := range dirs {
+		prevHolder, err := s.db.AcquireScanLease(dir, s.holder, LeaseStaleAfter)
+		switch {
+		case errors.Is(err, db.ErrScanLeaseHeld):
+			if lease := s.db.GetScanLease(dir); lease != nil {
+				return nil, nil, fmt.Errorf("%w %q, by %q", ErrAlreadyScanning, dir, lease.Holder)
+			}
+			return nil, nil, fmt.Errorf("%w %q", ErrAlreadyScanning, dir)
+		case err != nil:
+			return nil, nil, fmt.Errorf("acquire scan lease: %w", err)
+		}
+		if prevHolder != "" {
+			log.Printf("warning: took over stale scan lease of %q from %q", dir, prevHolder)
+		}
+		leased = append(leased, dir)
+	}
+	return claimed, func() {
+		s.releaseLeases(claimed)
+		s.unclaim(claimed)
+	}, nil
+}
+
+// scanDirs checks that dirs are music dirs, or returns all of them if there
+// aren't any
+func (s *Scanner) scanDirs(dirs []string) ([]string, error) {
+	if len(dirs) == 0 {
+		return s.musicDirs, nil
+	}
+	for _, dir := range dirs {
+		if !contains(s.musicDirs, dir) {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownDir, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// claim marks dirs as being scanned by this process, if none of them are yet
+func (s *Scanner) claim(dirs []string) error {
+	s.scanningMu.Lock()
+	defer s.scanningMu.Unlock()
+	if s.stopped {
+		return ErrStopped
+	}
+	if s.paused {
+		return ErrPaused
+	}
+	for _, dir := range dirs {
+		if _, ok := s.scanning[dir]; ok {
+			return fmt.Errorf("%w %q", ErrAlreadyScanning, dir)
+		}
+	}
+	for _, dir := range dirs {
+		s.scanning[dir] = struct{}{}
+	}
+	s.running.Add(1)
+	return nil
+}
+
+func (s *Scanner) unclaim(dirs []string) {
+	s.scanningMu.Lock()
+	defer s.scanningMu.Unlock()
+	for _, dir := range dirs {
+		delete(s.scanning, dir)
+	}
+	s.running.Done()
+}
+
+func (s *Scanner) releaseLeases(dirs []string) {
+	for _, dir := range dirs {
+		if err := s.db.ReleaseScanLease(dir, s.holder); err != nil {
+			log.Printf("error releasing scan lease of %q: %v", dir, err)
+		}
+	}
+}
+
+func (s *Scanner) heartbeat(dirs []string) error {
+	for _, dir := range dirs {
+		if err := s.db.HeartbeatScanLease(dir, s.holder); err != nil {
+			return fmt.Errorf("%q: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// checkMusicDir makes sure dir can be listed. otherwise the walk would only
+// record the error and carry on, then clean everything in dir from the db
+func checkMusicDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open music dir: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.ReadDir(1); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("read music dir %q: %w", dir, err)
 	}
-	atomic.StoreInt32(s.scanning, 1)
-	defer atomic.StoreInt32(s.scanning, 0)
+	return nil
+}
+
+func (s *Scanner) scan(dirs []string, opts ScanOptions) (_ *Context, err error) {
+	defer func() {
+		if err != nil && !errors.Is(err, ErrStopped) {
+			s.notifier.Publish(notify.Event{
+				Type:    notify.EventScanFailed,
+				Title:   "gonic scan failed",
+				Message: scanErrorMessage(err),
+			})
+		}
+	}()
 
 	start := time.Now()
 	c := &Context{
-		errs:       &multierr.Err{},
-		seenTracks: map[int]struct{}{},
-		seenAlbums: map[int]struct{}{},
-		isFull:     opts.IsFull,
+		errs:          &multierr.Err{},
+		seenTracks:    map[int]struct{}{},
+		seenAlbums:    map[int]struct{}{},
+		timings:       map[string]*DirTiming{},
+		isFull:        opts.IsFull,
+		dirs:          dirs,
+		allDirs:       len(opts.Dirs) == 0,
+		search:        s.db.HasSearch(),
+		lastHeartbeat: start,
 	}
 
-	log.Println("starting scan")
+	if c.allDirs {
+		log.Println("starting scan")
+	} else {
+		log.Printf("starting scan of %s", strings.Join(dirs, ", "))
+	}
 	defer func() {
-		log.Printf("finished scan in %s, +%d/%d tracks (%d err)\n",
-			durSince(start), c.SeenTracksNew(), c.SeenTracks(), c.errs.Len())
+		log.Printf("finished scan in %s, +%d/%d tracks, -%d tracks and %d refs to them (%d err)\n",
+			durSince(start), c.SeenTracksNew(), c.SeenTracks(), c.TracksMissing(), c.TrackRefsMissing(), c.errs.Len())
 	}()
 
-	for _, dir := range s.musicDirs {
+	for _, dir := range dirs {
 		err := filepath.WalkDir(dir, func(absPath string, d fs.DirEntry, err error) error {
 			return s.scanCallback(c, dir, absPath, d, err)
 		})
@@ -84,9 +412,17 @@ func (s *Scanner) ScanAndClean(opts ScanOptions) (*Context, error) {
 		}
 	}
 
+	// make sure we still hold the leases before deleting anything we didn't see
+	if err := s.heartbeat(dirs); err != nil {
+		return nil, fmt.Errorf("heartbeat before clean: %w", err)
+	}
+
 	if err := s.cleanTracks(c); err != nil {
 		return nil, fmt.Errorf("clean tracks: %w", err)
 	}
+	if err := s.cleanTrackRefs(c); err != nil {
+		return nil, fmt.Errorf("clean track refs: %w", err)
+	}
 	if err := s.cleanAlbums(c); err != nil {
 		return nil, fmt.Errorf("clean albums: %w", err)
 	}
@@ -96,10 +432,38 @@ func (s *Scanner) ScanAndClean(opts ScanOptions) (*Context, error) {
 	if err := s.cleanGenres(c); err != nil {
 		return nil, fmt.Errorf("clean genres: %w", err)
 	}
+	if err := s.cleanFutureTimes(c); err != nil {
+		return nil, fmt.Errorf("clean future times: %w", err)
+	}
+	logFutureFiles(c.futureFiles)
 
-	if err := s.db.SetSetting("last_scan_time", strconv.FormatInt(time.Now().Unix(), 10)); err != nil {
+	scannedAt := time.Now()
+	if err := s.db.SetSetting("last_scan_time", strconv.FormatInt(scannedAt.Unix(), 10)); err != nil {
 		return nil, fmt.Errorf("set scan time: %w", err)
 	}
+	if err := s.db.SetMusicFolderScanned(dirs, scannedAt); err != nil {
+		return nil, fmt.Errorf("set folder scan time: %w", err)
+	}
+	stats, err := countLibrary(s.db, scannedAt)
+	if err != nil {
+		return nil, fmt.Errorf("count library: %w", err)
+	}
+	if err := saveLibraryStats(s.db, stats); err != nil {
+		return nil, fmt.Errorf("save library stats: %w", err)
+	}
+	s.metrics.Scan(scannedAt.Sub(start), scannedAt)
+	s.metrics.Library(stats.Tracks, stats.Albums, stats.Artists)
+	timings := c.Timings()
+	if err := saveTimings(s.db, dirs, timings); err != nil {
+		return nil, fmt.Errorf("save scan timing: %w", err)
+	}
+	if s.logTimings {
+		logTimings(timings)
+	}
+
+	for _, fn := range s.onDone {
+		go fn()
+	}
 
 	if c.errs.Len() > 0 {
 		return c, c.errs
@@ -109,6 +473,11 @@ func (s *Scanner) ScanAndClean(opts ScanOptions) (*Context, error) {
 }
 
 func (s *Scanner) scanCallback(c *Context, dir string, absPath string, d fs.DirEntry, err error) error {
+	select {
+	case <-s.stop:
+		return ErrStopped
+	default:
+	}
 	if err != nil {
 		c.errs.Add(err)
 		return nil
@@ -131,7 +500,18 @@ func (s *Scanner) scanCallback(c *Context, dir string, absPath string, d fs.DirE
 
 	log.Printf("processing folder `%s`", absPath)
 
-	tx := s.db.Begin()
+	// anything not spent walking or reading tags is counted as db time
+	c.timing = c.timingFor(dir, absPath)
+	c.timing.Folders++
+	start, startOther := time.Now(), c.timing.Walk+c.timing.Tags
+	defer func(timing *DirTiming) {
+		timing.DB += time.Since(start) - (timing.Walk + timing.Tags - startOther)
+	}(c.timing)
+
+	tx, err := s.db.BeginRetry()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
 	if err := s.scanDir(tx, c, dir, absPath); err != nil {
 		c.errs.Add(fmt.Errorf("%q: %w", absPath, err))
 		tx.Rollback()
@@ -141,11 +521,20 @@ func (s *Scanner) scanCallback(c *Context, dir string, absPath string, d fs.DirE
 		return fmt.Errorf("commit tx: %w", err)
 	}
 
+	if time.Since(c.lastHeartbeat) > leaseHeartbeatEvery {
+		if err := s.heartbeat(c.dirs); err != nil {
+			return fmt.Errorf("heartbeat: %w", err)
+		}
+		c.lastHeartbeat = time.Now()
+	}
+
 	return nil
 }
 
 func (s *Scanner) scanDir(tx *db.DB, c *Context, musicDir string, absPath string) error {
+	start := time.Now()
 	items, err := os.ReadDir(absPath)
+	c.timing.Walk += time.Since(start)
 	if err != nil {
 		return err
 	}
@@ -187,12 +576,20 @@ func (s *Scanner) scanDir(tx *db.DB, c *Context, musicDir string, absPath string
 			return fmt.Errorf("populate track %q: %w", basename, err)
 		}
 	}
+	if len(tracks) > 0 {
+		if err := populateAlbumDynamicRange(tx, &album); err != nil {
+			return fmt.Errorf("populate album dynamic range: %w", err)
+		}
+	}
 
 	return nil
 }
 
 func (s *Scanner) populateTrackAndAlbumArtists(tx *db.DB, c *Context, i int, parent, album *db.Album, basename string, absPath string) error {
+	c.timing.Tracks++
+	start := time.Now()
 	stat, err := os.Stat(absPath)
+	c.timing.Walk += time.Since(start)
 	if err != nil {
 		return fmt.Errorf("stating %q: %w", basename, err)
 	}
@@ -202,17 +599,35 @@ func (s *Scanner) populateTrackAndAlbumArtists(tx *db.DB, c *Context, i int, par
 		return fmt.Errorf("query track: %w", err)
 	}
 
-	if !c.isFull && track.ID != 0 && stat.ModTime().Before(track.UpdatedAt) {
+	now := time.Now()
+	modTime, future := clampTime(stat.ModTime(), now)
+	if future {
+		c.futureFiles = append(c.futureFiles, absPath)
+	}
+	// a file dated in the future can't be compared with when we last saw it, so
+	// once it's been scanned it's only scanned again when its date is fixed, or
+	// on a full scan
+	if !c.isFull && track.ID != 0 && (future || modTime.Before(track.UpdatedAt)) {
 		c.seenTracks[track.ID] = struct{}{}
 		return nil
 	}
 
+	start = time.Now()
 	trags, err := s.tagger.Read(absPath)
+	c.timing.Tags += time.Since(start)
 	if err != nil {
 		return fmt.Errorf("%v: %w", err, ErrReadingTags)
 	}
 
-	genreNames := strings.Split(trags.SomeGenre(), s.genreSplit)
+	// each of a multi-valued genre tag's values can be split again
+	genres := trags.Genres()
+	if len(genres) == 0 {
+		genres = []string{trags.SomeGenre()}
+	}
+	var genreNames []string
+	for _, genre := range genres {
+		genreNames = append(genreNames, strings.Split(genre, s.genreSplit)...)
+	}
 	genreIDs, err := populateGenres(tx, track, genreNames)
 	if err != nil {
 		return fmt.Errorf("populate genres: %w", err)
@@ -220,13 +635,22 @@ func (s *Scanner) populateTrackAndAlbumArtists(tx *db.DB, c *Context, i int, par
 
 	// metadata for the album table comes only from the the first track's tags
 	if i == 0 || album.TagArtist == nil {
-		albumArtist, err := populateAlbumArtist(tx, album, parent, trags.SomeAlbumArtist())
+		albumArtist, err := populateAlbumArtist(tx, album, parent, trags.SomeAlbumArtist(), trags.AlbumArtistBrainzID())
 		if err != nil {
 			return fmt.Errorf("populate album artist: %w", err)
 		}
-		if err := populateAlbum(tx, album, albumArtist, trags, stat.ModTime(), statCreateTime(stat)); err != nil {
+		createTime, _ := clampTime(statCreateTime(stat), now)
+		if err := populateAlbum(tx, album, albumArtist, trags, modTime, createTime); err != nil {
 			return fmt.Errorf("populate album: %w", err)
 		}
+		if c.search {
+			if err := db.IndexArtist(tx.DB, albumArtist); err != nil {
+				return fmt.Errorf("index album artist: %w", err)
+			}
+			if err := db.IndexAlbum(tx.DB, album, albumArtist); err != nil {
+				return fmt.Errorf("index album: %w", err)
+			}
+		}
 		if err := populateAlbumGenres(tx, album, genreIDs); err != nil {
 			return fmt.Errorf("populate album genres: %w", err)
 		}
@@ -238,6 +662,11 @@ func (s *Scanner) populateTrackAndAlbumArtists(tx *db.DB, c *Context, i int, par
 	if err := populateTrackGenres(tx, track, genreIDs); err != nil {
 		return fmt.Errorf("populate track genres: %w", err)
 	}
+	if c.search {
+		if err := db.IndexTrack(tx.DB, track, album.TagArtist); err != nil {
+			return fmt.Errorf("index track: %w", err)
+		}
+	}
 
 	c.seenTracks[track.ID] = struct{}{}
 	c.seenTracksNew++
@@ -250,8 +679,13 @@ func populateAlbum(tx *db.DB, album *db.Album, albumArtist *db.Artist, trags tag
 	album.TagTitle = albumName
 	album.TagTitleUDec = decoded(albumName)
 	album.TagBrainzID = trags.AlbumBrainzID()
+	album.TagReleaseGroupBrainzID = trags.ReleaseGroupBrainzID()
 	album.TagYear = trags.Year()
+	album.TagReleaseType = trags.ReleaseType()
 	album.TagArtist = albumArtist
+	// estimated from the tracks after they're scanned, if it isn't tagged
+	album.DynamicRange = trags.AlbumDynamicRange()
+	album.DynamicRangeEstimated = false
 
 	album.ModifiedAt = modTime
 	if !createTime.IsZero() {
@@ -265,6 +699,41 @@ func populateAlbum(tx *db.DB, album *db.Album, albumArtist *db.Artist, trags tag
 	return nil
 }
 
+// populateAlbumDynamicRange estimates the album's DR value if it isn't tagged,
+// as the rounded mean of its tracks', like the DR meter works it out
+func populateAlbumDynamicRange(tx *db.DB, album *db.Album) error {
+	if album.DynamicRange != nil && !album.DynamicRangeEstimated {
+		return nil
+	}
+	var mean struct{ DR *float64 }
+	err := tx.
+		Model(db.Track{}).
+		Select("AVG(tag_dynamic_range) dr").
+		Where("album_id=?", album.ID).
+		Scan(&mean).
+		Error
+	if err != nil {
+		return fmt.Errorf("find mean of tracks: %w", err)
+	}
+	var estimate *int
+	if mean.DR != nil {
+		dr := int(math.Round(*mean.DR))
+		estimate = &dr
+	}
+	if (estimate == nil) == (album.DynamicRange == nil) && (estimate == nil || *estimate == *album.DynamicRange) {
+		return nil
+	}
+	album.DynamicRange = estimate
+	album.DynamicRangeEstimated = estimate != nil
+	return tx.
+		Model(album).
+		UpdateColumns(map[string]interface{}{
+			"dynamic_range":           estimate,
+			"dynamic_range_estimated": album.DynamicRangeEstimated,
+		}).
+		Error
+}
+
 func populateAlbumBasics(tx *db.DB, musicDir string, parent, album *db.Album, dir, basename string, cover string) error {
 	if err := tx.Where(db.Album{RootDir: musicDir, LeftPath: dir, RightPath: basename}).First(album).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		return fmt.Errorf("find album: %w", err)
@@ -303,6 +772,10 @@ func populateTrack(tx *db.DB, album *db.Album, track *db.Track, trags tags.Parse
 	track.TagTrackNumber = trags.TrackNumber()
 	track.TagDiscNumber = trags.DiscNumber()
 	track.TagBrainzID = trags.BrainzID()
+	track.TagArtistBrainzID = trags.ArtistBrainzID()
+	track.TagReplayGainTrack = trags.ReplayGainTrack()
+	track.TagReplayGainAlbum = trags.ReplayGainAlbum()
+	track.TagDynamicRange = trags.DynamicRange()
 
 	track.Length = trags.Length()   // these two should be calculated
 	track.Bitrate = trags.Bitrate() // ...from the file instead of tags
@@ -314,15 +787,21 @@ func populateTrack(tx *db.DB, album *db.Album, track *db.Track, trags tags.Parse
 	return nil
 }
 
-func populateAlbumArtist(tx *db.DB, album, parent *db.Album, artistName string) (*db.Artist, error) {
+func populateAlbumArtist(tx *db.DB, album, parent *db.Album, artistName, brainzID string) (*db.Artist, error) {
 	var update db.Artist
 	update.Name = artistName
 	update.NameUDec = decoded(artistName)
+	// an album without the id doesn't clear it, since it's left out of the update
+	update.BrainzID = brainzID
 	if parent.Cover != "" {
 		update.Cover = parent.Cover
 	}
 	var artist db.Artist
-	if err := tx.Where("name=?", artistName).Assign(update).FirstOrCreate(&artist).Error; err != nil {
+	err := retryUnique(tx, func() error {
+		artist = db.Artist{}
+		return tx.Where("name=?", artistName).Assign(update).FirstOrCreate(&artist).Error
+	})
+	if err != nil {
 		return nil, fmt.Errorf("find or create artist: %w", err)
 	}
 	return &artist, nil
@@ -341,7 +820,11 @@ func populateGenres(tx *db.DB, track *db.Track, names []string) ([]int, error) {
 	var ids []int
 	for _, name := range filteredNames {
 		var genre db.Genre
-		if err := tx.FirstOrCreate(&genre, db.Genre{Name: name}).Error; err != nil {
+		err := retryUnique(tx, func() error {
+			genre = db.Genre{}
+			return tx.FirstOrCreate(&genre, db.Genre{Name: name}).Error
+		})
+		if err != nil {
 			return nil, fmt.Errorf("find or create genre: %w", err)
 		}
 		ids = append(ids, genre.ID)
@@ -349,6 +832,33 @@ func populateGenres(tx *db.DB, track *db.Track, names []string) ([]int, error) {
 	return ids, nil
 }
 
+// retryUnique runs a find or create again if its insert lost a race with
+// another's. artist and genre names are unique, so the second find sees the
+// row that won. the first try is behind a savepoint, since postgres won't
+// run anything else in a transaction after an error until it's rolled back
+func retryUnique(tx *db.DB, firstOrCreate func() error) error {
+	if err := tx.Exec("SAVEPOINT find_or_create").Error; err != nil {
+		return fmt.Errorf("savepoint: %w", err)
+	}
+	err := firstOrCreate()
+	if err != nil && !db.IsUniqueViolation(err) {
+		return err
+	}
+	if err == nil {
+		if err := tx.Exec("RELEASE SAVEPOINT find_or_create").Error; err != nil {
+			return fmt.Errorf("release savepoint: %w", err)
+		}
+		return nil
+	}
+	if err := tx.Exec("ROLLBACK TO SAVEPOINT find_or_create").Error; err != nil {
+		return fmt.Errorf("rollback to savepoint: %w", err)
+	}
+	if err := tx.Exec("RELEASE SAVEPOINT find_or_create").Error; err != nil {
+		return fmt.Errorf("release savepoint: %w", err)
+	}
+	return firstOrCreate()
+}
+
 func populateTrackGenres(tx *db.DB, track *db.Track, genreIDs []int) error {
 	if err := tx.Where("track_id=?", track.ID).Delete(db.TrackGenre{}).Error; err != nil {
 		return fmt.Errorf("delete old track genre records: %w", err)
@@ -375,9 +885,16 @@ func (s *Scanner) cleanTracks(c *Context) error {
 	start := time.Now()
 	defer func() { log.Printf("finished clean tracks in %s, %d removed", durSince(start), c.TracksMissing()) }()
 
+	q := s.db.Model(&db.Track{})
+	if !c.allDirs {
+		q = q.Where("album_id IN ?", s.db.
+			Model(&db.Album{}).
+			Select("id").
+			Where("root_dir IN (?)", c.dirs).
+			SubQuery())
+	}
 	var all []int
-	err := s.db.
-		Model(&db.Track{}).
+	err := q.
 		Pluck("id", &all).
 		Error
 	if err != nil {
@@ -389,17 +906,136 @@ func (s *Scanner) cleanTracks(c *Context) error {
 		}
 	}
 	return s.db.TransactionChunked(c.tracksMissing, func(tx *gorm.DB, chunk []int64) error {
-		return tx.Where(chunk).Delete(&db.Track{}).Error
+		if err := tx.Where(chunk).Delete(&db.Track{}).Error; err != nil {
+			return err
+		}
+		if c.search {
+			return db.Unindex(tx, db.SearchTrack, chunk)
+		}
+		return nil
+	})
+}
+
+// cleanTrackRefs removes the cleaned tracks from users' playlists, play queues,
+// and bookmarks, which have their ids without a foreign key. stars, ratings,
+// and plays are removed with the tracks by theirs
+func (s *Scanner) cleanTrackRefs(c *Context) error {
+	start := time.Now()
+	defer func() {
+		log.Printf("finished clean track refs in %s, %d removed", durSince(start), c.TrackRefsMissing())
+	}()
+
+	if len(c.tracksMissing) == 0 {
+		return nil
+	}
+	missing := make(map[int]struct{}, len(c.tracksMissing))
+	for _, id := range c.tracksMissing {
+		missing[int(id)] = struct{}{}
+	}
+
+	err := s.db.TransactionChunked(c.tracksMissing, func(tx *gorm.DB, chunk []int64) error {
+		q := tx.
+			Where("entry_id_type=? AND entry_id IN (?)", specid.Track, chunk).
+			Delete(&db.Bookmark{})
+		c.trackRefsMissing += int(q.RowsAffected)
+		return q.Error
+	})
+	if err != nil {
+		return fmt.Errorf("clean bookmarks: %w", err)
+	}
+	err = inPages(s.db, func(tx *db.DB, after int) (int, error) {
+		var playlists []*db.Playlist
+		if err := tx.Where("id>?", after).Order("id").Limit(cleanPageSize).Find(&playlists).Error; err != nil {
+			return 0, err
+		}
+		for _, playlist := range playlists {
+			prev := *playlist
+			removed := playlist.RemoveItems(missing)
+			if removed == 0 {
+				continue
+			}
+			if err := tx.SavePlaylist(prev, playlist); err != nil {
+				return 0, fmt.Errorf("save playlist %d: %w", playlist.ID, err)
+			}
+			c.trackRefsMissing += removed
+		}
+		if len(playlists) == 0 {
+			return 0, nil
+		}
+		return playlists[len(playlists)-1].ID, nil
 	})
+	if err != nil {
+		return fmt.Errorf("clean playlists: %w", err)
+	}
+	err = inPages(s.db, func(tx *db.DB, after int) (int, error) {
+		var queues []*db.PlayQueue
+		if err := tx.Where("id>?", after).Order("id").Limit(cleanPageSize).Find(&queues).Error; err != nil {
+			return 0, err
+		}
+		for _, queue := range queues {
+			removed := queue.RemoveItems(missing)
+			if removed == 0 {
+				continue
+			}
+			// without moving UpdatedAt, since the queue hasn't been saved by anyone
+			err := tx.
+				Model(queue).
+				UpdateColumns(map[string]interface{}{"items": queue.Items, "current": queue.Current, "position": queue.Position}).
+				Error
+			if err != nil {
+				return 0, fmt.Errorf("save play queue %d: %w", queue.ID, err)
+			}
+			c.trackRefsMissing += removed
+		}
+		if len(queues) == 0 {
+			return 0, nil
+		}
+		return queues[len(queues)-1].ID, nil
+	})
+	if err != nil {
+		return fmt.Errorf("clean play queues: %w", err)
+	}
+	return nil
+}
+
+// cleanPageSize is how many playlists or play queues are cleaned in each
+// transaction, since each has every one of its tracks
+const cleanPageSize = 100
+
+// inPages calls page in a transaction of its own, with the id of the last row
+// of the page before, until it returns 0
+func inPages(dbc *db.DB, page func(tx *db.DB, after int) (int, error)) error {
+	var after int
+	for {
+		tx, err := dbc.BeginRetry()
+		if err != nil {
+			return fmt.Errorf("begin tx: %w", err)
+		}
+		last, err := page(tx, after)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return fmt.Errorf("commit tx: %w", err)
+		}
+		if last == 0 {
+			return nil
+		}
+		after = last
+	}
 }
 
 func (s *Scanner) cleanAlbums(c *Context) error {
 	start := time.Now()
 	defer func() { log.Printf("finished clean albums in %s, %d removed", durSince(start), c.AlbumsMissing()) }()
 
+	q := s.db.Model(&db.Album{})
+	if !c.allDirs {
+		q = q.Where("root_dir IN (?)", c.dirs)
+	}
 	var all []int
-	err := s.db.
-		Model(&db.Album{}).
+	err := q.
 		Pluck("id", &all).
 		Error
 	if err != nil {
@@ -411,7 +1047,13 @@ func (s *Scanner) cleanAlbums(c *Context) error {
 		}
 	}
 	return s.db.TransactionChunked(c.albumsMissing, func(tx *gorm.DB, chunk []int64) error {
-		return tx.Where(chunk).Delete(&db.Album{}).Error
+		if err := tx.Where(chunk).Delete(&db.Album{}).Error; err != nil {
+			return err
+		}
+		if c.search {
+			return db.Unindex(tx, db.SearchAlbum, chunk)
+		}
+		return nil
 	})
 }
 
@@ -419,20 +1061,26 @@ func (s *Scanner) cleanArtists(c *Context) error {
 	start := time.Now()
 	defer func() { log.Printf("finished clean artists in %s, %d removed", durSince(start), c.ArtistsMissing()) }()
 
-	sub := s.db.
-		Select("artists.id").
+	var missing []int64
+	err := s.db.
 		Model(&db.Artist{}).
 		Joins("LEFT JOIN albums ON albums.tag_artist_id=artists.id").
 		Where("albums.id IS NULL").
-		SubQuery()
-	q := s.db.
-		Where("artists.id IN ?", sub).
-		Delete(&db.Artist{})
-	if err := q.Error; err != nil {
-		return err
+		Pluck("artists.id", &missing).
+		Error
+	if err != nil {
+		return fmt.Errorf("plucking ids: %w", err)
 	}
-	c.artistsMissing = int(q.RowsAffected)
-	return nil
+	c.artistsMissing = len(missing)
+	return s.db.TransactionChunked(missing, func(tx *gorm.DB, chunk []int64) error {
+		if err := tx.Where(chunk).Delete(&db.Artist{}).Error; err != nil {
+			return err
+		}
+		if c.search {
+			return db.Unindex(tx, db.SearchArtist, chunk)
+		}
+		return nil
+	})
 }
 
 func (s *Scanner) cleanGenres(c *Context) error {
@@ -454,10 +1102,78 @@ func (s *Scanner) cleanGenres(c *Context) error {
 	q := s.db.
 		Where("genres.id IN ? AND genres.id IN ?", subTrack, subAlbum).
 		Delete(&db.Genre{})
+	if err := q.Error; err != nil {
+		return err
+	}
 	c.genresMissing = int(q.RowsAffected)
 	return nil
 }
 
+// cleanFutureTimes repairs albums dated in the future, by files from a machine
+// with a wrong clock, from before we clamped file times
+func (s *Scanner) cleanFutureTimes(c *Context) error {
+	start := time.Now()
+	defer func() {
+		log.Printf("finished clean future times in %s, %d repaired", durSince(start), c.TimesRepaired())
+	}()
+
+	for _, column := range []string{"created_at", "modified_at"} {
+		q := s.db.
+			Model(&db.Album{}).
+			Where(column+">?", start).
+			UpdateColumn(column, start)
+		if err := q.Error; err != nil {
+			return fmt.Errorf("repair %s: %w", column, err)
+		}
+		c.timesRepaired += int(q.RowsAffected)
+	}
+	return nil
+}
+
+// scanErrorMessage summarises the errors from a scan, which can be one for every
+// file
+func scanErrorMessage(err error) string {
+	var errs *multierr.Err
+	if errors.As(err, &errs) && errs.Len() > 0 {
+		return fmt.Sprintf("the scan had %d errors, the first was: %v", errs.Len(), errs.Errors()[0])
+	}
+	return err.Error()
+}
+
+// clampTime returns t, or now if t is in the future
+func clampTime(t, now time.Time) (time.Time, bool) {
+	if t.After(now) {
+		return now, true
+	}
+	return t, false
+}
+
+// maxFutureFilesLogged is how many future dated files are listed after a scan
+const maxFutureFilesLogged = 10
+
+func logFutureFiles(paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	log.Printf("warning: %d files are dated in the future, their clock may have been wrong. the scan time was used instead for:", len(paths))
+	for i, path := range paths {
+		if i == maxFutureFilesLogged {
+			log.Printf("  and %d more", len(paths)-i)
+			break
+		}
+		log.Printf("  %s", path)
+	}
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
 func ext(name string) string {
 	if ext := filepath.Ext(name); len(ext) > 0 {
 		return ext[1:]
@@ -490,6 +1206,15 @@ func decoded(in string) string {
 	return ""
 }
 
+// newHolder identifies this scanner in the scan lease, so that we can see who
+// is scanning when there are multiple processes using the same database
+func newHolder() string {
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return fmt.Sprintf("%s/%d/%x", hostname, os.Getpid(), suffix)
+}
+
 func durSince(t time.Time) time.Duration {
 	return time.Since(t).Truncate(10 * time.Microsecond)
 }
@@ -498,6 +1223,15 @@ type Context struct {
 	errs   *multierr.Err
 	isFull bool
 
+	// dirs are the music dirs being scanned, and allDirs is whether they're
+	// all of them, so that anything outside of them can be cleaned too
+	dirs    []string
+	allDirs bool
+
+	// search is whether the db has the full text search index, which is kept
+	// up to date as rows are saved and cleaned
+	search bool
+
 	seenTracks    map[int]struct{}
 	seenAlbums    map[int]struct{}
 	seenTracksNew int
@@ -505,17 +1239,33 @@ type Context struct {
 	tracksMissing  []int64
 	albumsMissing  []int64
 	artistsMissing int
-	genresMissing  int
+	// trackRefsMissing are the items of playlists and play queues, and the
+	// bookmarks, which had the tracks missing
+	trackRefsMissing int
+	genresMissing    int
+	timesRepaired    int
+
+	// futureFiles are dated in the future, so the scan time was used for them
+	futureFiles []string
+
+	// timings are kept per top level directory, timing is the current one
+	timings map[string]*DirTiming
+	timing  *DirTiming
+
+	lastHeartbeat time.Time
 }
 
 func (c *Context) SeenTracks() int    { return len(c.seenTracks) }
 func (c *Context) SeenAlbums() int    { return len(c.seenAlbums) }
 func (c *Context) SeenTracksNew() int { return c.seenTracksNew }
 
-func (c *Context) TracksMissing() int  { return len(c.tracksMissing) }
-func (c *Context) AlbumsMissing() int  { return len(c.albumsMissing) }
-func (c *Context) ArtistsMissing() int { return c.artistsMissing }
-func (c *Context) GenresMissing() int  { return c.genresMissing }
+func (c *Context) TracksMissing() int    { return len(c.tracksMissing) }
+func (c *Context) AlbumsMissing() int    { return len(c.albumsMissing) }
+func (c *Context) ArtistsMissing() int   { return c.artistsMissing }
+func (c *Context) TrackRefsMissing() int { return c.trackRefsMissing }
+func (c *Context) GenresMissing() int    { return c.genresMissing }
+func (c *Context) TimesRepaired() int    { return c.timesRepaired }
+func (c *Context) FutureFiles() int      { return len(c.futureFiles) }
 
 func statCreateTime(info fs.FileInfo) time.Time {
 	stat, ok := info.Sys().(*syscall.Stat_t)
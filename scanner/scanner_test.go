@@ -1,13 +1,16 @@
 package scanner_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
@@ -208,6 +211,66 @@ func TestDeleteArtist(t *testing.T) {
 	is.Equal(m.DB().Where("name=?", "artist-2").Find(&db.Artist{}).Error, gorm.ErrRecordNotFound)                                  // artist doesn't exist
 }
 
+func TestDeleteTrackRefs(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	m.AddItems()
+	m.ScanAndClean()
+
+	trackID := func(path string) int {
+		var track db.Track
+		is.NoErr(m.DB().
+			Joins("JOIN albums ON albums.id=tracks.album_id").
+			Where("albums.left_path || albums.right_path || '/' || tracks.filename=?", path).
+			First(&track).
+			Error)
+		return track.ID
+	}
+	a, b := trackID("artist-0/album-0/track-0.flac"), trackID("artist-0/album-0/track-1.flac")
+	x, y := trackID("artist-1/album-0/track-0.flac"), trackID("artist-1/album-0/track-1.flac")
+	var user db.User
+	is.NoErr(m.DB().First(&user).Error)
+
+	playlist := &db.Playlist{UserID: user.ID, Name: "p"}
+	playlist.SetItems([]int{a, x, b, y, a})
+	is.NoErr(m.DB().Save(playlist).Error)
+	queue := &db.PlayQueue{UserID: user.ID, Current: a, Position: 30}
+	queue.SetItems([]int{x, a, b, y})
+	is.NoErr(m.DB().Save(queue).Error)
+	is.NoErr(m.DB().Save(&db.Bookmark{UserID: user.ID, EntryIDType: "tr", EntryID: a}).Error)
+	is.NoErr(m.DB().Save(&db.Bookmark{UserID: user.ID, EntryIDType: "tr", EntryID: x}).Error)
+	is.NoErr(m.DB().Save(&db.TrackStar{UserID: user.ID, TrackID: a}).Error)
+	is.NoErr(m.DB().Save(&db.TrackRating{UserID: user.ID, TrackID: b, Rating: 5}).Error)
+
+	m.RemoveAll("artist-0")
+	ctx := m.ScanAndClean()
+	is.Equal(ctx.TrackRefsMissing(), 3+2+1)
+
+	is.NoErr(m.DB().First(playlist, playlist.ID).Error)
+	is.Equal(playlist.GetItems(), []int{x, y})
+	is.Equal(playlist.TrackCount, 2)
+	is.NoErr(m.DB().First(queue, queue.ID).Error)
+	is.Equal(queue.GetItems(), []int{x, y})
+	is.Equal(queue.Current, y) // the next track left
+	is.Equal(queue.Position, 0)
+
+	var bookmarks []*db.Bookmark
+	is.NoErr(m.DB().Find(&bookmarks).Error)
+	is.Equal(len(bookmarks), 1)
+	is.Equal(bookmarks[0].EntryID, x)
+	var stars, ratings int
+	is.NoErr(m.DB().Model(&db.TrackStar{}).Count(&stars).Error)
+	is.NoErr(m.DB().Model(&db.TrackRating{}).Count(&ratings).Error)
+	is.Equal(stars, 0)
+	is.Equal(ratings, 0)
+
+	// nothing is left to clean after
+	ctx = m.ScanAndClean()
+	is.Equal(ctx.TrackRefsMissing(), 0)
+}
+
 func TestGenres(t *testing.T) {
 	t.Parallel()
 	is := is.New(t)
@@ -415,6 +478,227 @@ func TestMultiFolderWithSharedArtist(t *testing.T) {
 	}
 }
 
+func TestArtistAndGenreInsertRace(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	for al := 0; al < 5; al++ {
+		for tr := 0; tr < 5; tr++ {
+			path := fmt.Sprintf("new-artist/album-%d/track-%d.flac", al, tr)
+			m.AddTrack(path)
+			m.SetTags(path, func(tags *mockfs.Tags) error {
+				tags.RawArtist = "new-artist"
+				tags.RawAlbumArtist = "new-artist"
+				tags.RawAlbum = fmt.Sprintf("album-%d", al)
+				tags.RawTitle = fmt.Sprintf("title-%d", tr)
+				tags.RawGenre = "new-genre"
+				return nil
+			})
+		}
+	}
+
+	// someone else inserts each new artist and genre between our lookup and insert.
+	// it's in the scan's transaction, so the retry's rollback undoes it, and it only
+	// races the first time
+	raced := map[string]bool{}
+	m.DB().Callback().Create().Before("gorm:create").Register("test:race", func(scope *gorm.Scope) {
+		table := scope.TableName()
+		if table != "artists" && table != "genres" {
+			return
+		}
+		name, _ := scope.FieldByName("Name")
+		key := table + "/" + name.Field.String()
+		if raced[key] {
+			return
+		}
+		raced[key] = true
+		scope.NewDB().Exec(fmt.Sprintf("INSERT OR IGNORE INTO %s (name) VALUES (?)", table), name.Field.String())
+	})
+	m.ScanAndClean()
+
+	var artists []*db.Artist
+	is.NoErr(m.DB().Find(&artists).Error)
+	is.Equal(len(artists), 1)
+	var genres []*db.Genre
+	is.NoErr(m.DB().Find(&genres).Error)
+	is.Equal(len(genres), 1)
+
+	var orphans int
+	is.NoErr(m.DB().Model(&db.Album{}).Where("tag_title IS NOT NULL AND tag_artist_id<>?", artists[0].ID).Count(&orphans).Error)
+	is.Equal(orphans, 0)
+	var tracks int
+	is.NoErr(m.DB().Model(&db.Track{}).Where("artist_id=?", artists[0].ID).Count(&tracks).Error)
+	is.Equal(tracks, 25)
+}
+
+func TestScanWhileReading(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.NewOnDisk(t)
+	m.AddItems()
+
+	// like people browsing and streaming during the scan
+	done := make(chan struct{})
+	errs := make(chan error, 9)
+	var wg, reading sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		reading.Add(1)
+		go func() {
+			defer wg.Done()
+			var once sync.Once
+			defer once.Do(reading.Done)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var tracks []*db.Track
+				if err := m.DB().Preload("Album").Order("id DESC").Limit(20).Find(&tracks).Error; err != nil {
+					errs <- fmt.Errorf("find tracks: %w", err)
+					return
+				}
+				var albums int
+				if err := m.DB().Model(&db.Album{}).Count(&albums).Error; err != nil {
+					errs <- fmt.Errorf("count albums: %w", err)
+					return
+				}
+				once.Do(reading.Done)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := m.DB().SetSetting("stress", fmt.Sprint(i)); err != nil {
+				errs <- fmt.Errorf("set setting: %w", err)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	reading.Wait()
+	m.ScanAndClean()
+	m.RemoveAll("artist-2")
+	m.ScanAndClean()
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		is.NoErr(err)
+	}
+	var tracks int
+	is.NoErr(m.DB().Model(&db.Track{}).Count(&tracks).Error)
+	is.Equal(tracks, 2*3*3)
+}
+
+func TestReplayGainTags(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	trackGain, albumGain := -6.5, -7.25
+	m.AddTrack("artist-a/album-a/tagged.flac")
+	m.SetTags("artist-a/album-a/tagged.flac", func(tags *mockfs.Tags) error {
+		tags.RawReplayGainTrack = &trackGain
+		tags.RawReplayGainAlbum = &albumGain
+		return nil
+	})
+	m.AddTrack("artist-a/album-a/untagged.flac")
+	m.SetTags("artist-a/album-a/untagged.flac", func(tags *mockfs.Tags) error { return nil })
+	m.ScanAndClean()
+
+	var tagged, untagged db.Track
+	is.NoErr(m.DB().Where("filename=?", "tagged.flac").First(&tagged).Error)
+	is.Equal(*tagged.TagReplayGainTrack, trackGain)
+	is.Equal(*tagged.TagReplayGainAlbum, albumGain)
+	is.NoErr(m.DB().Where("filename=?", "untagged.flac").First(&untagged).Error)
+	is.True(untagged.TagReplayGainTrack == nil)
+	is.True(untagged.TagReplayGainAlbum == nil)
+}
+
+func TestBrainzIDTags(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	m.AddTrack("artist-a/album-a/track.flac")
+	m.SetTags("artist-a/album-a/track.flac", func(tags *mockfs.Tags) error {
+		tags.RawArtist = "artist-a"
+		tags.RawAlbumArtist = "artist-a"
+		tags.RawAlbum = "album-a"
+		tags.RawArtistBrainzID = "artist-mbid"
+		tags.RawAlbumArtistBrainzID = "album-artist-mbid"
+		tags.RawReleaseGroupBrainzID = "release-group-mbid"
+		tags.RawGenres = []string{"gen-a", "gen-b;gen-c"}
+		return nil
+	})
+	m.ScanAndClean()
+
+	var track db.Track
+	is.NoErr(m.DB().Preload("Genres").Where("filename=?", "track.flac").First(&track).Error)
+	is.Equal(track.TagArtistBrainzID, "artist-mbid")
+	is.Equal(len(track.Genres), 3) // each value of a multi-valued tag is split again
+	var album db.Album
+	is.NoErr(m.DB().Where("tag_title=?", "album-a").First(&album).Error)
+	is.Equal(album.TagReleaseGroupBrainzID, "release-group-mbid")
+	var artist db.Artist
+	is.NoErr(m.DB().Where("name=?", "artist-a").First(&artist).Error)
+	is.Equal(artist.BrainzID, "album-artist-mbid")
+}
+
+func TestDynamicRangeTags(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	setDR := func(path string, track, album *int) {
+		m.AddTrack(path)
+		m.SetTags(path, func(tags *mockfs.Tags) error {
+			tags.RawAlbum = filepath.Base(filepath.Dir(path))
+			tags.RawDynamicRange = track
+			tags.RawAlbumDynamicRange = album
+			return nil
+		})
+	}
+	dr := func(v int) *int { return &v }
+	setDR("artist-a/album-a/track-1.flac", dr(8), nil)
+	setDR("artist-a/album-a/track-2.flac", dr(11), nil)
+	setDR("artist-a/album-a/track-3.flac", nil, nil)
+	setDR("artist-a/album-b/track-1.flac", dr(8), dr(12))
+	setDR("artist-a/album-c/track-1.flac", nil, nil)
+	m.ScanAndClean()
+
+	var track db.Track
+	is.NoErr(m.DB().Where("filename=?", "track-2.flac").First(&track).Error)
+	is.Equal(*track.TagDynamicRange, 11)
+
+	var albumA, albumB, albumC db.Album
+	is.NoErr(m.DB().Where("right_path=?", "album-a").First(&albumA).Error)
+	is.Equal(*albumA.DynamicRange, 10) // 9.5 rounded, of the tracks which have one
+	is.True(albumA.DynamicRangeEstimated)
+	is.NoErr(m.DB().Where("right_path=?", "album-b").First(&albumB).Error)
+	is.Equal(*albumB.DynamicRange, 12) // the tag wins
+	is.True(!albumB.DynamicRangeEstimated)
+	is.NoErr(m.DB().Where("right_path=?", "album-c").First(&albumC).Error)
+	is.True(albumC.DynamicRange == nil)
+
+	// the estimate follows the tracks
+	setDR("artist-a/album-a/track-2.flac", dr(6), nil)
+	m.ScanAndClean()
+	is.NoErr(m.DB().Where("right_path=?", "album-a").First(&albumA).Error)
+	is.Equal(*albumA.DynamicRange, 7)
+}
+
 func TestSymlinkedAlbum(t *testing.T) {
 	t.Parallel()
 	is := is.New(t)
@@ -585,3 +869,390 @@ func TestIncrementalScanNoChangeNoUpdatedAt(t *testing.T) {
 
 	is.Equal(albumA.UpdatedAt, albumB.UpdatedAt)
 }
+
+func TestScanLeaseHeldByOther(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	m.AddItems()
+
+	_, err := m.DB().AcquireScanLease(m.TmpDir(), "other-host/1/ab", scanner.LeaseStaleAfter)
+	is.NoErr(err)
+
+	_, err = m.ScanAndCleanErr()
+	is.True(errors.Is(err, scanner.ErrAlreadyScanning)) // lease is held by another process
+
+	var tracks int
+	is.NoErr(m.DB().Model(&db.Track{}).Count(&tracks).Error)
+	is.Equal(tracks, 0) // we didn't scan anything
+
+	lease := m.NewScanner().ActiveLease(m.TmpDir())
+	is.True(lease != nil)
+	is.Equal(lease.Holder, "other-host/1/ab")
+}
+
+func TestWithoutScans(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	m.AddItems()
+	s := m.NewScanner()
+
+	// no scan can start while it runs
+	is.NoErr(s.WithoutScans(func() error {
+		_, err := s.ScanAndClean(scanner.ScanOptions{})
+		is.True(errors.Is(err, scanner.ErrPaused))
+		return nil
+	}))
+
+	// and it doesn't run while another process is scanning
+	_, err := m.DB().AcquireScanLease(m.TmpDir(), "other-host/1/ab", scanner.LeaseStaleAfter)
+	is.NoErr(err)
+	var ran bool
+	err = s.WithoutScans(func() error {
+		ran = true
+		return nil
+	})
+	is.True(errors.Is(err, scanner.ErrAlreadyScanning))
+	is.True(!ran)
+}
+
+func TestScanLeaseStaleTakeover(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	m.AddItems()
+
+	_, err := m.DB().AcquireScanLease(m.TmpDir(), "other-host/1/ab", scanner.LeaseStaleAfter)
+	is.NoErr(err)
+	stale := time.Now().UTC().Add(-2 * scanner.LeaseStaleAfter)
+	is.NoErr(m.DB().Model(&db.ScanLease{}).Update("heartbeat_at", stale).Error)
+
+	m.ScanAndClean()
+
+	var tracks int
+	is.NoErr(m.DB().Model(&db.Track{}).Count(&tracks).Error)
+	is.Equal(tracks, m.NumTracks())                 // we took over and scanned everything
+	is.True(m.DB().GetScanLease(m.TmpDir()) == nil) // and released the lease after
+}
+
+func TestScanLeaseRace(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	m.AddItems()
+
+	scanners := []*scanner.Scanner{m.NewScanner(), m.NewScanner(), m.NewScanner()}
+	errs := make(chan error, len(scanners))
+	var wg sync.WaitGroup
+	for _, s := range scanners {
+		wg.Add(1)
+		go func(s *scanner.Scanner) {
+			defer wg.Done()
+			_, err := s.ScanAndClean(scanner.ScanOptions{IsFull: true})
+			errs <- err
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+
+	var succeeded int
+	for err := range errs {
+		if errors.Is(err, scanner.ErrAlreadyScanning) {
+			continue
+		}
+		is.NoErr(err) // only losing the lease is expected
+		succeeded++
+	}
+	is.True(succeeded > 0)
+
+	var tracks int
+	is.NoErr(m.DB().Model(&db.Track{}).Count(&tracks).Error)
+	is.Equal(tracks, m.NumTracks())
+	is.True(m.DB().GetScanLease(m.TmpDir()) == nil)
+}
+
+func TestTimings(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	m.AddItems()
+	ctx := m.ScanAndClean()
+
+	timings := ctx.Timings()
+	is.Equal(len(timings), 3) // one per artist folder
+	for i := 1; i < len(timings); i++ {
+		is.True(timings[i-1].Total() >= timings[i].Total()) // slowest first
+	}
+	for _, timing := range timings {
+		is.Equal(filepath.Dir(timing.Dir), m.TmpDir())
+		is.Equal(timing.Folders, 4) // the artist folder and its albums
+		is.Equal(timing.Tracks, 9)
+	}
+
+	saved, err := scanner.LastTimings(m.DB())
+	is.NoErr(err)
+	is.Equal(len(saved), len(timings))
+	is.Equal(saved[0].Dir, timings[0].Dir)
+	is.Equal(saved[0].Total(), timings[0].Total())
+}
+
+func TestLibraryStats(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	stats, err := scanner.LastLibraryStats(m.DB())
+	is.NoErr(err)
+	is.True(stats == nil) // before the first scan
+
+	m.AddItems()
+	m.ScanAndClean()
+	stats, err = scanner.LastLibraryStats(m.DB())
+	is.NoErr(err)
+	is.Equal(stats.Version, scanner.LibraryStatsVersion)
+	is.Equal(stats.Tracks, m.NumTracks())
+	is.Equal(stats.Albums, 9) // 3 for each of 3 artists
+	is.Equal(stats.Artists, 3)
+	is.True(!stats.ScannedAt.IsZero())
+
+	var totals struct{ Length, Size int64 }
+	is.NoErr(m.DB().Model(db.Track{}).Select("SUM(length) AS length, SUM(size) AS size").Scan(&totals).Error)
+	is.Equal(stats.Duration, totals.Length)
+	is.Equal(stats.Size, totals.Size)
+
+	// and they're counted again after the next
+	m.RemoveAll("artist-2")
+	m.ScanAndClean()
+	stats, err = scanner.LastLibraryStats(m.DB())
+	is.NoErr(err)
+	is.Equal(stats.Tracks, 18)
+	is.Equal(stats.Albums, 6)
+	is.Equal(stats.Artists, 2)
+}
+
+func TestStartChecksFirst(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.NewWithDirs(t, []string{"a", "b"})
+
+	m.AddItemsPrefix("a")
+	m.ScanAndClean()
+	is.NoErr(os.RemoveAll(filepath.Join(m.TmpDir(), "b")))
+
+	// a missing music dir is reported straight away, rather than scanned as empty
+	s := m.NewScanner()
+	err := s.Start(scanner.ScanOptions{})
+	is.True(errors.Is(err, os.ErrNotExist))
+	is.True(!s.IsScanning())
+	leases, err := m.DB().GetScanLeases()
+	is.NoErr(err)
+	is.Equal(len(leases), 0)
+
+	var tracks int
+	is.NoErr(m.DB().Model(&db.Track{}).Count(&tracks).Error)
+	is.Equal(tracks, m.NumTracks())
+
+	// as is a scan from another process
+	dirB := filepath.Join(m.TmpDir(), "b")
+	_, err = m.DB().AcquireScanLease(dirB, "other-host/1/ab", scanner.LeaseStaleAfter)
+	is.NoErr(err)
+	is.NoErr(os.MkdirAll(dirB, os.ModePerm))
+	err = s.Start(scanner.ScanOptions{})
+	is.True(errors.Is(err, scanner.ErrAlreadyScanning))
+	is.Equal(err.Error(), fmt.Sprintf(`already scanning %q, by "other-host/1/ab"`, dirB))
+	is.True(!s.IsScanning())
+	is.True(m.DB().GetScanLease(filepath.Join(m.TmpDir(), "a")) == nil) // the lease of a was given back
+
+	// once it's clear, the scan runs in the background
+	is.NoErr(m.DB().ReleaseScanLease(dirB, "other-host/1/ab"))
+	is.NoErr(s.Start(scanner.ScanOptions{}))
+	for s.IsScanning() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	leases, err = m.DB().GetScanLeases()
+	is.NoErr(err)
+	is.Equal(len(leases), 0)
+}
+
+func TestScanOneDir(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.NewWithDirs(t, []string{"ssd", "hdd"})
+
+	m.AddItemsPrefix("ssd")
+	m.AddItemsPrefix("hdd")
+	m.ScanAndClean()
+
+	// a scan of one dir only sees, and only cleans, what's in it
+	m.RemoveAll("hdd/artist-2")
+	m.AddItemsPrefix("ssd/new")
+	ctx, err := m.ScanDirsAndCleanErr("ssd")
+	is.NoErr(err)
+	is.Equal(ctx.SeenTracks(), 54) // 27 for each of ssd's sets of items
+	is.Equal(ctx.TracksMissing(), 0)
+
+	var tracks int
+	is.NoErr(m.DB().Model(&db.Track{}).Count(&tracks).Error)
+	is.Equal(tracks, 81) // artist-2 of hdd is still there until hdd is scanned
+
+	ctx, err = m.ScanDirsAndCleanErr("hdd")
+	is.NoErr(err)
+	is.Equal(ctx.TracksMissing(), 9)
+	is.NoErr(m.DB().Model(&db.Track{}).Count(&tracks).Error)
+	is.Equal(tracks, 72)
+
+	// each dir has its own last scan time
+	var folders []*db.MusicFolder
+	is.NoErr(m.DB().Find(&folders).Error)
+	is.Equal(len(folders), 0) // the mock doesn't sync any
+	_, err = m.DB().SyncMusicFolders([]db.MusicFolder{
+		{Path: filepath.Join(m.TmpDir(), "ssd")},
+		{Path: filepath.Join(m.TmpDir(), "hdd")},
+	})
+	is.NoErr(err)
+	before := time.Now()
+	_, err = m.ScanDirsAndCleanErr("hdd")
+	is.NoErr(err)
+	is.NoErr(m.DB().Order("id").Find(&folders).Error)
+	is.True(folders[0].LastScanAt.IsZero())
+	is.True(!folders[1].LastScanAt.Before(before.Truncate(time.Second)))
+
+	_, err = m.ScanDirsAndCleanErr("elsewhere")
+	is.True(errors.Is(err, scanner.ErrUnknownDir))
+}
+
+func TestScanDirsConcurrently(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.NewWithDirs(t, []string{"ssd", "hdd"})
+
+	m.AddItemsPrefix("ssd")
+	m.AddItemsPrefix("hdd")
+	m.ScanAndClean()
+	m.RemoveAll("ssd/artist-0")
+	m.RemoveAll("hdd/artist-1")
+
+	// each scan's seen tracks and clean are its own dir's, so neither cleans
+	// what the other hasn't got to yet
+	var wg sync.WaitGroup
+	ctxs := make([]*scanner.Context, 2)
+	errs := make([]error, 2)
+	for i, dir := range []string{"ssd", "hdd"} {
+		wg.Add(1)
+		go func(i int, dir string) {
+			defer wg.Done()
+			ctxs[i], errs[i] = m.ScanDirsAndCleanErr(dir)
+		}(i, dir)
+	}
+	wg.Wait()
+	for i := range ctxs {
+		is.NoErr(errs[i])
+		is.Equal(ctxs[i].SeenTracks(), 18)
+		is.Equal(ctxs[i].TracksMissing(), 9)
+	}
+
+	var tracks int
+	is.NoErr(m.DB().Model(&db.Track{}).Count(&tracks).Error)
+	is.Equal(tracks, 36)
+	var artists int
+	is.NoErr(m.DB().Model(&db.Artist{}).Count(&artists).Error)
+	is.Equal(artists, 3) // artist-0 and artist-1 are still in the other dir
+	leases, err := m.DB().GetScanLeases()
+	is.NoErr(err)
+	is.Equal(len(leases), 0)
+}
+
+func TestScanSameDirTwice(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.NewWithDirs(t, []string{"ssd", "hdd"})
+
+	m.AddItemsPrefix("ssd")
+	m.AddItemsPrefix("hdd")
+
+	// another process is scanning hdd, so ssd can be scanned but not everything
+	hdd := filepath.Join(m.TmpDir(), "hdd")
+	_, err := m.DB().AcquireScanLease(hdd, "other-host/1/ab", scanner.LeaseStaleAfter)
+	is.NoErr(err)
+	_, err = m.ScanAndCleanErr()
+	is.True(errors.Is(err, scanner.ErrAlreadyScanning))
+	_, err = m.ScanDirsAndCleanErr("hdd")
+	is.True(errors.Is(err, scanner.ErrAlreadyScanning))
+	_, err = m.ScanDirsAndCleanErr("ssd")
+	is.NoErr(err)
+
+	var tracks int
+	is.NoErr(m.DB().Model(&db.Track{}).Count(&tracks).Error)
+	is.Equal(tracks, 27)
+	is.Equal(m.DB().GetScanLease(hdd).Holder, "other-host/1/ab") // theirs is untouched
+}
+
+func TestStop(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	m.AddItems()
+	m.ScanAndClean()
+
+	s := m.NewScanner()
+	is.NoErr(s.Stop(context.Background()))
+	is.NoErr(s.Stop(context.Background())) // twice is fine
+
+	// scans don't start once stopped, so nothing is cleaned
+	m.RemoveAll("artist-2")
+	_, err := s.ScanAndClean(scanner.ScanOptions{})
+	is.True(errors.Is(err, scanner.ErrStopped))
+	is.True(errors.Is(s.Start(scanner.ScanOptions{}), scanner.ErrStopped))
+	is.True(!s.IsScanning())
+
+	var tracks int
+	is.NoErr(m.DB().Model(&db.Track{}).Count(&tracks).Error)
+	is.Equal(tracks, 3*3*3)
+}
+
+func TestFutureModTime(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	m.AddTrack("artist-0/album-0/track-0.flac")
+	m.SetTags("artist-0/album-0/track-0.flac", func(tags *mockfs.Tags) error { return nil })
+	m.SetModTime("artist-0/album-0/track-0.flac", time.Now().AddDate(10, 0, 0))
+
+	before := time.Now()
+	ctx := m.ScanAndClean()
+	is.Equal(ctx.SeenTracksNew(), 1)
+	is.Equal(ctx.FutureFiles(), 1)
+
+	// the scan time is stored instead, for the album and the track
+	after := time.Now()
+	var album db.Album
+	is.NoErr(m.DB().Where("right_path=?", "album-0").Find(&album).Error)
+	is.True(!album.ModifiedAt.Before(before))
+	is.True(!album.ModifiedAt.After(after))
+	var track db.Track
+	is.NoErr(m.DB().Where("album_id=? AND filename=?", album.ID, "track-0.flac").Find(&track).Error)
+	is.True(!track.CreatedAt.Before(before) && !track.CreatedAt.After(after))
+	is.True(!track.UpdatedAt.Before(before) && !track.UpdatedAt.After(after))
+
+	// not scanned again, even though it looks newer than the last scan
+	ctx = m.ScanAndClean()
+	is.Equal(ctx.SeenTracksNew(), 0)
+	is.Equal(ctx.FutureFiles(), 1)
+
+	// dates from before clamping are repaired
+	future := time.Now().AddDate(10, 0, 0)
+	is.NoErr(m.DB().Model(db.Album{}).Where("id=?", album.ID).UpdateColumns(db.Album{CreatedAt: future, ModifiedAt: future}).Error)
+	ctx = m.ScanAndClean()
+	is.Equal(ctx.TimesRepaired(), 2)
+	is.NoErr(m.DB().Where("id=?", album.ID).Find(&album).Error)
+	is.True(!album.CreatedAt.After(time.Now()))
+	is.True(!album.ModifiedAt.After(time.Now()))
+}
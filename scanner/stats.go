@@ -0,0 +1,95 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+)
+
+const (
+	// SettingLibraryStats has the library's totals as of the last scan, as json
+	SettingLibraryStats = "library_stats"
+	// LibraryStatsVersion changes if the fields of LibraryStats change in a way
+	// that would break something reading them
+	LibraryStatsVersion = 1
+)
+
+// LibraryStats are the library's totals, counted at the end of each scan so
+// that reading them costs nothing. Duration is in seconds, and Size in bytes
+type LibraryStats struct {
+	Version   int       `json:"version"`
+	Tracks    int       `json:"tracks"`
+	Albums    int       `json:"albums"`
+	Artists   int       `json:"artists"`
+	Genres    int       `json:"genres"`
+	Playlists int       `json:"playlists"`
+	Duration  int64     `json:"duration"`
+	Size      int64     `json:"size"`
+	ScannedAt time.Time `json:"scannedAt"`
+}
+
+// countLibrary counts the library's totals after a scan. the scan may only have
+// been of some of the music dirs, so everything is counted from the db
+func countLibrary(dbc *db.DB, scannedAt time.Time) (*LibraryStats, error) {
+	stats := &LibraryStats{
+		Version:   LibraryStatsVersion,
+		ScannedAt: scannedAt,
+	}
+	if err := dbc.Model(db.Track{}).Count(&stats.Tracks).Error; err != nil {
+		return nil, fmt.Errorf("count tracks: %w", err)
+	}
+	var totals struct {
+		Duration int64
+		Size     int64
+	}
+	err := dbc.
+		Model(db.Track{}).
+		Select("COALESCE(SUM(length), 0) AS duration, COALESCE(SUM(size), 0) AS size").
+		Scan(&totals).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("sum tracks: %w", err)
+	}
+	stats.Duration, stats.Size = totals.Duration, totals.Size
+	// folders without tags, like an artist's folder of albums, aren't albums
+	if err := dbc.Model(db.Album{}).Where("tag_artist_id IS NOT NULL").Count(&stats.Albums).Error; err != nil {
+		return nil, fmt.Errorf("count albums: %w", err)
+	}
+	if err := dbc.Model(db.Artist{}).Count(&stats.Artists).Error; err != nil {
+		return nil, fmt.Errorf("count artists: %w", err)
+	}
+	if err := dbc.Model(db.Genre{}).Count(&stats.Genres).Error; err != nil {
+		return nil, fmt.Errorf("count genres: %w", err)
+	}
+	if err := dbc.Model(db.Playlist{}).Count(&stats.Playlists).Error; err != nil {
+		return nil, fmt.Errorf("count playlists: %w", err)
+	}
+	return stats, nil
+}
+
+func saveLibraryStats(dbc *db.DB, stats *LibraryStats) error {
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	return dbc.SetSetting(SettingLibraryStats, string(data))
+}
+
+// LastLibraryStats returns the library's totals as of the last scan, or nil if
+// there hasn't been one
+func LastLibraryStats(dbc *db.DB) (*LibraryStats, error) {
+	data, err := dbc.GetSetting(SettingLibraryStats)
+	if err != nil {
+		return nil, fmt.Errorf("get setting: %w", err)
+	}
+	if data == "" {
+		return nil, nil
+	}
+	var stats LibraryStats
+	if err := json.Unmarshal([]byte(data), &stats); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	return &stats, nil
+}
@@ -0,0 +1,235 @@
+package tags
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+var errID3Invalid = errors.New("invalid id3v2 tag")
+
+// id3Frames maps id3v2 frames to the same keys taglib uses, so that the
+// Tagger's getters work for both. v2.2 frames have 3 character ids
+var id3Frames = map[string]string{
+	"TIT2": "title", "TT2": "title",
+	"TPE1": "artist", "TP1": "artist",
+	"TALB": "album", "TAL": "album",
+	"TPE2": "albumartist", "TP2": "albumartist",
+	"TCON": "genre", "TCO": "genre",
+	"TRCK": "tracknumber", "TRK": "tracknumber",
+	"TPOS": "discnumber", "TPA": "discnumber",
+	"TDRC": "date", "TYER": "date", "TYE": "date",
+	"TDOR": "originaldate", "TORY": "originaldate", "TOR": "originaldate",
+}
+
+// id3UserFrames maps the descriptions of TXXX frames, as picard writes them
+var id3UserFrames = map[string]string{
+	"musicbrainz album id":         "musicbrainz_albumid",
+	"musicbrainz album type":       "musicbrainz_albumtype",
+	"musicbrainz artist id":        "musicbrainz_artistid",
+	"musicbrainz album artist id":  "musicbrainz_albumartistid",
+	"musicbrainz release group id": "musicbrainz_releasegroupid",
+	"musicbrainz release track id": "musicbrainz_releasetrackid",
+	"releasetype":                  "releasetype",
+	"replaygain_track_gain":        "replaygain_track_gain",
+	"replaygain_album_gain":        "replaygain_album_gain",
+}
+
+// id3v23Joined are the keys whose values v2.3 tags join with "/", since v2.3
+// has no separator of its own. text like artist names can have a "/" in it,
+// so only ids are split
+var id3v23Joined = map[string]bool{
+	"musicbrainz_artistid":      true,
+	"musicbrainz_albumartistid": true,
+}
+
+const id3MusicBrainzOwner = "http://musicbrainz.org"
+
+// id3v2MaxRead is as much of a tag as we read. the size is from the file
+// so it can't be trusted, and anything past this is usually embedded art.
+// the text frames come first, so they're still found in a truncated tag
+const id3v2MaxRead = 4 * 1024 * 1024
+
+// parseID3v2 reads the text frames we use from an id3v2.2, 2.3, or 2.4 tag,
+// with each of a frame's values
+func parseID3v2(data []byte) (map[string][]string, error) {
+	if len(data) < 10 || string(data[:3]) != "ID3" {
+		return nil, errID3Invalid
+	}
+	version, flags := data[3], data[5]
+	size := int(syncsafe(data[6:10]))
+	data = data[10:]
+	if size > len(data) {
+		size = len(data)
+	}
+	data = data[:size]
+	if flags&0x80 != 0 {
+		// unsynchronisation, applied to the whole tag
+		data = bytes.ReplaceAll(data, []byte{0xff, 0x00}, []byte{0xff})
+	}
+	if flags&0x40 != 0 && version >= 3 {
+		if len(data) < 4 {
+			return nil, errID3Invalid
+		}
+		extSize := int(binary.BigEndian.Uint32(data[:4])) + 4 // v2.3 doesn't count the size itself
+		if version == 4 {
+			extSize = int(syncsafe(data[:4]))
+		}
+		if extSize > len(data) {
+			return nil, errID3Invalid
+		}
+		data = data[extSize:]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	raw := map[string][]string{}
+	for len(data) >= headerLen && data[0] != 0 {
+		id := string(data[:idLen])
+		var frameSize int
+		switch version {
+		case 2:
+			frameSize = int(data[3])<<16 | int(data[4])<<8 | int(data[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(data[4:8]))
+		default:
+			frameSize = int(syncsafe(data[4:8]))
+		}
+		if frameSize > len(data)-headerLen {
+			break
+		}
+		body := data[headerLen : headerLen+frameSize]
+		data = data[headerLen+frameSize:]
+
+		switch id {
+		case "TXXX", "TXX":
+			desc, values := id3UserText(body)
+			key, ok := id3UserFrames[strings.ToLower(desc)]
+			if !ok {
+				continue
+			}
+			if version < 4 && id3v23Joined[key] {
+				values = splitJoined(values, "/")
+			}
+			if len(values) > 0 {
+				raw[key] = values
+			}
+		case "UFID", "UFI":
+			if owner := bytes.SplitN(body, []byte{0}, 2); len(owner) == 2 && string(owner[0]) == id3MusicBrainzOwner {
+				raw["musicbrainz_trackid"] = []string{string(owner[1])}
+			}
+		default:
+			key, ok := id3Frames[id]
+			if !ok {
+				continue
+			}
+			if _, ok := raw[key]; ok {
+				continue
+			}
+			if values := id3Text(body); len(values) > 0 {
+				raw[key] = values
+			}
+		}
+	}
+	for i, genre := range raw["genre"] {
+		raw["genre"][i] = id3Genre(genre)
+	}
+	return raw, nil
+}
+
+func splitJoined(values []string, sep string) []string {
+	var split []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, sep) {
+			if part = strings.TrimSpace(part); part != "" {
+				split = append(split, part)
+			}
+		}
+	}
+	return split
+}
+
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7f)<<21 | uint32(b[1]&0x7f)<<14 | uint32(b[2]&0x7f)<<7 | uint32(b[3]&0x7f)
+}
+
+// id3Text decodes a text frame's values, which v2.4 separates with nulls
+func id3Text(body []byte) []string {
+	if len(body) < 1 {
+		return nil
+	}
+	return nonEmpty(id3Decode(body[0], body[1:]))
+}
+
+// id3UserText decodes a TXXX frame's description, and its values after it
+func id3UserText(body []byte) (string, []string) {
+	if len(body) < 1 {
+		return "", nil
+	}
+	values := id3Decode(body[0], body[1:])
+	if len(values) < 2 {
+		return "", nil
+	}
+	return values[0], nonEmpty(values[1:])
+}
+
+func nonEmpty(values []string) []string {
+	var ret []string
+	for _, value := range values {
+		if value != "" {
+			ret = append(ret, value)
+		}
+	}
+	return ret
+}
+
+// id3Decode decodes text in one of id3v2's encodings, and splits it on nulls
+func id3Decode(encoding byte, data []byte) []string {
+	var text string
+	switch encoding {
+	case 0: // iso-8859-1
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		text = string(runes)
+	case 1, 2: // utf-16 with a bom, or big endian without
+		var order binary.ByteOrder = binary.BigEndian
+		units := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			switch {
+			case data[i] == 0xff && data[i+1] == 0xfe:
+				order = binary.LittleEndian
+				continue
+			case data[i] == 0xfe && data[i+1] == 0xff:
+				order = binary.BigEndian
+				continue
+			}
+			units = append(units, order.Uint16(data[i:i+2]))
+		}
+		text = string(utf16.Decode(units))
+	default: // utf-8
+		text = string(data)
+	}
+	values := strings.Split(strings.TrimRight(text, "\x00"), "\x00")
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return values
+}
+
+var id3GenreRef = regexp.MustCompile(`^\(\d+\)`)
+
+// id3Genre drops an id3v1 genre reference, eg. "(17)Rock", when there's a name
+// after it
+func id3Genre(genre string) string {
+	if name := id3GenreRef.ReplaceAllString(genre, ""); name != "" {
+		return name
+	}
+	return genre
+}
@@ -0,0 +1,248 @@
+package tags
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/nicksellen/audiotags"
+)
+
+var (
+	errNotWAV  = errors.New("not a wav file")
+	errNotAIFF = errors.New("not an aiff file")
+	errNoAudio = errors.New("no audio format chunk")
+)
+
+// wavInfo maps the RIFF INFO chunks of a wav file, which are only used when
+// the file has no id3 chunk
+var wavInfo = map[string]string{
+	"INAM": "title",
+	"IART": "artist",
+	"IPRD": "album",
+	"IGNR": "genre",
+	"ITRK": "tracknumber",
+	"IPRT": "tracknumber",
+	"ICRD": "date",
+}
+
+// chunk is a chunk of a RIFF or AIFF container, which are the same apart from
+// the byte order of the size
+type chunk struct {
+	id   string
+	size int64
+}
+
+func readChunkHeader(r io.Reader, order binary.ByteOrder) (chunk, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return chunk{}, err
+	}
+	return chunk{id: string(header[:4]), size: int64(order.Uint32(header[4:]))}, nil
+}
+
+// walkChunks calls fn for each chunk in r, which is positioned just after the
+// container's header. fn may read from r, the rest of the chunk is skipped
+func walkChunks(r io.ReadSeeker, order binary.ByteOrder, fn func(c chunk, r io.Reader) error) error {
+	for {
+		c, err := readChunkHeader(r, order)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read chunk header: %w", err)
+		}
+		start, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("seek: %w", err)
+		}
+		if err := fn(c, io.LimitReader(r, c.size)); err != nil {
+			return fmt.Errorf("chunk %q: %w", c.id, err)
+		}
+		// chunks are padded to an even size
+		if _, err := r.Seek(start+c.size+c.size%2, io.SeekStart); err != nil {
+			return fmt.Errorf("seek: %w", err)
+		}
+	}
+}
+
+func readWAVFile(abspath string) (*Tagger, error) {
+	f, err := os.Open(abspath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readWAV(f)
+}
+
+// readWAV reads tags from a wav file's id3 chunk, else its INFO list, and
+// works out the length and bitrate from its format and data chunks
+func readWAV(r io.ReadSeeker) (*Tagger, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WAVE" {
+		return nil, errNotWAV
+	}
+	var id3, info map[string][]string
+	var byteRate, sampleRate, channels, dataSize int64
+	err := walkChunks(r, binary.LittleEndian, func(c chunk, r io.Reader) error {
+		switch c.id {
+		case "fmt ":
+			var fmtChunk struct {
+				Format, Channels     uint16
+				SampleRate, ByteRate uint32
+			}
+			if err := binary.Read(r, binary.LittleEndian, &fmtChunk); err != nil {
+				return err
+			}
+			channels, sampleRate, byteRate = int64(fmtChunk.Channels), int64(fmtChunk.SampleRate), int64(fmtChunk.ByteRate)
+		case "data":
+			dataSize = c.size
+		case "id3 ", "ID3 ":
+			data, err := io.ReadAll(io.LimitReader(r, id3v2MaxRead))
+			if err != nil {
+				return err
+			}
+			// a broken tag shouldn't stop the file being scanned, we still
+			// have the INFO list
+			id3, _ = parseID3v2(data)
+		case "LIST":
+			list, err := readWAVInfo(r)
+			if err != nil {
+				return err
+			}
+			if list != nil {
+				info = list
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if byteRate == 0 {
+		return nil, errNoAudio
+	}
+	raw := id3
+	if len(raw) == 0 {
+		raw = info
+	}
+	return &Tagger{raw: raw, props: &audiotags.AudioProperties{
+		Length:     int(dataSize / byteRate),
+		Bitrate:    int(byteRate * 8 / 1000),
+		Samplerate: int(sampleRate),
+		Channels:   int(channels),
+	}}, nil
+}
+
+func readWAVInfo(r io.Reader) (map[string][]string, error) {
+	var listType [4]byte
+	if _, err := io.ReadFull(r, listType[:]); err != nil {
+		return nil, err
+	}
+	if string(listType[:]) != "INFO" {
+		return nil, nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string][]string{}
+	for len(data) >= 8 {
+		id, size := string(data[:4]), int(binary.LittleEndian.Uint32(data[4:8]))
+		data = data[8:]
+		if size > len(data) {
+			break
+		}
+		value := strings.TrimSpace(strings.TrimRight(string(data[:size]), "\x00"))
+		if key, ok := wavInfo[id]; ok && value != "" {
+			if _, ok := raw[key]; !ok {
+				raw[key] = []string{value}
+			}
+		}
+		if size += size % 2; size > len(data) {
+			break
+		}
+		data = data[size:]
+	}
+	return raw, nil
+}
+
+// aiffComm is the start of the common chunk, which has the audio format
+type aiffComm struct {
+	Channels   int16
+	Frames     uint32
+	SampleSize int16
+	SampleRate [10]byte
+}
+
+func readAIFFFile(abspath string) (*Tagger, error) {
+	f, err := os.Open(abspath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readAIFF(f)
+}
+
+// readAIFF reads tags from an aiff file's id3 chunk, and works out the length
+// and bitrate from its common chunk
+func readAIFF(r io.ReadSeeker) (*Tagger, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:4]) != "FORM" {
+		return nil, errNotAIFF
+	}
+	if formType := string(header[8:]); formType != "AIFF" && formType != "AIFC" {
+		return nil, errNotAIFF
+	}
+	var raw map[string][]string
+	var comm *aiffComm
+	err := walkChunks(r, binary.BigEndian, func(c chunk, r io.Reader) error {
+		switch c.id {
+		case "COMM":
+			comm = &aiffComm{}
+			return binary.Read(r, binary.BigEndian, comm)
+		case "ID3 ", "id3 ":
+			data, err := io.ReadAll(io.LimitReader(r, id3v2MaxRead))
+			if err != nil {
+				return err
+			}
+			raw, _ = parseID3v2(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if comm == nil {
+		return nil, errNoAudio
+	}
+	sampleRate := extendedFloat(comm.SampleRate)
+	if sampleRate == 0 {
+		return nil, errNoAudio
+	}
+	return &Tagger{raw: raw, props: &audiotags.AudioProperties{
+		Length:     int(float64(comm.Frames) / sampleRate),
+		Bitrate:    int(sampleRate * float64(comm.Channels) * float64(comm.SampleSize) / 1000),
+		Samplerate: int(sampleRate),
+		Channels:   int(comm.Channels),
+	}}, nil
+}
+
+// extendedFloat decodes the 80 bit ieee 754 extended precision float which
+// aiff uses for its sample rate
+func extendedFloat(b [10]byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(b[:2]) & 0x7fff)
+	mantissa := binary.BigEndian.Uint64(b[2:])
+	if exponent == 0 && mantissa == 0 {
+		return 0
+	}
+	value := math.Ldexp(float64(mantissa), exponent-16383-63)
+	if b[0]&0x80 != 0 {
+		value = -value
+	}
+	return value
+}
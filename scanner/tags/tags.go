@@ -1,6 +1,10 @@
 package tags
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -10,19 +14,69 @@ import (
 type TagReader struct{}
 
 func (*TagReader) Read(abspath string) (Parser, error) {
-	raw, props, err := audiotags.Read(abspath)
-	return &Tagger{raw, props}, err
+	// taglib doesn't read the id3 chunks of these, so we do it ourselves
+	switch strings.ToLower(filepath.Ext(abspath)) {
+	case ".wav":
+		return readWAVFile(abspath)
+	case ".aif", ".aiff":
+		return readAIFFFile(abspath)
+	}
+	tags, props, err := audiotags.Read(abspath)
+	if err != nil {
+		return &Tagger{props: props}, err
+	}
+	// taglib only gives the last of a frame's values, so mp3s' id3v2 tags are
+	// read again for all of them
+	raw := make(map[string][]string, len(tags))
+	for key, value := range tags {
+		raw[key] = []string{value}
+	}
+	if strings.EqualFold(filepath.Ext(abspath), ".mp3") {
+		id3, err := readID3v2File(abspath)
+		if err != nil {
+			return nil, fmt.Errorf("read id3v2: %w", err)
+		}
+		for key, values := range id3 {
+			raw[key] = values
+		}
+	}
+	return &Tagger{raw, props}, nil
+}
+
+// readID3v2File reads the id3v2 tag at the start of a file, if it has one
+func readID3v2File(abspath string) (map[string][]string, error) {
+	f, err := os.Open(abspath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var header [10]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil || string(header[:3]) != "ID3" {
+		return nil, nil
+	}
+	size := int(syncsafe(header[6:10]))
+	if size > id3v2MaxRead {
+		size = id3v2MaxRead
+	}
+	data := make([]byte, 10+size)
+	copy(data, header[:])
+	// a broken tag shouldn't stop the file being scanned, taglib's are kept
+	if _, err := io.ReadFull(f, data[10:]); err != nil {
+		return nil, nil
+	}
+	raw, _ := parseID3v2(data)
+	return raw, nil
 }
 
 type Tagger struct {
-	raw   map[string]string
+	raw   map[string][]string
 	props *audiotags.AudioProperties
 }
 
 func (t *Tagger) first(keys ...string) string {
 	for _, key := range keys {
-		if val, ok := t.raw[key]; ok {
-			return val
+		if vals := t.raw[key]; len(vals) > 0 {
+			return vals[0]
 		}
 	}
 	return ""
@@ -35,12 +89,42 @@ func (t *Tagger) Album() string         { return t.first("album") }
 func (t *Tagger) AlbumArtist() string   { return t.first("albumartist", "album artist") }
 func (t *Tagger) AlbumBrainzID() string { return t.first("musicbrainz_albumid") }
 func (t *Tagger) Genre() string         { return t.first("genre") }
+func (t *Tagger) Genres() []string      { return t.raw["genre"] }
 func (t *Tagger) TrackNumber() int      { return intSep(t.first("tracknumber"), "/") } // eg. 5/12
 func (t *Tagger) DiscNumber() int       { return intSep(t.first("discnumber"), "/") }  // eg. 1/2
 func (t *Tagger) Length() int           { return t.props.Length }
 func (t *Tagger) Bitrate() int          { return t.props.Bitrate }
+func (t *Tagger) ReleaseType() string   { return t.first("releasetype", "musicbrainz_albumtype") }
 func (t *Tagger) Year() int             { return intSep(t.first("originaldate", "date", "year"), "-") }
 
+// ArtistBrainzID is the first of the track artists' ids, AlbumArtistBrainzID
+// the first of the album artists', and ReleaseGroupBrainzID the album's release
+// group's
+func (t *Tagger) ArtistBrainzID() string       { return t.first("musicbrainz_artistid") }
+func (t *Tagger) AlbumArtistBrainzID() string  { return t.first("musicbrainz_albumartistid") }
+func (t *Tagger) ReleaseGroupBrainzID() string { return t.first("musicbrainz_releasegroupid") }
+
+// ReplayGainTrack is the track's replaygain in dB, or nil if it isn't tagged
+func (t *Tagger) ReplayGainTrack() *float64 {
+	return replayGain(t.first("replaygain_track_gain"), t.first("r128_track_gain"))
+}
+
+// ReplayGainAlbum is the album's replaygain in dB, or nil if it isn't tagged
+func (t *Tagger) ReplayGainAlbum() *float64 {
+	return replayGain(t.first("replaygain_album_gain"), t.first("r128_album_gain"))
+}
+
+// DynamicRange is the track's DR value, as written by the foobar2000 DR meter,
+// or nil if it isn't tagged
+func (t *Tagger) DynamicRange() *int {
+	return dynamicRange(t.first("dynamic range", "dynamic_range", "dr"))
+}
+
+// AlbumDynamicRange is the album's DR value, or nil if it isn't tagged
+func (t *Tagger) AlbumDynamicRange() *int {
+	return dynamicRange(t.first("album dynamic range", "album_dynamic_range"))
+}
+
 func (t *Tagger) SomeAlbum() string  { return first("Unknown Album", t.Album()) }
 func (t *Tagger) SomeArtist() string { return first("Unknown Artist", t.Artist()) }
 func (t *Tagger) SomeAlbumArtist() string {
@@ -69,6 +153,34 @@ func intSep(in, sep string) int {
 	return out
 }
 
+// replayGain parses a gain like "-6.54 dB". opus files have an r128 gain
+// instead, which is in 1/256 dB relative to -23 LUFS. replaygain's reference
+// is 5 dB louder
+func replayGain(rg, r128 string) *float64 {
+	if rg = strings.TrimSpace(rg); rg != "" {
+		rg = strings.TrimSpace(strings.TrimSuffix(strings.ToLower(rg), "db"))
+		if gain, err := strconv.ParseFloat(rg, 64); err == nil {
+			return &gain
+		}
+	}
+	if r128 != "" {
+		if q78, err := strconv.Atoi(strings.TrimSpace(r128)); err == nil {
+			gain := float64(q78)/256 + 5
+			return &gain
+		}
+	}
+	return nil
+}
+
+// dynamicRange parses a DR value like "DR12" or "12"
+func dynamicRange(dr string) *int {
+	dr = strings.TrimSpace(strings.TrimPrefix(strings.ToLower(strings.TrimSpace(dr)), "dr"))
+	if value, err := strconv.Atoi(dr); err == nil && value >= 0 {
+		return &value
+	}
+	return nil
+}
+
 type Reader interface {
 	Read(abspath string) (Parser, error)
 }
@@ -80,12 +192,23 @@ type Parser interface {
 	Album() string
 	AlbumArtist() string
 	AlbumBrainzID() string
+	ArtistBrainzID() string
+	AlbumArtistBrainzID() string
+	ReleaseGroupBrainzID() string
 	Genre() string
+	// Genres is each of the genre tag's values, for tags which can have more
+	// than one
+	Genres() []string
 	TrackNumber() int
 	DiscNumber() int
 	Length() int
 	Bitrate() int
 	Year() int
+	ReleaseType() string
+	ReplayGainTrack() *float64
+	ReplayGainAlbum() *float64
+	DynamicRange() *int
+	AlbumDynamicRange() *int
 
 	SomeAlbum() string
 	SomeArtist() string
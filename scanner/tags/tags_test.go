@@ -0,0 +1,212 @@
+package tags
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestReadWAVID3(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	p, err := (&TagReader{}).Read("testdata/id3.wav")
+	is.NoErr(err)
+	is.Equal(p.Title(), "id3 title") // id3 is preferred over INFO
+	is.Equal(p.Artist(), "id3 artist")
+	is.Equal(p.Album(), "id3 album")
+	is.Equal(p.AlbumArtist(), "id3 album artist")
+	is.Equal(p.TrackNumber(), 3)
+	is.Equal(p.DiscNumber(), 1)
+	is.Equal(p.Year(), 2019)
+	is.Equal(p.Genre(), "Ambient")
+	is.Equal(p.AlbumBrainzID(), "b1f4a6ab-0000-4000-8000-000000000001")
+	is.Equal(p.BrainzID(), "0f6ab3a4-0000-4000-8000-000000000002")
+	is.Equal(p.Length(), 2)
+	is.Equal(p.Bitrate(), 128) // 8khz, 16 bit, mono
+
+	tagger := p.(*Tagger)
+	is.Equal(tagger.props.Samplerate, 8000)
+	is.Equal(tagger.props.Channels, 1)
+}
+
+func TestReadWAVInfo(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	p, err := (&TagReader{}).Read("testdata/info.wav")
+	is.NoErr(err)
+	is.Equal(p.Title(), "info title")
+	is.Equal(p.Artist(), "info artist")
+	is.Equal(p.Album(), "info album")
+	is.Equal(p.SomeAlbumArtist(), "info artist")
+	is.Equal(p.Genre(), "Drone")
+	is.Equal(p.TrackNumber(), 4)
+	is.Equal(p.Year(), 2018)
+	is.Equal(p.Length(), 3)
+	is.Equal(p.Bitrate(), 64) // 8khz, 8 bit, mono
+}
+
+func TestReadAIFF(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	p, err := (&TagReader{}).Read("testdata/id3.aiff")
+	is.NoErr(err)
+	is.Equal(p.Title(), "aiff tïtle") // utf-16
+	is.Equal(p.Artist(), "aiff artist")
+	is.Equal(p.Album(), "aiff album")
+	is.Equal(p.TrackNumber(), 5)
+	is.Equal(p.Year(), 2017)
+	is.Equal(p.Genre(), "Rock") // without the id3v1 reference
+	is.Equal(p.Length(), 1)
+	is.Equal(p.Bitrate(), 256) // 8khz, 16 bit, stereo
+
+	tagger := p.(*Tagger)
+	is.Equal(tagger.props.Samplerate, 8000)
+	is.Equal(tagger.props.Channels, 2)
+}
+
+func TestReadNotRIFF(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	_, err := (&TagReader{}).Read("testdata/id3.aiff.wav")
+	is.True(err != nil) // missing
+	_, err = readAIFFFile("testdata/id3.wav")
+	is.Equal(err, errNotAIFF)
+	_, err = readWAVFile("testdata/id3.aiff")
+	is.Equal(err, errNotWAV)
+}
+
+func TestExtendedFloat(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	// 44100 and 48000, as written by common encoders
+	is.Equal(extendedFloat([10]byte{0x40, 0x0e, 0xac, 0x44}), 44100.0)
+	is.Equal(extendedFloat([10]byte{0x40, 0x0e, 0xbb, 0x80}), 48000.0)
+	is.Equal(extendedFloat([10]byte{}), 0.0)
+}
+
+func TestDynamicRange(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		dr  string
+		exp int
+		ok  bool
+	}{
+		{"DR12", 12, true},
+		{"dr 7", 7, true},
+		{" 14 ", 14, true},
+		{"DR-", 0, false},
+		{"", 0, false},
+	}
+	for _, tc := range tcs {
+		got := dynamicRange(tc.dr)
+		switch {
+		case !tc.ok && got != nil:
+			t.Errorf("dynamic range of %q = %v, want nil", tc.dr, *got)
+		case tc.ok && (got == nil || *got != tc.exp):
+			t.Errorf("dynamic range of %q = %v, want %v", tc.dr, got, tc.exp)
+		}
+	}
+}
+
+func TestReplayGain(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		rg, r128 string
+		exp      float64
+		ok       bool
+	}{
+		{"-6.54 dB", "", -6.54, true},
+		{"+2.10 DB", "", 2.1, true},
+		{" -1.5dB ", "", -1.5, true},
+		{"", "-2560", -5, true}, // -10 dB from -23 LUFS
+		{"-6.54 dB", "-2560", -6.54, true},
+		{"loud", "", 0, false},
+		{"", "", 0, false},
+	}
+	for _, tc := range tcs {
+		got := replayGain(tc.rg, tc.r128)
+		switch {
+		case !tc.ok && got != nil:
+			t.Errorf("replay gain of %q, %q = %v, want nil", tc.rg, tc.r128, *got)
+		case tc.ok && (got == nil || *got != tc.exp):
+			t.Errorf("replay gain of %q, %q = %v, want %v", tc.rg, tc.r128, got, tc.exp)
+		}
+	}
+}
+
+func TestReadID3v24Multiple(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	raw, err := readID3v2File("testdata/picard_v24.mp3")
+	is.NoErr(err)
+	p := &Tagger{raw: raw}
+	is.Equal(p.Title(), "picard title")
+	is.Equal(p.Artist(), "Artist One") // the first of null separated values
+	is.Equal(p.AlbumArtist(), "AC/DC")
+	is.Equal(p.Genres(), []string{"Rock", "Shoegaze"})
+	is.Equal(p.Genre(), "Rock")
+	is.Equal(p.TrackNumber(), 2)
+	is.Equal(p.Year(), 2001)
+	is.Equal(p.ArtistBrainzID(), "a74b1b7f-71a5-4011-9441-d0b5e4122711")
+	is.Equal(p.AlbumArtistBrainzID(), "a74b1b7f-71a5-4011-9441-d0b5e4122711")
+	is.Equal(p.ReleaseGroupBrainzID(), "3f2c4e52-0000-4000-8000-000000000003")
+	is.Equal(p.AlbumBrainzID(), "b1f4a6ab-0000-4000-8000-000000000004")
+	is.Equal(p.BrainzID(), "0f6ab3a4-0000-4000-8000-000000000005")
+
+	is.Equal(p.raw["musicbrainz_artistid"], []string{
+		"a74b1b7f-71a5-4011-9441-d0b5e4122711",
+		"8bfac288-ccc5-448d-9573-c33ea2aa5c30",
+	})
+}
+
+func TestReadID3v23Joined(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	raw, err := readID3v2File("testdata/picard_v23.mp3")
+	is.NoErr(err)
+	p := &Tagger{raw: raw}
+	is.Equal(p.Title(), "picard title") // utf-16
+	is.Equal(p.Artist(), "Artist One & Artist Two")
+	is.Equal(p.AlbumArtist(), "AC/DC") // names aren't split on "/"
+	is.Equal(p.Genres(), []string{"Rock"})
+	is.Equal(p.Year(), 2001)
+	is.Equal(p.ArtistBrainzID(), "a74b1b7f-71a5-4011-9441-d0b5e4122711")
+	is.Equal(p.ReleaseGroupBrainzID(), "3f2c4e52-0000-4000-8000-000000000003")
+	is.Equal(p.BrainzID(), "0f6ab3a4-0000-4000-8000-000000000005")
+
+	is.Equal(p.raw["musicbrainz_artistid"], []string{
+		"a74b1b7f-71a5-4011-9441-d0b5e4122711",
+		"8bfac288-ccc5-448d-9573-c33ea2aa5c30",
+	})
+}
+
+func TestReadID3v2Oversized(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	// the header says the tag is 256MB, only the start of it is read
+	title := append([]byte{3}, "big title"...)
+	data := append([]byte("ID3"), 4, 0, 0, 0x7f, 0x7f, 0x7f, 0x7f)
+	data = append(data, "TIT2"...)
+	data = append(data, 0, 0, 0, byte(len(title)), 0, 0)
+	data = append(data, title...)
+	data = append(data, "APIC"...)
+	data = append(data, 0x7f, 0x7f, 0x7f, 0x7f, 0, 0)
+	data = append(data, make([]byte, id3v2MaxRead)...)
+
+	path := filepath.Join(t.TempDir(), "big.mp3")
+	is.NoErr(os.WriteFile(path, data, 0o600))
+	raw, err := readID3v2File(path)
+	is.NoErr(err)
+	p := &Tagger{raw: raw}
+	is.Equal(p.Title(), "big title")
+}
@@ -0,0 +1,125 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+)
+
+const (
+	// SettingLastTiming has the slowest directories of the last scan of each music
+	// dir, as json
+	SettingLastTiming = "last_scan_timing"
+	// only the slowest are kept, the rest are usually noise
+	lastTimingKeep = 20
+)
+
+// DirTiming is where the time went while scanning a top level directory of a
+// music dir. Walk is time spent listing and stating files, Tags is time spent
+// reading tags, and DB is everything else, which is mostly writing the database
+type DirTiming struct {
+	Dir     string        `json:"dir"`
+	Folders int           `json:"folders"`
+	Tracks  int           `json:"tracks"`
+	Walk    time.Duration `json:"walk"`
+	Tags    time.Duration `json:"tags"`
+	DB      time.Duration `json:"db"`
+}
+
+func (t *DirTiming) Total() time.Duration {
+	return t.Walk + t.Tags + t.DB
+}
+
+// timingFor finds the timing for the top level directory which absPath is in.
+// paths are only split, so there's nothing extra to stat
+func (c *Context) timingFor(musicDir, absPath string) *DirTiming {
+	relPath, _ := filepath.Rel(musicDir, absPath)
+	top := strings.SplitN(filepath.ToSlash(relPath), "/", 2)[0]
+	dir := filepath.Join(musicDir, top)
+	timing, ok := c.timings[dir]
+	if !ok {
+		timing = &DirTiming{Dir: dir}
+		c.timings[dir] = timing
+	}
+	return timing
+}
+
+// Timings returns the time spent in each top level directory, slowest first
+func (c *Context) Timings() []*DirTiming {
+	timings := make([]*DirTiming, 0, len(c.timings))
+	for _, timing := range c.timings {
+		timings = append(timings, timing)
+	}
+	sortTimings(timings)
+	return timings
+}
+
+// sortTimings sorts the slowest first
+func sortTimings(timings []*DirTiming) {
+	sort.Slice(timings, func(i, j int) bool {
+		if timings[i].Total() != timings[j].Total() {
+			return timings[i].Total() > timings[j].Total()
+		}
+		return timings[i].Dir < timings[j].Dir
+	})
+}
+
+// saveTimings saves the timings of a scan of dirs. the last timings of the
+// other music dirs are kept, so that a scan of one doesn't hide the others'
+func saveTimings(dbc *db.DB, dirs []string, timings []*DirTiming) error {
+	prev, err := LastTimings(dbc)
+	if err != nil {
+		return fmt.Errorf("get last: %w", err)
+	}
+	timings = append([]*DirTiming(nil), timings...)
+	for _, timing := range prev {
+		if !contains(dirs, filepath.Dir(timing.Dir)) {
+			timings = append(timings, timing)
+		}
+	}
+	sortTimings(timings)
+	if len(timings) > lastTimingKeep {
+		timings = timings[:lastTimingKeep]
+	}
+	data, err := json.Marshal(timings)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	return dbc.SetSetting(SettingLastTiming, string(data))
+}
+
+// LastTimings returns the slowest directories from the last scan of each music
+// dir, if any
+func LastTimings(dbc *db.DB) ([]*DirTiming, error) {
+	data, err := dbc.GetSetting(SettingLastTiming)
+	if err != nil {
+		return nil, fmt.Errorf("get setting: %w", err)
+	}
+	if data == "" {
+		return nil, nil
+	}
+	var timings []*DirTiming
+	if err := json.Unmarshal([]byte(data), &timings); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	return timings, nil
+}
+
+func logTimings(timings []*DirTiming) {
+	log.Printf("scan timing by directory, slowest first")
+	log.Printf("    %10s %10s %10s %10s %7s %7s  %s", "total", "walk", "tags", "db", "folders", "tracks", "dir")
+	for _, t := range timings {
+		log.Printf("    %10s %10s %10s %10s %7d %7d  %s",
+			roundDur(t.Total()), roundDur(t.Walk), roundDur(t.Tags), roundDur(t.DB), t.Folders, t.Tracks, t.Dir)
+	}
+}
+
+func roundDur(d time.Duration) time.Duration {
+	return d.Round(time.Millisecond)
+}
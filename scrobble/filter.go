@@ -0,0 +1,132 @@
+package scrobble
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+)
+
+const (
+	// SettingDuplicateWindow is how many seconds apart two submissions of the
+	// same track by a user need to be for both to count. 0 or unset allows
+	// any
+	SettingDuplicateWindow = "scrobble_duplicate_window"
+	// SettingRequirePlaying is "true" if submissions only count once the
+	// track was now playing for long enough. see playThreshold
+	SettingRequirePlaying = "scrobble_require_playing"
+)
+
+// a track needs playing for half its length, or 4 minutes if that's longer.
+// one shorter than 4 minutes can't be played for that long, so it needs
+// playing through, and any track needs at least 30 seconds, like last.fm's
+// rule that shorter ones aren't scrobbled.
+// https://www.last.fm/api/scrobbling#when-is-a-scrobble-a-scrobble
+const (
+	playThresholdLong = 4 * time.Minute
+	playThresholdMin  = 30 * time.Second
+)
+
+var (
+	ErrDuplicate       = errors.New("submitted again too soon")
+	ErrNotPlayedEnough = errors.New("not played for long enough")
+)
+
+type userTrack struct {
+	trackID int
+	time    time.Time
+}
+
+// Filter decides which submissions count, so that clients which submit
+// twice, or too early, don't leave scrobbles which weren't listens
+type Filter struct {
+	db *db.DB
+
+	mu sync.Mutex
+	// playing is each user's now playing track, and when it started
+	playing map[int]userTrack
+	// submitted is each user's last submission which counted, and its time
+	submitted map[int]userTrack
+}
+
+func NewFilter(dbc *db.DB) *Filter {
+	return &Filter{
+		db:        dbc,
+		playing:   map[int]userTrack{},
+		submitted: map[int]userTrack{},
+	}
+}
+
+// NowPlaying remembers that the user started playing the track at now. the
+// same track again keeps when it started
+func (f *Filter) NowPlaying(userID, trackID int, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if playing, ok := f.playing[userID]; ok && playing.trackID == trackID {
+		return
+	}
+	f.playing[userID] = userTrack{trackID: trackID, time: now}
+}
+
+// Check returns nil if a submission of the track, played at stamp and
+// received at now, counts. if it does, it's remembered to check the next ones
+// against
+func (f *Filter) Check(userID int, track *db.Track, stamp, now time.Time) error {
+	window, requirePlaying, err := f.settings()
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if last, ok := f.submitted[userID]; ok && window > 0 && last.trackID == track.ID {
+		if diff := stamp.Sub(last.time); diff < window && diff > -window {
+			return fmt.Errorf("%w: %s after the last", ErrDuplicate, diff.Round(time.Second))
+		}
+	}
+	if requirePlaying {
+		playing, ok := f.playing[userID]
+		if !ok || playing.trackID != track.ID {
+			return fmt.Errorf("%w: it wasn't now playing", ErrNotPlayedEnough)
+		}
+		if played, threshold := now.Sub(playing.time), playThreshold(track.Length); played < threshold {
+			return fmt.Errorf("%w: %s of %s", ErrNotPlayedEnough, played.Round(time.Second), threshold)
+		}
+	}
+	f.submitted[userID] = userTrack{trackID: track.ID, time: stamp}
+	// playing the same track again starts over
+	delete(f.playing, userID)
+	return nil
+}
+
+func (f *Filter) settings() (time.Duration, bool, error) {
+	windowStr, err := f.db.GetSetting(SettingDuplicateWindow)
+	if err != nil {
+		return 0, false, fmt.Errorf("get duplicate window: %w", err)
+	}
+	requirePlaying, err := f.db.GetSetting(SettingRequirePlaying)
+	if err != nil {
+		return 0, false, fmt.Errorf("get require playing: %w", err)
+	}
+	window, _ := strconv.Atoi(windowStr)
+	return time.Duration(window) * time.Second, requirePlaying == "true", nil
+}
+
+// playThreshold is how long a track of length seconds needs to be played for
+func playThreshold(length int) time.Duration {
+	full := time.Duration(length) * time.Second
+	threshold := full / 2
+	if threshold < playThresholdLong {
+		threshold = playThresholdLong
+	}
+	if threshold > full {
+		threshold = full
+	}
+	if threshold < playThresholdMin {
+		threshold = playThresholdMin
+	}
+	return threshold
+}
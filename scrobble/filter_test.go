@@ -0,0 +1,74 @@
+package scrobble
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+)
+
+func TestFilterDuplicate(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dbc, user, tracks := newQueueDB(t)
+	filter := NewFilter(dbc)
+	now := time.Now()
+
+	// no rules by default
+	is.NoErr(filter.Check(user.ID, tracks[0], now, now))
+	is.NoErr(filter.Check(user.ID, tracks[0], now, now))
+
+	is.NoErr(dbc.SetSetting(SettingDuplicateWindow, "30"))
+	is.True(errors.Is(filter.Check(user.ID, tracks[0], now.Add(10*time.Second), now), ErrDuplicate))
+	is.True(errors.Is(filter.Check(user.ID, tracks[0], now.Add(-10*time.Second), now), ErrDuplicate)) // or before
+	is.NoErr(filter.Check(user.ID, tracks[1], now.Add(10*time.Second), now))                          // another track
+	is.NoErr(filter.Check(user.ID, tracks[0], now.Add(20*time.Second), now))                          // not the last one anymore
+	is.NoErr(filter.Check(user.ID, tracks[0], now.Add(time.Minute), now))                             // played again
+
+	other := &db.User{Name: "other", Password: "other"}
+	is.NoErr(dbc.Create(other).Error)
+	is.NoErr(filter.Check(other.ID, tracks[0], now.Add(time.Minute), now)) // another user
+}
+
+func TestFilterRequirePlaying(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dbc, user, tracks := newQueueDB(t)
+	is.NoErr(dbc.SetSetting(SettingRequirePlaying, "true"))
+	filter := NewFilter(dbc)
+	start := time.Now()
+
+	short, long := tracks[0], tracks[1]
+	short.Length = 60     // shorter than 4 minutes, so all of it
+	long.Length = 60 * 60 // half is longer than 4 minutes
+
+	// never now playing
+	is.True(errors.Is(filter.Check(user.ID, short, start, start.Add(time.Hour)), ErrNotPlayedEnough))
+
+	filter.NowPlaying(user.ID, short.ID, start)
+	filter.NowPlaying(user.ID, short.ID, start.Add(20*time.Second)) // still the same play
+	is.True(errors.Is(filter.Check(user.ID, short, start, start.Add(59*time.Second)), ErrNotPlayedEnough))
+	is.NoErr(filter.Check(user.ID, short, start, start.Add(60*time.Second)))
+	// the next play of it starts over
+	is.True(errors.Is(filter.Check(user.ID, short, start, start.Add(2*time.Minute)), ErrNotPlayedEnough))
+
+	filter.NowPlaying(user.ID, long.ID, start)
+	is.True(errors.Is(filter.Check(user.ID, long, start, start.Add(29*time.Minute)), ErrNotPlayedEnough))
+	filter.NowPlaying(user.ID, short.ID, start) // skipped to another track
+	is.True(errors.Is(filter.Check(user.ID, long, start, start.Add(31*time.Minute)), ErrNotPlayedEnough))
+	filter.NowPlaying(user.ID, long.ID, start)
+	is.NoErr(filter.Check(user.ID, long, start, start.Add(30*time.Minute)))
+}
+
+func TestPlayThreshold(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	is.Equal(playThreshold(10), 30*time.Second)    // at least 30 seconds
+	is.Equal(playThreshold(3*60), 3*time.Minute)   // all of a short one
+	is.Equal(playThreshold(6*60), 4*time.Minute)   // 4 minutes is longer than half
+	is.Equal(playThreshold(20*60), 10*time.Minute) // half is longer than 4 minutes
+	is.Equal(playThreshold(0), playThresholdMin)   // an unknown length
+}
@@ -12,6 +12,7 @@ import (
 	"net/url"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"go.senan.xyz/gonic/db"
@@ -26,6 +27,15 @@ var (
 	ErrLastFM = errors.New("last.fm error")
 )
 
+// authErrorCodes are last.fm errors which mean the session or api key is no
+// good. https://www.last.fm/api/errorcodes
+var authErrorCodes = map[uint]bool{
+	4:  true, // authentication failed
+	9:  true, // invalid session key
+	10: true, // invalid api key
+	26: true, // suspended api key
+}
+
 type LastFM struct {
 	XMLName        xml.Name       `xml:"lfm"`
 	Status         string         `xml:"status,attr"`
@@ -35,6 +45,7 @@ type LastFM struct {
 	TopTracks      TopTracks      `xml:"toptracks"`
 	SimilarTracks  SimilarTracks  `xml:"similartracks"`
 	SimilarArtists SimilarArtists `xml:"similarartists"`
+	RecentTracks   RecentTracks   `xml:"recenttracks"`
 }
 
 type Session struct {
@@ -127,6 +138,33 @@ type Track struct {
 	} `xml:"image"`
 }
 
+type RecentTracks struct {
+	XMLName    xml.Name      `xml:"recenttracks"`
+	User       string        `xml:"user,attr"`
+	Page       int           `xml:"page,attr"`
+	TotalPages int           `xml:"totalPages,attr"`
+	Total      int           `xml:"total,attr"`
+	Tracks     []RecentTrack `xml:"track"`
+}
+
+type RecentTrack struct {
+	// NowPlaying tracks haven't been scrobbled yet, and have no Date
+	NowPlaying bool   `xml:"nowplaying,attr"`
+	Name       string `xml:"name"`
+	MBID       string `xml:"mbid"`
+	Artist     struct {
+		Name string `xml:",chardata"`
+		MBID string `xml:"mbid,attr"`
+	} `xml:"artist"`
+	Album struct {
+		Name string `xml:",chardata"`
+		MBID string `xml:"mbid,attr"`
+	} `xml:"album"`
+	Date struct {
+		UTS int64 `xml:"uts,attr"`
+	} `xml:"date"`
+}
+
 func getParamSignature(params url.Values, secret string) string {
 	// the parameters must be in order before hashing
 	paramKeys := make([]string, 0, len(params))
@@ -144,9 +182,17 @@ func getParamSignature(params url.Values, secret string) string {
 	return hex.EncodeToString(hash[:])
 }
 
-func makeRequest(method string, params url.Values) (LastFM, error) {
-	req, _ := http.NewRequest(method, baseURL, nil)
-	req.URL.RawQuery = params.Encode()
+// makeRequest calls the api at base. GETs have the params in the query, and
+// POSTs, which change things, have them in the body
+func makeRequest(base, method string, params url.Values) (LastFM, error) {
+	var req *http.Request
+	if method == http.MethodPost {
+		req, _ = http.NewRequest(method, base, strings.NewReader(params.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req, _ = http.NewRequest(method, base, nil)
+		req.URL.RawQuery = params.Encode()
+	}
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return LastFM{}, fmt.Errorf("get: %w", err)
@@ -162,6 +208,9 @@ func makeRequest(method string, params url.Values) (LastFM, error) {
 	if lastfm.Error.Code != 0 {
 		respBytes, _ := httputil.DumpResponse(resp, true)
 		log.Printf("received bad lastfm response:\n%s", string(respBytes))
+		if authErrorCodes[lastfm.Error.Code] {
+			return LastFM{}, fmt.Errorf("last.fm: %v: %w", lastfm.Error.Value, scrobble.ErrUnauthorized)
+		}
 		return LastFM{}, fmt.Errorf("%v: %w", lastfm.Error.Value, ErrLastFM)
 	}
 	return lastfm, nil
@@ -172,7 +221,7 @@ func ArtistGetInfo(apiKey string, artistName string) (Artist, error) {
 	params.Add("method", "artist.getInfo")
 	params.Add("api_key", apiKey)
 	params.Add("artist", artistName)
-	resp, err := makeRequest("GET", params)
+	resp, err := makeRequest(baseURL, "GET", params)
 	if err != nil {
 		return Artist{}, fmt.Errorf("making artist GET: %w", err)
 	}
@@ -184,7 +233,7 @@ func ArtistGetTopTracks(apiKey, artistName string) (TopTracks, error) {
 	params.Add("method", "artist.getTopTracks")
 	params.Add("api_key", apiKey)
 	params.Add("artist", artistName)
-	resp, err := makeRequest("GET", params)
+	resp, err := makeRequest(baseURL, "GET", params)
 	if err != nil {
 		return TopTracks{}, fmt.Errorf("making track GET: %w", err)
 	}
@@ -197,19 +246,41 @@ func TrackGetSimilarTracks(apiKey string, artistName, trackName string) (Similar
 	params.Add("api_key", apiKey)
 	params.Add("track", trackName)
 	params.Add("artist", artistName)
-	resp, err := makeRequest("GET", params)
+	resp, err := makeRequest(baseURL, "GET", params)
 	if err != nil {
 		return SimilarTracks{}, fmt.Errorf("making track GET: %w", err)
 	}
 	return resp.SimilarTracks, nil
 }
 
+// UserGetRecentTracks is a page of the user's scrobbles between from and to,
+// newest first. pages start at 1
+func UserGetRecentTracks(apiKey, username string, from, to time.Time, page int) (RecentTracks, error) {
+	params := url.Values{}
+	params.Add("method", "user.getRecentTracks")
+	params.Add("api_key", apiKey)
+	params.Add("user", username)
+	params.Add("limit", "200")
+	params.Add("page", strconv.Itoa(page))
+	if !from.IsZero() {
+		params.Add("from", strconv.FormatInt(from.Unix(), 10))
+	}
+	if !to.IsZero() {
+		params.Add("to", strconv.FormatInt(to.Unix(), 10))
+	}
+	resp, err := makeRequest(baseURL, "GET", params)
+	if err != nil {
+		return RecentTracks{}, fmt.Errorf("making recent tracks GET: %w", err)
+	}
+	return resp.RecentTracks, nil
+}
+
 func ArtistGetSimilar(apiKey string, artistName string) (SimilarArtists, error) {
 	params := url.Values{}
 	params.Add("method", "artist.getSimilar")
 	params.Add("api_key", apiKey)
 	params.Add("artist", artistName)
-	resp, err := makeRequest("GET", params)
+	resp, err := makeRequest(baseURL, "GET", params)
 	if err != nil {
 		return SimilarArtists{}, fmt.Errorf("making similar artists GET:  %w", err)
 	}
@@ -222,7 +293,7 @@ func GetSession(apiKey, secret, token string) (string, error) {
 	params.Add("api_key", apiKey)
 	params.Add("token", token)
 	params.Add("api_sig", getParamSignature(params, secret))
-	resp, err := makeRequest("GET", params)
+	resp, err := makeRequest(baseURL, "GET", params)
 	if err != nil {
 		return "", fmt.Errorf("making session GET: %w", err)
 	}
@@ -231,10 +302,16 @@ func GetSession(apiKey, secret, token string) (string, error) {
 
 type Scrobbler struct {
 	DB *db.DB
+	// baseURL is the api to scrobble to, if not last.fm's
+	baseURL string
 }
 
+func (s *Scrobbler) Name() string { return "lastfm" }
+
+func (s *Scrobbler) IsLinked(user *db.User) bool { return user.LastFMSession != "" }
+
 func (s *Scrobbler) Scrobble(user *db.User, track *db.Track, stamp time.Time, submission bool) error {
-	if user.LastFMSession == "" {
+	if !s.IsLinked(user) {
 		return nil
 	}
 	apiKey, err := s.DB.GetSetting("lastfm_api_key")
@@ -246,9 +323,11 @@ func (s *Scrobbler) Scrobble(user *db.User, track *db.Track, stamp time.Time, su
 		return fmt.Errorf("get secret: %w", err)
 	}
 
+	// a submission is a scrobble of a listen that's done, otherwise the track
+	// just started and only the user's now playing is updated
 	params := url.Values{}
 	if submission {
-		params.Add("method", "track.Scrobble")
+		params.Add("method", "track.scrobble")
 		// last.fm wants the timestamp in seconds
 		params.Add("timestamp", strconv.Itoa(int(stamp.Unix())))
 	} else {
@@ -262,8 +341,15 @@ func (s *Scrobbler) Scrobble(user *db.User, track *db.Track, stamp time.Time, su
 	params.Add("album", track.Album.TagTitle)
 	params.Add("mbid", track.TagBrainzID)
 	params.Add("albumArtist", track.Artist.Name)
+	if track.Length > 0 {
+		params.Add("duration", strconv.Itoa(track.Length))
+	}
 	params.Add("api_sig", getParamSignature(params, secret))
-	_, err = makeRequest("POST", params)
+	base := s.baseURL
+	if base == "" {
+		base = baseURL
+	}
+	_, err = makeRequest(base, http.MethodPost, params)
 	return err
 }
 
@@ -3,8 +3,15 @@ package lastfm
 import (
 	"crypto/md5"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
 )
 
 func TestGetParamSignature(t *testing.T) {
@@ -21,3 +28,60 @@ func TestGetParamSignature(t *testing.T) {
 		t.Errorf("expected %x, got %s", expected, actual)
 	}
 }
+
+func TestScrobble(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	var forms []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		is.Equal(r.Method, http.MethodPost)
+		is.NoErr(r.ParseForm())
+		is.Equal(len(r.URL.Query()), 0) // params go in the body
+		forms = append(forms, r.PostForm)
+		fmt.Fprint(w, `<lfm status="ok"></lfm>`)
+	}))
+	defer server.Close()
+
+	dbc, err := db.NewMock()
+	is.NoErr(err)
+	defer dbc.Close()
+	is.NoErr(dbc.Migrate(db.MigrationContext{}))
+	is.NoErr(dbc.SetSetting("lastfm_api_key", "key"))
+	is.NoErr(dbc.SetSetting("lastfm_secret", "secret"))
+
+	scrobbler := &Scrobbler{DB: dbc, baseURL: server.URL}
+	user := &db.User{LastFMSession: "session"}
+	track := &db.Track{
+		TagTitle:       "title",
+		TagTrackArtist: "artist",
+		Length:         200,
+		Album:          &db.Album{TagTitle: "album"},
+		Artist:         &db.Artist{Name: "album artist"},
+	}
+	stamp := time.Unix(1600000000, 0)
+
+	is.NoErr(scrobbler.Scrobble(user, track, stamp, false))
+	is.NoErr(scrobbler.Scrobble(user, track, stamp, true))
+	is.Equal(len(forms), 2)
+
+	nowPlaying, submission := forms[0], forms[1]
+	is.Equal(nowPlaying.Get("method"), "track.updateNowPlaying")
+	is.Equal(nowPlaying.Get("timestamp"), "")
+	is.Equal(submission.Get("method"), "track.scrobble")
+	is.Equal(submission.Get("timestamp"), "1600000000")
+	for _, form := range forms {
+		is.Equal(form.Get("sk"), "session")
+		is.Equal(form.Get("track"), "title")
+		is.Equal(form.Get("artist"), "artist")
+		is.Equal(form.Get("album"), "album")
+		is.Equal(form.Get("duration"), "200")
+		sig := form.Get("api_sig")
+		form.Del("api_sig")
+		is.Equal(sig, getParamSignature(form, "secret"))
+	}
+
+	// nothing is sent for users who haven't linked last.fm
+	is.NoErr(scrobbler.Scrobble(&db.User{}, track, stamp, true))
+	is.Equal(len(forms), 2)
+}
@@ -0,0 +1,70 @@
+package listenbrainz
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const recordingPrefix = "https://musicbrainz.org/recording/"
+
+// JSPF is the json form of an XSPF playlist, as exported by listenbrainz.
+// https://listenbrainz.readthedocs.io/en/latest/users/api/playlist.html
+type JSPF struct {
+	Playlist *JSPFPlaylist `json:"playlist"`
+}
+
+type JSPFPlaylist struct {
+	Title      string       `json:"title"`
+	Creator    string       `json:"creator"`
+	Annotation string       `json:"annotation"`
+	Identifier string       `json:"identifier"`
+	Tracks     []*JSPFTrack `json:"track"`
+}
+
+type JSPFTrack struct {
+	Title      string          `json:"title"`
+	Creator    string          `json:"creator"`
+	Album      string          `json:"album"`
+	Identifier jspfIdentifiers `json:"identifier"`
+}
+
+// RecordingMBID finds the musicbrainz recording id in the track's identifiers
+func (t *JSPFTrack) RecordingMBID() string {
+	for _, identifier := range t.Identifier {
+		if strings.HasPrefix(identifier, recordingPrefix) {
+			return strings.TrimPrefix(identifier, recordingPrefix)
+		}
+	}
+	return ""
+}
+
+// jspfIdentifiers may be a single string or a list of them, depending on the
+// version of listenbrainz which exported the playlist
+type jspfIdentifiers []string
+
+func (ids *jspfIdentifiers) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*ids = jspfIdentifiers{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("identifier is not a string or list: %w", err)
+	}
+	*ids = list
+	return nil
+}
+
+func ParseJSPF(r io.Reader) (*JSPFPlaylist, error) {
+	var jspf JSPF
+	if err := json.NewDecoder(r).Decode(&jspf); err != nil {
+		return nil, fmt.Errorf("decode jspf: %w", err)
+	}
+	if jspf.Playlist == nil {
+		return nil, fmt.Errorf("no playlist in jspf")
+	}
+	return jspf.Playlist, nil
+}
@@ -0,0 +1,46 @@
+package listenbrainz
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestParseJSPF(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	playlist, err := ParseJSPF(strings.NewReader(`{
+		"playlist": {
+			"title": "Weekly Exploration for sentriz, week of 2022-06-13 Mon",
+			"creator": "listenbrainz",
+			"identifier": "https://listenbrainz.org/playlist/9f4a4b0b-0a5a-4f4e-8b8e-4b4a7d2c3d1e",
+			"track": [
+				{
+					"title": "Windowlicker",
+					"creator": "Aphex Twin",
+					"identifier": "https://musicbrainz.org/recording/3f8a2b44-1b1e-4e8f-9f3b-7c1c5c2b0a11"
+				},
+				{
+					"title": "Teardrop",
+					"creator": "Massive Attack",
+					"identifier": ["https://musicbrainz.org/recording/a1b2c3d4-0000-4000-8000-000000000000"]
+				},
+				{
+					"title": "Untitled",
+					"creator": "Someone"
+				}
+			]
+		}
+	}`))
+	is.NoErr(err)
+	is.Equal(playlist.Title, "Weekly Exploration for sentriz, week of 2022-06-13 Mon")
+	is.Equal(len(playlist.Tracks), 3)
+	is.Equal(playlist.Tracks[0].RecordingMBID(), "3f8a2b44-1b1e-4e8f-9f3b-7c1c5c2b0a11") // string identifier
+	is.Equal(playlist.Tracks[1].RecordingMBID(), "a1b2c3d4-0000-4000-8000-000000000000") // list identifier
+	is.Equal(playlist.Tracks[2].RecordingMBID(), "")                                     // no identifier
+
+	_, err = ParseJSPF(strings.NewReader(`{"nope": {}}`))
+	is.True(err != nil) // missing playlist
+}
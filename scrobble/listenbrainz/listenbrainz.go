@@ -8,8 +8,10 @@ import (
 	"log"
 	"net/http"
 	"net/http/httputil"
+	"strings"
 	"time"
 
+	"go.senan.xyz/gonic"
 	"go.senan.xyz/gonic/db"
 	"go.senan.xyz/gonic/scrobble"
 )
@@ -19,6 +21,7 @@ const (
 
 	submitPath           = "/1/submit-listens"
 	listenTypeSingle     = "single"
+	listenTypeImport     = "import"
 	listenTypePlayingNow = "playing_now"
 )
 
@@ -27,9 +30,14 @@ var (
 )
 
 type AdditionalInfo struct {
-	TrackNumber int    `json:"tracknumber,omitempty"`
-	TrackMBID   string `json:"track_mbid,omitempty"`
-	TrackLength int    `json:"track_length,omitempty"`
+	TrackNumber             int      `json:"tracknumber,omitempty"`
+	TrackMBID               string   `json:"track_mbid,omitempty"`
+	ReleaseMBID             string   `json:"release_mbid,omitempty"`
+	ArtistMBIDs             []string `json:"artist_mbids,omitempty"`
+	DurationMS              int      `json:"duration_ms,omitempty"`
+	MediaPlayer             string   `json:"media_player,omitempty"`
+	SubmissionClient        string   `json:"submission_client,omitempty"`
+	SubmissionClientVersion string   `json:"submission_client_version,omitempty"`
 }
 
 type TrackMetadata struct {
@@ -51,37 +59,73 @@ type Scrobble struct {
 
 type Scrobbler struct{}
 
+func (s *Scrobbler) Name() string { return "listenbrainz" }
+
+func (s *Scrobbler) IsLinked(user *db.User) bool {
+	return user.ListenBrainzURL != "" && user.ListenBrainzToken != ""
+}
+
 func (s *Scrobbler) Scrobble(user *db.User, track *db.Track, stamp time.Time, submission bool) error {
+	if !s.IsLinked(user) {
+		return nil
+	}
+	listen := Scrobble{
+		Payload: []*Payload{trackPayload(track)},
+	}
+	if submission && len(listen.Payload) > 0 {
+		listen.ListenType = listenTypeSingle
+		listen.Payload[0].ListenedAt = int(stamp.Unix())
+	} else {
+		listen.ListenType = listenTypePlayingNow
+	}
+	return submit(user, listen)
+}
+
+// ScrobbleBatch submits a number of past listens at once, as an import
+func (s *Scrobbler) ScrobbleBatch(user *db.User, listens []scrobble.Listen) error {
 	if user.ListenBrainzURL == "" || user.ListenBrainzToken == "" {
 		return nil
 	}
-	payload := &Payload{
-		TrackMetadata: &TrackMetadata{
-			AdditionalInfo: &AdditionalInfo{
-				TrackNumber: track.TagTrackNumber,
-				TrackMBID:   track.TagBrainzID,
-				TrackLength: track.Length,
-			},
-			ArtistName:  track.TagTrackArtist,
-			TrackName:   track.TagTitle,
-			ReleaseName: track.Album.TagTitle,
-		},
+	listen := Scrobble{
+		ListenType: listenTypeImport,
 	}
-	scrobble := Scrobble{
-		Payload: []*Payload{payload},
+	for _, l := range listens {
+		payload := trackPayload(l.Track)
+		payload.ListenedAt = int(l.Time.Unix())
+		listen.Payload = append(listen.Payload, payload)
 	}
-	if submission && len(scrobble.Payload) > 0 {
-		scrobble.ListenType = listenTypeSingle
-		scrobble.Payload[0].ListenedAt = int(stamp.Unix())
-	} else {
-		scrobble.ListenType = listenTypePlayingNow
+	return submit(user, listen)
+}
+
+func trackPayload(track *db.Track) *Payload {
+	info := &AdditionalInfo{
+		TrackNumber:             track.TagTrackNumber,
+		TrackMBID:               track.TagBrainzID,
+		ReleaseMBID:             track.Album.TagBrainzID,
+		DurationMS:              track.Length * 1000,
+		MediaPlayer:             gonic.Name,
+		SubmissionClient:        gonic.Name,
+		SubmissionClientVersion: gonic.Version,
 	}
+	if track.TagArtistBrainzID != "" {
+		info.ArtistMBIDs = []string{track.TagArtistBrainzID}
+	}
+	return &Payload{
+		TrackMetadata: &TrackMetadata{
+			AdditionalInfo: info,
+			ArtistName:     track.TagTrackArtist,
+			TrackName:      track.TagTitle,
+			ReleaseName:    track.Album.TagTitle,
+		},
+	}
+}
 
+func submit(user *db.User, listen Scrobble) error {
 	var payloadBuf bytes.Buffer
-	if err := json.NewEncoder(&payloadBuf).Encode(scrobble); err != nil {
+	if err := json.NewEncoder(&payloadBuf).Encode(listen); err != nil {
 		return err
 	}
-	submitURL := fmt.Sprintf("%s%s", user.ListenBrainzURL, submitPath)
+	submitURL := fmt.Sprintf("%s%s", strings.TrimRight(user.ListenBrainzURL, "/"), submitPath)
 	authHeader := fmt.Sprintf("Token %s", user.ListenBrainzToken)
 	req, _ := http.NewRequest(http.MethodPost, submitURL, &payloadBuf)
 	req.Header.Add("Content-Type", "application/json")
@@ -94,7 +138,7 @@ func (s *Scrobbler) Scrobble(user *db.User, track *db.Track, stamp time.Time, su
 
 	switch {
 	case resp.StatusCode == http.StatusUnauthorized:
-		return fmt.Errorf("unathorized: %w", ErrListenBrainz)
+		return fmt.Errorf("listenbrainz: %w", scrobble.ErrUnauthorized)
 	case resp.StatusCode >= 400:
 		respBytes, _ := httputil.DumpResponse(resp, true)
 		log.Printf("received bad listenbrainz response:\n%s", string(respBytes))
@@ -103,4 +147,4 @@ func (s *Scrobbler) Scrobble(user *db.User, track *db.Track, stamp time.Time, su
 	return nil
 }
 
-var _ scrobble.Scrobbler = (*Scrobbler)(nil)
+var _ scrobble.BatchScrobbler = (*Scrobbler)(nil)
@@ -0,0 +1,80 @@
+package listenbrainz
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/scrobble"
+)
+
+func TestScrobble(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	var bodies []Scrobble
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		is.Equal(r.Method, http.MethodPost)
+		is.Equal(r.URL.Path, "/apis/listenbrainz"+submitPath) // under the user's path
+		is.Equal(r.Header.Get("Authorization"), "Token token")
+		var body Scrobble
+		is.NoErr(json.NewDecoder(r.Body).Decode(&body))
+		bodies = append(bodies, body)
+	}))
+	defer server.Close()
+
+	scrobbler := &Scrobbler{}
+	user := &db.User{ListenBrainzURL: server.URL + "/apis/listenbrainz/", ListenBrainzToken: "token"}
+	track := &db.Track{
+		TagTitle:          "title",
+		TagTrackArtist:    "artist",
+		TagTrackNumber:    3,
+		TagBrainzID:       "track-mbid",
+		TagArtistBrainzID: "artist-mbid",
+		Length:            200,
+		Album:             &db.Album{TagTitle: "album", TagBrainzID: "release-mbid"},
+	}
+	stamp := time.Unix(1600000000, 0)
+
+	is.NoErr(scrobbler.Scrobble(user, track, stamp, false))
+	is.NoErr(scrobbler.Scrobble(user, track, stamp, true))
+	is.NoErr(scrobbler.ScrobbleBatch(user, []scrobble.Listen{
+		{Track: track, Time: stamp},
+		{Track: track, Time: stamp.Add(time.Minute)},
+	}))
+	is.Equal(len(bodies), 3)
+
+	nowPlaying, single, batch := bodies[0], bodies[1], bodies[2]
+	is.Equal(nowPlaying.ListenType, listenTypePlayingNow)
+	is.Equal(len(nowPlaying.Payload), 1)
+	is.Equal(nowPlaying.Payload[0].ListenedAt, 0) // playing now listens have no time
+	is.Equal(nowPlaying.Payload[0].TrackMetadata.TrackName, "title")
+
+	is.Equal(single.ListenType, listenTypeSingle)
+	is.Equal(len(single.Payload), 1)
+	is.Equal(single.Payload[0].ListenedAt, 1600000000)
+	is.Equal(single.Payload[0].TrackMetadata.ReleaseName, "album")
+
+	info := single.Payload[0].TrackMetadata.AdditionalInfo
+	is.Equal(info.TrackMBID, "track-mbid")
+	is.Equal(info.ReleaseMBID, "release-mbid")
+	is.Equal(info.ArtistMBIDs, []string{"artist-mbid"})
+	is.Equal(info.DurationMS, 200000)
+	is.Equal(info.TrackNumber, 3)
+	is.Equal(info.MediaPlayer, "gonic")
+	is.Equal(info.SubmissionClient, "gonic")
+	is.True(info.SubmissionClientVersion != "")
+
+	is.Equal(batch.ListenType, listenTypeImport)
+	is.Equal(len(batch.Payload), 2)
+	is.Equal(batch.Payload[1].ListenedAt, 1600000060)
+
+	// nothing is sent for users who haven't linked listenbrainz
+	is.NoErr(scrobbler.Scrobble(&db.User{}, track, stamp, true))
+	is.Equal(len(bodies), 3)
+}
@@ -0,0 +1,116 @@
+// Package maloja scrobbles to a maloja server, with its native api.
+// https://github.com/krateng/maloja/blob/master/API.md
+package maloja
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/scrobble"
+)
+
+const scrobblePath = "/apis/mlj_1/newscrobble"
+
+var ErrMaloja = errors.New("maloja error")
+
+type Scrobble struct {
+	Artists      []string `json:"artists"`
+	Title        string   `json:"title"`
+	Album        string   `json:"album,omitempty"`
+	AlbumArtists []string `json:"albumartists,omitempty"`
+	// Duration is how long the track was listened to, and Length how long it
+	// is, both in seconds
+	Duration int    `json:"duration,omitempty"`
+	Length   int    `json:"length,omitempty"`
+	Time     int64  `json:"time"`
+	Key      string `json:"key"`
+}
+
+type Response struct {
+	Status string `json:"status"`
+	Error  *Error `json:"error"`
+}
+
+type Error struct {
+	Type string `json:"type"`
+	Desc string `json:"desc"`
+}
+
+type Scrobbler struct{}
+
+func (s *Scrobbler) Name() string { return "maloja" }
+
+func (s *Scrobbler) IsLinked(user *db.User) bool {
+	return user.MalojaURL != "" && user.MalojaAPIKey != ""
+}
+
+// Scrobble sends submissions. maloja has no now playing, so the rest are
+// ignored
+func (s *Scrobbler) Scrobble(user *db.User, track *db.Track, stamp time.Time, submission bool) error {
+	if !s.IsLinked(user) || !submission {
+		return nil
+	}
+	body := Scrobble{
+		Artists:  []string{track.TagTrackArtist},
+		Title:    track.TagTitle,
+		Duration: track.Length,
+		Length:   track.Length,
+		Time:     stamp.Unix(),
+		Key:      user.MalojaAPIKey,
+	}
+	if track.Album != nil {
+		body.Album = track.Album.TagTitle
+	}
+	if track.Artist != nil && track.Artist.Name != "" {
+		body.AlbumArtists = []string{track.Artist.Name}
+	}
+
+	var bodyBuf bytes.Buffer
+	if err := json.NewEncoder(&bodyBuf).Encode(body); err != nil {
+		return err
+	}
+	scrobbleURL := fmt.Sprintf("%s%s", strings.TrimRight(user.MalojaURL, "/"), scrobblePath)
+	req, _ := http.NewRequest(http.MethodPost, scrobbleURL, &bodyBuf)
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http post: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var malojaResp Response
+	decodeErr := json.NewDecoder(resp.Body).Decode(&malojaResp)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("maloja: %s: %w", malojaResp.desc(), scrobble.ErrUnauthorized)
+	case malojaResp.Error != nil && malojaResp.Error.Type == "authentication_fail":
+		return fmt.Errorf("maloja: %s: %w", malojaResp.desc(), scrobble.ErrUnauthorized)
+	case resp.StatusCode >= 400:
+		return fmt.Errorf("%d: %s: %w", resp.StatusCode, malojaResp.desc(), ErrMaloja)
+	case decodeErr != nil:
+		return fmt.Errorf("decoding: %w", decodeErr)
+	case malojaResp.Status != "success":
+		return fmt.Errorf("%s: %s: %w", malojaResp.Status, malojaResp.desc(), ErrMaloja)
+	}
+	return nil
+}
+
+// desc is the reason for an error response, as best as maloja gave one
+func (r Response) desc() string {
+	switch {
+	case r.Error == nil:
+		return "no reason given"
+	case r.Error.Desc != "":
+		return r.Error.Desc
+	default:
+		return r.Error.Type
+	}
+}
+
+var _ scrobble.Scrobbler = (*Scrobbler)(nil)
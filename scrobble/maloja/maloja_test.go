@@ -0,0 +1,98 @@
+package maloja
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/scrobble"
+)
+
+func TestScrobble(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	var bodies []Scrobble
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		is.Equal(r.Method, http.MethodPost)
+		is.Equal(r.URL.Path, scrobblePath)
+		var body Scrobble
+		is.NoErr(json.NewDecoder(r.Body).Decode(&body))
+		bodies = append(bodies, body)
+		fmt.Fprint(w, `{"status": "success", "track": {"artists": ["artist"], "title": "title"}}`)
+	}))
+	defer server.Close()
+
+	scrobbler := &Scrobbler{}
+	user := &db.User{MalojaURL: server.URL + "/", MalojaAPIKey: "key"}
+	track := &db.Track{
+		TagTitle:       "title",
+		TagTrackArtist: "artist",
+		Length:         200,
+		Album:          &db.Album{TagTitle: "album"},
+		Artist:         &db.Artist{Name: "album artist"},
+	}
+	stamp := time.Unix(1600000000, 0)
+
+	// maloja has no now playing
+	is.NoErr(scrobbler.Scrobble(user, track, stamp, false))
+	is.Equal(len(bodies), 0)
+
+	is.NoErr(scrobbler.Scrobble(user, track, stamp, true))
+	is.Equal(len(bodies), 1)
+	is.Equal(bodies[0], Scrobble{
+		Artists:      []string{"artist"},
+		Title:        "title",
+		Album:        "album",
+		AlbumArtists: []string{"album artist"},
+		Duration:     200,
+		Length:       200,
+		Time:         1600000000,
+		Key:          "key",
+	})
+
+	// nothing is sent for users who haven't linked maloja
+	is.NoErr(scrobbler.Scrobble(&db.User{}, track, stamp, true))
+	is.Equal(len(bodies), 1)
+}
+
+func TestScrobbleErrors(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name         string
+		status       int
+		body         string
+		unauthorized bool
+	}{
+		{"bad key", http.StatusForbidden, `{"status": "failure", "error": {"type": "authentication_fail", "desc": "Invalid or missing API key"}}`, true},
+		{"missing data", http.StatusBadRequest, `{"status": "error", "error": {"type": "missing_scrobble_data", "desc": "The scrobble is missing needed information."}}`, false},
+		{"not maloja", http.StatusOK, `<html></html>`, false},
+		{"failure", http.StatusOK, `{"status": "failure"}`, false},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.body)
+			}))
+			defer server.Close()
+
+			user := &db.User{MalojaURL: server.URL, MalojaAPIKey: "key"}
+			track := &db.Track{TagTitle: "title", TagTrackArtist: "artist"}
+			err := (&Scrobbler{}).Scrobble(user, track, time.Now(), true)
+			is.True(err != nil)
+			is.Equal(errors.Is(err, scrobble.ErrUnauthorized), tc.unauthorized)
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package scrobble
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/metrics"
+	"go.senan.xyz/gonic/multierr"
+)
+
+// a scrobble which fails again isn't retried for retryBackoffMin, which
+// doubles with each attempt, up to retryBackoffMax
+const (
+	retryBackoffMin = time.Minute
+	retryBackoffMax = 6 * time.Hour
+)
+
+// a scrobble is given up on after retryAttemptsMax failed retries, or once
+// it's older than retryAgeMax. last.fm ignores scrobbles older than that
+// anyway, and it keeps the queue from growing while a scrobbler is down
+const (
+	retryAttemptsMax = 50
+	retryAgeMax      = 14 * 24 * time.Hour
+)
+
+// batchMax is the most listens sent to a BatchScrobbler at once
+const batchMax = 100
+
+// Queue keeps submissions which a scrobbler failed, and retries them
+type Queue struct {
+	db         *db.DB
+	scrobblers map[string]Scrobbler
+	metrics    *metrics.Metrics
+	// retrying stops two retries sending the same scrobbles. it's a channel
+	// so that waiting for it can be given up
+	retrying chan struct{}
+}
+
+func NewQueue(dbc *db.DB, scrobblers []Scrobbler) *Queue {
+	byName := make(map[string]Scrobbler, len(scrobblers))
+	for _, scrobbler := range scrobblers {
+		byName[scrobbler.Name()] = scrobbler
+	}
+	return &Queue{db: dbc, scrobblers: byName, retrying: make(chan struct{}, 1)}
+}
+
+// SetMetrics records the results of retries
+func (q *Queue) SetMetrics(m *metrics.Metrics) {
+	q.metrics = m
+}
+
+// Add queues the scrobble to be retried, unless it already is
+func (q *Queue) Add(scrobbler Scrobbler, user *db.User, track *db.Track, stamp time.Time, reason error) error {
+	retry := &db.ScrobbleRetry{}
+	err := q.db.
+		Where(db.ScrobbleRetry{UserID: user.ID, TrackID: track.ID, Time: stamp, Scrobbler: scrobbler.Name()}).
+		Attrs(db.ScrobbleRetry{NextAttempt: time.Now().Add(retryBackoffMin), Error: reason.Error()}).
+		FirstOrCreate(retry).
+		Error
+	if err != nil {
+		return fmt.Errorf("queue scrobble: %w", err)
+	}
+	return nil
+}
+
+// Pending is up to limit of the queued scrobbles, oldest first, with their
+// user and track
+func (q *Queue) Pending(limit int) ([]*db.ScrobbleRetry, error) {
+	var retries []*db.ScrobbleRetry
+	err := q.db.
+		Preload("User").
+		Preload("Track").
+		Preload("Track.Album").
+		Order("time, id").
+		Limit(limit).
+		Find(&retries).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("find queued scrobbles: %w", err)
+	}
+	return retries, nil
+}
+
+// PendingCount is how many scrobbles are queued
+func (q *Queue) PendingCount() (int, error) {
+	var count int
+	if err := q.db.Model(&db.ScrobbleRetry{}).Count(&count).Error; err != nil {
+		return 0, fmt.Errorf("count queued scrobbles: %w", err)
+	}
+	return count, nil
+}
+
+// Retry submits the queued scrobbles which are due, or all of them if now is
+// true. the ones which fail again wait longer before the next retry. once ctx
+// is done, the rest are left for next time
+func (q *Queue) Retry(ctx context.Context, now bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case q.retrying <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-q.retrying }()
+
+	if err := q.db.Where("time<?", time.Now().Add(-retryAgeMax)).Delete(&db.ScrobbleRetry{}).Error; err != nil {
+		return fmt.Errorf("delete old queued scrobbles: %w", err)
+	}
+
+	query := q.db.
+		Preload("User").
+		Preload("Track").
+		Preload("Track.Album").
+		Preload("Track.Artist").
+		Order("time, id")
+	if !now {
+		query = query.Where("next_attempt<=?", time.Now())
+	}
+	var retries []*db.ScrobbleRetry
+	if err := query.Find(&retries).Error; err != nil {
+		return fmt.Errorf("find queued scrobbles: %w", err)
+	}
+
+	type key struct {
+		userID    int
+		scrobbler string
+	}
+	var keys []key
+	groups := map[key][]*db.ScrobbleRetry{}
+	for _, retry := range retries {
+		k := key{retry.UserID, retry.Scrobbler}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], retry)
+	}
+	errs := &multierr.Err{}
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			errs.Add(err)
+			break
+		}
+		scrobbler, ok := q.scrobblers[k.scrobbler]
+		if !ok {
+			errs.Add(fmt.Errorf("unknown scrobbler %q", k.scrobbler))
+			continue
+		}
+		if err := q.retry(ctx, scrobbler, groups[k]); err != nil {
+			errs.Add(err)
+		}
+	}
+	if errs.Len() > 0 {
+		return errs
+	}
+	return nil
+}
+
+// retry submits the scrobbles of one user to one scrobbler, in batches if it
+// can take them. if some fail, it says how many and the last reason
+func (q *Queue) retry(ctx context.Context, scrobbler Scrobbler, retries []*db.ScrobbleRetry) error {
+	user := retries[0].User
+	var batches [][]*db.ScrobbleRetry
+	batcher, canBatch := scrobbler.(BatchScrobbler)
+	for len(retries) > 0 {
+		n := 1
+		if canBatch {
+			n = len(retries)
+		}
+		if n > batchMax {
+			n = batchMax
+		}
+		batches = append(batches, retries[:n])
+		retries = retries[n:]
+	}
+	var failed, total int
+	var lastErr error
+	for _, batch := range batches {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var err error
+		if canBatch {
+			listens := make([]Listen, 0, len(batch))
+			for _, retry := range batch {
+				listens = append(listens, Listen{Track: retry.Track, Time: retry.Time})
+			}
+			err = batcher.ScrobbleBatch(user, listens)
+		} else {
+			err = scrobbler.Scrobble(user, batch[0].Track, batch[0].Time, true)
+		}
+		for range batch {
+			q.metrics.Scrobble(scrobbler.Name(), err)
+		}
+		if err := q.done(batch, err); err != nil {
+			return err
+		}
+		total += len(batch)
+		if err != nil {
+			failed += len(batch)
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("%s: %d of %d scrobbles for %q failed: %w", scrobbler.Name(), failed, total, user.Name, lastErr)
+	}
+	return nil
+}
+
+// done removes the retries from the queue if they were submitted, or else
+// keeps why they weren't and backs off. unauthorized ones are removed too,
+// they'd fail until the user links their account again, which they're told
+// about when the scrobble first fails. so are ones which failed too often
+func (q *Queue) done(retries []*db.ScrobbleRetry, submitErr error) error {
+	return q.db.Transaction(func(tx *gorm.DB) error {
+		for _, retry := range retries {
+			retry.Attempts++
+			if submitErr == nil || errors.Is(submitErr, ErrUnauthorized) || retry.Attempts >= retryAttemptsMax {
+				if err := tx.Delete(retry).Error; err != nil {
+					return fmt.Errorf("delete queued scrobble: %w", err)
+				}
+				continue
+			}
+			err := tx.
+				Model(retry).
+				UpdateColumns(map[string]interface{}{
+					"attempts":     retry.Attempts,
+					"next_attempt": time.Now().Add(retryBackoff(retry.Attempts)),
+					"error":        submitErr.Error(),
+				}).
+				Error
+			if err != nil {
+				return fmt.Errorf("save queued scrobble: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// retryBackoff is how long to wait after attempts failed retries
+func retryBackoff(attempts int) time.Duration {
+	backoff := retryBackoffMin
+	for i := 0; i < attempts && backoff < retryBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > retryBackoffMax {
+		return retryBackoffMax
+	}
+	return backoff
+}
@@ -0,0 +1,184 @@
+package scrobble
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+)
+
+var errOffline = errors.New("offline")
+
+type fakeScrobbler struct {
+	name string
+	mu   sync.Mutex
+	fail bool
+	// err is what a failure returns, errOffline if it's nil
+	err error
+	// calls is how many requests were made, and listens what they sent
+	calls   int
+	listens []Listen
+}
+
+func (s *fakeScrobbler) Name() string { return s.name }
+
+func (s *fakeScrobbler) Scrobble(_ *db.User, track *db.Track, stamp time.Time, _ bool) error {
+	return s.send([]Listen{{Track: track, Time: stamp}})
+}
+
+func (s *fakeScrobbler) send(listens []Listen) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.fail && s.err != nil {
+		return s.err
+	}
+	if s.fail {
+		return errOffline
+	}
+	s.listens = append(s.listens, listens...)
+	return nil
+}
+
+type fakeBatchScrobbler struct {
+	fakeScrobbler
+}
+
+func (s *fakeBatchScrobbler) ScrobbleBatch(_ *db.User, listens []Listen) error {
+	return s.send(listens)
+}
+
+func newQueueDB(t *testing.T) (*db.DB, *db.User, []*db.Track) {
+	t.Helper()
+	is := is.New(t)
+	dbc, err := db.NewMock()
+	is.NoErr(err)
+	t.Cleanup(func() { dbc.Close() })
+	is.NoErr(dbc.Migrate(db.MigrationContext{}))
+
+	user := &db.User{Name: "user", Password: "password"}
+	is.NoErr(dbc.Create(user).Error)
+	artist := &db.Artist{Name: "artist"}
+	is.NoErr(dbc.Create(artist).Error)
+	album := &db.Album{RightPath: "album", RootDir: "/music"}
+	is.NoErr(dbc.Create(album).Error)
+	var tracks []*db.Track
+	for i := 0; i < 3; i++ {
+		track := &db.Track{AlbumID: album.ID, ArtistID: artist.ID, Filename: fmt.Sprintf("track-%d.flac", i), TagTitle: "track"}
+		is.NoErr(dbc.Create(track).Error)
+		tracks = append(tracks, track)
+	}
+	return dbc, user, tracks
+}
+
+func TestQueueAdd(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dbc, user, tracks := newQueueDB(t)
+	lastfm := &fakeScrobbler{name: "lastfm"}
+	listenbrainz := &fakeBatchScrobbler{fakeScrobbler{name: "listenbrainz"}}
+	queue := NewQueue(dbc, []Scrobbler{lastfm, listenbrainz})
+
+	stamp := time.Now().Truncate(time.Second)
+	is.NoErr(queue.Add(lastfm, user, tracks[0], stamp, errOffline))
+	is.NoErr(queue.Add(lastfm, user, tracks[0], stamp, errOffline))                  // the same scrobble
+	is.NoErr(queue.Add(listenbrainz, user, tracks[0], stamp, errOffline))            // to another scrobbler
+	is.NoErr(queue.Add(lastfm, user, tracks[0], stamp.Add(time.Minute), errOffline)) // played again
+
+	pending, err := queue.Pending(10)
+	is.NoErr(err)
+	is.Equal(len(pending), 3)
+	is.Equal(pending[0].User.Name, "user")
+	is.Equal(pending[0].Track.ID, tracks[0].ID)
+	is.Equal(pending[0].Error, errOffline.Error())
+
+	// none are due yet
+	is.NoErr(queue.Retry(context.Background(), false))
+	is.Equal(lastfm.calls, 0)
+	is.Equal(listenbrainz.calls, 0)
+}
+
+func TestQueueRetry(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dbc, user, tracks := newQueueDB(t)
+	lastfm := &fakeScrobbler{name: "lastfm", fail: true}
+	listenbrainz := &fakeBatchScrobbler{fakeScrobbler{name: "listenbrainz", fail: true}}
+	queue := NewQueue(dbc, []Scrobbler{lastfm, listenbrainz})
+
+	stamp := time.Now().Truncate(time.Second)
+	for i, track := range tracks {
+		is.NoErr(queue.Add(lastfm, user, track, stamp.Add(time.Duration(i)*time.Minute), errOffline))
+		is.NoErr(queue.Add(listenbrainz, user, track, stamp.Add(time.Duration(i)*time.Minute), errOffline))
+	}
+
+	// nothing is sent once the context is done, like when gonic is stopping
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	is.True(errors.Is(queue.Retry(ctx, true), context.Canceled))
+	is.Equal(lastfm.calls+listenbrainz.calls, 0)
+
+	// still offline, so they wait longer
+	is.True(queue.Retry(context.Background(), true) != nil)
+	is.Equal(lastfm.calls, 3)       // one at a time
+	is.Equal(listenbrainz.calls, 1) // in one batch
+	pending, err := queue.Pending(10)
+	is.NoErr(err)
+	is.Equal(len(pending), 6)
+	for _, retry := range pending {
+		is.Equal(retry.Attempts, 1)
+		is.True(retry.NextAttempt.After(time.Now().Add(retryBackoffMin)))
+	}
+
+	// back online
+	lastfm.fail = false
+	listenbrainz.fail = false
+	is.NoErr(queue.Retry(context.Background(), true))
+	is.Equal(len(lastfm.listens), 3)
+	is.Equal(len(listenbrainz.listens), 3)
+	is.Equal(listenbrainz.calls, 2)
+	is.Equal(listenbrainz.listens[0].Track.ID, tracks[0].ID)
+	is.Equal(listenbrainz.listens[2].Time.Unix(), stamp.Add(2*time.Minute).Unix())
+	pending, err = queue.Pending(10)
+	is.NoErr(err)
+	is.Equal(len(pending), 0)
+}
+
+func TestQueueRetryUnauthorized(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dbc, user, tracks := newQueueDB(t)
+	lastfm := &fakeScrobbler{name: "lastfm", fail: true, err: fmt.Errorf("lastfm: %w", ErrUnauthorized)}
+	queue := NewQueue(dbc, []Scrobbler{lastfm})
+	is.NoErr(queue.Add(lastfm, user, tracks[0], time.Now(), errOffline))
+
+	// it would fail until the account is linked again, so it isn't kept
+	is.True(queue.Retry(context.Background(), true) != nil)
+	is.Equal(lastfm.calls, 1)
+	pending, err := queue.Pending(10)
+	is.NoErr(err)
+	is.Equal(len(pending), 0)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	is.Equal(retryBackoff(0), time.Minute)
+	is.Equal(retryBackoff(1), 2*time.Minute)
+	is.Equal(retryBackoff(3), 8*time.Minute)
+	is.Equal(retryBackoff(20), retryBackoffMax)
+}
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
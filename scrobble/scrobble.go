@@ -1,11 +1,72 @@
 package scrobble
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	"go.senan.xyz/gonic/db"
 )
 
+// ErrUnauthorized is returned when a scrobbler rejects the user's session or
+// token, so they need to link their account again
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ErrInvalidURL is returned by NormaliseURL for addresses which aren't http(s)
+var ErrInvalidURL = errors.New("invalid url")
+
 type Scrobbler interface {
+	// Name says which scrobbler a queued scrobble is for
+	Name() string
 	Scrobble(user *db.User, track *db.Track, stamp time.Time, submission bool) error
 }
+
+// LinkScrobbler is a Scrobbler which knows if the user has linked it. it does
+// nothing for users who haven't
+type LinkScrobbler interface {
+	Scrobbler
+	IsLinked(user *db.User) bool
+}
+
+// IsLinked is true if the user has linked scrobbler, or if it can't tell
+func IsLinked(scrobbler Scrobbler, user *db.User) bool {
+	linker, ok := scrobbler.(LinkScrobbler)
+	return !ok || linker.IsLinked(user)
+}
+
+// Listen is a track the user listened to at Time
+type Listen struct {
+	Track *db.Track
+	Time  time.Time
+}
+
+// BatchScrobbler is a Scrobbler which can submit a number of the user's
+// listens in one request
+type BatchScrobbler interface {
+	Scrobbler
+	ScrobbleBatch(user *db.User, listens []Listen) error
+}
+
+// NormaliseURL checks that raw is the address of a scrobbling server, so that
+// users are told it's wrong when they save it. it's returned without a
+// trailing slash. it can have a path, which the api paths go under
+func NormaliseURL(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%w: it should start with http:// or https://", ErrInvalidURL)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("%w: it has no host", ErrInvalidURL)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%w: it should only have a host and path", ErrInvalidURL)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
@@ -2,7 +2,9 @@
 package ctrladmin
 
 import (
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"html/template"
@@ -23,8 +25,17 @@ import (
 	"go.senan.xyz/gonic"
 	"go.senan.xyz/gonic/server/assets"
 	"go.senan.xyz/gonic/server/ctrlbase"
+	"go.senan.xyz/gonic/backup"
+	"go.senan.xyz/gonic/coverarchive"
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/history"
+	"go.senan.xyz/gonic/locale"
+	"go.senan.xyz/gonic/notify"
 	"go.senan.xyz/gonic/podcasts"
+	"go.senan.xyz/gonic/scanner"
+	"go.senan.xyz/gonic/scrobble"
+	"go.senan.xyz/gonic/transcode"
+	"go.senan.xyz/gonic/warm"
 )
 
 type CtxKey int
@@ -43,10 +54,12 @@ func funcMap() template.FuncMap {
 			parsed.RawQuery = params.Encode()
 			return parsed.String()
 		},
-		"date": func(in time.Time) string {
-			return strings.ToLower(in.Format("Jan 02, 2006"))
+		"bytes": func(in int64) string {
+			return humanize.Bytes(uint64(in))
+		},
+		"duration": func(in time.Duration) string {
+			return in.Round(10 * time.Millisecond).String()
 		},
-		"dateHuman": humanize.Time,
 	}
 }
 
@@ -56,9 +69,30 @@ type Controller struct {
 	templates map[string]*template.Template
 	sessDB    *gormstore.Store
 	Podcasts  *podcasts.Podcasts
+	// ScrobbleQueue's pending scrobbles are shown on the home page, and can
+	// be sent now
+	ScrobbleQueue *scrobble.Queue
+	// History imports users' listening history from scrobblers
+	History *history.Importer
+	// CoverArchive is run after scans, and when it's enabled
+	CoverArchive *coverarchive.Fetcher
+	// TranscodeCache can be purged from the home page
+	TranscodeCache *transcode.CachingTranscoder
+	// TranscodeLimiter's running and waiting transcodes are shown on the home page
+	TranscodeLimiter *transcode.Limiter
+	// Warmer can be given albums and playlists to warm the cache with
+	Warmer *warm.Warmer
+	// SetupPaths are checked by the setup page on the first run
+	SetupPaths []SetupPath
+	// MusicFolders can be scanned one at a time from the home page
+	MusicFolders []*db.MusicFolder
+	// Backups of the db can be downloaded, or written to its dir, from the
+	// home page
+	Backups *backup.Backups
+	setup   setup
 }
 
-func New(b *ctrlbase.Controller, sessDB *gormstore.Store, podcasts *podcasts.Podcasts) (*Controller, error) {
+func New(b *ctrlbase.Controller, sessDB *gormstore.Store, podcasts *podcasts.Podcasts, scrobbleQueue *scrobble.Queue, history *history.Importer, coverArchive *coverarchive.Fetcher, transcodeCache *transcode.CachingTranscoder, transcodeLimiter *transcode.Limiter, warmer *warm.Warmer) (*Controller, error) {
 	tmpl := template.
 		New("layout").
 		Funcs(sprig.FuncMap()).
@@ -90,13 +124,46 @@ func New(b *ctrlbase.Controller, sessDB *gormstore.Store, podcasts *podcasts.Pod
 		pages[pageName] = page
 	}
 
-	return &Controller{
-		Controller: b,
-		buffPool:   bpool.NewBufferPool(64),
-		templates:  pages,
-		sessDB:     sessDB,
-		Podcasts:   podcasts,
-	}, nil
+	c := &Controller{
+		Controller:       b,
+		buffPool:         bpool.NewBufferPool(64),
+		templates:        pages,
+		sessDB:           sessDB,
+		Podcasts:         podcasts,
+		ScrobbleQueue:    scrobbleQueue,
+		History:          history,
+		CoverArchive:     coverArchive,
+		TranscodeCache:   transcodeCache,
+		TranscodeLimiter: transcodeLimiter,
+		Warmer:           warmer,
+	}
+	if err := c.startSetup(); err != nil {
+		return nil, fmt.Errorf("start setup: %w", err)
+	}
+	return c, nil
+}
+
+// MusicFolderScan is the scan state of a music folder
+type MusicFolderScan struct {
+	ID         int
+	Name       string
+	LastScanAt time.Time
+	IsScanning bool
+}
+
+// UserMusicFolder is a music folder, and whether the selected user has been
+// granted it
+type UserMusicFolder struct {
+	ID      int
+	Name    string
+	Granted bool
+}
+
+// ArtistGroup is a group of an artist's albums, like getArtist's discography.
+// Title is empty for the one group of an artist with only ordinary albums
+type ArtistGroup struct {
+	Title  string
+	Albums []*db.Album
 }
 
 type templateData struct {
@@ -104,6 +171,7 @@ type templateData struct {
 	Flashes []interface{}
 	User    *db.User
 	Version string
+	Locale  *locale.Locale
 	// home
 	AlbumCount           int
 	ArtistCount          int
@@ -112,18 +180,65 @@ type templateData struct {
 	RecentFolders        []*db.Album
 	AllUsers             []*db.User
 	LastScanTime         time.Time
+	SlowestFolders       []*scanner.DirTiming
 	IsScanning           bool
+	MusicFolders         []*MusicFolderScan
 	Playlists            []*db.Playlist
+	PlaylistImages       map[int]bool
 	TranscodePreferences []*db.TranscodePreference
 	TranscodeProfiles    []string
+	TranscodeCacheSize   int64
+	TranscodeCacheLimit  int64
+	TranscodeWarmQueued  int
+	TranscodesActive     int
+	TranscodesQueued     int
+	TranscodesLimit      int
+	ReplayGainModes      []transcode.ReplayGainMode
+	RawRules             []*db.RawRule
+	APIKeys              []*db.APIKey
+	Locales              []locale.Choice
+	NotificationSinks    []string
+	NotificationEvents   []notify.EventType
+	ScrobbleQueue        []*db.ScrobbleRetry
+	// ScrobbleQueueCount is every queued scrobble, not only the ones shown
+	ScrobbleQueueCount int
+	// ScrobbleDuplicateWindow is in seconds
+	ScrobbleDuplicateWindow int
+	ScrobbleRequirePlaying  bool
+
+	AvatarCount         int
+	PublicAvatars       bool
+	CoverArchiveEnabled bool
+	FetchedCoverCount   int
+
+	SetupToken        string
+	SetupChecks       []SetupCheck
+	MinPasswordLength int
+
+	SettingVersions     map[string]string
+	SettingConflicts    []db.SettingConflict
+	SettingConflictBack string
 
 	CurrentLastFMAPIKey    string
-	CurrentLastFMAPISecret string
+	LastFMSecretSet        bool
 	DefaultListenBrainzURL string
+	HistoryImports         []*history.Status
 	SelectedUser           *db.User
-
-	Podcasts []*db.Podcast
+	// UserMusicFolders are the folders to grant SelectedUser. if none are
+	// granted, they can see all of them
+	UserMusicFolders []*UserMusicFolder
+
+	Podcasts      []*db.Podcast
+	PodcastImport podcasts.ImportStatus
+	// PodcastFailures is how many episodes of each podcast failed to download
+	PodcastFailures       map[int]int
 	InternetRadioStations []*db.InternetRadioStation
+
+	BackupDir string
+	Backups   []*backup.File
+
+	Artist       *db.Artist
+	ArtistGroups []*ArtistGroup
 }
 
 type Response struct {
@@ -187,6 +302,9 @@ func (c *Controller) H(h handlerAdmin) http.Handler {
 		}
 		if user, ok := r.Context().Value(CtxUser).(*db.User); ok {
 			resp.data.User = user
+			resp.data.Locale = locale.New(user.Locale)
+		} else {
+			resp.data.Locale = locale.New("")
 		}
 
 		buff := c.buffPool.Get()
@@ -266,6 +384,79 @@ func sessLogSave(s *sessions.Session, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// sessLogIn puts the user into the session, along with a stamp of their
+// password. WithUserSession ends the session once the stamp doesn't match, so
+// that changing a password logs the user out everywhere
+func sessLogIn(s *sessions.Session, user *db.User) {
+	s.Values["user"] = user.ID
+	s.Values["password"] = passwordStamp(user)
+}
+
+func passwordStamp(user *db.User) string {
+	sum := sha256.Sum256([]byte(user.Password))
+	return hex.EncodeToString(sum[:8])
+}
+
+// settingVersions has the version of each setting which a page's forms edit.
+// forms send them back as `version_<key>`, see db.EditSettings
+func (c *Controller) settingVersions(keys ...string) (map[string]string, error) {
+	versions := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, err := c.DB.GetSetting(key)
+		if err != nil {
+			return nil, fmt.Errorf("get setting %q: %w", key, err)
+		}
+		versions[key] = db.SettingVersion(value)
+	}
+	return versions, nil
+}
+
+func settingEdit(r *http.Request, key, value string) db.SettingEdit {
+	return db.SettingEdit{
+		Key:     key,
+		Version: r.FormValue("version_" + key),
+		Value:   value,
+	}
+}
+
+// secretSettings are never shown, only whether they're set
+var secretSettings = map[string]struct{}{
+	"lastfm_secret": {},
+}
+
+func maskSecretSetting(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "set"
+}
+
+// editSettings saves edits from a form, showing a conflict page instead if
+// another admin changed the same settings since the form was rendered
+func (c *Controller) editSettings(back string, edits ...db.SettingEdit) *Response {
+	conflicts, err := c.DB.EditSettings(edits)
+	if errors.Is(err, db.ErrSettingConflict) {
+		for i, conflict := range conflicts {
+			if _, ok := secretSettings[conflict.Key]; ok {
+				conflicts[i].Current = maskSecretSetting(conflict.Current)
+				conflicts[i].Value = maskSecretSetting(conflict.Value)
+			}
+		}
+		return &Response{
+			code:     http.StatusConflict,
+			template: "settings_conflict.tmpl",
+			data: &templateData{
+				SettingConflicts:    conflicts,
+				SettingConflictBack: back,
+			},
+		}
+	}
+	if err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("couldn't save settings: %v", err)}
+	}
+	return nil
+}
+
 // ## begin validation
 // ## begin validation
 // ## begin validation
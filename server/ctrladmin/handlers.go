@@ -1,28 +1,59 @@
 package ctrladmin
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/dustin/go-humanize"
+	"github.com/gorilla/sessions"
 	"github.com/mmcdole/gofeed"
 
+	"go.senan.xyz/gonic/avatar"
+	"go.senan.xyz/gonic/backup"
+	"go.senan.xyz/gonic/coverarchive"
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/history"
+	"go.senan.xyz/gonic/locale"
+	"go.senan.xyz/gonic/podcasts"
 	"go.senan.xyz/gonic/scanner"
+	"go.senan.xyz/gonic/scrobble"
 	"go.senan.xyz/gonic/scrobble/lastfm"
 	"go.senan.xyz/gonic/scrobble/listenbrainz"
 	"go.senan.xyz/gonic/transcode"
 )
 
-func doScan(scanner *scanner.Scanner, opts scanner.ScanOptions) {
-	go func() {
-		if _, err := scanner.ScanAndClean(opts); err != nil {
-			log.Printf("error while scanning: %v\n", err)
+// startScan tells the admin whether the scan started, was already running, or
+// couldn't start, and why
+func startScan(s *scanner.Scanner, opts scanner.ScanOptions, kind string) *Response {
+	err := s.Start(opts)
+	switch {
+	case errors.Is(err, scanner.ErrAlreadyScanning):
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("%s scan not started, %v", kind, err)},
 		}
-	}()
+	case err != nil:
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't start %s scan: %v", kind, err)},
+		}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{fmt.Sprintf("%s scan started. refresh for results", kind)},
+	}
 }
 
 func (c *Controller) ServeNotFound(r *http.Request) *Response {
@@ -30,9 +61,18 @@ func (c *Controller) ServeNotFound(r *http.Request) *Response {
 }
 
 func (c *Controller) ServeLogin(r *http.Request) *Response {
+	if c.setupPending() {
+		return &Response{redirect: "/admin/setup"}
+	}
+	if user, _ := c.ProxyUser(r); user != nil {
+		return &Response{redirect: "/admin/home"}
+	}
 	return &Response{template: "login.tmpl"}
 }
 
+// scrobbleQueueShown is how many of the queued scrobbles the home page lists
+const scrobbleQueueShown = 20
+
 func (c *Controller) ServeHome(r *http.Request) *Response {
 	data := &templateData{}
 	// stats box
@@ -43,27 +83,83 @@ func (c *Controller) ServeHome(r *http.Request) *Response {
 	data.RequestRoot = c.BaseURL(r)
 	data.CurrentLastFMAPIKey, _ = c.DB.GetSetting("lastfm_api_key")
 	data.DefaultListenBrainzURL = listenbrainz.BaseURL
+	// listening history box
+	data.HistoryImports, _ = c.History.Statuses(r.Context().Value(CtxUser).(*db.User).ID)
+	// avatar box
+	c.DB.
+		Model(&db.Avatar{}).
+		Where("user_id=?", r.Context().Value(CtxUser).(*db.User).ID).
+		Count(&data.AvatarCount)
+	public, _ := c.DB.GetSetting(avatar.SettingPublic)
+	data.PublicAvatars = public == "true"
+	// cover art archive box
+	data.CoverArchiveEnabled = c.CoverArchive.IsEnabled()
+	var err error
+	data.SettingVersions, err = c.settingVersions(avatar.SettingPublic, coverarchive.SettingEnabled, scrobble.SettingDuplicateWindow, scrobble.SettingRequirePlaying)
+	if err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("couldn't get settings: %v", err)}
+	}
+	c.DB.
+		Model(&db.FetchedCover{}).
+		Where("coalesce(path, '')!=''").
+		Count(&data.FetchedCoverCount)
 	// users box
 	c.DB.Find(&data.AllUsers)
 	// recent folders box
 	c.DB.
 		Where("tag_artist_id IS NOT NULL").
+		Where("created_at<=?", time.Now()).
 		Order("created_at DESC").
 		Limit(8).
 		Find(&data.RecentFolders)
+	// folders being scanned from another process are seen by their leases
+	var folders []*db.MusicFolder
+	c.DB.Find(&folders)
+	lastScans := map[int]time.Time{}
+	for _, folder := range folders {
+		lastScans[folder.ID] = folder.LastScanAt
+	}
 	data.IsScanning = c.Scanner.IsScanning()
+	for _, folder := range c.MusicFolders {
+		scan := &MusicFolderScan{
+			ID:         folder.ID,
+			Name:       folder.Name,
+			LastScanAt: lastScans[folder.ID],
+			IsScanning: c.Scanner.IsScanningDir(folder.Path) || c.Scanner.ActiveLease(folder.Path) != nil,
+		}
+		data.IsScanning = data.IsScanning || scan.IsScanning
+		data.MusicFolders = append(data.MusicFolders, scan)
+	}
 	if tStr, err := c.DB.GetSetting("last_scan_time"); err != nil {
 		i, _ := strconv.ParseInt(tStr, 10, 64)
 		data.LastScanTime = time.Unix(i, 0)
 	}
+	if timings, err := scanner.LastTimings(c.DB); err != nil {
+		log.Printf("error getting last scan timing: %v", err)
+	} else if len(timings) > 5 {
+		data.SlowestFolders = timings[:5]
+	} else {
+		data.SlowestFolders = timings
+	}
 
 	user := r.Context().Value(CtxUser).(*db.User)
 
+	// language box
+	data.Locales = locale.Supported
 	// playlists box
 	c.DB.
 		Where("user_id=?", user.ID).
 		Limit(20).
 		Find(&data.Playlists)
+	data.PlaylistImages = map[int]bool{}
+	for _, playlist := range data.Playlists {
+		var count int
+		c.DB.
+			Model(&db.PlaylistImage{}).
+			Where("playlist_id=?", playlist.ID).
+			Count(&count)
+		data.PlaylistImages[playlist.ID] = count > 0
+	}
 	// transcoding box
 	c.DB.
 		Where("user_id=?", user.ID).
@@ -71,11 +167,52 @@ func (c *Controller) ServeHome(r *http.Request) *Response {
 	for profile := range transcode.UserProfiles {
 		data.TranscodeProfiles = append(data.TranscodeProfiles, profile)
 	}
+	sort.Strings(data.TranscodeProfiles)
+	data.TranscodeCacheSize = c.TranscodeCache.Size()
+	data.TranscodeCacheLimit = c.TranscodeCache.Limit()
+	data.TranscodeWarmQueued = c.Warmer.Queued()
+	data.TranscodesActive = c.TranscodeLimiter.Active()
+	data.TranscodesQueued = c.TranscodeLimiter.Queued()
+	data.TranscodesLimit = c.TranscodeLimiter.Limit()
+	data.ReplayGainModes = transcode.ReplayGainModes
+	// always raw box
+	c.DB.
+		Order("created_at").
+		Find(&data.RawRules)
+	// api keys box
+	c.DB.
+		Where("user_id=?", user.ID).
+		Order("created_at").
+		Find(&data.APIKeys)
+	// notifications box
+	data.NotificationSinks = c.Notifier.Sinks()
+	data.NotificationEvents = c.Notifier.Events()
+	// scrobble rules box
+	duplicateWindow, _ := c.DB.GetSetting(scrobble.SettingDuplicateWindow)
+	data.ScrobbleDuplicateWindow, _ = strconv.Atoi(duplicateWindow)
+	requirePlaying, _ := c.DB.GetSetting(scrobble.SettingRequirePlaying)
+	data.ScrobbleRequirePlaying = requirePlaying == "true"
+	// scrobble queue box
+	data.ScrobbleQueue, _ = c.ScrobbleQueue.Pending(scrobbleQueueShown)
+	data.ScrobbleQueueCount, _ = c.ScrobbleQueue.PendingCount()
 	// podcasts box
 	c.DB.Find(&data.Podcasts)
+	data.PodcastImport = c.Podcasts.ImportStatus()
+	data.PodcastFailures = map[int]int{}
+	for _, podcast := range data.Podcasts {
+		var count int
+		c.DB.
+			Model(&db.PodcastEpisode{}).
+			Where("podcast_id=? AND status=?", podcast.ID, db.PodcastEpisodeStatusError).
+			Count(&count)
+		data.PodcastFailures[podcast.ID] = count
+	}
 
 	// internet radio box
 	c.DB.Find(&data.InternetRadioStations)
+	// database backup box
+	data.BackupDir = c.Backups.Dir()
+	data.Backups, _ = c.Backups.List()
 
 	return &Response{
 		template: "home.tmpl",
@@ -117,6 +254,10 @@ func (c *Controller) ServeChangeOwnPasswordDo(r *http.Request) *Response {
 	user := r.Context().Value(CtxUser).(*db.User)
 	user.Password = passwordOne
 	c.DB.Save(user)
+	// stay logged in here, but not anywhere else
+	if session, ok := r.Context().Value(CtxSession).(*sessions.Session); ok {
+		sessLogIn(session, user)
+	}
 	return &Response{redirect: "/admin/home"}
 }
 
@@ -162,6 +303,13 @@ func (c *Controller) ServeLinkListenBrainzDo(r *http.Request) *Response {
 			flashW:   []string{"please provide a url and token"},
 		}
 	}
+	url, err := scrobble.NormaliseURL(url)
+	if err != nil {
+		return &Response{
+			redirect: r.Referer(),
+			flashW:   []string{err.Error()},
+		}
+	}
 	user := r.Context().Value(CtxUser).(*db.User)
 	user.ListenBrainzURL = url
 	user.ListenBrainzToken = token
@@ -169,6 +317,114 @@ func (c *Controller) ServeLinkListenBrainzDo(r *http.Request) *Response {
 	return &Response{redirect: "/admin/home"}
 }
 
+// ServeImportLastFMHistoryDo imports the user's scrobbles from a last.fm
+// username, which doesn't need to be the linked account
+func (c *Controller) ServeImportLastFMHistoryDo(r *http.Request) *Response {
+	username := strings.TrimSpace(r.FormValue("username"))
+	if username == "" {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{"please provide a last.fm username"},
+		}
+	}
+	apiKey, err := c.DB.GetSetting("lastfm_api_key")
+	if err != nil || apiKey == "" {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{"please ask an admin to set a last.fm api key first"},
+		}
+	}
+	user := r.Context().Value(CtxUser).(*db.User)
+	if err := c.History.StartLastFM(user.ID, apiKey, username); err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't import history: %v", err)},
+		}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{"importing last.fm history. refresh to see how it's going"},
+	}
+}
+
+// ServeImportListenBrainzHistoryDo imports the user's listens from an
+// uploaded listenbrainz export
+func (c *Controller) ServeImportListenBrainzHistoryDo(r *http.Request) *Response {
+	file, _, err := r.FormFile("listens")
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't read export: %v", err)},
+		}
+	}
+	defer file.Close()
+	listens, err := history.ReadListenBrainz(file)
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't read export: %v", err)},
+		}
+	}
+	user := r.Context().Value(CtxUser).(*db.User)
+	if err := c.History.StartListenBrainz(user.ID, listens); err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't import history: %v", err)},
+		}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{fmt.Sprintf("importing %d listenbrainz listens. refresh to see how it's going", len(listens))},
+	}
+}
+
+func (c *Controller) ServeUpdateArtistIndexDo(r *http.Request) *Response {
+	mode := r.FormValue("mode")
+	switch mode {
+	case db.ArtistIndexAll, db.ArtistIndexAlbumArtists, db.ArtistIndexCredited:
+	default:
+		return &Response{code: 400, err: fmt.Sprintf("unknown artist index mode %q", mode)}
+	}
+	minCredits, _ := strconv.Atoi(r.FormValue("min_credits"))
+	if mode == db.ArtistIndexCredited && minCredits < 1 {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{"please provide a number of credited tracks of at least 1"},
+		}
+	}
+	user := r.Context().Value(CtxUser).(*db.User)
+	user.ArtistIndex = mode
+	user.ArtistIndexMinCredits = minCredits
+	c.DB.Save(user)
+	return &Response{redirect: "/admin/home"}
+}
+
+func (c *Controller) ServeUpdateLocaleDo(r *http.Request) *Response {
+	tag := r.FormValue("locale")
+	if !locale.IsSupported(tag) {
+		return &Response{code: 400, err: fmt.Sprintf("unknown locale %q", tag)}
+	}
+	user := r.Context().Value(CtxUser).(*db.User)
+	user.Locale = tag
+	c.DB.Save(user)
+	return &Response{redirect: "/admin/home"}
+}
+
+func (c *Controller) ServeUpdateReplayGainDo(r *http.Request) *Response {
+	mode := transcode.ReplayGainMode(r.FormValue("mode"))
+	var known bool
+	for _, m := range transcode.ReplayGainModes {
+		known = known || m == mode
+	}
+	if !known {
+		return &Response{code: 400, err: fmt.Sprintf("unknown replay gain mode %q", mode)}
+	}
+	user := r.Context().Value(CtxUser).(*db.User)
+	user.ReplayGain = string(mode)
+	c.DB.Save(user)
+	return &Response{redirect: "/admin/home"}
+}
+
 func (c *Controller) ServeUnlinkListenBrainzDo(r *http.Request) *Response {
 	user := r.Context().Value(CtxUser).(*db.User)
 	user.ListenBrainzURL = ""
@@ -177,6 +433,37 @@ func (c *Controller) ServeUnlinkListenBrainzDo(r *http.Request) *Response {
 	return &Response{redirect: "/admin/home"}
 }
 
+func (c *Controller) ServeLinkMalojaDo(r *http.Request) *Response {
+	key := r.FormValue("key")
+	url := r.FormValue("url")
+	if key == "" || url == "" {
+		return &Response{
+			redirect: r.Referer(),
+			flashW:   []string{"please provide a url and api key"},
+		}
+	}
+	url, err := scrobble.NormaliseURL(url)
+	if err != nil {
+		return &Response{
+			redirect: r.Referer(),
+			flashW:   []string{err.Error()},
+		}
+	}
+	user := r.Context().Value(CtxUser).(*db.User)
+	user.MalojaURL = url
+	user.MalojaAPIKey = key
+	c.DB.Save(&user)
+	return &Response{redirect: "/admin/home"}
+}
+
+func (c *Controller) ServeUnlinkMalojaDo(r *http.Request) *Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	user.MalojaURL = ""
+	user.MalojaAPIKey = ""
+	c.DB.Save(&user)
+	return &Response{redirect: "/admin/home"}
+}
+
 func (c *Controller) ServeChangeUsername(r *http.Request) *Response {
 	username := r.URL.Query().Get("user")
 	if username == "" {
@@ -209,6 +496,99 @@ func (c *Controller) ServeChangeUsernameDo(r *http.Request) *Response {
 	return &Response{redirect: "/admin/home"}
 }
 
+func (c *Controller) ServeChangeRole(r *http.Request) *Response {
+	username := r.URL.Query().Get("user")
+	if username == "" {
+		return &Response{code: 400, err: "please provide a username"}
+	}
+	user := c.DB.GetUserByName(username)
+	if user == nil {
+		return &Response{code: 400, err: "couldn't find a user with that name"}
+	}
+	data := &templateData{}
+	data.SelectedUser = user
+	return &Response{
+		template: "change_role.tmpl",
+		data:     data,
+	}
+}
+
+func (c *Controller) ServeChangeRoleDo(r *http.Request) *Response {
+	username := r.URL.Query().Get("user")
+	user := c.DB.GetUserByName(username)
+	if user == nil {
+		return &Response{code: 400, err: "couldn't find a user with that name"}
+	}
+	user.IsReadOnly = r.FormValue("read_only") == "true"
+	if err := c.DB.Save(user).Error; err != nil {
+		return &Response{
+			redirect: r.Referer(),
+			flashW:   []string{fmt.Sprintf("couldn't save role: %v", err)},
+		}
+	}
+	return &Response{redirect: "/admin/home"}
+}
+
+func (c *Controller) ServeChangeMusicFolders(r *http.Request) *Response {
+	username := r.URL.Query().Get("user")
+	if username == "" {
+		return &Response{code: 400, err: "please provide a username"}
+	}
+	user := c.DB.GetUserByName(username)
+	if user == nil {
+		return &Response{code: 400, err: "couldn't find a user with that name"}
+	}
+	ids, err := c.DB.GetUserMusicFolderIDs(user.ID)
+	if err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("couldn't get music folders: %v", err)}
+	}
+	granted := map[int]bool{}
+	for _, id := range ids {
+		granted[id] = true
+	}
+	data := &templateData{}
+	data.SelectedUser = user
+	for _, folder := range c.MusicFolders {
+		data.UserMusicFolders = append(data.UserMusicFolders, &UserMusicFolder{
+			ID:      folder.ID,
+			Name:    folder.Name,
+			Granted: granted[folder.ID],
+		})
+	}
+	return &Response{
+		template: "change_music_folders.tmpl",
+		data:     data,
+	}
+}
+
+// ServeChangeMusicFoldersDo grants the user the checked music folders. with
+// none checked, they can see all of them
+func (c *Controller) ServeChangeMusicFoldersDo(r *http.Request) *Response {
+	username := r.URL.Query().Get("user")
+	user := c.DB.GetUserByName(username)
+	if user == nil {
+		return &Response{code: 400, err: "couldn't find a user with that name"}
+	}
+	if err := r.ParseForm(); err != nil {
+		return &Response{code: 400, err: fmt.Sprintf("couldn't parse form: %v", err)}
+	}
+	var ids []int
+	for _, value := range r.PostForm["folder"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return &Response{code: 400, err: fmt.Sprintf("invalid folder id %q", value)}
+		}
+		ids = append(ids, id)
+	}
+	if err := c.DB.SetUserMusicFolders(user.ID, ids); err != nil {
+		return &Response{
+			redirect: r.Referer(),
+			flashW:   []string{fmt.Sprintf("couldn't save music folders: %v", err)},
+		}
+	}
+	return &Response{redirect: "/admin/home"}
+}
+
 func (c *Controller) ServeChangePassword(r *http.Request) *Response {
 	username := r.URL.Query().Get("user")
 	if username == "" {
@@ -295,8 +675,9 @@ func (c *Controller) ServeCreateUserDo(r *http.Request) *Response {
 		}
 	}
 	user := db.User{
-		Name:     username,
-		Password: passwordOne,
+		Name:       username,
+		Password:   passwordOne,
+		IsReadOnly: r.FormValue("read_only") == "true",
 	}
 	if err := c.DB.Create(&user).Error; err != nil {
 		return &Response{
@@ -313,46 +694,169 @@ func (c *Controller) ServeUpdateLastFMAPIKey(r *http.Request) *Response {
 	if data.CurrentLastFMAPIKey, err = c.DB.GetSetting("lastfm_api_key"); err != nil {
 		return &Response{code: 500, err: fmt.Sprintf("couldn't get api key: %v", err)}
 	}
-	if data.CurrentLastFMAPISecret, err = c.DB.GetSetting("lastfm_secret"); err != nil {
+	secret, err := c.DB.GetSetting("lastfm_secret")
+	if err != nil {
 		return &Response{code: 500, err: fmt.Sprintf("couldn't get secret: %v", err)}
 	}
+	data.LastFMSecretSet = secret != ""
+	if data.SettingVersions, err = c.settingVersions("lastfm_api_key", "lastfm_secret"); err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("couldn't get settings: %v", err)}
+	}
 	return &Response{
 		template: "update_lastfm_api_key.tmpl",
 		data:     data,
 	}
 }
 
+// ServeUpdateLastFMAPIKeyDo saves the api key, and the secret if a new one was
+// entered. the form doesn't have the current secret, so a blank one keeps it
 func (c *Controller) ServeUpdateLastFMAPIKeyDo(r *http.Request) *Response {
 	apiKey := r.FormValue("api_key")
 	secret := r.FormValue("secret")
+	edits := []db.SettingEdit{settingEdit(r, "lastfm_api_key", apiKey)}
+	if secret != "" {
+		edits = append(edits, settingEdit(r, "lastfm_secret", secret))
+	} else {
+		var err error
+		if secret, err = c.DB.GetSetting("lastfm_secret"); err != nil {
+			return &Response{code: 500, err: fmt.Sprintf("couldn't get secret: %v", err)}
+		}
+	}
 	if err := validateAPIKey(apiKey, secret); err != nil {
 		return &Response{
 			redirect: r.Referer(),
 			flashW:   []string{err.Error()},
 		}
 	}
-	if err := c.DB.SetSetting("lastfm_api_key", apiKey); err != nil {
-		return &Response{code: 500, err: fmt.Sprintf("couldn't set api key: %v", err)}
+	if resp := c.editSettings("/admin/update_lastfm_api_key", edits...); resp != nil {
+		return resp
 	}
-	if err := c.DB.SetSetting("lastfm_secret", secret); err != nil {
-		return &Response{code: 500, err: fmt.Sprintf("couldn't set secret: %v", err)}
+	return &Response{redirect: "/admin/home"}
+}
+
+func (c *Controller) ServeUpdateCoverArchiveDo(r *http.Request) *Response {
+	enabled := r.FormValue("enabled") == "true"
+	if resp := c.editSettings("/admin/home", settingEdit(r, coverarchive.SettingEnabled, strconv.FormatBool(enabled))); resp != nil {
+		return resp
+	}
+	if !enabled {
+		return &Response{redirect: "/admin/home"}
+	}
+	go func() {
+		if err := c.CoverArchive.FetchMissing(context.Background()); err != nil {
+			log.Printf("error fetching covers: %v", err)
+		}
+	}()
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{"fetching missing covers. refresh for results"},
+	}
+}
+
+func (c *Controller) ServePurgeTranscodeCacheDo(r *http.Request) *Response {
+	freed := c.TranscodeCache.Purge()
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{fmt.Sprintf("purged %s of transcodes", humanize.Bytes(uint64(freed)))},
+	}
+}
+
+// ServeWarmTranscodeCacheDo queues the tracks of the album `album_id`, or the
+// playlist `playlist_id`, to be transcoded ahead of time
+func (c *Controller) ServeWarmTranscodeCacheDo(r *http.Request) *Response {
+	var n int
+	var err error
+	if id, ierr := strconv.Atoi(r.URL.Query().Get("playlist_id")); ierr == nil {
+		n, err = c.Warmer.QueuePlaylist(id)
+	} else if id, ierr := strconv.Atoi(r.URL.Query().Get("album_id")); ierr == nil {
+		n, err = c.Warmer.QueueAlbum(id)
+	} else {
+		return &Response{code: 400, err: "please provide an album_id or playlist_id"}
+	}
+	if err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("couldn't queue tracks: %v", err)}
+	}
+	if n == 0 {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{"nothing to warm. enable warming on a transcoding device profile first"},
+		}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{fmt.Sprintf("queued %d transcodes", n)},
+	}
+}
+
+func (c *Controller) ServeSendTestNotificationDo(r *http.Request) *Response {
+	if err := c.Notifier.Test(r.Context()); err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't send test notification: %s", strings.TrimSpace(err.Error()))},
+		}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{"sent test notification"},
+	}
+}
+
+func (c *Controller) ServeUpdateScrobbleRulesDo(r *http.Request) *Response {
+	window, err := strconv.Atoi(r.FormValue("duplicate_window"))
+	if err != nil || window < 0 {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{"please provide a number of seconds of at least 0"},
+		}
+	}
+	requirePlaying := r.FormValue("require_playing") == "true"
+	resp := c.editSettings("/admin/home",
+		settingEdit(r, scrobble.SettingDuplicateWindow, strconv.Itoa(window)),
+		settingEdit(r, scrobble.SettingRequirePlaying, strconv.FormatBool(requirePlaying)),
+	)
+	if resp != nil {
+		return resp
 	}
 	return &Response{redirect: "/admin/home"}
 }
 
-func (c *Controller) ServeStartScanIncDo(r *http.Request) *Response {
-	defer doScan(c.Scanner, scanner.ScanOptions{})
+func (c *Controller) ServeFlushScrobbleQueueDo(r *http.Request) *Response {
+	if err := c.ScrobbleQueue.Retry(r.Context(), true); err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't send some scrobbles: %s", strings.TrimSpace(err.Error()))},
+		}
+	}
 	return &Response{
 		redirect: "/admin/home",
-		flashN:   []string{"incremental scan started. refresh for results"},
+		flashN:   []string{"sent queued scrobbles"},
 	}
 }
 
+func (c *Controller) ServeStartScanIncDo(r *http.Request) *Response {
+	return c.startFolderScan(r, scanner.ScanOptions{}, "incremental")
+}
+
 func (c *Controller) ServeStartScanFullDo(r *http.Request) *Response {
-	defer doScan(c.Scanner, scanner.ScanOptions{IsFull: true})
+	return c.startFolderScan(r, scanner.ScanOptions{IsFull: true}, "full")
+}
+
+// startFolderScan scans every music folder, or only the one with the request's
+// music_folder_id
+func (c *Controller) startFolderScan(r *http.Request, opts scanner.ScanOptions, kind string) *Response {
+	id, err := strconv.Atoi(r.URL.Query().Get("music_folder_id"))
+	if err != nil {
+		return startScan(c.Scanner, opts, kind)
+	}
+	for _, folder := range c.MusicFolders {
+		if folder.ID == id {
+			opts.Dirs = []string{folder.Path}
+			return startScan(c.Scanner, opts, fmt.Sprintf("%s %q", kind, folder.Name))
+		}
+	}
 	return &Response{
 		redirect: "/admin/home",
-		flashN:   []string{"full scan started. refresh for results"},
+		flashW:   []string{fmt.Sprintf("couldn't find music folder %d", id)},
 	}
 }
 
@@ -370,6 +874,7 @@ func (c *Controller) ServeCreateTranscodePrefDo(r *http.Request) *Response {
 		UserID:  user.ID,
 		Client:  client,
 		Profile: profile,
+		Warm:    r.FormValue("warm") == "true",
 	}
 	if err := c.DB.Create(&pref).Error; err != nil {
 		return &Response{
@@ -380,6 +885,49 @@ func (c *Controller) ServeCreateTranscodePrefDo(r *http.Request) *Response {
 	return &Response{redirect: "/admin/home"}
 }
 
+func (c *Controller) ServeCreateRawRuleDo(r *http.Request) *Response {
+	rule := &db.RawRule{
+		Kind:    r.FormValue("kind"),
+		Pattern: strings.TrimSpace(r.FormValue("pattern")),
+	}
+	if rule.Pattern == "" {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{"please provide a pattern"},
+		}
+	}
+	switch rule.Kind {
+	case db.RawRuleExtension:
+	case db.RawRulePath:
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return &Response{
+				redirect: "/admin/home",
+				flashW:   []string{fmt.Sprintf("invalid path pattern %q: %v", rule.Pattern, err)},
+			}
+		}
+	default:
+		return &Response{code: 400, err: fmt.Sprintf("unknown rule kind %q", rule.Kind)}
+	}
+	if err := c.DB.Create(rule).Error; err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("could not create rule: %v", err)},
+		}
+	}
+	return &Response{redirect: "/admin/home"}
+}
+
+func (c *Controller) ServeDeleteRawRuleDo(r *http.Request) *Response {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return &Response{code: 400, err: "please provide a valid id"}
+	}
+	c.DB.
+		Where("id=?", id).
+		Delete(db.RawRule{})
+	return &Response{redirect: "/admin/home"}
+}
+
 func (c *Controller) ServeDeleteTranscodePrefDo(r *http.Request) *Response {
 	user := r.Context().Value(CtxUser).(*db.User)
 	client := r.URL.Query().Get("client")
@@ -394,6 +942,116 @@ func (c *Controller) ServeDeleteTranscodePrefDo(r *http.Request) *Response {
 	}
 }
 
+func (c *Controller) ServeCreateAPIKeyDo(r *http.Request) *Response {
+	name := r.FormValue("name")
+	if name == "" {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{"please provide a name for the key"},
+		}
+	}
+	user := r.Context().Value(CtxUser).(*db.User)
+	key, err := c.DB.CreateAPIKey(user.ID, name)
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("could not create key: %v", err)},
+		}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{fmt.Sprintf("created key %q: %s (it won't be shown again)", name, key)},
+	}
+}
+
+func (c *Controller) ServeDeleteAPIKeyDo(r *http.Request) *Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return &Response{code: 400, err: "please provide a valid id"}
+	}
+	c.DB.
+		Where("user_id=? AND id=?", user.ID, id).
+		Delete(db.APIKey{})
+	return &Response{
+		redirect: "/admin/home",
+	}
+}
+
+func (c *Controller) ServeRotateStreamKeyDo(r *http.Request) *Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	if err := c.DB.RotateStreamKey(user); err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("could not revoke signed urls: %v", err)},
+		}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{"all signed stream urls revoked"},
+	}
+}
+
+// ServeAvatar shows the user their own avatar, since the admin page can't use
+// subsonic auth for getAvatar
+func (c *Controller) ServeAvatar(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(CtxUser).(*db.User)
+	image, err := avatar.Image(c.DB, user, avatar.Sizes[0])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error getting avatar: %v", err), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(image)
+}
+
+func (c *Controller) ServeUploadAvatarDo(r *http.Request) *Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't read avatar: %v", err)},
+		}
+	}
+	defer file.Close()
+	images, err := avatar.Resize(file)
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't read avatar: %v", err)},
+		}
+	}
+	if err := c.DB.SetAvatar(user.ID, images); err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("couldn't save avatar: %v", err)}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{"avatar updated"},
+	}
+}
+
+func (c *Controller) ServeDeleteAvatarDo(r *http.Request) *Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	c.DB.
+		Where("user_id=?", user.ID).
+		Delete(db.Avatar{})
+	return &Response{
+		redirect: "/admin/home",
+	}
+}
+
+func (c *Controller) ServeUpdatePublicAvatarsDo(r *http.Request) *Response {
+	public := r.FormValue("public") == "true"
+	if resp := c.editSettings("/admin/home", settingEdit(r, avatar.SettingPublic, strconv.FormatBool(public))); resp != nil {
+		return resp
+	}
+	return &Response{
+		redirect: "/admin/home",
+	}
+}
+
 func (c *Controller) ServePodcastAddDo(r *http.Request) *Response {
 	rssURL := r.FormValue("feed")
 	fp := gofeed.NewParser()
@@ -415,6 +1073,51 @@ func (c *Controller) ServePodcastAddDo(r *http.Request) *Response {
 	}
 }
 
+// ServePodcastImportDo adds the feeds of an uploaded OPML file. they're
+// fetched in the background, and the podcasts box shows how far along it is
+func (c *Controller) ServePodcastImportDo(r *http.Request) *Response {
+	file, _, err := r.FormFile("opml")
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't read opml: %v", err)},
+		}
+	}
+	defer file.Close()
+	feeds, err := podcasts.ReadOPML(file)
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't read opml: %v", err)},
+		}
+	}
+	skipped, err := c.Podcasts.Import(feeds)
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't import podcasts: %v", err)},
+		}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{fmt.Sprintf("importing %d podcasts, skipped %d already added", len(feeds)-skipped, skipped)},
+	}
+}
+
+// ServePodcastExport downloads the feeds of every podcast as an OPML file
+func (c *Controller) ServePodcastExport(w http.ResponseWriter, r *http.Request) {
+	var all []*db.Podcast
+	if err := c.DB.Order("title").Find(&all).Error; err != nil {
+		http.Error(w, fmt.Sprintf("error finding podcasts: %v", err), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "gonic-podcasts.opml"}))
+	if err := podcasts.WriteOPML(w, all); err != nil {
+		log.Printf("error writing podcasts opml: %v", err)
+	}
+}
+
 func (c *Controller) ServePodcastDownloadDo(r *http.Request) *Response {
 	id, err := strconv.Atoi(r.URL.Query().Get("id"))
 	if err != nil {
@@ -429,22 +1132,51 @@ func (c *Controller) ServePodcastDownloadDo(r *http.Request) *Response {
 	}
 }
 
+// ServePodcastRetryDo downloads the podcast's failed episodes again
+func (c *Controller) ServePodcastRetryDo(r *http.Request) *Response {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return &Response{code: 400, err: "please provide a valid podcast id"}
+	}
+	count, err := c.Podcasts.RetryFailed(id)
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't retry some episodes: %v", err)},
+		}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{fmt.Sprintf("retrying %d podcast episodes", count)},
+	}
+}
+
 func (c *Controller) ServePodcastUpdateDo(r *http.Request) *Response {
 	id, err := strconv.Atoi(r.URL.Query().Get("id"))
 	if err != nil {
 		return &Response{code: 400, err: "please provide a valid podcast id"}
 	}
 	setting := db.PodcastAutoDownload(r.FormValue("setting"))
+	var keep int
 	var message string
 	switch setting {
 	case db.PodcastAutoDownloadLatest:
+		keep, err = strconv.Atoi(r.FormValue("keep"))
+		if err != nil || keep < 1 {
+			return &Response{
+				redirect: "/admin/home",
+				flashW:   []string{"please provide how many episodes to keep"},
+			}
+		}
+		message = fmt.Sprintf("future podcast episodes will be automatically downloaded, keeping the latest %d", keep)
+	case db.PodcastAutoDownloadAll:
 		message = "future podcast episodes will be automatically downloaded"
 	case db.PodcastAutoDownloadNone:
 		message = "future podcast episodes will not be downloaded"
 	default:
 		return &Response{code: 400, err: "please provide a valid podcast download type"}
 	}
-	if err := c.Podcasts.SetAutoDownload(id, setting); err != nil {
+	if err := c.Podcasts.SetAutoDownload(id, setting, keep); err != nil {
 		return &Response{
 			flashW: []string{fmt.Sprintf("could not update auto download setting: %v", err)},
 			code:   400,
@@ -570,3 +1302,90 @@ func (c *Controller) ServeInternetRadioStationDeleteDo(r *http.Request) *Respons
 		redirect: "/admin/home",
 	}
 }
+
+// ServeDownloadDBBackup makes a backup of the db in a temp dir and downloads it
+func (c *Controller) ServeDownloadDBBackup(w http.ResponseWriter, r *http.Request) {
+	tmp, err := os.MkdirTemp("", "gonic-backup-")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error creating temp dir: %v", err), 500)
+		return
+	}
+	defer os.RemoveAll(tmp)
+	now := time.Now()
+	name := backup.FileName(now)
+	switch err := c.Backups.WriteTo(filepath.Join(tmp, name)); {
+	case errors.Is(err, backup.ErrScanning), errors.Is(err, backup.ErrRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, db.ErrBackupPostgres), errors.Is(err, db.ErrBackupMemory):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("error backing up db: %v", err), 500)
+		return
+	}
+	file, err := os.Open(filepath.Join(tmp, name))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error opening backup: %v", err), 500)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, name, now, file)
+}
+
+// ServeBackupDBDo writes a backup of the db to the backup dir now
+func (c *Controller) ServeBackupDBDo(r *http.Request) *Response {
+	file, err := c.Backups.Write(time.Now())
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't back up the database: %v", err)},
+		}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{fmt.Sprintf("backed up the database to %q", file.Name)},
+	}
+}
+
+// ServeCheckDBDo checks the db for damage, and repairs what it can if the form
+// says to. see db.CheckIntegrity. it won't repair during a scan, which could be
+// adding the rows a repair would remove
+func (c *Controller) ServeCheckDBDo(r *http.Request) *Response {
+	check := c.DB.CheckIntegrity
+	repair := r.FormValue("repair") == "true"
+	if repair {
+		check = func() (report *db.IntegrityReport, err error) {
+			err = c.Scanner.WithoutScans(func() error {
+				report, err = c.DB.RepairIntegrity()
+				return err
+			})
+			return report, err
+		}
+	}
+	report, err := check()
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't check the database: %v", err)},
+		}
+	}
+	if report.OK() {
+		return &Response{
+			redirect: "/admin/home",
+			flashN:   []string{"no problems found in the database"},
+		}
+	}
+	resp := &Response{redirect: "/admin/home"}
+	if repair && len(report.SQLite) == 0 {
+		resp.flashN = report.Lines()
+		return resp
+	}
+	resp.flashW = report.Lines()
+	if len(report.SQLite) > 0 {
+		resp.flashW = append(resp.flashW, "the database file is damaged, which can't be repaired. restore a backup instead")
+	}
+	return resp
+}
@@ -0,0 +1,107 @@
+package ctrladmin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+
+	"go.senan.xyz/gonic/db"
+)
+
+// artistGroupTitles are the headings of the groups of an artist's page
+var artistGroupTitles = map[string]string{
+	db.ReleaseGroupAlbums:       "albums",
+	db.ReleaseGroupEPsSingles:   "eps and singles",
+	db.ReleaseGroupLive:         "live",
+	db.ReleaseGroupCompilations: "compilations",
+	db.ReleaseGroupAppearsOn:    "appears on",
+}
+
+// ServeArtist shows an artist's albums, grouped by release type like the
+// discography of getArtist. albums outside the user's music folders aren't
+// shown
+func (c *Controller) ServeArtist(r *http.Request) *Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return &Response{code: 400, err: "please provide a valid id"}
+	}
+	roots, err := c.userRoots(user)
+	if err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("couldn't find music folders: %v", err)}
+	}
+	artist := &db.Artist{}
+	err = c.DB.
+		Preload("Albums", func(q *gorm.DB) *gorm.DB {
+			q = q.
+				Select("albums.*, count(sub.id) child_count, sum(sub.length) duration").
+				Joins("LEFT JOIN tracks sub ON albums.id=sub.album_id").
+				Order("albums.tag_year, albums.right_path").
+				Group("albums.id")
+			if roots != nil {
+				q = q.Where("albums.root_dir IN (?)", roots)
+			}
+			return q
+		}).
+		First(artist, id).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &Response{template: "not_found.tmpl", code: 404}
+	}
+	if err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("couldn't find artist: %v", err)}
+	}
+	appearsOn, err := c.DB.GetAppearsOn(artist, roots)
+	if err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("couldn't find albums: %v", err)}
+	}
+
+	grouped := map[string][]*db.Album{}
+	for _, album := range artist.Albums {
+		group := album.ReleaseGroup()
+		grouped[group] = append(grouped[group], album)
+	}
+	if len(appearsOn) > 0 {
+		grouped[db.ReleaseGroupAppearsOn] = appearsOn
+	}
+	data := &templateData{Artist: artist}
+	for _, name := range db.ReleaseGroups {
+		if albums, ok := grouped[name]; ok {
+			data.ArtistGroups = append(data.ArtistGroups, &ArtistGroup{Title: artistGroupTitles[name], Albums: albums})
+		}
+	}
+	// nothing to tell apart, so there are no headings
+	if len(data.ArtistGroups) == 1 && grouped[db.ReleaseGroupAlbums] != nil {
+		data.ArtistGroups[0].Title = ""
+	}
+	return &Response{
+		template: "artist.tmpl",
+		data:     data,
+	}
+}
+
+// userRoots are the paths of the music folders the user can see, or nil if
+// they can see all of them
+func (c *Controller) userRoots(user *db.User) ([]string, error) {
+	if user.IsAdmin {
+		return nil, nil
+	}
+	ids, err := c.DB.GetUserMusicFolderIDs(user.ID)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	granted := map[int]struct{}{}
+	for _, id := range ids {
+		granted[id] = struct{}{}
+	}
+	roots := []string{}
+	for _, folder := range c.MusicFolders {
+		if _, ok := granted[folder.ID]; ok {
+			roots = append(roots, folder.Path)
+		}
+	}
+	return roots, nil
+}
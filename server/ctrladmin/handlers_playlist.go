@@ -2,24 +2,35 @@ package ctrladmin
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
+	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 
+	"github.com/disintegration/imaging"
 	"github.com/jinzhu/gorm"
 
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/playlists"
+	"go.senan.xyz/gonic/scrobble/listenbrainz"
+	"go.senan.xyz/gonic/trackmatch"
 )
 
 var (
 	errPlaylistNoMatch = errors.New("couldn't match track")
 )
 
-func playlistParseLine(c *Controller, absPath string) (int, error) {
-	if strings.HasPrefix(absPath, "#") || strings.TrimSpace(absPath) == "" {
+// playlistParseLine finds the track of a line of an m3u8, by its path relative
+// to a music folder, like in the ones we serve, or by its absolute path
+func playlistParseLine(c *Controller, line string) (int, error) {
+	if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
 		return 0, nil
 	}
 	var track db.Track
@@ -27,7 +38,16 @@ func playlistParseLine(c *Controller, absPath string) (int, error) {
 		SELECT tracks.id FROM TRACKS
 		JOIN albums ON tracks.album_id=albums.id
 		WHERE (albums.root_dir || '/' || albums.left_path || albums.right_path || '/' || tracks.filename)=?`,
-		absPath)
+		line)
+	if !path.IsAbs(line) {
+		// the same as the album paths the scanner stores
+		dir, filename := path.Split(path.Clean(line))
+		leftPath, rightPath := path.Split(path.Clean(dir))
+		query = c.DB.
+			Select("tracks.id").
+			Joins("JOIN albums ON tracks.album_id=albums.id").
+			Where("albums.left_path=? AND albums.right_path=? AND tracks.filename=?", leftPath, rightPath, filename)
+	}
 	err := query.First(&track).Error
 	switch {
 	case errors.Is(err, gorm.ErrRecordNotFound):
@@ -50,7 +70,80 @@ func playlistCheckContentType(contentType string) bool {
 	return ok
 }
 
+func playlistCheckContentTypeJSPF(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	known := map[string]struct{}{
+		"application/json":         {},
+		"application/jspf+json":    {},
+		"application/octet-stream": {},
+	}
+	_, ok := known[contentType]
+	return ok
+}
+
+// playlistParseUploadJSPF imports a listenbrainz playlist. tracks are matched by
+// their recording mbid, falling back to artist and title. any which can't be
+// found are listed in the playlist's comment
+func playlistParseUploadJSPF(c *Controller, userID int, header *multipart.FileHeader) ([]string, bool) {
+	file, err := header.Open()
+	if err != nil {
+		return []string{fmt.Sprintf("couldn't open file %q", header.Filename)}, false
+	}
+	defer file.Close()
+	contentType := header.Header.Get("Content-Type")
+	if !playlistCheckContentTypeJSPF(contentType) {
+		return []string{fmt.Sprintf("invalid content-type %q", contentType)}, false
+	}
+	jspf, err := listenbrainz.ParseJSPF(file)
+	if err != nil {
+		return []string{fmt.Sprintf("parsing %q: %v", header.Filename, err)}, false
+	}
+	playlistName := jspf.Title
+	if playlistName == "" {
+		playlistName = strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename))
+	}
+	var trackIDs []int
+	var errors []string
+	var unmatched []string
+	for _, jspfTrack := range jspf.Tracks {
+		query := trackmatch.Query{
+			RecordingMBID: jspfTrack.RecordingMBID(),
+			Artist:        jspfTrack.Creator,
+			Title:         jspfTrack.Title,
+		}
+		track, err := trackmatch.Match(c.DB, query)
+		if err != nil {
+			// trim length of error to not overflow cookie flash
+			errors = append(errors, fmt.Sprintf("%.100s", err.Error()))
+			unmatched = append(unmatched, query.String())
+			continue
+		}
+		trackIDs = append(trackIDs, track.ID)
+	}
+	playlist := &db.Playlist{}
+	c.DB.FirstOrCreate(playlist, db.Playlist{
+		Name:   playlistName,
+		UserID: userID,
+	})
+	prev := *playlist
+	playlist.Comment = jspf.Annotation
+	if len(unmatched) > 0 {
+		playlist.Comment = strings.TrimSpace(fmt.Sprintf("%s\n\nunmatched tracks:\n%s",
+			playlist.Comment, strings.Join(unmatched, "\n")))
+	}
+	playlist.SetItems(trackIDs)
+	if err := c.DB.SavePlaylist(prev, playlist); err != nil {
+		return []string{fmt.Sprintf("saving playlist %q: %v", playlistName, err)}, true
+	}
+	c.PlaylistChanged(playlist.ID)
+	return errors, true
+}
+
 func playlistParseUpload(c *Controller, userID int, header *multipart.FileHeader) ([]string, bool) {
+	switch strings.ToLower(filepath.Ext(header.Filename)) {
+	case ".jspf", ".json":
+		return playlistParseUploadJSPF(c, userID, header)
+	}
 	file, err := header.Open()
 	if err != nil {
 		return []string{fmt.Sprintf("couldn't open file %q", header.Filename)}, false
@@ -84,8 +177,12 @@ func playlistParseUpload(c *Controller, userID int, header *multipart.FileHeader
 		Name:   playlistName,
 		UserID: userID,
 	})
+	prev := *playlist
 	playlist.SetItems(trackIDs)
-	c.DB.Save(playlist)
+	if err := c.DB.SavePlaylist(prev, playlist); err != nil {
+		return []string{fmt.Sprintf("saving playlist %q: %v", playlistName, err)}, true
+	}
+	c.PlaylistChanged(playlist.ID)
 	return errors, true
 }
 
@@ -117,14 +214,137 @@ func (c *Controller) ServeUploadPlaylistDo(r *http.Request) *Response {
 }
 
 func (c *Controller) ServeDeletePlaylistDo(r *http.Request) *Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return &Response{code: 400, err: "please provide a valid id"}
+	}
+	playlist := &db.Playlist{}
+	if err := c.DB.Where("user_id=? AND id=?", user.ID, id).First(playlist).Error; err != nil {
+		return &Response{redirect: "/admin/home"}
+	}
+	c.PlaylistDeleting(playlist.ID)
+	c.DB.Delete(playlist)
+	return &Response{
+		redirect: "/admin/home",
+	}
+}
+
+// ServeRefreshSmartPlaylistDo builds the user's smart playlist again, for the
+// plays, stars, and ratings since the last scan
+func (c *Controller) ServeRefreshSmartPlaylistDo(r *http.Request) *Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return &Response{code: 400, err: "please provide a valid id"}
+	}
+	playlist := &db.Playlist{}
+	if err := c.DB.Where("user_id=? AND id=? AND is_smart=?", user.ID, id, true).First(playlist).Error; err != nil {
+		return &Response{code: 404, err: "couldn't find a smart playlist with that id"}
+	}
+	if err := c.PlaylistFiles.Refresh(playlist.ID); err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't refresh %q: %v", playlist.Name, err)},
+		}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{fmt.Sprintf("%q refreshed", playlist.Name)},
+	}
+}
+
+// ServeDownloadPlaylist serves the user's playlist, or a public one, as an m3u8
+// of its tracks' paths in their music folders, which can be uploaded again
+func (c *Controller) ServeDownloadPlaylist(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "please provide a valid id", 400)
+		return
+	}
+	playlist := &db.Playlist{}
+	err = c.DB.
+		Where("id=? AND (user_id=? OR is_public=?)", id, user.ID, true).
+		First(playlist).
+		Error
+	if err != nil {
+		http.Error(w, "couldn't find a playlist with that id", 404)
+		return
+	}
+	entries, err := playlists.Entries(c.DB, playlist, "")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error finding tracks: %v", err), 500)
+		return
+	}
+	filename := playlists.FileName(playlist.Name) + ".m3u8"
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	if err := playlists.WriteM3U8(w, entries); err != nil {
+		log.Printf("error writing playlist %d: %v", playlist.ID, err)
+	}
+}
+
+// playlistImageMaxSize is the largest an uploaded playlist image is stored at,
+// which is the largest size getCoverArt serves
+const playlistImageMaxSize = 2048
+
+// ServeUploadPlaylistImageDo sets an image for the playlist, which clients see
+// as its cover art instead of a mosaic of its albums' covers
+func (c *Controller) ServeUploadPlaylistImageDo(r *http.Request) *Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		return &Response{code: 400, err: "please provide a valid id"}
+	}
+	playlist := &db.Playlist{}
+	if err := c.DB.Where("user_id=? AND id=?", user.ID, id).First(playlist).Error; err != nil {
+		return &Response{code: 404, err: "couldn't find a playlist with that id"}
+	}
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't read image: %v", err)},
+		}
+	}
+	defer file.Close()
+	src, err := imaging.Decode(file, imaging.AutoOrientation(true))
+	if err != nil {
+		return &Response{
+			redirect: "/admin/home",
+			flashW:   []string{fmt.Sprintf("couldn't read image: %v", err)},
+		}
+	}
+	var buff bytes.Buffer
+	img := imaging.Fit(src, playlistImageMaxSize, playlistImageMaxSize, imaging.Lanczos)
+	if err := imaging.Encode(&buff, img, imaging.JPEG); err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("couldn't encode image: %v", err)}
+	}
+	if err := c.DB.Save(&db.PlaylistImage{PlaylistID: playlist.ID, Image: buff.Bytes()}).Error; err != nil {
+		return &Response{code: 500, err: fmt.Sprintf("couldn't save image: %v", err)}
+	}
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{fmt.Sprintf("image for %q updated", playlist.Name)},
+	}
+}
+
+// ServeDeletePlaylistImageDo goes back to a mosaic of the playlist's albums'
+// covers. deleting the playlist deletes its image too
+func (c *Controller) ServeDeletePlaylistImageDo(r *http.Request) *Response {
 	user := r.Context().Value(CtxUser).(*db.User)
 	id, err := strconv.Atoi(r.URL.Query().Get("id"))
 	if err != nil {
 		return &Response{code: 400, err: "please provide a valid id"}
 	}
 	c.DB.
-		Where("user_id=? AND id=?", user.ID, id).
-		Delete(db.Playlist{})
+		Where("playlist_id IN (?)", c.DB.
+			Model(&db.Playlist{}).
+			Select("id").
+			Where("user_id=? AND id=?", user.ID, id).
+			QueryExpr()).
+		Delete(db.PlaylistImage{})
 	return &Response{
 		redirect: "/admin/home",
 	}
@@ -16,17 +16,26 @@ func (c *Controller) ServeLoginDo(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, r.Referer(), http.StatusSeeOther)
 		return
 	}
+	ip := c.ClientIP(r)
+	if err := c.AuthLimit.Wait(r.Context(), ip, username); err != nil {
+		sessAddFlashW(session, []string{"too many failed logins, please try again later"})
+		sessLogSave(session, w, r)
+		http.Redirect(w, r, r.Referer(), http.StatusSeeOther)
+		return
+	}
 	user := c.DB.GetUserByName(username)
 	if user == nil || password != user.Password {
+		c.AuthLimit.Fail(ip, username)
 		sessAddFlashW(session, []string{"invalid username / password"})
 		sessLogSave(session, w, r)
 		http.Redirect(w, r, r.Referer(), http.StatusSeeOther)
 		return
 	}
+	c.AuthLimit.Succeed(ip, username)
 	// put the user name into the session. future endpoints after this one
 	// are wrapped with WithUserSession() which will get the name from the
 	// session and put the row into the request context
-	session.Values["user"] = user.ID
+	sessLogIn(session, user)
 	sessLogSave(session, w, r)
 	http.Redirect(w, r, c.Path("/admin/home"), http.StatusSeeOther)
 }
@@ -25,6 +25,17 @@ func (c *Controller) WithSession(next http.Handler) http.Handler {
 
 func (c *Controller) WithUserSession(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a trusted proxy has logged the user in already
+		proxyUser, err := c.ProxyUser(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error getting user from proxy: %s", err), 500)
+			return
+		}
+		if proxyUser != nil {
+			withUser := context.WithValue(r.Context(), CtxUser, proxyUser)
+			next.ServeHTTP(w, r.WithContext(withUser))
+			return
+		}
 		// session exists at this point
 		session := r.Context().Value(CtxSession).(*sessions.Session)
 		userID, ok := session.Values["user"].(int)
@@ -36,9 +47,11 @@ func (c *Controller) WithUserSession(next http.Handler) http.Handler {
 		}
 		// take username from sesion and add the user row to the context
 		user := c.DB.GetUserByID(userID)
-		if user == nil {
+		stamp, _ := session.Values["password"].(string)
+		if user == nil || stamp != passwordStamp(user) {
 			// the username in the client's session no longer relates to a
-			// user in the database (maybe the user was deleted)
+			// user in the database (maybe the user was deleted), or their
+			// password was changed since they logged in
 			session.Options.MaxAge = -1
 			sessLogSave(session, w, r)
 			http.Redirect(w, r, c.Path("/admin/login"), http.StatusSeeOther)
@@ -63,3 +76,27 @@ func (c *Controller) WithAdminSession(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// WithMaxBody stops reading the request body after n bytes, so that an upload
+// can't fill up the disk
+func WithMaxBody(n int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *Controller) WithWritableSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// session and user exist at this point
+		session := r.Context().Value(CtxSession).(*sessions.Session)
+		user := r.Context().Value(CtxUser).(*db.User)
+		if !user.CanWrite() {
+			sessAddFlashW(session, []string{"you are a read only user"})
+			sessLogSave(session, w, r)
+			http.Redirect(w, r, c.Path("/admin/home"), http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,220 @@
+package ctrladmin
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/sessions"
+
+	"go.senan.xyz/gonic/db"
+)
+
+// minPasswordLength is the shortest password the first admin can have
+const minPasswordLength = 10
+
+// setup is the first run, before there are any users. until the setup page
+// creates an admin, it's the only page served. the page asks for a token from
+// the log, so that someone else who can reach the server can't get there first
+type setup struct {
+	sync.Mutex
+	token string
+}
+
+// SetupPath is a configured path which the setup page checks before an admin
+// can be created
+type SetupPath struct {
+	Name string
+	Path string
+	// Writable is true if gonic writes to the path, and not just reads it
+	Writable bool
+}
+
+// SetupCheck is a SetupPath, and what's wrong with it if anything
+type SetupCheck struct {
+	SetupPath
+	Err string
+}
+
+var (
+	errValiSetupToken       = errors.New("the setup token isn't right, please copy it from gonic's log")
+	errValiPasswordShort    = fmt.Errorf("please use a password with at least %d characters", minPasswordLength)
+	errValiPasswordUsername = errors.New("please use a password which doesn't have your username in it")
+)
+
+// startSetup makes a token for the setup page and logs it, if there are no users
+func (c *Controller) startSetup() error {
+	hasUsers, err := c.DB.HasUsers()
+	if err != nil {
+		return fmt.Errorf("find users: %w", err)
+	}
+	if hasUsers {
+		return nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("generate token: %w", err)
+	}
+	c.setup.token = hex.EncodeToString(b)
+	log.Printf("gonic isn't set up yet. please visit %s and enter the setup token %s", c.Path("/admin/setup"), c.setup.token)
+	return nil
+}
+
+func (c *Controller) setupPending() bool {
+	c.setup.Lock()
+	defer c.setup.Unlock()
+	return c.setup.token != ""
+}
+
+// checkSetupPaths checks each of the setup paths is a directory which can be
+// read, and written if it needs to be
+func (c *Controller) checkSetupPaths() ([]SetupCheck, bool) {
+	checks := make([]SetupCheck, 0, len(c.SetupPaths))
+	ok := true
+	for _, path := range c.SetupPaths {
+		check := SetupCheck{SetupPath: path}
+		if err := checkSetupPath(path); err != nil {
+			check.Err = err.Error()
+			ok = false
+		}
+		checks = append(checks, check)
+	}
+	return checks, ok
+}
+
+func checkSetupPath(path SetupPath) error {
+	dir, err := os.Open(path.Path)
+	if err != nil {
+		return fmt.Errorf("can't open it: %w", err)
+	}
+	defer dir.Close()
+	info, err := dir.Stat()
+	if err != nil {
+		return fmt.Errorf("can't stat it: %w", err)
+	}
+	if !info.IsDir() {
+		return errors.New("it isn't a directory")
+	}
+	if _, err := dir.Readdirnames(1); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("can't read it: %w", err)
+	}
+	if !path.Writable {
+		return nil
+	}
+	f, err := os.CreateTemp(path.Path, ".gonic-setup-*")
+	if err != nil {
+		return fmt.Errorf("can't write to it: %w", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func validatePasswordStrength(username, password string) error {
+	if len([]rune(password)) < minPasswordLength {
+		return errValiPasswordShort
+	}
+	if strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return errValiPasswordUsername
+	}
+	return nil
+}
+
+func (c *Controller) ServeSetup(r *http.Request) *Response {
+	if !c.setupPending() {
+		return &Response{redirect: "/admin/login"}
+	}
+	checks, _ := c.checkSetupPaths()
+	data := &templateData{
+		SetupToken:        r.URL.Query().Get("token"),
+		SetupChecks:       checks,
+		MinPasswordLength: minPasswordLength,
+	}
+	return &Response{template: "setup.tmpl", data: data}
+}
+
+func (c *Controller) ServeSetupDo(r *http.Request) *Response {
+	c.setup.Lock()
+	defer c.setup.Unlock()
+	if c.setup.token == "" {
+		return &Response{redirect: "/admin/login"}
+	}
+	token := r.FormValue("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.setup.token)) != 1 {
+		return &Response{
+			redirect: "/admin/setup",
+			flashW:   []string{errValiSetupToken.Error()},
+		}
+	}
+	if _, ok := c.checkSetupPaths(); !ok {
+		return &Response{
+			redirect: "/admin/setup",
+			flashW:   []string{"please fix the paths in gonic's config, and restart it"},
+		}
+	}
+	username := r.FormValue("username")
+	if err := validateUsername(username); err != nil {
+		return &Response{
+			redirect: "/admin/setup",
+			flashW:   []string{err.Error()},
+		}
+	}
+	passwordOne := r.FormValue("password_one")
+	passwordTwo := r.FormValue("password_two")
+	if err := validatePasswords(passwordOne, passwordTwo); err != nil {
+		return &Response{
+			redirect: "/admin/setup",
+			flashW:   []string{err.Error()},
+		}
+	}
+	if err := validatePasswordStrength(username, passwordOne); err != nil {
+		return &Response{
+			redirect: "/admin/setup",
+			flashW:   []string{err.Error()},
+		}
+	}
+	apiKey := r.FormValue("lastfm_api_key")
+	secret := r.FormValue("lastfm_secret")
+	if apiKey != "" || secret != "" {
+		if err := validateAPIKey(apiKey, secret); err != nil {
+			return &Response{
+				redirect: "/admin/setup",
+				flashW:   []string{err.Error()},
+			}
+		}
+		if err := c.DB.SetSetting("lastfm_api_key", apiKey); err != nil {
+			return &Response{code: 500, err: fmt.Sprintf("couldn't save last.fm api key: %v", err)}
+		}
+		if err := c.DB.SetSetting("lastfm_secret", secret); err != nil {
+			return &Response{code: 500, err: fmt.Sprintf("couldn't save last.fm secret: %v", err)}
+		}
+	}
+	user := db.User{
+		Name:     username,
+		Password: passwordOne,
+		IsAdmin:  true,
+	}
+	if err := c.DB.Create(&user).Error; err != nil {
+		return &Response{
+			redirect: "/admin/setup",
+			flashW:   []string{fmt.Sprintf("could not create user `%s`: %v", username, err)},
+		}
+	}
+	// the token is only good for one setup
+	c.setup.token = ""
+
+	// and the admin is logged in
+	session := r.Context().Value(CtxSession).(*sessions.Session)
+	sessLogIn(session, &user)
+	return &Response{
+		redirect: "/admin/home",
+		flashN:   []string{"gonic is set up. start a scan to find your music"},
+	}
+}
@@ -1,12 +1,22 @@
 package ctrlbase
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"path"
+	"strings"
+	"time"
 
+	"go.senan.xyz/gonic/authlimit"
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/metrics"
+	"go.senan.xyz/gonic/notify"
+	"go.senan.xyz/gonic/playlists"
 	"go.senan.xyz/gonic/scanner"
 )
 
@@ -44,10 +54,91 @@ func statusToBlock(code int) string {
 	return fmt.Sprintf("\u001b[%d;1m %d \u001b[0m", bg, code)
 }
 
+type ctxKey int
+
+const ctxRequestLog ctxKey = iota
+
+// RequestLog is what WithLogging logs about a request, besides its url and
+// status. the middlewares and handlers after it fill in what they know
+type RequestLog struct {
+	View   string
+	User   string
+	Client string
+	// Failed is set with the Code of a subsonic error response
+	Failed bool
+	Code   int
+}
+
+// RequestLogOf returns the request's RequestLog, or nil if it isn't logged
+func RequestLogOf(r *http.Request) *RequestLog {
+	rl, _ := r.Context().Value(ctxRequestLog).(*RequestLog)
+	return rl
+}
+
+// requestLogJSON is a line of the request log with LogJSON
+type requestLogJSON struct {
+	Time       time.Time `json:"time"`
+	Msg        string    `json:"msg"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Status     int       `json:"status"`
+	DurationMS float64   `json:"duration_ms"`
+	Slow       bool      `json:"slow,omitempty"`
+	View       string    `json:"view,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Client     string    `json:"client,omitempty"`
+	Code       *int      `json:"error_code,omitempty"`
+}
+
 type Controller struct {
 	DB          *db.DB
 	Scanner     *scanner.Scanner
+	Notifier    *notify.Dispatcher
 	ProxyPrefix string
+	// PlaylistFiles keeps the playlists dir up to date with playlists which
+	// change, if there is one
+	PlaylistFiles *playlists.Syncer
+	// Metrics records requests and such for prometheus, or nothing if nil
+	Metrics *metrics.Metrics
+	// HTTPLog logs every request. requests which take longer than SlowRequest
+	// are logged either way, unless it's 0
+	HTTPLog     bool
+	SlowRequest time.Duration
+	// LogJSON logs requests as json lines, instead of plain text
+	LogJSON bool
+	// ProxyAuth logs users in by a header from a reverse proxy, or is nil
+	ProxyAuth *ProxyAuth
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For is trusted
+	// for the client's address. see ClientIP
+	TrustedProxies []*net.IPNet
+	// AuthLimit slows down and locks out clients which keep failing to log
+	// in, or does nothing if nil
+	AuthLimit *authlimit.Limiter
+	// CORSOrigins are the origins of browser clients which can use the
+	// subsonic api, or "*" for any. see WithCORS
+	CORSOrigins []string
+}
+
+// PlaylistChanged writes the playlist's file after it was saved
+func (c *Controller) PlaylistChanged(playlistID int) {
+	if c.PlaylistFiles == nil {
+		return
+	}
+	err := c.PlaylistFiles.Export(playlistID)
+	if err != nil && !errors.Is(err, playlists.ErrDisabled) {
+		log.Printf("error exporting playlist %d: %v", playlistID, err)
+	}
+}
+
+// PlaylistDeleting removes the playlist's file before it's deleted
+func (c *Controller) PlaylistDeleting(playlistID int) {
+	if c.PlaylistFiles == nil {
+		return
+	}
+	err := c.PlaylistFiles.Remove(playlistID)
+	if err != nil && !errors.Is(err, playlists.ErrDisabled) {
+		log.Printf("error removing file of playlist %d: %v", playlistID, err)
+	}
 }
 
 // Path returns a URL path with the proxy prefix included
@@ -74,39 +165,179 @@ func (c *Controller) BaseURL(r *http.Request) string {
 	return fmt.Sprintf("%s://%s", scheme, host)
 }
 
+// redactParams are the query params with credentials, or a signed url's
+// signature, which aren't logged
+var redactParams = []string{"p", "t", "apiKey", "sig"}
+
 func (c *Controller) WithLogging(next http.Handler) http.Handler {
+	if !c.HTTPLog && c.SlowRequest <= 0 {
+		return next
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// this is (should be) the first middleware. pass right though it
 		// by calling `next` first instead of last. when it completes all
 		// other middlewares and the custom ResponseWriter has been written
 		sw := &statusWriter{ResponseWriter: w}
-		next.ServeHTTP(sw, r)
+		rl := &RequestLog{}
+		start := time.Now()
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), ctxRequestLog, rl)))
+		took := time.Since(start)
+
+		slow := c.SlowRequest > 0 && took >= c.SlowRequest
+		if !c.HTTPLog && !slow {
+			return
+		}
+
+		// sanitise credentials
+		q := r.URL.Query()
+		for _, key := range redactParams {
+			if q.Get(key) != "" {
+				q.Set(key, "REDACTED")
+			}
+		}
+		r.URL.RawQuery = q.Encode()
 
-		// sanitise password
-		if q := r.URL.Query(); q.Get("p") != "" {
-			q.Set("p", "REDACTED")
-			r.URL.RawQuery = q.Encode()
+		if c.LogJSON {
+			logRequestJSON(r, sw.status, took, slow, rl)
+			return
 		}
-		log.Printf("response %s for `%v`", statusToBlock(sw.status), r.URL)
+		msg := "response"
+		if slow {
+			msg = "slow response"
+		}
+		log.Printf("%s %s for %s `%v` in %v%s", msg, statusToBlock(sw.status), r.Method, r.URL, took.Round(time.Millisecond), rl.details())
 	})
 }
 
+// details are the fields of rl which are set, like " (view ping, user alice)"
+func (rl *RequestLog) details() string {
+	var details []string
+	if rl.View != "" {
+		details = append(details, "view "+rl.View)
+	}
+	if rl.User != "" {
+		details = append(details, "user "+rl.User)
+	}
+	if rl.Client != "" {
+		details = append(details, "client "+rl.Client)
+	}
+	if rl.Failed {
+		details = append(details, fmt.Sprintf("error %d", rl.Code))
+	}
+	if len(details) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(details, ", ") + ")"
+}
+
+func logRequestJSON(r *http.Request, status int, took time.Duration, slow bool, rl *RequestLog) {
+	line := requestLogJSON{
+		Time:       time.Now(),
+		Msg:        "response",
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		Status:     status,
+		DurationMS: float64(took.Microseconds()) / 1000,
+		Slow:       slow,
+		View:       rl.View,
+		User:       rl.User,
+		Client:     rl.Client,
+	}
+	if rl.Failed {
+		line.Code = &rl.Code
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		log.Printf("error marshalling request log: %v", err)
+		return
+	}
+	fmt.Fprintln(log.Writer(), string(data))
+}
+
+// WithCORS lets browser clients from CORSOrigins use the api, and answers
+// their preflight requests without going on to auth. an origin which is listed
+// is echoed back with credentials allowed, so that requests with cookies or an
+// Authorization header work too, like those from media elements. "*" only
+// allows requests without them, otherwise any website could make them with
+// the browser's logins. it does nothing if CORSOrigins is empty
 func (c *Controller) WithCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods",
-			"POST, GET, OPTIONS, PUT, DELETE",
-		)
-		w.Header().Set("Access-Control-Allow-Headers",
-			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization",
-		)
-		if r.Method == "OPTIONS" {
+		if len(c.CORSOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch listed, wildcard := c.corsAllows(origin); {
+		case listed:
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		case wildcard:
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		default:
+			next.ServeHTTP(w, r)
 			return
 		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers",
+				"Accept, Content-Type, Range, Authorization",
+			)
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// so that players can seek and show progress
+		w.Header().Set("Access-Control-Expose-Headers",
+			"Content-Length, Content-Range, Accept-Ranges, Content-Disposition",
+		)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// corsAllows finds if origin is one of CORSOrigins, or if "*" is
+func (c *Controller) corsAllows(origin string) (listed, wildcard bool) {
+	for _, allowed := range c.CORSOrigins {
+		switch {
+		case strings.EqualFold(allowed, origin):
+			listed = true
+		case allowed == "*":
+			wildcard = true
+		}
+	}
+	return listed, wildcard
+}
+
+// ClientIP is the address r came from, without the port. if it came through
+// one of the TrustedProxies, or over a unix socket, it's the last address in
+// X-Forwarded-For which isn't one of them, since the ones before it could
+// have been made up by the client
+func (c *Controller) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedPeer(r, c.TrustedProxies) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !containsIP(c.TrustedProxies, ip) {
+			break
+		}
+	}
+	return host
+}
+
 func firstExisting(or string, strings ...string) string {
 	for _, s := range strings {
 		if s != "" {
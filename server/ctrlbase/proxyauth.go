@@ -0,0 +1,137 @@
+package ctrlbase
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"go.senan.xyz/gonic/db"
+)
+
+// ProxyAuth trusts a header with the name of the user from a reverse proxy
+// which has logged them in already, like authelia
+type ProxyAuth struct {
+	// Header has the username, like Remote-User
+	Header string
+	// Trusted are the addresses of the proxies. the header is ignored on
+	// requests from anywhere else, except over a unix socket, which only the
+	// proxy should be able to connect to
+	Trusted []*net.IPNet
+	// Subsonic trusts the header for the subsonic api too, not only the web
+	// interface
+	Subsonic bool
+	// CreateUsers creates the users who don't exist yet, as non admins
+	CreateUsers bool
+}
+
+// ParseTrustedProxies parses comma separated CIDRs like 10.0.0.0/8, or single
+// addresses
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", part)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %w", part, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// trusts is true if r came from one of the proxies
+func (p *ProxyAuth) trusts(r *http.Request) bool {
+	return trustedPeer(r, p.Trusted)
+}
+
+// trustedPeer is true if r came straight from one of trusted, or over a unix
+// socket. the request's own forwarding headers aren't looked at, anyone could
+// set them
+func trustedPeer(r *http.Request, trusted []*net.IPNet) bool {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	return containsIP(trusted, net.ParseIP(host))
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProxyUser returns the user named by the ProxyAuth header, which is created
+// if they don't exist and CreateUsers is set. it's nil if proxy auth is off,
+// the header isn't there, or r didn't come from a trusted proxy. it's also nil
+// before setup, so that the first user is still the admin made there
+func (c *Controller) ProxyUser(r *http.Request) (*db.User, error) {
+	p := c.ProxyAuth
+	if p == nil || p.Header == "" {
+		return nil, nil
+	}
+	name := strings.TrimSpace(r.Header.Get(p.Header))
+	if name == "" || !p.trusts(r) {
+		return nil, nil
+	}
+	if user := c.DB.GetUserByName(name); user != nil {
+		return user, nil
+	}
+	if !p.CreateUsers {
+		return nil, nil
+	}
+	hasUsers, err := c.DB.HasUsers()
+	if err != nil {
+		return nil, fmt.Errorf("check for users: %w", err)
+	}
+	if !hasUsers {
+		return nil, nil
+	}
+
+	// the password is random, they log in through the proxy
+	password := make([]byte, 24)
+	if _, err := rand.Read(password); err != nil {
+		return nil, fmt.Errorf("generate password: %w", err)
+	}
+	user := &db.User{
+		Name:     name,
+		Password: hex.EncodeToString(password),
+	}
+	if err := c.DB.Create(user).Error; err != nil {
+		// another request from them may have created them first
+		if user := c.DB.GetUserByName(name); user != nil {
+			return user, nil
+		}
+		return nil, fmt.Errorf("create user %q: %w", name, err)
+	}
+	log.Printf("created user %q from the %s header of the proxy", name, p.Header)
+	return user, nil
+}
@@ -8,13 +8,16 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"time"
 
 	"go.senan.xyz/gonic/server/ctrlbase"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/db"
 	"go.senan.xyz/gonic/jukebox"
 	"go.senan.xyz/gonic/podcasts"
 	"go.senan.xyz/gonic/scrobble"
+	"go.senan.xyz/gonic/streamsign"
 	"go.senan.xyz/gonic/transcode"
 )
 
@@ -24,6 +27,10 @@ const (
 	CtxUser CtxKey = iota
 	CtxSession
 	CtxParams
+	// ctxProxyUser is set when CtxUser is from WithProxyUser
+	ctxProxyUser
+	// ctxSignedURL is set when CtxUser is from WithSignedURL
+	ctxSignedURL
 )
 
 type Controller struct {
@@ -31,11 +38,21 @@ type Controller struct {
 	CachePath      string
 	CoverCachePath string
 	PodcastsPath   string
-	MusicPaths     []string
+	MusicFolders   []*db.MusicFolder
 	Jukebox        *jukebox.Jukebox
 	Scrobblers     []scrobble.Scrobbler
 	Podcasts       *podcasts.Podcasts
 	Transcoder     transcode.Transcoder
+	StreamSigner   *streamsign.Signer
+	// FetchedCoverPath has covers from outside the music dirs, see coverarchive
+	FetchedCoverPath string
+	// ChatHistoryMax is how many chat messages to keep, or all if 0
+	ChatHistoryMax int
+	// ScrobbleQueue keeps submissions which failed to be retried later, if
+	// it's set
+	ScrobbleQueue *scrobble.Queue
+	// ScrobbleFilter drops duplicate and early submissions, if it's set
+	ScrobbleFilter *scrobble.Filter
 }
 
 type metaResponse struct {
@@ -61,6 +78,12 @@ func writeResp(w http.ResponseWriter, r *http.Request, resp *spec.Response) erro
 	}
 	if resp.Error != nil {
 		log.Printf("subsonic error code %d: %s", resp.Error.Code, resp.Error.Message)
+		if mw, ok := w.(*metricsWriter); ok {
+			mw.failed = true
+		}
+		if rl := ctrlbase.RequestLogOf(r); rl != nil {
+			rl.Failed, rl.Code = true, resp.Error.Code
+		}
 	}
 
 	res := metaResponse{Response: resp}
@@ -102,9 +125,33 @@ type (
 	handlerSubsonicRaw func(w http.ResponseWriter, r *http.Request) *spec.Response
 )
 
+// writeNotModified sets the Last-Modified header for responses which know when
+// their data last changed. if the client sent an If-Modified-Since which is still
+// current, a bare 304 is written instead of the usual subsonic response
+func writeNotModified(w http.ResponseWriter, r *http.Request, resp *spec.Response) bool {
+	if resp == nil || resp.LastModified.IsZero() {
+		return false
+	}
+	lastModified := resp.LastModified.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || lastModified.After(since) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
 func (c *Controller) H(h handlerSubsonic) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if err := writeResp(w, r, h(r)); err != nil {
+		resp := h(r)
+		if resp != nil {
+			c.setTranscoded(r, resp.TrackChildren())
+		}
+		if writeNotModified(w, r, resp) {
+			return
+		}
+		if err := writeResp(w, r, resp); err != nil {
 			log.Printf("error writing subsonic response: %v\n", err)
 		}
 	})
@@ -119,12 +166,84 @@ func (c *Controller) HR(h handlerSubsonicRaw) http.Handler {
 }
 
 func (c *Controller) getMusicFolder(p params.Params) string {
-	idx, err := p.GetInt("musicFolderId")
+	id, err := p.GetInt("musicFolderId")
 	if err != nil {
 		return ""
 	}
-	if idx < 0 || idx > len(c.MusicPaths) {
-		return ""
+	for _, folder := range c.MusicFolders {
+		if folder.ID == id {
+			return folder.Path
+		}
+	}
+	return ""
+}
+
+// musicFolders returns the music folders user can see. admins, and users who
+// haven't been granted any folders, can see all of them. on error none are
+// returned, so that nothing is shown which shouldn't be
+func (c *Controller) musicFolders(user *db.User) []*db.MusicFolder {
+	if user == nil || user.IsAdmin || user.ID == 0 {
+		return c.MusicFolders
+	}
+	ids, err := c.DB.GetUserMusicFolderIDs(user.ID)
+	if err != nil {
+		log.Printf("error finding music folders of user %q: %v", user.Name, err)
+		return nil
+	}
+	if len(ids) == 0 {
+		return c.MusicFolders
+	}
+	granted := map[int]struct{}{}
+	for _, id := range ids {
+		granted[id] = struct{}{}
+	}
+	var folders []*db.MusicFolder
+	for _, folder := range c.MusicFolders {
+		if _, ok := granted[folder.ID]; ok {
+			folders = append(folders, folder)
+		}
+	}
+	return folders
+}
+
+// musicFolderRoots returns the paths of the music folders to list from for r.
+// that's the one in the musicFolderId param if the user can see it, otherwise
+// all of those they can see. it's nil if they can see everything and no folder
+// was asked for, and empty if they can see nothing
+func (c *Controller) musicFolderRoots(r *http.Request) []string {
+	user, _ := r.Context().Value(CtxUser).(*db.User)
+	folders := c.musicFolders(user)
+	restricted := len(folders) != len(c.MusicFolders)
+	params := r.Context().Value(CtxParams).(params.Params)
+	if path := c.getMusicFolder(params); path != "" {
+		for _, folder := range folders {
+			if folder.Path == path {
+				return []string{path}
+			}
+		}
+		return []string{}
+	}
+	if !restricted {
+		return nil
+	}
+	roots := make([]string, 0, len(folders))
+	for _, folder := range folders {
+		roots = append(roots, folder.Path)
+	}
+	return roots
+}
+
+// canSeeRoot is true if the user of r can see the music folder at root
+func (c *Controller) canSeeRoot(r *http.Request, root string) bool {
+	user, _ := r.Context().Value(CtxUser).(*db.User)
+	folders := c.musicFolders(user)
+	if len(folders) == len(c.MusicFolders) {
+		return true
+	}
+	for _, folder := range folders {
+		if folder.Path == root {
+			return true
+		}
 	}
-	return c.MusicPaths[idx]
+	return false
 }
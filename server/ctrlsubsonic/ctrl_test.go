@@ -21,6 +21,7 @@ import (
 	"go.senan.xyz/gonic/mockfs"
 	"go.senan.xyz/gonic/server/ctrlbase"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/streamsign"
 	"go.senan.xyz/gonic/transcode"
 )
 
@@ -158,16 +159,25 @@ func makec(t *testing.T, roots []string, audio bool) *Controller {
 	m.ScanAndClean()
 	m.ResetDates()
 
-	var absRoots []string
+	return makeControllerMock(m, roots)
+}
+
+func makeControllerMock(m *mockfs.MockFS, roots []string) *Controller {
+	var absRoots []db.MusicFolder
 	for _, root := range roots {
-		absRoots = append(absRoots, filepath.Join(m.TmpDir(), root))
+		absRoots = append(absRoots, db.MusicFolder{Path: filepath.Join(m.TmpDir(), root)})
+	}
+	folders, err := m.DB().SyncMusicFolders(absRoots)
+	if err != nil {
+		panic(err)
 	}
 
 	base := &ctrlbase.Controller{DB: m.DB()}
 	contr := &Controller{
-		Controller: base,
-		MusicPaths: absRoots,
-		Transcoder: transcode.NewFFmpegTranscoder(),
+		Controller:   base,
+		MusicFolders: folders,
+		Transcoder:   transcode.NewFFmpegTranscoder(),
+		StreamSigner: streamsign.New([]byte("test")),
 	}
 
 	return contr
@@ -0,0 +1,245 @@
+package ctrlsubsonic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+)
+
+// the most operations we'll accept in one batch annotation request
+const maxAnnotationBatch = 1000
+
+var errAnnotationIDType = errors.New("can't star or rate this type of id")
+
+type annotationTable struct {
+	stars   string
+	ratings string
+	column  string
+}
+
+func annotationTableFor(id specid.ID) (annotationTable, error) {
+	switch id.Type {
+	case specid.Artist:
+		return annotationTable{stars: "artist_stars", ratings: "artist_ratings", column: "artist_id"}, nil
+	case specid.Album:
+		return annotationTable{stars: "album_stars", ratings: "album_ratings", column: "album_id"}, nil
+	case specid.Track:
+		return annotationTable{stars: "track_stars", ratings: "track_ratings", column: "track_id"}, nil
+	default:
+		return annotationTable{}, fmt.Errorf("%q: %w", id, errAnnotationIDType)
+	}
+}
+
+// groupAnnotationIDs splits ids by the tables their stars and ratings live in
+func groupAnnotationIDs(ids []specid.ID) (map[annotationTable][]int, error) {
+	grouped := map[annotationTable][]int{}
+	for _, id := range ids {
+		table, err := annotationTableFor(id)
+		if err != nil {
+			return nil, err
+		}
+		grouped[table] = append(grouped[table], id.Value)
+	}
+	return grouped, nil
+}
+
+// starIDs stars or unstars any number of ids, chunked to keep under sqlite's
+// limit on host parameters. https://sqlite.org/limits.html
+func starIDs(tx *gorm.DB, userID int, ids []specid.ID, star bool) error {
+	grouped, err := groupAnnotationIDs(ids)
+	if err != nil {
+		return err
+	}
+	const size = 300 // 3 parameters per row
+	now := time.Now()
+	for table, values := range grouped {
+		for i := 0; i < len(values); i += size {
+			end := i + size
+			if end > len(values) {
+				end = len(values)
+			}
+			chunk := values[i:end]
+			if !star {
+				q := fmt.Sprintf("DELETE FROM %q WHERE user_id=? AND %s IN (?)", table.stars, table.column)
+				if err := tx.Exec(q, userID, chunk).Error; err != nil {
+					return fmt.Errorf("unstar: %w", err)
+				}
+				continue
+			}
+			var rows []string
+			var args []interface{}
+			for _, value := range chunk {
+				rows = append(rows, "(?, ?, ?)")
+				args = append(args, userID, value, now)
+			}
+			q := fmt.Sprintf("INSERT INTO %q (user_id, %s, star_date) VALUES %s ON CONFLICT DO NOTHING",
+				table.stars, table.column, strings.Join(rows, ", "))
+			if err := tx.Exec(q, args...).Error; err != nil {
+				return fmt.Errorf("star: %w", err)
+			}
+		}
+	}
+	return db.UserAnnotated(tx, userID)
+}
+
+// rateID sets the user's rating for id, where a rating of 0 removes it
+func rateID(tx *gorm.DB, userID int, id specid.ID, rating int) error {
+	if rating < 0 || rating > 5 {
+		return fmt.Errorf("rating %d must be between 0 and 5", rating)
+	}
+	table, err := annotationTableFor(id)
+	if err != nil {
+		return err
+	}
+	q := fmt.Sprintf("INSERT INTO %q (user_id, %s, rating) VALUES (?, ?, ?) ON CONFLICT (user_id, %s) DO UPDATE SET rating=excluded.rating",
+		table.ratings, table.column, table.column)
+	args := []interface{}{userID, id.Value, rating}
+	if rating == 0 {
+		q = fmt.Sprintf("DELETE FROM %q WHERE user_id=? AND %s=?", table.ratings, table.column)
+		args = args[:2]
+	}
+	if err := tx.Exec(q, args...).Error; err != nil {
+		return err
+	}
+	return db.UserAnnotated(tx, userID)
+}
+
+func annotationParamIDs(params params.Params) []specid.ID {
+	var ids []specid.ID
+	ids = append(ids, params.GetOrIDList("id", nil)...)
+	ids = append(ids, params.GetOrIDList("albumId", nil)...)
+	ids = append(ids, params.GetOrIDList("artistId", nil)...)
+	return ids
+}
+
+func (c *Controller) serveStarOrUnstar(r *http.Request, star bool) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	ids := annotationParamIDs(params)
+	if len(ids) == 0 {
+		return spec.NewError(10, "please provide an `id`, `albumId`, or `artistId` parameter")
+	}
+	err := c.DB.Transaction(func(tx *gorm.DB) error {
+		return starIDs(tx, user.ID, ids, star)
+	})
+	if errors.Is(err, errAnnotationIDType) {
+		return spec.NewError(10, "%v", err)
+	}
+	if err != nil {
+		return spec.NewError(0, "%v", err)
+	}
+	return spec.NewResponse()
+}
+
+func (c *Controller) ServeStar(r *http.Request) *spec.Response {
+	return c.serveStarOrUnstar(r, true)
+}
+
+func (c *Controller) ServeUnstar(r *http.Request) *spec.Response {
+	return c.serveStarOrUnstar(r, false)
+}
+
+func (c *Controller) ServeSetRating(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := params.GetID("id")
+	if err != nil {
+		return spec.NewError(10, "please provide a valid `id` parameter")
+	}
+	rating, err := params.GetInt("rating")
+	if err != nil {
+		return spec.NewError(10, "please provide a `rating` parameter")
+	}
+	if rating < 0 || rating > 5 {
+		return spec.NewError(10, "please provide a `rating` between 0 and 5")
+	}
+	if err := rateID(c.DB.DB, user.ID, id, rating); err != nil {
+		return spec.NewError(0, "%v", err)
+	}
+	return spec.NewResponse()
+}
+
+type annotationOp struct {
+	Op     string `json:"op"`
+	ID     string `json:"id"`
+	Rating int    `json:"rating"`
+}
+
+type annotationBatch struct {
+	Operations []*annotationOp `json:"operations"`
+}
+
+// ServeAnnotateBatch is a gonic extension which takes a json body of mixed star,
+// unstar, and rate operations. they're run in a single transaction, and the
+// result of each is reported so that partial failures can be retried. each op
+// gets a savepoint, since on postgres a failed statement aborts the transaction
+// otherwise
+func (c *Controller) ServeAnnotateBatch(r *http.Request) *spec.Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	if r.Method != http.MethodPost {
+		return spec.NewError(10, "please POST a json body of operations")
+	}
+	var batch annotationBatch
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		return spec.NewError(10, "decoding operations: %v", err)
+	}
+	if len(batch.Operations) > maxAnnotationBatch {
+		return spec.NewError(10, "too many operations, the maximum is %d", maxAnnotationBatch)
+	}
+	results := &spec.AnnotationResults{
+		List: make([]*spec.AnnotationResult, 0, len(batch.Operations)),
+	}
+	err := c.DB.Transaction(func(tx *gorm.DB) error {
+		for _, op := range batch.Operations {
+			result := &spec.AnnotationResult{Op: op.Op, ID: op.ID, Status: "ok"}
+			if err := tx.Exec("SAVEPOINT annotation_op").Error; err != nil {
+				return fmt.Errorf("savepoint: %w", err)
+			}
+			if err := runAnnotationOp(tx, user.ID, op); err != nil {
+				result.Status = "failed"
+				result.Error = err.Error()
+				if err := tx.Exec("ROLLBACK TO SAVEPOINT annotation_op").Error; err != nil {
+					return fmt.Errorf("rollback to savepoint: %w", err)
+				}
+			}
+			if err := tx.Exec("RELEASE SAVEPOINT annotation_op").Error; err != nil {
+				return fmt.Errorf("release savepoint: %w", err)
+			}
+			results.List = append(results.List, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return spec.NewError(0, "running operations: %v", err)
+	}
+	sub := spec.NewResponse()
+	sub.AnnotationResults = results
+	return sub
+}
+
+func runAnnotationOp(tx *gorm.DB, userID int, op *annotationOp) error {
+	id, err := specid.New(op.ID)
+	if err != nil {
+		return err
+	}
+	switch op.Op {
+	case "star":
+		return starIDs(tx, userID, []specid.ID{id}, true)
+	case "unstar":
+		return starIDs(tx, userID, []specid.ID{id}, false)
+	case "rate":
+		return rateID(tx, userID, id, op.Rating)
+	default:
+		return fmt.Errorf("unknown op %q", op.Op)
+	}
+}
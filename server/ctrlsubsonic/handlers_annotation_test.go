@@ -0,0 +1,169 @@
+package ctrlsubsonic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+)
+
+func runAnnotationCase(t *testing.T, contr *Controller, h handlerSubsonic, q url.Values, body string) *spec.Response {
+	t.Helper()
+	q.Add("f", "json")
+	method := http.MethodGet
+	if body != "" {
+		method = http.MethodPost
+	}
+	req, _ := http.NewRequest(method, "", strings.NewReader(body))
+	req.URL.RawQuery = q.Encode()
+	ctx := req.Context()
+	ctx = context.WithValue(ctx, CtxParams, params.New(req))
+	ctx = context.WithValue(ctx, CtxUser, contr.DB.GetUserByName(mockUsername))
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+	contr.H(h).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("didn't give a 200\n%s", rr.Body.String())
+	}
+	var resp spec.SubsonicResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	return &resp.Response
+}
+
+func TestStarUnstar(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	resp := runAnnotationCase(t, contr, contr.ServeStar, url.Values{
+		"id":       {"tr-1", "tr-2", "al-3"},
+		"artistId": {"ar-1"},
+	}, "")
+	is.Equal(resp.Status, "ok")
+
+	resp = runAnnotationCase(t, contr, contr.ServeGetStarredTwo, url.Values{}, "")
+	is.Equal(len(resp.StarredTwo.Artists), 1)
+	is.Equal(len(resp.StarredTwo.Albums), 1)
+	is.Equal(len(resp.StarredTwo.Tracks), 2)
+	is.True(resp.StarredTwo.Tracks[0].Starred != nil) // starred date is set
+
+	resp = runAnnotationCase(t, contr, contr.ServeGetStarred, url.Values{}, "")
+	is.Equal(len(resp.Starred.Albums), 1)
+	is.Equal(len(resp.Starred.Tracks), 2)
+
+	resp = runAnnotationCase(t, contr, contr.ServeUnstar, url.Values{"id": {"tr-1", "ar-1"}}, "")
+	is.Equal(resp.Status, "ok")
+
+	resp = runAnnotationCase(t, contr, contr.ServeGetStarredTwo, url.Values{}, "")
+	is.Equal(len(resp.StarredTwo.Artists), 0)
+	is.Equal(len(resp.StarredTwo.Tracks), 1)
+
+	resp = runAnnotationCase(t, contr, contr.ServeStar, url.Values{"id": {"pd-1"}}, "")
+	is.Equal(resp.Status, "failed") // can't star podcasts
+	is.Equal(resp.Error.Code, 10)
+}
+
+func TestStarMany(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	var trackCount int
+	is.NoErr(contr.DB.Model(db.Track{}).Count(&trackCount).Error)
+
+	var ids []string
+	for i := 1; i <= trackCount; i++ {
+		ids = append(ids, fmt.Sprintf("tr-%d", i))
+	}
+	resp := runAnnotationCase(t, contr, contr.ServeStar, url.Values{"id": ids}, "")
+	is.Equal(resp.Status, "ok")
+
+	var starCount int
+	is.NoErr(contr.DB.Model(db.TrackStar{}).Count(&starCount).Error)
+	is.Equal(starCount, trackCount)
+
+	// starring again keeps the existing stars
+	resp = runAnnotationCase(t, contr, contr.ServeStar, url.Values{"id": ids}, "")
+	is.Equal(resp.Status, "ok")
+	is.NoErr(contr.DB.Model(db.TrackStar{}).Count(&starCount).Error)
+	is.Equal(starCount, trackCount)
+}
+
+func TestSetRating(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	resp := runAnnotationCase(t, contr, contr.ServeSetRating, url.Values{"id": {"al-3"}, "rating": {"4"}}, "")
+	is.Equal(resp.Status, "ok")
+
+	var rating db.AlbumRating
+	is.NoErr(contr.DB.Where("album_id=?", 3).First(&rating).Error)
+	is.Equal(rating.Rating, 4)
+
+	resp = runAnnotationCase(t, contr, contr.ServeSetRating, url.Values{"id": {"al-3"}, "rating": {"0"}}, "")
+	is.Equal(resp.Status, "ok")
+
+	var ratingCount int
+	is.NoErr(contr.DB.Model(db.AlbumRating{}).Count(&ratingCount).Error)
+	is.Equal(ratingCount, 0) // rating of 0 removes it
+
+	resp = runAnnotationCase(t, contr, contr.ServeSetRating, url.Values{"id": {"al-3"}, "rating": {"6"}}, "")
+	is.Equal(resp.Status, "failed")
+	is.Equal(resp.Error.Code, 10) // a bad parameter
+}
+
+func TestAnnotateBatch(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	body := `{"operations": [
+		{"op": "star", "id": "tr-1"},
+		{"op": "star", "id": "tr-999"},
+		{"op": "star", "id": "al-3"},
+		{"op": "unstar", "id": "al-3"},
+		{"op": "rate", "id": "tr-2", "rating": 4},
+		{"op": "rate", "id": "tr-3", "rating": 9},
+		{"op": "star", "id": "pd-1"},
+		{"op": "star", "id": "not-an-id"},
+		{"op": "love", "id": "tr-4"}
+	]}`
+	resp := runAnnotationCase(t, contr, contr.ServeAnnotateBatch, url.Values{}, body)
+	is.Equal(resp.Status, "ok")
+
+	var statuses []string
+	for _, result := range resp.AnnotationResults.List {
+		statuses = append(statuses, result.Status)
+	}
+	is.Equal(statuses, []string{"ok", "failed", "ok", "ok", "ok", "failed", "failed", "failed", "failed"})
+
+	var trackStars, albumStars, trackRatings int
+	is.NoErr(contr.DB.Model(db.TrackStar{}).Count(&trackStars).Error)
+	is.NoErr(contr.DB.Model(db.AlbumStar{}).Count(&albumStars).Error)
+	is.NoErr(contr.DB.Model(db.TrackRating{}).Count(&trackRatings).Error)
+	is.Equal(trackStars, 1)   // only tr-1, tr-999 doesn't exist
+	is.Equal(albumStars, 0)   // al-3 was starred then unstarred
+	is.Equal(trackRatings, 1) // only the valid rating
+
+	var ops []string
+	for i := 0; i <= maxAnnotationBatch; i++ {
+		ops = append(ops, `{"op": "star", "id": "tr-1"}`)
+	}
+	body = fmt.Sprintf(`{"operations": [%s]}`, strings.Join(ops, ","))
+	resp = runAnnotationCase(t, contr, contr.ServeAnnotateBatch, url.Values{}, body)
+	is.Equal(resp.Status, "failed") // too many operations
+	is.Equal(resp.Error.Code, 10)
+}
@@ -22,11 +22,28 @@ func (c *Controller) ServeGetBookmarks(r *http.Request) *spec.Response {
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return spec.NewResponse()
 	}
+	// bookmarked tracks outside the user's music folders are left out
+	var trackIDs []int
+	for _, bookmark := range bookmarks {
+		if specid.IDT(bookmark.EntryIDType) == specid.Track {
+			trackIDs = append(trackIDs, bookmark.EntryID)
+		}
+	}
+	roots := c.musicFolderRoots(r)
+	tracks, err := findTracks(c.DB, trackIDs, "Album")
+	if err != nil {
+		return spec.NewError(0, "error finding tracks: %v", err)
+	}
 	sub := spec.NewResponse()
 	sub.Bookmarks = &spec.Bookmarks{
 		List: []*spec.Bookmark{},
 	}
 	for _, bookmark := range bookmarks {
+		if specid.IDT(bookmark.EntryIDType) == specid.Track {
+			if track, ok := tracks[bookmark.EntryID]; !ok || !inRoots(roots, track.Album) {
+				continue
+			}
+		}
 		specid := &specid.ID{
 			Type:  specid.IDT(bookmark.EntryIDType),
 			Value: bookmark.EntryID,
@@ -1,9 +1,9 @@
 package ctrlsubsonic
 
 import (
-	"fmt"
+	"errors"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 
@@ -20,27 +20,61 @@ import (
 
 func (c *Controller) ServeGetIndexes(r *http.Request) *spec.Response {
 	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	// clients can pass back the last modified time they got from us, if
+	// nothing has changed since then we can skip finding the indexes. the
+	// folders are starred and rated too, so the user's annotations count
+	var latest db.Album
+	latestQ := c.DB.
+		Select("updated_at").
+		Order("updated_at DESC")
+	roots := c.musicFolderRoots(r)
+	if roots != nil {
+		latestQ = latestQ.Where("root_dir IN (?)", roots)
+	}
+	if err := latestQ.First(&latest).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return spec.NewError(0, "finding last modified: %v", err)
+	}
+	lastModified := latestTime(latest.UpdatedAt, user.AnnotatedAt).Truncate(time.Millisecond)
+	if since, err := params.GetTime("ifModifiedSince"); err == nil && !lastModified.After(since) {
+		sub := spec.NewResponse()
+		sub.Indexes = &spec.Indexes{
+			LastModified: int(lastModified.UnixNano() / int64(time.Millisecond)),
+			Index:        []*spec.Index{},
+		}
+		return sub
+	}
 	rootQ := c.DB.
 		Select("id").
 		Model(&db.Album{}).
 		Where("parent_id IS NULL")
-	if m := c.getMusicFolder(params); m != "" {
+	if roots != nil {
 		rootQ = rootQ.
-			Where("root_dir=?", m)
+			Where("root_dir IN (?)", roots)
 	}
 	var folders []*db.Album
-	c.DB.
+	folderQ := c.DB.
 		Select("*, count(sub.id) child_count").
 		Joins("LEFT JOIN albums sub ON albums.id=sub.parent_id").
 		Where("albums.parent_id IN ?", rootQ.SubQuery()).
 		Group("albums.id").
-		Order("albums.right_path COLLATE NOCASE").
-		Find(&folders)
+		Order("albums.right_path COLLATE NOCASE")
+	folderIndexFilter(folderQ, user).Find(&folders)
+	folderIDs := make([]int, 0, len(folders))
+	for _, folder := range folders {
+		folderIDs = append(folderIDs, folder.ID)
+	}
+	ann, err := findFolderAnnotations(c.DB, user.ID, folderIDs, nil)
+	if err != nil {
+		return spec.NewError(0, "find annotations: %v", err)
+	}
+	sorter := userSorter(user)
+	sorter.Slice(folders, func(i int) string { return folders[i].RightPath })
 	// [a-z#] -> 27
 	indexMap := make(map[string]*spec.Index, 27)
 	resp := make([]*spec.Index, 0, 27)
 	for _, folder := range folders {
-		key := lowerUDecOrHash(folder.IndexRightPath())
+		key := sorter.IndexKey(folder.RightPath, folder.IndexRightPath())
 		if _, ok := indexMap[key]; !ok {
 			indexMap[key] = &spec.Index{
 				Name:    key,
@@ -48,12 +82,16 @@ func (c *Controller) ServeGetIndexes(r *http.Request) *spec.Response {
 			}
 			resp = append(resp, indexMap[key])
 		}
-		indexMap[key].Artists = append(indexMap[key].Artists,
-			spec.NewArtistByFolder(folder))
+		artist := spec.NewArtistByFolder(folder)
+		if starred, ok := ann.folderStars[folder.ID]; ok {
+			artist.Starred = &starred
+		}
+		artist.UserRating = ann.folderRatings[folder.ID]
+		indexMap[key].Artists = append(indexMap[key].Artists, artist)
 	}
 	sub := spec.NewResponse()
 	sub.Indexes = &spec.Indexes{
-		LastModified: 0,
+		LastModified: int(lastModified.UnixNano() / int64(time.Millisecond)),
 		Index:        resp,
 	}
 	return sub
@@ -65,15 +103,24 @@ func (c *Controller) ServeGetMusicDirectory(r *http.Request) *spec.Response {
 	if err != nil {
 		return spec.NewError(10, "please provide an `id` parameter")
 	}
+	user := r.Context().Value(CtxUser).(*db.User)
 	childrenObj := []*spec.TrackChild{}
 	folder := &db.Album{}
-	c.DB.First(folder, id.Value)
+	c.DB.
+		Preload("TagArtist").
+		First(folder, id.Value)
+	if !c.canSeeRoot(r, folder.RootDir) {
+		return spec.NewError(50, "user not allowed to access this music folder")
+	}
 	// start looking for child childFolders in the current dir
 	var childFolders []*db.Album
 	c.DB.
-		Where("parent_id=?", id.Value).
+		Select("albums.*, plays.count play_count").
+		Joins("LEFT JOIN plays ON plays.album_id=albums.id AND plays.user_id=?", user.ID).
+		Where("albums.parent_id=?", id.Value).
 		Order("albums.right_path COLLATE NOCASE").
 		Find(&childFolders)
+	userSorter(user).Slice(childFolders, func(i int) string { return childFolders[i].RightPath })
 	for _, c := range childFolders {
 		childrenObj = append(childrenObj, spec.NewTCAlbumByFolder(c))
 	}
@@ -94,9 +141,23 @@ func (c *Controller) ServeGetMusicDirectory(r *http.Request) *spec.Response {
 		}
 		childrenObj = append(childrenObj, toAppend)
 	}
+	if err := setTrackPlays(c.DB, user.ID, childrenObj); err != nil {
+		return spec.NewError(0, "find track plays: %v", err)
+	}
+	if err := setChildAnnotations(c.DB, user.ID, childrenObj); err != nil {
+		return spec.NewError(0, "find annotations: %v", err)
+	}
+	ann, err := findFolderAnnotations(c.DB, user.ID, []int{folder.ID}, nil)
+	if err != nil {
+		return spec.NewError(0, "find annotations: %v", err)
+	}
 	// respond section
 	sub := spec.NewResponse()
 	sub.Directory = spec.NewDirectoryByFolder(folder, childrenObj)
+	if starred, ok := ann.folderStars[folder.ID]; ok {
+		sub.Directory.Starred = starred.Format(time.RFC3339)
+	}
+	sub.Directory.UserRating = ann.folderRatings[folder.ID]
 	return sub
 }
 
@@ -106,12 +167,15 @@ func (c *Controller) ServeGetMusicDirectory(r *http.Request) *spec.Response {
 func (c *Controller) ServeGetAlbumList(r *http.Request) *spec.Response {
 	params := r.Context().Value(CtxParams).(params.Params)
 	q := c.DB.DB
+	// albums are grouped to count their tracks, so other tables are sorted by an
+	// aggregate, which postgres needs. there's one row for each album anyway
 	switch v, _ := params.Get("type"); v {
+	// paged, so sorted by the db rather than the user's locale. see userSorter
 	case "alphabeticalByArtist":
 		q = q.Joins(`
 			JOIN albums parent_albums
 			ON albums.parent_id=parent_albums.id`)
-		q = q.Order("parent_albums.right_path")
+		q = q.Order("max(parent_albums.right_path)")
 	case "alphabeticalByName":
 		q = q.Order("right_path")
 	case "byYear":
@@ -130,8 +194,10 @@ func (c *Controller) ServeGetAlbumList(r *http.Request) *spec.Response {
 			JOIN plays
 			ON albums.id=plays.album_id AND plays.user_id=?`,
 			user.ID)
-		q = q.Order("plays.count DESC")
+		q = q.Order("max(plays.count) DESC")
 	case "newest":
+		// albums dated in the future would always be first
+		q = q.Where("albums.created_at<=?", time.Now())
 		q = q.Order("created_at DESC")
 	case "random":
 		q = q.Order(gorm.Expr("random()"))
@@ -141,13 +207,13 @@ func (c *Controller) ServeGetAlbumList(r *http.Request) *spec.Response {
 			JOIN plays
 			ON albums.id=plays.album_id AND plays.user_id=?`,
 			user.ID)
-		q = q.Order("plays.time DESC")
+		q = q.Order("max(plays.time) DESC")
 	default:
 		return spec.NewError(10, "unknown value `%s` for parameter 'type'", v)
 	}
 
-	if m := c.getMusicFolder(params); m != "" {
-		q = q.Where("root_dir=?", m)
+	if roots := c.musicFolderRoots(r); roots != nil {
+		q = q.Where("root_dir IN (?)", roots)
 	}
 	var folders []*db.Album
 	// TODO: think about removing this extra join to count number
@@ -177,8 +243,8 @@ func (c *Controller) ServeSearchTwo(r *http.Request) *spec.Response {
 	if err != nil {
 		return spec.NewError(10, "please provide a `query` parameter")
 	}
-	query = fmt.Sprintf("%%%s%%", strings.TrimSuffix(query, "*"))
-
+	user := r.Context().Value(CtxUser).(*db.User)
+	terms := searchTerms(query)
 	results := &spec.SearchResultTwo{}
 
 	// search "artists"
@@ -186,30 +252,48 @@ func (c *Controller) ServeSearchTwo(r *http.Request) *spec.Response {
 		Select("id").
 		Model(&db.Album{}).
 		Where("parent_id IS NULL")
-	if m := c.getMusicFolder(params); m != "" {
-		rootQ = rootQ.Where("root_dir=?", m)
+	roots := c.musicFolderRoots(r)
+	if roots != nil {
+		rootQ = rootQ.Where("root_dir IN (?)", roots)
 	}
 
 	var artists []*db.Album
 	q := c.DB.
-		Where(`parent_id IN ? AND (right_path LIKE ? OR right_path_u_dec LIKE ?)`, rootQ.SubQuery(), query, query).
+		Where("parent_id IN ?", rootQ.SubQuery()).
 		Offset(params.GetOrInt("artistOffset", 0)).
 		Limit(params.GetOrInt("artistCount", 20))
+	q = searchWhere(q, terms, "right_path", "right_path_u_dec")
 	if err := q.Find(&artists).Error; err != nil {
 		return spec.NewError(0, "find artists: %v", err)
 	}
+	artistIDs := make([]int, 0, len(artists))
 	for _, a := range artists {
-		results.Artists = append(results.Artists, spec.NewDirectoryByFolder(a, nil))
+		artistIDs = append(artistIDs, a.ID)
+	}
+	ann, err := findFolderAnnotations(c.DB, user.ID, artistIDs, nil)
+	if err != nil {
+		return spec.NewError(0, "find annotations: %v", err)
+	}
+	for _, a := range artists {
+		artist := spec.NewDirectoryByFolder(a, nil)
+		if starred, ok := ann.folderStars[a.ID]; ok {
+			artist.Starred = starred.Format(time.RFC3339)
+		}
+		artist.UserRating = ann.folderRatings[a.ID]
+		results.Artists = append(results.Artists, artist)
 	}
 
 	// search "albums"
 	var albums []*db.Album
 	q = c.DB.
-		Where(`tag_artist_id IS NOT NULL AND (right_path LIKE ? OR right_path_u_dec LIKE ?)`, query, query).
+		Select("albums.*, plays.count play_count").
+		Joins("LEFT JOIN plays ON plays.album_id=albums.id AND plays.user_id=?", user.ID).
+		Where("albums.tag_artist_id IS NOT NULL").
 		Offset(params.GetOrInt("albumOffset", 0)).
 		Limit(params.GetOrInt("albumCount", 20))
-	if m := c.getMusicFolder(params); m != "" {
-		q = q.Where("root_dir=?", m)
+	q = searchWhere(q, terms, "albums.right_path", "albums.right_path_u_dec")
+	if roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
 	}
 	if err := q.Find(&albums).Error; err != nil {
 		return spec.NewError(0, "find albums: %v", err)
@@ -221,14 +305,15 @@ func (c *Controller) ServeSearchTwo(r *http.Request) *spec.Response {
 	// search tracks
 	var tracks []*db.Track
 	q = c.DB.
+		Select("tracks.*").
 		Preload("Album").
-		Where("filename LIKE ? OR filename_u_dec LIKE ?", query, query).
+		Preload("Album.TagArtist").
+		Joins("JOIN albums ON albums.id=tracks.album_id").
 		Offset(params.GetOrInt("songOffset", 0)).
 		Limit(params.GetOrInt("songCount", 20))
-	if m := c.getMusicFolder(params); m != "" {
-		q = q.
-			Joins("JOIN albums ON albums.id=tracks.album_id").
-			Where("albums.root_dir=?", m)
+	q = searchWhere(q, terms, "tracks.filename", "tracks.filename_u_dec")
+	if roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
 	}
 	if err := q.Find(&tracks).Error; err != nil {
 		return spec.NewError(0, "find tracks: %v", err)
@@ -236,6 +321,12 @@ func (c *Controller) ServeSearchTwo(r *http.Request) *spec.Response {
 	for _, t := range tracks {
 		results.Tracks = append(results.Tracks, spec.NewTCTrackByFolder(t, t.Album))
 	}
+	if err := setTrackPlays(c.DB, user.ID, results.Tracks); err != nil {
+		return spec.NewError(0, "find track plays: %v", err)
+	}
+	if err := setChildAnnotations(c.DB, user.ID, append(results.Albums, results.Tracks...)); err != nil {
+		return spec.NewError(0, "find annotations: %v", err)
+	}
 
 	sub := spec.NewResponse()
 	sub.SearchResultTwo = results
@@ -247,11 +338,68 @@ func (c *Controller) ServeGetArtistInfo(r *http.Request) *spec.Response {
 }
 
 func (c *Controller) ServeGetStarred(r *http.Request) *spec.Response {
-	sub := spec.NewResponse()
-	sub.Starred = &spec.Starred{
+	user := r.Context().Value(CtxUser).(*db.User)
+	results := &spec.Starred{
 		Artists: []*spec.Directory{},
 		Albums:  []*spec.TrackChild{},
 		Tracks:  []*spec.TrackChild{},
 	}
+
+	// starred folders which contain albums are considered artists, the
+	// rest are albums. see the note at the top of this file
+	var folderStars []*db.AlbumStar
+	q := c.DB.
+		Select("album_stars.*").
+		Preload("Album").
+		Joins("JOIN albums ON albums.id=album_stars.album_id").
+		Where("album_stars.user_id=?", user.ID).
+		Order("album_stars.star_date DESC")
+	roots := c.musicFolderRoots(r)
+	if roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
+	}
+	if err := q.Find(&folderStars).Error; err != nil {
+		return spec.NewError(0, "find album stars: %v", err)
+	}
+	for _, star := range folderStars {
+		starDate := star.StarDate
+		if star.Album.TagArtistID == 0 {
+			artist := spec.NewDirectoryByFolder(star.Album, nil)
+			artist.Starred = starDate.Format(time.RFC3339)
+			results.Artists = append(results.Artists, artist)
+			continue
+		}
+		album := spec.NewTCAlbumByFolder(star.Album)
+		album.Starred = &starDate
+		results.Albums = append(results.Albums, album)
+	}
+
+	var trackStars []*db.TrackStar
+	q = c.DB.
+		Select("track_stars.*").
+		Preload("Track").
+		Preload("Track.Album").
+		Joins("JOIN tracks ON tracks.id=track_stars.track_id").
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Where("track_stars.user_id=?", user.ID).
+		Order("track_stars.star_date DESC")
+	if roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
+	}
+	if err := q.Find(&trackStars).Error; err != nil {
+		return spec.NewError(0, "find track stars: %v", err)
+	}
+	for _, star := range trackStars {
+		starDate := star.StarDate
+		track := spec.NewTCTrackByFolder(star.Track, star.Track.Album)
+		track.Starred = &starDate
+		results.Tracks = append(results.Tracks, track)
+	}
+	if err := setTrackPlays(c.DB, user.ID, results.Tracks); err != nil {
+		return spec.NewError(0, "find track plays: %v", err)
+	}
+
+	sub := spec.NewResponse()
+	sub.Starred = results
 	return sub
 }
@@ -1,10 +1,19 @@
 package ctrlsubsonic
 
 import (
+	"context"
+	"encoding/json"
 	"net/url"
+	"path/filepath"
 	"testing"
 
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/mockfs"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
 )
 
 func TestGetIndexes(t *testing.T) {
@@ -14,9 +23,68 @@ func TestGetIndexes(t *testing.T) {
 		{url.Values{}, "no_args", false},
 		{url.Values{"musicFolderId": {"0"}}, "with_music_folder_1", false},
 		{url.Values{"musicFolderId": {"1"}}, "with_music_folder_2", false},
+		{url.Values{"ifModifiedSince": {"1575072000000"}}, "if_modified_since_unchanged", false},
+		{url.Values{"ifModifiedSince": {"1575071999999"}}, "if_modified_since_changed", false},
 	})
 }
 
+func TestGetIndexesArtistIndexMode(t *testing.T) {
+	t.Parallel()
+	m := mockfs.New(t)
+	tracks := []struct{ path, trackArtist string }{
+		{"artist-a/album/track-0.flac", "artist-a"},
+		{"guest/album/track-0.flac", "guest"},
+		{"other guest/album/track-0.flac", "other guest"},
+		{"other guest/album/track-1.flac", "Other Guest"},
+		{"misc/album/track-0.flac", "artist-a"},
+	}
+	for _, tr := range tracks {
+		tr := tr
+		m.AddTrack(tr.path)
+		m.SetTags(tr.path, func(tags *mockfs.Tags) error {
+			tags.RawAlbumArtist = "artist-a"
+			tags.RawArtist = tr.trackArtist
+			tags.RawAlbum = "album"
+			tags.RawTitle = filepath.Base(tr.path)
+			return nil
+		})
+	}
+	m.ScanAndClean()
+	contr := makeControllerMock(m, []string{""})
+
+	// the folders of credit-only artists, like in TestGetArtistsIndexMode
+	for _, name := range []string{"guest", "other guest"} {
+		if err := contr.DB.Create(&db.Artist{Name: name}).Error; err != nil {
+			t.Fatalf("create artist: %v", err)
+		}
+	}
+
+	listFolders := func(mode string, minCredits int) []string {
+		t.Helper()
+		rr, req := makeHTTPMock(url.Values{})
+		user := &db.User{ArtistIndex: mode, ArtistIndexMinCredits: minCredits}
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, user))
+		contr.H(contr.ServeGetIndexes).ServeHTTP(rr, req)
+		var resp spec.SubsonicResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal response: %v", err)
+		}
+		var names []string
+		for _, index := range resp.Response.Indexes.Index {
+			for _, artist := range index.Artists {
+				names = append(names, artist.Name)
+			}
+		}
+		return names
+	}
+
+	is := is.New(t)
+	is.Equal(listFolders(db.ArtistIndexAll, 0), []string{"artist-a", "guest", "misc", "other guest"})
+	is.Equal(listFolders(db.ArtistIndexAlbumArtists, 0), []string{"artist-a", "misc"}) // misc isn't an artist
+	is.Equal(listFolders(db.ArtistIndexCredited, 1), []string{"artist-a", "guest", "misc", "other guest"})
+	is.Equal(listFolders(db.ArtistIndexCredited, 2), []string{"artist-a", "misc", "other guest"}) // credits ignore case
+}
+
 func TestGetMusicDirectory(t *testing.T) {
 	contr := makeController(t)
 
@@ -26,6 +94,67 @@ func TestGetMusicDirectory(t *testing.T) {
 	})
 }
 
+func TestFolderAnnotations(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	user := contr.DB.GetUserByName(mockUsername)
+
+	var track db.Track
+	is.NoErr(contr.DB.Where("album_id=?", 3).Order("filename").First(&track).Error)
+	artistID := specid.ID{Type: specid.Album, Value: 2}
+	albumID := specid.ID{Type: specid.Album, Value: 3}
+	trackID := track.SID()
+	is.NoErr(starIDs(contr.DB.DB, user.ID, []specid.ID{artistID, albumID, *trackID}, true))
+	is.NoErr(rateID(contr.DB.DB, user.ID, artistID, 2))
+	is.NoErr(rateID(contr.DB.DB, user.ID, albumID, 4))
+	is.NoErr(rateID(contr.DB.DB, user.ID, *trackID, 5))
+
+	query := func(h handlerSubsonic, q url.Values) *spec.Response {
+		_, req := makeHTTPMock(q)
+		return h(req.WithContext(context.WithValue(req.Context(), CtxUser, user)))
+	}
+	findChild := func(children []*spec.TrackChild, id specid.ID) *spec.TrackChild {
+		for _, child := range children {
+			if *child.ID == id {
+				return child
+			}
+		}
+		return nil
+	}
+
+	resp := query(contr.ServeGetMusicDirectory, url.Values{"id": {artistID.String()}})
+	is.True(resp.Directory.Starred != "")
+	is.Equal(resp.Directory.UserRating, 2)
+	album := findChild(resp.Directory.Children, albumID)
+	is.True(album.Starred != nil)
+	is.Equal(album.UserRating, 4)
+
+	resp = query(contr.ServeGetMusicDirectory, url.Values{"id": {albumID.String()}})
+	child := findChild(resp.Directory.Children, *trackID)
+	is.True(child.Starred != nil)
+	is.Equal(child.UserRating, 5)
+	is.True(resp.Directory.Children[1].Starred == nil) // only the one track
+	is.Equal(resp.Directory.Children[1].UserRating, 0)
+
+	resp = query(contr.ServeGetIndexes, url.Values{})
+	var artist *spec.Artist
+	for _, index := range resp.Indexes.Index {
+		for _, a := range index.Artists {
+			if *a.ID == artistID {
+				artist = a
+			}
+		}
+	}
+	is.True(artist.Starred != nil)
+	is.Equal(artist.UserRating, 2)
+
+	resp = query(contr.ServeSearchTwo, url.Values{"query": {"artist-0"}})
+	is.Equal(resp.SearchResultTwo.Artists[0].UserRating, 2)
+	resp = query(contr.ServeSearchTwo, url.Values{"query": {track.Filename}})
+	is.Equal(resp.SearchResultTwo.Tracks[0].UserRating, 5)
+}
+
 func TestGetAlbumList(t *testing.T) {
 	t.Parallel()
 	contr := makeController(t)
@@ -7,8 +7,10 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
+	"github.com/rainycape/unidecode"
 
 	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
@@ -17,25 +19,119 @@ import (
 	"go.senan.xyz/gonic/scrobble/lastfm"
 )
 
+// artistIndexFilter limits the artists listed when browsing to the user's
+// choice. credits are counted in a single grouped join, not per artist
+func artistIndexFilter(q *gorm.DB, user *db.User) *gorm.DB {
+	switch user.ArtistIndex {
+	case db.ArtistIndexAlbumArtists:
+		return q.Having("count(sub.id) > 0")
+	case db.ArtistIndexCredited:
+		return q.
+			Joins(`
+				LEFT JOIN (
+					SELECT tag_track_artist COLLATE NOCASE name, count(*) track_count
+					FROM tracks
+					GROUP BY tag_track_artist COLLATE NOCASE
+				) credits ON credits.name=artists.name COLLATE NOCASE`).
+			Having("count(sub.id) > 0 OR max(credits.track_count) >= ?", user.ArtistIndexMinCredits)
+	default:
+		return q
+	}
+}
+
+// folderIndexFilter is artistIndexFilter for browsing by folders. a top level
+// folder named after an artist who'd be left out of getArtists is left out too,
+// and folders which aren't named after an artist are always listed
+func folderIndexFilter(q *gorm.DB, user *db.User) *gorm.DB {
+	const creditOnly = `
+		SELECT lower(artists.name) FROM artists
+		WHERE artists.id NOT IN (SELECT tag_artist_id FROM albums WHERE tag_artist_id IS NOT NULL)`
+	switch user.ArtistIndex {
+	case db.ArtistIndexAlbumArtists:
+		return q.Where("lower(albums.right_path) NOT IN (" + creditOnly + ")")
+	case db.ArtistIndexCredited:
+		return q.Where(`
+			lower(albums.right_path) NOT IN (`+creditOnly+`
+				AND lower(artists.name) NOT IN (
+					SELECT lower(tag_track_artist) FROM tracks
+					WHERE tag_track_artist IS NOT NULL
+					GROUP BY lower(tag_track_artist)
+					HAVING count(*) >= ?
+				)
+			)`, user.ArtistIndexMinCredits)
+	default:
+		return q
+	}
+}
+
+// artistCountBatch is how many artists are counted with each query, to stay
+// well under sqlite's limit on query parameters
+const artistCountBatch = 500
+
+// fillArtistTrackCounts sets the number of tracks on each artist's albums, in
+// the music folders with roots, or all of them if it's nil
+func fillArtistTrackCounts(dbc *db.DB, artists []*db.Artist, roots []string) error {
+	byID := make(map[int]*db.Artist, len(artists))
+	ids := make([]int, 0, len(artists))
+	for _, artist := range artists {
+		byID[artist.ID] = artist
+		ids = append(ids, artist.ID)
+	}
+	for len(ids) > 0 {
+		n := artistCountBatch
+		if len(ids) < n {
+			n = len(ids)
+		}
+		var counts []struct {
+			ArtistID   int
+			TrackCount int
+		}
+		q := dbc.
+			Table("tracks").
+			Select("albums.tag_artist_id artist_id, count(tracks.id) track_count").
+			Joins("JOIN albums ON albums.id=tracks.album_id").
+			Where("albums.tag_artist_id IN (?)", ids[:n]).
+			Group("albums.tag_artist_id")
+		if roots != nil {
+			q = q.Where("albums.root_dir IN (?)", roots)
+		}
+		if err := q.Scan(&counts).Error; err != nil {
+			return fmt.Errorf("count tracks: %w", err)
+		}
+		for _, count := range counts {
+			byID[count.ArtistID].TrackCount = count.TrackCount
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
+
 func (c *Controller) ServeGetArtists(r *http.Request) *spec.Response {
-	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
 	var artists []*db.Artist
 	q := c.DB.
-		Select("*, count(sub.id) album_count").
+		Select("artists.*, count(sub.id) album_count").
 		Joins("LEFT JOIN albums sub ON artists.id=sub.tag_artist_id").
 		Group("artists.id").
 		Order("artists.name COLLATE NOCASE")
-	if m := c.getMusicFolder(params); m != "" {
-		q = q.Where("sub.root_dir=?", m)
+	q = artistIndexFilter(q, user)
+	roots := c.musicFolderRoots(r)
+	if roots != nil {
+		q = q.Where("sub.root_dir IN (?)", roots)
 	}
 	if err := q.Find(&artists).Error; err != nil {
 		return spec.NewError(10, "error finding artists: %v", err)
 	}
+	if err := fillArtistTrackCounts(c.DB, artists, roots); err != nil {
+		return spec.NewError(0, "error counting artist tracks: %v", err)
+	}
+	sorter := userSorter(user)
+	sorter.Slice(artists, func(i int) string { return artists[i].Name })
 	// [a-z#] -> 27
 	indexMap := make(map[string]*spec.Index, 27)
 	resp := make([]*spec.Index, 0, 27)
 	for _, artist := range artists {
-		key := lowerUDecOrHash(artist.IndexName())
+		key := sorter.IndexKey(artist.Name, artist.IndexName())
 		if _, ok := indexMap[key]; !ok {
 			indexMap[key] = &spec.Index{
 				Name:    key,
@@ -55,32 +151,80 @@ func (c *Controller) ServeGetArtists(r *http.Request) *spec.Response {
 
 func (c *Controller) ServeGetArtist(r *http.Request) *spec.Response {
 	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
 	id, err := params.GetID("id")
 	if err != nil {
 		return spec.NewError(10, "please provide an `id` parameter")
 	}
+	roots := c.musicFolderRoots(r)
 	artist := &db.Artist{}
 	c.DB.
 		Preload("Albums", func(db *gorm.DB) *gorm.DB {
-			return db.
+			db = db.
 				Select("*, count(sub.id) child_count, sum(sub.length) duration").
 				Joins("LEFT JOIN tracks sub ON albums.id=sub.album_id").
 				Order("albums.right_path").
 				Group("albums.id")
+			if roots != nil {
+				db = db.Where("albums.root_dir IN (?)", roots)
+			}
+			return db
 		}).
 		First(artist, id.Value)
+	if err := fillArtistTrackCounts(c.DB, []*db.Artist{artist}, roots); err != nil {
+		return spec.NewError(0, "error counting artist tracks: %v", err)
+	}
 	sub := spec.NewResponse()
 	sub.Artist = spec.NewArtistByTags(artist)
 	sub.Artist.Albums = make([]*spec.Album, len(artist.Albums))
+	var changed time.Time
 	for i, album := range artist.Albums {
 		sub.Artist.Albums[i] = spec.NewAlbumByTags(album, artist)
+		changed = latestTime(changed, album.UpdatedAt)
 	}
 	sub.Artist.AlbumCount = len(artist.Albums)
+
+	// albums where the artist has track credits, but isn't the album artist
+	appearsOn, err := c.DB.GetAppearsOn(artist, roots)
+	if err != nil {
+		return spec.NewError(0, "find appears on albums: %v", err)
+	}
+	for _, album := range appearsOn {
+		changed = latestTime(changed, album.UpdatedAt)
+	}
+	sub.Artist.Discography = artistDiscography(artist, appearsOn)
+	sub.Artist.LastModified = unixMilli(changed)
+	// the user's stars and such are in it too
+	sub.LastModified = latestTime(changed, user.AnnotatedAt)
 	return sub
 }
 
+// artistDiscography groups the artist's albums by release type. it returns nil
+// if everything is an ordinary album, so that there's nothing extra to render
+func artistDiscography(artist *db.Artist, appearsOn []*db.Album) []*spec.DiscographyGroup {
+	grouped := map[string][]*spec.Album{}
+	for _, album := range artist.Albums {
+		group := album.ReleaseGroup()
+		grouped[group] = append(grouped[group], spec.NewAlbumByTags(album, artist))
+	}
+	for _, album := range appearsOn {
+		grouped[db.ReleaseGroupAppearsOn] = append(grouped[db.ReleaseGroupAppearsOn], spec.NewAlbumByTags(album, album.TagArtist))
+	}
+	if len(grouped) == 0 || (len(grouped) == 1 && grouped[db.ReleaseGroupAlbums] != nil) {
+		return nil
+	}
+	var groups []*spec.DiscographyGroup
+	for _, name := range db.ReleaseGroups {
+		if albums, ok := grouped[name]; ok {
+			groups = append(groups, &spec.DiscographyGroup{Name: name, Albums: albums})
+		}
+	}
+	return groups
+}
+
 func (c *Controller) ServeGetAlbum(r *http.Request) *spec.Response {
 	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
 	id, err := params.GetID("id")
 	if err != nil {
 		return spec.NewError(10, "please provide an `id` parameter")
@@ -99,12 +243,23 @@ func (c *Controller) ServeGetAlbum(r *http.Request) *spec.Response {
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return spec.NewError(10, "couldn't find an album with that id")
 	}
+	if !c.canSeeRoot(r, album.RootDir) {
+		return spec.NewError(50, "user not allowed to access this music folder")
+	}
 	sub := spec.NewResponse()
 	sub.Album = spec.NewAlbumByTags(album, album.TagArtist)
 	sub.Album.Tracks = make([]*spec.TrackChild, len(album.Tracks))
+	changed := album.UpdatedAt
 	for i, track := range album.Tracks {
 		sub.Album.Tracks[i] = spec.NewTrackByTags(track, album)
+		changed = latestTime(changed, track.UpdatedAt)
+	}
+	if err := setTrackPlays(c.DB, user.ID, sub.Album.Tracks); err != nil {
+		return spec.NewError(0, "find track plays: %v", err)
 	}
+	sub.Album.LastModified = unixMilli(changed)
+	// the user's plays are in it too
+	sub.LastModified = latestTime(changed, user.AnnotatedAt)
 	return sub
 }
 
@@ -118,10 +273,12 @@ func (c *Controller) ServeGetAlbumListTwo(r *http.Request) *spec.Response {
 		return spec.NewError(10, "please provide a `type` parameter")
 	}
 	q := c.DB.DB
+	// joined tables are sorted by an aggregate, see ServeGetAlbumList
 	switch listType {
+	// paged, so sorted by the db rather than the user's locale. see userSorter
 	case "alphabeticalByArtist":
 		q = q.Joins("JOIN artists ON albums.tag_artist_id=artists.id")
-		q = q.Order("artists.name")
+		q = q.Order("max(artists.name)")
 	case "alphabeticalByName":
 		q = q.Order("tag_title")
 	case "byYear":
@@ -138,21 +295,37 @@ func (c *Controller) ServeGetAlbumListTwo(r *http.Request) *spec.Response {
 		user := r.Context().Value(CtxUser).(*db.User)
 		q = q.Joins("JOIN plays ON albums.id=plays.album_id AND plays.user_id=?",
 			user.ID)
-		q = q.Order("plays.count DESC")
+		q = q.Order("max(plays.count) DESC")
 	case "newest":
+		// albums dated in the future would always be first
+		q = q.Where("albums.created_at<=?", time.Now())
 		q = q.Order("created_at DESC")
 	case "random":
 		q = q.Order(gorm.Expr("random()"))
 	case "recent":
+		// by the last track played, falling back to the album's stat for
+		// plays from before tracks were counted
 		user := r.Context().Value(CtxUser).(*db.User)
 		q = q.Joins("JOIN plays ON albums.id=plays.album_id AND plays.user_id=?",
 			user.ID)
-		q = q.Order("plays.time DESC")
+		q = q.Joins(`LEFT JOIN (
+				SELECT tracks.album_id, max(track_plays.time) AS "time"
+				FROM track_plays
+				JOIN tracks ON tracks.id=track_plays.track_id
+				WHERE track_plays.user_id=?
+				GROUP BY tracks.album_id
+			) last_track_plays ON last_track_plays.album_id=albums.id`,
+			user.ID)
+		q = q.Order("max(coalesce(last_track_plays.time, plays.time)) DESC")
 	default:
 		return spec.NewError(10, "unknown value `%s` for parameter 'type'", listType)
 	}
-	if m := c.getMusicFolder(params); m != "" {
-		q = q.Where("root_dir=?", m)
+	if roots := c.musicFolderRoots(r); roots != nil {
+		q = q.Where("root_dir IN (?)", roots)
+	}
+	// minDr is a gonic extension
+	if dr, err := params.GetInt("minDr"); err == nil {
+		q = q.Where("albums.dynamic_range >= ?", dr)
 	}
 	var albums []*db.Album
 	// TODO: think about removing this extra join to count number
@@ -178,28 +351,40 @@ func (c *Controller) ServeGetAlbumListTwo(r *http.Request) *spec.Response {
 
 func (c *Controller) ServeSearchThree(r *http.Request) *spec.Response {
 	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
 	query, err := params.Get("query")
 	if err != nil {
 		return spec.NewError(10, "please provide a `query` parameter")
 	}
-	query = fmt.Sprintf("%%%s%%", strings.TrimSuffix(query, "*"))
+	terms := searchTerms(query)
+	indexed := c.DB.HasSearch()
 	results := &spec.SearchResultThree{}
 
 	// search "artists"
 	var artists []*db.Artist
 	q := c.DB.
-		Select("*, count(albums.id) album_count").
+		Select("artists.*, count(albums.id) album_count").
 		Group("artists.id").
-		Where("name LIKE ? OR name_u_dec LIKE ?", query, query).
 		Joins("JOIN albums ON albums.tag_artist_id=artists.id").
 		Offset(params.GetOrInt("artistOffset", 0)).
 		Limit(params.GetOrInt("artistCount", 20))
-	if m := c.getMusicFolder(params); m != "" {
-		q = q.Where("albums.root_dir=?", m)
+	if indexed {
+		q = searchIndexed(q, terms, db.SearchArtist, "artists.id")
+	} else {
+		q = searchWhere(q, terms, "artists.name", "artists.name_u_dec")
+	}
+	// after the best matches, if they're ranked, so that pages don't overlap
+	q = q.Order("artists.id")
+	roots := c.musicFolderRoots(r)
+	if roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
 	}
 	if err := q.Find(&artists).Error; err != nil {
 		return spec.NewError(0, "find artists: %v", err)
 	}
+	if err := fillArtistTrackCounts(c.DB, artists, roots); err != nil {
+		return spec.NewError(0, "count artist tracks: %v", err)
+	}
 	for _, a := range artists {
 		results.Artists = append(results.Artists, spec.NewArtistByTags(a))
 	}
@@ -207,12 +392,22 @@ func (c *Controller) ServeSearchThree(r *http.Request) *spec.Response {
 	// search "albums"
 	var albums []*db.Album
 	q = c.DB.
+		Select("albums.*").
 		Preload("TagArtist").
-		Where("tag_title LIKE ? OR tag_title_u_dec LIKE ?", query, query).
+		Joins("LEFT JOIN artists ON artists.id=albums.tag_artist_id").
+		Where("albums.tag_artist_id IS NOT NULL").
 		Offset(params.GetOrInt("albumOffset", 0)).
 		Limit(params.GetOrInt("albumCount", 20))
-	if m := c.getMusicFolder(params); m != "" {
-		q = q.Where("root_dir=?", m)
+	if indexed {
+		q = searchIndexed(q, terms, db.SearchAlbum, "albums.id")
+	} else {
+		q = searchWhere(q, terms,
+			"albums.tag_title", "albums.tag_title_u_dec",
+			"artists.name", "artists.name_u_dec")
+	}
+	q = q.Order("albums.id")
+	if roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
 	}
 	if err := q.Find(&albums).Error; err != nil {
 		return spec.NewError(0, "find albums: %v", err)
@@ -224,14 +419,23 @@ func (c *Controller) ServeSearchThree(r *http.Request) *spec.Response {
 	// search tracks
 	var tracks []*db.Track
 	q = c.DB.
+		Select("tracks.*").
 		Preload("Album").
-		Where("tag_title LIKE ? OR tag_title_u_dec LIKE ?", query, query).
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Joins("LEFT JOIN artists ON artists.id=tracks.artist_id").
 		Offset(params.GetOrInt("songOffset", 0)).
 		Limit(params.GetOrInt("songCount", 20))
-	if m := c.getMusicFolder(params); m != "" {
-		q = q.
-			Joins("JOIN albums ON albums.id=tracks.album_id").
-			Where("albums.root_dir=?", m)
+	if indexed {
+		q = searchIndexed(q, terms, db.SearchTrack, "tracks.id")
+	} else {
+		q = searchWhere(q, terms,
+			"tracks.tag_title", "tracks.tag_title_u_dec",
+			"tracks.tag_track_artist",
+			"artists.name", "artists.name_u_dec")
+	}
+	q = q.Order("tracks.id")
+	if roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
 	}
 	if err := q.Find(&tracks).Error; err != nil {
 		return spec.NewError(0, "find tracks: %v", err)
@@ -239,6 +443,9 @@ func (c *Controller) ServeSearchThree(r *http.Request) *spec.Response {
 	for _, t := range tracks {
 		results.Tracks = append(results.Tracks, spec.NewTrackByTags(t, t.Album))
 	}
+	if err := setTrackPlays(c.DB, user.ID, results.Tracks); err != nil {
+		return spec.NewError(0, "find track plays: %v", err)
+	}
 
 	sub := spec.NewResponse()
 	sub.SearchResultThree = results
@@ -333,12 +540,17 @@ func (c *Controller) ServeGetArtistInfoTwo(r *http.Request) *spec.Response {
 
 func (c *Controller) ServeGetGenres(r *http.Request) *spec.Response {
 	var genres []*db.Genre
-	c.DB.
-		Select(`*,
-			(SELECT count(1) FROM album_genres WHERE genre_id=genres.id) album_count,
-			(SELECT count(1) FROM track_genres WHERE genre_id=genres.id) track_count`).
-		Group("genres.id").
-		Find(&genres)
+	// genres without tracks are dropped by the inner join
+	err := c.DB.
+		Select("genres.*, track_counts.n track_count, coalesce(album_counts.n, 0) album_count").
+		Joins("JOIN (SELECT genre_id, count(1) n FROM track_genres GROUP BY genre_id) track_counts ON track_counts.genre_id=genres.id").
+		Joins("LEFT JOIN (SELECT genre_id, count(1) n FROM album_genres GROUP BY genre_id) album_counts ON album_counts.genre_id=genres.id").
+		Order("genres.name COLLATE NOCASE").
+		Find(&genres).
+		Error
+	if err != nil {
+		return spec.NewError(0, "finding genres: %v", err)
+	}
 	sub := spec.NewResponse()
 	sub.Genres = &spec.Genres{
 		List: make([]*spec.Genre, len(genres)),
@@ -349,23 +561,46 @@ func (c *Controller) ServeGetGenres(r *http.Request) *spec.Response {
 	return sub
 }
 
+// genreIDsMatching finds genres with the same name as genre, ignoring case and
+// accents. the genres table is small, so it's compared here instead of in sql
+func genreIDsMatching(dbc *db.DB, genre string) ([]int, error) {
+	var genres []*db.Genre
+	if err := dbc.Find(&genres).Error; err != nil {
+		return nil, err
+	}
+	want := strings.ToLower(unidecode.Unidecode(genre))
+	var ids []int
+	for _, g := range genres {
+		if strings.ToLower(unidecode.Unidecode(g.Name)) == want {
+			ids = append(ids, g.ID)
+		}
+	}
+	return ids, nil
+}
+
 func (c *Controller) ServeGetSongsByGenre(r *http.Request) *spec.Response {
 	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
 	genre, err := params.Get("genre")
 	if err != nil {
 		return spec.NewError(10, "please provide an `genre` parameter")
 	}
+	genreIDs, err := genreIDsMatching(c.DB, genre)
+	if err != nil {
+		return spec.NewError(0, "error finding genres: %v", err)
+	}
 	var tracks []*db.Track
 	q := c.DB.
 		Joins("JOIN albums ON tracks.album_id=albums.id").
-		Joins("JOIN track_genres ON track_genres.track_id=tracks.id").
-		Joins("JOIN genres ON track_genres.genre_id=genres.id AND genres.name=?", genre).
+		Where("tracks.id IN (SELECT track_id FROM track_genres WHERE genre_id IN (?))", genreIDs).
 		Preload("Album").
 		Preload("Album.TagArtist").
+		// a stable order, so that paging doesn't repeat or skip tracks
+		Order("albums.tag_title COLLATE NOCASE, albums.id, tracks.tag_disc_number, tracks.tag_track_number, tracks.id").
 		Offset(params.GetOrInt("offset", 0)).
 		Limit(params.GetOrInt("count", 10))
-	if m := c.getMusicFolder(params); m != "" {
-		q = q.Where("albums.root_dir=?", m)
+	if roots := c.musicFolderRoots(r); roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
 	}
 	if err := q.Find(&tracks).Error; err != nil {
 		return spec.NewError(0, "error finding tracks: %v", err)
@@ -377,16 +612,92 @@ func (c *Controller) ServeGetSongsByGenre(r *http.Request) *spec.Response {
 	for i, track := range tracks {
 		sub.TracksByGenre.List[i] = spec.NewTrackByTags(track, track.Album)
 	}
+	if err := setTrackPlays(c.DB, user.ID, sub.TracksByGenre.List); err != nil {
+		return spec.NewError(0, "find track plays: %v", err)
+	}
 	return sub
 }
 
 func (c *Controller) ServeGetStarredTwo(r *http.Request) *spec.Response {
-	sub := spec.NewResponse()
-	sub.StarredTwo = &spec.StarredTwo{
+	user := r.Context().Value(CtxUser).(*db.User)
+	results := &spec.StarredTwo{
 		Artists: []*spec.Artist{},
 		Albums:  []*spec.Album{},
 		Tracks:  []*spec.TrackChild{},
 	}
+
+	var artistStars []*db.ArtistStar
+	q := c.DB.
+		Preload("Artist").
+		Where("user_id=?", user.ID).
+		Order("star_date DESC")
+	roots := c.musicFolderRoots(r)
+	if roots != nil {
+		q = q.Where("artist_id IN ?", c.DB.
+			Select("tag_artist_id").
+			Model(db.Album{}).
+			Where("root_dir IN (?)", roots).
+			SubQuery())
+	}
+	if err := q.Find(&artistStars).Error; err != nil {
+		return spec.NewError(0, "find artist stars: %v", err)
+	}
+	for _, star := range artistStars {
+		starDate := star.StarDate
+		artist := spec.NewArtistByTags(star.Artist)
+		artist.Starred = &starDate
+		results.Artists = append(results.Artists, artist)
+	}
+
+	var albumStars []*db.AlbumStar
+	q = c.DB.
+		Select("album_stars.*").
+		Preload("Album").
+		Preload("Album.TagArtist").
+		Joins("JOIN albums ON albums.id=album_stars.album_id").
+		Where("album_stars.user_id=? AND albums.tag_artist_id IS NOT NULL", user.ID).
+		Order("album_stars.star_date DESC")
+	if roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
+	}
+	if err := q.Find(&albumStars).Error; err != nil {
+		return spec.NewError(0, "find album stars: %v", err)
+	}
+	for _, star := range albumStars {
+		starDate := star.StarDate
+		album := spec.NewAlbumByTags(star.Album, star.Album.TagArtist)
+		album.Starred = &starDate
+		results.Albums = append(results.Albums, album)
+	}
+
+	var trackStars []*db.TrackStar
+	q = c.DB.
+		Select("track_stars.*").
+		Preload("Track").
+		Preload("Track.Album").
+		Preload("Track.Album.TagArtist").
+		Joins("JOIN tracks ON tracks.id=track_stars.track_id").
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Where("track_stars.user_id=?", user.ID).
+		Order("track_stars.star_date DESC")
+	if roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
+	}
+	if err := q.Find(&trackStars).Error; err != nil {
+		return spec.NewError(0, "find track stars: %v", err)
+	}
+	for _, star := range trackStars {
+		starDate := star.StarDate
+		track := spec.NewTrackByTags(star.Track, star.Track.Album)
+		track.Starred = &starDate
+		results.Tracks = append(results.Tracks, track)
+	}
+	if err := setTrackPlays(c.DB, user.ID, results.Tracks); err != nil {
+		return spec.NewError(0, "find track plays: %v", err)
+	}
+
+	sub := spec.NewResponse()
+	sub.StarredTwo = results
 	return sub
 }
 
@@ -404,6 +715,7 @@ func (c *Controller) genArtistCoverURL(r *http.Request, artist *db.Artist, size
 
 func (c *Controller) ServeGetTopSongs(r *http.Request) *spec.Response {
 	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
 	count := params.GetOrInt("count", 10)
 	artistName, err := params.Get("artist")
 	if err != nil {
@@ -431,14 +743,16 @@ func (c *Controller) ServeGetTopSongs(r *http.Request) *spec.Response {
 		topTrackNames[i] = t.Name
 	}
 
-	var tracks []*db.Track
-	err = c.DB.
+	q := c.DB.
 		Preload("Album").
-		Where("artist_id=? AND tracks.tag_title IN (?)", artist.ID, topTrackNames).
-		Limit(count).
-		Find(&tracks).
-		Error
-	if err != nil {
+		Select("tracks.*").
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Where("tracks.artist_id=? AND tracks.tag_title IN (?)", artist.ID, topTrackNames)
+	if roots := c.musicFolderRoots(r); roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
+	}
+	var tracks []*db.Track
+	if err := q.Limit(count).Find(&tracks).Error; err != nil {
 		return spec.NewError(0, "error finding tracks: %v", err)
 	}
 	if len(tracks) == 0 {
@@ -452,11 +766,15 @@ func (c *Controller) ServeGetTopSongs(r *http.Request) *spec.Response {
 	for i, track := range tracks {
 		sub.TopSongs.Tracks[i] = spec.NewTrackByTags(track, track.Album)
 	}
+	if err := setTrackPlays(c.DB, user.ID, sub.TopSongs.Tracks); err != nil {
+		return spec.NewError(0, "find track plays: %v", err)
+	}
 	return sub
 }
 
 func (c *Controller) ServeGetSimilarSongs(r *http.Request) *spec.Response {
 	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
 	count := params.GetOrInt("count", 10)
 	id, err := params.GetID("id")
 	if err != nil || id.Type != specid.Track {
@@ -491,17 +809,17 @@ func (c *Controller) ServeGetSimilarSongs(r *http.Request) *spec.Response {
 		similarTrackNames[i] = t.Name
 	}
 
-	var tracks []*db.Track
-	err = c.DB.
+	q := c.DB.
 		Preload("Artist").
 		Preload("Album").
 		Select("tracks.*").
-		Where("tracks.tag_title IN (?)", similarTrackNames).
-		Order(gorm.Expr("random()")).
-		Limit(count).
-		Find(&tracks).
-		Error
-	if err != nil {
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Where("tracks.tag_title IN (?)", similarTrackNames)
+	if roots := c.musicFolderRoots(r); roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
+	}
+	var tracks []*db.Track
+	if err := q.Order(gorm.Expr("random()")).Limit(count).Find(&tracks).Error; err != nil {
 		return spec.NewError(0, "error finding tracks: %v", err)
 	}
 	if len(tracks) == 0 {
@@ -515,11 +833,15 @@ func (c *Controller) ServeGetSimilarSongs(r *http.Request) *spec.Response {
 	for i, track := range tracks {
 		sub.SimilarSongs.Tracks[i] = spec.NewTrackByTags(track, track.Album)
 	}
+	if err := setTrackPlays(c.DB, user.ID, sub.SimilarSongs.Tracks); err != nil {
+		return spec.NewError(0, "find track plays: %v", err)
+	}
 	return sub
 }
 
 func (c *Controller) ServeGetSimilarSongsTwo(r *http.Request) *spec.Response {
 	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
 	count := params.GetOrInt("count", 10)
 	id, err := params.GetID("id")
 	if err != nil || id.Type != specid.Artist {
@@ -553,16 +875,17 @@ func (c *Controller) ServeGetSimilarSongsTwo(r *http.Request) *spec.Response {
 		artistNames[i] = similarArtist.Name
 	}
 
-	var tracks []*db.Track
-	err = c.DB.
+	q := c.DB.
 		Preload("Album").
+		Select("tracks.*").
 		Joins("JOIN artists on tracks.artist_id=artists.id").
-		Where("artists.name IN (?)", artistNames).
-		Order(gorm.Expr("random()")).
-		Limit(count).
-		Find(&tracks).
-		Error
-	if err != nil {
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Where("artists.name IN (?)", artistNames)
+	if roots := c.musicFolderRoots(r); roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
+	}
+	var tracks []*db.Track
+	if err := q.Order(gorm.Expr("random()")).Limit(count).Find(&tracks).Error; err != nil {
 		return spec.NewError(0, "error finding tracks: %v", err)
 	}
 	if len(tracks) == 0 {
@@ -576,5 +899,8 @@ func (c *Controller) ServeGetSimilarSongsTwo(r *http.Request) *spec.Response {
 	for i, track := range tracks {
 		sub.SimilarSongsTwo.Tracks[i] = spec.NewTrackByTags(track, track.Album)
 	}
+	if err := setTrackPlays(c.DB, user.ID, sub.SimilarSongsTwo.Tracks); err != nil {
+		return spec.NewError(0, "find track plays: %v", err)
+	}
 	return sub
 }
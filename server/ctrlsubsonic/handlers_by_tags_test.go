@@ -1,8 +1,22 @@
 package ctrlsubsonic
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/mockfs"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
 )
 
 func TestGetArtists(t *testing.T) {
@@ -59,3 +73,553 @@ func TestSearchThree(t *testing.T) {
 		{url.Values{"query": {"tit"}}, "q_tra", false},
 	})
 }
+
+func TestSearchThreePaging(t *testing.T) {
+	t.Parallel()
+	contr := makeController(t)
+
+	runQueryCases(t, contr, contr.ServeSearchThree, []*queryCase{
+		{url.Values{"query": {"art"}, "artistCount": {"1"}, "artistOffset": {"1"}, "albumCount": {"2"}, "albumOffset": {"2"}, "songCount": {"2"}, "songOffset": {"4"}}, "q_art_offsets", false},
+		{url.Values{"query": {"artist-1 album-2"}}, "q_multi_term", false},
+		{url.Values{"query": {`""`}, "artistCount": {"5"}, "albumCount": {"5"}, "songCount": {"5"}}, "q_empty_quotes", false},
+		{url.Values{"query": {"*"}, "artistCount": {"5"}, "albumCount": {"5"}, "songCount": {"5"}}, "q_star", false},
+	})
+}
+
+func TestSearchThreePagesDontOverlap(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	search := func(params url.Values) *spec.SearchResultThree {
+		_, req := makeHTTPMock(params)
+		resp := contr.ServeSearchThree(req)
+		is.True(resp.Error == nil)
+		return resp.SearchResultThree
+	}
+
+	all := search(url.Values{"query": {"tit"}, "artistCount": {"0"}, "albumCount": {"0"}, "songCount": {"500"}})
+	is.True(len(all.Tracks) > 1)
+
+	// one track a page, each page follows the last, and together they're the full result
+	for i, track := range all.Tracks {
+		page := search(url.Values{"query": {"tit"}, "artistCount": {"0"}, "albumCount": {"0"},
+			"songCount": {"1"}, "songOffset": {strconv.Itoa(i)}})
+		is.Equal(len(page.Tracks), 1)
+		is.Equal(page.Tracks[0].ID, track.ID)
+	}
+}
+
+func TestSearchThreeUnidecode(t *testing.T) {
+	t.Parallel()
+	m := mockfs.New(t)
+	m.AddTrack("sigur-ros/agaetis-byrjun/track-0.flac")
+	m.SetTags("sigur-ros/agaetis-byrjun/track-0.flac", func(tags *mockfs.Tags) error {
+		tags.RawArtist = "Sigur Rós feat. Alex"
+		tags.RawAlbumArtist = "Sigur Rós"
+		tags.RawAlbum = "Ágætis byrjun"
+		tags.RawTitle = "Svefn-g-englar"
+		return nil
+	})
+	m.ScanAndClean()
+	m.ResetDates()
+	contr := makeControllerMock(m, []string{""})
+
+	runQueryCases(t, contr, contr.ServeSearchThree, []*queryCase{
+		{url.Values{"query": {"sigur ros"}}, "q_album_artist", false},
+		{url.Values{"query": {"agaetis"}}, "q_album", false},
+		{url.Values{"query": {"alex"}}, "q_track_artist", false},
+	})
+}
+
+func TestSearchThreeTracksUnindexed(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	if contr.DB.HasSearch() {
+		t.Skip("the search index is used with fts5")
+	}
+
+	search := func(query string) []int {
+		_, req := makeHTTPMock(url.Values{"query": {query}, "artistCount": {"0"}, "albumCount": {"0"}})
+		resp := contr.ServeSearchThree(req)
+		is.True(resp.Error == nil)
+		var ids []int
+		for _, track := range resp.SearchResultThree.Tracks {
+			ids = append(ids, track.ID.Value)
+		}
+		return ids
+	}
+
+	var track db.Track
+	is.NoErr(contr.DB.Order("id").First(&track).Error)
+	is.Equal(len(search("nocturne")), 0)
+
+	// renamed tracks are found by their new title, or part of it
+	is.NoErr(contr.DB.Model(&track).Update("tag_title", "Nocturne in E-flat").Error)
+	is.Equal(search("nocturne"), []int{track.ID})
+	is.Equal(search("NOCT e-fl"), []int{track.ID})
+	is.Equal(len(search("title-0 nocturne")), 0)
+
+	// and deleted ones aren't
+	is.NoErr(contr.DB.Delete(&track).Error)
+	is.Equal(len(search("nocturne")), 0)
+}
+
+func TestSearchThreeIndexed(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+	tracks := []struct{ path, artist, album, title string }{
+		{"a/blue/track-0.flac", "Miles Davis", "Kind of Blue", "So What"},
+		{"a/blue/track-1.flac", "Miles Davis", "Kind of Blue", "Blue in Green"},
+		{"b/homogenic/track-0.flac", "Björk", "Homogénic", "Jóga"},
+		{"c/blues/track-0.flac", "Blues Brothers", "Briefcase Full of Blues", "Soul Man"},
+	}
+	for _, tr := range tracks {
+		tr := tr
+		m.AddTrack(tr.path)
+		m.SetTags(tr.path, func(tags *mockfs.Tags) error {
+			tags.RawAlbumArtist = tr.artist
+			tags.RawArtist = tr.artist
+			tags.RawAlbum = tr.album
+			tags.RawTitle = tr.title
+			return nil
+		})
+	}
+	m.ScanAndClean()
+	contr := makeControllerMock(m, []string{""})
+	if !contr.DB.HasSearch() {
+		t.Skip("sqlite wasn't built with fts5")
+	}
+
+	type result struct{ artists, albums, tracks []string }
+	search := func(query string) result {
+		_, req := makeHTTPMock(url.Values{"query": {query}})
+		resp := contr.ServeSearchThree(req)
+		is.True(resp.Error == nil)
+		var r result
+		for _, artist := range resp.SearchResultThree.Artists {
+			r.artists = append(r.artists, artist.Name)
+		}
+		for _, album := range resp.SearchResultThree.Albums {
+			r.albums = append(r.albums, album.Name)
+		}
+		for _, track := range resp.SearchResultThree.Tracks {
+			r.tracks = append(r.tracks, track.Title)
+		}
+		return r
+	}
+
+	// every word is found, in any of the names, in any order
+	is.Equal(search("blue davis"), result{
+		albums: []string{"Kind of Blue"},
+		tracks: []string{"Blue in Green"},
+	})
+	is.Equal(search("davis green").tracks, []string{"Blue in Green"})
+	is.Equal(search("green miles what"), result{})
+
+	// words are matched from their start, and better matches are first
+	is.Equal(search("blue"), result{
+		artists: []string{"Blues Brothers"},
+		albums:  []string{"Briefcase Full of Blues", "Kind of Blue"},
+		tracks:  []string{"Blue in Green", "Soul Man"},
+	})
+	is.Equal(search("mil").artists, []string{"Miles Davis"})
+	is.Equal(search("ues"), result{})
+
+	// accents are folded, either way around
+	is.Equal(search("bjork joga"), result{tracks: []string{"Jóga"}})
+	is.Equal(search("Bjork").artists, []string{"Björk"})
+	is.Equal(search("hómogènic").albums, []string{"Homogénic"})
+
+	// the index is kept up to date by the scanner
+	m.SetTags("a/blue/track-1.flac", func(tags *mockfs.Tags) error {
+		tags.RawTitle = "Flamenco Sketches"
+		return nil
+	})
+	m.RemoveAll("c")
+	m.ScanAndClean()
+	is.Equal(search("green"), result{})
+	is.Equal(search("flamenco").tracks, []string{"Flamenco Sketches"})
+	is.Equal(search("blues"), result{})
+}
+
+func TestGetArtistDiscography(t *testing.T) {
+	t.Parallel()
+	m := mockfs.New(t)
+	releases := []struct{ path, albumArtist, trackArtist, releaseType string }{
+		{"a/album/track-0.flac", "artist-a", "artist-a", "album"},
+		{"a/ep/track-0.flac", "artist-a", "artist-a", "ep"},
+		{"a/live/track-0.flac", "artist-a", "artist-a", "album; live"},
+		{"b/album/track-0.flac", "artist-b", "artist-b", "album"},
+		{"b/album/track-1.flac", "artist-b", "artist-a", "album"},
+	}
+	for _, r := range releases {
+		r := r
+		m.AddTrack(r.path)
+		m.SetTags(r.path, func(tags *mockfs.Tags) error {
+			tags.RawAlbumArtist = r.albumArtist
+			tags.RawArtist = r.trackArtist
+			tags.RawAlbum = filepath.Dir(r.path)
+			tags.RawTitle = filepath.Base(r.path)
+			tags.RawReleaseType = r.releaseType
+			return nil
+		})
+	}
+	m.ScanAndClean()
+	m.ResetDates()
+	contr := makeControllerMock(m, []string{""})
+
+	runQueryCases(t, contr, contr.ServeGetArtist, []*queryCase{
+		{url.Values{"id": {"ar-1"}}, "grouped", false},
+		{url.Values{"id": {"ar-2"}}, "ungrouped", false},
+	})
+}
+
+func TestGetArtistsIndexMode(t *testing.T) {
+	t.Parallel()
+	m := mockfs.New(t)
+	tracks := []struct{ path, albumArtist, trackArtist string }{
+		{"a/album/track-0.flac", "artist-a", "artist-a"},
+		{"a/album/track-1.flac", "artist-a", "guest"},
+		{"a/album/track-2.flac", "artist-a", "Guest"},
+		{"a/album/track-3.flac", "artist-a", "other guest"},
+	}
+	for _, tr := range tracks {
+		tr := tr
+		m.AddTrack(tr.path)
+		m.SetTags(tr.path, func(tags *mockfs.Tags) error {
+			tags.RawAlbumArtist = tr.albumArtist
+			tags.RawArtist = tr.trackArtist
+			tags.RawAlbum = "album"
+			tags.RawTitle = filepath.Base(tr.path)
+			return nil
+		})
+	}
+	m.ScanAndClean()
+	contr := makeControllerMock(m, []string{""})
+
+	// the scanner only makes album artists for now, so add some credit-only ones
+	for _, name := range []string{"guest", "other guest", "nobody"} {
+		if err := contr.DB.Create(&db.Artist{Name: name}).Error; err != nil {
+			t.Fatalf("create artist: %v", err)
+		}
+	}
+
+	listArtists := func(mode string, minCredits int) map[string]int {
+		t.Helper()
+		rr, req := makeHTTPMock(url.Values{})
+		user := &db.User{ArtistIndex: mode, ArtistIndexMinCredits: minCredits}
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, user))
+		contr.H(contr.ServeGetArtists).ServeHTTP(rr, req)
+		var resp spec.SubsonicResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal response: %v", err)
+		}
+		albumCounts := map[string]int{}
+		for _, index := range resp.Response.Artists.List {
+			for _, artist := range index.Artists {
+				albumCounts[artist.Name] = artist.AlbumCount
+			}
+		}
+		return albumCounts
+	}
+
+	is := is.New(t)
+	is.Equal(listArtists(db.ArtistIndexAll, 0), map[string]int{"artist-a": 1, "guest": 0, "other guest": 0, "nobody": 0})
+	is.Equal(listArtists(db.ArtistIndexAlbumArtists, 0), map[string]int{"artist-a": 1})
+	is.Equal(listArtists(db.ArtistIndexCredited, 1), map[string]int{"artist-a": 1, "guest": 0, "other guest": 0})
+	is.Equal(listArtists(db.ArtistIndexCredited, 2), map[string]int{"artist-a": 1, "guest": 0}) // credits ignore case
+	is.Equal(listArtists(db.ArtistIndexCredited, 3), map[string]int{"artist-a": 1})
+}
+
+func TestGetSongsByGenre(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+	tracks := []struct{ path, genre string }{
+		{"b/album/track-0.flac", "Électronica"},
+		{"b/album/track-1.flac", "Électronica"},
+		{"b/album/track-2.flac", "rock"},
+		{"a/album/track-0.flac", "electronica"},
+		{"a/album/track-1.flac", "electronica;rock"},
+	}
+	for _, tr := range tracks {
+		tr := tr
+		m.AddTrack(tr.path)
+		m.SetTags(tr.path, func(tags *mockfs.Tags) error {
+			tags.RawArtist = filepath.Dir(filepath.Dir(tr.path))
+			tags.RawAlbum = filepath.Dir(tr.path)
+			tags.RawTitle = filepath.Base(tr.path)
+			tags.RawGenre = tr.genre
+			return nil
+		})
+	}
+	m.ScanAndClean()
+	contr := makeControllerMock(m, []string{""})
+
+	songsByGenre := func(params url.Values) []string {
+		rr, req := makeHTTPMock(params)
+		contr.H(contr.ServeGetSongsByGenre).ServeHTTP(rr, req)
+		var resp spec.SubsonicResponse
+		is.NoErr(json.Unmarshal(rr.Body.Bytes(), &resp))
+		is.Equal(resp.Response.Error, nil)
+		var paths []string
+		for _, track := range resp.Response.TracksByGenre.List {
+			paths = append(paths, track.Path)
+		}
+		return paths
+	}
+
+	// case and accents are ignored, and the order is by album then track
+	all := songsByGenre(url.Values{"genre": {"ELECTRONICA"}})
+	is.Equal(all, []string{
+		"a/album/track-0.flac",
+		"a/album/track-1.flac",
+		"b/album/track-0.flac",
+		"b/album/track-1.flac",
+	})
+
+	// pages don't overlap or skip
+	var paged []string
+	for offset := 0; offset < 6; offset += 2 {
+		paged = append(paged, songsByGenre(url.Values{
+			"genre":  {"electronica"},
+			"count":  {"2"},
+			"offset": {strconv.Itoa(offset)},
+		})...)
+	}
+	is.Equal(paged, all)
+
+	is.Equal(len(songsByGenre(url.Values{"genre": {"rock"}})), 2)
+	is.Equal(len(songsByGenre(url.Values{"genre": {"jazz"}})), 0)
+}
+
+func TestGetGenres(t *testing.T) {
+	t.Parallel()
+	m := mockfs.New(t)
+	tracks := []struct{ path, genre string }{
+		{"a/album/track-0.flac", "rock;pop"},
+		{"a/album/track-1.flac", "rock"},
+		{"b/album/track-0.flac", "Jazz"},
+	}
+	for _, tr := range tracks {
+		tr := tr
+		m.AddTrack(tr.path)
+		m.SetTags(tr.path, func(tags *mockfs.Tags) error {
+			tags.RawArtist = filepath.Dir(filepath.Dir(tr.path))
+			tags.RawAlbum = "album"
+			tags.RawTitle = filepath.Base(tr.path)
+			tags.RawGenre = tr.genre
+			return nil
+		})
+	}
+	m.ScanAndClean()
+	contr := makeControllerMock(m, []string{""})
+
+	// genres without tracks shouldn't be listed
+	if err := contr.DB.Create(&db.Genre{Name: "empty"}).Error; err != nil {
+		t.Fatalf("create genre: %v", err)
+	}
+
+	runQueryCases(t, contr, contr.ServeGetGenres, []*queryCase{
+		{url.Values{}, "no_args", false},
+	})
+}
+
+func TestConditionalGet(t *testing.T) {
+	t.Parallel()
+	contr := makeController(t)
+
+	lastModified := time.Date(2020, 0, 0, 0, 0, 0, 0, time.UTC) // from mockfs.ResetDates
+	cases := []struct {
+		name    string
+		handler handlerSubsonic
+		id      string
+	}{
+		{"getAlbum", contr.ServeGetAlbum, "al-3"},
+		{"getArtist", contr.ServeGetArtist, "ar-1"},
+		{"getSong", contr.ServeGetSong, "tr-1"},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			rr, req := makeHTTPMock(url.Values{"id": {tc.id}})
+			contr.H(tc.handler).ServeHTTP(rr, req)
+			is.Equal(rr.Code, http.StatusOK)
+			is.Equal(rr.Header().Get("Last-Modified"), lastModified.Format(http.TimeFormat))
+
+			rr, req = makeHTTPMock(url.Values{"id": {tc.id}})
+			req.Header.Set("If-Modified-Since", lastModified.Format(http.TimeFormat))
+			contr.H(tc.handler).ServeHTTP(rr, req)
+			is.Equal(rr.Code, http.StatusNotModified) // unchanged since
+			is.Equal(rr.Body.Len(), 0)
+
+			rr, req = makeHTTPMock(url.Values{"id": {tc.id}})
+			req.Header.Set("If-Modified-Since", lastModified.Add(-time.Hour).Format(http.TimeFormat))
+			contr.H(tc.handler).ServeHTTP(rr, req)
+			is.Equal(rr.Code, http.StatusOK) // changed since
+			is.True(rr.Body.Len() > 0)
+		})
+	}
+
+	// the user's own plays and stars are in them too, so starring anything
+	// changes them for that user
+	withUser := func(query url.Values) (*httptest.ResponseRecorder, *http.Request) {
+		rr, req := makeHTTPMock(query)
+		user := contr.DB.GetUserByName(mockUsername)
+		return rr, req.WithContext(context.WithValue(req.Context(), CtxUser, user))
+	}
+	_, req := withUser(url.Values{"id": {"al-1"}})
+	if resp := contr.ServeStar(req); resp.Error != nil {
+		t.Fatalf("star: %v", resp.Error)
+	}
+	rr, req := withUser(url.Values{"id": {"tr-1"}})
+	req.Header.Set("If-Modified-Since", lastModified.Format(http.TimeFormat))
+	contr.H(contr.ServeGetSong).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected the song after starring, got %d", rr.Code)
+	}
+
+	// responses without a known modification time don't get the header
+	rr, req = makeHTTPMock(url.Values{})
+	contr.H(contr.ServePing).ServeHTTP(rr, req)
+	if rr.Header().Get("Last-Modified") != "" {
+		t.Errorf("expected no last modified for ping")
+	}
+}
+
+func TestGetArtistsLocale(t *testing.T) {
+	t.Parallel()
+	contr := makeControllerMock(mockfs.New(t), []string{""})
+	artists := []struct{ name, udec string }{
+		{"Zappa", ""},
+		{"Öberg", "Oberg"},
+		{"oasis", ""},
+		{"Abba", ""},
+		{"Ärzte", "Arzte"},
+		{"Irmak", ""},
+		{"İlhan", "Ilhan"},
+		{"Cem", ""},
+		{"Çelik", "Celik"},
+	}
+	for _, a := range artists {
+		if err := contr.DB.Create(&db.Artist{Name: a.name, NameUDec: a.udec}).Error; err != nil {
+			t.Fatalf("create artist: %v", err)
+		}
+	}
+
+	listArtists := func(locale string) []string {
+		t.Helper()
+		rr, req := makeHTTPMock(url.Values{})
+		user := &db.User{Locale: locale}
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, user))
+		contr.H(contr.ServeGetArtists).ServeHTTP(rr, req)
+		var resp spec.SubsonicResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal response: %v", err)
+		}
+		var names []string
+		for _, index := range resp.Response.Artists.List {
+			for _, artist := range index.Artists {
+				names = append(names, index.Name+" "+artist.Name)
+			}
+		}
+		return names
+	}
+
+	is := is.New(t)
+	is.Equal(listArtists("de"), []string{"a Abba", "a Ärzte", "c Çelik", "c Cem", "i İlhan", "i Irmak", "o oasis", "o Öberg", "z Zappa"})
+	is.Equal(listArtists("sv"), []string{"a Abba", "c Çelik", "c Cem", "i İlhan", "i Irmak", "o oasis", "z Zappa", "ä Ärzte", "ö Öberg"})
+	is.Equal(listArtists("tr"), []string{"a Abba", "a Ärzte", "c Cem", "ç Çelik", "i Irmak", "i İlhan", "o oasis", "ö Öberg", "z Zappa"})
+}
+
+func TestCompilationAndCounts(t *testing.T) {
+	t.Parallel()
+	m := mockfs.New(t)
+	tracks := []struct{ path, albumArtist, trackArtist, releaseType string }{
+		{"various/hits/track-0.flac", "Various Artists", "artist-a", "album; compilation"},
+		{"various/hits/track-1.flac", "Various Artists", "artist-b", "album; compilation"},
+		{"various/hits/track-2.flac", "Various Artists", "artist-c", "album; compilation"},
+		{"a/album/track-0.flac", "artist-a", "artist-a", "album"},
+		{"a/album/track-1.flac", "artist-a", "artist-a", "album"},
+		{"a/ep/track-0.flac", "artist-a", "artist-a", "ep"},
+	}
+	for _, tr := range tracks {
+		tr := tr
+		m.AddTrack(tr.path)
+		m.SetTags(tr.path, func(tags *mockfs.Tags) error {
+			tags.RawAlbumArtist = tr.albumArtist
+			tags.RawArtist = tr.trackArtist
+			tags.RawAlbum = filepath.Base(filepath.Dir(tr.path))
+			tags.RawTitle = filepath.Base(tr.path)
+			tags.RawReleaseType = tr.releaseType
+			return nil
+		})
+	}
+	m.ScanAndClean()
+	contr := makeControllerMock(m, []string{""})
+
+	serve := func(h handlerSubsonic, params url.Values) *httptest.ResponseRecorder {
+		rr, req := makeHTTPMock(params)
+		contr.H(h).ServeHTTP(rr, req)
+		return rr
+	}
+	serveJSON := func(h handlerSubsonic, params url.Values) *spec.Response {
+		var resp spec.SubsonicResponse
+		if err := json.Unmarshal(serve(h, params).Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unmarshal response: %v", err)
+		}
+		return &resp.Response
+	}
+	serveXML := func(h handlerSubsonic, params url.Values) string {
+		params.Set("f", "xml") // before the mock's own f=json
+		return serve(h, params).Body.String()
+	}
+
+	is := is.New(t)
+
+	// artist counts
+	type counts struct{ albums, songs int }
+	artistCounts := map[string]counts{}
+	for _, index := range serveJSON(contr.ServeGetArtists, url.Values{}).Artists.List {
+		for _, artist := range index.Artists {
+			artistCounts[artist.Name] = counts{artist.AlbumCount, artist.SongCount}
+		}
+	}
+	is.Equal(artistCounts, map[string]counts{"Various Artists": {1, 3}, "artist-a": {2, 3}})
+
+	var variousID string
+	for _, a := range serveJSON(contr.ServeSearchThree, url.Values{"query": {"various"}}).SearchResultThree.Artists {
+		is.Equal(a.AlbumCount, 1)
+		is.Equal(a.SongCount, 3)
+		variousID = a.ID.String()
+	}
+	artist := serveJSON(contr.ServeGetArtist, url.Values{"id": {variousID}}).Artist
+	is.Equal(artist.AlbumCount, 1)
+	is.Equal(artist.SongCount, 3)
+	is.True(artist.Albums[0].IsCompilation)
+
+	getArtistXML := serveXML(contr.ServeGetArtist, url.Values{"id": {variousID}})
+	is.True(strings.Contains(getArtistXML, `albumCount="1" songCount="3"`))
+	is.True(strings.Contains(getArtistXML, `isCompilation="true"`))
+
+	// by tags and by folder agree on compilations
+	compilations := func(albums []*spec.Album) map[string]bool {
+		ret := map[string]bool{}
+		for _, album := range albums {
+			ret[album.Name+album.Title] = album.IsCompilation
+		}
+		return ret
+	}
+	listParams := url.Values{"type": {"alphabeticalByName"}}
+	exp := map[string]bool{"hits": true, "album": false, "ep": false}
+	is.Equal(compilations(serveJSON(contr.ServeGetAlbumListTwo, listParams).AlbumsTwo.List), exp)
+	is.Equal(compilations(serveJSON(contr.ServeGetAlbumList, listParams).Albums.List), exp)
+	for _, h := range []handlerSubsonic{contr.ServeGetAlbumListTwo, contr.ServeGetAlbumList} {
+		is.Equal(strings.Count(serveXML(h, url.Values{"type": {"alphabeticalByName"}}), `isCompilation="true"`), 1)
+	}
+}
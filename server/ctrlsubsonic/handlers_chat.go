@@ -0,0 +1,61 @@
+package ctrlsubsonic
+
+import (
+	"net/http"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+)
+
+func (c *Controller) ServeGetChatMessages(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	q := c.DB.
+		Preload("User").
+		Order("created_at, id")
+	if since := params.GetOrInt("since", 0); since > 0 {
+		// messages at exactly since were already seen by the client. times are
+		// stored in utc so that sqlite compares them correctly
+		q = q.Where("created_at>?", time.Unix(0, int64(since)*int64(time.Millisecond)).UTC())
+	}
+	var messages []*db.ChatMessage
+	if err := q.Find(&messages).Error; err != nil {
+		return spec.NewError(0, "error finding chat messages: %v", err)
+	}
+	sub := spec.NewResponse()
+	sub.ChatMessages = &spec.ChatMessages{
+		List: make([]*spec.ChatMessage, 0, len(messages)),
+	}
+	for _, message := range messages {
+		var username string
+		if message.User != nil {
+			username = message.User.Name
+		}
+		sub.ChatMessages.List = append(sub.ChatMessages.List, &spec.ChatMessage{
+			Username: username,
+			Time:     message.CreatedAt.UnixNano() / int64(time.Millisecond),
+			Message:  message.Message,
+		})
+	}
+	return sub
+}
+
+func (c *Controller) ServeAddChatMessage(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	text, err := params.Get("message")
+	if err != nil || text == "" {
+		return spec.NewError(10, "please provide a `message` parameter")
+	}
+	message := &db.ChatMessage{
+		UserID:  user.ID,
+		Message: text,
+		// stored to the millisecond since that's all that clients see
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if err := c.DB.AddChatMessage(message, c.ChatHistoryMax); err != nil {
+		return spec.NewError(0, "error saving chat message: %v", err)
+	}
+	return spec.NewResponse()
+}
@@ -0,0 +1,70 @@
+package ctrlsubsonic
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+)
+
+func TestChatMessages(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	contr.ChatHistoryMax = 2
+
+	admin := contr.DB.GetUserByName(mockUsername)
+	add := func(message string) int {
+		_, req := makeHTTPMock(url.Values{"message": {message}})
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, admin))
+		if resp := contr.ServeAddChatMessage(req); resp.Error != nil {
+			return resp.Error.Code
+		}
+		return 0
+	}
+	is.Equal(add(""), 10)
+	is.Equal(add("one"), 0)
+	is.Equal(add("two"), 0)
+	is.Equal(add("three"), 0)
+
+	// only the newest are kept
+	_, req := makeHTTPMock(url.Values{})
+	resp := contr.ServeGetChatMessages(req)
+	is.True(resp.Error == nil)
+	is.Equal(len(resp.ChatMessages.List), 2)
+	is.Equal(resp.ChatMessages.List[0].Message, "two")
+	is.Equal(resp.ChatMessages.List[1].Message, "three")
+	is.Equal(resp.ChatMessages.List[1].Username, mockUsername)
+	is.True(resp.ChatMessages.List[1].Time > 0)
+}
+
+func TestChatMessagesSince(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	admin := contr.DB.GetUserByName(mockUsername)
+	base := time.Date(2022, 6, 25, 12, 0, 0, 0, time.UTC)
+	for i, text := range []string{"old", "seen", "new"} {
+		message := &db.ChatMessage{
+			UserID:    admin.ID,
+			Message:   text,
+			CreatedAt: base.Add(time.Duration(i) * time.Second),
+		}
+		is.NoErr(contr.DB.AddChatMessage(message, 0))
+	}
+
+	// since is exclusive, clients pass the time of the last message they saw
+	seen := base.Add(time.Second).UnixNano() / int64(time.Millisecond)
+	_, req := makeHTTPMock(url.Values{"since": {fmt.Sprint(seen)}})
+	resp := contr.ServeGetChatMessages(req)
+	is.True(resp.Error == nil)
+	is.Equal(len(resp.ChatMessages.List), 1)
+	is.Equal(resp.ChatMessages.List[0].Message, "new")
+	is.Equal(resp.ChatMessages.List[0].Time, seen+1000)
+}
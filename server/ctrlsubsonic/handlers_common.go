@@ -2,11 +2,12 @@ package ctrlsubsonic
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"path/filepath"
+	"net/url"
+	"strings"
 	"time"
-	"unicode"
 
 	"github.com/jinzhu/gorm"
 
@@ -15,15 +16,80 @@ import (
 	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/jukebox"
+	"go.senan.xyz/gonic/locale"
+	"go.senan.xyz/gonic/notify"
 	"go.senan.xyz/gonic/scanner"
+	"go.senan.xyz/gonic/scrobble"
+	"go.senan.xyz/gonic/streamsign"
+	"go.senan.xyz/gonic/transcode"
 )
 
-func lowerUDecOrHash(in string) string {
-	lower := unicode.ToLower(rune(in[0]))
-	if !unicode.IsLetter(lower) {
-		return "#"
+// userSorter orders artists and folders for the user's locale. lists which are
+// paged are still ordered by the db, which is only roughly right outside of
+// english, since sqlite's NOCASE collation compares code points
+func userSorter(user *db.User) *locale.Sorter {
+	return locale.NewSorter(locale.Parse(user.Locale))
+}
+
+// searchTerms splits a search query into terms, one per whitespace separated
+// word. some clients search for `""` or `*` to mean everything, which gives no terms
+func searchTerms(query string) []string {
+	query = strings.Trim(strings.TrimSpace(query), `"`)
+	var terms []string
+	for _, term := range strings.Fields(query) {
+		term = strings.Trim(term, "*")
+		if term == "" {
+			continue
+		}
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// searchWhere requires every term to be found in at least one of the fields
+func searchWhere(q *gorm.DB, terms []string, fields ...string) *gorm.DB {
+	for _, term := range terms {
+		var conds []string
+		var args []interface{}
+		for _, field := range fields {
+			conds = append(conds, fmt.Sprintf("%s %s ?", field, db.Like(q)))
+			args = append(args, "%"+term+"%")
+		}
+		q = q.Where(strings.Join(conds, " OR "), args...)
+	}
+	return q
+}
+
+// searchIndexed finds the rows of kind in the db's search index with words
+// starting with every term, the best matches first. see db.HasSearch
+func searchIndexed(q *gorm.DB, terms []string, kind int, column string) *gorm.DB {
+	if len(terms) == 0 {
+		return q
+	}
+	return q.
+		Joins(db.SearchJoin(kind, column)).
+		Where("search MATCH ?", db.SearchMatch(terms)).
+		Order("search.rank")
+}
+
+// latestTime finds the most recent of times, for reporting when a response's
+// data last changed
+func latestTime(times ...time.Time) time.Time {
+	var latest time.Time
+	for _, t := range times {
+		if t.After(latest) {
+			latest = t
+		}
 	}
-	return string(lower)
+	return latest
+}
+
+func unixMilli(t time.Time) int {
+	if t.IsZero() {
+		return 0
+	}
+	return int(t.UnixNano() / int64(time.Millisecond))
 }
 
 func (c *Controller) ServeGetLicence(r *http.Request) *spec.Response {
@@ -38,6 +104,25 @@ func (c *Controller) ServePing(r *http.Request) *spec.Response {
 	return spec.NewResponse()
 }
 
+// openSubsonicExtensions lists the extensions we support. ones which depend on
+// optional features should only be listed when that feature is enabled
+func (c *Controller) openSubsonicExtensions() []*spec.OpenSubsonicExtension {
+	return []*spec.OpenSubsonicExtension{
+		{Name: "apiKeyAuthentication", Versions: []int{1}},
+		{Name: "formPost", Versions: []int{1}},
+		{Name: "transcodeOffset", Versions: []int{1}},
+		{Name: "transcodedDownload", Versions: []int{1}},
+	}
+}
+
+// ServeGetOpenSubsonicExtensions doesn't need auth, so that clients can probe
+// for features before logging in
+func (c *Controller) ServeGetOpenSubsonicExtensions(r *http.Request) *spec.Response {
+	sub := spec.NewResponse()
+	sub.OpenSubsonicExtensions = c.openSubsonicExtensions()
+	return sub
+}
+
 func (c *Controller) ServeScrobble(r *http.Request) *spec.Response {
 	user := r.Context().Value(CtxUser).(*db.User)
 	params := r.Context().Value(CtxParams).(params.Params)
@@ -55,15 +140,62 @@ func (c *Controller) ServeScrobble(r *http.Request) *spec.Response {
 	optStamp := params.GetOrTime("time", time.Now())
 	optSubmission := params.GetOrBool("submission", true)
 
-	if err := streamUpdateStats(c.DB, user.ID, track.Album.ID, optStamp); err != nil {
+	switch {
+	case c.ScrobbleFilter == nil:
+	case !optSubmission:
+		c.ScrobbleFilter.NowPlaying(user.ID, track.ID, time.Now())
+	default:
+		err := c.ScrobbleFilter.Check(user.ID, track, optStamp, time.Now())
+		if errors.Is(err, scrobble.ErrDuplicate) || errors.Is(err, scrobble.ErrNotPlayedEnough) {
+			// still a success, so that the client doesn't keep trying
+			log.Printf("not counting scrobble of track %d by user %q: %v", track.ID, user.Name, err)
+			return spec.NewResponse()
+		}
+		if err != nil {
+			return spec.NewError(0, "error checking scrobble: %v", err)
+		}
+	}
+
+	if err := streamUpdateStats(c.DB, user.ID, track, optStamp); err != nil {
 		return spec.NewError(0, "error updating stats: %v", err)
 	}
+	// read only users' plays are counted, but not sent anywhere else
+	if !user.CanWrite() {
+		return spec.NewResponse()
+	}
 
 	var scrobbleErrs multierr.Err
 	for _, scrobbler := range c.Scrobblers {
-		if err := scrobbler.Scrobble(user, track, optStamp, optSubmission); err != nil {
-			scrobbleErrs.Add(err)
+		err := scrobbler.Scrobble(user, track, optStamp, optSubmission)
+		if optSubmission && scrobble.IsLinked(scrobbler, user) {
+			c.Metrics.Scrobble(scrobbler.Name(), err)
+		}
+		if err == nil {
+			continue
+		}
+		unauthorized := errors.Is(err, scrobble.ErrUnauthorized)
+		if unauthorized {
+			c.Notifier.Publish(notify.Event{
+				Type:    notify.EventScrobblerAuth,
+				Title:   "gonic scrobbling needs relinking",
+				Message: fmt.Sprintf("scrobbling for user %q failed, they may need to link their account again: %v", user.Name, err),
+			})
+		}
+		// a submission can be sent later, but now playing is stale by then. an
+		// unauthorized one would fail until the user links their account again,
+		// so it's dropped once they're told
+		if optSubmission && unauthorized {
+			log.Printf("error scrobbling to %s, dropping: %v", scrobbler.Name(), err)
+			continue
+		}
+		if optSubmission && c.ScrobbleQueue != nil {
+			log.Printf("error scrobbling to %s, queueing to retry: %v", scrobbler.Name(), err)
+			if err := c.ScrobbleQueue.Add(scrobbler, user, track, optStamp, err); err != nil {
+				scrobbleErrs.Add(err)
+			}
+			continue
 		}
+		scrobbleErrs.Add(err)
 	}
 	if scrobbleErrs.Len() > 0 {
 		return spec.NewError(0, "error when submitting: %s", scrobbleErrs.Error())
@@ -72,53 +204,134 @@ func (c *Controller) ServeScrobble(r *http.Request) *spec.Response {
 	return spec.NewResponse()
 }
 
+// ServeGetMusicFolders lists the music folders the user can see
 func (c *Controller) ServeGetMusicFolders(r *http.Request) *spec.Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	folders := c.musicFolders(user)
 	sub := spec.NewResponse()
 	sub.MusicFolders = &spec.MusicFolders{}
-	sub.MusicFolders.List = make([]*spec.MusicFolder, len(c.MusicPaths))
-	for i, path := range c.MusicPaths {
-		sub.MusicFolders.List[i] = &spec.MusicFolder{ID: i, Name: filepath.Base(path)}
+	sub.MusicFolders.List = make([]*spec.MusicFolder, len(folders))
+	for i, folder := range folders {
+		sub.MusicFolders.List[i] = &spec.MusicFolder{ID: folder.ID, Name: folder.Name}
 	}
 	return sub
 }
 
+// ServeStartScan returns the scan status if a scan started or was already
+// running, or an error if it couldn't start. with a musicFolderId, only that
+// folder is scanned
 func (c *Controller) ServeStartScan(r *http.Request) *spec.Response {
-	go func() {
-		if _, err := c.Scanner.ScanAndClean(scanner.ScanOptions{}); err != nil {
-			log.Printf("error while scanning: %v\n", err)
+	user := r.Context().Value(CtxUser).(*db.User)
+	if !user.CanWrite() {
+		return spec.NewError(50, "user is read only")
+	}
+	params := r.Context().Value(CtxParams).(params.Params)
+	var opts scanner.ScanOptions
+	if id, err := params.GetInt("musicFolderId"); err == nil {
+		path := c.getMusicFolder(params)
+		if path == "" {
+			return spec.NewError(70, "music folder with id `%d` not found", id)
 		}
-	}()
+		opts.Dirs = []string{path}
+	}
+	err := c.Scanner.Start(opts)
+	if err != nil && !errors.Is(err, scanner.ErrAlreadyScanning) {
+		return spec.NewError(0, "couldn't start scan: %v", err)
+	}
 	return c.ServeGetScanStatus(r)
 }
 
+// ServeGetScanStatus is scanning if any of the music folders are, and has the
+// state of each of them
 func (c *Controller) ServeGetScanStatus(r *http.Request) *spec.Response {
 	var trackCount int
 	if err := c.DB.Model(db.Track{}).Count(&trackCount).Error; err != nil {
 		return spec.NewError(0, "error finding track count: %v", err)
 	}
+	leases, err := c.Scanner.ActiveLeases()
+	if err != nil {
+		return spec.NewError(0, "error finding scan leases: %v", err)
+	}
+	leaseHolders := map[string]string{}
+	for _, lease := range leases {
+		leaseHolders[lease.Dir] = lease.Holder
+	}
+	// the last scan times are kept up to date in the db, not in c.MusicFolders
+	var folders []*db.MusicFolder
+	if err := c.DB.Find(&folders).Error; err != nil {
+		return spec.NewError(0, "error finding music folders: %v", err)
+	}
+	lastScans := map[int]time.Time{}
+	for _, folder := range folders {
+		lastScans[folder.ID] = folder.LastScanAt
+	}
 
 	sub := spec.NewResponse()
 	sub.ScanStatus = &spec.ScanStatus{
 		Scanning: c.Scanner.IsScanning(),
 		Count:    trackCount,
 	}
+	for _, folder := range c.MusicFolders {
+		status := &spec.ScanStatusFolder{
+			ID:       folder.ID,
+			Name:     folder.Name,
+			Scanning: c.Scanner.IsScanningDir(folder.Path),
+		}
+		if holder, ok := leaseHolders[folder.Path]; ok {
+			status.Scanning = true
+			status.Holder = holder
+			sub.ScanStatus.Scanning = true
+			if sub.ScanStatus.Holder == "" {
+				sub.ScanStatus.Holder = holder
+			}
+		}
+		if lastScan := lastScans[folder.ID]; !lastScan.IsZero() {
+			status.LastScan = &lastScan
+		}
+		sub.ScanStatus.Folders = append(sub.ScanStatus.Folders, status)
+	}
+	return sub
+}
+
+// ServeGetLibraryStats returns the totals counted at the end of the last scan,
+// so it's cheap enough for a dashboard to poll
+func (c *Controller) ServeGetLibraryStats(r *http.Request) *spec.Response {
+	stats, err := scanner.LastLibraryStats(c.DB)
+	if err != nil {
+		return spec.NewError(0, "error getting library stats: %v", err)
+	}
+	sub := spec.NewResponse()
+	sub.LibraryStats = &spec.LibraryStats{Version: scanner.LibraryStatsVersion}
+	if stats == nil {
+		return sub
+	}
+	sub.LibraryStats = &spec.LibraryStats{
+		Version:   stats.Version,
+		Tracks:    stats.Tracks,
+		Albums:    stats.Albums,
+		Artists:   stats.Artists,
+		Genres:    stats.Genres,
+		Playlists: stats.Playlists,
+		Duration:  stats.Duration,
+		Size:      stats.Size,
+		LastScan:  &stats.ScannedAt,
+	}
 	return sub
 }
 
 func (c *Controller) ServeGetUser(r *http.Request) *spec.Response {
 	user := r.Context().Value(CtxUser).(*db.User)
-	hasLastFM := user.LastFMSession != ""
-	hasListenBrainz := user.ListenBrainzToken != ""
-
-	sub := spec.NewResponse()
-	sub.User = &spec.User{
-		Username:          user.Name,
-		AdminRole:         user.IsAdmin,
-		JukeboxRole:       c.Jukebox != nil,
-		PodcastRole:       c.Podcasts != nil,
-		ScrobblingEnabled: hasLastFM || hasListenBrainz,
-		Folder:            []int{1},
+	params := r.Context().Value(CtxParams).(params.Params)
+	if username, err := params.Get("username"); err == nil && username != user.Name {
+		if !user.IsAdmin {
+			return spec.NewError(50, "user not admin")
+		}
+		if user = c.DB.GetUserByName(username); user == nil {
+			return spec.NewError(70, "user %q not found", username)
+		}
 	}
+	sub := spec.NewResponse()
+	sub.User = c.specUser(user)
 	return sub
 }
 
@@ -144,19 +357,69 @@ func (c *Controller) ServeGetPlayQueue(r *http.Request) *spec.Response {
 	sub.PlayQueue.Changed = queue.UpdatedAt
 	sub.PlayQueue.ChangedBy = queue.ChangedBy
 	trackIDs := queue.GetItems()
-	sub.PlayQueue.List = make([]*spec.TrackChild, len(trackIDs))
-	for i, id := range trackIDs {
-		track := db.Track{}
-		c.DB.
-			Where("id=?", id).
-			Preload("Album").
-			Find(&track)
-		sub.PlayQueue.List[i] = spec.NewTCTrackByFolder(&track, track.Album)
+	tracks, err := findTracks(c.DB, trackIDs, "Album")
+	if err != nil {
+		return spec.NewError(0, "error finding tracks: %v", err)
+	}
+	// tracks outside the user's music folders are left out like deleted ones
+	roots := c.musicFolderRoots(r)
+	for id, track := range tracks {
+		if !inRoots(roots, track.Album) {
+			delete(tracks, id)
+		}
+	}
+	sub.PlayQueue.List = make([]*spec.TrackChild, 0, len(trackIDs))
+	for _, id := range trackIDs {
+		if track, ok := tracks[id]; ok {
+			sub.PlayQueue.List = append(sub.PlayQueue.List, spec.NewTCTrackByFolder(track, track.Album))
+		}
+	}
+	// the current track was deleted since the queue was saved. carry on from
+	// the next one which is left, or the one before if it was last
+	if _, ok := tracks[queue.Current]; !ok {
+		sub.PlayQueue.Current = nil
+		sub.PlayQueue.Position = 0
+		if next, ok := nextQueueTrack(trackIDs, tracks, queue.Current); ok {
+			sub.PlayQueue.Current = &specid.ID{Type: specid.Track, Value: next}
+		}
+	}
+	if err := setTrackPlays(c.DB, user.ID, sub.PlayQueue.List); err != nil {
+		return spec.NewError(0, "find track plays: %v", err)
 	}
 	return sub
 }
 
+// nextQueueTrack is the first track after current in ids which still exists,
+// or the last one before it if there are none after
+func nextQueueTrack(ids []int, tracks map[int]*db.Track, current int) (int, bool) {
+	at := -1
+	for i, id := range ids {
+		if id == current {
+			at = i
+			break
+		}
+	}
+	if at == -1 {
+		return 0, false
+	}
+	for _, id := range ids[at+1:] {
+		if _, ok := tracks[id]; ok {
+			return id, true
+		}
+	}
+	for i := at - 1; i >= 0; i-- {
+		if _, ok := tracks[ids[i]]; ok {
+			return ids[i], true
+		}
+	}
+	return 0, false
+}
+
 func (c *Controller) ServeSavePlayQueue(r *http.Request) *spec.Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	if !user.CanWrite() {
+		return spec.NewError(50, "user is read only")
+	}
 	params := r.Context().Value(CtxParams).(params.Params)
 	tracks, err := params.GetIDList("id")
 	if err != nil {
@@ -169,7 +432,6 @@ func (c *Controller) ServeSavePlayQueue(r *http.Request) *spec.Response {
 			trackIDs = append(trackIDs, id.Value)
 		}
 	}
-	user := r.Context().Value(CtxUser).(*db.User)
 	queue := &db.PlayQueue{UserID: user.ID}
 	c.DB.Where(queue).First(queue)
 	queue.Current = params.GetOrID("current", specid.ID{}).Value
@@ -182,6 +444,7 @@ func (c *Controller) ServeSavePlayQueue(r *http.Request) *spec.Response {
 
 func (c *Controller) ServeGetSong(r *http.Request) *spec.Response {
 	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
 	id, err := params.GetID("id")
 	if err != nil {
 		return spec.NewError(10, "provide an `id` parameter")
@@ -196,13 +459,89 @@ func (c *Controller) ServeGetSong(r *http.Request) *spec.Response {
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return spec.NewError(10, "couldn't find a track with that id")
 	}
+	if !c.canSeeRoot(r, track.Album.RootDir) {
+		return spec.NewError(50, "user not allowed to access this music folder")
+	}
 	sub := spec.NewResponse()
 	sub.Track = spec.NewTrackByTags(track, track.Album)
+	changed := latestTime(track.UpdatedAt, track.Album.UpdatedAt)
+	sub.Track.LastModified = unixMilli(changed)
+	// the user's plays are in it too
+	sub.LastModified = latestTime(changed, user.AnnotatedAt)
+	if err := setTrackPlays(c.DB, user.ID, []*spec.TrackChild{sub.Track}); err != nil {
+		return spec.NewError(0, "find track plays: %v", err)
+	}
+	return sub
+}
+
+const (
+	signedStreamTTL    = 6 * time.Hour
+	signedStreamMaxTTL = 7 * 24 * time.Hour
+)
+
+// signedStreamURL makes a stream URL for id which works without credentials
+// until it expires, or the user rotates their stream key. if bindIP is set, it
+// only works from the address of r
+func (c *Controller) signedStreamURL(r *http.Request, user *db.User, id specid.ID, ttl time.Duration, bindIP bool) (string, time.Time, error) {
+	return c.signedURL(r, "/rest/stream", nil, user, id, ttl, bindIP)
+}
+
+// signedURL is like signedStreamURL, but for any of the routes which accept
+// signed urls. extra params aren't signed
+func (c *Controller) signedURL(r *http.Request, route string, extra url.Values, user *db.User, id specid.ID, ttl time.Duration, bindIP bool) (string, time.Time, error) {
+	if user.StreamKey == "" {
+		if err := c.DB.RotateStreamKey(user); err != nil {
+			return "", time.Time{}, fmt.Errorf("create stream key: %w", err)
+		}
+	}
+	claims := streamsign.Claims{
+		ID:      id.String(),
+		UserID:  user.ID,
+		Expires: time.Now().Add(ttl).Truncate(time.Second),
+	}
+	if bindIP {
+		if claims.IP = c.ClientIP(r); claims.IP == "" {
+			return "", time.Time{}, fmt.Errorf("no client address to bind to")
+		}
+	}
+	query := c.StreamSigner.Sign(user.StreamKey, claims)
+	// the client isn't signed, it only picks the user's transcode preference
+	if client, _ := r.Context().Value(CtxParams).(params.Params).Get("c"); client != "" {
+		query.Set("c", client)
+	}
+	for key, values := range extra {
+		query[key] = values
+	}
+	signedURL := c.BaseURL(r) + c.Path(route) + "?" + query.Encode()
+	return signedURL, claims.Expires, nil
+}
+
+func (c *Controller) ServeGetSignedStreamURL(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := params.GetID("id")
+	if err != nil || (id.Type != specid.Track && id.Type != specid.PodcastEpisode) {
+		return spec.NewError(10, "please provide a track or podcast episode `id` parameter")
+	}
+	ttl := time.Duration(params.GetOrInt("expires", int(signedStreamTTL.Seconds()))) * time.Second
+	if ttl <= 0 || ttl > signedStreamMaxTTL {
+		return spec.NewError(10, "please provide an `expires` between 1 and %d seconds", int(signedStreamMaxTTL.Seconds()))
+	}
+	streamURL, expires, err := c.signedStreamURL(r, user, id, ttl, params.GetOrBool("bindIP", false))
+	if err != nil {
+		return spec.NewError(0, "signing url: %v", err)
+	}
+	sub := spec.NewResponse()
+	sub.SignedStreamURL = &spec.SignedStreamURL{
+		URL:     streamURL,
+		Expires: expires,
+	}
 	return sub
 }
 
 func (c *Controller) ServeGetRandomSongs(r *http.Request) *spec.Response {
 	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
 	var tracks []*db.Track
 	q := c.DB.DB.
 		Limit(params.GetOrInt("size", 10)).
@@ -220,8 +559,12 @@ func (c *Controller) ServeGetRandomSongs(r *http.Request) *spec.Response {
 		q = q.Joins("JOIN track_genres ON track_genres.track_id=tracks.id")
 		q = q.Joins("JOIN genres ON genres.id=track_genres.genre_id AND genres.name=?", genre)
 	}
-	if m := c.getMusicFolder(params); m != "" {
-		q = q.Where("albums.root_dir=?", m)
+	if roots := c.musicFolderRoots(r); roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
+	}
+	// minDr is a gonic extension. tracks without a DR of their own go by their album's
+	if dr, err := params.GetInt("minDr"); err == nil {
+		q = q.Where("COALESCE(tracks.tag_dynamic_range, albums.dynamic_range) >= ?", dr)
 	}
 	if err := q.Find(&tracks).Error; err != nil {
 		return spec.NewError(10, "get random songs: %v", err)
@@ -232,11 +575,43 @@ func (c *Controller) ServeGetRandomSongs(r *http.Request) *spec.Response {
 	for i, track := range tracks {
 		sub.RandomTracks.List[i] = spec.NewTrackByTags(track, track.Album)
 	}
+	if err := setTrackPlays(c.DB, user.ID, sub.RandomTracks.List); err != nil {
+		return spec.NewError(0, "find track plays: %v", err)
+	}
 	return sub
 }
 
+// jukeboxReplayGainModes are the jukebox's replaygain modes by the names
+// clients use for them
+var jukeboxReplayGainModes = map[string]transcode.ReplayGainMode{
+	"off":   transcode.ReplayGainOff,
+	"track": transcode.ReplayGainTrack,
+	"album": transcode.ReplayGainAlbum,
+}
+
+func jukeboxReplayGainName(mode transcode.ReplayGainMode) string {
+	if mode == transcode.ReplayGainOff {
+		return "off"
+	}
+	return string(mode)
+}
+
+func validRepeatMode(mode jukebox.RepeatMode) bool {
+	for _, m := range jukebox.RepeatModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Controller) ServeJukebox(r *http.Request) *spec.Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	if !user.CanWrite() {
+		return spec.NewError(50, "user is read only")
+	}
 	params := r.Context().Value(CtxParams).(params.Params)
+	roots := c.musicFolderRoots(r)
 	getTracks := func() []*db.Track {
 		var tracks []*db.Track
 		ids, err := params.GetIDList("id")
@@ -246,7 +621,7 @@ func (c *Controller) ServeJukebox(r *http.Request) *spec.Response {
 		for _, id := range ids {
 			track := &db.Track{}
 			c.DB.Preload("Album").First(track, id.Value)
-			if track.ID != 0 {
+			if track.ID != 0 && inRoots(roots, track.Album) {
 				tracks = append(tracks, track)
 			}
 		}
@@ -259,13 +634,26 @@ func (c *Controller) ServeJukebox(r *http.Request) *spec.Response {
 			Playing:      status.Playing,
 			Gain:         status.Gain,
 			Position:     status.Position,
+			Shuffle:      status.Shuffle,
+			Repeat:       string(status.Repeat),
+			Ended:        status.Ended,
+			Stalled:      status.Stalled,
+			Crossfade:    status.Crossfade,
+			Device:       status.Device,
+			Error:        status.Error,
+			ReplayGain:   jukeboxReplayGainName(status.ReplayGain),
 		}
 	}
 	getStatusTracks := func() []*spec.TrackChild {
-		tracks := c.Jukebox.GetTracks()
-		ret := make([]*spec.TrackChild, len(tracks))
-		for i, track := range tracks {
-			ret[i] = spec.NewTrackByTags(track, track.Album)
+		items := c.Jukebox.GetItems()
+		ret := make([]*spec.TrackChild, len(items))
+		for i, item := range items {
+			ret[i] = spec.NewTrackByTags(item.Track, item.Track.Album)
+			ret[i].JukeboxError = item.Error
+			if item.ReplayGain != 0 {
+				gain := item.ReplayGain
+				ret[i].JukeboxReplayGain = &gain
+			}
 		}
 		return ret
 	}
@@ -282,6 +670,22 @@ func (c *Controller) ServeJukebox(r *http.Request) *spec.Response {
 			return spec.NewError(10, "please provide an id for remove actions")
 		}
 		c.Jukebox.RemoveTrack(index)
+	case "insert":
+		index, err := params.GetInt("index")
+		if err != nil {
+			return spec.NewError(10, "please provide an index for insert actions")
+		}
+		c.Jukebox.InsertTracks(index, getTracks())
+	case "move":
+		index, err := params.GetInt("index")
+		if err != nil {
+			return spec.NewError(10, "please provide an index for move actions")
+		}
+		to, err := params.GetInt("to")
+		if err != nil {
+			return spec.NewError(10, "please provide a `to` index for move actions")
+		}
+		c.Jukebox.MoveTrack(index, to)
 	case "stop":
 		c.Jukebox.Stop()
 	case "start":
@@ -293,6 +697,37 @@ func (c *Controller) ServeJukebox(r *http.Request) *spec.Response {
 		}
 		offset, _ := params.GetInt("offset")
 		c.Jukebox.Skip(index, offset)
+	case "shuffle":
+		shuffle, err := params.GetBool("shuffle")
+		if err != nil {
+			return spec.NewError(10, "please provide a `shuffle` parameter for shuffle actions")
+		}
+		c.Jukebox.SetShuffle(shuffle)
+	case "repeat":
+		mode, err := params.Get("mode")
+		if err != nil || !validRepeatMode(jukebox.RepeatMode(mode)) {
+			return spec.NewError(10, "please provide a `mode` of off, one, or all for repeat actions")
+		}
+		c.Jukebox.SetRepeat(jukebox.RepeatMode(mode))
+	case "crossfade":
+		seconds, err := params.GetInt("seconds")
+		if err != nil || seconds < 0 {
+			return spec.NewError(10, "please provide a `seconds` parameter for crossfade actions, 0 turns it off")
+		}
+		c.Jukebox.SetCrossfade(time.Duration(seconds) * time.Second)
+	case "setGain":
+		gain, err := params.GetFloat("gain")
+		if err != nil || gain < 0 || gain > 1 {
+			return spec.NewError(10, "please provide a `gain` from 0 to 1 for setGain actions")
+		}
+		c.Jukebox.SetGain(gain)
+	case "replayGain":
+		mode, err := params.Get("mode")
+		replayGain, ok := jukeboxReplayGainModes[mode]
+		if err != nil || !ok {
+			return spec.NewError(10, "please provide a `mode` of off, track, or album for replayGain actions")
+		}
+		c.Jukebox.SetReplayGainMode(replayGain)
 	case "get":
 		sub := spec.NewResponse()
 		sub.JukeboxPlaylist = &spec.JukeboxPlaylist{
@@ -0,0 +1,337 @@
+package ctrlsubsonic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/scrobble"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+)
+
+func TestGetOpenSubsonicExtensions(t *testing.T) {
+	t.Parallel()
+	contr := makeController(t)
+
+	runQueryCases(t, contr, contr.ServeGetOpenSubsonicExtensions, []*queryCase{
+		{url.Values{}, "no_args", false},
+	})
+}
+
+type failingScrobbler struct {
+	submissions []bool
+	// err is what the scrobbles fail with, offline if it's nil
+	err error
+}
+
+func (s *failingScrobbler) Name() string { return "failing" }
+
+func (s *failingScrobbler) Scrobble(_ *db.User, _ *db.Track, _ time.Time, submission bool) error {
+	s.submissions = append(s.submissions, submission)
+	if s.err != nil {
+		return s.err
+	}
+	return errors.New("offline")
+}
+
+func TestScrobbleQueue(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	scrobbler := &failingScrobbler{}
+	contr.Scrobblers = []scrobble.Scrobbler{scrobbler}
+	contr.ScrobbleQueue = scrobble.NewQueue(contr.DB, contr.Scrobblers)
+
+	user := contr.DB.GetUserByName(mockUsername)
+	track := &db.Track{}
+	is.NoErr(contr.DB.First(track).Error)
+	serve := func(submission string) *spec.Response {
+		_, req := makeHTTPMock(url.Values{"id": {"tr-" + strconv.Itoa(track.ID)}, "submission": {submission}})
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, user))
+		return contr.ServeScrobble(req)
+	}
+
+	// now playing is stale by the time it could be retried
+	resp := serve("false")
+	is.True(resp.Error != nil)
+	pending, err := contr.ScrobbleQueue.Pending(10)
+	is.NoErr(err)
+	is.Equal(len(pending), 0)
+
+	// a submission is queued, and the client doesn't need to know
+	resp = serve("true")
+	is.True(resp.Error == nil)
+	pending, err = contr.ScrobbleQueue.Pending(10)
+	is.NoErr(err)
+	is.Equal(len(pending), 1)
+	is.Equal(pending[0].TrackID, track.ID)
+	is.Equal(pending[0].Scrobbler, "failing")
+
+	is.Equal(scrobbler.submissions, []bool{false, true})
+
+	// one which is unauthorized would keep failing, so it isn't queued
+	scrobbler.err = fmt.Errorf("failing: %w", scrobble.ErrUnauthorized)
+	resp = serve("true")
+	is.True(resp.Error == nil)
+	pending, err = contr.ScrobbleQueue.Pending(10)
+	is.NoErr(err)
+	is.Equal(len(pending), 1)
+}
+
+type recordingScrobbler struct {
+	submissions int
+}
+
+func (s *recordingScrobbler) Name() string { return "recording" }
+
+func (s *recordingScrobbler) Scrobble(_ *db.User, _ *db.Track, _ time.Time, submission bool) error {
+	if submission {
+		s.submissions++
+	}
+	return nil
+}
+
+func TestScrobbleFilter(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	scrobbler := &recordingScrobbler{}
+	contr.Scrobblers = []scrobble.Scrobbler{scrobbler}
+	contr.ScrobbleFilter = scrobble.NewFilter(contr.DB)
+	is.NoErr(contr.DB.SetSetting(scrobble.SettingDuplicateWindow, "60"))
+
+	user := contr.DB.GetUserByName(mockUsername)
+	track := &db.Track{}
+	is.NoErr(contr.DB.Preload("Album").First(track).Error)
+	stamp := time.Now()
+	serve := func(stamp time.Time) *spec.Response {
+		query := url.Values{"id": {"tr-" + strconv.Itoa(track.ID)}, "time": {strconv.FormatInt(stamp.UnixNano()/1e6, 10)}}
+		_, req := makeHTTPMock(query)
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, user))
+		return contr.ServeScrobble(req)
+	}
+	playCount := func() int {
+		var play db.Play
+		is.NoErr(contr.DB.Where("user_id=? AND album_id=?", user.ID, track.AlbumID).First(&play).Error)
+		return play.Count
+	}
+
+	is.True(serve(stamp).Error == nil)
+	is.True(serve(stamp.Add(2*time.Second)).Error == nil) // the client submitted twice
+	is.Equal(scrobbler.submissions, 1)
+	is.Equal(playCount(), 1)
+
+	is.True(serve(stamp.Add(5*time.Minute)).Error == nil)
+	is.Equal(scrobbler.submissions, 2)
+	is.Equal(playCount(), 2)
+}
+
+func TestTrackPlays(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	user := contr.DB.GetUserByName(mockUsername)
+	var first, second db.Track
+	is.NoErr(contr.DB.Order("id").First(&first).Error)
+	is.NoErr(contr.DB.Where("album_id<>?", first.AlbumID).Order("id").First(&second).Error)
+	withUser := func(query url.Values) *http.Request {
+		_, req := makeHTTPMock(query)
+		return req.WithContext(context.WithValue(req.Context(), CtxUser, user))
+	}
+	scrobble := func(track db.Track, stamp time.Time) {
+		query := url.Values{"id": {"tr-" + strconv.Itoa(track.ID)}, "time": {strconv.FormatInt(stamp.UnixNano()/1e6, 10)}}
+		is.True(contr.ServeScrobble(withUser(query)).Error == nil)
+	}
+
+	// never played tracks have no count or time
+	resp := contr.ServeGetSong(withUser(url.Values{"id": {"tr-" + strconv.Itoa(first.ID)}}))
+	is.True(resp.Error == nil)
+	is.Equal(resp.Track.PlayCount, 0)
+	is.True(resp.Track.Played == nil)
+
+	stamp := time.Date(2022, 8, 8, 10, 0, 0, 0, time.UTC)
+	scrobble(first, stamp)
+	scrobble(second, stamp.Add(time.Hour))
+	scrobble(first, stamp.Add(2*time.Hour))
+
+	resp = contr.ServeGetSong(withUser(url.Values{"id": {"tr-" + strconv.Itoa(first.ID)}}))
+	is.True(resp.Error == nil)
+	is.Equal(resp.Track.PlayCount, 2)
+	is.True(resp.Track.Played != nil)
+	is.True(resp.Track.Played.Equal(stamp.Add(2 * time.Hour)))
+
+	// the album with the track played last comes first
+	resp = contr.ServeGetAlbumListTwo(withUser(url.Values{"type": {"recent"}}))
+	is.True(resp.Error == nil)
+	is.Equal(len(resp.AlbumsTwo.List), 2)
+	is.Equal(resp.AlbumsTwo.List[0].ID.Value, first.AlbumID)
+	is.Equal(resp.AlbumsTwo.List[1].ID.Value, second.AlbumID)
+
+	scrobble(second, stamp.Add(3*time.Hour))
+	resp = contr.ServeGetAlbumListTwo(withUser(url.Values{"type": {"recent"}}))
+	is.True(resp.Error == nil)
+	is.Equal(resp.AlbumsTwo.List[0].ID.Value, second.AlbumID)
+}
+
+func TestPlayQueueQueries(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	user := contr.DB.GetUserByName(mockUsername)
+	var album db.Album
+	is.NoErr(contr.DB.Where("tag_artist_id IS NOT NULL").First(&album).Error)
+	var ids []int
+	is.NoErr(contr.DB.Transaction(func(tx *gorm.DB) error {
+		for i := 0; i < 1000; i++ {
+			track := &db.Track{AlbumID: album.ID, ArtistID: album.TagArtistID, Filename: fmt.Sprintf("queued-%d.flac", i)}
+			if err := tx.Create(track).Error; err != nil {
+				return err
+			}
+			ids = append(ids, track.ID)
+		}
+		return nil
+	}))
+	withUser := func(query url.Values) *http.Request {
+		_, req := makeHTTPMock(query)
+		return req.WithContext(context.WithValue(req.Context(), CtxUser, user))
+	}
+
+	query := url.Values{"current": {fmt.Sprintf("tr-%d", ids[500])}, "position": {"1234"}}
+	for _, id := range ids {
+		query.Add("id", fmt.Sprintf("tr-%d", id))
+	}
+	is.True(contr.ServeSavePlayQueue(withUser(query)).Error == nil)
+
+	var queries int
+	count := func(*gorm.Scope) { queries++ }
+	contr.DB.Callback().Query().After("gorm:query").Register("test:count_queries", count)
+	contr.DB.Callback().RowQuery().After("gorm:row_query").Register("test:count_queries", count)
+
+	// the same few queries, however long the queue is
+	resp := contr.ServeGetPlayQueue(withUser(url.Values{}))
+	is.True(resp.Error == nil)
+	is.True(queries <= 8)
+	is.Equal(len(resp.PlayQueue.List), 1000)
+	for i, child := range resp.PlayQueue.List {
+		is.Equal(child.ID.Value, ids[i])
+	}
+	is.Equal(resp.PlayQueue.Current.Value, ids[500])
+	is.Equal(resp.PlayQueue.Position, 1234)
+
+	// deleted tracks are dropped, and the queue carries on from the next one
+	is.NoErr(contr.DB.Where("id IN (?)", []int{ids[10], ids[500], ids[501]}).Delete(&db.Track{}).Error)
+	resp = contr.ServeGetPlayQueue(withUser(url.Values{}))
+	is.True(resp.Error == nil)
+	is.Equal(len(resp.PlayQueue.List), 997)
+	is.Equal(resp.PlayQueue.List[10].ID.Value, ids[11])
+	is.Equal(resp.PlayQueue.Current.Value, ids[502])
+	is.Equal(resp.PlayQueue.Position, 0)
+
+	// or the one before, if it was last
+	is.NoErr(contr.DB.Where("id IN (?)", ids[502:]).Delete(&db.Track{}).Error)
+	resp = contr.ServeGetPlayQueue(withUser(url.Values{}))
+	is.True(resp.Error == nil)
+	is.Equal(len(resp.PlayQueue.List), 499)
+	is.Equal(resp.PlayQueue.Current.Value, ids[499])
+}
+
+func TestMusicFolderAccess(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeControllerRoots(t, []string{"m-0", "m-1"})
+	allowed, forbidden := contr.MusicFolders[0], contr.MusicFolders[1]
+
+	kid := &db.User{Name: "kid", Password: "kid"}
+	is.NoErr(contr.DB.Create(kid).Error)
+	is.NoErr(contr.DB.SetUserMusicFolders(kid.ID, []int{allowed.ID}))
+	withUser := func(user *db.User, query url.Values) *http.Request {
+		_, req := makeHTTPMock(query)
+		return req.WithContext(context.WithValue(req.Context(), CtxUser, user))
+	}
+	var allowedAlbums int
+	is.NoErr(contr.DB.Model(db.Album{}).Where("root_dir=? AND tag_artist_id IS NOT NULL", allowed.Path).Count(&allowedAlbums).Error)
+	var forbiddenTrack db.Track
+	is.NoErr(contr.DB.
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Where("albums.root_dir=?", forbidden.Path).
+		First(&forbiddenTrack).
+		Error)
+	forbiddenID := url.Values{"id": {"tr-" + strconv.Itoa(forbiddenTrack.ID)}}
+
+	resp := contr.ServeGetMusicFolders(withUser(kid, url.Values{}))
+	is.Equal(len(resp.MusicFolders.List), 1)
+	is.Equal(resp.MusicFolders.List[0].ID, allowed.ID)
+	resp = contr.ServeGetUser(withUser(kid, url.Values{}))
+	is.Equal(resp.User.Folder, []int{allowed.ID})
+
+	// only the granted folder is listed, even if another is asked for
+	albums := url.Values{"type": {"alphabeticalByName"}, "size": {"500"}}
+	resp = contr.ServeGetAlbumListTwo(withUser(kid, albums))
+	is.True(resp.Error == nil)
+	is.Equal(len(resp.AlbumsTwo.List), allowedAlbums)
+	albums.Set("musicFolderId", strconv.Itoa(forbidden.ID))
+	resp = contr.ServeGetAlbumListTwo(withUser(kid, albums))
+	is.True(resp.Error == nil)
+	is.Equal(len(resp.AlbumsTwo.List), 0)
+
+	// even by id
+	resp = contr.ServeGetSong(withUser(kid, forbiddenID))
+	is.Equal(resp.Error.Code, 50)
+	resp = contr.ServeStream(httptest.NewRecorder(), withUser(kid, forbiddenID))
+	is.Equal(resp.Error.Code, 50)
+	forbiddenAlbum := url.Values{"id": {"al-" + strconv.Itoa(forbiddenTrack.AlbumID)}}
+	resp = contr.ServeGetCoverArt(httptest.NewRecorder(), withUser(kid, forbiddenAlbum))
+	is.Equal(resp.Error.Code, 50)
+
+	// or in a playlist
+	var allowedTrack db.Track
+	is.NoErr(contr.DB.
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Where("albums.root_dir=?", allowed.Path).
+		First(&allowedTrack).
+		Error)
+	playlist := &db.Playlist{UserID: kid.ID, Name: "mixed"}
+	playlist.SetItems([]int{forbiddenTrack.ID, allowedTrack.ID})
+	is.NoErr(contr.DB.Create(playlist).Error)
+	resp = contr.ServeGetPlaylist(withUser(kid, url.Values{"id": {strconv.Itoa(playlist.ID)}}))
+	is.True(resp.Error == nil)
+	is.Equal(len(resp.Playlist.List), 1)
+	is.Equal(resp.Playlist.List[0].ID.Value, allowedTrack.ID)
+	is.Equal(resp.Playlist.SongCount, 1)
+
+	// or the play queue and bookmarks
+	queue := &db.PlayQueue{UserID: kid.ID, Current: forbiddenTrack.ID}
+	queue.SetItems([]int{forbiddenTrack.ID, allowedTrack.ID})
+	is.NoErr(contr.DB.Create(queue).Error)
+	resp = contr.ServeGetPlayQueue(withUser(kid, url.Values{}))
+	is.True(resp.Error == nil)
+	is.Equal(len(resp.PlayQueue.List), 1)
+	is.Equal(resp.PlayQueue.List[0].ID.Value, allowedTrack.ID)
+	is.Equal(resp.PlayQueue.Current.Value, allowedTrack.ID)
+	for _, track := range []db.Track{forbiddenTrack, allowedTrack} {
+		is.NoErr(contr.DB.Create(&db.Bookmark{UserID: kid.ID, EntryIDType: string(specid.Track), EntryID: track.ID}).Error)
+	}
+	resp = contr.ServeGetBookmarks(withUser(kid, url.Values{}))
+	is.Equal(len(resp.Bookmarks.List), 1)
+	is.Equal(resp.Bookmarks.List[0].Entries[0].ID.Value, allowedTrack.ID)
+
+	// users without any grants can see everything
+	admin := contr.DB.GetUserByName(mockUsername)
+	resp = contr.ServeGetMusicFolders(withUser(admin, url.Values{}))
+	is.Equal(len(resp.MusicFolders.List), 2)
+	resp = contr.ServeGetSong(withUser(admin, forbiddenID))
+	is.True(resp.Error == nil)
+}
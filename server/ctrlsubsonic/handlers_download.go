@@ -0,0 +1,468 @@
+package ctrlsubsonic
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+	"go.senan.xyz/gonic/transcode"
+)
+
+// downloadFile is a file to add to a zip download, at name inside the archive.
+// tracks are transcoded with profile if it's set
+type downloadFile struct {
+	absPath string
+	name    string
+	track   *db.Track
+	profile *transcode.Profile
+}
+
+// downloadNameMax is the most bytes of a name in an archive, or of a
+// download's filename. most filesystems can't have names longer than 255
+// bytes, which leaves room for a " (2)" when names have to be made unique
+const downloadNameMax = 240
+
+// downloadSafeName makes a tag usable as a single path element in an archive
+func downloadSafeName(name, or string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_", "\x00", "").Replace(strings.TrimSpace(name))
+	if name == "" || name == "." || name == ".." {
+		return or
+	}
+	return downloadTruncate(name, downloadNameMax)
+}
+
+// downloadTruncate shortens name to at most max bytes, without splitting a
+// character, and keeps its extension
+func downloadTruncate(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	ext := path.Ext(name)
+	if len(ext) > max/2 || strings.Contains(ext, " ") {
+		// a dot in a long title, not an extension
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	end := max - len(ext)
+	for end > 0 && !utf8.RuneStart(base[end]) {
+		end--
+	}
+	return strings.TrimRight(base[:end], " .") + ext
+}
+
+// downloadUniqueName adds a number to name if it's already taken, since
+// truncated names, or albums with the same name, can collide
+func downloadUniqueName(taken map[string]struct{}, name string) string {
+	unique := name
+	for i := 2; ; i++ {
+		if _, ok := taken[unique]; !ok {
+			break
+		}
+		dir, file := path.Split(name)
+		ext := path.Ext(file)
+		unique = fmt.Sprintf("%s%s (%d)%s", dir, strings.TrimSuffix(file, ext), i, ext)
+	}
+	taken[unique] = struct{}{}
+	return unique
+}
+
+// downloadAlbumDir is the Artist/Album dir of an album inside an archive
+func downloadAlbumDir(album *db.Album) string {
+	var artist string
+	if album.TagArtist != nil {
+		artist = album.TagArtist.Name
+	}
+	title := album.TagTitle
+	if title == "" {
+		title = album.RightPath
+	}
+	return path.Join(
+		downloadSafeName(artist, "Unknown Artist"),
+		downloadSafeName(title, "Unknown Album"),
+	)
+}
+
+// downloadFiles lays out tracks as Artist/Album/Track.ext, with each album's
+// cover alongside its tracks. tracks must have their album and its artist preloaded
+func downloadFiles(dbc *db.DB, fetchedCoverPath string, tracks []*db.Track) []downloadFile {
+	var files []downloadFile
+	seen := map[string]struct{}{}
+	names := map[string]struct{}{}
+	dirs := map[string]struct{}{}
+	add := func(absPath, name string, track *db.Track) {
+		// playlists can have the same track more than once
+		if _, ok := seen[absPath]; ok {
+			return
+		}
+		seen[absPath] = struct{}{}
+		files = append(files, downloadFile{absPath: absPath, name: downloadUniqueName(names, name), track: track})
+	}
+	for _, track := range tracks {
+		if track.Album == nil {
+			continue
+		}
+		dir := downloadAlbumDir(track.Album)
+		if _, ok := dirs[dir]; !ok {
+			dirs[dir] = struct{}{}
+			if coverPath, err := coverGetPathAlbum(dbc, fetchedCoverPath, track.Album.ID); err == nil {
+				add(coverPath, path.Join(dir, "cover"+path.Ext(coverPath)), nil)
+			}
+		}
+		add(track.AbsPath(), path.Join(dir, downloadSafeName(track.Filename, "track")), track)
+	}
+	return files
+}
+
+// downloadWithSuffix replaces the extension of name with suffix's
+func downloadWithSuffix(name, suffix string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + "." + suffix
+}
+
+// downloadDecide picks the profile to transcode file with, or nil to send it as
+// it is. unlike streams, downloads are raw unless a format or maxBitRate is asked for
+func downloadDecide(rules []*db.RawRule, file db.AudioFile, format string, maxBitRate int) (*transcode.Profile, error) {
+	if format == "" && maxBitRate <= 0 {
+		return nil, nil
+	}
+	decision, err := streamDecide(rules, streamRelPath(file), file.AudioBitrate(), nil, format, maxBitRate)
+	if err != nil {
+		return nil, err
+	}
+	return decision.profile, nil
+}
+
+// downloadSetProfiles decides how each track in files is transcoded, and names
+// it with its new extension
+func downloadSetProfiles(files []downloadFile, rules []*db.RawRule, format string, maxBitRate int) {
+	names := map[string]struct{}{}
+	for i, file := range files {
+		if file.track != nil {
+			profile, err := downloadDecide(rules, file.track, format, maxBitRate)
+			if err != nil {
+				log.Printf("sending %q in download as it is: %v", file.absPath, err)
+			}
+			if profile != nil {
+				files[i].profile = profile
+				file.name = downloadWithSuffix(file.name, profile.Suffix())
+			}
+		}
+		files[i].name = downloadUniqueName(names, file.name)
+	}
+}
+
+// downloadTracksQuery finds tracks in the music folders with roots, or in any
+// if it's nil
+func downloadTracksQuery(dbc *db.DB, roots []string) *gorm.DB {
+	q := dbc.
+		Select("tracks.*").
+		Joins("JOIN albums ON albums.id=tracks.album_id").
+		Preload("Album").
+		Preload("Album.TagArtist")
+	if roots != nil {
+		q = q.Where("albums.root_dir IN (?)", roots)
+	}
+	return q
+}
+
+func downloadAlbum(dbc *db.DB, fetchedCoverPath string, roots []string, id int) ([]downloadFile, string, error) {
+	var tracks []*db.Track
+	err := downloadTracksQuery(dbc, roots).
+		Where("tracks.album_id=?", id).
+		Order("tracks.tag_disc_number, tracks.tag_track_number, tracks.filename").
+		Find(&tracks).
+		Error
+	if err != nil {
+		return nil, "", fmt.Errorf("find tracks: %w", err)
+	}
+	if len(tracks) == 0 {
+		return nil, "", errors.New("album has no tracks")
+	}
+	name := strings.Replace(downloadAlbumDir(tracks[0].Album), "/", " - ", 1)
+	return downloadFiles(dbc, fetchedCoverPath, tracks), name, nil
+}
+
+func downloadArtist(dbc *db.DB, fetchedCoverPath string, roots []string, id int) ([]downloadFile, string, error) {
+	var tracks []*db.Track
+	err := downloadTracksQuery(dbc, roots).
+		Where("albums.tag_artist_id=?", id).
+		Order("albums.tag_year, albums.tag_title, albums.id, tracks.tag_disc_number, tracks.tag_track_number, tracks.filename").
+		Find(&tracks).
+		Error
+	if err != nil {
+		return nil, "", fmt.Errorf("find tracks: %w", err)
+	}
+	if len(tracks) == 0 {
+		return nil, "", errors.New("artist has no tracks")
+	}
+	name := downloadSafeName(tracks[0].Album.TagArtist.Name, "Unknown Artist")
+	return downloadFiles(dbc, fetchedCoverPath, tracks), name, nil
+}
+
+func downloadPlaylist(dbc *db.DB, fetchedCoverPath string, roots []string, user *db.User, id int) ([]downloadFile, string, error) {
+	var playlist db.Playlist
+	if err := dbc.First(&playlist, id).Error; err != nil {
+		return nil, "", fmt.Errorf("find playlist: %w", err)
+	}
+	if playlist.UserID != user.ID && !playlist.IsPublic {
+		return nil, "", errors.New("playlist is private")
+	}
+	trackIDs := playlist.GetItems()
+	var found []*db.Track
+	if err := downloadTracksQuery(dbc, roots).Where("tracks.id IN (?)", trackIDs).Find(&found).Error; err != nil {
+		return nil, "", fmt.Errorf("find tracks: %w", err)
+	}
+	byID := make(map[int]*db.Track, len(found))
+	for _, track := range found {
+		byID[track.ID] = track
+	}
+	tracks := make([]*db.Track, 0, len(trackIDs))
+	for _, id := range trackIDs {
+		if track, ok := byID[id]; ok {
+			tracks = append(tracks, track)
+		}
+	}
+	return downloadFiles(dbc, fetchedCoverPath, tracks), downloadSafeName(playlist.Name, "playlist"), nil
+}
+
+// downloadWriteZip streams files into a zip without compression, since audio
+// and images are already compressed. files which have gone missing since they
+// were found are skipped, and tracks which can't be transcoded are added as
+// they are. the response has already started by the time one fails to read,
+// so that can only be logged
+func downloadWriteZip(ctx context.Context, transcoder transcode.Transcoder, w io.Writer, files []downloadFile) error {
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		if err := downloadWriteZipFile(ctx, transcoder, zw, file); err != nil {
+			return fmt.Errorf("add %q: %w", file.name, err)
+		}
+	}
+	return zw.Close()
+}
+
+func downloadWriteZipFile(ctx context.Context, transcoder transcode.Transcoder, zw *zip.Writer, file downloadFile) error {
+	// open before adding the entry so that a missing file leaves nothing behind
+	f, err := os.Open(file.absPath)
+	if err != nil {
+		log.Printf("skipping %q in download: %v", file.absPath, err)
+		return nil
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil || !stat.Mode().IsRegular() {
+		log.Printf("skipping %q in download: not a regular file", file.absPath)
+		return nil
+	}
+	header := &zip.FileHeader{
+		Name:     file.name,
+		Method:   zip.Store,
+		Modified: stat.ModTime(),
+	}
+	if file.profile != nil {
+		ok, err := downloadWriteZipTranscoded(ctx, transcoder, zw, header, file)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		header.Name = downloadWithSuffix(file.name, strings.TrimPrefix(path.Ext(file.absPath), "."))
+	}
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return fmt.Errorf("create entry: %w", err)
+	}
+	if _, err := io.Copy(entry, f); err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+	return nil
+}
+
+// downloadWriteZipTranscoded adds the transcoded track to the zip. if it can't
+// be transcoded, false is returned for the caller to add the file as it is
+// instead
+func downloadWriteZipTranscoded(ctx context.Context, transcoder transcode.Transcoder, zw *zip.Writer, header *zip.FileHeader, file downloadFile) (bool, error) {
+	tmp, err := downloadTranscodeTemp(ctx, transcoder, *file.profile, file.absPath)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		if !errors.Is(err, transcode.ErrBusy) {
+			log.Printf("adding %q to download as it is: %v", file.absPath, err)
+		}
+		return false, nil
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return false, fmt.Errorf("create entry: %w", err)
+	}
+	if _, err := io.Copy(entry, tmp); err != nil {
+		return false, fmt.Errorf("copy: %w", err)
+	}
+	return true, nil
+}
+
+// downloadTranscodeTemp transcodes to a temporary file, so that a transcode
+// which fails part way is found out before any of it is sent, and the track
+// can be sent as it is instead. the file is at its start, and the caller
+// closes and removes it
+func downloadTranscodeTemp(ctx context.Context, transcoder transcode.Transcoder, profile transcode.Profile, absPath string) (*os.File, error) {
+	tmp, err := os.CreateTemp("", "gonic-download-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+	if err := transcoder.Transcode(ctx, profile, absPath, tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("transcode: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("seek temp file: %w", err)
+	}
+	return tmp, nil
+}
+
+// downloadDisposition has a short ascii filename for every client, and the
+// full one in filename* for clients which understand it
+func downloadDisposition(filename string) string {
+	fallback := downloadASCIIName(filename)
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": fallback})
+	if fallback == filename {
+		return disposition
+	}
+	return disposition + "; filename*=UTF-8''" + downloadEncodeExtValue(filename)
+}
+
+func downloadASCIIName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, name)
+	return downloadTruncate(name, downloadNameMax)
+}
+
+// downloadEncodeExtValue percent encodes a filename* value, as in rfc 5987
+func downloadEncodeExtValue(value string) string {
+	const attrChars = "!#$&+-.^_`|~"
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', strings.IndexByte(attrChars, c) >= 0:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// ServeDownload sends tracks and podcast episodes as they are, unless the
+// `format` or `maxBitRate` parameters ask for them to be transcoded. albums,
+// artists, and playlists are sent as a zip, with those applied to each track.
+// playlists are found by the `playlistId` parameter, or an `id` without a type
+func (c *Controller) ServeDownload(w http.ResponseWriter, r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	format, _ := params.Get("format")
+	maxBitRate, _ := params.GetInt("maxBitRate")
+	var rawRules []*db.RawRule
+	if err := c.DB.Find(&rawRules).Error; err != nil {
+		return spec.NewError(0, "couldn't find always raw rules: %v", err)
+	}
+
+	roots := c.musicFolderRoots(r)
+	var files []downloadFile
+	var name string
+	var err error
+	// a signed url only covers its `id`, so the playlist params are ignored
+	if playlistID, perr := params.GetFirstInt("playlistId", "id"); perr == nil && !isSignedURL(r) {
+		files, name, err = downloadPlaylist(c.DB, c.FetchedCoverPath, roots, user, playlistID)
+	} else {
+		id, ierr := params.GetID("id")
+		if ierr != nil {
+			return spec.NewError(10, "please provide an `id` parameter")
+		}
+		switch id.Type {
+		case specid.Track, specid.PodcastEpisode:
+			return c.serveDownloadFile(w, r, user, id, rawRules, format, maxBitRate)
+		case specid.Album:
+			files, name, err = downloadAlbum(c.DB, c.FetchedCoverPath, roots, id.Value)
+		case specid.Artist:
+			files, name, err = downloadArtist(c.DB, c.FetchedCoverPath, roots, id.Value)
+		default:
+			return spec.NewError(10, "can't download id type %q", id.Type)
+		}
+	}
+	if err != nil {
+		return spec.NewError(70, "error finding download: %v", err)
+	}
+	if format != "" || maxBitRate > 0 {
+		downloadSetProfiles(files, rawRules, format, maxBitRate)
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", downloadDisposition(name+".zip"))
+	if err := downloadWriteZip(r.Context(), c.Transcoder, w, files); err != nil {
+		log.Printf("error writing download %q: %v", name, err)
+	}
+	return nil
+}
+
+func (c *Controller) serveDownloadFile(w http.ResponseWriter, r *http.Request, user *db.User, id specid.ID, rawRules []*db.RawRule, format string, maxBitRate int) *spec.Response {
+	file, audioPath, err := streamGetAudio(c.DB, c.PodcastsPath, user, id)
+	if err != nil {
+		return spec.NewError(70, "error finding media: %v", err)
+	}
+	if !c.canStream(r, file) {
+		return spec.NewError(50, "user not allowed to access this music folder")
+	}
+	// like in a zip, a track which can't be transcoded is sent as it is
+	profile, err := downloadDecide(rawRules, file, format, maxBitRate)
+	if err != nil {
+		log.Printf("sending %q in download as it is: %v", audioPath, err)
+	}
+	if profile != nil {
+		tmp, err := downloadTranscodeTemp(r.Context(), c.Transcoder, *profile, audioPath)
+		switch {
+		case err == nil:
+			defer os.Remove(tmp.Name())
+			defer tmp.Close()
+			w.Header().Set("Content-Type", profile.MIME())
+			w.Header().Set("Content-Disposition", downloadDisposition(downloadWithSuffix(file.AudioFilename(), profile.Suffix())))
+			http.ServeContent(w, r, "", time.Time{}, tmp)
+			return nil
+		case r.Context().Err() != nil:
+			return nil
+		case !errors.Is(err, transcode.ErrBusy):
+			log.Printf("sending %q in download as it is: %v", audioPath, err)
+		}
+	}
+	w.Header().Set("Content-Disposition", downloadDisposition(file.AudioFilename()))
+	if info, err := os.Stat(audioPath); err == nil {
+		w.Header().Set("ETag", fileETag(audioPath, info))
+	}
+	http.ServeFile(w, r, audioPath)
+	return nil
+}
@@ -0,0 +1,328 @@
+package ctrlsubsonic
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/mockfs"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+	"go.senan.xyz/gonic/transcode"
+)
+
+func serveDownload(t *testing.T, contr *Controller, params url.Values) (*http.Response, []string) {
+	t.Helper()
+	rr, req := makeHTTPMock(params)
+	req = req.WithContext(context.WithValue(req.Context(), CtxUser, contr.DB.GetUserByName(mockUsername)))
+	contr.HR(contr.ServeDownload).ServeHTTP(rr, req)
+	resp := rr.Result()
+	if resp.Header.Get("Content-Type") != "application/zip" {
+		return resp, nil
+	}
+	body := rr.Body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("read zip: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		if f.Method != zip.Store {
+			t.Fatalf("%q is compressed", f.Name)
+		}
+		names = append(names, f.Name)
+	}
+	return resp, names
+}
+
+func TestDownloadAlbum(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	var album db.Album
+	is.NoErr(contr.DB.Where("right_path=? AND left_path=?", "album-0", "artist-0/").First(&album).Error)
+
+	resp, names := serveDownload(t, contr, url.Values{"id": {fmt.Sprintf("al-%d", album.ID)}})
+	is.Equal(resp.Header.Get("Content-Disposition"), `attachment; filename="artist-0 - album-0.zip"`)
+	is.Equal(names, []string{
+		"artist-0/album-0/cover.png",
+		"artist-0/album-0/track-0.flac",
+		"artist-0/album-0/track-1.flac",
+		"artist-0/album-0/track-2.flac",
+	})
+
+	// a track which has gone since the last scan is left out
+	var track db.Track
+	is.NoErr(contr.DB.Preload("Album").Where("album_id=? AND filename=?", album.ID, "track-1.flac").First(&track).Error)
+	is.NoErr(os.Remove(track.AbsPath()))
+	_, names = serveDownload(t, contr, url.Values{"id": {fmt.Sprintf("al-%d", album.ID)}})
+	is.Equal(names, []string{
+		"artist-0/album-0/cover.png",
+		"artist-0/album-0/track-0.flac",
+		"artist-0/album-0/track-2.flac",
+	})
+}
+
+func TestDownloadArtist(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	var artist db.Artist
+	is.NoErr(contr.DB.Where("name=?", "artist-1").First(&artist).Error)
+	resp, names := serveDownload(t, contr, url.Values{"id": {fmt.Sprintf("ar-%d", artist.ID)}})
+	is.Equal(resp.Header.Get("Content-Disposition"), `attachment; filename=artist-1.zip`)
+	is.Equal(len(names), 3*4) // tracks and a cover for each album
+	is.Equal(names[0], "artist-1/album-0/cover.png")
+}
+
+func TestDownloadPlaylist(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	var tracks []*db.Track
+	is.NoErr(contr.DB.Order("id").Limit(2).Find(&tracks).Error)
+	admin := contr.DB.GetUserByName(mockUsername)
+	playlist := &db.Playlist{UserID: admin.ID, Name: "mix"}
+	playlist.SetItems([]int{tracks[1].ID, tracks[0].ID, tracks[1].ID})
+	is.NoErr(contr.DB.Create(playlist).Error)
+
+	resp, names := serveDownload(t, contr, url.Values{"id": {fmt.Sprint(playlist.ID)}})
+	is.Equal(resp.Header.Get("Content-Disposition"), `attachment; filename=mix.zip`)
+	is.Equal(names, []string{ // in playlist order, without the repeat
+		"artist-0/album-0/cover.png",
+		"artist-0/album-0/track-1.flac",
+		"artist-0/album-0/track-0.flac",
+	})
+
+	// other users can't download private playlists
+	other := &db.User{Name: "other", Password: "other"}
+	is.NoErr(contr.DB.Create(other).Error)
+	rr, req := makeHTTPMock(url.Values{"playlistId": {fmt.Sprint(playlist.ID)}})
+	req = req.WithContext(context.WithValue(req.Context(), CtxUser, other))
+	contr.HR(contr.ServeDownload).ServeHTTP(rr, req)
+	is.True(rr.Header().Get("Content-Type") != "application/zip")
+
+	// and a url signed for a track only downloads that track
+	_, req = makeHTTPMock(url.Values{})
+	signedURL, _, err := contr.signedURL(req, "/rest/download", url.Values{"playlistId": {fmt.Sprint(playlist.ID)}},
+		admin, specid.ID{Type: specid.Track, Value: tracks[0].ID}, time.Minute, false)
+	is.NoErr(err)
+	rr = httptest.NewRecorder()
+	contr.WithParams(contr.WithSignedURL(contr.HR(contr.ServeDownload))).
+		ServeHTTP(rr, httptest.NewRequest(http.MethodGet, signedURL, nil))
+	is.Equal(rr.Header().Get("Content-Disposition"), `attachment; filename=track-0.flac`)
+}
+
+func TestDownloadTrack(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	var track db.Track
+	is.NoErr(contr.DB.Where("filename=?", "track-2.flac").First(&track).Error)
+	resp, names := serveDownload(t, contr, url.Values{"id": {fmt.Sprintf("tr-%d", track.ID)}})
+	is.Equal(names, nil)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(resp.Header.Get("Content-Disposition"), `attachment; filename=track-2.flac`)
+}
+
+func TestDownloadLongNames(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	// each name is close to the filesystem's limit, which makes paths of over
+	// 400 characters. the track names only differ past where they're truncated
+	m := mockfs.New(t)
+	dir := filepath.Join(strings.Repeat("Symphonie ", 24), strings.Repeat("Sätze ", 30))
+	long := strings.Repeat("ü", 100) + strings.Repeat("x", 40)
+	trackNames := []string{long + "1.flac", long + "2.flac"}
+	for _, name := range trackNames {
+		m.AddTrack(filepath.Join(dir, name))
+		m.SetTags(filepath.Join(dir, name), func(tags *mockfs.Tags) error {
+			tags.RawArtist = strings.Repeat("Orchester ", 40)
+			tags.RawAlbumArtist = strings.Repeat("Orchester ", 40)
+			tags.RawAlbum = strings.Repeat("Klavierkonzert ", 30)
+			return nil
+		})
+	}
+	m.ScanAndClean()
+	contr := makeControllerMock(m, []string{""})
+
+	// nothing is truncated in the db
+	var tracks []*db.Track
+	is.NoErr(contr.DB.Preload("Album").Order("filename").Find(&tracks).Error)
+	is.Equal(len(tracks), 2)
+	is.Equal(tracks[0].Filename, trackNames[0])
+	is.True(len(tracks[0].RelPath()) > 400)
+	_, err := os.Stat(tracks[0].AbsPath())
+	is.NoErr(err)
+
+	admin := contr.DB.GetUserByName(mockUsername)
+	rr, req := makeHTTPMock(url.Values{"id": {fmt.Sprintf("tr-%d", tracks[0].ID)}})
+	req = req.WithContext(context.WithValue(req.Context(), CtxUser, admin))
+	contr.HR(contr.ServeStream).ServeHTTP(rr, req)
+	is.Equal(rr.Code, http.StatusOK)
+
+	// the full name is in filename*, with a shortened ascii name for other clients
+	resp, _ := serveDownload(t, contr, url.Values{"id": {fmt.Sprintf("tr-%d", tracks[0].ID)}})
+	disposition := resp.Header.Get("Content-Disposition")
+	is.True(strings.Contains(disposition, "filename*=UTF-8''%C3%BC"))
+	_, params, err := mime.ParseMediaType(disposition)
+	is.NoErr(err)
+	is.Equal(params["filename"], trackNames[0])
+	fallback := strings.Trim(strings.TrimPrefix(strings.SplitN(disposition, ";", 3)[1], " filename="), `"`)
+	is.Equal(fallback, strings.Repeat("_", 100)+strings.Repeat("x", 40)+"1.flac")
+
+	resp, names := serveDownload(t, contr, url.Values{"id": {fmt.Sprintf("al-%d", tracks[0].AlbumID)}})
+	is.Equal(resp.StatusCode, http.StatusOK)
+	disposition = resp.Header.Get("Content-Disposition")
+	_, params, err = mime.ParseMediaType(disposition)
+	is.NoErr(err)
+	is.True(len(params["filename"]) > downloadNameMax)
+	fallback = strings.Trim(strings.TrimPrefix(strings.SplitN(disposition, ";", 3)[1], " filename="), `"`)
+	is.True(len(fallback) <= downloadNameMax)
+	is.True(strings.HasSuffix(fallback, ".zip"))
+	is.Equal(len(names), 2)
+	is.True(names[0] != names[1])
+	for _, name := range names {
+		is.True(utf8.ValidString(name))
+		is.True(strings.HasSuffix(name, ".flac"))
+		for _, elem := range strings.Split(name, "/") {
+			is.True(len(elem) <= 255)
+		}
+	}
+	is.True(strings.HasSuffix(names[1], " (2).flac"))
+}
+
+func TestDownloadTruncate(t *testing.T) {
+	t.Parallel()
+	tcases := []struct {
+		name string
+		max  int
+		exp  string
+	}{
+		{"short.flac", 20, "short.flac"},
+		{"a long name.flac", 10, "a lon.flac"},
+		{"éééé.flac", 10, "éé.flac"},       // doesn't split a character
+		{"a name. then more", 8, "a name"}, // not an extension
+	}
+	for _, tc := range tcases {
+		if got := downloadTruncate(tc.name, tc.max); got != tc.exp {
+			t.Errorf("truncate %q to %d: exp %q, got %q", tc.name, tc.max, tc.exp, got)
+		}
+	}
+}
+
+// suffixTranscoder writes the suffix of the profile it's asked for
+type suffixTranscoder struct{}
+
+func (suffixTranscoder) Transcode(_ context.Context, profile transcode.Profile, _ string, out io.Writer) error {
+	_, err := fmt.Fprintf(out, "transcoded %s", profile.Suffix())
+	return err
+}
+
+// brokenTranscoder fails part way through transcoding the track at path
+type brokenTranscoder struct{ path string }
+
+func (b brokenTranscoder) Transcode(ctx context.Context, profile transcode.Profile, in string, out io.Writer) error {
+	if in != b.path {
+		return suffixTranscoder{}.Transcode(ctx, profile, in, out)
+	}
+	_, _ = fmt.Fprint(out, "transcoded part")
+	return errors.New("broken")
+}
+
+func TestDownloadTranscoded(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	contr.Transcoder = suffixTranscoder{}
+
+	var track db.Track
+	is.NoErr(contr.DB.Preload("Album").Where("filename=?", "track-2.flac").First(&track).Error)
+	is.NoErr(contr.DB.Model(&track).UpdateColumns(map[string]interface{}{"bitrate": 900}).Error)
+	original := []byte("fLaC original")
+	is.NoErr(os.WriteFile(track.AbsPath(), original, 0600))
+
+	download := func(params url.Values) *httptest.ResponseRecorder {
+		if params.Get("id") == "" {
+			params.Set("id", fmt.Sprintf("tr-%d", track.ID))
+		}
+		rr, req := makeHTTPMock(params)
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, contr.DB.GetUserByName(mockUsername)))
+		contr.HR(contr.ServeDownload).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := download(url.Values{"format": {"opus"}})
+	is.Equal(rr.Header().Get("Content-Disposition"), `attachment; filename=track-2.opus`)
+	is.Equal(rr.Header().Get("Content-Type"), "audio/ogg")
+	is.Equal(rr.Body.String(), "transcoded opus")
+
+	rr = download(url.Values{"maxBitRate": {"128"}})
+	is.Equal(rr.Header().Get("Content-Disposition"), `attachment; filename=track-2.mp3`)
+
+	// the original, byte for byte
+	for _, params := range []url.Values{{}, {"format": {"raw"}}} {
+		rr = download(params)
+		is.Equal(rr.Header().Get("Content-Disposition"), `attachment; filename=track-2.flac`)
+		is.Equal(rr.Body.Bytes(), original)
+	}
+
+	// zips transcode each track, but not covers
+	readZip := func(params url.Values) map[string]string {
+		params.Set("id", fmt.Sprintf("al-%d", track.AlbumID))
+		rr := download(params)
+		zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+		is.NoErr(err)
+		files := map[string]string{}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			is.NoErr(err)
+			body, err := io.ReadAll(rc)
+			is.NoErr(err)
+			rc.Close()
+			files[f.Name] = string(body)
+		}
+		return files
+	}
+	files := readZip(url.Values{"format": {"mp3"}})
+	is.Equal(len(files), 4)
+	is.Equal(files["artist-0/album-0/track-2.mp3"], "transcoded mp3")
+	_, ok := files["artist-0/album-0/cover.png"]
+	is.True(ok)
+
+	files = readZip(url.Values{"format": {"raw"}})
+	is.Equal(files["artist-0/album-0/track-2.flac"], string(original))
+
+	// a track which fails to transcode is added as it is, and the rest still are
+	contr.Transcoder = brokenTranscoder{path: track.AbsPath()}
+	files = readZip(url.Values{"format": {"mp3"}})
+	is.Equal(len(files), 4)
+	is.Equal(files["artist-0/album-0/track-2.flac"], string(original))
+	is.Equal(files["artist-0/album-0/track-1.mp3"], "transcoded mp3")
+
+	// and so is a single one
+	rr = download(url.Values{"format": {"mp3"}})
+	is.Equal(rr.Code, http.StatusOK)
+	is.Equal(rr.Header().Get("Content-Disposition"), `attachment; filename=track-2.flac`)
+	is.Equal(rr.Body.Bytes(), original)
+}
@@ -0,0 +1,230 @@
+package ctrlsubsonic
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+	"go.senan.xyz/gonic/streamsign"
+	"go.senan.xyz/gonic/transcode"
+)
+
+// hlsSegmentLength is how much of the track is in each segment. the last one
+// is usually shorter
+const hlsSegmentLength = 10 * time.Second
+
+const (
+	hlsMinBitRate = 32
+	hlsMaxBitRate = 320
+)
+
+// hlsBitRates reads the bitRate params. they can have a video size too, like
+// 1000@480x360, which doesn't mean anything for audio
+func hlsBitRates(params params.Params) []int {
+	var bitRates []int
+	seen := map[int]struct{}{}
+	for _, value := range params.GetOrList("bitRate", nil) {
+		value = strings.SplitN(value, "@", 2)[0]
+		bitRate, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || bitRate <= 0 {
+			continue
+		}
+		if bitRate < hlsMinBitRate {
+			bitRate = hlsMinBitRate
+		}
+		if bitRate > hlsMaxBitRate {
+			bitRate = hlsMaxBitRate
+		}
+		if _, ok := seen[bitRate]; ok {
+			continue
+		}
+		seen[bitRate] = struct{}{}
+		bitRates = append(bitRates, bitRate)
+	}
+	return bitRates
+}
+
+// hlsSegments returns how many segments a track of length has
+func hlsSegments(length time.Duration) int {
+	return int((length + hlsSegmentLength - 1) / hlsSegmentLength)
+}
+
+// hlsMediaPlaylist lists the segments of a track of length. it's a complete,
+// VOD playlist, so players know where the track ends
+func hlsMediaPlaylist(length time.Duration, segmentURL func(index int) string) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	target := hlsSegmentLength
+	if length < target {
+		target = length
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target.Seconds())))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	for i := 0; i < hlsSegments(length); i++ {
+		duration := length - time.Duration(i)*hlsSegmentLength
+		if duration > hlsSegmentLength {
+			duration = hlsSegmentLength
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", duration.Seconds())
+		fmt.Fprintf(&b, "%s\n", segmentURL(i))
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+// hlsMasterPlaylist lists a media playlist for each bitrate, for players to
+// pick between
+func hlsMasterPlaylist(bitRates []int, variantURL func(bitRate int) string) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	for _, bitRate := range bitRates {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"mp4a.40.2\"\n", bitRate*1000)
+		fmt.Fprintf(&b, "%s\n", variantURL(bitRate))
+	}
+	return b.String()
+}
+
+// hlsSignedURL signs a url to another part of the stream, so that players
+// which can't do subsonic auth can follow it. if r was itself signed, the new
+// url expires with it, and is bound to the same address
+func (c *Controller) hlsSignedURL(r *http.Request, route string, extra url.Values, user *db.User, id specid.ID) (string, error) {
+	ttl, bindIP := signedStreamTTL, false
+	query := r.URL.Query()
+	if query.Get(streamsign.ParamSig) != "" {
+		claims, err := streamsign.Parse(query, c.ClientIP(r))
+		if err != nil {
+			return "", fmt.Errorf("parse signed url: %w", err)
+		}
+		ttl, bindIP = time.Until(claims.Expires), claims.IP != ""
+	}
+	signedURL, _, err := c.signedURL(r, route, extra, user, id, ttl, bindIP)
+	return signedURL, err
+}
+
+// ServeHLS makes a playlist of segments for a track. with more than one
+// bitRate, it's a master playlist of a media playlist for each
+func (c *Controller) ServeHLS(w http.ResponseWriter, r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := params.GetID("id")
+	if err != nil || (id.Type != specid.Track && id.Type != specid.PodcastEpisode) {
+		return spec.NewError(10, "please provide a track or podcast episode `id` parameter")
+	}
+	file, _, err := streamGetAudio(c.DB, c.PodcastsPath, user, id)
+	if err != nil {
+		return spec.NewError(70, "error finding media: %v", err)
+	}
+	if !c.canStream(r, file) {
+		return spec.NewError(50, "user not allowed to access this music folder")
+	}
+	length := time.Duration(file.AudioLength()) * time.Second
+	if length <= 0 {
+		return spec.NewError(0, "media has an unknown length, so can't be segmented")
+	}
+
+	var playlist string
+	var signErr error
+	switch bitRates := hlsBitRates(params); len(bitRates) {
+	case 0, 1:
+		bitRate := int(transcode.HLSSegment.BitRate())
+		if len(bitRates) == 1 {
+			bitRate = bitRates[0]
+		}
+		playlist = hlsMediaPlaylist(length, func(index int) string {
+			extra := url.Values{"index": {strconv.Itoa(index)}, "bitRate": {strconv.Itoa(bitRate)}}
+			segmentURL, err := c.hlsSignedURL(r, "/rest/hlsSegment.ts", extra, user, id)
+			if err != nil {
+				signErr = err
+			}
+			return segmentURL
+		})
+		// the master playlist isn't counted, only the one which is played
+		if track, ok := file.(*db.Track); ok && track.Album != nil {
+			if err := streamUpdateStats(c.DB, user.ID, track, time.Now()); err != nil {
+				log.Printf("error updating status: %v", err)
+			}
+		}
+	default:
+		playlist = hlsMasterPlaylist(bitRates, func(bitRate int) string {
+			extra := url.Values{"bitRate": {strconv.Itoa(bitRate)}}
+			variantURL, err := c.hlsSignedURL(r, "/rest/hls.m3u8", extra, user, id)
+			if err != nil {
+				signErr = err
+			}
+			return variantURL
+		})
+	}
+	if signErr != nil {
+		return spec.NewError(0, "signing url: %v", signErr)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	_, _ = w.Write([]byte(playlist))
+	return nil
+}
+
+// ServeHLSSegment transcodes a segment of a track from a ServeHLS playlist.
+// they go through the same cache as other transcodes
+func (c *Controller) ServeHLSSegment(w http.ResponseWriter, r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	id, err := params.GetID("id")
+	if err != nil || (id.Type != specid.Track && id.Type != specid.PodcastEpisode) {
+		return spec.NewError(10, "please provide a track or podcast episode `id` parameter")
+	}
+	index, err := params.GetInt("index")
+	if err != nil || index < 0 {
+		return spec.NewError(10, "please provide a segment `index` parameter")
+	}
+	file, audioPath, err := streamGetAudio(c.DB, c.PodcastsPath, user, id)
+	if err != nil {
+		return spec.NewError(70, "error finding media: %v", err)
+	}
+	if !c.canStream(r, file) {
+		return spec.NewError(50, "user not allowed to access this music folder")
+	}
+	length := time.Duration(file.AudioLength()) * time.Second
+	if index >= hlsSegments(length) {
+		return spec.NewError(70, "segment %d is past the end of the media", index)
+	}
+
+	profile := transcode.HLSSegment
+	if bitRates := hlsBitRates(params); len(bitRates) > 0 {
+		profile = transcode.WithBitrate(profile, transcode.BitRate(bitRates[0]))
+	}
+	seek := time.Duration(index) * hlsSegmentLength
+	duration := length - seek
+	if duration > hlsSegmentLength {
+		duration = hlsSegmentLength
+	}
+	profile = transcode.WithSeek(profile, seek)
+	profile = transcode.WithDuration(profile, duration)
+	if mode := transcode.ReplayGainMode(user.ReplayGain); mode != transcode.ReplayGainOff {
+		trackGain, albumGain := streamReplayGain(file)
+		profile = transcode.WithGain(profile, transcode.ReplayGain(mode, trackGain, albumGain))
+	}
+
+	w.Header().Set("Content-Type", profile.MIME())
+	err = c.Transcoder.Transcode(r.Context(), profile, audioPath, w)
+	if errors.Is(err, transcode.ErrBusy) {
+		w.Header().Del("Content-Type")
+		return spec.NewError(0, "too many transcodes running, try again soon")
+	}
+	if err != nil {
+		return spec.NewError(0, "error transcoding: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package ctrlsubsonic
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/transcode"
+)
+
+func TestHLSMediaPlaylist(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	segmentURL := func(index int) string { return fmt.Sprintf("seg-%d.ts", index) }
+
+	is.Equal(hlsMediaPlaylist(25*time.Second, segmentURL), strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-TARGETDURATION:10",
+		"#EXT-X-MEDIA-SEQUENCE:0",
+		"#EXT-X-PLAYLIST-TYPE:VOD",
+		"#EXTINF:10.000,", "seg-0.ts",
+		"#EXTINF:10.000,", "seg-1.ts",
+		"#EXTINF:5.000,", "seg-2.ts",
+		"#EXT-X-ENDLIST",
+		"",
+	}, "\n"))
+
+	// shorter than a segment
+	short := hlsMediaPlaylist(4*time.Second, segmentURL)
+	is.True(strings.Contains(short, "#EXT-X-TARGETDURATION:4\n"))
+	is.Equal(strings.Count(short, "#EXTINF"), 1)
+}
+
+func TestHLS(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	transcoder := &seekTranscoder{}
+	contr.Transcoder = transcoder
+
+	admin := contr.DB.GetUserByName(mockUsername)
+	var track db.Track
+	is.NoErr(contr.DB.First(&track).Error)
+	is.NoErr(contr.DB.Model(&track).UpdateColumns(map[string]interface{}{"length": 25}).Error)
+
+	serve := func(h handlerSubsonicRaw, query url.Values) *httptest.ResponseRecorder {
+		query.Set("id", fmt.Sprintf("tr-%d", track.ID))
+		rr, req := makeHTTPMock(query)
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, admin))
+		contr.HR(h).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// one bitrate is a media playlist of signed segments
+	rr := serve(contr.ServeHLS, url.Values{"bitRate": {"192"}})
+	is.Equal(rr.Code, http.StatusOK)
+	is.Equal(rr.Header().Get("Content-Type"), "application/vnd.apple.mpegurl")
+	var segments []*url.URL
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			u, err := url.Parse(line)
+			is.NoErr(err)
+			segments = append(segments, u)
+		}
+	}
+	is.Equal(len(segments), 3)
+	is.True(strings.HasSuffix(segments[2].Path, "/rest/hlsSegment.ts"))
+	is.Equal(segments[2].Query().Get("index"), "2")
+	is.Equal(segments[2].Query().Get("bitRate"), "192")
+	is.True(segments[2].Query().Get("sig") != "")
+	is.True(strings.HasSuffix(rr.Body.String(), "#EXT-X-ENDLIST\n"))
+
+	// the signed segment url works without credentials
+	segmentHandler := contr.WithParams(contr.WithSignedURL(contr.HR(contr.ServeHLSSegment)))
+	req := httptest.NewRequest(http.MethodGet, segments[2].String(), nil)
+	rr = httptest.NewRecorder()
+	segmentHandler.ServeHTTP(rr, req)
+	is.Equal(rr.Code, http.StatusOK)
+	is.Equal(rr.Header().Get("Content-Type"), "video/mp2t")
+	is.Equal(transcoder.profile.Seek(), 20*time.Second)
+	is.Equal(transcoder.profile.Duration(), 5*time.Second)
+	is.Equal(transcoder.profile.BitRate(), transcode.BitRate(192))
+
+	// past the end
+	rr = serve(contr.ServeHLSSegment, url.Values{"index": {"3"}})
+	is.True(strings.Contains(rr.Body.String(), "past the end"))
+
+	// more than one is a master playlist, with a variant for each
+	rr = serve(contr.ServeHLS, url.Values{"bitRate": {"128", "1000@480x360"}})
+	body := rr.Body.String()
+	is.True(strings.Contains(body, "#EXT-X-STREAM-INF:BANDWIDTH=128000,"))
+	is.True(strings.Contains(body, "#EXT-X-STREAM-INF:BANDWIDTH=320000,"))
+	is.True(strings.Contains(body, "/rest/hls.m3u8?"))
+	is.True(!strings.Contains(body, "#EXT-X-ENDLIST"))
+
+	// the length is needed to know the segments
+	is.NoErr(contr.DB.Model(&track).UpdateColumns(map[string]interface{}{"length": 0}).Error)
+	rr = serve(contr.ServeHLS, url.Values{})
+	is.True(strings.Contains(rr.Body.String(), "unknown length"))
+}
@@ -2,18 +2,22 @@ package ctrlsubsonic
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"sort"
 
 	"github.com/jinzhu/gorm"
 
 	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/playlists"
 )
 
-func playlistRender(c *Controller, playlist *db.Playlist) *spec.Playlist {
+// playlistRender renders playlist with its tracks in the music folders with
+// roots, or all of them if it's nil
+func playlistRender(c *Controller, playlist *db.Playlist, roots []string) (*spec.Playlist, error) {
 	user := &db.User{}
 	c.DB.Where("id=?", playlist.UserID).Find(user)
 
@@ -22,46 +26,98 @@ func playlistRender(c *Controller, playlist *db.Playlist) *spec.Playlist {
 		Name:      playlist.Name,
 		Comment:   playlist.Comment,
 		Created:   playlist.CreatedAt,
+		Changed:   playlist.ChangedAt,
 		SongCount: playlist.TrackCount,
 		Public:    playlist.IsPublic,
 		Owner:     user.Name,
+		CoverID:   &specid.ID{Type: specid.Playlist, Value: playlist.ID},
+		ReadOnly:  playlist.IsSmart,
 	}
 
 	trackIDs := playlist.GetItems()
-	resp.List = make([]*spec.TrackChild, len(trackIDs))
+	addedAt := playlist.GetItemsAddedAt()
+	tracks, err := findTracks(c.DB, trackIDs, "Album", "Album.TagArtist")
+	if err != nil {
+		return nil, err
+	}
+	resp.List = make([]*spec.TrackChild, 0, len(trackIDs))
 	for i, id := range trackIDs {
-		track := db.Track{}
-		err := c.DB.
-			Where("id=?", id).
-			Preload("Album").
-			Preload("Album.TagArtist").
-			Find(&track).
-			Error
-		if errors.Is(err, gorm.ErrRecordNotFound) {
+		track, ok := tracks[id]
+		if !ok {
 			log.Printf("wasn't able to find track with id %d", id)
 			continue
 		}
-		resp.List[i] = spec.NewTCTrackByFolder(&track, track.Album)
+		if !inRoots(roots, track.Album) {
+			continue
+		}
+		child := spec.NewTCTrackByFolder(track, track.Album)
+		if !addedAt[i].IsZero() {
+			child.Added = &addedAt[i]
+		}
+		resp.List = append(resp.List, child)
 		resp.Duration += track.Length
 	}
-	return resp
+	if roots != nil {
+		resp.SongCount = len(resp.List)
+	}
+	return resp, nil
+}
+
+// inRoots is true if album is in one of the music folders with roots, or if
+// roots is nil
+func inRoots(roots []string, album *db.Album) bool {
+	if roots == nil {
+		return true
+	}
+	if album == nil {
+		return false
+	}
+	for _, root := range roots {
+		if album.RootDir == root {
+			return true
+		}
+	}
+	return false
+}
+
+// keepItems are the items which are in ids, in their order
+func keepItems(items []int, ids []int) []int {
+	keep := make(map[int]struct{}, len(ids))
+	for _, id := range ids {
+		keep[id] = struct{}{}
+	}
+	kept := make([]int, 0, len(items))
+	for _, item := range items {
+		if _, ok := keep[item]; ok {
+			kept = append(kept, item)
+		}
+	}
+	return kept
 }
 
 func (c *Controller) ServeGetPlaylists(r *http.Request) *spec.Response {
 	user := r.Context().Value(CtxUser).(*db.User)
 	var playlists []*db.Playlist
 	c.DB.Where("user_id=?", user.ID).Or("is_public=?", true).Find(&playlists)
+	roots := c.musicFolderRoots(r)
 	sub := spec.NewResponse()
 	sub.Playlists = &spec.Playlists{
 		List: make([]*spec.Playlist, len(playlists)),
 	}
 	for i, playlist := range playlists {
-		sub.Playlists.List[i] = playlistRender(c, playlist)
+		rendered, err := playlistRender(c, playlist, roots)
+		if err != nil {
+			return spec.NewError(0, "error rendering playlist: %v", err)
+		}
+		sub.Playlists.List[i] = rendered
 	}
 	return sub
 }
 
+// ServeGetPlaylist finds one of the user's playlists, or another user's public
+// one, which they can play but not change
 func (c *Controller) ServeGetPlaylist(r *http.Request) *spec.Response {
+	user := r.Context().Value(CtxUser).(*db.User)
 	params := r.Context().Value(CtxParams).(params.Params)
 	playlistID, err := params.GetFirstInt("id", "playlistId")
 	if err != nil {
@@ -69,19 +125,77 @@ func (c *Controller) ServeGetPlaylist(r *http.Request) *spec.Response {
 	}
 	playlist := db.Playlist{}
 	err = c.DB.
-		Where("id=?", playlistID).
+		Where("id=? AND (user_id=? OR is_public=?)", playlistID, user.ID, true).
 		Find(&playlist).
 		Error
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return spec.NewError(70, "playlist with id `%d` not found", playlistID)
 	}
+	if err != nil {
+		return spec.NewError(0, "error finding playlist: %v", err)
+	}
 	sub := spec.NewResponse()
-	sub.Playlist = playlistRender(c, &playlist)
+	sub.Playlist, err = playlistRender(c, &playlist, c.musicFolderRoots(r))
+	if err != nil {
+		return spec.NewError(0, "error rendering playlist: %v", err)
+	}
+	if err := setTrackPlays(c.DB, user.ID, sub.Playlist.List); err != nil {
+		return spec.NewError(0, "find track plays: %v", err)
+	}
 	return sub
 }
 
+// ServeGetPlaylistFile is getPlaylist with format=m3u8. it serves the playlist
+// as an m3u8 of its tracks' paths in their music folders, for players with the
+// same files
+func (c *Controller) ServeGetPlaylistFile(w http.ResponseWriter, r *http.Request) *spec.Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	params := r.Context().Value(CtxParams).(params.Params)
+	playlistID, err := params.GetFirstInt("id", "playlistId")
+	if err != nil {
+		return spec.NewError(10, "please provide an `id` parameter")
+	}
+	var playlist db.Playlist
+	err = c.DB.
+		Where("id=? AND (user_id=? OR is_public=?)", playlistID, user.ID, true).
+		First(&playlist).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return spec.NewError(70, "playlist with id `%d` not found", playlistID)
+	}
+	if err != nil {
+		return spec.NewError(0, "error finding playlist: %v", err)
+	}
+	if roots := c.musicFolderRoots(r); roots != nil {
+		var visible []int
+		err := c.DB.
+			Model(db.Track{}).
+			Joins("JOIN albums ON albums.id=tracks.album_id").
+			Where("tracks.id IN (?) AND albums.root_dir IN (?)", playlist.GetItems(), roots).
+			Pluck("tracks.id", &visible).
+			Error
+		if err != nil {
+			return spec.NewError(0, "error finding tracks: %v", err)
+		}
+		playlist.SetItems(keepItems(playlist.GetItems(), visible))
+	}
+	entries, err := playlists.Entries(c.DB, &playlist, "")
+	if err != nil {
+		return spec.NewError(0, "error finding tracks: %v", err)
+	}
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	w.Header().Set("Content-Disposition", downloadDisposition(playlists.FileName(playlist.Name)+".m3u8"))
+	if err := playlists.WriteM3U8(w, entries); err != nil {
+		log.Printf("error writing playlist %d: %v", playlist.ID, err)
+	}
+	return nil
+}
+
 func (c *Controller) ServeCreatePlaylist(r *http.Request) *spec.Response {
 	user := r.Context().Value(CtxUser).(*db.User)
+	if !user.CanWrite() {
+		return spec.NewError(50, "user is read only")
+	}
 	params := r.Context().Value(CtxParams).(params.Params)
 	playlistID := params.GetFirstOrInt( /* default */ 0, "id", "playlistId")
 	// playlistID may be 0 from above. in that case we get a new playlist
@@ -90,15 +204,22 @@ func (c *Controller) ServeCreatePlaylist(r *http.Request) *spec.Response {
 	c.DB.
 		Where("id=?", playlistID).
 		FirstOrCreate(&playlist)
+	prev := playlist
 
 		// update meta info
 	if playlist.UserID != 0 && playlist.UserID != user.ID {
-		return spec.NewResponse()
+		return spec.NewError(50, "playlist with id `%d` belongs to another user", playlist.ID)
+	}
+	if playlist.IsSmart {
+		return spec.NewError(50, "playlist with id `%d` is built from rules, and can't be changed", playlist.ID)
 	}
 	playlist.UserID = user.ID
 	if val, err := params.Get("name"); err == nil {
 		playlist.Name = val
 	}
+	if val, err := params.GetBool("public"); err == nil {
+		playlist.IsPublic = val
+	}
 
 	// replace song IDs
 	var trackIDs []int
@@ -109,64 +230,138 @@ func (c *Controller) ServeCreatePlaylist(r *http.Request) *spec.Response {
 	}
 	// Set the items of the playlist
 	playlist.SetItems(trackIDs)
-	c.DB.Save(playlist)
+	if err := c.DB.SavePlaylist(prev, &playlist); err != nil {
+		return spec.NewError(0, "error saving playlist: %v", err)
+	}
+	c.PlaylistChanged(playlist.ID)
 
 	sub := spec.NewResponse()
-	sub.Playlist = playlistRender(c, &playlist)
+	rendered, err := playlistRender(c, &playlist, c.musicFolderRoots(r))
+	if err != nil {
+		return spec.NewError(0, "error rendering playlist: %v", err)
+	}
+	sub.Playlist = rendered
 	return sub
 }
 
+var (
+	errPlaylistNotFound = errors.New("playlist not found")
+	errPlaylistNotOwned = errors.New("playlist belongs to another user")
+	errPlaylistSmart    = errors.New("playlist is built from rules, and can't be changed")
+	errPlaylistIndex    = errors.New("song index out of range")
+)
+
+// ServeUpdatePlaylist changes the playlist's details, then removes and adds
+// entries, all at once. nothing is changed if any of it fails
 func (c *Controller) ServeUpdatePlaylist(r *http.Request) *spec.Response {
 	user := r.Context().Value(CtxUser).(*db.User)
-	params := r.Context().Value(CtxParams).(params.Params)
-	playlistID := params.GetFirstOrInt( /* default */ 0, "id", "playlistId")
-	// playlistID may be 0 from above. in that case we get a new playlist
-	// as intended
-	var playlist db.Playlist
-	c.DB.
-		Where("id=?", playlistID).
-		FirstOrCreate(&playlist)
-
-		// update meta info
-	if playlist.UserID != 0 && playlist.UserID != user.ID {
-		return spec.NewResponse()
+	if !user.CanWrite() {
+		return spec.NewError(50, "user is read only")
 	}
-	playlist.UserID = user.ID
-	if val, err := params.Get("name"); err == nil {
-		playlist.Name = val
-	}
-	if val, err := params.Get("comment"); err == nil {
-		playlist.Comment = val
+	params := r.Context().Value(CtxParams).(params.Params)
+	playlistID, err := params.GetFirstInt("playlistId", "id")
+	if err != nil {
+		return spec.NewError(10, "please provide a `playlistId` parameter")
 	}
-	if val, err := params.GetBool("public"); err == nil {
-		playlist.IsPublic = val
+	var addIDs []int
+	for _, id := range params.GetOrIDList("songIdToAdd", nil) {
+		addIDs = append(addIDs, id.Value)
 	}
-	trackIDs := playlist.GetItems()
 
-	// delete items
-	if p, err := params.GetIntList("songIndexToRemove"); err == nil {
-		sort.Sort(sort.Reverse(sort.IntSlice(p)))
-		for _, i := range p {
-			trackIDs = append(trackIDs[:i], trackIDs[i+1:]...)
+	var playlist db.Playlist
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.
+			Where("id=?", playlistID).
+			First(&playlist).
+			Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errPlaylistNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("find playlist: %w", err)
 		}
+		switch {
+		case playlist.UserID != user.ID:
+			return errPlaylistNotOwned
+		case playlist.IsSmart:
+			return errPlaylistSmart
+		}
+		prev := playlist
+		if val, err := params.Get("name"); err == nil {
+			playlist.Name = val
+		}
+		if val, err := params.Get("comment"); err == nil {
+			playlist.Comment = val
+		}
+		if val, err := params.GetBool("public"); err == nil {
+			playlist.IsPublic = val
+		}
+		trackIDs, err := playlistUpdateItems(playlist.GetItems(), params.GetOrIntList("songIndexToRemove", nil), addIDs)
+		if err != nil {
+			return err
+		}
+		playlist.SetItems(trackIDs)
+		return (&db.DB{DB: tx}).SavePlaylist(prev, &playlist)
+	})
+	switch {
+	case errors.Is(err, errPlaylistNotFound):
+		return spec.NewError(70, "playlist with id `%d` not found", playlistID)
+	case errors.Is(err, errPlaylistNotOwned), errors.Is(err, errPlaylistSmart):
+		return spec.NewError(50, "can't change playlist with id `%d`: %v", playlistID, err)
+	case errors.Is(err, errPlaylistIndex):
+		return spec.NewError(0, "%v", err)
+	case err != nil:
+		return spec.NewError(0, "error saving playlist: %v", err)
 	}
+	c.PlaylistChanged(playlist.ID)
+	return spec.NewResponse()
+}
 
-	// add items
-	if p, err := params.GetIDList("songIdToAdd"); err == nil {
-		for _, i := range p {
-			trackIDs = append(trackIDs, i.Value)
+// playlistUpdateItems removes the entries at removeIndices from trackIDs, then
+// appends addIDs. the indices are all of trackIDs before any are removed, as if
+// they were removed from the highest down, so an index given twice removes one
+// entry
+func playlistUpdateItems(trackIDs []int, removeIndices []int, addIDs []int) ([]int, error) {
+	remove := make(map[int]struct{}, len(removeIndices))
+	for _, i := range removeIndices {
+		if i < 0 || i >= len(trackIDs) {
+			return nil, fmt.Errorf("%w: %d", errPlaylistIndex, i)
 		}
+		remove[i] = struct{}{}
 	}
-
-	playlist.SetItems(trackIDs)
-	c.DB.Save(playlist)
-	return spec.NewResponse()
+	updated := make([]int, 0, len(trackIDs)-len(remove)+len(addIDs))
+	for i, id := range trackIDs {
+		if _, ok := remove[i]; !ok {
+			updated = append(updated, id)
+		}
+	}
+	return append(updated, addIDs...), nil
 }
 
 func (c *Controller) ServeDeletePlaylist(r *http.Request) *spec.Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	if !user.CanWrite() {
+		return spec.NewError(50, "user is read only")
+	}
 	params := r.Context().Value(CtxParams).(params.Params)
+	playlistID := params.GetOrInt("id", 0)
+	var playlist db.Playlist
+	err := c.DB.
+		Where("id=?", playlistID).
+		First(&playlist).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return spec.NewError(70, "playlist with id `%d` not found", playlistID)
+	}
+	if err != nil {
+		return spec.NewError(0, "error finding playlist: %v", err)
+	}
+	if playlist.UserID != user.ID {
+		return spec.NewError(50, "playlist with id `%d` belongs to another user", playlistID)
+	}
+	c.PlaylistDeleting(playlistID)
 	c.DB.
-		Where("id=?", params.GetOrInt("id", 0)).
+		Where("id=?", playlistID).
 		Delete(&db.Playlist{})
 	return spec.NewResponse()
 }
@@ -0,0 +1,292 @@
+package ctrlsubsonic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+)
+
+func TestPlaylistTimestamps(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	admin := contr.DB.GetUserByName(mockUsername)
+
+	var tracks []*db.Track
+	is.NoErr(contr.DB.Order("id").Limit(3).Find(&tracks).Error)
+	trackID := func(i int) string { return fmt.Sprintf("tr-%d", tracks[i].ID) }
+
+	serve := func(h handlerSubsonic, params url.Values) *spec.Response {
+		_, req := makeHTTPMock(params)
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, admin))
+		resp := h(req)
+		is.True(resp.Error == nil)
+		return resp
+	}
+
+	resp := serve(contr.ServeCreatePlaylist, url.Values{"name": {"mix"}, "songId": {trackID(0), trackID(1)}})
+	playlistID := fmt.Sprint(resp.Playlist.ID)
+	is.True(!resp.Playlist.Changed.IsZero())
+	is.True(resp.Playlist.List[0].Added != nil)
+
+	// move everything into the past, so that we can see what moves
+	past := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	pastUnix := fmt.Sprint(past.Unix())
+	is.NoErr(contr.DB.Model(&db.Playlist{}).Where("id=?", playlistID).UpdateColumns(map[string]interface{}{
+		"changed_at":     past,
+		"updated_at":     past,
+		"items_added_at": pastUnix + "," + pastUnix,
+	}).Error)
+	get := func() *spec.Playlist {
+		return serve(contr.ServeGetPlaylist, url.Values{"id": {playlistID}}).Playlist
+	}
+
+	// a no-op update doesn't move anything
+	serve(contr.ServeUpdatePlaylist, url.Values{"playlistId": {playlistID}, "name": {"mix"}})
+	playlist := get()
+	is.True(playlist.Changed.Equal(past))
+	var row db.Playlist
+	is.NoErr(contr.DB.First(&row, playlistID).Error)
+	is.True(row.UpdatedAt.Equal(past))
+
+	// a reorder moves the playlist, but the entries keep when they were added
+	serve(contr.ServeCreatePlaylist, url.Values{"playlistId": {playlistID}, "songId": {trackID(1), trackID(0)}})
+	playlist = get()
+	is.True(playlist.Changed.After(past))
+	is.Equal(playlist.List[0].ID.String(), trackID(1))
+	is.True(playlist.List[0].Added.Equal(past))
+	is.True(playlist.List[1].Added.Equal(past))
+
+	// an added entry is new, the others aren't
+	serve(contr.ServeUpdatePlaylist, url.Values{"playlistId": {playlistID}, "songIdToAdd": {trackID(2)}})
+	playlist = get()
+	is.Equal(len(playlist.List), 3)
+	is.True(playlist.List[1].Added.Equal(past))
+	is.True(playlist.List[2].Added.After(past))
+
+	// and so is a removal
+	is.NoErr(contr.DB.Model(&db.Playlist{}).Where("id=?", playlistID).UpdateColumn("changed_at", past).Error)
+	serve(contr.ServeUpdatePlaylist, url.Values{"playlistId": {playlistID}, "songIndexToRemove": {"0"}})
+	playlist = get()
+	is.Equal(len(playlist.List), 2)
+	is.True(playlist.Changed.After(past))
+
+	// summaries have the change time too
+	playlists := serve(contr.ServeGetPlaylists, url.Values{}).Playlists
+	is.Equal(len(playlists.List), 1)
+	is.True(playlists.List[0].Changed.Equal(playlist.Changed))
+}
+
+func TestGetPlaylistFile(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	admin := contr.DB.GetUserByName(mockUsername)
+
+	var tracks []*db.Track
+	is.NoErr(contr.DB.Preload("Album").Order("id").Limit(2).Find(&tracks).Error)
+	playlist := &db.Playlist{UserID: admin.ID, Name: "a/b"}
+	playlist.SetItems([]int{tracks[1].ID, tracks[0].ID})
+	is.NoErr(contr.DB.SavePlaylist(db.Playlist{}, playlist))
+
+	rr, req := makeHTTPMock(url.Values{"id": {fmt.Sprint(playlist.ID)}, "format": {"m3u8"}})
+	serveRaw(t, contr, contr.ServeGetPlaylistFile, rr, req)
+	is.Equal(rr.Code, http.StatusOK)
+	is.Equal(rr.Header().Get("Content-Type"), "audio/x-mpegurl")
+	is.Equal(rr.Header().Get("Content-Disposition"), `attachment; filename=a_b.m3u8`)
+	var paths []string
+	for _, line := range strings.Split(strings.TrimSpace(rr.Body.String()), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			paths = append(paths, line)
+		}
+	}
+	is.Equal(paths, []string{tracks[1].RelPath(), tracks[0].RelPath()}) // not the server's paths
+
+	// someone else's private playlist isn't found
+	other := &db.User{Name: "other", Password: "other"}
+	is.NoErr(contr.DB.Create(other).Error)
+	_, req = makeHTTPMock(url.Values{"id": {fmt.Sprint(playlist.ID)}, "format": {"m3u8"}})
+	req = req.WithContext(context.WithValue(req.Context(), CtxUser, other))
+	resp := contr.ServeGetPlaylistFile(httptest.NewRecorder(), req)
+	is.True(resp != nil && resp.Error != nil)
+	is.Equal(resp.Error.Code, 70)
+}
+
+func TestPublicPlaylists(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	admin := contr.DB.GetUserByName(mockUsername)
+	other := &db.User{Name: "other", Password: "other"}
+	is.NoErr(contr.DB.Create(other).Error)
+
+	var tracks []*db.Track
+	is.NoErr(contr.DB.Order("id").Limit(1).Find(&tracks).Error)
+	serve := func(user *db.User, h handlerSubsonic, params url.Values) *spec.Response {
+		_, req := makeHTTPMock(params)
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, user))
+		return h(req)
+	}
+
+	resp := serve(admin, contr.ServeCreatePlaylist, url.Values{"name": {"shared"}, "public": {"true"}, "songId": {fmt.Sprintf("tr-%d", tracks[0].ID)}})
+	is.True(resp.Error == nil)
+	is.True(resp.Playlist.Public)
+	shared := fmt.Sprint(resp.Playlist.ID)
+	resp = serve(admin, contr.ServeCreatePlaylist, url.Values{"name": {"private"}})
+	is.True(resp.Error == nil)
+	private := fmt.Sprint(resp.Playlist.ID)
+
+	// others see public playlists, with their owner
+	list := serve(other, contr.ServeGetPlaylists, url.Values{}).Playlists.List
+	is.Equal(len(list), 1)
+	is.Equal(list[0].Name, "shared")
+	is.Equal(list[0].Owner, mockUsername)
+	resp = serve(other, contr.ServeGetPlaylist, url.Values{"id": {shared}})
+	is.True(resp.Error == nil)
+	is.Equal(len(resp.Playlist.List), 1)
+	resp = serve(other, contr.ServeGetPlaylist, url.Values{"id": {private}})
+	is.Equal(resp.Error.Code, 70)
+
+	// but can't change them
+	resp = serve(other, contr.ServeUpdatePlaylist, url.Values{"playlistId": {shared}, "name": {"mine now"}})
+	is.Equal(resp.Error.Code, 50)
+	resp = serve(other, contr.ServeCreatePlaylist, url.Values{"playlistId": {shared}, "name": {"mine now"}})
+	is.Equal(resp.Error.Code, 50)
+	resp = serve(other, contr.ServeDeletePlaylist, url.Values{"id": {shared}})
+	is.Equal(resp.Error.Code, 50)
+	is.Equal(serve(admin, contr.ServeGetPlaylist, url.Values{"id": {shared}}).Playlist.Name, "shared")
+
+	// which their owner can, making them private again
+	resp = serve(admin, contr.ServeUpdatePlaylist, url.Values{"playlistId": {shared}, "public": {"false"}})
+	is.True(resp.Error == nil)
+	is.Equal(len(serve(other, contr.ServeGetPlaylists, url.Values{}).Playlists.List), 0)
+	resp = serve(admin, contr.ServeDeletePlaylist, url.Values{"id": {shared}})
+	is.True(resp.Error == nil)
+}
+
+func TestSmartPlaylistReadOnly(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	admin := contr.DB.GetUserByName(mockUsername)
+
+	smart := &db.Playlist{UserID: admin.ID, Name: "smart", IsSmart: true}
+	is.NoErr(contr.DB.SavePlaylist(db.Playlist{}, smart))
+	serve := func(h handlerSubsonic, params url.Values) *spec.Response {
+		_, req := makeHTTPMock(params)
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, admin))
+		return h(req)
+	}
+
+	list := serve(contr.ServeGetPlaylists, url.Values{}).Playlists.List
+	is.Equal(len(list), 1)
+	is.True(list[0].ReadOnly)
+	resp := serve(contr.ServeUpdatePlaylist, url.Values{"playlistId": {fmt.Sprint(smart.ID)}, "name": {"dumb"}})
+	is.Equal(resp.Error.Code, 50)
+	resp = serve(contr.ServeCreatePlaylist, url.Values{"playlistId": {fmt.Sprint(smart.ID)}})
+	is.Equal(resp.Error.Code, 50)
+}
+
+func TestPlaylistUpdateItems(t *testing.T) {
+	t.Parallel()
+
+	tcases := []struct {
+		name     string
+		items    []int
+		remove   []int
+		add      []int
+		expected []int
+		err      error
+	}{
+		{"add", []int{1, 2}, nil, []int{3, 3}, []int{1, 2, 3, 3}, nil},
+		{"remove", []int{1, 2, 3}, []int{1}, nil, []int{1, 3}, nil},
+		{"remove by original index", []int{1, 2, 3, 4}, []int{0, 2}, nil, []int{2, 4}, nil},
+		{"remove in any order", []int{1, 2, 3, 4}, []int{3, 0, 1}, nil, []int{3}, nil},
+		{"remove duplicate index", []int{1, 2, 3}, []int{1, 1}, nil, []int{1, 3}, nil},
+		{"remove then add", []int{1, 2, 3}, []int{0, 2}, []int{1, 4}, []int{2, 1, 4}, nil},
+		{"remove everything", []int{1, 2}, []int{1, 0}, []int{5}, []int{5}, nil},
+		{"remove out of range", []int{1, 2}, []int{0, 2}, []int{3}, nil, errPlaylistIndex},
+		{"remove negative", []int{1, 2}, []int{-1}, nil, nil, errPlaylistIndex},
+		{"remove from empty", nil, []int{0}, nil, nil, errPlaylistIndex},
+	}
+	for _, tc := range tcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			items, err := playlistUpdateItems(tc.items, tc.remove, tc.add)
+			is.True(errors.Is(err, tc.err))
+			if tc.err != nil {
+				return
+			}
+			is.Equal(items, tc.expected)
+		})
+	}
+}
+
+func TestUpdatePlaylist(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	admin := contr.DB.GetUserByName(mockUsername)
+	other := &db.User{Name: "other", Password: "other"}
+	is.NoErr(contr.DB.Create(other).Error)
+
+	var tracks []*db.Track
+	is.NoErr(contr.DB.Order("id").Limit(4).Find(&tracks).Error)
+	trackID := func(i int) string { return fmt.Sprintf("tr-%d", tracks[i].ID) }
+	serve := func(user *db.User, h handlerSubsonic, params url.Values) *spec.Response {
+		_, req := makeHTTPMock(params)
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, user))
+		return h(req)
+	}
+	resp := serve(admin, contr.ServeCreatePlaylist, url.Values{"name": {"mix"}, "songId": {trackID(0), trackID(1), trackID(2)}})
+	is.True(resp.Error == nil)
+	playlistID := fmt.Sprint(resp.Playlist.ID)
+	items := func() []string {
+		var ids []string
+		for _, track := range serve(admin, contr.ServeGetPlaylist, url.Values{"id": {playlistID}}).Playlist.List {
+			ids = append(ids, track.ID.String())
+		}
+		return ids
+	}
+
+	// removals are by the original indices, then additions are appended
+	resp = serve(admin, contr.ServeUpdatePlaylist, url.Values{
+		"playlistId":        {playlistID},
+		"songIndexToRemove": {"0", "2", "0"},
+		"songIdToAdd":       {trackID(3), trackID(0)},
+		"name":              {"mix 2"},
+	})
+	is.True(resp.Error == nil)
+	is.Equal(items(), []string{trackID(1), trackID(3), trackID(0)})
+
+	// a bad index changes nothing at all
+	resp = serve(admin, contr.ServeUpdatePlaylist, url.Values{
+		"playlistId":        {playlistID},
+		"songIndexToRemove": {"0", "3"},
+		"name":              {"mix 3"},
+	})
+	is.Equal(resp.Error.Code, 0)
+	is.Equal(items(), []string{trackID(1), trackID(3), trackID(0)})
+	is.Equal(serve(admin, contr.ServeGetPlaylist, url.Values{"id": {playlistID}}).Playlist.Name, "mix 2")
+
+	resp = serve(admin, contr.ServeUpdatePlaylist, url.Values{"playlistId": {"9999"}, "name": {"new"}})
+	is.Equal(resp.Error.Code, 70)
+	resp = serve(other, contr.ServeUpdatePlaylist, url.Values{"playlistId": {playlistID}, "songIndexToRemove": {"0"}})
+	is.Equal(resp.Error.Code, 50)
+	resp = serve(admin, contr.ServeUpdatePlaylist, url.Values{})
+	is.Equal(resp.Error.Code, 10)
+	is.Equal(len(items()), 3)
+}
@@ -119,3 +119,25 @@ func (c *Controller) ServeDeletePodcastEpisode(r *http.Request) *spec.Response {
 	}
 	return spec.NewResponse()
 }
+
+// ServeGetPodcastEpisodeChapters is a gonic extension. it lists the chapters of
+// a downloaded episode, if its feed links some
+func (c *Controller) ServeGetPodcastEpisodeChapters(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	id, err := params.GetID("id")
+	if err != nil || id.Type != specid.PodcastEpisode {
+		return spec.NewError(10, "please provide a valid podcast episode id")
+	}
+	chapters, err := c.Podcasts.GetPodcastEpisodeChapters(id.Value)
+	if err != nil {
+		return spec.NewError(70, "failed to get chapters: %s", err)
+	}
+	sub := spec.NewResponse()
+	sub.PodcastChapters = &spec.PodcastChapters{
+		List: make([]*spec.PodcastChapter, len(chapters)),
+	}
+	for i, chapter := range chapters {
+		sub.PodcastChapters.List[i] = spec.NewPodcastChapter(chapter)
+	}
+	return sub
+}
@@ -1,18 +1,27 @@
 package ctrlsubsonic
 
 import (
+	"crypto/md5"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/disintegration/imaging"
 	"github.com/jinzhu/gorm"
 
+	"go.senan.xyz/gonic/avatar"
 	"go.senan.xyz/gonic/db"
+	gmime "go.senan.xyz/gonic/mime"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
@@ -70,7 +79,18 @@ func streamGetAudio(dbc *db.DB, podcastsPath string, user *db.User, id specid.ID
 	}
 }
 
-func streamUpdateStats(dbc *db.DB, userID, albumID int, playTime time.Time) error {
+// canStream is true if the user of r can see the music folder file is in.
+// podcast episodes are anyone's
+func (c *Controller) canStream(r *http.Request, file db.AudioFile) bool {
+	track, ok := file.(*db.Track)
+	if !ok || track.Album == nil {
+		return true
+	}
+	return c.canSeeRoot(r, track.Album.RootDir)
+}
+
+func streamUpdateStats(dbc *db.DB, userID int, track *db.Track, playTime time.Time) error {
+	albumID := track.AlbumID
 	play := db.Play{
 		AlbumID: albumID,
 		UserID:  userID,
@@ -90,12 +110,229 @@ func streamUpdateStats(dbc *db.DB, userID, albumID int, playTime time.Time) erro
 	if err := dbc.Save(&play).Error; err != nil {
 		return fmt.Errorf("save stat: %w", err)
 	}
+	listen := db.Listen{UserID: userID, AlbumID: albumID, Time: playTime} // for package together
+	if err := dbc.Create(&listen).Error; err != nil {
+		return fmt.Errorf("save listen: %w", err)
+	}
+	trackPlay := db.TrackPlay{
+		TrackID: track.ID,
+		UserID:  userID,
+	}
+	err = dbc.
+		Where(trackPlay).
+		First(&trackPlay).
+		Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("find track stat: %w", err)
+	}
+	trackPlay.Count++ // for playCount on tracks
+	if playTime.After(trackPlay.Time) {
+		trackPlay.Time = playTime // for played on tracks
+	}
+	if err := dbc.Save(&trackPlay).Error; err != nil {
+		return fmt.Errorf("save track stat: %w", err)
+	}
+	if err := db.UserAnnotated(dbc.DB, userID); err != nil {
+		return fmt.Errorf("save user: %w", err)
+	}
+	return nil
+}
+
+// setTrackPlays fills in how often the user played each of the tracks, and
+// when they last did. folders and other children are left alone
+func setTrackPlays(dbc *db.DB, userID int, children []*spec.TrackChild) error {
+	var trackIDs []int
+	for _, child := range children {
+		if child != nil && child.ID != nil && child.ID.Type == specid.Track {
+			trackIDs = append(trackIDs, child.ID.Value)
+		}
+	}
+	if len(trackIDs) == 0 {
+		return nil
+	}
+	var plays []*db.TrackPlay
+	err := forChunks(trackIDs, func(chunk []int) error {
+		var found []*db.TrackPlay
+		err := dbc.
+			Where("user_id=? AND track_id IN (?)", userID, chunk).
+			Find(&found).
+			Error
+		plays = append(plays, found...)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("find track plays: %w", err)
+	}
+	byTrack := make(map[int]*db.TrackPlay, len(plays))
+	for _, play := range plays {
+		byTrack[play.TrackID] = play
+	}
+	for _, child := range children {
+		if child == nil || child.ID == nil || child.ID.Type != specid.Track {
+			continue
+		}
+		if play, ok := byTrack[child.ID.Value]; ok {
+			child.PlayCount = play.Count
+			played := play.Time
+			child.Played = &played
+		}
+	}
+	return nil
+}
+
+// folderAnnotations are a user's stars and ratings of some folders and tracks,
+// by their ids
+type folderAnnotations struct {
+	folderStars   map[int]time.Time
+	folderRatings map[int]int
+	trackStars    map[int]time.Time
+	trackRatings  map[int]int
+}
+
+// findFolderAnnotations finds the user's stars and ratings of the folders and
+// tracks with ids. folders are albums in the db, see handlers_by_folder.go
+func findFolderAnnotations(dbc *db.DB, userID int, folderIDs, trackIDs []int) (*folderAnnotations, error) {
+	ann := &folderAnnotations{
+		folderStars:   map[int]time.Time{},
+		folderRatings: map[int]int{},
+		trackStars:    map[int]time.Time{},
+		trackRatings:  map[int]int{},
+	}
+	err := forChunks(folderIDs, func(chunk []int) error {
+		var stars []*db.AlbumStar
+		if err := dbc.Where("user_id=? AND album_id IN (?)", userID, chunk).Find(&stars).Error; err != nil {
+			return fmt.Errorf("find album stars: %w", err)
+		}
+		for _, star := range stars {
+			ann.folderStars[star.AlbumID] = star.StarDate
+		}
+		var ratings []*db.AlbumRating
+		if err := dbc.Where("user_id=? AND album_id IN (?)", userID, chunk).Find(&ratings).Error; err != nil {
+			return fmt.Errorf("find album ratings: %w", err)
+		}
+		for _, rating := range ratings {
+			ann.folderRatings[rating.AlbumID] = rating.Rating
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = forChunks(trackIDs, func(chunk []int) error {
+		var stars []*db.TrackStar
+		if err := dbc.Where("user_id=? AND track_id IN (?)", userID, chunk).Find(&stars).Error; err != nil {
+			return fmt.Errorf("find track stars: %w", err)
+		}
+		for _, star := range stars {
+			ann.trackStars[star.TrackID] = star.StarDate
+		}
+		var ratings []*db.TrackRating
+		if err := dbc.Where("user_id=? AND track_id IN (?)", userID, chunk).Find(&ratings).Error; err != nil {
+			return fmt.Errorf("find track ratings: %w", err)
+		}
+		for _, rating := range ratings {
+			ann.trackRatings[rating.TrackID] = rating.Rating
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ann, nil
+}
+
+// setChildAnnotations fills in when the user starred each of the folder and
+// track children, and how they rated them
+func setChildAnnotations(dbc *db.DB, userID int, children []*spec.TrackChild) error {
+	var folderIDs, trackIDs []int
+	for _, child := range children {
+		if child == nil || child.ID == nil {
+			continue
+		}
+		switch child.ID.Type {
+		case specid.Album:
+			folderIDs = append(folderIDs, child.ID.Value)
+		case specid.Track:
+			trackIDs = append(trackIDs, child.ID.Value)
+		}
+	}
+	ann, err := findFolderAnnotations(dbc, userID, folderIDs, trackIDs)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if child == nil || child.ID == nil {
+			continue
+		}
+		stars, ratings := ann.folderStars, ann.folderRatings
+		switch child.ID.Type {
+		case specid.Album:
+		case specid.Track:
+			stars, ratings = ann.trackStars, ann.trackRatings
+		default:
+			continue
+		}
+		if starred, ok := stars[child.ID.Value]; ok {
+			child.Starred = &starred
+		}
+		child.UserRating = ratings[child.ID.Value]
+	}
+	return nil
+}
+
+// findTracks finds the tracks with ids in as few queries as it can, with
+// preloads. ids which don't exist anymore aren't in the map
+func findTracks(dbc *db.DB, ids []int, preloads ...string) (map[int]*db.Track, error) {
+	byID := make(map[int]*db.Track, len(ids))
+	err := forChunks(ids, func(chunk []int) error {
+		q := dbc.Where("id IN (?)", chunk)
+		for _, preload := range preloads {
+			q = q.Preload(preload)
+		}
+		var found []*db.Track
+		if err := q.Find(&found).Error; err != nil {
+			return err
+		}
+		for _, track := range found {
+			byID[track.ID] = track
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("find tracks: %w", err)
+	}
+	return byID, nil
+}
+
+// forChunks calls cb with the distinct ids in chunks small enough to keep
+// under sqlite's limit on host parameters. https://sqlite.org/limits.html
+func forChunks(ids []int, cb func([]int) error) error {
+	const size = 900 // leaving room for other parameters
+	seen := make(map[int]struct{}, len(ids))
+	distinct := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			distinct = append(distinct, id)
+		}
+	}
+	ids = distinct
+	for i := 0; i < len(ids); i += size {
+		end := i + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := cb(ids[i:end]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 const (
 	coverDefaultSize = 600
-	coverCacheFormat = "png"
+	// bigger requests are capped, resizing is slow and bigger is rarely useful
+	coverMaxSize = 2048
 )
 
 var (
@@ -103,22 +340,69 @@ var (
 	errCoverEmpty    = errors.New("no cover found for that folder")
 )
 
-func coverGetPath(dbc *db.DB, podcastPath string, id specid.ID) (string, error) {
+// canSeeCover is true if the user of r can see the album, artist, or playlist
+// with the cover id. an artist needs an album in their music folders, and a
+// playlist's mosaic needs all of its albums to be
+func (c *Controller) canSeeCover(r *http.Request, id specid.ID) (bool, error) {
+	roots := c.musicFolderRoots(r)
+	switch {
+	case roots == nil:
+		return true, nil
+	case len(roots) == 0:
+		return false, nil
+	}
+	q := c.DB.Model(db.Album{})
 	switch id.Type {
 	case specid.Album:
-		return coverGetPathAlbum(dbc, id.Value)
+		q = q.Where("id=? AND root_dir NOT IN (?)", id.Value, roots)
+	case specid.Artist:
+		q = q.Where("tag_artist_id=? AND root_dir IN (?)", id.Value, roots)
+	case specid.Playlist:
+		var playlist db.Playlist
+		err := c.DB.Select("id, items").First(&playlist, id.Value).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return true, nil // so that it isn't found
+		}
+		if err != nil {
+			return false, err
+		}
+		q = q.
+			Joins("JOIN tracks ON tracks.album_id=albums.id").
+			Where("tracks.id IN (?) AND albums.root_dir NOT IN (?)", playlist.GetItems(), roots)
+	default:
+		return true, nil
+	}
+	var count int
+	if err := q.Count(&count).Error; err != nil {
+		return false, err
+	}
+	// an artist is seen through one of their albums, the rest by none being hidden
+	if id.Type == specid.Artist {
+		return count > 0, nil
+	}
+	return count == 0, nil
+}
+
+func coverGetPath(dbc *db.DB, podcastPath, fetchedCoverPath, cachePath string, id specid.ID) (string, error) {
+	switch id.Type {
+	case specid.Album:
+		return coverGetPathAlbum(dbc, fetchedCoverPath, id.Value)
 	case specid.Artist:
 		return coverGetPathArtist(dbc, id.Value)
 	case specid.Podcast:
 		return coverGetPathPodcast(dbc, podcastPath, id.Value)
 	case specid.PodcastEpisode:
 		return coverGetPathPodcastEpisode(dbc, podcastPath, id.Value)
+	case specid.Playlist:
+		return coverGetPathPlaylist(dbc, fetchedCoverPath, cachePath, id.Value)
 	default:
 		return "", errCoverNotFound
 	}
 }
 
-func coverGetPathAlbum(dbc *db.DB, id int) (string, error) {
+// coverGetPathAlbum prefers a cover in the album's folder, then one fetched
+// from outside, eg. the cover art archive
+func coverGetPathAlbum(dbc *db.DB, fetchedCoverPath string, id int) (string, error) {
 	folder := &db.Album{}
 	err := dbc.DB.
 		Select("id, root_dir, left_path, right_path, cover").
@@ -128,7 +412,7 @@ func coverGetPathAlbum(dbc *db.DB, id int) (string, error) {
 		return "", fmt.Errorf("select album: %w", err)
 	}
 	if folder.Cover == "" {
-		return "", errCoverEmpty
+		return coverGetPathFetched(dbc, fetchedCoverPath, id)
 	}
 	return path.Join(
 		folder.RootDir,
@@ -138,6 +422,24 @@ func coverGetPathAlbum(dbc *db.DB, id int) (string, error) {
 	), nil
 }
 
+func coverGetPathFetched(dbc *db.DB, fetchedCoverPath string, albumID int) (string, error) {
+	if fetchedCoverPath == "" {
+		return "", errCoverEmpty
+	}
+	fetched := &db.FetchedCover{}
+	err := dbc.
+		Where("album_id=? AND coalesce(path, '')!=''", albumID).
+		First(fetched).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", errCoverEmpty
+	}
+	if err != nil {
+		return "", fmt.Errorf("select fetched cover: %w", err)
+	}
+	return path.Join(fetchedCoverPath, fetched.Path), nil
+}
+
 func coverGetPathArtist(dbc *db.DB, id int) (string, error) {
 	folder := &db.Album{}
 	err := dbc.DB.
@@ -195,20 +497,199 @@ func coverGetPathPodcastEpisode(dbc *db.DB, podcastPath string, id int) (string,
 	return path.Join(podcastPath, podcast.ImagePath), nil
 }
 
-func coverScaleAndSave(absPath, cachePath string, size int) error {
+// coverMosaicCells is how many album covers go in a playlist's 2x2 mosaic
+const coverMosaicCells = 4
+
+// coverGetPathPlaylist uses the playlist's uploaded image, else a mosaic of the
+// covers of its first few albums. either is written to the cache with a name
+// which changes along with the image or the albums, so that it's resized and
+// tagged like any other cover
+func coverGetPathPlaylist(dbc *db.DB, fetchedCoverPath, cachePath string, id int) (string, error) {
+	playlist := &db.Playlist{}
+	if err := dbc.First(playlist, id).Error; err != nil {
+		return "", fmt.Errorf("select playlist: %w", err)
+	}
+	uploaded := &db.PlaylistImage{}
+	err := dbc.
+		Select("playlist_id, updated_at").
+		Where("playlist_id=?", id).
+		First(uploaded).
+		Error
+	switch {
+	case err == nil:
+		uploadedPath := path.Join(cachePath, fmt.Sprintf("playlist-%d-%d.jpg", id, uploaded.UpdatedAt.UnixNano()))
+		return uploadedPath, coverCacheWrite(uploadedPath, func(w io.Writer) error {
+			if err := dbc.Where("playlist_id=?", id).First(uploaded).Error; err != nil {
+				return fmt.Errorf("select playlist image: %w", err)
+			}
+			_, err := w.Write(uploaded.Image)
+			return err
+		})
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return "", fmt.Errorf("select playlist image: %w", err)
+	}
+
+	covers, err := coverGetPathsPlaylistAlbums(dbc, fetchedCoverPath, playlist)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case len(covers) == 0:
+		return "", errCoverEmpty
+	case len(covers) < coverMosaicCells:
+		return covers[0], nil
+	}
+	sum := md5.New()
+	for _, coverPath := range covers {
+		stat, err := os.Stat(coverPath)
+		if err != nil {
+			return "", fmt.Errorf("stat cover: %w", err)
+		}
+		fmt.Fprintf(sum, "%s\n%d\n", coverPath, stat.ModTime().UnixNano())
+	}
+	mosaicPath := path.Join(cachePath, fmt.Sprintf("playlist-%x.jpg", sum.Sum(nil)))
+	return mosaicPath, coverCacheWrite(mosaicPath, func(w io.Writer) error {
+		return coverMosaic(w, covers)
+	})
+}
+
+// coverGetPathsPlaylistAlbums finds the covers of the playlist's first few
+// distinct albums which have one, in playlist order
+func coverGetPathsPlaylistAlbums(dbc *db.DB, fetchedCoverPath string, playlist *db.Playlist) ([]string, error) {
+	trackIDs := playlist.GetItems()
+	var tracks []*db.Track
+	if err := dbc.Select("id, album_id").Where("id IN (?)", trackIDs).Find(&tracks).Error; err != nil {
+		return nil, fmt.Errorf("select tracks: %w", err)
+	}
+	albumIDs := make(map[int]int, len(tracks))
+	for _, track := range tracks {
+		albumIDs[track.ID] = track.AlbumID
+	}
+	var covers []string
+	seen := map[int]struct{}{}
+	for _, trackID := range trackIDs {
+		albumID, ok := albumIDs[trackID]
+		if !ok {
+			continue
+		}
+		if _, ok := seen[albumID]; ok {
+			continue
+		}
+		seen[albumID] = struct{}{}
+		coverPath, err := coverGetPathAlbum(dbc, fetchedCoverPath, albumID)
+		if err != nil {
+			continue
+		}
+		if covers = append(covers, coverPath); len(covers) == coverMosaicCells {
+			break
+		}
+	}
+	return covers, nil
+}
+
+// coverMosaic draws covers in a 2x2 grid, each cropped square
+func coverMosaic(w io.Writer, covers []string) error {
+	const cell = coverDefaultSize
+	mosaic := imaging.New(cell*2, cell*2, color.Black)
+	for i, coverPath := range covers {
+		src, err := imaging.Open(coverPath)
+		if err != nil {
+			return fmt.Errorf("open `%s`: %w", coverPath, err)
+		}
+		src = imaging.Fill(src, cell, cell, imaging.Center, imaging.Lanczos)
+		mosaic = imaging.Paste(mosaic, src, image.Pt(i%2*cell, i/2*cell))
+	}
+	return imaging.Encode(w, mosaic, imaging.JPEG)
+}
+
+// coverCacheKey changes whenever the cover's path or modification time
+// changes, so that a replaced cover is resized again
+func coverCacheKey(coverPath string, modTime time.Time, size int) string {
+	sum := md5.New()
+	fmt.Fprintf(sum, "%s\n%d\n%d", coverPath, modTime.UnixNano(), size)
+	return fmt.Sprintf("%x", sum.Sum(nil))
+}
+
+// fileETag changes whenever the file's path, size, or modification time
+// changes
+func fileETag(filePath string, info os.FileInfo) string {
+	sum := md5.New()
+	fmt.Fprintf(sum, "%s\n%d\n%d", filePath, info.ModTime().UnixNano(), info.Size())
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", sum.Sum(nil)))
+}
+
+// notModified is true if r is conditional, and the client already has the
+// version with etag and modTime. like ServeFile, If-None-Match wins over
+// If-Modified-Since. modTime can be zero to only check the etag
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != "" && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modTime.IsZero() {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// coverCacheFormat keeps resized covers in the same format as their source. ok
+// is false for formats we can't encode, such as webp, which are served as is
+func coverCacheFormat(coverPath string) (format imaging.Format, ext string, ok bool) {
+	switch strings.ToLower(path.Ext(coverPath)) {
+	case ".jpg", ".jpeg":
+		return imaging.JPEG, ".jpg", true
+	case ".png":
+		return imaging.PNG, ".png", true
+	default:
+		return 0, "", false
+	}
+}
+
+func coverScaleAndSave(absPath, cachePath string, format imaging.Format, size int) error {
 	src, err := imaging.Open(absPath)
 	if err != nil {
 		return fmt.Errorf("resizing `%s`: %w", absPath, err)
 	}
-	width := size
-	if width > src.Bounds().Dx() {
-		// don't upscale images
-		width = src.Bounds().Dx()
+	// fit won't upscale
+	return coverCacheWrite(cachePath, func(w io.Writer) error {
+		return imaging.Encode(w, imaging.Fit(src, size, size, imaging.Lanczos), format)
+	})
+}
+
+// coverCacheWrite writes cachePath with write, unless it already exists
+func coverCacheWrite(cachePath string, write func(io.Writer) error) error {
+	if _, err := os.Stat(cachePath); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(cachePath), os.ModePerm); err != nil {
+		return fmt.Errorf("create cache dir: %w", err)
 	}
-	err = imaging.Save(imaging.Resize(src, width, 0, imaging.Lanczos), cachePath)
+	// write somewhere else first, since another request could be serving the
+	// cached file as soon as it exists
+	tmp, err := os.CreateTemp(path.Dir(cachePath), ".cover-*")
 	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
 		return fmt.Errorf("caching `%s`: %w", cachePath, err)
 	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close `%s`: %w", cachePath, err)
+	}
+	if err := os.Rename(tmp.Name(), cachePath); err != nil {
+		return fmt.Errorf("rename `%s`: %w", cachePath, err)
+	}
 	return nil
 }
 
@@ -219,18 +700,60 @@ func (c *Controller) ServeGetCoverArt(w http.ResponseWriter, r *http.Request) *s
 		return spec.NewError(10, "please provide an `id` parameter")
 	}
 	size := params.GetOrInt("size", coverDefaultSize)
-	cachePath := path.Join(
-		c.CoverCachePath,
-		fmt.Sprintf("%s-%d.%s", id.String(), size, coverCacheFormat),
-	)
+	if size <= 0 || size > coverMaxSize {
+		size = coverMaxSize
+	}
+	if id.Type == specid.Playlist {
+		// like getPlaylist, other users' private playlists aren't found
+		user := r.Context().Value(CtxUser).(*db.User)
+		err := c.DB.
+			Select("id").
+			Where("id=? AND (user_id=? OR is_public=?)", id.Value, user.ID, true).
+			First(&db.Playlist{}).
+			Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return spec.NewError(70, "playlist with id `%d` not found", id.Value)
+		}
+		if err != nil {
+			return spec.NewError(0, "error finding playlist: %v", err)
+		}
+	}
+	visible, err := c.canSeeCover(r, id)
+	if err != nil {
+		return spec.NewError(0, "error finding cover `%s`: %v", id, err)
+	}
+	if !visible {
+		return spec.NewError(50, "user not allowed to access this music folder")
+	}
+	coverPath, err := coverGetPath(c.DB, c.PodcastsPath, c.FetchedCoverPath, c.CoverCachePath, id)
+	if err != nil {
+		return spec.NewError(10, "couldn't find cover `%s`: %v", id, err)
+	}
+	stat, err := os.Stat(coverPath)
+	if err != nil {
+		return spec.NewError(10, "couldn't find cover `%s`: %v", id, err)
+	}
+
+	// the etag lets clients which already have this size of this version of
+	// the cover skip downloading it again, and it being resized
+	key := coverCacheKey(coverPath, stat.ModTime(), size)
+	etag := fmt.Sprintf("%q", key)
+	w.Header().Set("ETag", etag)
+	if notModified(r, etag, time.Time{}) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	format, ext, ok := coverCacheFormat(coverPath)
+	if !ok {
+		http.ServeFile(w, r, coverPath)
+		return nil
+	}
+	cachePath := path.Join(c.CoverCachePath, key+ext)
 	_, err = os.Stat(cachePath)
 	switch {
 	case os.IsNotExist(err):
-		coverPath, err := coverGetPath(c.DB, c.PodcastsPath, id)
-		if err != nil {
-			return spec.NewError(10, "couldn't find cover `%s`: %v", id, err)
-		}
-		if err := coverScaleAndSave(coverPath, cachePath, size); err != nil {
+		if err := coverScaleAndSave(coverPath, cachePath, format, size); err != nil {
 			log.Printf("error scaling cover: %v", err)
 			return nil
 		}
@@ -242,6 +765,191 @@ func (c *Controller) ServeGetCoverArt(w http.ResponseWriter, r *http.Request) *s
 	return nil
 }
 
+// streamDecisionHeader tells the client whether a stream was sent raw or
+// transcoded, and why, so that raw rules and preferences can be checked
+const streamDecisionHeader = "X-Gonic-Stream-Decision"
+
+var errStreamRawOverMax = errors.New("file is always streamed raw, but its bitrate is over the requested maxBitRate")
+
+type streamDecision struct {
+	profile *transcode.Profile // nil for raw
+	reason  string
+}
+
+func (d *streamDecision) String() string {
+	if d.profile == nil {
+		return fmt.Sprintf("raw; %s", d.reason)
+	}
+	if seek := d.profile.Seek(); seek > 0 {
+		return fmt.Sprintf("transcode %s %dk from %s; %s", d.profile.MIME(), d.profile.BitRate(), seek, d.reason)
+	}
+	return fmt.Sprintf("transcode %s %dk; %s", d.profile.MIME(), d.profile.BitRate(), d.reason)
+}
+
+// streamEstimateLength guesses the size of a transcode from its bitrate and
+// the duration left after its seek, for clients which need a Content-Length
+func streamEstimateLength(profile transcode.Profile, lengthSecs int) int {
+	remaining := time.Duration(lengthSecs)*time.Second - profile.Seek()
+	if remaining <= 0 || profile.BitRate() <= 0 {
+		return 0
+	}
+	return int(int64(profile.BitRate()) * 1000 / 8 * int64(remaining) / int64(time.Second))
+}
+
+// streamUncompressedProfile is used for uncompressed files when the client has
+// no transcode preference, since hundreds of megabytes of wav is rarely wanted
+var streamUncompressedProfile = transcode.WithBitrate(transcode.MP3, 320)
+
+func streamIsUncompressed(relPath string) bool {
+	switch strings.ToLower(path.Ext(relPath)) {
+	case ".wav", ".aif", ".aiff":
+		return true
+	default:
+		return false
+	}
+}
+
+type streamFormat struct {
+	profile transcode.Profile
+	exts    []string // of files which are already in this format
+}
+
+// streamFormats are the formats a client can ask for with the format param.
+// mp3 is used when a client only asks for a maxBitRate
+var streamFormats = map[string]streamFormat{
+	"mp3":  {profile: transcode.MP3, exts: []string{".mp3"}},
+	"opus": {profile: transcode.Opus, exts: []string{".opus"}},
+	"aac":  {profile: transcode.AAC256, exts: []string{".aac"}},
+}
+
+const streamDefaultFormat = "mp3"
+
+// streamIsFormat checks if the file at relPath is already in format, which
+// doesn't need to be one of streamFormats
+func streamIsFormat(relPath, format string) bool {
+	ext := strings.ToLower(path.Ext(relPath))
+	if f, ok := streamFormats[format]; ok {
+		for _, formatExt := range f.exts {
+			if ext == formatExt {
+				return true
+			}
+		}
+		return false
+	}
+	return ext == "."+strings.ToLower(format)
+}
+
+// streamDecide picks between streaming raw or transcoding. in order:
+//   - always raw rules. a file which matches is never transcoded, so a request with a
+//     lower maxBitRate than the file's is an error
+//   - format=raw from the request
+//   - raw if the file is already in the requested format, and within maxBitRate
+//   - the requested format, if it's one of streamFormats
+//   - the client's transcode preference
+//   - streamUncompressedProfile for uncompressed files
+//   - streamDefaultFormat at maxBitRate if the file is over it, else raw
+//   - maxBitRate from the request, which can only lower the profile's bitrate
+func streamDecide(rules []*db.RawRule, relPath string, bitrate int, pref *db.TranscodePreference, format string, maxBitRate int) (*streamDecision, error) {
+	for _, rule := range rules {
+		if !rule.Matches(relPath) {
+			continue
+		}
+		if maxBitRate > 0 && bitrate > maxBitRate {
+			return nil, fmt.Errorf("%w (%dk > %dk, rule %s %q)", errStreamRawOverMax, bitrate, maxBitRate, rule.Kind, rule.Pattern)
+		}
+		return &streamDecision{reason: fmt.Sprintf("always raw %s rule %q", rule.Kind, rule.Pattern)}, nil
+	}
+	if format == "raw" {
+		return &streamDecision{reason: "raw format requested"}, nil
+	}
+	withinMax := maxBitRate <= 0 || bitrate <= maxBitRate
+	requested, isRequested := streamFormats[format]
+	var profile transcode.Profile
+	var reason string
+	switch {
+	case format != "" && withinMax && streamIsFormat(relPath, format):
+		return &streamDecision{reason: fmt.Sprintf("file is already in the requested %s format", format)}, nil
+	case isRequested:
+		profile = requested.profile
+		reason = fmt.Sprintf("%s format requested", format)
+	case pref != nil:
+		var ok bool
+		if profile, ok = transcode.UserProfiles[pref.Profile]; !ok {
+			return nil, fmt.Errorf("unknown transcode user profile %q", pref.Profile)
+		}
+		reason = fmt.Sprintf("preference %q for client %q", pref.Profile, pref.Client)
+	case streamIsUncompressed(relPath):
+		profile = streamUncompressedProfile
+		reason = "uncompressed file and no transcode preference for client"
+	case !withinMax:
+		profile = transcode.WithBitrate(streamFormats[streamDefaultFormat].profile, transcode.BitRate(maxBitRate))
+		reason = fmt.Sprintf("file is over maxBitRate %dk and no transcode preference for client", maxBitRate)
+	default:
+		return &streamDecision{reason: "no transcode preference for client"}, nil
+	}
+	if maxBitRate > 0 && int(profile.BitRate()) > maxBitRate {
+		profile = transcode.WithBitrate(profile, transcode.BitRate(maxBitRate))
+		reason += fmt.Sprintf(", lowered to maxBitRate %dk", maxBitRate)
+	}
+	return &streamDecision{profile: &profile, reason: reason}, nil
+}
+
+// setTranscoded tells the client which format each of tracks will be streamed in
+// when it's transcoded. requests can ask for a different format or bitrate, so
+// this only goes by the always raw rules and the client's transcode preference
+func (c *Controller) setTranscoded(r *http.Request, tracks []*spec.TrackChild) {
+	if len(tracks) == 0 {
+		return
+	}
+	user, ok := r.Context().Value(CtxUser).(*db.User)
+	if !ok {
+		return
+	}
+	params := r.Context().Value(CtxParams).(params.Params)
+	pref, err := streamGetTransPref(c.DB, user.ID, params.GetOr("c", ""))
+	if err != nil {
+		log.Printf("error finding transcode preference: %v", err)
+		return
+	}
+	var rawRules []*db.RawRule
+	if err := c.DB.Find(&rawRules).Error; err != nil {
+		log.Printf("error finding always raw rules: %v", err)
+		return
+	}
+	for _, track := range tracks {
+		decision, err := streamDecide(rawRules, track.Path, track.Bitrate, pref, "", 0)
+		if err != nil || decision.profile == nil {
+			continue
+		}
+		track.TranscodedContentType = decision.profile.MIME()
+		track.TranscodedSuffix = decision.profile.Suffix()
+	}
+}
+
+// streamReplayGain returns file's replaygain tags. podcast episodes don't have any
+func streamReplayGain(file db.AudioFile) (track, album *float64) {
+	if t, ok := file.(*db.Track); ok {
+		return t.TagReplayGainTrack, t.TagReplayGainAlbum
+	}
+	return nil, nil
+}
+
+// streamRelPath is the path of file inside the music or podcasts dir, for matching
+// always raw rules
+func streamRelPath(file db.AudioFile) string {
+	switch f := file.(type) {
+	case *db.Track:
+		if f.Album == nil {
+			return f.Filename
+		}
+		return path.Join(f.Album.LeftPath, f.Album.RightPath, f.Filename)
+	case *db.PodcastEpisode:
+		return f.Path
+	default:
+		return file.AudioFilename()
+	}
+}
+
 func (c *Controller) ServeStream(w http.ResponseWriter, r *http.Request) *spec.Response {
 	params := r.Context().Value(CtxParams).(params.Params)
 	user := r.Context().Value(CtxUser).(*db.User)
@@ -254,41 +962,96 @@ func (c *Controller) ServeStream(w http.ResponseWriter, r *http.Request) *spec.R
 	if err != nil {
 		return spec.NewError(70, "error finding media: %v", err)
 	}
+	if !c.canStream(r, file) {
+		return spec.NewError(50, "user not allowed to access this music folder")
+	}
 
+	// a client checking that it still has the file hasn't played it again
+	var cached bool
 	if track, ok := file.(*db.Track); ok && track.Album != nil {
 		defer func() {
-			if err := streamUpdateStats(c.DB, user.ID, track.Album.ID, time.Now()); err != nil {
+			if cached {
+				return
+			}
+			if err := streamUpdateStats(c.DB, user.ID, track, time.Now()); err != nil {
 				log.Printf("error updating status: %v", err)
 			}
 		}()
 	}
 
-	if format, _ := params.Get("format"); format == "raw" {
-		http.ServeFile(w, r, audioPath)
-		return nil
+	var rawRules []*db.RawRule
+	if err := c.DB.Find(&rawRules).Error; err != nil {
+		return spec.NewError(0, "couldn't find always raw rules: %v", err)
 	}
-
 	pref, err := streamGetTransPref(c.DB, user.ID, params.GetOr("c", ""))
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		return spec.NewError(0, "couldn't find transcode preference: %v", err)
 	}
-	if pref == nil {
+	format, _ := params.Get("format")
+	maxBitRate, _ := params.GetInt("maxBitRate")
+	decision, err := streamDecide(rawRules, streamRelPath(file), file.AudioBitrate(), pref, format, maxBitRate)
+	if err != nil {
+		return spec.NewError(0, "%v", err)
+	}
+	// raw streams are never transcoded just to seek, clients can seek in them
+	// with range requests instead
+	timeOffset, _ := params.GetInt("timeOffset")
+	serveRaw := func() {
+		if timeOffset > 0 {
+			decision.reason += "; timeOffset ignored, use a range request"
+		}
+		w.Header().Set(streamDecisionHeader, decision.String())
+		// ServeFile checks the etag along with Last-Modified and ranges
+		if info, err := os.Stat(audioPath); err == nil {
+			etag := fileETag(audioPath, info)
+			w.Header().Set("ETag", etag)
+			cached = notModified(r, etag, info.ModTime())
+		}
+		// ServeFile doesn't know some audio types, eg. opus
+		ext := strings.ToLower(path.Ext(audioPath))
+		if contentType, ok := gmime.FromExtension(strings.TrimPrefix(ext, ".")); ok && mime.TypeByExtension(ext) == "" {
+			w.Header().Set("Content-Type", contentType)
+		}
 		http.ServeFile(w, r, audioPath)
+	}
+	if decision.profile == nil {
+		serveRaw()
 		return nil
 	}
-
-	profile, ok := transcode.UserProfiles[pref.Profile]
-	if !ok {
-		return spec.NewError(0, "unknown transcode user profile %q", pref.Profile)
+	profile := *decision.profile
+	if timeOffset > 0 {
+		profile = transcode.WithSeek(profile, time.Duration(timeOffset)*time.Second)
+		decision.profile = &profile
 	}
-	if max, _ := params.GetInt("maxBitRate"); max > 0 && int(profile.BitRate()) > max {
-		profile = transcode.WithBitrate(profile, transcode.BitRate(max))
+	if mode := transcode.ReplayGainMode(user.ReplayGain); mode != transcode.ReplayGainOff {
+		trackGain, albumGain := streamReplayGain(file)
+		profile = transcode.WithGain(profile, transcode.ReplayGain(mode, trackGain, albumGain))
+		decision.profile = &profile
+		if gain := profile.Gain(); gain != (transcode.Gain{}) {
+			decision.reason += fmt.Sprintf(", %s replay gain %s", mode, gain)
+		}
 	}
+	w.Header().Set(streamDecisionHeader, decision.String())
 
 	log.Printf("trancoding to %q with max bitrate %dk", profile.MIME(), profile.BitRate())
 
 	w.Header().Set("Content-Type", profile.MIME())
-	if err := c.Transcoder.Transcode(r.Context(), profile, audioPath, w); err != nil {
+	if params.GetOrBool("estimateContentLength", false) {
+		if length := streamEstimateLength(profile, file.AudioLength()); length > 0 {
+			w.Header().Set("Content-Length", strconv.Itoa(length))
+		}
+	}
+	err = c.Transcoder.Transcode(r.Context(), profile, audioPath, w)
+	if errors.Is(err, transcode.ErrBusy) {
+		// nothing was written, so there's still time to send the file as it is
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Length")
+		decision.profile = nil
+		decision.reason += "; too many transcodes running"
+		serveRaw()
+		return nil
+	}
+	if err != nil {
 		return spec.NewError(0, "error transcoding: %v", err)
 	}
 
@@ -297,3 +1060,30 @@ func (c *Controller) ServeStream(w http.ResponseWriter, r *http.Request) *spec.R
 	}
 	return nil
 }
+
+func (c *Controller) ServeGetAvatar(w http.ResponseWriter, r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	user := r.Context().Value(CtxUser).(*db.User)
+	username, err := params.Get("username")
+	if err != nil {
+		return spec.NewError(10, "please provide an `username` parameter")
+	}
+	if username != user.Name && !user.IsAdmin {
+		if public, _ := c.DB.GetSetting(avatar.SettingPublic); public != "true" {
+			return spec.NewError(50, "you can only see your own avatar")
+		}
+	}
+	avatarUser := c.DB.GetUserByName(username)
+	if avatarUser == nil {
+		return spec.NewError(70, "no user %q", username)
+	}
+	image, err := avatar.Image(c.DB, avatarUser, params.GetOrInt("size", avatar.DefaultSize))
+	if err != nil {
+		return spec.NewError(0, "error getting avatar: %v", err)
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if _, err := w.Write(image); err != nil {
+		log.Printf("error writing avatar: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,514 @@
+package ctrlsubsonic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/avatar"
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/transcode"
+)
+
+func TestGetAvatar(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	admin := contr.DB.GetUserByName(mockUsername)
+	other := &db.User{Name: "other", Password: "other"}
+	is.NoErr(contr.DB.Create(other).Error)
+	is.NoErr(contr.DB.SetAvatar(admin.ID, map[int][]byte{64: []byte("small"), 128: []byte("medium"), 256: []byte("large")}))
+
+	getAvatar := func(as *db.User, params url.Values) (string, int) {
+		rr, req := makeHTTPMock(params)
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, as))
+		contr.HR(contr.ServeGetAvatar).ServeHTTP(rr, req)
+		is.Equal(rr.Code, http.StatusOK)
+		if rr.Header().Get("Content-Type") == "image/png" {
+			return rr.Body.String(), 0
+		}
+		var resp spec.SubsonicResponse
+		is.NoErr(json.Unmarshal(rr.Body.Bytes(), &resp))
+		return "", resp.Response.Error.Code
+	}
+
+	image, _ := getAvatar(admin, url.Values{"username": {mockUsername}})
+	is.Equal(image, "medium") // default size
+	image, _ = getAvatar(admin, url.Values{"username": {mockUsername}, "size": {"200"}})
+	is.Equal(image, "large")
+
+	// users without an avatar get an identicon
+	identicon, err := avatar.Identicon("other", avatar.DefaultSize)
+	is.NoErr(err)
+	image, _ = getAvatar(other, url.Values{"username": {"other"}})
+	is.Equal(image, string(identicon))
+	image, _ = getAvatar(admin, url.Values{"username": {"other"}}) // admins can see anyone
+	is.Equal(image, string(identicon))
+
+	_, code := getAvatar(other, url.Values{"username": {mockUsername}})
+	is.Equal(code, 50) // not public
+	is.NoErr(contr.DB.SetSetting(avatar.SettingPublic, "true"))
+	image, _ = getAvatar(other, url.Values{"username": {mockUsername}})
+	is.Equal(image, "medium")
+
+	_, code = getAvatar(admin, url.Values{"username": {"nobody"}})
+	is.Equal(code, 70)
+	_, code = getAvatar(admin, url.Values{})
+	is.Equal(code, 10)
+}
+
+func TestStreamDecide(t *testing.T) {
+	t.Parallel()
+	rules := []*db.RawRule{
+		{Kind: db.RawRuleExtension, Pattern: "dsf"},
+		{Kind: db.RawRulePath, Pattern: "archive/**"},
+	}
+	opus := &db.TranscodePreference{Client: "test", Profile: "opus"}
+	cases := []struct {
+		name       string
+		path       string
+		bitrate    int
+		pref       *db.TranscodePreference
+		format     string
+		maxBitRate int
+		expRaw     bool
+		expBitRate int // of the profile, if not raw
+		expErr     error
+	}{
+		{"no preference", "a/b.flac", 1000, nil, "", 0, true, 0, nil},
+		{"preference", "a/b.flac", 1000, opus, "", 0, false, 96, nil},
+		{"preference lowered by max", "a/b.flac", 1000, opus, "", 64, false, 64, nil},
+		{"preference not raised by max", "a/b.flac", 1000, opus, "", 320, false, 96, nil},
+		{"raw format over preference", "a/b.flac", 1000, opus, "raw", 0, true, 0, nil},
+		{"extension rule over preference", "a/b.dsf", 5000, opus, "", 0, true, 0, nil},
+		{"path rule over preference", "archive/a/b.flac", 1000, opus, "", 0, true, 0, nil},
+		{"rule under max", "a/b.dsf", 5000, opus, "", 6000, true, 0, nil},
+		{"rule over max", "a/b.dsf", 5000, opus, "", 320, false, 0, errStreamRawOverMax},
+		{"rule over max with raw format", "a/b.dsf", 5000, nil, "raw", 320, false, 0, errStreamRawOverMax},
+		{"uncompressed without preference", "a/b.wav", 1411, nil, "", 0, false, 320, nil},
+		{"uncompressed lowered by max", "a/b.AIFF", 1411, nil, "", 128, false, 128, nil},
+		{"uncompressed with preference", "a/b.wav", 1411, opus, "", 0, false, 96, nil},
+		{"uncompressed with raw format", "a/b.wav", 1411, nil, "raw", 0, true, 0, nil},
+		{"format", "a/b.flac", 1000, nil, "opus", 0, false, 96, nil},
+		{"format over preference", "a/b.flac", 1000, opus, "mp3", 0, false, 128, nil},
+		{"format lowered by max", "a/b.flac", 1000, nil, "mp3", 64, false, 64, nil},
+		{"already in format", "a/b.MP3", 320, opus, "mp3", 0, true, 0, nil},
+		{"already in format under max", "a/b.opus", 96, nil, "opus", 128, true, 0, nil},
+		{"already in format over max", "a/b.mp3", 320, nil, "mp3", 128, false, 128, nil},
+		{"already in unknown format", "a/b.flac", 1000, opus, "flac", 0, true, 0, nil},
+		{"unknown format uses preference", "a/b.mp3", 320, opus, "flac", 0, false, 96, nil},
+		{"unknown format without preference", "a/b.mp3", 320, nil, "flac", 0, true, 0, nil},
+		{"over max without preference", "a/b.flac", 1000, nil, "", 192, false, 192, nil},
+		{"under max without preference", "a/b.mp3", 128, nil, "", 192, true, 0, nil},
+		{"unknown profile", "a/b.flac", 1000, &db.TranscodePreference{Profile: "nope"}, "", 0, false, 0, nil},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			decision, err := streamDecide(rules, tc.path, tc.bitrate, tc.pref, tc.format, tc.maxBitRate)
+			switch {
+			case tc.expErr != nil:
+				if !errors.Is(err, tc.expErr) {
+					t.Fatalf("expected error %v, got %v", tc.expErr, err)
+				}
+				return
+			case !tc.expRaw && tc.expBitRate == 0:
+				if err == nil {
+					t.Fatalf("expected an error, got %v", decision)
+				}
+				return
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if raw := decision.profile == nil; raw != tc.expRaw {
+				t.Fatalf("expected raw %t, got %v", tc.expRaw, decision)
+			}
+			if !tc.expRaw && int(decision.profile.BitRate()) != tc.expBitRate {
+				t.Fatalf("expected bitrate %d, got %v", tc.expBitRate, decision)
+			}
+		})
+	}
+}
+
+func TestGetCoverArt(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	contr.CoverCachePath = t.TempDir()
+
+	var album db.Album
+	is.NoErr(contr.DB.Where("right_path=? AND left_path=?", "album-0", "artist-0/").First(&album).Error)
+	coverPath := filepath.Join(album.RootDir, album.LeftPath, album.RightPath, album.Cover)
+	is.NoErr(imaging.Save(image.NewRGBA(image.Rect(0, 0, 1000, 500)), coverPath))
+
+	getCover := func(size string, header http.Header) (*httptest.ResponseRecorder, image.Config) {
+		rr, req := makeHTTPMock(url.Values{"id": {fmt.Sprintf("al-%d", album.ID)}, "size": {size}})
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		contr.HR(contr.ServeGetCoverArt).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			return rr, image.Config{}
+		}
+		config, format, err := image.DecodeConfig(rr.Body)
+		is.NoErr(err)
+		is.Equal(format, "png") // same as the source
+		return rr, config
+	}
+
+	rr, config := getCover("300", nil)
+	is.Equal(config.Width, 300) // aspect is kept
+	is.Equal(config.Height, 150)
+	etag := rr.Header().Get("ETag")
+	is.True(etag != "")
+
+	rr, _ = getCover("300", http.Header{"If-None-Match": {etag}})
+	is.Equal(rr.Code, http.StatusNotModified)
+
+	_, config = getCover("5000", nil)
+	is.Equal(config.Width, 1000) // capped, and never upscaled
+
+	// a changed cover is resized again
+	is.NoErr(imaging.Save(image.NewRGBA(image.Rect(0, 0, 400, 400)), coverPath))
+	is.NoErr(os.Chtimes(coverPath, time.Now(), time.Now().Add(time.Minute)))
+	rr, config = getCover("300", http.Header{"If-None-Match": {etag}})
+	is.Equal(rr.Code, http.StatusOK)
+	is.True(rr.Header().Get("ETag") != etag)
+	is.Equal(config.Width, 300)
+	is.Equal(config.Height, 300)
+}
+
+func TestGetCoverArtPlaylist(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	contr.CoverCachePath = t.TempDir()
+
+	var albums []*db.Album
+	is.NoErr(contr.DB.Where("cover<>''").Order("id").Limit(4).Find(&albums).Error)
+	is.Equal(len(albums), 4)
+	var trackIDs []int
+	for i, album := range albums {
+		coverPath := filepath.Join(album.RootDir, album.LeftPath, album.RightPath, album.Cover)
+		img := imaging.New(300, 300, color.Gray{Y: uint8(50 * (i + 1))})
+		is.NoErr(imaging.Save(img, coverPath))
+		var track db.Track
+		is.NoErr(contr.DB.Where("album_id=?", album.ID).First(&track).Error)
+		trackIDs = append(trackIDs, track.ID, track.ID) // repeated albums only count once
+	}
+
+	admin := contr.DB.GetUserByName(mockUsername)
+	playlist := &db.Playlist{UserID: admin.ID, Name: "mix"}
+	playlist.SetItems(trackIDs)
+	is.NoErr(contr.DB.Create(playlist).Error)
+
+	requestCover := func(user *db.User, size int) *httptest.ResponseRecorder {
+		rr, req := makeHTTPMock(url.Values{"id": {fmt.Sprintf("pl-%d", playlist.ID)}, "size": {strconv.Itoa(size)}})
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, user))
+		contr.HR(contr.ServeGetCoverArt).ServeHTTP(rr, req)
+		return rr
+	}
+	getCoverSize := func(size int) (*httptest.ResponseRecorder, image.Image) {
+		rr := requestCover(admin, size)
+		is.Equal(rr.Code, http.StatusOK)
+		img, err := imaging.Decode(rr.Body)
+		is.NoErr(err)
+		return rr, img
+	}
+	getCover := func() (*httptest.ResponseRecorder, image.Image) {
+		return getCoverSize(1200)
+	}
+
+	// a mosaic of the albums in playlist order
+	rr, img := getCover()
+	is.Equal(img.Bounds().Dx(), 1200)
+	is.Equal(img.Bounds().Dy(), 1200)
+	for i, pt := range []image.Point{{300, 300}, {900, 300}, {300, 900}, {900, 900}} {
+		y := color.GrayModel.Convert(img.At(pt.X, pt.Y)).(color.Gray).Y
+		is.True(int(y) > 50*(i+1)-5 && int(y) < 50*(i+1)+5)
+	}
+	etag := rr.Header().Get("ETag")
+
+	// other users can't see the cover of a private playlist, until it's public
+	other := &db.User{Name: "other", Password: "other"}
+	is.NoErr(contr.DB.Create(other).Error)
+	rr = requestCover(other, 1200)
+	is.Equal(rr.Header().Get("Content-Type"), "application/json")
+	is.True(strings.Contains(rr.Body.String(), `"code":70`))
+	is.NoErr(contr.DB.Model(playlist).Update("is_public", true).Error)
+	is.Equal(requestCover(other, 1200).Code, http.StatusOK)
+
+	// new albums make a new mosaic
+	playlist.SetItems(trackIDs[2:])
+	is.NoErr(contr.DB.Save(playlist).Error)
+	rr, _ = getCover()
+	is.True(rr.Header().Get("ETag") != etag)
+	etag = rr.Header().Get("ETag")
+
+	// an uploaded image is used instead
+	var buff bytes.Buffer
+	is.NoErr(imaging.Encode(&buff, imaging.New(100, 50, color.White), imaging.JPEG))
+	is.NoErr(contr.DB.Save(&db.PlaylistImage{PlaylistID: playlist.ID, Image: buff.Bytes()}).Error)
+	_, img = getCover()
+	is.Equal(img.Bounds().Dx(), 100)
+	is.Equal(img.Bounds().Dy(), 50)
+	// and resized like any other cover
+	_, img = getCoverSize(40)
+	is.Equal(img.Bounds().Dx(), 40)
+	is.Equal(img.Bounds().Dy(), 20)
+
+	// without it, the albums' covers are back
+	is.NoErr(contr.DB.Where("playlist_id=?", playlist.ID).Delete(db.PlaylistImage{}).Error)
+	rr, _ = getCover()
+	is.Equal(rr.Header().Get("ETag"), etag)
+
+	// and deleting the playlist deletes its image
+	is.NoErr(contr.DB.Save(&db.PlaylistImage{PlaylistID: playlist.ID, Image: buff.Bytes()}).Error)
+	is.NoErr(contr.DB.Delete(playlist).Error)
+	var count int
+	is.NoErr(contr.DB.Model(db.PlaylistImage{}).Where("playlist_id=?", playlist.ID).Count(&count).Error)
+	is.Equal(count, 0)
+}
+
+// seekTranscoder records the profile it was asked for, and writes nothing
+type seekTranscoder struct{ profile transcode.Profile }
+
+func (t *seekTranscoder) Transcode(_ context.Context, profile transcode.Profile, _ string, _ io.Writer) error {
+	t.profile = profile
+	return nil
+}
+
+func TestStreamTimeOffset(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	transcoder := &seekTranscoder{}
+	contr.Transcoder = transcoder
+
+	admin := contr.DB.GetUserByName(mockUsername)
+	var track db.Track
+	is.NoErr(contr.DB.First(&track).Error)
+	is.NoErr(contr.DB.Model(&track).UpdateColumns(map[string]interface{}{"length": 100, "bitrate": 900}).Error)
+
+	stream := func(query url.Values) *httptest.ResponseRecorder {
+		query.Set("id", fmt.Sprintf("tr-%d", track.ID))
+		rr, req := makeHTTPMock(query)
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, admin))
+		contr.HR(contr.ServeStream).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// without a preference the file is sent raw, and the offset is left to range requests
+	rr := stream(url.Values{"timeOffset": {"30"}})
+	is.Equal(rr.Code, http.StatusOK)
+	is.True(strings.Contains(rr.Header().Get(streamDecisionHeader), "timeOffset ignored"))
+
+	is.NoErr(contr.DB.Create(&db.TranscodePreference{UserID: admin.ID, Client: mockClientName, Profile: "opus"}).Error)
+
+	rr = stream(url.Values{"timeOffset": {"30"}, "estimateContentLength": {"true"}})
+	is.Equal(rr.Code, http.StatusOK)
+	is.Equal(transcoder.profile.Seek(), 30*time.Second)
+	is.Equal(rr.Header().Get("Content-Length"), fmt.Sprint(96*1000/8*70)) // 96k for the 70s left
+	is.True(strings.Contains(rr.Header().Get(streamDecisionHeader), "from 30s"))
+
+	rr = stream(url.Values{})
+	is.Equal(transcoder.profile.Seek(), time.Duration(0))
+	is.Equal(rr.Header().Get("Content-Length"), "")
+}
+
+func TestStreamFormat(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	transcoder := &seekTranscoder{}
+	contr.Transcoder = transcoder
+
+	admin := contr.DB.GetUserByName(mockUsername)
+	var track db.Track
+	is.NoErr(contr.DB.First(&track).Error)
+	is.NoErr(contr.DB.Model(&track).UpdateColumns(map[string]interface{}{"bitrate": 900}).Error)
+	is.NoErr(contr.DB.Create(&db.TranscodePreference{UserID: admin.ID, Client: mockClientName, Profile: "opus"}).Error)
+
+	rr, req := makeHTTPMock(url.Values{"id": {fmt.Sprintf("tr-%d", track.ID)}, "format": {"mp3"}, "maxBitRate": {"64"}})
+	req = req.WithContext(context.WithValue(req.Context(), CtxUser, admin))
+	contr.HR(contr.ServeStream).ServeHTTP(rr, req)
+	is.Equal(rr.Code, http.StatusOK)
+	is.Equal(rr.Header().Get("Content-Type"), "audio/mpeg") // the format, not the preference
+	is.Equal(transcoder.profile.BitRate(), transcode.BitRate(64))
+}
+
+func TestStreamConditional(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeControllerAudio(t)
+
+	admin := contr.DB.GetUserByName(mockUsername)
+	var track db.Track
+	is.NoErr(contr.DB.First(&track).Error)
+	get := func(handler handlerSubsonicRaw, header http.Header) *httptest.ResponseRecorder {
+		rr, req := makeHTTPMock(url.Values{"id": {fmt.Sprintf("tr-%d", track.ID)}})
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, admin))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		contr.HR(handler).ServeHTTP(rr, req)
+		return rr
+	}
+	plays := func() int {
+		var count int
+		is.NoErr(contr.DB.Model(&db.TrackPlay{}).Where("track_id=?", track.ID).Select("coalesce(sum(count), 0)").Row().Scan(&count))
+		return count
+	}
+
+	rr := get(contr.ServeStream, nil)
+	is.Equal(rr.Code, http.StatusOK)
+	etag := rr.Header().Get("ETag")
+	lastModified := rr.Header().Get("Last-Modified")
+	is.True(etag != "")
+	is.True(lastModified != "")
+	is.Equal(plays(), 1)
+
+	// the client already has it, so it's not played again
+	rr = get(contr.ServeStream, http.Header{"If-None-Match": {etag}})
+	is.Equal(rr.Code, http.StatusNotModified)
+	is.Equal(rr.Body.Len(), 0)
+	rr = get(contr.ServeStream, http.Header{"If-Modified-Since": {lastModified}})
+	is.Equal(rr.Code, http.StatusNotModified)
+	is.Equal(plays(), 1)
+
+	// a stale etag gets the file, and ranges still work alongside it
+	rr = get(contr.ServeStream, http.Header{"If-None-Match": {`"stale"`}, "Range": {"bytes=0-9"}})
+	is.Equal(rr.Code, http.StatusPartialContent)
+	is.Equal(rr.Body.Len(), 10)
+	is.Equal(rr.Header().Get("ETag"), etag)
+	rr = get(contr.ServeStream, http.Header{"If-Range": {etag}, "Range": {"bytes=0-9"}})
+	is.Equal(rr.Code, http.StatusPartialContent)
+
+	// downloads are the same file with the same etag
+	rr = get(contr.ServeDownload, nil)
+	is.Equal(rr.Code, http.StatusOK)
+	is.Equal(rr.Header().Get("ETag"), etag)
+	rr = get(contr.ServeDownload, http.Header{"If-None-Match": {etag}})
+	is.Equal(rr.Code, http.StatusNotModified)
+	rr = get(contr.ServeDownload, http.Header{"If-Modified-Since": {lastModified}})
+	is.Equal(rr.Code, http.StatusNotModified)
+}
+
+func TestStreamReplayGain(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	transcoder := &seekTranscoder{}
+	contr.Transcoder = transcoder
+
+	admin := contr.DB.GetUserByName(mockUsername)
+	var track db.Track
+	is.NoErr(contr.DB.First(&track).Error)
+	is.NoErr(contr.DB.Model(&track).UpdateColumns(map[string]interface{}{"tag_replay_gain_track": -6.5}).Error)
+	is.NoErr(contr.DB.Create(&db.TranscodePreference{UserID: admin.ID, Client: mockClientName, Profile: "opus_128"}).Error)
+
+	stream := func() *httptest.ResponseRecorder {
+		rr, req := makeHTTPMock(url.Values{"id": {fmt.Sprintf("tr-%d", track.ID)}})
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, admin))
+		contr.HR(contr.ServeStream).ServeHTTP(rr, req)
+		return rr
+	}
+
+	stream()
+	is.Equal(transcoder.profile.Gain(), transcode.Gain{})
+
+	admin.ReplayGain = string(transcode.ReplayGainAlbum)
+	rr := stream()
+	is.Equal(transcoder.profile.Gain(), transcode.Gain{DB: -6.5}) // no album gain, so the track's
+	is.True(strings.Contains(rr.Header().Get(streamDecisionHeader), "album replay gain -6.50dB"))
+}
+
+// busyTranscoder is always waiting on other transcodes
+type busyTranscoder struct{}
+
+func (busyTranscoder) Transcode(context.Context, transcode.Profile, string, io.Writer) error {
+	return fmt.Errorf("internal transcode: %w", transcode.ErrBusy)
+}
+
+func TestStreamBusy(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	contr.Transcoder = busyTranscoder{}
+
+	admin := contr.DB.GetUserByName(mockUsername)
+	var track db.Track
+	is.NoErr(contr.DB.First(&track).Error)
+	is.NoErr(contr.DB.Model(&track).UpdateColumns(map[string]interface{}{"length": 100, "bitrate": 900}).Error)
+	is.NoErr(contr.DB.Create(&db.TranscodePreference{UserID: admin.ID, Client: mockClientName, Profile: "opus"}).Error)
+
+	rr, req := makeHTTPMock(url.Values{"id": {fmt.Sprintf("tr-%d", track.ID)}, "estimateContentLength": {"true"}})
+	req = req.WithContext(context.WithValue(req.Context(), CtxUser, admin))
+	contr.HR(contr.ServeStream).ServeHTTP(rr, req)
+
+	// sent raw rather than failing
+	is.Equal(rr.Code, http.StatusOK)
+	is.True(strings.HasPrefix(rr.Header().Get(streamDecisionHeader), "raw; "))
+	is.True(strings.Contains(rr.Header().Get(streamDecisionHeader), "too many transcodes running"))
+	is.True(rr.Header().Get("Content-Type") != "audio/ogg")
+}
+
+func TestTranscodedFields(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	admin := contr.DB.GetUserByName(mockUsername)
+	var track db.Track
+	is.NoErr(contr.DB.Preload("Album").First(&track).Error)
+
+	getDirectory := func() []*spec.TrackChild {
+		rr, req := makeHTTPMock(url.Values{"id": {track.Album.SID().String()}})
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, admin))
+		contr.H(contr.ServeGetMusicDirectory).ServeHTTP(rr, req)
+		is.Equal(rr.Code, http.StatusOK)
+		var resp spec.SubsonicResponse
+		is.NoErr(json.Unmarshal(rr.Body.Bytes(), &resp))
+		is.True(len(resp.Response.Directory.Children) > 0)
+		return resp.Response.Directory.Children
+	}
+
+	// without a preference the tracks are streamed raw
+	for _, child := range getDirectory() {
+		is.Equal(child.TranscodedContentType, "")
+		is.Equal(child.TranscodedSuffix, "")
+	}
+
+	is.NoErr(contr.DB.Create(&db.TranscodePreference{UserID: admin.ID, Client: mockClientName, Profile: "opus_128"}).Error)
+	for _, child := range getDirectory() {
+		is.Equal(child.TranscodedContentType, "audio/ogg")
+		is.Equal(child.TranscodedSuffix, "ogg")
+	}
+
+	// unless they always are
+	is.NoErr(contr.DB.Create(&db.RawRule{Kind: db.RawRuleExtension, Pattern: path.Ext(track.Filename)}).Error)
+	for _, child := range getDirectory() {
+		is.Equal(child.TranscodedSuffix, "")
+	}
+}
@@ -0,0 +1,47 @@
+package ctrlsubsonic
+
+import (
+	"net/http"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
+	"go.senan.xyz/gonic/together"
+)
+
+const playedTogetherMax = 50
+
+// ServeGetAlbumsPlayedTogether is a gonic extension which suggests albums by
+// other artists which are often played in the same session as the album `id`
+func (c *Controller) ServeGetAlbumsPlayedTogether(r *http.Request) *spec.Response {
+	params := r.Context().Value(CtxParams).(params.Params)
+	id, err := params.GetID("id")
+	if err != nil || id.Type != specid.Album {
+		return spec.NewError(10, "please provide an album `id` parameter")
+	}
+	count := params.GetOrInt("count", 10)
+	if count <= 0 || count > playedTogetherMax {
+		count = playedTogetherMax
+	}
+	var album db.Album
+	if err := c.DB.Select("id, root_dir").First(&album, id.Value).Error; err != nil {
+		return spec.NewError(70, "couldn't find an album with that id")
+	}
+	if !c.canSeeRoot(r, album.RootDir) {
+		return spec.NewError(50, "user not allowed to access this music folder")
+	}
+	albums, fromListens, err := together.Suggest(c.DB, id.Value, count, c.musicFolderRoots(r))
+	if err != nil {
+		return spec.NewError(70, "couldn't find suggestions: %v", err)
+	}
+	sub := spec.NewResponse()
+	sub.PlayedTogether = &spec.PlayedTogether{
+		FromListens: fromListens,
+		List:        make([]*spec.Album, len(albums)),
+	}
+	for i, album := range albums {
+		sub.PlayedTogether.List[i] = spec.NewAlbumByTags(album, album.TagArtist)
+	}
+	return sub
+}
@@ -0,0 +1,54 @@
+package ctrlsubsonic
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/together"
+)
+
+func TestGetAlbumsPlayedTogether(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+
+	var albums []*db.Album
+	is.NoErr(contr.DB.Where("tag_artist_id IS NOT NULL").Order("id").Find(&albums).Error)
+	is.True(len(albums) >= 4)
+	album, sameArtist := albums[0], albums[1]
+	var other *db.Album
+	for _, a := range albums {
+		if a.TagArtistID != album.TagArtistID {
+			other = a
+			break
+		}
+	}
+	is.True(other != nil)
+
+	user := contr.DB.GetUserByName(mockUsername)
+	base := time.Now()
+	for i, a := range []*db.Album{album, sameArtist, other} {
+		listen := &db.Listen{UserID: user.ID, AlbumID: a.ID, Time: base.Add(time.Duration(i) * time.Minute)}
+		is.NoErr(contr.DB.Create(listen).Error)
+	}
+	_, err := together.Update(contr.DB)
+	is.NoErr(err)
+
+	_, req := makeHTTPMock(url.Values{"id": {"tr-1"}})
+	resp := contr.ServeGetAlbumsPlayedTogether(req)
+	is.True(resp.Error != nil)
+	is.Equal(resp.Error.Code, 10)
+
+	// the album by the same artist isn't suggested
+	_, req = makeHTTPMock(url.Values{"id": {"al-" + strconv.Itoa(album.ID)}})
+	resp = contr.ServeGetAlbumsPlayedTogether(req)
+	is.True(resp.Error == nil)
+	is.True(resp.PlayedTogether.FromListens)
+	is.Equal(len(resp.PlayedTogether.List), 1)
+	is.Equal(resp.PlayedTogether.List[0].ID.Value, other.ID)
+}
@@ -0,0 +1,239 @@
+package ctrlsubsonic
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+)
+
+func (c *Controller) specUser(user *db.User) *spec.User {
+	folders := c.musicFolders(user)
+	folderIDs := make([]int, len(folders))
+	for i, folder := range folders {
+		folderIDs[i] = folder.ID
+	}
+	return &spec.User{
+		Username:          user.Name,
+		AdminRole:         user.IsAdmin,
+		SettingsRole:      user.CanWrite(),
+		DownloadRole:      true,
+		StreamRole:        true,
+		PlaylistRole:      user.CanWrite(),
+		JukeboxRole:       c.Jukebox != nil && user.CanWrite(),
+		PodcastRole:       c.Podcasts != nil && user.IsAdmin,
+		ScrobblingEnabled: user.CanWrite() && (user.LastFMSession != "" || user.ListenBrainzToken != "" || user.MalojaAPIKey != ""),
+		Folder:            folderIDs,
+	}
+}
+
+func (c *Controller) ServeGetUsers(r *http.Request) *spec.Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	if !user.IsAdmin {
+		return spec.NewError(50, "user not admin")
+	}
+	var users []*db.User
+	if err := c.DB.Order("name").Find(&users).Error; err != nil {
+		return spec.NewError(0, "find users: %v", err)
+	}
+	sub := spec.NewResponse()
+	sub.Users = &spec.Users{List: make([]*spec.User, len(users))}
+	for i, user := range users {
+		sub.Users.List[i] = c.specUser(user)
+	}
+	return sub
+}
+
+func (c *Controller) ServeCreateUser(r *http.Request) *spec.Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	if !user.IsAdmin {
+		return spec.NewError(50, "user not admin")
+	}
+	params := r.Context().Value(CtxParams).(params.Params)
+	username, err := params.Get("username")
+	if err != nil {
+		return spec.NewError(10, "please provide a `username` parameter")
+	}
+	password, err := paramPassword(params)
+	if err != nil {
+		return spec.NewError(10, "please provide a `password` parameter")
+	}
+	if c.DB.GetUserByName(username) != nil {
+		return spec.NewError(0, "user %q already exists", username)
+	}
+	folderIDs, err := c.paramMusicFolderIDs(params)
+	if errors.Is(err, errMusicFolderIDInvalid) {
+		return spec.NewError(10, "%v", err)
+	}
+	if err != nil {
+		return spec.NewError(70, "%v", err)
+	}
+	newUser := db.User{
+		Name:       username,
+		Password:   password,
+		IsAdmin:    params.GetOrBool("adminRole", false),
+		IsReadOnly: !params.GetOrBool("settingsRole", true),
+	}
+	// without their folders, they'd see all of them
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&newUser).Error; err != nil {
+			return fmt.Errorf("create user: %w", err)
+		}
+		if err := db.SetUserMusicFolders(tx, newUser.ID, folderIDs); err != nil {
+			return fmt.Errorf("set music folders: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return spec.NewError(0, "%v", err)
+	}
+	return spec.NewResponse()
+}
+
+func (c *Controller) ServeUpdateUser(r *http.Request) *spec.Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	if !user.IsAdmin {
+		return spec.NewError(50, "user not admin")
+	}
+	params := r.Context().Value(CtxParams).(params.Params)
+	username, err := params.Get("username")
+	if err != nil {
+		return spec.NewError(10, "please provide a `username` parameter")
+	}
+	target := c.DB.GetUserByName(username)
+	if target == nil {
+		return spec.NewError(70, "user %q not found", username)
+	}
+	if _, err := params.Get("password"); err == nil {
+		password, err := paramPassword(params)
+		if err != nil {
+			return spec.NewError(10, "please provide a non empty `password` parameter")
+		}
+		target.Password = password
+	}
+	if admin, err := params.GetBool("adminRole"); err == nil {
+		if !admin && target.ID == user.ID {
+			return spec.NewError(0, "you can't remove your own admin role")
+		}
+		target.IsAdmin = admin
+	}
+	if settings, err := params.GetBool("settingsRole"); err == nil {
+		target.IsReadOnly = !settings
+	}
+	folderIDs, err := c.paramMusicFolderIDs(params)
+	if errors.Is(err, errMusicFolderIDInvalid) {
+		return spec.NewError(10, "%v", err)
+	}
+	if err != nil {
+		return spec.NewError(70, "%v", err)
+	}
+	err = c.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(target).Error; err != nil {
+			return fmt.Errorf("save user: %w", err)
+		}
+		if folderIDs == nil {
+			return nil
+		}
+		if err := db.SetUserMusicFolders(tx, target.ID, folderIDs); err != nil {
+			return fmt.Errorf("set music folders: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return spec.NewError(0, "%v", err)
+	}
+	return spec.NewResponse()
+}
+
+// paramPassword is the decoded `password` param, which can't be empty, even
+// once it's decoded
+func paramPassword(params params.Params) (string, error) {
+	password, err := params.Get("password")
+	if err != nil {
+		return "", err
+	}
+	if password = decodePassword(password); password == "" {
+		return "", errors.New("empty password")
+	}
+	return password, nil
+}
+
+var errMusicFolderIDInvalid = errors.New("please provide numbers for the `musicFolderId` parameters")
+
+// paramMusicFolderIDs are the folders in the `musicFolderId` params, or nil if
+// there aren't any
+func (c *Controller) paramMusicFolderIDs(p params.Params) ([]int, error) {
+	ids, err := p.GetIntList("musicFolderId")
+	if errors.Is(err, params.ErrNoValues) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errMusicFolderIDInvalid
+	}
+	for _, id := range ids {
+		var found bool
+		for _, folder := range c.MusicFolders {
+			found = found || folder.ID == id
+		}
+		if !found {
+			return nil, fmt.Errorf("music folder with id `%d` not found", id)
+		}
+	}
+	return ids, nil
+}
+
+func (c *Controller) ServeDeleteUser(r *http.Request) *spec.Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	if !user.IsAdmin {
+		return spec.NewError(50, "user not admin")
+	}
+	params := r.Context().Value(CtxParams).(params.Params)
+	username, err := params.Get("username")
+	if err != nil {
+		return spec.NewError(10, "please provide a `username` parameter")
+	}
+	target := c.DB.GetUserByName(username)
+	if target == nil {
+		return spec.NewError(70, "user %q not found", username)
+	}
+	if target.IsAdmin {
+		return spec.NewError(0, "can't delete an admin user")
+	}
+	if err := c.DB.Delete(target).Error; err != nil {
+		return spec.NewError(0, "delete user: %v", err)
+	}
+	return spec.NewResponse()
+}
+
+// ServeChangePassword changes the user's own password, or anyone's for admins
+func (c *Controller) ServeChangePassword(r *http.Request) *spec.Response {
+	user := r.Context().Value(CtxUser).(*db.User)
+	params := r.Context().Value(CtxParams).(params.Params)
+	username, err := params.Get("username")
+	if err != nil {
+		return spec.NewError(10, "please provide a `username` parameter")
+	}
+	password, err := paramPassword(params)
+	if err != nil {
+		return spec.NewError(10, "please provide a `password` parameter")
+	}
+	target := user
+	if username != user.Name {
+		if !user.IsAdmin {
+			return spec.NewError(50, "user not admin")
+		}
+		if target = c.DB.GetUserByName(username); target == nil {
+			return spec.NewError(70, "user %q not found", username)
+		}
+	}
+	target.Password = password
+	if err := c.DB.Save(target).Error; err != nil {
+		return spec.NewError(0, "save user: %v", err)
+	}
+	return spec.NewResponse()
+}
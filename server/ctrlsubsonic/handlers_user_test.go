@@ -0,0 +1,149 @@
+package ctrlsubsonic
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+)
+
+func TestUserManagement(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := makeController(t)
+	admin := m.DB.GetUserByName(mockUsername)
+
+	query := func(h handlerSubsonic, as *db.User, q url.Values) *spec.SubsonicResponse {
+		rr, req := makeHTTPMock(q)
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, as))
+		m.H(h).ServeHTTP(rr, req)
+		var resp spec.SubsonicResponse
+		is.NoErr(json.Unmarshal(rr.Body.Bytes(), &resp))
+		return &resp
+	}
+
+	resp := query(m.ServeCreateUser, admin, url.Values{
+		"username": {"bob"},
+		"password": {"enc:" + hex.EncodeToString([]byte("hunter2"))},
+	})
+	is.Equal(resp.Response.Status, "ok")
+	bob := m.DB.GetUserByName("bob")
+	is.Equal(bob.Password, "hunter2") // decoded
+	is.True(!bob.IsAdmin)
+
+	// no empty passwords, encoded or not
+	resp = query(m.ServeCreateUser, admin, url.Values{"username": {"eve"}, "password": {"enc:"}})
+	is.Equal(resp.Response.Error.Code, 10)
+	is.True(m.DB.GetUserByName("eve") == nil)
+	resp = query(m.ServeUpdateUser, admin, url.Values{"username": {"bob"}, "password": {""}})
+	is.Equal(resp.Response.Error.Code, 10)
+	is.Equal(m.DB.GetUserByName("bob").Password, "hunter2")
+
+	resp = query(m.ServeCreateUser, bob, url.Values{"username": {"eve"}, "password": {"x"}})
+	is.Equal(resp.Response.Error.Code, 50) // only admins
+	resp = query(m.ServeGetUsers, bob, url.Values{})
+	is.Equal(resp.Response.Error.Code, 50)
+	resp = query(m.ServeGetUser, bob, url.Values{"username": {mockUsername}})
+	is.Equal(resp.Response.Error.Code, 50)
+
+	resp = query(m.ServeGetUsers, admin, url.Values{})
+	is.Equal(len(resp.Response.Users.List), 2)
+	resp = query(m.ServeGetUser, admin, url.Values{"username": {"bob"}})
+	is.Equal(resp.Response.User.Username, "bob")
+
+	// users can change their own password, but not someone else's
+	resp = query(m.ServeChangePassword, bob, url.Values{"username": {"bob"}, "password": {"hunter3"}})
+	is.Equal(resp.Response.Status, "ok")
+	is.Equal(m.DB.GetUserByName("bob").Password, "hunter3")
+	resp = query(m.ServeChangePassword, bob, url.Values{"username": {mockUsername}, "password": {"x"}})
+	is.Equal(resp.Response.Error.Code, 50)
+
+	resp = query(m.ServeUpdateUser, admin, url.Values{"username": {"bob"}, "adminRole": {"true"}})
+	is.Equal(resp.Response.Status, "ok")
+	is.True(m.DB.GetUserByName("bob").IsAdmin)
+	resp = query(m.ServeDeleteUser, admin, url.Values{"username": {"bob"}})
+	is.Equal(resp.Response.Status, "failed") // admins can't be deleted
+	resp = query(m.ServeUpdateUser, admin, url.Values{"username": {"bob"}, "adminRole": {"false"}})
+	is.Equal(resp.Response.Status, "ok")
+	resp = query(m.ServeDeleteUser, admin, url.Values{"username": {"bob"}})
+	is.Equal(resp.Response.Status, "ok")
+	is.True(m.DB.GetUserByName("bob") == nil)
+}
+
+func TestReadOnlyUser(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := makeController(t)
+	guest := &db.User{Name: "guest", Password: "guest", IsReadOnly: true}
+	is.NoErr(m.DB.Create(guest).Error)
+	var track db.Track
+	is.NoErr(m.DB.First(&track).Error)
+	trackID := "tr-" + strconv.Itoa(track.ID)
+
+	query := func(h handlerSubsonic, q url.Values) *spec.Response {
+		_, req := makeHTTPMock(q)
+		return h(req.WithContext(context.WithValue(req.Context(), CtxUser, guest)))
+	}
+
+	// they can browse
+	resp := query(m.ServeGetSong, url.Values{"id": {trackID}})
+	is.True(resp.Error == nil)
+
+	// but not change anything
+	resp = query(m.ServeCreatePlaylist, url.Values{"name": {"mine"}})
+	is.Equal(resp.Error.Code, 50)
+	resp = query(m.ServeSavePlayQueue, url.Values{"id": {trackID}})
+	is.Equal(resp.Error.Code, 50)
+	resp = query(m.ServeStartScan, url.Values{})
+	is.Equal(resp.Error.Code, 50)
+	var playlists int
+	is.NoErr(m.DB.Model(db.Playlist{}).Count(&playlists).Error)
+	is.Equal(playlists, 0)
+
+	resp = query(m.ServeGetUser, url.Values{})
+	is.True(resp.User.StreamRole)
+	is.True(!resp.User.PlaylistRole)
+	is.True(!resp.User.SettingsRole)
+	is.True(!resp.User.JukeboxRole)
+}
+
+func TestUserRoleParams(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := makeControllerRoots(t, []string{"m-0", "m-1"})
+	admin := m.DB.GetUserByName(mockUsername)
+
+	query := func(h handlerSubsonic, q url.Values) *spec.Response {
+		_, req := makeHTTPMock(q)
+		return h(req.WithContext(context.WithValue(req.Context(), CtxUser, admin)))
+	}
+
+	resp := query(m.ServeCreateUser, url.Values{
+		"username":      {"kid"},
+		"password":      {"kid"},
+		"settingsRole":  {"false"},
+		"musicFolderId": {strconv.Itoa(m.MusicFolders[1].ID)},
+	})
+	is.True(resp.Error == nil)
+	kid := m.DB.GetUserByName("kid")
+	is.True(kid.IsReadOnly)
+	resp = query(m.ServeGetUser, url.Values{"username": {"kid"}})
+	is.Equal(resp.User.Folder, []int{m.MusicFolders[1].ID})
+
+	resp = query(m.ServeUpdateUser, url.Values{"username": {"kid"}, "musicFolderId": {"99"}})
+	is.Equal(resp.Error.Code, 70) // no such folder
+	resp = query(m.ServeUpdateUser, url.Values{"username": {"kid"}, "musicFolderId": {"all"}})
+	is.Equal(resp.Error.Code, 10)
+	resp = query(m.ServeUpdateUser, url.Values{"username": {"kid"}, "settingsRole": {"true"}})
+	is.True(resp.Error == nil)
+	is.True(!m.DB.GetUserByName("kid").IsReadOnly)
+	resp = query(m.ServeGetUser, url.Values{"username": {"kid"}})
+	is.Equal(resp.User.Folder, []int{m.MusicFolders[1].ID}) // left as they were
+}
@@ -3,32 +3,72 @@ package ctrlsubsonic
 import (
 	"context"
 	"crypto/md5"
+	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
+	"path"
+	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
+
+	"go.senan.xyz/gonic/authlimit"
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlbase"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/params"
 	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+	"go.senan.xyz/gonic/streamsign"
 )
 
 func checkCredsToken(password, token, salt string) bool {
 	toHash := fmt.Sprintf("%s%s", password, salt)
 	hash := md5.Sum([]byte(toHash))
 	expToken := hex.EncodeToString(hash[:])
-	return token == expToken
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(token)), []byte(expToken)) == 1
 }
 
-func checkCredsBasic(password, given string) bool {
+// decodePassword decodes a password which the client hex encoded, with `enc:`
+func decodePassword(given string) string {
 	if len(given) >= 4 && given[:4] == "enc:" {
 		bytes, _ := hex.DecodeString(given[4:])
 		given = string(bytes)
 	}
-	return password == given
+	return given
+}
+
+func checkCredsBasic(password, given string) bool {
+	return password == decodePassword(given)
+}
+
+// checkCreds checks every set of credentials the client provided. a request
+// with both `p` and `t` is only allowed if they agree with each other
+func checkCreds(password, given, token, salt string) bool {
+	if given != "" && !checkCredsBasic(password, given) {
+		return false
+	}
+	if token != "" && !checkCredsToken(password, token, salt) {
+		return false
+	}
+	return true
+}
+
+// withUser is r for the user, who is logged with it
+func withUser(r *http.Request, user *db.User) *http.Request {
+	if rl := ctrlbase.RequestLogOf(r); rl != nil {
+		rl.User = user.Name
+	}
+	return r.WithContext(context.WithValue(r.Context(), CtxUser, user))
 }
 
 func (c *Controller) WithParams(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		params := params.New(r)
+		if rl := ctrlbase.RequestLogOf(r); rl != nil {
+			rl.View = viewName(r)
+			rl.Client = params.GetOr("c", "")
+		}
 		withParams := context.WithValue(r.Context(), CtxParams, params)
 		next.ServeHTTP(w, r.WithContext(withParams))
 	})
@@ -40,8 +80,17 @@ func (c *Controller) WithRequiredParams(next http.Handler) http.Handler {
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		params := r.Context().Value(CtxParams).(params.Params)
+		hasProxyUser := isProxyUser(r)
 		for _, req := range requiredParameters {
 			if _, err := params.Get(req); err != nil {
+				if _, err := params.Get("apiKey"); err == nil && req == "u" {
+					// the key identifies the user
+					continue
+				}
+				if hasProxyUser && req == "u" {
+					// and so does the proxy
+					continue
+				}
 				_ = writeResp(w, r, spec.NewError(10,
 					"please provide a `%s` parameter", req))
 				return
@@ -51,8 +100,55 @@ func (c *Controller) WithRequiredParams(next http.Handler) http.Handler {
 	})
 }
 
+// errNotSetUp is returned until the first admin is created from the setup page
+const errNotSetUp = "server not configured, please create an admin from gonic's web interface or command line"
+
+// isSetUp is checked when a user isn't found, so that clients can say why
+// instead of it looking like the wrong password
+func (c *Controller) isSetUp() bool {
+	hasUsers, err := c.DB.HasUsers()
+	return err != nil || hasUsers
+}
+
+// WithProxyUser logs the user in by the header of a trusted reverse proxy
+// instead of their credentials, if ProxyAuth is on for the subsonic api. it
+// goes before WithRequiredParams and WithUser
+func (c *Controller) WithProxyUser(next http.Handler) http.Handler {
+	if c.ProxyAuth == nil || !c.ProxyAuth.Subsonic {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := c.ProxyUser(r)
+		if err != nil {
+			_ = writeResp(w, r, spec.NewError(0, "get user from proxy: %v", err))
+			return
+		}
+		if user == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		params := r.Context().Value(CtxParams).(params.Params)
+		if username, _ := params.Get("u"); username != "" && username != user.Name {
+			_ = writeResp(w, r, spec.NewError(40,
+				"username `%s` isn't the one from the proxy", username))
+			return
+		}
+		r = withUser(r, user)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxProxyUser, true)))
+	})
+}
+
+func isProxyUser(r *http.Request) bool {
+	ok, _ := r.Context().Value(ctxProxyUser).(bool)
+	return ok
+}
+
 func (c *Controller) WithUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isProxyUser(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
 		params := r.Context().Value(CtxParams).(params.Params)
 		// ignoring errors here, a middleware has already ensured they exist
 		username, _ := params.Get("u")
@@ -60,30 +156,190 @@ func (c *Controller) WithUser(next http.Handler) http.Handler {
 		token, _ := params.Get("t")
 		salt, _ := params.Get("s")
 
-		passwordAuth := token == "" && salt == ""
-		tokenAuth := password == ""
-		if tokenAuth == passwordAuth {
+		// https://opensubsonic.netlify.app/docs/extensions/apikeyauth/
+		if apiKey, _ := params.Get("apiKey"); apiKey != "" {
+			if username != "" || password != "" || token != "" || salt != "" {
+				_ = writeResp(w, r, spec.NewError(43,
+					"please provide either `apiKey`, or `u` with credentials"))
+				return
+			}
+			ip := c.ClientIP(r)
+			if !c.waitAuthLimit(w, r, ip, "") {
+				return
+			}
+			user := c.DB.GetUserByAPIKey(apiKey)
+			if user == nil && !c.isSetUp() {
+				_ = writeResp(w, r, spec.NewError(0, errNotSetUp))
+				return
+			}
+			if user == nil {
+				c.AuthLimit.Fail(ip, "")
+				_ = writeResp(w, r, spec.NewError(44, "invalid api key"))
+				return
+			}
+			c.AuthLimit.Succeed(ip, "")
+			next.ServeHTTP(w, withUser(r, user))
+			return
+		}
+		if (token == "") != (salt == "") {
+			_ = writeResp(w, r, spec.NewError(10,
+				"please provide both `t` and `s`"))
+			return
+		}
+		if token == "" && password == "" {
 			_ = writeResp(w, r, spec.NewError(10,
 				"please provide `t` and `s`, or just `p`"))
 			return
 		}
+		ip := c.ClientIP(r)
+		if !c.waitAuthLimit(w, r, ip, username) {
+			return
+		}
 		user := c.DB.GetUserByName(username)
+		if user == nil && !c.isSetUp() {
+			_ = writeResp(w, r, spec.NewError(0, errNotSetUp))
+			return
+		}
 		if user == nil {
+			c.AuthLimit.Fail(ip, username)
 			_ = writeResp(w, r, spec.NewError(40,
 				"invalid username `%s`", username))
 			return
 		}
-		var credsOk bool
-		if tokenAuth {
-			credsOk = checkCredsToken(user.Password, token, salt)
-		} else {
-			credsOk = checkCredsBasic(user.Password, password)
-		}
-		if !credsOk {
+		if !checkCreds(user.Password, password, token, salt) {
+			c.AuthLimit.Fail(ip, username)
 			_ = writeResp(w, r, spec.NewError(40, "invalid password"))
 			return
 		}
-		withUser := context.WithValue(r.Context(), CtxUser, user)
-		next.ServeHTTP(w, r.WithContext(withUser))
+		c.AuthLimit.Succeed(ip, username)
+		next.ServeHTTP(w, withUser(r, user))
+	})
+}
+
+// waitAuthLimit waits if the client has failed to log in a few times, and
+// responds with an error if they've been locked out, in which case it's false
+func (c *Controller) waitAuthLimit(w http.ResponseWriter, r *http.Request, ip, username string) bool {
+	err := c.AuthLimit.Wait(r.Context(), ip, username)
+	switch {
+	case errors.Is(err, authlimit.ErrLockedOut):
+		_ = writeResp(w, r, spec.NewError(40, "too many failed logins, please try again later"))
+		return false
+	case err != nil:
+		// the client has gone
+		return false
+	}
+	return true
+}
+
+// WithSignedURL authenticates a request with a signature from getSignedStreamURL
+// instead of the usual credentials. it's only used for stream routes
+func (c *Controller) WithSignedURL(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		claims, err := streamsign.Parse(query, c.ClientIP(r))
+		if err != nil {
+			_ = writeResp(w, r, spec.NewError(10, "invalid signed url: %v", err))
+			return
+		}
+		user := c.DB.GetUserByID(claims.UserID)
+		if user == nil {
+			_ = writeResp(w, r, spec.NewError(40, "invalid signed url: %v", streamsign.ErrInvalid))
+			return
+		}
+		switch err := c.StreamSigner.Verify(user.StreamKey, claims, query, time.Now()); {
+		case errors.Is(err, streamsign.ErrExpired):
+			_ = writeResp(w, r, spec.NewError(40, "signed url has expired"))
+			return
+		case err != nil:
+			_ = writeResp(w, r, spec.NewError(40, "invalid signed url: %v", err))
+			return
+		}
+		r = withUser(r, user)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxSignedURL, true)))
+	})
+}
+
+// isSignedURL is whether the request was authenticated by WithSignedURL, in
+// which case only the signed `id` may be served
+func isSignedURL(r *http.Request) bool {
+	ok, _ := r.Context().Value(ctxSignedURL).(bool)
+	return ok
+}
+
+// streamViews are the views which serve audio, whose bytes are counted
+var streamViews = map[string]struct{}{
+	"stream":        {},
+	"download":      {},
+	"hlsSegment.ts": {},
+}
+
+// metricsWriter records how a response went for WithMetrics. writeResp marks
+// it failed if it writes a subsonic error
+type metricsWriter struct {
+	http.ResponseWriter
+	status  int
+	failed  bool
+	written int64
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *metricsWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// WithMetrics records each request's view and status, and the bytes of audio
+// served, if the controller has metrics
+func (c *Controller) WithMetrics(next http.Handler) http.Handler {
+	if c.Metrics == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mw := &metricsWriter{ResponseWriter: w}
+		next.ServeHTTP(mw, r)
+		view := viewName(r)
+		ok := !mw.failed && mw.status < http.StatusBadRequest
+		c.Metrics.Request(view, ok)
+		// not the bytes of an error response
+		if _, isStream := streamViews[view]; isStream && ok {
+			c.Metrics.StreamBytes(view, mw.written)
+		}
 	})
 }
+
+// viewName is the view a request was routed to, like getAlbum. requests which
+// weren't routed to a view are "unknown", so that they can't add any number of
+// views to the metrics
+func viewName(r *http.Request) string {
+	view := strings.TrimSuffix(path.Base(r.URL.Path), ".view")
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unknown"
+	}
+	// like "/rest/getAlbum{_:(?:\\.view)?}", or just "/rest" for not found
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return "unknown"
+	}
+	rest := strings.TrimPrefix(path.Base(tmpl), view)
+	if rest == path.Base(tmpl) || (rest != "" && !strings.HasPrefix(rest, "{")) {
+		return "unknown"
+	}
+	return view
+}
@@ -0,0 +1,405 @@
+package ctrlsubsonic
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/authlimit"
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/metrics"
+	"go.senan.xyz/gonic/server/ctrlbase"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/spec"
+)
+
+func makeToken(password, salt string) string {
+	hash := md5.Sum([]byte(password + salt))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestWithUser(t *testing.T) {
+	t.Parallel()
+	contr := makeController(t)
+	handler := contr.WithParams(contr.WithUser(contr.H(contr.ServePing)))
+
+	cases := []struct {
+		name   string
+		params url.Values
+		code   int // 0 for a successful response
+	}{
+		{"password", url.Values{"p": {"admin"}}, 0},
+		{"password hex encoded", url.Values{"p": {"enc:" + hex.EncodeToString([]byte("admin"))}}, 0},
+		{"password wrong", url.Values{"p": {"nope"}}, 40},
+		{"token", url.Values{"t": {makeToken("admin", "salt")}, "s": {"salt"}}, 0},
+		{"token upper case", url.Values{"t": {strings.ToUpper(makeToken("admin", "salt"))}, "s": {"salt"}}, 0},
+		{"token wrong salt", url.Values{"t": {makeToken("admin", "salt")}, "s": {"pepper"}}, 40},
+		{"token wrong password", url.Values{"t": {makeToken("nope", "salt")}, "s": {"salt"}}, 40},
+		{"token without salt", url.Values{"t": {makeToken("admin", "")}}, 10},
+		{"salt without token", url.Values{"s": {"salt"}}, 10},
+		{"no credentials", url.Values{}, 10},
+		{"password and token agree", url.Values{"p": {"admin"}, "t": {makeToken("admin", "salt")}, "s": {"salt"}}, 0},
+		{"password and token disagree", url.Values{"p": {"nope"}, "t": {makeToken("admin", "salt")}, "s": {"salt"}}, 40},
+		{"token and password disagree", url.Values{"p": {"admin"}, "t": {makeToken("nope", "salt")}, "s": {"salt"}}, 40},
+		{"unknown user", url.Values{"u": {"nobody"}, "p": {"admin"}}, 40},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			query := url.Values{"u": {mockUsername}, "c": {mockClientName}, "v": {"1.15.0"}, "f": {"json"}}
+			for k, v := range tc.params {
+				query[k] = v
+			}
+			req, _ := http.NewRequest(http.MethodGet, "", nil)
+			req.URL.RawQuery = query.Encode()
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			var resp spec.SubsonicResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("unmarshal response: %v", err)
+			}
+			switch {
+			case tc.code == 0 && resp.Response.Error != nil:
+				t.Errorf("expected success, got error %d %q", resp.Response.Error.Code, resp.Response.Error.Message)
+			case tc.code != 0 && resp.Response.Error == nil:
+				t.Errorf("expected error %d, got success", tc.code)
+			case tc.code != 0 && resp.Response.Error.Code != tc.code:
+				t.Errorf("expected error %d, got %d", tc.code, resp.Response.Error.Code)
+			}
+		})
+	}
+}
+
+func TestWithUserAPIKey(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	handler := contr.WithParams(contr.WithRequiredParams(contr.WithUser(contr.H(contr.ServePing))))
+
+	admin := contr.DB.GetUserByName(mockUsername)
+	key, err := contr.DB.CreateAPIKey(admin.ID, "test")
+	is.NoErr(err)
+	revokedKey, err := contr.DB.CreateAPIKey(admin.ID, "revoked")
+	is.NoErr(err)
+	is.NoErr(contr.DB.Where("name=?", "revoked").Delete(db.APIKey{}).Error)
+
+	request := func(params url.Values) *spec.Response {
+		query := url.Values{"c": {mockClientName}, "v": {"1.15.0"}, "f": {"json"}}
+		for k, v := range params {
+			query[k] = v
+		}
+		req, _ := http.NewRequest(http.MethodGet, "", nil)
+		req.URL.RawQuery = query.Encode()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp spec.SubsonicResponse
+		is.NoErr(json.Unmarshal(rr.Body.Bytes(), &resp))
+		return &resp.Response
+	}
+
+	resp := request(url.Values{"apiKey": {key}})
+	is.Equal(resp.Error, nil)
+
+	var apiKey db.APIKey
+	is.NoErr(contr.DB.Where("name=?", "test").First(&apiKey).Error)
+	is.True(apiKey.LastUsed != nil) // last used is updated
+
+	resp = request(url.Values{"apiKey": {key}, "u": {mockUsername}})
+	is.Equal(resp.Error.Code, 43) // conflicting auth
+
+	resp = request(url.Values{"apiKey": {key}, "u": {mockUsername}, "p": {"admin"}})
+	is.Equal(resp.Error.Code, 43) // conflicting auth
+
+	resp = request(url.Values{"apiKey": {"nope"}})
+	is.Equal(resp.Error.Code, 44) // unknown key
+
+	resp = request(url.Values{"apiKey": {revokedKey}})
+	is.Equal(resp.Error.Code, 44) // revoked key
+}
+
+func TestWithSignedURL(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeControllerAudio(t)
+	streamHandler := contr.WithParams(contr.WithSignedURL(contr.HR(contr.ServeStream)))
+
+	admin := contr.DB.GetUserByName(mockUsername)
+	sign := func(params url.Values) *spec.Response {
+		rr, req := makeHTTPMock(params)
+		req = req.WithContext(context.WithValue(req.Context(), CtxUser, admin))
+		req.RemoteAddr = "192.0.2.1:1234"
+		contr.H(contr.ServeGetSignedStreamURL).ServeHTTP(rr, req)
+		var resp spec.SubsonicResponse
+		is.NoErr(json.Unmarshal(rr.Body.Bytes(), &resp))
+		return &resp.Response
+	}
+	stream := func(rawURL string, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, rawURL, nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		streamHandler.ServeHTTP(rr, req)
+		return rr
+	}
+	isAudio := func(rr *httptest.ResponseRecorder) bool {
+		return rr.Code == http.StatusOK && rr.Header().Get("Content-Type") == "audio/flac"
+	}
+
+	resp := sign(url.Values{"id": {"al-1"}})
+	is.Equal(resp.Error.Code, 10) // albums can't be streamed
+	resp = sign(url.Values{"id": {"tr-1"}, "expires": {"-1"}})
+	is.Equal(resp.Error.Code, 10) // bad expiry
+
+	resp = sign(url.Values{"id": {"tr-1"}})
+	is.Equal(resp.Error, nil)
+	signedURL := resp.SignedStreamURL.URL
+	is.True(isAudio(stream(signedURL, "10.0.0.1:1234")))
+
+	tampered := strings.Replace(signedURL, "id=tr-1", "id=tr-2", 1)
+	is.True(!isAudio(stream(tampered, "10.0.0.1:1234")))
+
+	resp = sign(url.Values{"id": {"tr-1"}, "bindIP": {"true"}})
+	is.Equal(resp.Error, nil)
+	boundURL := resp.SignedStreamURL.URL
+	is.True(isAudio(stream(boundURL, "192.0.2.1:1234"))) // the address it was signed for
+	is.True(!isAudio(stream(boundURL, "10.0.0.1:1234")))
+
+	// rotating the user's key revokes everything signed so far
+	is.NoErr(contr.DB.RotateStreamKey(admin))
+	is.True(!isAudio(stream(signedURL, "10.0.0.1:1234")))
+	is.True(!isAudio(stream(boundURL, "192.0.2.1:1234")))
+}
+
+func TestWithMetrics(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeControllerAudio(t)
+	contr.Metrics = metrics.New()
+
+	// like the routes in package server
+	router := mux.NewRouter()
+	r := router.PathPrefix("/rest").Subrouter()
+	r.Use(contr.WithMetrics)
+	r.Use(contr.WithParams)
+	r.Use(contr.WithUser)
+	r.Handle("/ping{_:(?:\\.view)?}", contr.H(contr.ServePing))
+	r.Handle("/stream{_:(?:\\.view)?}", contr.HR(contr.ServeStream))
+	notFoundRoute := r.NewRoute().Handler(contr.H(contr.ServeNotFound))
+	r.NotFoundHandler = notFoundRoute.GetHandler()
+
+	var track db.Track
+	is.NoErr(contr.DB.First(&track).Error)
+
+	request := func(path string, params url.Values) *httptest.ResponseRecorder {
+		query := url.Values{"u": {mockUsername}, "p": {mockPassword}, "c": {mockClientName}, "v": {"1.15.0"}, "f": {"json"}}
+		for k, v := range params {
+			query[k] = v
+		}
+		req := httptest.NewRequest(http.MethodGet, path+"?"+query.Encode(), nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	request("/rest/ping.view", nil)
+	request("/rest/ping", nil)
+	request("/rest/ping", url.Values{"p": {"nope"}})
+	streamed := request("/rest/stream", url.Values{"id": {fmt.Sprintf("tr-%d", track.ID)}})
+	is.True(streamed.Body.Len() > 0)
+	request("/rest/stream", url.Values{"id": {"tr-0"}})
+	request("/rest/nope.view", nil)
+	request("/rest/another", nil)
+
+	rr := httptest.NewRecorder()
+	contr.Metrics.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rr.Body.String()
+	for _, line := range []string{
+		`gonic_subsonic_requests_total{status="ok",view="ping"} 2`,
+		`gonic_subsonic_requests_total{status="failed",view="ping"} 1`,
+		`gonic_subsonic_requests_total{status="ok",view="stream"} 1`,
+		`gonic_subsonic_requests_total{status="failed",view="stream"} 1`,
+		`gonic_subsonic_requests_total{status="failed",view="unknown"} 2`,
+		fmt.Sprintf(`gonic_stream_bytes_total{view="stream"} %d`, streamed.Body.Len()),
+	} {
+		is.True(strings.Contains(body, line+"\n")) // missing line
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	// not parallel, since it takes over the log
+	is := is.New(t)
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(io.Discard)
+
+	contr := makeController(t)
+	contr.HTTPLog = true
+	contr.LogJSON = true
+
+	router := mux.NewRouter()
+	router.Use(contr.WithLogging)
+	r := router.PathPrefix("/rest").Subrouter()
+	r.Use(contr.WithParams)
+	r.Use(contr.WithUser)
+	r.Handle("/ping{_:(?:\\.view)?}", contr.H(contr.ServePing))
+
+	type line struct {
+		URL    string `json:"url"`
+		Status int    `json:"status"`
+		View   string `json:"view"`
+		User   string `json:"user"`
+		Client string `json:"client"`
+		Code   *int   `json:"error_code"`
+	}
+	request := func(password string) *line {
+		out.Reset()
+		query := url.Values{"u": {mockUsername}, "p": {password}, "c": {mockClientName}, "v": {"1.15.0"}, "f": {"json"}}
+		req := httptest.NewRequest(http.MethodGet, "/rest/ping.view?"+query.Encode(), nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		// the last line, after any others like the subsonic error
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		var l line
+		is.NoErr(json.Unmarshal([]byte(lines[len(lines)-1]), &l))
+		return &l
+	}
+
+	l := request(mockPassword)
+	is.Equal(l.Status, http.StatusOK)
+	is.Equal(l.View, "ping")
+	is.Equal(l.User, mockUsername)
+	is.Equal(l.Client, mockClientName)
+	is.Equal(l.Code, nil)
+	is.True(!strings.Contains(l.URL, "p="+mockPassword)) // redacted
+
+	l = request("nope")
+	is.Equal(l.User, "") // not logged in
+	is.True(l.Code != nil)
+	is.Equal(*l.Code, 40)
+}
+
+func TestWithProxyUser(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	trusted, err := ctrlbase.ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	is.NoErr(err)
+	contr.ProxyAuth = &ctrlbase.ProxyAuth{
+		Header:      "Remote-User",
+		Trusted:     trusted,
+		Subsonic:    true,
+		CreateUsers: true,
+	}
+	handler := contr.WithParams(contr.WithProxyUser(contr.WithRequiredParams(contr.WithUser(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.Context().Value(CtxUser).(*db.User).Name)
+		}),
+	))))
+
+	// request returns the name of the user, or the error code
+	request := func(from, remoteUser string, params url.Values) (string, int) {
+		query := url.Values{"c": {mockClientName}, "v": {"1.15.0"}, "f": {"json"}}
+		for k, v := range params {
+			query[k] = v
+		}
+		req := httptest.NewRequest(http.MethodGet, "/rest/ping.view?"+query.Encode(), nil)
+		req.RemoteAddr = from
+		if remoteUser != "" {
+			req.Header.Set("Remote-User", remoteUser)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp spec.SubsonicResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err == nil && resp.Response.Error != nil {
+			return "", resp.Response.Error.Code
+		}
+		return rr.Body.String(), 0
+	}
+
+	name, code := request("10.1.2.3:4000", mockUsername, nil)
+	is.Equal(code, 0)
+	is.Equal(name, mockUsername) // without credentials
+	name, _ = request("192.168.1.1:4000", mockUsername, url.Values{"u": {mockUsername}})
+	is.Equal(name, mockUsername) // with a matching username
+
+	_, code = request("10.1.2.3:4000", mockUsername, url.Values{"u": {"alice"}})
+	is.Equal(code, 40) // with someone else's username
+	_, code = request("192.168.1.2:4000", mockUsername, nil)
+	is.Equal(code, 10) // untrusted, so it needs credentials
+	_, code = request("192.168.1.2:4000", mockUsername, url.Values{"u": {"alice"}, "p": {"alice"}})
+	is.Equal(code, 40) // and the header doesn't matter
+	name, _ = request("192.168.1.2:4000", "", url.Values{"u": {mockUsername}, "p": {mockPassword}})
+	is.Equal(name, mockUsername) // credentials still work
+
+	name, _ = request("10.1.2.3:4000", "alice", nil)
+	is.Equal(name, "alice")
+	alice := contr.DB.GetUserByName("alice")
+	is.True(alice != nil) // created
+	is.True(!alice.IsAdmin)
+	is.True(alice.Password != "")
+
+	contr.ProxyAuth.CreateUsers = false
+	_, code = request("10.1.2.3:4000", "bob", nil)
+	is.Equal(code, 10) // not created, so it needs credentials
+	is.True(contr.DB.GetUserByName("bob") == nil)
+}
+
+func TestWithUserAuthLimit(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	contr := makeController(t)
+	contr.AuthLimit = authlimit.New(authlimit.Options{MaxFailures: 3, Window: time.Minute})
+	trusted, err := ctrlbase.ParseTrustedProxies("192.168.1.1")
+	is.NoErr(err)
+	contr.TrustedProxies = trusted
+	handler := contr.WithParams(contr.WithUser(contr.H(contr.ServePing)))
+
+	// forwarded is the client's address sent by a proxy, if any
+	request := func(from, forwarded, username, password string) *spec.Error {
+		query := url.Values{"u": {username}, "p": {password}, "c": {mockClientName}, "v": {"1.15.0"}, "f": {"json"}}
+		req := httptest.NewRequest(http.MethodGet, "/rest/ping.view?"+query.Encode(), nil)
+		req.RemoteAddr = from
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", "203.0.113.9, "+forwarded)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp spec.SubsonicResponse
+		is.NoErr(json.Unmarshal(rr.Body.Bytes(), &resp))
+		return resp.Response.Error
+	}
+
+	is.Equal(request("10.0.0.1:4000", "", mockUsername, "nope").Code, 40)
+	is.Equal(request("10.0.0.1:4000", "", mockUsername, "nope").Code, 40)
+	is.Equal(request("10.0.0.1:4000", "", mockUsername, mockPassword), nil) // which resets the failures
+	for i := 0; i < 3; i++ {
+		is.Equal(request("10.0.0.1:4000", "", mockUsername, "nope").Code, 40)
+	}
+
+	// the address is locked out, even with the right password
+	is.True(strings.Contains(request("10.0.0.1:4000", "", mockUsername, mockPassword).Message, "too many"))
+	is.True(strings.Contains(request("10.0.0.1:4000", "", "nobody", "nope").Message, "too many"))
+	// but the user isn't, from anywhere else
+	is.Equal(request("10.0.0.3:4000", "", mockUsername, mockPassword), nil)
+
+	// clients behind the proxy are told apart by the address it forwards
+	for i := 0; i < 3; i++ {
+		is.Equal(request("192.168.1.1:4000", "10.0.0.5", mockUsername, "nope").Code, 40)
+	}
+	is.True(strings.Contains(request("192.168.1.1:4000", "10.0.0.5", mockUsername, mockPassword).Message, "too many"))
+	is.Equal(request("192.168.1.1:4000", "10.0.0.6", mockUsername, mockPassword), nil)
+	// and anyone else's forwarded address is ignored
+	is.True(strings.Contains(request("10.0.0.1:4000", "10.0.0.6", mockUsername, mockPassword).Message, "too many"))
+}
@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/server/ctrlsubsonic/specid"
 )
 
 func NewAlbumByFolder(f *db.Album) *Album {
@@ -17,13 +18,29 @@ func NewAlbumByFolder(f *db.Album) *Album {
 		TrackCount: f.ChildCount,
 		Duration:   f.Duration,
 		Created:    f.CreatedAt,
+		PlayCount:  f.PlayCount,
+
+		IsCompilation: f.IsCompilation(),
 	}
 	if f.Cover != "" {
 		a.CoverID = f.SID()
 	}
+	a.DynamicRange, a.DynamicRangeSource = albumDynamicRange(f)
 	return a
 }
 
+// albumDynamicRange is the album's DR value, and whether it was tagged or estimated
+func albumDynamicRange(a *db.Album) (*int, string) {
+	switch {
+	case a.DynamicRange == nil:
+		return nil, ""
+	case a.DynamicRangeEstimated:
+		return a.DynamicRange, DynamicRangeEstimate
+	default:
+		return a.DynamicRange, DynamicRangeTag
+	}
+}
+
 func NewTCAlbumByFolder(f *db.Album) *TrackChild {
 	trCh := &TrackChild{
 		ID:        f.SID(),
@@ -31,10 +48,15 @@ func NewTCAlbumByFolder(f *db.Album) *TrackChild {
 		Title:     f.RightPath,
 		ParentID:  f.ParentSID(),
 		CreatedAt: f.CreatedAt,
+		PlayCount: f.PlayCount,
 	}
 	if f.Cover != "" {
 		trCh.CoverID = f.SID()
 	}
+	if f.TagArtistID != 0 {
+		trCh.AlbumID = f.SID()
+		trCh.ArtistID = &specid.ID{Type: specid.Artist, Value: f.TagArtistID}
+	}
 	return trCh
 }
 
@@ -68,9 +90,16 @@ func NewTCTrackByFolder(t *db.Track, parent *db.Album) *TrackChild {
 	if parent.Cover != "" {
 		trCh.CoverID = parent.SID()
 	}
+	if t.TagDynamicRange != nil {
+		trCh.DynamicRange, trCh.DynamicRangeSource = t.TagDynamicRange, DynamicRangeTag
+	}
 	if t.Album != nil {
 		trCh.Album = t.Album.RightPath
 	}
+	if parent.TagArtistID != 0 {
+		trCh.AlbumID = parent.SID()
+		trCh.ArtistID = &specid.ID{Type: specid.Artist, Value: parent.TagArtistID}
+	}
 	return trCh
 }
 
@@ -16,10 +16,14 @@ func NewAlbumByTags(a *db.Album, artist *db.Artist) *Album {
 		TrackCount: a.ChildCount,
 		Genre:      strings.Join(a.GenreStrings(), ", "),
 		Duration:   a.Duration,
+		PlayCount:  a.PlayCount,
+
+		IsCompilation: a.IsCompilation(),
 	}
 	if a.Cover != "" {
 		ret.CoverID = a.SID()
 	}
+	ret.DynamicRange, ret.DynamicRangeSource = albumDynamicRange(a)
 	if artist != nil {
 		ret.Artist = artist.Name
 		ret.ArtistID = artist.SID()
@@ -58,6 +62,9 @@ func NewTrackByTags(t *db.Track, album *db.Album) *TrackChild {
 	if album.TagArtist != nil {
 		ret.ArtistID = album.TagArtist.SID()
 	}
+	if t.TagDynamicRange != nil {
+		ret.DynamicRange, ret.DynamicRangeSource = t.TagDynamicRange, DynamicRangeTag
+	}
 	// replace tags that we're present
 	if ret.Title == "" {
 		ret.Title = "<title>"
@@ -76,6 +83,7 @@ func NewArtistByTags(a *db.Artist) *Artist {
 		ID:         a.SID(),
 		Name:       a.Name,
 		AlbumCount: a.AlbumCount,
+		SongCount:  a.TrackCount,
 	}
 	if a.Cover != "" {
 		r.CoverID = a.SID()
@@ -12,6 +12,11 @@ func NewPodcastChannel(p *db.Podcast) *PodcastChannel {
 		CoverArt:         p.SID(),
 		Status:           "skipped",
 	}
+	if p.Error != "" {
+		// the last refresh failed
+		ret.Status = "error"
+		ret.ErrorMessage = p.Error
+	}
 	for _, episode := range p.Episodes {
 		specEpisode := NewPodcastEpisode(episode)
 		ret.Episode = append(ret.Episode, specEpisode)
@@ -23,23 +28,39 @@ func NewPodcastEpisode(e *db.PodcastEpisode) *PodcastEpisode {
 	if e == nil {
 		return nil
 	}
-	return &PodcastEpisode{
-		ID:          e.SID(),
-		StreamID:    e.SID(),
-		ContentType: e.MIME(),
-		ChannelID:   e.PodcastSID(),
-		Title:       e.Title,
-		Description: e.Description,
-		Status:      string(e.Status),
-		CoverArt:    e.PodcastSID(),
-		PublishDate: *e.PublishDate,
-		Genre:       "Podcast",
-		Duration:    e.Length,
-		Year:        e.PublishDate.Year(),
-		Suffix:      e.Ext(),
-		BitRate:     e.Bitrate,
-		IsDir:       false,
-		Path:        e.Path,
-		Size:        e.Size,
+	ret := &PodcastEpisode{
+		ID:            e.SID(),
+		StreamID:      e.SID(),
+		ContentType:   e.MIME(),
+		ChannelID:     e.PodcastSID(),
+		Title:         e.Title,
+		Description:   e.Description,
+		Status:        string(e.Status),
+		CoverArt:      e.PodcastSID(),
+		PublishDate:   *e.PublishDate,
+		Genre:         "Podcast",
+		Duration:      e.Length,
+		Year:          e.PublishDate.Year(),
+		Suffix:        e.Ext(),
+		BitRate:       e.Bitrate,
+		IsDir:         false,
+		Path:          e.Path,
+		Size:          e.Size,
+		EpisodeNumber: e.EpisodeNumber,
+		SeasonNumber:  e.SeasonNumber,
+		ErrorMessage:  e.Error,
+	}
+	for _, chapter := range e.Chapters {
+		ret.Chapters = append(ret.Chapters, NewPodcastChapter(chapter))
+	}
+	return ret
+}
+
+func NewPodcastChapter(c *db.PodcastChapter) *PodcastChapter {
+	return &PodcastChapter{
+		StartTime: c.StartTime,
+		Title:     c.Title,
+		URL:       c.URL,
+		ImageURL:  c.ImageURL,
 	}
 }
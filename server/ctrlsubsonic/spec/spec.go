@@ -22,6 +22,8 @@ type Response struct {
 	Version           string             `xml:"version,attr"      json:"version"`
 	XMLNS             string             `xml:"xmlns,attr"        json:"-"`
 	Type              string             `xml:"type,attr"         json:"type"`
+	ServerVersion     string             `xml:"serverVersion,attr" json:"serverVersion"`
+	OpenSubsonic      bool               `xml:"openSubsonic,attr" json:"openSubsonic"`
 	Error             *Error             `xml:"error"             json:"error,omitempty"`
 	Albums            *Albums            `xml:"albumList"         json:"albumList,omitempty"`
 	AlbumsTwo         *Albums            `xml:"albumList2"        json:"albumList2,omitempty"`
@@ -35,10 +37,12 @@ type Response struct {
 	TracksByGenre     *TracksByGenre     `xml:"songsByGenre"      json:"songsByGenre,omitempty"`
 	MusicFolders      *MusicFolders      `xml:"musicFolders"      json:"musicFolders,omitempty"`
 	ScanStatus        *ScanStatus        `xml:"scanStatus"        json:"scanStatus,omitempty"`
+	LibraryStats      *LibraryStats      `xml:"libraryStats"      json:"libraryStats,omitempty"`
 	Licence           *Licence           `xml:"license"           json:"license,omitempty"`
 	SearchResultTwo   *SearchResultTwo   `xml:"searchResult2"     json:"searchResult2,omitempty"`
 	SearchResultThree *SearchResultThree `xml:"searchResult3"     json:"searchResult3,omitempty"`
 	User              *User              `xml:"user"              json:"user,omitempty"`
+	Users             *Users             `xml:"users"             json:"users,omitempty"`
 	Playlists         *Playlists         `xml:"playlists"         json:"playlists,omitempty"`
 	Playlist          *Playlist          `xml:"playlist"          json:"playlist,omitempty"`
 	ArtistInfo        *ArtistInfo        `xml:"artistInfo"        json:"artistInfo,omitempty"`
@@ -52,19 +56,90 @@ type Response struct {
 	Bookmarks         *Bookmarks         `xml:"bookmarks"         json:"bookmarks,omitempty"`
 	Starred           *Starred           `xml:"starred"           json:"starred,omitempty"`
 	StarredTwo        *StarredTwo        `xml:"starred2"          json:"starred2,omitempty"`
+	AnnotationResults *AnnotationResults `xml:"annotationResults" json:"annotationResults,omitempty"`
 	TopSongs          *TopSongs          `xml:"topSongs"          json:"topSongs,omitempty"`
 	SimilarSongs      *SimilarSongs      `xml:"similarSongs"      json:"similarSongs,omitempty"`
 	SimilarSongsTwo   *SimilarSongsTwo   `xml:"similarSongs2"     json:"similarSongs2,omitempty"`
 	InternetRadioStations   *InternetRadioStations   `xml:"internetRadioStations"     json:"internetRadioStations,omitempty"`
+	OpenSubsonicExtensions  []*OpenSubsonicExtension `xml:"openSubsonicExtensions"    json:"openSubsonicExtensions,omitempty"`
+	SignedStreamURL         *SignedStreamURL         `xml:"signedStreamUrl"           json:"signedStreamUrl,omitempty"`
+	ChatMessages            *ChatMessages            `xml:"chatMessages"              json:"chatMessages,omitempty"`
+	PlayedTogether          *PlayedTogether          `xml:"playedTogether"            json:"playedTogether,omitempty"`
+	PodcastChapters         *PodcastChapters         `xml:"podcastChapters"           json:"podcastChapters,omitempty"`
+
+	// LastModified is when the data in the response last changed. it's sent as
+	// a header rather than in the body, see ctrlsubsonic's H
+	LastModified time.Time `xml:"-" json:"-"`
 }
 
 func NewResponse() *Response {
 	return &Response{
-		Status:  "ok",
-		XMLNS:   xmlns,
-		Version: apiVersion,
-		Type:    gonic.Name,
+		Status:        "ok",
+		XMLNS:         xmlns,
+		Version:       apiVersion,
+		Type:          gonic.Name,
+		ServerVersion: gonic.Version,
+		OpenSubsonic:  true,
+	}
+}
+
+// TrackChildren returns each track in the response, wherever it is
+func (r *Response) TrackChildren() []*TrackChild {
+	var lists [][]*TrackChild
+	if r.Track != nil {
+		lists = append(lists, []*TrackChild{r.Track})
+	}
+	if r.Album != nil {
+		lists = append(lists, r.Album.Tracks)
+	}
+	if r.Directory != nil {
+		lists = append(lists, r.Directory.Children)
+	}
+	if r.RandomTracks != nil {
+		lists = append(lists, r.RandomTracks.List)
+	}
+	if r.TracksByGenre != nil {
+		lists = append(lists, r.TracksByGenre.List)
+	}
+	if r.SearchResultTwo != nil {
+		lists = append(lists, r.SearchResultTwo.Tracks)
+	}
+	if r.SearchResultThree != nil {
+		lists = append(lists, r.SearchResultThree.Tracks)
 	}
+	if r.Playlist != nil {
+		lists = append(lists, r.Playlist.List)
+	}
+	if r.PlayQueue != nil {
+		lists = append(lists, r.PlayQueue.List)
+	}
+	if r.JukeboxPlaylist != nil {
+		lists = append(lists, r.JukeboxPlaylist.List)
+	}
+	if r.Starred != nil {
+		lists = append(lists, r.Starred.Tracks)
+	}
+	if r.StarredTwo != nil {
+		lists = append(lists, r.StarredTwo.Tracks)
+	}
+	if r.TopSongs != nil {
+		lists = append(lists, r.TopSongs.Tracks)
+	}
+	if r.SimilarSongs != nil {
+		lists = append(lists, r.SimilarSongs.Tracks)
+	}
+	if r.SimilarSongsTwo != nil {
+		lists = append(lists, r.SimilarSongsTwo.Tracks)
+	}
+	var tracks []*TrackChild
+	for _, list := range lists {
+		for _, child := range list {
+			if child != nil && !child.IsDir {
+				tracks = append(tracks, child)
+			}
+		}
+	}
+	return tracks
 }
 
 // Error represents a typed error
@@ -91,7 +166,9 @@ func NewError(code int, message string, a ...interface{}) *Response {
 			Code:    code,
 			Message: fmt.Sprintf(message, a...),
 		},
-		Type: gonic.Name,
+		Type:          gonic.Name,
+		ServerVersion: gonic.Version,
+		OpenSubsonic:  true,
 	}
 }
 
@@ -101,11 +178,15 @@ type Albums struct {
 
 type Album struct {
 	// common
-	ID       *specid.ID `xml:"id,attr,omitempty"       json:"id"`
-	CoverID  *specid.ID `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
-	ArtistID *specid.ID `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
-	Artist   string     `xml:"artist,attr,omitempty"   json:"artist,omitempty"`
-	Created  time.Time  `xml:"created,attr,omitempty"  json:"created,omitempty"`
+	ID           *specid.ID `xml:"id,attr,omitempty"           json:"id"`
+	CoverID      *specid.ID `xml:"coverArt,attr,omitempty"     json:"coverArt,omitempty"`
+	ArtistID     *specid.ID `xml:"artistId,attr,omitempty"     json:"artistId,omitempty"`
+	Artist       string     `xml:"artist,attr,omitempty"       json:"artist,omitempty"`
+	Created      time.Time  `xml:"created,attr,omitempty"      json:"created,omitempty"`
+	PlayCount    int        `xml:"playCount,attr,omitempty"    json:"playCount,omitempty"`
+	Starred      *time.Time `xml:"starred,attr,omitempty"      json:"starred,omitempty"`
+	UserRating   int        `xml:"userRating,attr,omitempty"   json:"userRating,omitempty"`
+	LastModified int        `xml:"lastModified,attr,omitempty" json:"lastModified,omitempty"`
 	// browsing by folder (eg. getAlbumList)
 	Title    string     `xml:"title,attr,omitempty"  json:"title"`
 	Album    string     `xml:"album,attr,omitempty"  json:"album"`
@@ -118,8 +199,20 @@ type Album struct {
 	Genre      string        `xml:"genre,attr,omitempty"   json:"genre,omitempty"`
 	Year       int           `xml:"year,attr,omitempty"    json:"year,omitempty"`
 	Tracks     []*TrackChild `xml:"song,omitempty"         json:"song,omitempty"`
+	// both
+	IsCompilation bool `xml:"isCompilation,attr,omitempty" json:"isCompilation,omitempty"`
+	// DynamicRange is a gonic extension. see DynamicRangeSource
+	DynamicRange       *int   `xml:"dynamicRange,attr,omitempty"       json:"dynamicRange,omitempty"`
+	DynamicRangeSource string `xml:"dynamicRangeSource,attr,omitempty" json:"dynamicRangeSource,omitempty"`
 }
 
+// DynamicRangeSource says where a DR value came from, a tag, or an estimate
+// from the album's tagged tracks
+const (
+	DynamicRangeTag      = "tag"
+	DynamicRangeEstimate = "estimate"
+)
+
 type RandomTracks struct {
 	List []*TrackChild `xml:"song" json:"song"`
 }
@@ -129,28 +222,46 @@ type TracksByGenre struct {
 }
 
 type TrackChild struct {
-	ID          *specid.ID `xml:"id,attr,omitempty"          json:"id,omitempty"`
-	Album       string     `xml:"album,attr,omitempty"       json:"album,omitempty"`
-	AlbumID     *specid.ID `xml:"albumId,attr,omitempty"     json:"albumId,omitempty"`
-	Artist      string     `xml:"artist,attr,omitempty"      json:"artist,omitempty"`
-	ArtistID    *specid.ID `xml:"artistId,attr,omitempty"    json:"artistId,omitempty"`
-	Bitrate     int        `xml:"bitRate,attr,omitempty"     json:"bitRate,omitempty"`
-	ContentType string     `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
-	CoverID     *specid.ID `xml:"coverArt,attr,omitempty"    json:"coverArt,omitempty"`
-	CreatedAt   time.Time  `xml:"created,attr,omitempty"     json:"created,omitempty"`
-	Duration    int        `xml:"duration,attr,omitempty"    json:"duration,omitempty"`
-	Genre       string     `xml:"genre,attr,omitempty"       json:"genre,omitempty"`
-	IsDir       bool       `xml:"isDir,attr"                 json:"isDir"`
-	IsVideo     bool       `xml:"isVideo,attr"               json:"isVideo"`
-	ParentID    *specid.ID `xml:"parent,attr,omitempty"      json:"parent,omitempty"`
-	Path        string     `xml:"path,attr,omitempty"        json:"path,omitempty"`
-	Size        int        `xml:"size,attr,omitempty"        json:"size,omitempty"`
-	Suffix      string     `xml:"suffix,attr,omitempty"      json:"suffix,omitempty"`
-	Title       string     `xml:"title,attr"                 json:"title"`
-	TrackNumber int        `xml:"track,attr,omitempty"       json:"track,omitempty"`
-	DiscNumber  int        `xml:"discNumber,attr,omitempty"  json:"discNumber,omitempty"`
-	Type        string     `xml:"type,attr,omitempty"        json:"type,omitempty"`
-	Year        int        `xml:"year,attr,omitempty"        json:"year,omitempty"`
+	ID           *specid.ID `xml:"id,attr,omitempty"           json:"id,omitempty"`
+	Album        string     `xml:"album,attr,omitempty"        json:"album,omitempty"`
+	AlbumID      *specid.ID `xml:"albumId,attr,omitempty"      json:"albumId,omitempty"`
+	Artist       string     `xml:"artist,attr,omitempty"       json:"artist,omitempty"`
+	ArtistID     *specid.ID `xml:"artistId,attr,omitempty"     json:"artistId,omitempty"`
+	Bitrate      int        `xml:"bitRate,attr,omitempty"      json:"bitRate,omitempty"`
+	ContentType  string     `xml:"contentType,attr,omitempty"  json:"contentType,omitempty"`
+	CoverID      *specid.ID `xml:"coverArt,attr,omitempty"     json:"coverArt,omitempty"`
+	CreatedAt    time.Time  `xml:"created,attr,omitempty"      json:"created,omitempty"`
+	Duration     int        `xml:"duration,attr,omitempty"     json:"duration,omitempty"`
+	Genre        string     `xml:"genre,attr,omitempty"        json:"genre,omitempty"`
+	IsDir        bool       `xml:"isDir,attr"                  json:"isDir"`
+	IsVideo      bool       `xml:"isVideo,attr"                json:"isVideo"`
+	ParentID     *specid.ID `xml:"parent,attr,omitempty"       json:"parent,omitempty"`
+	Path         string     `xml:"path,attr,omitempty"         json:"path,omitempty"`
+	Size         int        `xml:"size,attr,omitempty"         json:"size,omitempty"`
+	Suffix       string     `xml:"suffix,attr,omitempty"       json:"suffix,omitempty"`
+	Title        string     `xml:"title,attr"                  json:"title"`
+	TrackNumber  int        `xml:"track,attr,omitempty"        json:"track,omitempty"`
+	DiscNumber   int        `xml:"discNumber,attr,omitempty"   json:"discNumber,omitempty"`
+	Type         string     `xml:"type,attr,omitempty"         json:"type,omitempty"`
+	Year         int        `xml:"year,attr,omitempty"         json:"year,omitempty"`
+	PlayCount    int        `xml:"playCount,attr,omitempty"    json:"playCount,omitempty"`
+	Played       *time.Time `xml:"played,attr,omitempty"       json:"played,omitempty"`
+	Starred      *time.Time `xml:"starred,attr,omitempty"      json:"starred,omitempty"`
+	UserRating   int        `xml:"userRating,attr,omitempty"   json:"userRating,omitempty"`
+	LastModified int        `xml:"lastModified,attr,omitempty" json:"lastModified,omitempty"`
+	// Added is a gonic extension, when a playlist entry was added
+	Added *time.Time `xml:"added,attr,omitempty" json:"added,omitempty"`
+	// the format the track will be streamed in, if it will be transcoded
+	TranscodedContentType string `xml:"transcodedContentType,attr,omitempty" json:"transcodedContentType,omitempty"`
+	TranscodedSuffix      string `xml:"transcodedSuffix,attr,omitempty"      json:"transcodedSuffix,omitempty"`
+	// DynamicRange is a gonic extension. see DynamicRangeSource
+	DynamicRange       *int   `xml:"dynamicRange,attr,omitempty"       json:"dynamicRange,omitempty"`
+	DynamicRangeSource string `xml:"dynamicRangeSource,attr,omitempty" json:"dynamicRangeSource,omitempty"`
+	// JukeboxError is a gonic extension, why the jukebox couldn't play the track
+	JukeboxError string `xml:"jukeboxError,attr,omitempty" json:"jukeboxError,omitempty"`
+	// JukeboxReplayGain is a gonic extension, the gain in dB the jukebox
+	// applies to the track for its replaygain
+	JukeboxReplayGain *float64 `xml:"jukeboxReplayGain,attr,omitempty" json:"jukeboxReplayGain,omitempty"`
 }
 
 type Artists struct {
@@ -159,11 +270,23 @@ type Artists struct {
 }
 
 type Artist struct {
-	ID         *specid.ID `xml:"id,attr,omitempty"       json:"id"`
-	Name       string     `xml:"name,attr"               json:"name"`
-	CoverID    *specid.ID `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
-	AlbumCount int        `xml:"albumCount,attr"         json:"albumCount"`
-	Albums     []*Album   `xml:"album,omitempty"         json:"album,omitempty"`
+	ID           *specid.ID          `xml:"id,attr,omitempty"           json:"id"`
+	Name         string              `xml:"name,attr"                   json:"name"`
+	CoverID      *specid.ID          `xml:"coverArt,attr,omitempty"     json:"coverArt,omitempty"`
+	AlbumCount   int                 `xml:"albumCount,attr"             json:"albumCount"`
+	SongCount    int                 `xml:"songCount,attr,omitempty"    json:"songCount,omitempty"`
+	Albums       []*Album            `xml:"album,omitempty"             json:"album,omitempty"`
+	Discography  []*DiscographyGroup `xml:"discography,omitempty"       json:"discography,omitempty"`
+	Starred      *time.Time          `xml:"starred,attr,omitempty"      json:"starred,omitempty"`
+	UserRating   int                 `xml:"userRating,attr,omitempty"   json:"userRating,omitempty"`
+	LastModified int                 `xml:"lastModified,attr,omitempty" json:"lastModified,omitempty"`
+}
+
+// DiscographyGroup is a gonic extension to getArtist which groups the artist's
+// releases by type, eg. albums, eps and singles, or releases they appear on
+type DiscographyGroup struct {
+	Name   string   `xml:"name,attr" json:"name"`
+	Albums []*Album `xml:"album"     json:"album"`
 }
 
 type Indexes struct {
@@ -178,11 +301,12 @@ type Index struct {
 }
 
 type Directory struct {
-	ID       *specid.ID    `xml:"id,attr,omitempty"      json:"id"`
-	ParentID *specid.ID    `xml:"parent,attr,omitempty"  json:"parent,omitempty"`
-	Name     string        `xml:"name,attr,omitempty"    json:"name"`
-	Starred  string        `xml:"starred,attr,omitempty" json:"starred,omitempty"`
-	Children []*TrackChild `xml:"child,omitempty"        json:"child,omitempty"`
+	ID         *specid.ID    `xml:"id,attr,omitempty"         json:"id"`
+	ParentID   *specid.ID    `xml:"parent,attr,omitempty"     json:"parent,omitempty"`
+	Name       string        `xml:"name,attr,omitempty"       json:"name"`
+	Starred    string        `xml:"starred,attr,omitempty"    json:"starred,omitempty"`
+	UserRating int           `xml:"userRating,attr,omitempty" json:"userRating,omitempty"`
+	Children   []*TrackChild `xml:"child,omitempty"           json:"child,omitempty"`
 }
 
 type MusicFolders struct {
@@ -199,8 +323,33 @@ type Licence struct {
 }
 
 type ScanStatus struct {
-	Scanning bool `xml:"scanning,attr"        json:"scanning"`
-	Count    int  `xml:"count,attr,omitempty" json:"count,omitempty"`
+	Scanning bool   `xml:"scanning,attr"         json:"scanning"`
+	Count    int    `xml:"count,attr,omitempty"  json:"count,omitempty"`
+	Holder   string `xml:"holder,attr,omitempty" json:"holder,omitempty"`
+	// Folders is a gonic extension, the scan state of each music folder
+	Folders []*ScanStatusFolder `xml:"folder,omitempty" json:"folder,omitempty"`
+}
+
+type ScanStatusFolder struct {
+	ID       int        `xml:"id,attr"                 json:"id"`
+	Name     string     `xml:"name,attr,omitempty"     json:"name,omitempty"`
+	Scanning bool       `xml:"scanning,attr"           json:"scanning"`
+	Holder   string     `xml:"holder,attr,omitempty"   json:"holder,omitempty"`
+	LastScan *time.Time `xml:"lastScan,attr,omitempty" json:"lastScan,omitempty"`
+}
+
+// LibraryStats is a gonic extension, the library's totals as of the last scan.
+// Version changes if the fields change in a way that would break a reader
+type LibraryStats struct {
+	Version   int        `xml:"version,attr"             json:"version"`
+	Tracks    int        `xml:"tracks,attr"              json:"tracks"`
+	Albums    int        `xml:"albums,attr"              json:"albums"`
+	Artists   int        `xml:"artists,attr"             json:"artists"`
+	Genres    int        `xml:"genres,attr"              json:"genres"`
+	Playlists int        `xml:"playlists,attr"           json:"playlists"`
+	Duration  int64      `xml:"duration,attr"            json:"duration"`
+	Size      int64      `xml:"size,attr"                json:"size"`
+	LastScan  *time.Time `xml:"lastScan,attr,omitempty"  json:"lastScan,omitempty"`
 }
 
 type SearchResultTwo struct {
@@ -233,20 +382,28 @@ type User struct {
 	Folder              []int  `xml:"folder,attr"              json:"folder"`
 }
 
+type Users struct {
+	List []*User `xml:"user" json:"user"`
+}
+
 type Playlists struct {
 	List []*Playlist `xml:"playlist" json:"playlist"`
 }
 
 type Playlist struct {
-	ID        int           `xml:"id,attr"        json:"id"`
-	Name      string        `xml:"name,attr"      json:"name"`
-	Comment   string        `xml:"comment,attr"   json:"comment"`
-	Owner     string        `xml:"owner,attr"     json:"owner"`
-	SongCount int           `xml:"songCount,attr" json:"songCount"`
-	Created   time.Time     `xml:"created,attr"   json:"created"`
-	Duration  int           `xml:"duration,attr"  json:"duration,omitempty"`
-	Public    bool          `xml:"public,attr"    json:"public,omitempty"`
-	List      []*TrackChild `xml:"entry"          json:"entry"`
+	ID        int           `xml:"id,attr"                 json:"id"`
+	Name      string        `xml:"name,attr"               json:"name"`
+	Comment   string        `xml:"comment,attr"            json:"comment"`
+	Owner     string        `xml:"owner,attr"              json:"owner"`
+	SongCount int           `xml:"songCount,attr"          json:"songCount"`
+	Created   time.Time     `xml:"created,attr"            json:"created"`
+	Changed   time.Time     `xml:"changed,attr"            json:"changed"`
+	Duration  int           `xml:"duration,attr"           json:"duration,omitempty"`
+	Public    bool          `xml:"public,attr"             json:"public,omitempty"`
+	CoverID   *specid.ID    `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	List      []*TrackChild `xml:"entry"                   json:"entry"`
+	// ReadOnly is set for smart playlists, which are built from rules
+	ReadOnly bool `xml:"readonly,attr,omitempty" json:"readonly,omitempty"`
 }
 
 type SimilarArtist struct {
@@ -271,8 +428,8 @@ type Genres struct {
 
 type Genre struct {
 	Name       string `xml:",chardata"                 json:"value"`
-	SongCount  int    `xml:"songCount,attr,omitempty"  json:"songCount,omitempty"`
-	AlbumCount int    `xml:"albumCount,attr,omitempty" json:"albumCount,omitempty"`
+	SongCount  int    `xml:"songCount,attr"            json:"songCount"`
+	AlbumCount int    `xml:"albumCount,attr"           json:"albumCount"`
 }
 
 type PlayQueue struct {
@@ -289,6 +446,14 @@ type JukeboxStatus struct {
 	Playing      bool    `xml:"playing,attr"      json:"playing"`
 	Gain         float64 `xml:"gain,attr"         json:"gain"`
 	Position     int     `xml:"position,attr"     json:"position"`
+	Shuffle      bool    `xml:"shuffle,attr"      json:"shuffle"`
+	Repeat       string  `xml:"repeat,attr"       json:"repeat"`
+	Ended        bool    `xml:"ended,attr"        json:"ended"`
+	Stalled      bool    `xml:"stalled,attr"      json:"stalled"`
+	Crossfade    int     `xml:"crossfade,attr"    json:"crossfade"`
+	Device       string  `xml:"device,attr"       json:"device"`
+	Error        string  `xml:"error,attr,omitempty" json:"error,omitempty"`
+	ReplayGain   string  `xml:"replayGain,attr"   json:"replayGain"`
 }
 
 type JukeboxPlaylist struct {
@@ -312,6 +477,7 @@ type PodcastChannel struct {
 	CoverArt         *specid.ID        `xml:"coverArt,attr"         json:"coverArt,omitempty"`
 	OriginalImageURL string            `xml:"originalImageUrl,attr" json:"originalImageUrl,omitempty"`
 	Status           string            `xml:"status,attr"           json:"status"`
+	ErrorMessage     string            `xml:"errorMessage,attr,omitempty" json:"errorMessage,omitempty"`
 	Episode          []*PodcastEpisode `xml:"episode"               json:"episode,omitempty"`
 }
 
@@ -334,6 +500,26 @@ type PodcastEpisode struct {
 	Duration    int        `xml:"duration,attr"    json:"duration"`
 	BitRate     int        `xml:"bitRate,attr"     json:"bitrate"`
 	Path        string     `xml:"path,attr"        json:"path"`
+	// EpisodeNumber and SeasonNumber are from the feed, 0 if it doesn't have them
+	EpisodeNumber int `xml:"episodeNumber,attr,omitempty" json:"episodeNumber,omitempty"`
+	SeasonNumber  int `xml:"seasonNumber,attr,omitempty"  json:"seasonNumber,omitempty"`
+	// ErrorMessage says why the download failed, when Status is "error"
+	ErrorMessage string `xml:"errorMessage,attr,omitempty" json:"errorMessage,omitempty"`
+	// Chapters are the same as getPodcastEpisodeChapters'
+	Chapters []*PodcastChapter `xml:"chapter,omitempty" json:"chapters,omitempty"`
+}
+
+// PodcastChapters is a gonic extension, listing the chapters of an episode
+type PodcastChapters struct {
+	List []*PodcastChapter `xml:"chapter" json:"chapter"`
+}
+
+type PodcastChapter struct {
+	// StartTime is in seconds from the start of the episode
+	StartTime float64 `xml:"startTime,attr"          json:"startTime"`
+	Title     string  `xml:"title,attr"              json:"title"`
+	URL       string  `xml:"url,attr,omitempty"      json:"url,omitempty"`
+	ImageURL  string  `xml:"imageUrl,attr,omitempty" json:"imageUrl,omitempty"`
 }
 
 type Bookmarks struct {
@@ -366,6 +552,19 @@ type StarredTwo struct {
 	Tracks  []*TrackChild `xml:"song,omitempty"   json:"song,omitempty"`
 }
 
+// AnnotationResults is a gonic extension which reports the outcome of each
+// operation in a batch of stars, unstars, and ratings
+type AnnotationResults struct {
+	List []*AnnotationResult `xml:"result" json:"result"`
+}
+
+type AnnotationResult struct {
+	Op     string `xml:"op,attr"              json:"op"`
+	ID     string `xml:"id,attr"              json:"id"`
+	Status string `xml:"status,attr"          json:"status"`
+	Error  string `xml:"error,attr,omitempty" json:"error,omitempty"`
+}
+
 type TopSongs struct {
 	Tracks []*TrackChild `xml:"song,omitempty" json:"song,omitempty"`
 }
@@ -389,3 +588,33 @@ type InternetRadioStation struct {
 	HomepageURL      string        `xml:"homepageUrl,attr" json:"homepageUrl"`
 }
 
+
+type SignedStreamURL struct {
+	URL     string    `xml:"url,attr"     json:"url"`
+	Expires time.Time `xml:"expires,attr" json:"expires"`
+}
+
+type ChatMessages struct {
+	List []*ChatMessage `xml:"chatMessage" json:"chatMessage"`
+}
+
+type ChatMessage struct {
+	Username string `xml:"username,attr" json:"username"`
+	// Time is in milliseconds since the epoch
+	Time    int64  `xml:"time,attr"    json:"time"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+type PlayedTogether struct {
+	// FromListens is false when the album hasn't been played with any others,
+	// and albums which share its genres are listed instead
+	FromListens bool     `xml:"fromListens,attr" json:"fromListens"`
+	List        []*Album `xml:"album"            json:"album"`
+}
+
+// OpenSubsonicExtension is an extension to the subsonic api that we support.
+// https://opensubsonic.netlify.app/docs/endpoints/getopensubsonicextensions/
+type OpenSubsonicExtension struct {
+	Name     string `xml:"name,attr" json:"name"`
+	Versions []int  `xml:"versions"  json:"versions"`
+}
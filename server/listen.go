@@ -0,0 +1,108 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// UnixPrefix starts a listen address which is the path of a unix socket, like
+// unix:/run/gonic/gonic.sock
+const UnixPrefix = "unix:"
+
+// listenFDsStart is the first file descriptor systemd passes, after stdin,
+// stdout, and stderr
+const listenFDsStart = 3
+
+var errNotSocket = errors.New("not a socket")
+
+// Listen listens on addr, a host and port or a unix socket path after
+// UnixPrefix. a unix socket is created with socketMode, and removed once the
+// listener is closed. if gonic was started by systemd socket activation, the
+// socket systemd passed is used instead of addr
+func Listen(addr string, socketMode os.FileMode) (net.Listener, error) {
+	l, err := systemdListener()
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket: %w", err)
+	}
+	if l != nil {
+		log.Printf("listening on socket %s from systemd, instead of %s", l.Addr(), addr)
+		return l, nil
+	}
+	if path := strings.TrimPrefix(addr, UnixPrefix); path != addr {
+		return listenUnix(path, socketMode)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	// a socket left behind by a gonic which didn't stop cleanly would make the
+	// listen fail. anything else at path is left alone
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%q: %w", path, errNotSocket)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove old socket: %w", err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("set socket mode: %w", err)
+	}
+	return l, nil
+}
+
+// systemdListener returns the first socket passed by systemd with the
+// LISTEN_FDS protocol, or nil if there isn't one. the variables are unset so
+// that processes started by gonic, like ffmpeg, don't see them
+func systemdListener() (net.Listener, error) {
+	n, err := listenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid())
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if n > 1 {
+		log.Printf("warning: systemd passed %d sockets, only the first is used", n)
+	}
+	return fileListener(listenFDsStart)
+}
+
+// listenFDs is how many sockets systemd passed, if they were passed to pid
+func listenFDs(listenPID, listenFDs string, pid int) (int, error) {
+	if listenPID == "" || listenFDs == "" {
+		return 0, nil
+	}
+	if listenPID != strconv.Itoa(pid) {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(listenFDs)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid LISTEN_FDS %q", listenFDs)
+	}
+	return n, nil
+}
+
+// fileListener is a listener for the socket at fd, which it takes over
+func fileListener(fd uintptr) (net.Listener, error) {
+	f := os.NewFile(fd, "systemd-socket")
+	if f == nil {
+		return nil, fmt.Errorf("fd %d: %w", fd, errNotSocket)
+	}
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("fd %d: %w", fd, err)
+	}
+	return l, nil
+}
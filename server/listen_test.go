@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestListenUnix(t *testing.T) {
+	is := is.New(t)
+	path := filepath.Join(t.TempDir(), "gonic.sock")
+
+	l, err := Listen(UnixPrefix+path, 0o600)
+	is.NoErr(err)
+	info, err := os.Stat(path)
+	is.NoErr(err)
+	is.True(info.Mode()&os.ModeSocket != 0)
+	is.Equal(info.Mode().Perm(), os.FileMode(0o600))
+
+	conn, err := net.Dial("unix", path)
+	is.NoErr(err)
+	conn.Close()
+
+	is.NoErr(l.Close())
+	_, err = os.Stat(path)
+	is.True(os.IsNotExist(err)) // removed on close
+}
+
+func TestListenUnixStale(t *testing.T) {
+	is := is.New(t)
+	path := filepath.Join(t.TempDir(), "gonic.sock")
+
+	// like one left by a gonic which was killed
+	stale, err := net.Listen("unix", path)
+	is.NoErr(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	is.NoErr(stale.Close())
+
+	l, err := Listen(UnixPrefix+path, 0o660)
+	is.NoErr(err)
+	is.NoErr(l.Close())
+
+	// anything which isn't a socket is left alone
+	is.NoErr(os.WriteFile(path, []byte("music"), 0o600))
+	_, err = Listen(UnixPrefix+path, 0o660)
+	is.True(errors.Is(err, errNotSocket))
+	data, err := os.ReadFile(path)
+	is.NoErr(err)
+	is.Equal(string(data), "music")
+}
+
+func TestListenFDs(t *testing.T) {
+	is := is.New(t)
+	n, err := listenFDs("", "", 100)
+	is.NoErr(err)
+	is.Equal(n, 0) // not started by systemd
+	n, err = listenFDs("99", "1", 100)
+	is.NoErr(err)
+	is.Equal(n, 0) // meant for another process
+	n, err = listenFDs("100", "2", 100)
+	is.NoErr(err)
+	is.Equal(n, 2)
+	_, err = listenFDs("100", "two", 100)
+	is.True(err != nil)
+}
+
+func TestFileListener(t *testing.T) {
+	is := is.New(t)
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer tcp.Close()
+
+	// a copy of the socket's fd, like the one systemd would pass
+	f, err := tcp.(*net.TCPListener).File()
+	is.NoErr(err)
+	fd, err := syscall.Dup(int(f.Fd()))
+	is.NoErr(err)
+	f.Close()
+	l, err := fileListener(uintptr(fd))
+	is.NoErr(err)
+	defer l.Close()
+	is.Equal(l.Addr().String(), tcp.Addr().String())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	is.NoErr(err)
+	conn.Close()
+}
@@ -1,12 +1,18 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
 	"github.com/sentriz/gormstore"
@@ -15,20 +21,33 @@ import (
 	"go.senan.xyz/gonic/server/ctrladmin"
 	"go.senan.xyz/gonic/server/ctrlbase"
 	"go.senan.xyz/gonic/server/ctrlsubsonic"
+	"go.senan.xyz/gonic/authlimit"
+	"go.senan.xyz/gonic/avatar"
+	"go.senan.xyz/gonic/backup"
+	"go.senan.xyz/gonic/coverarchive"
 	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/history"
 	"go.senan.xyz/gonic/jukebox"
+	"go.senan.xyz/gonic/metrics"
+	"go.senan.xyz/gonic/multierr"
+	"go.senan.xyz/gonic/notify"
+	"go.senan.xyz/gonic/playlists"
 	"go.senan.xyz/gonic/podcasts"
 	"go.senan.xyz/gonic/scanner"
 	"go.senan.xyz/gonic/scanner/tags"
 	"go.senan.xyz/gonic/scrobble"
 	"go.senan.xyz/gonic/scrobble/lastfm"
 	"go.senan.xyz/gonic/scrobble/listenbrainz"
+	"go.senan.xyz/gonic/scrobble/maloja"
+	"go.senan.xyz/gonic/streamsign"
+	"go.senan.xyz/gonic/together"
 	"go.senan.xyz/gonic/transcode"
+	"go.senan.xyz/gonic/warm"
 )
 
 type Options struct {
 	DB             *db.DB
-	MusicPaths     []string
+	MusicPaths     []db.MusicFolder
 	PodcastPath    string
 	CachePath      string
 	CoverCachePath string
@@ -36,6 +55,69 @@ type Options struct {
 	GenreSplit     string
 	HTTPLog        bool
 	JukeboxEnabled bool
+	// SlowRequest logs requests which take longer, even without HTTPLog, or
+	// nothing if 0
+	SlowRequest time.Duration
+	// LogJSON logs requests as json lines instead of plain text
+	LogJSON bool
+	// NoWebUI turns the web interface off, for when gonic is only used
+	// through the subsonic api
+	NoWebUI bool
+	// JukeboxReplayGain is which replaygain tags the jukebox applies
+	JukeboxReplayGain transcode.ReplayGainMode
+	// JukeboxPreBuffer is how much of the next track the jukebox decodes
+	// before the current one ends
+	JukeboxPreBuffer time.Duration
+	// JukeboxDevice is the audio device the jukebox plays to, or empty for
+	// the default one
+	JukeboxDevice string
+	// CoverArchiveWriteMusicDir saves fetched covers into album folders
+	// instead of the covers cache
+	CoverArchiveWriteMusicDir bool
+	// ChatHistoryMax is how many chat messages to keep, or all if 0
+	ChatHistoryMax int
+	// ScanTiming logs where the time went in each scan
+	ScanTiming bool
+	// PlaylistsPath has m3u and pls files to import after each scan, or is
+	// empty if there aren't any
+	PlaylistsPath string
+	// TranscodeCacheLimit is the most bytes of transcodes to keep, or no
+	// limit if 0
+	TranscodeCacheLimit int64
+	// TranscodeWarmWorkers is how many transcodes to warm the cache with at once
+	TranscodeWarmWorkers int
+	// TranscodeLimit is how many transcodes can run at once, see
+	// transcode.NewLimiter
+	TranscodeLimit int
+	// TranscodeMaxWait is how long a stream waits for a transcode before it's
+	// sent raw instead
+	TranscodeMaxWait time.Duration
+	// Notifier sends admins events like failed scans, or drops them if nil
+	Notifier *notify.Dispatcher
+	// DiskMinFree is how many bytes should be free where the cache and
+	// podcasts are kept before a disk_low event is sent
+	DiskMinFree uint64
+	// DBBackupPath is where StartDBBackup writes backups of the db, or empty
+	// if they're only downloaded from the admin page
+	DBBackupPath string
+	// Metrics records metrics for prometheus, which admins can see at
+	// /admin/metrics, and StartMetricsHTTP serves
+	Metrics bool
+	// ShutdownTimeout is how long StartHTTP's requests, like streams, have to
+	// finish once it's interrupted, before they're cut off
+	ShutdownTimeout time.Duration
+	// ProxyAuth logs users in by a header from a trusted reverse proxy, or is
+	// nil to only use gonic's own logins
+	ProxyAuth *ctrlbase.ProxyAuth
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For has the
+	// address of the client, for limiting failed logins and such
+	TrustedProxies []*net.IPNet
+	// AuthLimit slows down and locks out clients which keep failing to log
+	// in. it's off if MaxFailures is 0
+	AuthLimit authlimit.Options
+	// CORSOrigins are the origins of browser clients which can use the
+	// subsonic api, or "*" for any. it's off if there are none
+	CORSOrigins []string
 }
 
 type Server struct {
@@ -44,98 +126,254 @@ type Server struct {
 	router  *mux.Router
 	sessDB  *gormstore.Store
 	podcast *podcasts.Podcasts
+	db      *db.DB
+	warmer  *warm.Warmer
+	// scrobbleQueue is retried by StartScrobbleRetrier
+	scrobbleQueue *scrobble.Queue
+	backups       *backup.Backups
+	metrics       *metrics.Metrics
+
+	shutdownTimeout time.Duration
+
+	notifier    *notify.Dispatcher
+	diskPaths   []string
+	diskMinFree uint64
 }
 
 func New(opts Options) (*Server, error) {
-	for i, musicPath := range opts.MusicPaths {
-		opts.MusicPaths[i] = filepath.Clean(musicPath)
+	musicPaths := make([]string, 0, len(opts.MusicPaths))
+	for i := range opts.MusicPaths {
+		opts.MusicPaths[i].Path = filepath.Clean(opts.MusicPaths[i].Path)
+		musicPaths = append(musicPaths, opts.MusicPaths[i].Path)
+	}
+	musicFolders, err := opts.DB.SyncMusicFolders(opts.MusicPaths)
+	if err != nil {
+		return nil, fmt.Errorf("sync music folders: %w", err)
 	}
 	opts.CachePath = filepath.Clean(opts.CachePath)
 	opts.PodcastPath = filepath.Clean(opts.PodcastPath)
 
 	tagger := &tags.TagReader{}
 
-	scanner := scanner.New(opts.MusicPaths, opts.DB, opts.GenreSplit, tagger)
+	var metricsRec *metrics.Metrics
+	if opts.Metrics {
+		metricsRec = metrics.New()
+	}
+
+	scanner := scanner.New(musicPaths, opts.DB, opts.GenreSplit, tagger)
+	scanner.LogTimings(opts.ScanTiming)
+	scanner.SetNotifier(opts.Notifier)
+	scanner.SetMetrics(metricsRec)
+	if opts.PlaylistsPath != "" {
+		opts.PlaylistsPath = filepath.Clean(opts.PlaylistsPath)
+	}
+	playlistSyncer := playlists.New(opts.DB, opts.PlaylistsPath, musicPaths)
+	scanner.OnDone(func() {
+		result, err := playlistSyncer.Sync()
+		if errors.Is(err, playlists.ErrDisabled) {
+			return
+		}
+		if err != nil {
+			log.Printf("error syncing playlist files: %v", err)
+			return
+		}
+		log.Printf("synced %d playlist files, %d removed, %d tracks unresolved", result.Synced, result.Deleted, result.Unresolved)
+	})
 	base := &ctrlbase.Controller{
-		DB:          opts.DB,
-		ProxyPrefix: opts.ProxyPrefix,
-		Scanner:     scanner,
+		DB:             opts.DB,
+		ProxyPrefix:    opts.ProxyPrefix,
+		Scanner:        scanner,
+		Notifier:       opts.Notifier,
+		PlaylistFiles:  playlistSyncer,
+		Metrics:        metricsRec,
+		HTTPLog:        opts.HTTPLog,
+		SlowRequest:    opts.SlowRequest,
+		LogJSON:        opts.LogJSON,
+		ProxyAuth:      opts.ProxyAuth,
+		TrustedProxies: opts.TrustedProxies,
+		AuthLimit:      authlimit.New(opts.AuthLimit),
+		CORSOrigins:    opts.CORSOrigins,
 	}
 
 	// router with common wares for admin / subsonic
 	r := mux.NewRouter()
-	if opts.HTTPLog {
-		r.Use(base.WithLogging)
-	}
-	r.Use(base.WithCORS)
+	r.Use(base.WithLogging)
 
-	sessKey, err := opts.DB.GetSetting("session_key")
+	streamSignKey, err := opts.DB.GetSetting("stream_sign_key")
 	if err != nil {
-		return nil, fmt.Errorf("get session key: %w", err)
+		return nil, fmt.Errorf("get stream sign key: %w", err)
 	}
-	if sessKey == "" {
-		if err := opts.DB.SetSetting("session_key", string(securecookie.GenerateRandomKey(32))); err != nil {
-			return nil, fmt.Errorf("set session key: %w", err)
+	if streamSignKey == "" {
+		if streamSignKey, err = streamsign.GenerateKey(); err != nil {
+			return nil, fmt.Errorf("generate stream sign key: %w", err)
+		}
+		if err := opts.DB.SetSetting("stream_sign_key", streamSignKey); err != nil {
+			return nil, fmt.Errorf("set stream sign key: %w", err)
 		}
 	}
 
-	sessDB := gormstore.New(opts.DB.DB, []byte(sessKey))
-	sessDB.SessionOpts.HttpOnly = true
-	sessDB.SessionOpts.SameSite = http.SameSiteLaxMode
+	scrobblers := []scrobble.Scrobbler{&lastfm.Scrobbler{DB: opts.DB}, &listenbrainz.Scrobbler{}, &maloja.Scrobbler{}}
+	scrobbleQueue := scrobble.NewQueue(opts.DB, scrobblers)
+	scrobbleQueue.SetMetrics(metricsRec)
 
 	podcast := podcasts.New(opts.DB, opts.PodcastPath, tagger)
+	podcast.SetNotifier(opts.Notifier)
+
+	fetchedCoverPath := filepath.Join(opts.CoverCachePath, "archive")
+	coverArchive := coverarchive.New(opts.DB, fetchedCoverPath, opts.CoverArchiveWriteMusicDir)
+	scanner.OnDone(func() {
+		err := coverArchive.FetchMissing(context.Background())
+		if err != nil && !errors.Is(err, coverarchive.ErrDisabled) {
+			log.Printf("error fetching covers: %v", err)
+		}
+	})
 
-	cacheTranscoder := transcode.NewCachingTranscoder(
+	transcodeLimiter := transcode.NewLimiter(
 		transcode.NewFFmpegTranscoder(),
+		opts.TranscodeLimit,
+		opts.TranscodeMaxWait,
+	)
+	metricsRec.TranscodesActive(transcodeLimiter.Active)
+	cacheTranscoder, err := transcode.NewCachingTranscoder(
+		transcodeLimiter,
 		opts.CachePath,
+		opts.TranscodeCacheLimit,
 	)
-
-	ctrlAdmin, err := ctrladmin.New(base, sessDB, podcast)
 	if err != nil {
-		return nil, fmt.Errorf("create admin controller: %w", err)
+		return nil, fmt.Errorf("create transcode cache: %w", err)
 	}
+	warmer := warm.New(opts.DB, cacheTranscoder, opts.TranscodeWarmWorkers)
+	backups := backup.New(opts.DB, scanner, opts.DBBackupPath)
+	scanner.OnDone(func() {
+		if _, err := warmer.QueueNew(); err != nil {
+			log.Printf("error queueing new tracks to warm: %v", err)
+		}
+	})
+
 	ctrlSubsonic := &ctrlsubsonic.Controller{
 		Controller:     base,
 		CachePath:      opts.CachePath,
 		CoverCachePath: opts.CoverCachePath,
 		PodcastsPath:   opts.PodcastPath,
-		MusicPaths:     opts.MusicPaths,
+		MusicFolders:   musicFolders,
 		Jukebox:        &jukebox.Jukebox{},
-		Scrobblers:     []scrobble.Scrobbler{&lastfm.Scrobbler{DB: opts.DB}, &listenbrainz.Scrobbler{}},
+		Scrobblers:     scrobblers,
+		ScrobbleQueue:  scrobbleQueue,
+		ScrobbleFilter: scrobble.NewFilter(opts.DB),
 		Podcasts:       podcast,
 		Transcoder:     cacheTranscoder,
+		StreamSigner:   streamsign.New([]byte(streamSignKey)),
+
+		FetchedCoverPath: fetchedCoverPath,
+		ChatHistoryMax:   opts.ChatHistoryMax,
 	}
 
-	setupMisc(r, base)
-	setupAdmin(r.PathPrefix("/admin").Subrouter(), ctrlAdmin)
-	setupSubsonic(r.PathPrefix("/rest").Subrouter(), ctrlSubsonic)
+	// sessions are only for the web interface, which isn't set up without it
+	var sessDB *gormstore.Store
+	setupMisc(r, base, !opts.NoWebUI)
+	if opts.NoWebUI {
+		hasUsers, err := opts.DB.HasUsers()
+		if err != nil {
+			return nil, fmt.Errorf("find users: %w", err)
+		}
+		if !hasUsers {
+			log.Printf("gonic isn't set up yet. please create an admin with `gonic create-admin <username>`")
+		}
+	} else {
+		sessDB, err = newSessionStore(opts.DB)
+		if err != nil {
+			return nil, err
+		}
+		ctrlAdmin, err := ctrladmin.New(base, sessDB, podcast, scrobbleQueue, history.New(opts.DB), coverArchive, cacheTranscoder, transcodeLimiter, warmer)
+		if err != nil {
+			return nil, fmt.Errorf("create admin controller: %w", err)
+		}
+		for _, folder := range musicFolders {
+			ctrlAdmin.SetupPaths = append(ctrlAdmin.SetupPaths, ctrladmin.SetupPath{Name: "music: " + folder.Name, Path: folder.Path})
+		}
+		ctrlAdmin.MusicFolders = musicFolders
+		ctrlAdmin.Backups = backups
+		ctrlAdmin.SetupPaths = append(ctrlAdmin.SetupPaths,
+			ctrladmin.SetupPath{Name: "cache", Path: opts.CachePath, Writable: true},
+			ctrladmin.SetupPath{Name: "podcasts", Path: opts.PodcastPath, Writable: true},
+		)
+		setupAdmin(r.PathPrefix("/admin").Subrouter(), ctrlAdmin)
+	}
+	// browser clients can only use the subsonic api, not the web interface
+	rest := r.PathPrefix("/rest").Subrouter()
+	rest.Use(base.WithCORS)
+	setupSubsonicPublic(rest.NewRoute().Subrouter(), ctrlSubsonic)
+	setupSubsonic(rest.NewRoute().Subrouter(), ctrlSubsonic)
 
 	server := &Server{
 		scanner: scanner,
 		router:  r,
 		sessDB:  sessDB,
 		podcast: podcast,
+		db:      opts.DB,
+		warmer:  warmer,
+
+		scrobbleQueue: scrobbleQueue,
+		backups:       backups,
+		metrics:       metricsRec,
+
+		shutdownTimeout: opts.ShutdownTimeout,
+
+		notifier:    opts.Notifier,
+		diskPaths:   []string{opts.CachePath, opts.PodcastPath},
+		diskMinFree: opts.DiskMinFree,
 	}
 
 	if opts.JukeboxEnabled {
-		jukebox := jukebox.New()
+		jukebox := jukebox.New(transcodeLimiter)
+		jukebox.SetReplayGainMode(opts.JukeboxReplayGain)
+		jukebox.SetPreBuffer(opts.JukeboxPreBuffer)
+		jukebox.SetDevice(opts.JukeboxDevice)
+		if err := jukebox.Restore(opts.DB); err != nil {
+			log.Printf("error restoring jukebox playlist: %v", err)
+		}
 		ctrlSubsonic.Jukebox = jukebox
 		server.jukebox = jukebox
+		metricsRec.JukeboxPlaying(func() bool {
+			return jukebox.GetStatus().Playing
+		})
 	}
 
 	return server, nil
 }
 
-func setupMisc(r *mux.Router, ctrl *ctrlbase.Controller) {
-	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// setupMisc adds the routes outside of /admin and /rest. without the web
+// interface, the ones which would go to it point at the subsonic api instead
+func newSessionStore(dbc *db.DB) (*gormstore.Store, error) {
+	sessKey, err := dbc.GetSetting("session_key")
+	if err != nil {
+		return nil, fmt.Errorf("get session key: %w", err)
+	}
+	if sessKey == "" {
+		if err := dbc.SetSetting("session_key", string(securecookie.GenerateRandomKey(32))); err != nil {
+			return nil, fmt.Errorf("set session key: %w", err)
+		}
+	}
+	sessDB := gormstore.New(dbc.DB, []byte(sessKey))
+	sessDB.SessionOpts.HttpOnly = true
+	sessDB.SessionOpts.SameSite = http.SameSiteLaxMode
+	return sessDB, nil
+}
+
+func setupMisc(r *mux.Router, ctrl *ctrlbase.Controller, webUI bool) {
+	toAdminHome := func(w http.ResponseWriter, r *http.Request) {
 		adminHome := ctrl.Path("/admin/home")
 		http.Redirect(w, r, adminHome, http.StatusSeeOther)
-	})
+	}
+	if !webUI {
+		toAdminHome = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintf(w, "gonic is running without its web interface. the subsonic api is at %s\n", ctrl.Path("/rest"))
+		}
+	}
+	r.HandleFunc("/", toAdminHome)
 	// misc subsonic routes without /rest prefix
-	r.HandleFunc("/settings.view", func(w http.ResponseWriter, r *http.Request) {
-		adminHome := ctrl.Path("/admin/home")
-		http.Redirect(w, r, adminHome, http.StatusSeeOther)
-	})
+	r.HandleFunc("/settings.view", toAdminHome)
 	r.HandleFunc("/musicFolderSettings.view", func(w http.ResponseWriter, r *http.Request) {
 		restScan := ctrl.Path(fmt.Sprintf("/rest/startScan.view?%s", r.URL.Query().Encode()))
 		http.Redirect(w, r, restScan, http.StatusSeeOther)
@@ -148,6 +386,8 @@ func setupAdmin(r *mux.Router, ctrl *ctrladmin.Controller) {
 	r.Use(ctrl.WithSession)
 	r.Handle("/login", ctrl.H(ctrl.ServeLogin))
 	r.Handle("/login_do", ctrl.HR(ctrl.ServeLoginDo)) // "raw" handler, updates session
+	r.Handle("/setup", ctrl.H(ctrl.ServeSetup))
+	r.Handle("/setup_do", ctrl.H(ctrl.ServeSetupDo)).Methods(http.MethodPost)
 
 	staticHandler := http.StripPrefix("/admin", http.FileServer(http.FS(assets.Static)))
 	r.PathPrefix("/static").Handler(staticHandler)
@@ -157,24 +397,51 @@ func setupAdmin(r *mux.Router, ctrl *ctrladmin.Controller) {
 	routUser.Use(ctrl.WithUserSession)
 	routUser.Handle("/logout", ctrl.HR(ctrl.ServeLogout)) // "raw" handler, updates session
 	routUser.Handle("/home", ctrl.H(ctrl.ServeHome))
-	routUser.Handle("/change_own_username", ctrl.H(ctrl.ServeChangeOwnUsername))
-	routUser.Handle("/change_own_username_do", ctrl.H(ctrl.ServeChangeOwnUsernameDo))
+	routUser.Handle("/artist", ctrl.H(ctrl.ServeArtist))
 	routUser.Handle("/change_own_password", ctrl.H(ctrl.ServeChangeOwnPassword))
 	routUser.Handle("/change_own_password_do", ctrl.H(ctrl.ServeChangeOwnPasswordDo))
-	routUser.Handle("/link_lastfm_do", ctrl.H(ctrl.ServeLinkLastFMDo))
-	routUser.Handle("/unlink_lastfm_do", ctrl.H(ctrl.ServeUnlinkLastFMDo))
-	routUser.Handle("/link_listenbrainz_do", ctrl.H(ctrl.ServeLinkListenBrainzDo))
-	routUser.Handle("/unlink_listenbrainz_do", ctrl.H(ctrl.ServeUnlinkListenBrainzDo))
-	routUser.Handle("/upload_playlist_do", ctrl.H(ctrl.ServeUploadPlaylistDo))
-	routUser.Handle("/delete_playlist_do", ctrl.H(ctrl.ServeDeletePlaylistDo))
-	routUser.Handle("/create_transcode_pref_do", ctrl.H(ctrl.ServeCreateTranscodePrefDo))
-	routUser.Handle("/delete_transcode_pref_do", ctrl.H(ctrl.ServeDeleteTranscodePrefDo))
+	routUser.Handle("/update_locale_do", ctrl.H(ctrl.ServeUpdateLocaleDo))
+	routUser.Handle("/download_playlist", ctrl.HR(ctrl.ServeDownloadPlaylist))
+	routUser.Handle("/create_api_key_do", ctrl.H(ctrl.ServeCreateAPIKeyDo))
+	routUser.Handle("/delete_api_key_do", ctrl.H(ctrl.ServeDeleteAPIKeyDo))
+	routUser.Handle("/rotate_stream_key_do", ctrl.H(ctrl.ServeRotateStreamKeyDo))
+	routUser.Handle("/avatar", ctrl.HR(ctrl.ServeAvatar))
+
+	// user routes which change things (if the user isn't read only)
+	routWrite := routUser.NewRoute().Subrouter()
+	routWrite.Use(ctrl.WithWritableSession)
+	routWrite.Handle("/change_own_username", ctrl.H(ctrl.ServeChangeOwnUsername))
+	routWrite.Handle("/change_own_username_do", ctrl.H(ctrl.ServeChangeOwnUsernameDo))
+	routWrite.Handle("/link_lastfm_do", ctrl.H(ctrl.ServeLinkLastFMDo))
+	routWrite.Handle("/unlink_lastfm_do", ctrl.H(ctrl.ServeUnlinkLastFMDo))
+	routWrite.Handle("/link_listenbrainz_do", ctrl.H(ctrl.ServeLinkListenBrainzDo))
+	routWrite.Handle("/unlink_listenbrainz_do", ctrl.H(ctrl.ServeUnlinkListenBrainzDo))
+	routWrite.Handle("/link_maloja_do", ctrl.H(ctrl.ServeLinkMalojaDo))
+	routWrite.Handle("/unlink_maloja_do", ctrl.H(ctrl.ServeUnlinkMalojaDo))
+	routWrite.Handle("/import_lastfm_history_do", ctrl.H(ctrl.ServeImportLastFMHistoryDo))
+	routWrite.Handle("/import_listenbrainz_history_do", ctrl.H(ctrl.ServeImportListenBrainzHistoryDo))
+	routWrite.Handle("/update_artist_index_do", ctrl.H(ctrl.ServeUpdateArtistIndexDo))
+	routWrite.Handle("/update_replay_gain_do", ctrl.H(ctrl.ServeUpdateReplayGainDo))
+	routWrite.Handle("/upload_playlist_do", ctrl.H(ctrl.ServeUploadPlaylistDo))
+	routWrite.Handle("/delete_playlist_do", ctrl.H(ctrl.ServeDeletePlaylistDo))
+	routWrite.Handle("/refresh_smart_playlist_do", ctrl.H(ctrl.ServeRefreshSmartPlaylistDo))
+	routWrite.Handle("/upload_playlist_image_do", ctrl.H(ctrl.ServeUploadPlaylistImageDo))
+	routWrite.Handle("/delete_playlist_image_do", ctrl.H(ctrl.ServeDeletePlaylistImageDo))
+	routWrite.Handle("/create_transcode_pref_do", ctrl.H(ctrl.ServeCreateTranscodePrefDo))
+	routWrite.Handle("/delete_transcode_pref_do", ctrl.H(ctrl.ServeDeleteTranscodePrefDo))
+	// with some room for the rest of the form
+	routWrite.Handle("/upload_avatar_do", ctrladmin.WithMaxBody(avatar.MaxUploadSize+1000*1000, ctrl.H(ctrl.ServeUploadAvatarDo)))
+	routWrite.Handle("/delete_avatar_do", ctrl.H(ctrl.ServeDeleteAvatarDo))
 
 	// admin routes (if session is valid, and is admin)
 	routAdmin := routUser.NewRoute().Subrouter()
 	routAdmin.Use(ctrl.WithAdminSession)
 	routAdmin.Handle("/change_username", ctrl.H(ctrl.ServeChangeUsername))
 	routAdmin.Handle("/change_username_do", ctrl.H(ctrl.ServeChangeUsernameDo))
+	routAdmin.Handle("/change_role", ctrl.H(ctrl.ServeChangeRole))
+	routAdmin.Handle("/change_role_do", ctrl.H(ctrl.ServeChangeRoleDo))
+	routAdmin.Handle("/change_music_folders", ctrl.H(ctrl.ServeChangeMusicFolders))
+	routAdmin.Handle("/change_music_folders_do", ctrl.H(ctrl.ServeChangeMusicFoldersDo))
 	routAdmin.Handle("/change_password", ctrl.H(ctrl.ServeChangePassword))
 	routAdmin.Handle("/change_password_do", ctrl.H(ctrl.ServeChangePasswordDo))
 	routAdmin.Handle("/delete_user", ctrl.H(ctrl.ServeDeleteUser))
@@ -185,10 +452,28 @@ func setupAdmin(r *mux.Router, ctrl *ctrladmin.Controller) {
 	routAdmin.Handle("/update_lastfm_api_key_do", ctrl.H(ctrl.ServeUpdateLastFMAPIKeyDo))
 	routAdmin.Handle("/start_scan_inc_do", ctrl.H(ctrl.ServeStartScanIncDo))
 	routAdmin.Handle("/start_scan_full_do", ctrl.H(ctrl.ServeStartScanFullDo))
+	routAdmin.Handle("/update_cover_archive_do", ctrl.H(ctrl.ServeUpdateCoverArchiveDo))
+	routAdmin.Handle("/update_public_avatars_do", ctrl.H(ctrl.ServeUpdatePublicAvatarsDo))
+	routAdmin.Handle("/purge_transcode_cache_do", ctrl.H(ctrl.ServePurgeTranscodeCacheDo))
+	routAdmin.Handle("/warm_transcode_cache_do", ctrl.H(ctrl.ServeWarmTranscodeCacheDo))
+	routAdmin.Handle("/send_test_notification_do", ctrl.H(ctrl.ServeSendTestNotificationDo))
+	routAdmin.Handle("/flush_scrobble_queue_do", ctrl.H(ctrl.ServeFlushScrobbleQueueDo))
+	routAdmin.Handle("/update_scrobble_rules_do", ctrl.H(ctrl.ServeUpdateScrobbleRulesDo))
+	routAdmin.Handle("/create_raw_rule_do", ctrl.H(ctrl.ServeCreateRawRuleDo))
+	routAdmin.Handle("/delete_raw_rule_do", ctrl.H(ctrl.ServeDeleteRawRuleDo))
 	routAdmin.Handle("/add_podcast_do", ctrl.H(ctrl.ServePodcastAddDo))
 	routAdmin.Handle("/delete_podcast_do", ctrl.H(ctrl.ServePodcastDeleteDo))
 	routAdmin.Handle("/download_podcast_do", ctrl.H(ctrl.ServePodcastDownloadDo))
 	routAdmin.Handle("/update_podcast_do", ctrl.H(ctrl.ServePodcastUpdateDo))
+	routAdmin.Handle("/retry_podcast_do", ctrl.H(ctrl.ServePodcastRetryDo))
+	routAdmin.Handle("/import_podcasts_do", ctrl.H(ctrl.ServePodcastImportDo))
+	routAdmin.Handle("/export_podcasts", ctrl.HR(ctrl.ServePodcastExport))
+	routAdmin.Handle("/download_db_backup", ctrl.HR(ctrl.ServeDownloadDBBackup))
+	routAdmin.Handle("/backup_db_do", ctrl.H(ctrl.ServeBackupDBDo))
+	routAdmin.Handle("/check_db_do", ctrl.H(ctrl.ServeCheckDBDo))
+	if ctrl.Metrics != nil {
+		routAdmin.Handle("/metrics", ctrl.Metrics)
+	}
 	routAdmin.Handle("/add_internet_radio_station_do", ctrl.H(ctrl.ServeInternetRadioStationAddDo))
 	routAdmin.Handle("/delete_internet_radio_station_do", ctrl.H(ctrl.ServeInternetRadioStationDeleteDo))
 	routAdmin.Handle("/update_internet_radio_station_do", ctrl.H(ctrl.ServeInternetRadioStationUpdateDo))
@@ -200,8 +485,25 @@ func setupAdmin(r *mux.Router, ctrl *ctrladmin.Controller) {
 	r.NotFoundHandler = notFoundRoute.GetHandler()
 }
 
+// setupSubsonicPublic adds the subsonic routes which don't need auth. requests
+// which don't match here fall through to the usual routes in setupSubsonic
+func setupSubsonicPublic(r *mux.Router, ctrl *ctrlsubsonic.Controller) {
+	r.Use(ctrl.WithMetrics)
+	r.Use(ctrl.WithParams)
+
+	r.Handle("/getOpenSubsonicExtensions{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetOpenSubsonicExtensions))
+
+	// signed urls from getSignedStreamURL. unsigned requests use the usual auth
+	r.Handle("/stream{_:(?:\\.view)?}", ctrl.WithSignedURL(ctrl.HR(ctrl.ServeStream))).Queries("sig", "{sig}")
+	r.Handle("/download{_:(?:\\.view)?}", ctrl.WithSignedURL(ctrl.HR(ctrl.ServeDownload))).Queries("sig", "{sig}")
+	r.Handle("/hls.m3u8", ctrl.WithSignedURL(ctrl.HR(ctrl.ServeHLS))).Queries("sig", "{sig}")
+	r.Handle("/hlsSegment.ts", ctrl.WithSignedURL(ctrl.HR(ctrl.ServeHLSSegment))).Queries("sig", "{sig}")
+}
+
 func setupSubsonic(r *mux.Router, ctrl *ctrlsubsonic.Controller) {
+	r.Use(ctrl.WithMetrics)
 	r.Use(ctrl.WithParams)
+	r.Use(ctrl.WithProxyUser)
 	r.Use(ctrl.WithRequiredParams)
 	r.Use(ctrl.WithUser)
 
@@ -209,11 +511,18 @@ func setupSubsonic(r *mux.Router, ctrl *ctrlsubsonic.Controller) {
 	r.Handle("/getLicense{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetLicence))
 	r.Handle("/getMusicFolders{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetMusicFolders))
 	r.Handle("/getScanStatus{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetScanStatus))
+	r.Handle("/getLibraryStats{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetLibraryStats))
 	r.Handle("/ping{_:(?:\\.view)?}", ctrl.H(ctrl.ServePing))
 	r.Handle("/scrobble{_:(?:\\.view)?}", ctrl.H(ctrl.ServeScrobble))
 	r.Handle("/startScan{_:(?:\\.view)?}", ctrl.H(ctrl.ServeStartScan))
 	r.Handle("/getUser{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetUser))
+	r.Handle("/getUsers{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetUsers))
+	r.Handle("/createUser{_:(?:\\.view)?}", ctrl.H(ctrl.ServeCreateUser))
+	r.Handle("/updateUser{_:(?:\\.view)?}", ctrl.H(ctrl.ServeUpdateUser))
+	r.Handle("/deleteUser{_:(?:\\.view)?}", ctrl.H(ctrl.ServeDeleteUser))
+	r.Handle("/changePassword{_:(?:\\.view)?}", ctrl.H(ctrl.ServeChangePassword))
 	r.Handle("/getPlaylists{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetPlaylists))
+	r.Handle("/getPlaylist{_:(?:\\.view)?}", ctrl.HR(ctrl.ServeGetPlaylistFile)).Queries("format", "m3u8")
 	r.Handle("/getPlaylist{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetPlaylist))
 	r.Handle("/createPlaylist{_:(?:\\.view)?}", ctrl.H(ctrl.ServeCreatePlaylist))
 	r.Handle("/updatePlaylist{_:(?:\\.view)?}", ctrl.H(ctrl.ServeUpdatePlaylist))
@@ -230,11 +539,22 @@ func setupSubsonic(r *mux.Router, ctrl *ctrlsubsonic.Controller) {
 	r.Handle("/getTopSongs{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetTopSongs))
 	r.Handle("/getSimilarSongs{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetSimilarSongs))
 	r.Handle("/getSimilarSongs2{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetSimilarSongsTwo))
+	r.Handle("/star{_:(?:\\.view)?}", ctrl.H(ctrl.ServeStar))
+	r.Handle("/unstar{_:(?:\\.view)?}", ctrl.H(ctrl.ServeUnstar))
+	r.Handle("/setRating{_:(?:\\.view)?}", ctrl.H(ctrl.ServeSetRating))
+	r.Handle("/annotateBatch{_:(?:\\.view)?}", ctrl.H(ctrl.ServeAnnotateBatch))
+	r.Handle("/getSignedStreamURL{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetSignedStreamURL))
+	r.Handle("/getChatMessages{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetChatMessages))
+	r.Handle("/addChatMessage{_:(?:\\.view)?}", ctrl.H(ctrl.ServeAddChatMessage))
+	r.Handle("/getAlbumsPlayedTogether{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetAlbumsPlayedTogether))
 
 	// raw
 	r.Handle("/getCoverArt{_:(?:\\.view)?}", ctrl.HR(ctrl.ServeGetCoverArt))
+	r.Handle("/getAvatar{_:(?:\\.view)?}", ctrl.HR(ctrl.ServeGetAvatar))
 	r.Handle("/stream{_:(?:\\.view)?}", ctrl.HR(ctrl.ServeStream))
-	r.Handle("/download{_:(?:\\.view)?}", ctrl.HR(ctrl.ServeStream))
+	r.Handle("/download{_:(?:\\.view)?}", ctrl.HR(ctrl.ServeDownload))
+	r.Handle("/hls.m3u8", ctrl.HR(ctrl.ServeHLS))
+	r.Handle("/hlsSegment.ts", ctrl.HR(ctrl.ServeHLSSegment))
 
 	// browse by tag
 	r.Handle("/getAlbum{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetAlbum))
@@ -262,6 +582,7 @@ func setupSubsonic(r *mux.Router, ctrl *ctrlsubsonic.Controller) {
 	r.Handle("/refreshPodcasts{_:(?:\\.view)?}", ctrl.H(ctrl.ServeRefreshPodcasts))
 	r.Handle("/deletePodcastChannel{_:(?:\\.view)?}", ctrl.H(ctrl.ServeDeletePodcastChannel))
 	r.Handle("/deletePodcastEpisode{_:(?:\\.view)?}", ctrl.H(ctrl.ServeDeletePodcastEpisode))
+	r.Handle("/getPodcastEpisodeChapters{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetPodcastEpisodeChapters))
 
 	// internet radio
 	r.Handle("/getInternetRadioStations{_:(?:\\.view)?}", ctrl.H(ctrl.ServeGetInternetRadioStations))
@@ -276,32 +597,69 @@ func setupSubsonic(r *mux.Router, ctrl *ctrlsubsonic.Controller) {
 	r.NotFoundHandler = notFoundRoute.GetHandler()
 }
 
+// Shutdown finishes what the jobs leave behind, once they've all stopped. it
+// stops the scans, waiting for them until ctx is done, and retries the queued
+// scrobbles one last time
+func (s *Server) Shutdown(ctx context.Context) error {
+	errs := &multierr.Err{}
+	if err := s.scanner.Stop(ctx); err != nil {
+		errs.Add(fmt.Errorf("stop scans: %w", err))
+	}
+	if err := s.scrobbleQueue.Retry(ctx, true); err != nil {
+		errs.Add(fmt.Errorf("retry scrobbles: %w", err))
+	}
+	if errs.Len() > 0 {
+		return errs
+	}
+	return nil
+}
+
 type (
 	FuncExecute   func() error
 	FuncInterrupt func(error)
 )
 
-func (s *Server) StartHTTP(listenAddr string, tlsCert string, tlsKey string) (FuncExecute, FuncInterrupt) {
+// StartHTTP serves the subsonic api and the web interface on l, see Listen.
+// once interrupted, new connections are refused, and the requests already
+// running get the shutdown timeout to finish
+func (s *Server) StartHTTP(l net.Listener, tlsCert string, tlsKey string) (FuncExecute, FuncInterrupt) {
 	list := &http.Server{
-		Addr:         listenAddr,
 		Handler:      s.router,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 80 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
+	drained := make(chan struct{})
 	return func() error {
-			log.Print("starting job 'http'\n")
+			log.Printf("starting job 'http' on %s\n", l.Addr())
+			var err error
 			if tlsCert != "" && tlsKey != "" {
-				return list.ListenAndServeTLS(tlsCert, tlsKey)
+				err = list.ServeTLS(l, tlsCert, tlsKey)
+			} else {
+				err = list.Serve(l)
 			}
-			return list.ListenAndServe()
+			if errors.Is(err, http.ErrServerClosed) {
+				<-drained
+				return nil
+			}
+			return err
 		}, func(_ error) {
 			// stop job
-			_ = list.Close()
+			go func() {
+				defer close(drained)
+				ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+				defer cancel()
+				if err := list.Shutdown(ctx); err != nil {
+					log.Printf("error waiting for requests to finish, closing them: %v", err)
+					_ = list.Close()
+				}
+			}()
 		}
 }
 
-func (s *Server) StartScanTicker(dur time.Duration) (FuncExecute, FuncInterrupt) {
+// StartScanTicker scans dirs every dur, or all the music dirs if there aren't
+// any
+func (s *Server) StartScanTicker(dur time.Duration, dirs ...string) (FuncExecute, FuncInterrupt) {
 	ticker := time.NewTicker(dur)
 	done := make(chan struct{})
 	waitFor := func() error {
@@ -311,7 +669,7 @@ func (s *Server) StartScanTicker(dur time.Duration) (FuncExecute, FuncInterrupt)
 				return nil
 			case <-ticker.C:
 				go func() {
-					if _, err := s.scanner.ScanAndClean(scanner.ScanOptions{}); err != nil {
+					if _, err := s.scanner.ScanAndClean(scanner.ScanOptions{Dirs: dirs}); err != nil {
 						log.Printf("error scanning: %v", err)
 					}
 				}()
@@ -319,7 +677,11 @@ func (s *Server) StartScanTicker(dur time.Duration) (FuncExecute, FuncInterrupt)
 		}
 	}
 	return func() error {
-			log.Printf("starting job 'scan timer'\n")
+			if len(dirs) > 0 {
+				log.Printf("starting job 'scan timer' for %s\n", strings.Join(dirs, ", "))
+			} else {
+				log.Printf("starting job 'scan timer'\n")
+			}
 			return waitFor()
 		}, func(_ error) {
 			// stop job
@@ -328,6 +690,20 @@ func (s *Server) StartScanTicker(dur time.Duration) (FuncExecute, FuncInterrupt)
 		}
 }
 
+// StartScanStopper waits for gonic to stop, and then tells running scans to
+// stop straight away, rather than once requests have finished in Shutdown
+func (s *Server) StartScanStopper() (FuncExecute, FuncInterrupt) {
+	done := make(chan struct{})
+	return func() error {
+			<-done
+			return nil
+		}, func(_ error) {
+			// stop job
+			s.scanner.Interrupt()
+			close(done)
+		}
+}
+
 func (s *Server) StartJukebox() (FuncExecute, FuncInterrupt) {
 	return func() error {
 			log.Printf("starting job 'jukebox'\n")
@@ -340,14 +716,14 @@ func (s *Server) StartJukebox() (FuncExecute, FuncInterrupt) {
 
 func (s *Server) StartPodcastRefresher(dur time.Duration) (FuncExecute, FuncInterrupt) {
 	ticker := time.NewTicker(dur)
-	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
 	waitFor := func() error {
 		for {
 			select {
-			case <-done:
+			case <-ctx.Done():
 				return nil
 			case <-ticker.C:
-				if err := s.podcast.RefreshPodcasts(); err != nil {
+				if err := s.podcast.RefreshDuePodcasts(ctx); err != nil {
 					log.Printf("failed to refresh some feeds: %s", err)
 				}
 			}
@@ -355,6 +731,35 @@ func (s *Server) StartPodcastRefresher(dur time.Duration) (FuncExecute, FuncInte
 	}
 	return func() error {
 			log.Printf("starting job 'podcast refresher'\n")
+			if err := s.podcast.RestartDownloads(); err != nil {
+				log.Printf("failed to restart some podcast downloads: %s", err)
+			}
+			return waitFor()
+		}, func(_ error) {
+			// stop job, and the refresh if there's one running
+			ticker.Stop()
+			cancel()
+		}
+}
+
+// StartTogetherUpdater pairs up new listens for package together's suggestions
+func (s *Server) StartTogetherUpdater(dur time.Duration) (FuncExecute, FuncInterrupt) {
+	ticker := time.NewTicker(dur)
+	done := make(chan struct{})
+	waitFor := func() error {
+		for {
+			select {
+			case <-done:
+				return nil
+			case <-ticker.C:
+				if _, err := together.Update(s.db); err != nil {
+					log.Printf("error pairing listens: %v", err)
+				}
+			}
+		}
+	}
+	return func() error {
+			log.Printf("starting job 'played together'\n")
 			return waitFor()
 		}, func(_ error) {
 			// stop job
@@ -363,6 +768,101 @@ func (s *Server) StartPodcastRefresher(dur time.Duration) (FuncExecute, FuncInte
 		}
 }
 
+// StartScrobbleRetrier retries the scrobbles which failed, once they're due
+func (s *Server) StartScrobbleRetrier(dur time.Duration) (FuncExecute, FuncInterrupt) {
+	ticker := time.NewTicker(dur)
+	done := make(chan struct{})
+	waitFor := func() error {
+		for {
+			select {
+			case <-done:
+				return nil
+			case <-ticker.C:
+				if err := s.scrobbleQueue.Retry(context.Background(), false); err != nil {
+					log.Printf("error retrying scrobbles: %v", err)
+				}
+			}
+		}
+	}
+	return func() error {
+			log.Printf("starting job 'scrobble retrier'\n")
+			return waitFor()
+		}, func(_ error) {
+			// stop job
+			ticker.Stop()
+			done <- struct{}{}
+		}
+}
+
+// StartTranscodeWarmer warms the transcode cache with new tracks after scans,
+// and whatever else is queued from the admin page
+func (s *Server) StartTranscodeWarmer() (FuncExecute, FuncInterrupt) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return func() error {
+			log.Printf("starting job 'transcode warmer'\n")
+			if _, err := s.warmer.QueueNew(); err != nil {
+				log.Printf("error queueing new tracks to warm: %v", err)
+			}
+			s.warmer.Run(ctx)
+			return nil
+		}, func(_ error) {
+			// stop job
+			cancel()
+		}
+}
+
+// StartDBBackup writes a backup of the db every dur. a backup due during a scan
+// is made at the next tick instead
+func (s *Server) StartDBBackup(dur time.Duration) (FuncExecute, FuncInterrupt) {
+	ticker := time.NewTicker(dur)
+	done := make(chan struct{})
+	waitFor := func() error {
+		for {
+			select {
+			case <-done:
+				return nil
+			case <-ticker.C:
+				file, err := s.backups.Write(time.Now())
+				if err != nil {
+					log.Printf("error backing up db: %v", err)
+					continue
+				}
+				log.Printf("backed up db to %q, %s", file.Name, humanize.IBytes(uint64(file.Size)))
+			}
+		}
+	}
+	return func() error {
+			log.Printf("starting job 'db backup'\n")
+			return waitFor()
+		}, func(_ error) {
+			// stop job
+			ticker.Stop()
+			done <- struct{}{}
+		}
+}
+
+// StartMetricsHTTP serves the metrics at /metrics on listenAddr, without any
+// auth, for prometheus on a network of its own
+func (s *Server) StartMetricsHTTP(listenAddr string) (FuncExecute, FuncInterrupt) {
+	handler := http.NewServeMux()
+	handler.Handle("/metrics", s.metrics)
+	list := &http.Server{
+		Addr:         listenAddr,
+		Handler:      handler,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	return func() error {
+			log.Printf("starting job 'metrics http' on %s\n", listenAddr)
+			return list.ListenAndServe()
+		}, func(_ error) {
+			// stop job
+			_ = list.Close()
+		}
+}
+
+// StartSessionClean removes expired web interface sessions, so it's only for a
+// server with the web interface
 func (s *Server) StartSessionClean(dur time.Duration) (FuncExecute, FuncInterrupt) {
 	ticker := time.NewTicker(dur)
 	done := make(chan struct{})
@@ -385,3 +885,55 @@ func (s *Server) StartSessionClean(dur time.Duration) (FuncExecute, FuncInterrup
 			done <- struct{}{}
 		}
 }
+
+// StartDiskCheck sends a disk_low event when there's less than the minimum free
+// space where transcodes and podcasts are kept
+func (s *Server) StartDiskCheck(dur time.Duration) (FuncExecute, FuncInterrupt) {
+	ticker := time.NewTicker(dur)
+	done := make(chan struct{})
+	check := func() {
+		for _, path := range s.diskPaths {
+			free, err := diskFree(path)
+			if err != nil {
+				log.Printf("error checking free space for %q: %v", path, err)
+				continue
+			}
+			if free >= s.diskMinFree {
+				continue
+			}
+			s.notifier.Publish(notify.Event{
+				Type:    notify.EventDiskLow,
+				Title:   "gonic is low on disk space",
+				Message: fmt.Sprintf("%q has %s free, less than the %s minimum", path, humanize.IBytes(free), humanize.IBytes(s.diskMinFree)),
+			})
+		}
+	}
+	waitFor := func() error {
+		check()
+		for {
+			select {
+			case <-done:
+				return nil
+			case <-ticker.C:
+				check()
+			}
+		}
+	}
+	return func() error {
+			log.Printf("starting job 'disk check'\n")
+			return waitFor()
+		}, func(_ error) {
+			// stop job
+			ticker.Stop()
+			done <- struct{}{}
+		}
+}
+
+// diskFree is how many bytes can be written to the filesystem path is on
+func diskFree(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
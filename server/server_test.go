@@ -0,0 +1,413 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+)
+
+// newTestServer serves a new install's server, and returns what it logged
+// while starting
+func newTestServer(t *testing.T, noWebUI bool) (*db.DB, *httptest.Server, string) {
+	return newTestServerOpts(t, func(opts *Options) { opts.NoWebUI = noWebUI })
+}
+
+// newTestServerOpts is newTestServer with the options changed by with
+func newTestServerOpts(t *testing.T, with func(*Options)) (*db.DB, *httptest.Server, string) {
+	is := is.New(t)
+
+	dbc, err := db.NewMock()
+	is.NoErr(err)
+	t.Cleanup(func() { dbc.Close() })
+	is.NoErr(dbc.Migrate(db.MigrationContext{}))
+
+	tmp := t.TempDir()
+	dirs := map[string]string{}
+	for _, name := range []string{"music", "cache", "covers", "podcasts"} {
+		dirs[name] = filepath.Join(tmp, name)
+		is.NoErr(os.Mkdir(dirs[name], os.ModePerm))
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	opts := Options{
+		DB:             dbc,
+		MusicPaths:     []db.MusicFolder{{Path: dirs["music"]}},
+		CachePath:      dirs["cache"],
+		CoverCachePath: dirs["covers"],
+		PodcastPath:    dirs["podcasts"],
+	}
+	with(&opts)
+	s, err := New(opts)
+	is.NoErr(err)
+	srv := httptest.NewServer(s.router)
+	t.Cleanup(srv.Close)
+	return dbc, srv, logs.String()
+}
+
+func TestSetup(t *testing.T) {
+	is := is.New(t)
+	dbc, srv, logs := newTestServer(t, false)
+
+	token := regexp.MustCompile(`setup token ([0-9a-f]+)`).FindStringSubmatch(logs)
+	is.True(token != nil) // token is in the log
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	ping := func(username, password string) (code int, message string) {
+		resp, err := client.Get(srv.URL + "/rest/ping?" + url.Values{
+			"u": {username}, "p": {password}, "c": {"test"}, "v": {"1.16.1"}, "f": {"json"},
+		}.Encode())
+		is.NoErr(err)
+		defer resp.Body.Close()
+		var body struct {
+			Response struct {
+				Status string
+				Error  struct {
+					Code    int
+					Message string
+				}
+			} `json:"subsonic-response"`
+		}
+		is.NoErr(json.NewDecoder(resp.Body).Decode(&body))
+		if body.Response.Status == "ok" {
+			return -1, ""
+		}
+		return body.Response.Error.Code, body.Response.Error.Message
+	}
+	setupDo := func(form url.Values) *http.Response {
+		resp, err := client.PostForm(srv.URL+"/admin/setup_do", form)
+		is.NoErr(err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// the old default admin is gone, and clients are told why
+	code, message := ping("admin", "admin")
+	is.Equal(code, 0)
+	is.True(strings.Contains(message, "server not configured"))
+
+	// the web interface goes to the setup page
+	resp, err := client.Get(srv.URL + "/admin/home")
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.Request.URL.Path, "/admin/setup")
+
+	form := url.Values{
+		"token":          {"wrong"},
+		"username":       {"alice"},
+		"password_one":   {"correct horse"},
+		"password_two":   {"correct horse"},
+		"lastfm_api_key": {"key"},
+		"lastfm_secret":  {"secret"},
+	}
+	is.Equal(setupDo(form).Request.URL.Path, "/admin/setup") // wrong token
+	form.Set("token", token[1])
+	form.Set("password_one", "short")
+	form.Set("password_two", "short")
+	is.Equal(setupDo(form).Request.URL.Path, "/admin/setup") // weak password
+	hasUsers, err := dbc.HasUsers()
+	is.NoErr(err)
+	is.True(!hasUsers)
+
+	form.Set("password_one", "correct horse")
+	form.Set("password_two", "correct horse")
+	resp = setupDo(form)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.Equal(resp.Request.URL.Path, "/admin/home") // and logged in
+
+	user := dbc.GetUserByName("alice")
+	is.True(user != nil)
+	is.True(user.IsAdmin)
+	apiKey, err := dbc.GetSetting("lastfm_api_key")
+	is.NoErr(err)
+	is.Equal(apiKey, "key")
+
+	code, _ = ping("alice", "correct horse")
+	is.Equal(code, -1)
+	code, _ = ping("admin", "admin")
+	is.Equal(code, 40)
+
+	// the token can't be used again
+	form.Set("username", "mallory")
+	is.Equal(setupDo(form).Request.URL.Path, "/admin/login")
+	is.True(dbc.GetUserByName("mallory") == nil)
+}
+
+func TestNoWebUI(t *testing.T) {
+	is := is.New(t)
+	dbc, srv, logs := newTestServer(t, true)
+	is.True(strings.Contains(logs, "gonic create-admin")) // instead of a setup token
+	sessKey, err := dbc.GetSetting("session_key")
+	is.NoErr(err)
+	is.Equal(sessKey, "") // there are no sessions to sign
+
+	resp, err := http.Get(srv.URL + "/")
+	is.NoErr(err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.True(strings.Contains(string(body), "the subsonic api is at /rest"))
+
+	for _, path := range []string{"/admin/login", "/admin/setup", "/admin/static/main.css"} {
+		resp, err = http.Get(srv.URL + path)
+		is.NoErr(err)
+		resp.Body.Close()
+		is.Equal(resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+// startSlowHTTP runs StartHTTP's job with a stream which writes once, then
+// waits for release before it finishes
+func startSlowHTTP(t *testing.T, shutdownTimeout time.Duration) (url string, started, release chan struct{}, interrupt func(), stopped chan error) {
+	is := is.New(t)
+	started, release = make(chan struct{}), make(chan struct{})
+	router := mux.NewRouter()
+	router.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("first "))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("second"))
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	is.NoErr(err)
+	s := &Server{router: router, shutdownTimeout: shutdownTimeout}
+	execute, interruptJob := s.StartHTTP(l, "", "")
+	stopped = make(chan error, 1)
+	go func() { stopped <- execute() }()
+	return "http://" + l.Addr().String(), started, release, func() { interruptJob(nil) }, stopped
+}
+
+func TestHTTPDrain(t *testing.T) {
+	is := is.New(t)
+	url, started, release, interrupt, stopped := startSlowHTTP(t, 10*time.Second)
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(url + "/stream")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		results <- result{string(body), err}
+	}()
+	<-started
+	interrupt()
+
+	// new connections are refused, while the stream carries on
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	refused := false
+	for i := 0; i < 100 && !refused; i++ {
+		resp, err := client.Get(url + "/stream")
+		if err != nil {
+			refused = true
+			break
+		}
+		resp.Body.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.True(refused)
+	select {
+	case err := <-stopped:
+		t.Fatalf("stopped before the stream finished: %v", err)
+	default:
+	}
+
+	close(release)
+	res := <-results
+	is.NoErr(res.err)
+	is.Equal(res.body, "first second") // the stream finished
+	select {
+	case err := <-stopped:
+		is.NoErr(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't stop once the stream finished")
+	}
+}
+
+func TestHTTPDrainTimeout(t *testing.T) {
+	is := is.New(t)
+	url, started, release, interrupt, stopped := startSlowHTTP(t, 50*time.Millisecond)
+	defer close(release)
+
+	results := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url + "/stream")
+		if err != nil {
+			results <- err
+			return
+		}
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+		results <- err
+	}()
+	<-started
+	interrupt()
+
+	// the stream doesn't finish in time, so it's cut off
+	select {
+	case err := <-stopped:
+		is.NoErr(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't stop after the timeout")
+	}
+	is.True(<-results != nil)
+}
+
+func TestCORS(t *testing.T) {
+	is := is.New(t)
+	_, srv, _ := newTestServerOpts(t, func(opts *Options) {
+		opts.CORSOrigins = []string{"https://player.example.com"}
+	})
+	request := func(method, path, origin string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		is.NoErr(err)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		is.NoErr(err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// preflights are answered without credentials
+	resp := request(http.MethodOptions, "/rest/ping.view", "https://player.example.com")
+	is.Equal(resp.StatusCode, http.StatusNoContent)
+	is.Equal(resp.Header.Get("Access-Control-Allow-Origin"), "https://player.example.com")
+	is.True(resp.Header.Get("Access-Control-Allow-Methods") != "")
+	resp = request(http.MethodOptions, "/rest/stream", "https://player.example.com")
+	is.Equal(resp.StatusCode, http.StatusNoContent)
+
+	resp = request(http.MethodGet, "/rest/ping.view", "https://player.example.com")
+	is.Equal(resp.Header.Get("Access-Control-Allow-Origin"), "https://player.example.com")
+	is.Equal(resp.Header.Get("Access-Control-Allow-Credentials"), "true")
+
+	// other origins, and the web interface, get nothing
+	resp = request(http.MethodGet, "/rest/ping.view", "https://evil.example.com")
+	is.Equal(resp.Header.Get("Access-Control-Allow-Origin"), "")
+	resp = request(http.MethodGet, "/admin/login", "https://player.example.com")
+	is.Equal(resp.Header.Get("Access-Control-Allow-Origin"), "")
+}
+
+func TestCORSAny(t *testing.T) {
+	is := is.New(t)
+	_, srv, _ := newTestServerOpts(t, func(opts *Options) {
+		opts.CORSOrigins = []string{"*", "https://player.example.com"}
+	})
+	request := func(origin string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/rest/ping.view", nil)
+		is.NoErr(err)
+		req.Header.Set("Origin", origin)
+		resp, err := http.DefaultClient.Do(req)
+		is.NoErr(err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// any origin, but without credentials
+	resp := request("https://evil.example.com")
+	is.Equal(resp.Header.Get("Access-Control-Allow-Origin"), "*")
+	is.Equal(resp.Header.Get("Access-Control-Allow-Credentials"), "")
+	// which listed ones still get
+	resp = request("https://player.example.com")
+	is.Equal(resp.Header.Get("Access-Control-Allow-Origin"), "https://player.example.com")
+	is.Equal(resp.Header.Get("Access-Control-Allow-Credentials"), "true")
+}
+
+func TestCORSOff(t *testing.T) {
+	is := is.New(t)
+	_, srv, _ := newTestServer(t, false)
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/rest/ping.view", nil)
+	is.NoErr(err)
+	req.Header.Set("Origin", "https://player.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.Header.Get("Access-Control-Allow-Origin"), "")
+}
+
+func TestArtistPage(t *testing.T) {
+	is := is.New(t)
+	dbc, srv, logs := newTestServer(t, false)
+
+	// logged in by the setup
+	token := regexp.MustCompile(`setup token ([0-9a-f]+)`).FindStringSubmatch(logs)
+	is.True(token != nil)
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	resp, err := client.PostForm(srv.URL+"/admin/setup_do", url.Values{
+		"token":        {token[1]},
+		"username":     {"alice"},
+		"password_one": {"correct horse"},
+		"password_two": {"correct horse"},
+	})
+	is.NoErr(err)
+	resp.Body.Close()
+	is.Equal(resp.Request.URL.Path, "/admin/home")
+
+	artist := &db.Artist{Name: "artist"}
+	is.NoErr(dbc.Create(artist).Error)
+	other := &db.Artist{Name: "other"}
+	is.NoErr(dbc.Create(other).Error)
+	album := func(artist *db.Artist, title, releaseType string) *db.Album {
+		album := &db.Album{RootDir: "/music", RightPath: title, TagTitle: title, TagArtistID: artist.ID, TagReleaseType: releaseType}
+		is.NoErr(dbc.Create(album).Error)
+		return album
+	}
+	page := func(artist *db.Artist) string {
+		resp, err := client.Get(srv.URL + "/admin/artist?id=" + strconv.Itoa(artist.ID))
+		is.NoErr(err)
+		defer resp.Body.Close()
+		is.Equal(resp.StatusCode, http.StatusOK)
+		body, err := io.ReadAll(resp.Body)
+		is.NoErr(err)
+		return string(body)
+	}
+
+	// only albums, so there's nothing to group
+	album(artist, "first album", "album")
+	heading := func(title string) string { return `<p class="text-emp">` + title + `</p>` }
+	body := page(artist)
+	is.True(strings.Contains(body, "first album"))
+	is.True(!strings.Contains(body, heading("albums")))
+
+	album(artist, "a single", "single")
+	split := album(other, "split", "album")
+	is.NoErr(dbc.Create(&db.Track{AlbumID: split.ID, ArtistID: other.ID, Filename: "a.flac", TagTrackArtist: "Artist"}).Error)
+	body = page(artist)
+	for _, inOrder := range []string{heading("albums"), "first album", heading("eps and singles"), "a single", heading("appears on"), "split"} {
+		i := strings.Index(body, inOrder)
+		is.True(i >= 0) // in order
+		body = body[i:]
+	}
+}
@@ -0,0 +1,78 @@
+package streamsign
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	t.Parallel()
+	signer := New([]byte("server key"))
+	now := time.Date(2022, 6, 20, 12, 0, 0, 0, time.UTC)
+	claims := Claims{ID: "tr-1", UserID: 1, Expires: now.Add(time.Hour)}
+
+	check := func(name string, userKey string, clientIP string, mutate func(c *Claims), at time.Time, want error) {
+		t.Helper()
+		c := claims
+		if clientIP != "" {
+			c.IP = "10.0.0.1"
+		}
+		params := signer.Sign("user key", c)
+		if mutate != nil {
+			mutate(&c)
+			params = signer.Sign("user key", c)
+			params.Set(ParamSig, signer.Sign("user key", claims).Get(ParamSig))
+		}
+		parsed, err := Parse(params, clientIP)
+		if err != nil {
+			t.Fatalf("%s: parse: %v", name, err)
+		}
+		if err := signer.Verify(userKey, parsed, params, at); !errors.Is(err, want) {
+			t.Errorf("%s: expected error %v, got %v", name, want, err)
+		}
+	}
+
+	check("valid", "user key", "", nil, now, nil)
+	check("expired", "user key", "", nil, now.Add(time.Hour), ErrExpired)
+	check("rotated user key", "new user key", "", nil, now, ErrInvalid)
+	check("no user key", "", "", nil, now, ErrInvalid)
+	check("tampered id", "user key", "", func(c *Claims) { c.ID = "tr-2" }, now, ErrInvalid)
+	check("tampered user", "user key", "", func(c *Claims) { c.UserID = 2 }, now, ErrInvalid)
+	check("tampered expiry", "user key", "", func(c *Claims) { c.Expires = now.Add(48 * time.Hour) }, now, ErrInvalid)
+	check("bound ip", "user key", "10.0.0.1", nil, now, nil)
+
+	// a url bound to one address doesn't work from another
+	bound := claims
+	bound.IP = "10.0.0.1"
+	params := signer.Sign("user key", bound)
+	parsed, err := Parse(params, "10.0.0.2")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if err := signer.Verify("user key", parsed, params, now); !errors.Is(err, ErrInvalid) {
+		t.Errorf("other ip: expected error %v, got %v", ErrInvalid, err)
+	}
+
+	// a different server can't verify
+	if err := New([]byte("other key")).Verify("user key", claims, signer.Sign("user key", claims), now); !errors.Is(err, ErrInvalid) {
+		t.Errorf("other server: expected error %v, got %v", ErrInvalid, err)
+	}
+}
+
+func TestParseMissing(t *testing.T) {
+	t.Parallel()
+	signer := New([]byte("server key"))
+	params := signer.Sign("user key", Claims{ID: "tr-1", UserID: 1, Expires: time.Now()})
+	for _, key := range []string{ParamID, ParamUserID, ParamExpires, ParamSig} {
+		missing := make(map[string][]string)
+		for k, v := range params {
+			if k != key {
+				missing[k] = v
+			}
+		}
+		if _, err := Parse(missing, ""); !errors.Is(err, ErrMissing) {
+			t.Errorf("without %q: expected error %v, got %v", key, ErrMissing, err)
+		}
+	}
+}
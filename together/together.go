@@ -0,0 +1,187 @@
+// Package together suggests albums which are often played in the same
+// listening session, using only the listens on this server.
+//
+// listens by the same user within SessionGap of each other are in the same
+// session. when an album is first played in a session, it's paired with each
+// album already played in it. playing a whole album after another counts
+// once, not once per track.
+//
+// old sessions fade with a half life of HalfLife. rather than decaying every
+// score as time passes, each pairing is weighted by 2^((t-epoch)/HalfLife)
+// for its time t. newer pairings count for more, which ranks the same as
+// decaying older ones, but scores only ever need adding to
+package together
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"go.senan.xyz/gonic/db"
+)
+
+const (
+	SessionGap = 2 * time.Hour
+	HalfLife   = 90 * 24 * time.Hour
+
+	// SettingLastListen is the id of the last listen which has been paired
+	SettingLastListen = "together_last_listen_id"
+
+	// listens are paired this many at a time, so that memory use doesn't grow
+	// with the history
+	batchSize = 500
+)
+
+var epoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func weight(t time.Time) float64 {
+	return math.Exp2(float64(t.Sub(epoch)) / float64(HalfLife))
+}
+
+// Update pairs the listens which were added since it last ran, and returns how
+// many it paired
+func Update(dbc *db.DB) (int, error) {
+	var total int
+	for {
+		n, err := updateBatch(dbc)
+		total += n
+		if err != nil || n < batchSize {
+			return total, err
+		}
+	}
+}
+
+func updateBatch(dbc *db.DB) (int, error) {
+	last, err := dbc.GetSetting(SettingLastListen)
+	if err != nil {
+		return 0, fmt.Errorf("get last listen: %w", err)
+	}
+	lastID, _ := strconv.Atoi(last)
+	var listens []*db.Listen
+	err = dbc.
+		Where("id>?", lastID).
+		Order("id").
+		Limit(batchSize).
+		Find(&listens).
+		Error
+	if err != nil {
+		return 0, fmt.Errorf("find listens: %w", err)
+	}
+	if len(listens) == 0 {
+		return 0, nil
+	}
+	err = dbc.Transaction(func(tx *gorm.DB) error {
+		for _, listen := range listens {
+			if err := pairListen(tx, listen); err != nil {
+				return fmt.Errorf("pair listen %d: %w", listen.ID, err)
+			}
+		}
+		lastID := strconv.Itoa(listens[len(listens)-1].ID)
+		return (&db.DB{DB: tx}).SetSetting(SettingLastListen, lastID)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(listens), nil
+}
+
+// sessionBefore matches the listens in the same session as, and before, a
+// listen. listens at the same time are ordered by id
+const sessionBefore = "user_id=? AND time>=? AND (time<? OR (time=? AND id<?))"
+
+func pairListen(tx *gorm.DB, listen *db.Listen) error {
+	args := []interface{}{listen.UserID, listen.Time.Add(-SessionGap), listen.Time, listen.Time, listen.ID}
+	var playing int
+	err := tx.
+		Model(&db.Listen{}).
+		Where(sessionBefore, args...).
+		Where("album_id=?", listen.AlbumID).
+		Count(&playing).
+		Error
+	if err != nil {
+		return fmt.Errorf("find session: %w", err)
+	}
+	if playing > 0 {
+		return nil
+	}
+	var otherIDs []int
+	err = tx.
+		Model(&db.Listen{}).
+		Where(sessionBefore, args...).
+		Where("album_id<>?", listen.AlbumID).
+		Pluck("DISTINCT album_id", &otherIDs).
+		Error
+	if err != nil {
+		return fmt.Errorf("find session albums: %w", err)
+	}
+	w := weight(listen.Time)
+	for _, otherID := range otherIDs {
+		for _, pair := range [][2]int{{listen.AlbumID, otherID}, {otherID, listen.AlbumID}} {
+			q := tx.Exec(`
+				INSERT INTO album_pairs (album_id, other_album_id, score) VALUES (?, ?, ?)
+				ON CONFLICT (album_id, other_album_id) DO UPDATE SET score=album_pairs.score+excluded.score`,
+				pair[0], pair[1], w)
+			if err := q.Error; err != nil {
+				return fmt.Errorf("add pair: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Suggest finds up to limit albums by other artists which are often played in
+// the same session as albumID, best first. when there are none, it finds
+// albums which share the most genres with it instead, and fromListens is false.
+// only albums in the music folders with roots are suggested, or in any of them
+// if it's nil
+func Suggest(dbc *db.DB, albumID, limit int, roots []string) (albums []*db.Album, fromListens bool, err error) {
+	album := &db.Album{}
+	if err := dbc.Select("id, tag_artist_id").First(album, albumID).Error; err != nil {
+		return nil, false, fmt.Errorf("find album: %w", err)
+	}
+	otherArtists := func(q *gorm.DB) *gorm.DB {
+		if roots != nil {
+			q = q.Where("albums.root_dir IN (?)", roots)
+		}
+		if album.TagArtistID == 0 {
+			return q
+		}
+		return q.Where("albums.tag_artist_id IS NULL OR albums.tag_artist_id<>?", album.TagArtistID)
+	}
+
+	err = otherArtists(dbc.DB).
+		Select("albums.*").
+		Joins("JOIN album_pairs ON album_pairs.other_album_id=albums.id").
+		Where("album_pairs.album_id=?", albumID).
+		Order("album_pairs.score DESC").
+		Limit(limit).
+		Preload("TagArtist").
+		Find(&albums).
+		Error
+	if err != nil {
+		return nil, false, fmt.Errorf("find paired albums: %w", err)
+	}
+	if len(albums) > 0 {
+		return albums, true, nil
+	}
+
+	err = otherArtists(dbc.DB).
+		Select("albums.*").
+		Joins("JOIN album_genres ON album_genres.album_id=albums.id").
+		Joins("JOIN album_genres mine ON mine.genre_id=album_genres.genre_id AND mine.album_id=?", albumID).
+		Where("albums.id<>?", albumID).
+		Group("albums.id").
+		Order("count(*) DESC, albums.tag_title").
+		Limit(limit).
+		Preload("TagArtist").
+		Find(&albums).
+		Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, fmt.Errorf("find genre albums: %w", err)
+	}
+	return albums, false, nil
+}
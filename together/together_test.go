@@ -0,0 +1,202 @@
+package together
+
+import (
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+type library struct {
+	*db.DB
+	users  map[string]int
+	albums map[string]int
+}
+
+// newLibrary makes albums named "artist/album"
+func newLibrary(t *testing.T, albums ...string) *library {
+	t.Helper()
+	is := is.New(t)
+	dbc, err := db.NewMock()
+	is.NoErr(err)
+	is.NoErr(dbc.Migrate(db.MigrationContext{}))
+	t.Cleanup(func() { dbc.Close() })
+
+	lib := &library{DB: dbc, users: map[string]int{}, albums: map[string]int{}}
+	artists := map[string]int{}
+	for _, name := range albums {
+		parts := strings.SplitN(name, "/", 2)
+		artistName, title := parts[0], parts[1]
+		if _, ok := artists[artistName]; !ok {
+			artist := &db.Artist{Name: artistName}
+			is.NoErr(dbc.Create(artist).Error)
+			artists[artistName] = artist.ID
+		}
+		album := &db.Album{TagTitle: title, TagArtistID: artists[artistName], RightPath: name}
+		is.NoErr(dbc.Create(album).Error)
+		lib.albums[name] = album.ID
+	}
+	return lib
+}
+
+func (l *library) listen(t *testing.T, user, album string, at time.Time) {
+	t.Helper()
+	is := is.New(t)
+	if _, ok := l.users[user]; !ok {
+		u := &db.User{Name: user, Password: "password"}
+		is.NoErr(l.Create(u).Error)
+		l.users[user] = u.ID
+	}
+	is.NoErr(l.Create(&db.Listen{UserID: l.users[user], AlbumID: l.albums[album], Time: at}).Error)
+}
+
+func (l *library) suggest(t *testing.T, album string) ([]string, bool) {
+	t.Helper()
+	is := is.New(t)
+	albums, fromListens, err := Suggest(l.DB, l.albums[album], 10, nil)
+	is.NoErr(err)
+	var names []string
+	for _, a := range albums {
+		names = append(names, a.RightPath)
+	}
+	return names, fromListens
+}
+
+func (l *library) score(t *testing.T, a, b string) float64 {
+	t.Helper()
+	var pair db.AlbumPair
+	if err := l.Where("album_id=? AND other_album_id=?", l.albums[a], l.albums[b]).First(&pair).Error; err != nil {
+		return 0
+	}
+	return pair.Score
+}
+
+func TestSessions(t *testing.T) {
+	is := is.New(t)
+	lib := newLibrary(t, "a/one", "a/two", "b/one", "c/one", "d/one")
+	start := time.Date(2022, time.June, 1, 20, 0, 0, 0, time.UTC)
+	track := func(i int) time.Time { return start.Add(time.Duration(i) * 4 * time.Minute) }
+
+	// a session of whole albums: b, then a/one, then a/two, then c
+	for i := 0; i < 10; i++ {
+		lib.listen(t, "alice", "b/one", track(i))
+		lib.listen(t, "alice", "a/one", track(10+i))
+		lib.listen(t, "alice", "a/two", track(20+i))
+	}
+	lib.listen(t, "alice", "c/one", track(40))
+	// d is played the next day, so it's a different session
+	lib.listen(t, "alice", "d/one", start.Add(24*time.Hour))
+	// and someone else's listens in the same hours aren't in alice's session
+	lib.listen(t, "bob", "d/one", track(5))
+
+	n, err := Update(lib.DB)
+	is.NoErr(err)
+	is.Equal(n, 33)
+
+	w := weight(start)
+	is.True(lib.score(t, "b/one", "a/one") > 0.99*w) // once, not once per track
+	is.True(lib.score(t, "b/one", "a/one") < 1.01*w)
+	is.Equal(lib.score(t, "b/one", "a/one"), lib.score(t, "a/one", "b/one")) // both ways
+	is.Equal(lib.score(t, "b/one", "d/one"), 0.0)
+
+	// c/one was only played within two hours of a/one and a/two
+	is.True(lib.score(t, "c/one", "a/two") > 0)
+	is.Equal(lib.score(t, "c/one", "b/one"), 0.0)
+
+	// b and a/one are played together again a few days later, so b is
+	// suggested first. the same artist's albums aren't suggested
+	lib.listen(t, "alice", "b/one", start.Add(72*time.Hour))
+	lib.listen(t, "alice", "a/one", start.Add(73*time.Hour))
+	_, err = Update(lib.DB)
+	is.NoErr(err)
+	names, fromListens := lib.suggest(t, "a/one")
+	is.True(fromListens)
+	is.Equal(names, []string{"b/one", "c/one"})
+
+	// nothing new, nothing to do
+	n, err = Update(lib.DB)
+	is.NoErr(err)
+	is.Equal(n, 0)
+}
+
+func TestDecay(t *testing.T) {
+	is := is.New(t)
+	lib := newLibrary(t, "a/one", "b/one", "c/one")
+	old := time.Date(2021, time.January, 1, 20, 0, 0, 0, time.UTC)
+	recent := old.Add(2 * HalfLife)
+
+	// a and b were played together three times, long ago. a and c once, recently
+	for i := 0; i < 3; i++ {
+		at := old.Add(time.Duration(i) * 24 * time.Hour)
+		lib.listen(t, "alice", "a/one", at)
+		lib.listen(t, "alice", "b/one", at.Add(time.Hour))
+	}
+	lib.listen(t, "alice", "a/one", recent)
+	lib.listen(t, "alice", "c/one", recent.Add(time.Hour))
+	_, err := Update(lib.DB)
+	is.NoErr(err)
+
+	// three sessions two half lives old are worth 3/4 of a recent one
+	ratio := lib.score(t, "a/one", "b/one") / lib.score(t, "a/one", "c/one")
+	is.True(ratio > 0.74 && ratio < 0.76)
+	names, _ := lib.suggest(t, "a/one")
+	is.Equal(names, []string{"c/one", "b/one"})
+}
+
+func TestBatches(t *testing.T) {
+	is := is.New(t)
+	lib := newLibrary(t, "a/one", "b/one")
+	start := time.Date(2022, time.June, 1, 20, 0, 0, 0, time.UTC)
+	for i := 0; i < batchSize+10; i++ {
+		lib.listen(t, "alice", "a/one", start.Add(time.Duration(i)*time.Second))
+	}
+	lib.listen(t, "alice", "b/one", start.Add(time.Hour))
+
+	n, err := Update(lib.DB)
+	is.NoErr(err)
+	is.Equal(n, batchSize+11)
+	is.True(lib.score(t, "a/one", "b/one") > 0)
+	last, err := lib.GetSetting(SettingLastListen)
+	is.NoErr(err)
+	is.Equal(last, strconv.Itoa(batchSize+11)) // the last listen's id
+}
+
+func TestColdStart(t *testing.T) {
+	is := is.New(t)
+	lib := newLibrary(t, "a/one", "a/two", "b/one", "c/one", "d/one")
+	genres := map[string][]string{
+		"a/one": {"jazz", "funk"},
+		"a/two": {"jazz", "funk"},
+		"b/one": {"jazz"},
+		"c/one": {"jazz", "funk"},
+		"d/one": {"metal"},
+	}
+	genreIDs := map[string]int{}
+	for album, names := range genres {
+		for _, name := range names {
+			if _, ok := genreIDs[name]; !ok {
+				genre := &db.Genre{Name: name}
+				is.NoErr(lib.Create(genre).Error)
+				genreIDs[name] = genre.ID
+			}
+			is.NoErr(lib.Create(&db.AlbumGenre{AlbumID: lib.albums[album], GenreID: genreIDs[name]}).Error)
+		}
+	}
+
+	names, fromListens := lib.suggest(t, "a/one")
+	is.True(!fromListens)
+	is.Equal(names, []string{"c/one", "b/one"}) // most shared genres first, not the same artist
+}
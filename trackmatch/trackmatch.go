@@ -0,0 +1,145 @@
+// Package trackmatch finds tracks in the library from metadata which came from
+// outside of it, such as imported playlists or listening history
+package trackmatch
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+	"github.com/rainycape/unidecode"
+
+	"go.senan.xyz/gonic/db"
+)
+
+var ErrNoMatch = errors.New("no matching track")
+
+// the most tracks we'll consider for a fuzzy title match
+const maxCandidates = 200
+
+type Query struct {
+	RecordingMBID string
+	Artist        string
+	Title         string
+}
+
+func (q Query) String() string {
+	if q.Artist == "" {
+		return q.Title
+	}
+	return fmt.Sprintf("%s - %s", q.Artist, q.Title)
+}
+
+// Match finds the track for q. if it has a recording mbid, that is tried first.
+// otherwise the artist and title are compared ignoring case, accents, punctuation,
+// and anything in brackets, eg. "(Remastered 2011)"
+func Match(dbc *db.DB, q Query) (*db.Track, error) {
+	if q.RecordingMBID != "" {
+		var track db.Track
+		err := dbc.
+			Where("tag_brainz_id=?", q.RecordingMBID).
+			First(&track).
+			Error
+		switch {
+		case err == nil:
+			return &track, nil
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			return nil, fmt.Errorf("find by mbid: %w", err)
+		}
+	}
+	title := normalise(q.Title)
+	if title == "" {
+		return nil, fmt.Errorf("%q: %w", q, ErrNoMatch)
+	}
+	pattern := likePattern(q.Title)
+	var candidates []*db.Track
+	err := dbc.
+		Preload("Artist").
+		Where(fmt.Sprintf("tag_title %[1]s ? OR tag_title_u_dec %[1]s ?", db.Like(dbc.DB)), pattern, pattern).
+		Order("id").
+		Limit(maxCandidates).
+		Find(&candidates).
+		Error
+	if err != nil {
+		return nil, fmt.Errorf("find candidates: %w", err)
+	}
+	var best *db.Track
+	var bestScore int
+	for _, track := range candidates {
+		if normalise(track.TagTitle) != title || !artistMatches(track, q.Artist) {
+			continue
+		}
+		score := 1
+		if normaliseKeepBrackets(track.TagTitle) == normaliseKeepBrackets(q.Title) {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = track, score
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("%q: %w", q, ErrNoMatch)
+	}
+	return best, nil
+}
+
+// artistMatches allows for extra featured artists on either side, as long as the
+// primary artist is the same
+func artistMatches(track *db.Track, artist string) bool {
+	want := normalise(artist)
+	if want == "" {
+		return true
+	}
+	have := []string{normalise(track.TagTrackArtist)}
+	if track.Artist != nil {
+		have = append(have, normalise(track.Artist.Name))
+	}
+	for _, h := range have {
+		if h == "" {
+			continue
+		}
+		if strings.HasPrefix(h, want) || strings.HasPrefix(want, h) {
+			return true
+		}
+	}
+	return false
+}
+
+var bracketExpr = regexp.MustCompile(`\([^)]*\)|\[[^\]]*\]`)
+
+func normalise(in string) string {
+	return normaliseKeepBrackets(bracketExpr.ReplaceAllString(in, ""))
+}
+
+func normaliseKeepBrackets(in string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(unidecode.Unidecode(in)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// likePattern makes a loose pattern for a case insensitive LIKE, where any
+// run of punctuation or bracketed text may be anything
+func likePattern(title string) string {
+	title = bracketExpr.ReplaceAllString(unidecode.Unidecode(title), "%")
+	var sb strings.Builder
+	sb.WriteRune('%')
+	for _, r := range title {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			sb.WriteRune(r)
+		case !strings.HasSuffix(sb.String(), "%"):
+			sb.WriteRune('%')
+		}
+	}
+	if !strings.HasSuffix(sb.String(), "%") {
+		sb.WriteRune('%')
+	}
+	return sb.String()
+}
@@ -0,0 +1,55 @@
+package trackmatch
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/mockfs"
+)
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	m := mockfs.New(t)
+
+	setTags := func(path, artist, title, mbid string) {
+		m.AddTrack(path)
+		m.SetTags(path, func(tags *mockfs.Tags) error {
+			tags.RawArtist = artist
+			tags.RawAlbumArtist = "Album Artist"
+			tags.RawAlbum = "Album"
+			tags.RawTitle = title
+			tags.RawBrainzID = mbid
+			return nil
+		})
+	}
+	setTags("album/a.flac", "Aphex Twin", "Windowlicker", "mbid-a")
+	setTags("album/b.flac", "Sigur Rós", "Hoppípolla", "")
+	setTags("album/c.flac", "Massive Attack feat. Elizabeth Fraser", "Teardrop (Remastered 2006)", "")
+	setTags("album/d.flac", "Massive Attack", "Teardrop", "")
+	m.ScanAndClean()
+
+	matchTitle := func(q Query) string {
+		t.Helper()
+		track, err := Match(m.DB(), q)
+		if err != nil {
+			t.Fatalf("match %q: %v", q, err)
+		}
+		return track.Filename
+	}
+
+	is.Equal(matchTitle(Query{RecordingMBID: "mbid-a"}), "a.flac")                                              // by mbid
+	is.Equal(matchTitle(Query{RecordingMBID: "mbid-x", Artist: "aphex twin", Title: "windowlicker"}), "a.flac") // falls back
+	is.Equal(matchTitle(Query{Artist: "Sigur Ros", Title: "Hoppipolla"}), "b.flac")                             // without accents
+	is.Equal(matchTitle(Query{Artist: "Sigur Rós", Title: "Hoppípolla"}), "b.flac")                             // with accents
+	is.Equal(matchTitle(Query{Artist: "Massive Attack", Title: "Teardrop"}), "d.flac")                          // exact is preferred
+	is.Equal(matchTitle(Query{Artist: "Massive Attack", Title: "Teardrop (Remastered 2006)"}), "c.flac")
+	is.Equal(matchTitle(Query{Artist: "Album Artist", Title: "Windowlicker"}), "a.flac") // album artist
+
+	_, err := Match(m.DB(), Query{Artist: "Aphex Twin", Title: "Xtal"})
+	is.True(errors.Is(err, ErrNoMatch))
+	_, err = Match(m.DB(), Query{Artist: "Boards of Canada", Title: "Windowlicker"})
+	is.True(errors.Is(err, ErrNoMatch)) // wrong artist
+}
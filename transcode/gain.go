@@ -0,0 +1,128 @@
+package transcode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ReplayGainMode is which of a file's replaygain tags are applied when it's
+// transcoded
+type ReplayGainMode string
+
+const (
+	ReplayGainOff   ReplayGainMode = ""
+	ReplayGainTrack ReplayGainMode = "track"
+	ReplayGainAlbum ReplayGainMode = "album"
+)
+
+// ReplayGainModes are the modes a user can choose, in the order they're shown
+var ReplayGainModes = []ReplayGainMode{ReplayGainOff, ReplayGainTrack, ReplayGainAlbum}
+
+// LoudnormTarget is the loudness files without replaygain tags are normalised
+// to, in LUFS. it's the reference loudness of replaygain 2.0
+const LoudnormTarget = -18
+
+// Gain changes the volume of a transcode. the zero Gain leaves it as it is
+type Gain struct {
+	DB       float64 // added to the volume
+	Loudnorm bool    // normalise to LoudnormTarget instead, for files without tags
+}
+
+// ReplayGain picks the gain for mode from a file's replaygain tags, which are
+// nil if the file doesn't have them. album mode falls back to the track's gain,
+// and a file with neither is normalised with loudnorm
+func ReplayGain(mode ReplayGainMode, track, album *float64) Gain {
+	switch {
+	case mode == ReplayGainOff:
+		return Gain{}
+	case mode == ReplayGainAlbum && album != nil:
+		return Gain{DB: *album}
+	case track != nil:
+		return Gain{DB: *track}
+	default:
+		return Gain{Loudnorm: true}
+	}
+}
+
+func (g Gain) String() string {
+	if g.Loudnorm {
+		return fmt.Sprintf("loudnorm to %d LUFS", LoudnormTarget)
+	}
+	return fmt.Sprintf("%+.2fdB", g.DB)
+}
+
+// filter is the ffmpeg audio filter which applies the gain, or "" if there's
+// nothing to apply. loudnorm upsamples to 192kHz, so it's brought back down
+func (g Gain) filter() string {
+	switch {
+	case g.Loudnorm:
+		return fmt.Sprintf("loudnorm=I=%d:TP=-1.5:LRA=11, aresample=48000", LoudnormTarget)
+	case g.DB != 0:
+		return fmt.Sprintf("volume=%.2fdB", g.DB)
+	default:
+		return ""
+	}
+}
+
+// WithGain applies gain to p's transcodes
+func WithGain(p Profile, gain Gain) Profile {
+	p.gain = gain
+	return p
+}
+
+// addGainFilter adds the filter for gain to args. it replaces the profile's
+// own replaygain filter if it has one, goes at the start of the profile's
+// other filters if not, or else just before the output
+func addGainFilter(args []string, gain Gain) []string {
+	if gain.filter() == "" || len(args) == 0 {
+		return args
+	}
+	for i, arg := range args {
+		if arg != "-af" || i+1 >= len(args) {
+			continue
+		}
+		args[i+1] = withGainFilter(args[i+1], gain)
+		return args
+	}
+	out := args[len(args)-1]
+	return append(args[:len(args)-1:len(args)-1], "-af", gain.filter(), out)
+}
+
+// withGainFilter puts the filter for gain in place of the one in filters which
+// applies the file's own replaygain, like mp3's and opus's. its preamp is kept
+// so the profile is as loud as it was with the file's gain
+func withGainFilter(filters string, gain Gain) string {
+	parts := strings.Split(filters, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "volume=replaygain=") {
+			continue
+		}
+		if !gain.Loudnorm {
+			gain.DB += replayGainPreamp(part)
+		}
+		parts[i] = gain.filter()
+		return strings.Join(parts, ", ")
+	}
+	return gain.filter() + ", " + strings.Join(parts, ", ")
+}
+
+// replayGainPreamp is the replaygain_preamp option of a volume filter in dB,
+// or 0 if it doesn't have one
+func replayGainPreamp(filter string) float64 {
+	for _, opt := range strings.Split(strings.TrimPrefix(filter, "volume="), ":") {
+		value := strings.TrimPrefix(opt, "replaygain_preamp=")
+		if value == opt {
+			continue
+		}
+		preamp, err := strconv.ParseFloat(strings.TrimSuffix(value, "dB"), 64)
+		if err != nil {
+			return 0
+		}
+		return preamp
+	}
+	return 0
+}
@@ -0,0 +1,111 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ErrBusy is returned when a transcode waited as long as it may for another
+// to finish. nothing has been written, so the caller can stream raw instead
+var ErrBusy = errors.New("too many transcodes running")
+
+// Limiter is a Transcoder which runs only so many transcodes at once. the
+// rest wait in turn for one to finish, up to a max wait
+type Limiter struct {
+	transcoder Transcoder
+	slots      chan struct{}
+	maxWait    time.Duration
+
+	mu     sync.Mutex
+	queued int
+}
+
+var _ Transcoder = (*Limiter)(nil)
+
+// DefaultLimit is half the cpus, so that transcodes leave room for the rest
+// of the server
+func DefaultLimit() int {
+	if n := runtime.NumCPU() / 2; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// NewLimiter runs up to limit of t's transcodes at once, or DefaultLimit if
+// limit is less than 1. others wait for up to maxWait before giving up with
+// ErrBusy. a maxWait of 0 doesn't wait at all
+func NewLimiter(t Transcoder, limit int, maxWait time.Duration) *Limiter {
+	if limit < 1 {
+		limit = DefaultLimit()
+	}
+	return &Limiter{
+		transcoder: t,
+		slots:      make(chan struct{}, limit),
+		maxWait:    maxWait,
+	}
+}
+
+func (l *Limiter) Transcode(ctx context.Context, profile Profile, in string, out io.Writer) error {
+	release, err := l.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return l.transcoder.Transcode(ctx, profile, in, out)
+}
+
+// Acquire takes a slot for a transcode which isn't run by the Limiter, like the
+// jukebox's. release must be called when it's done
+func (l *Limiter) Acquire(ctx context.Context) (release func(), err error) {
+	release = func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if l.maxWait <= 0 {
+		return nil, ErrBusy
+	}
+
+	l.mu.Lock()
+	l.queued++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.queued--
+		l.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%w, waited %v", ErrBusy, l.maxWait)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Active returns how many transcodes are running
+func (l *Limiter) Active() int {
+	return len(l.slots)
+}
+
+// Queued returns how many transcodes are waiting for a slot
+func (l *Limiter) Queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queued
+}
+
+// Limit returns how many transcodes can run at once
+func (l *Limiter) Limit() int {
+	return cap(l.slots)
+}
@@ -0,0 +1,83 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// blockTranscoder tells started about each transcode, and doesn't finish them
+// until wait is closed
+type blockTranscoder struct {
+	started chan struct{}
+	wait    chan struct{}
+}
+
+func (t *blockTranscoder) Transcode(ctx context.Context, profile Profile, in string, out io.Writer) error {
+	t.started <- struct{}{}
+	<-t.wait
+	return nil
+}
+
+func TestLimiter(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	inner := &blockTranscoder{started: make(chan struct{}, 2), wait: make(chan struct{})}
+	l := NewLimiter(inner, 1, time.Minute)
+	is.Equal(l.Limit(), 1)
+
+	first := make(chan error)
+	go func() {
+		first <- l.Transcode(context.Background(), catProfile, "a", io.Discard)
+	}()
+	<-inner.started
+	is.Equal(l.Active(), 1)
+
+	// the second waits its turn
+	second := make(chan error)
+	go func() {
+		second <- l.Transcode(context.Background(), catProfile, "a", io.Discard)
+	}()
+	for l.Queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	is.Equal(l.Active(), 1)
+	close(inner.wait)
+	is.NoErr(<-first)
+	is.NoErr(<-second)
+	is.Equal(len(inner.started), 1) // the second's, after the first's was read
+	is.Equal(l.Active(), 0)
+	is.Equal(l.Queued(), 0)
+}
+
+func TestLimiterBusy(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+
+	l := NewLimiter(&countTranscoder{}, 1, 10*time.Millisecond)
+	release, err := l.Acquire(context.Background())
+	is.NoErr(err)
+
+	// waits as long as it may
+	_, err = l.Acquire(context.Background())
+	is.True(errors.Is(err, ErrBusy))
+
+	// or until it's cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l = NewLimiter(&countTranscoder{}, 1, time.Minute)
+	release, err = l.Acquire(context.Background())
+	is.NoErr(err)
+	_, err = l.Acquire(ctx)
+	is.Equal(err, context.Canceled)
+
+	release()
+	release, err = l.Acquire(ctx)
+	is.NoErr(err)
+	release()
+	is.Equal(l.Active(), 0)
+}
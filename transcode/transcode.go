@@ -24,12 +24,15 @@ var UserProfiles = map[string]Profile{
 	"opus_car": OpusCar,
 	"opus":     Opus,
 	"opus_rg":  OpusRG,
+	"opus_128": Opus128,
+	"opus_96":  Opus96,
+	"aac_256":  AAC256,
 }
 
 // Store as simple strings, since we may let the user provide their own profiles soon
 var (
-	MP3   = NewProfile("audio/mpeg", 128, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a libmp3lame -af "volume=replaygain=track:replaygain_preamp=6dB:replaygain_noclip=0, alimiter=level=disabled, asidedata=mode=delete:type=REPLAYGAIN" -metadata replaygain_album_gain= -metadata replaygain_album_peak= -metadata replaygain_track_gain= -metadata replaygain_track_peak= -metadata r128_album_gain= -metadata r128_track_gain= -f mp3 -`)
-	MP3RG = NewProfile("audio/mpeg", 128, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a libmp3lame -af "volume=replaygain=track:replaygain_preamp=6dB:replaygain_noclip=0, alimiter=level=disabled, asidedata=mode=delete:type=REPLAYGAIN" -metadata replaygain_album_gain= -metadata replaygain_album_peak= -metadata replaygain_track_gain= -metadata replaygain_track_peak= -metadata r128_album_gain= -metadata r128_track_gain= -f mp3 -`)
+	MP3   = NewProfile("audio/mpeg", "mp3", 128, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a libmp3lame -af "volume=replaygain=track:replaygain_preamp=6dB:replaygain_noclip=0, alimiter=level=disabled, asidedata=mode=delete:type=REPLAYGAIN" -metadata replaygain_album_gain= -metadata replaygain_album_peak= -metadata replaygain_track_gain= -metadata replaygain_track_peak= -metadata r128_album_gain= -metadata r128_track_gain= -f mp3 -`)
+	MP3RG = NewProfile("audio/mpeg", "mp3", 128, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a libmp3lame -af "volume=replaygain=track:replaygain_preamp=6dB:replaygain_noclip=0, alimiter=level=disabled, asidedata=mode=delete:type=REPLAYGAIN" -metadata replaygain_album_gain= -metadata replaygain_album_peak= -metadata replaygain_track_gain= -metadata replaygain_track_peak= -metadata r128_album_gain= -metadata r128_track_gain= -f mp3 -`)
 
 	// this sets a baseline gain which results in the final track being +3~5dB louder than
 	// Foobar2000's default ReplayGain target volume.
@@ -42,28 +45,44 @@ var (
 	// on my Ryzen 3600 to transcode an 8-minute FLAC with 2x upsample and RG applied.
 	//
 	// -- @spijet
-	OpusCar = NewProfile("audio/ogg", 96, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a libopus -vbr on -af "aresample=96000:resampler=soxr, volume=replaygain=track:replaygain_preamp=15dB:replaygain_noclip=0, alimiter=level=disabled, asidedata=mode=delete:type=REPLAYGAIN" -f opus -`)
-	Opus    = NewProfile("audio/ogg", 96, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a libopus -vbr on -af "volume=replaygain=track:replaygain_preamp=6dB:replaygain_noclip=0, alimiter=level=disabled, asidedata=mode=delete:type=REPLAYGAIN" -metadata replaygain_album_gain= -metadata replaygain_album_peak= -metadata replaygain_track_gain= -metadata replaygain_track_peak= -metadata r128_album_gain= -metadata r128_track_gain= -f opus -`)
-	OpusRG  = NewProfile("audio/ogg", 96, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a libopus -vbr on -af "volume=replaygain=track:replaygain_preamp=6dB:replaygain_noclip=0, alimiter=level=disabled, asidedata=mode=delete:type=REPLAYGAIN" -metadata replaygain_album_gain= -metadata replaygain_album_peak= -metadata replaygain_track_gain= -metadata replaygain_track_peak= -metadata r128_album_gain= -metadata r128_track_gain= -f opus -`)
+	OpusCar = NewProfile("audio/ogg", "opus", 96, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a libopus -vbr on -af "aresample=96000:resampler=soxr, volume=replaygain=track:replaygain_preamp=15dB:replaygain_noclip=0, alimiter=level=disabled, asidedata=mode=delete:type=REPLAYGAIN" -f opus -`)
+	Opus    = NewProfile("audio/ogg", "opus", 96, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a libopus -vbr on -af "volume=replaygain=track:replaygain_preamp=6dB:replaygain_noclip=0, alimiter=level=disabled, asidedata=mode=delete:type=REPLAYGAIN" -metadata replaygain_album_gain= -metadata replaygain_album_peak= -metadata replaygain_track_gain= -metadata replaygain_track_peak= -metadata r128_album_gain= -metadata r128_track_gain= -f opus -`)
+	OpusRG  = NewProfile("audio/ogg", "opus", 96, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a libopus -vbr on -af "volume=replaygain=track:replaygain_preamp=6dB:replaygain_noclip=0, alimiter=level=disabled, asidedata=mode=delete:type=REPLAYGAIN" -metadata replaygain_album_gain= -metadata replaygain_album_peak= -metadata replaygain_track_gain= -metadata replaygain_track_peak= -metadata r128_album_gain= -metadata r128_track_gain= -f opus -`)
 
-	PCM16le = NewProfile("audio/wav", 0, `ffmpeg -v 0 -i <file> -ss <seek> -c:a pcm_s16le -ac 2 -f s16le -`)
+	// opus in the ogg container, which android clients know how to seek in
+	Opus128 = NewProfile("audio/ogg", "ogg", 128, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a libopus -vbr on -f ogg -`)
+	Opus96  = NewProfile("audio/ogg", "ogg", 96, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a libopus -vbr on -f ogg -`)
+	// aac in an adts stream, which unlike mp4 can be written as it's transcoded
+	AAC256 = NewProfile("audio/aac", "aac", 256, `ffmpeg -v 0 -i <file> -ss <seek> -map 0:a:0 -vn -b:a <bitrate> -c:a aac -f adts -`)
+
+	// a segment of a track for hls, which is aac in mpeg-ts. the timestamps carry on
+	// from the last segment's, so that players can join them up
+	HLSSegment = NewProfile("video/mp2t", "ts", 128, `ffmpeg -v 0 -ss <seek> -i <file> -t <duration> -map 0:a:0 -vn -b:a <bitrate> -c:a aac -output_ts_offset <seek> -muxdelay 0 -f mpegts -`)
+
+	PCM16le = NewProfile("audio/wav", "wav", 0, `ffmpeg -v 0 -i <file> -ss <seek> -c:a pcm_s16le -ac 2 -f s16le -`)
 )
 
 type BitRate int // kb/s
 
 type Profile struct {
-	bitrate BitRate // the default bitrate, but the user can request a different one
-	seek    time.Duration
-	mime    string
-	exec    string
+	bitrate  BitRate // the default bitrate, but the user can request a different one
+	seek     time.Duration
+	duration time.Duration // of the output, for profiles which take a <duration>
+	mime     string
+	suffix   string // of a file in the output format
+	gain     Gain
+	exec     string
 }
 
-func (p *Profile) BitRate() BitRate    { return p.bitrate }
-func (p *Profile) Seek() time.Duration { return p.seek }
-func (p *Profile) MIME() string        { return p.mime }
+func (p *Profile) BitRate() BitRate        { return p.bitrate }
+func (p *Profile) Seek() time.Duration     { return p.seek }
+func (p *Profile) Duration() time.Duration { return p.duration }
+func (p *Profile) MIME() string            { return p.mime }
+func (p *Profile) Suffix() string          { return p.suffix }
+func (p *Profile) Gain() Gain              { return p.gain }
 
-func NewProfile(mime string, bitrate BitRate, exec string) Profile {
-	return Profile{mime: mime, bitrate: bitrate, exec: exec}
+func NewProfile(mime, suffix string, bitrate BitRate, exec string) Profile {
+	return Profile{mime: mime, suffix: suffix, bitrate: bitrate, exec: exec}
 }
 
 func WithBitrate(p Profile, bitRate BitRate) Profile {
@@ -74,6 +93,10 @@ func WithSeek(p Profile, seek time.Duration) Profile {
 	p.seek = seek
 	return p
 }
+func WithDuration(p Profile, duration time.Duration) Profile {
+	p.duration = duration
+	return p
+}
 
 var ErrNoProfileParts = fmt.Errorf("not enough profile parts")
 
@@ -89,20 +112,26 @@ func parseProfile(profile Profile, in string) (string, []string, error) {
 	if err != nil {
 		return "", nil, fmt.Errorf("find name: %w", err)
 	}
+	return name, profileArgs(profile, parts[1:], in), nil
+}
 
+// profileArgs are the arguments to run profile's command with for the file
+// in, given the rest of its split command after the name
+func profileArgs(profile Profile, parts []string, in string) []string {
 	var args []string
-	for _, p := range parts[1:] {
+	for _, p := range parts {
 		switch p {
 		case "<file>":
 			args = append(args, in)
 		case "<seek>":
 			args = append(args, fmt.Sprintf("%dus", profile.Seek().Microseconds()))
+		case "<duration>":
+			args = append(args, fmt.Sprintf("%dus", profile.Duration().Microseconds()))
 		case "<bitrate>":
 			args = append(args, fmt.Sprintf("%dk", profile.BitRate()))
 		default:
 			args = append(args, p)
 		}
 	}
-
-	return name, args, nil
+	return addGainFilter(args, profile.gain)
 }
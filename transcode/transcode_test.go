@@ -0,0 +1,175 @@
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/shlex"
+	"github.com/matryer/is"
+)
+
+func TestProfileFormats(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		name    string
+		profile Profile
+		mime    string
+		suffix  string
+		bitrate BitRate
+	}{
+		{"opus_128", Opus128, "audio/ogg", "ogg", 128},
+		{"opus_96", Opus96, "audio/ogg", "ogg", 96},
+		{"aac_256", AAC256, "audio/aac", "aac", 256},
+		{"mp3", MP3, "audio/mpeg", "mp3", 128},
+	}
+	for _, tc := range tcs {
+		if _, ok := UserProfiles[tc.name]; !ok {
+			t.Errorf("%s isn't a user profile", tc.name)
+		}
+		if got := tc.profile.MIME(); got != tc.mime {
+			t.Errorf("%s: mime = %q, want %q", tc.name, got, tc.mime)
+		}
+		if got := tc.profile.Suffix(); got != tc.suffix {
+			t.Errorf("%s: suffix = %q, want %q", tc.name, got, tc.suffix)
+		}
+		if got := tc.profile.BitRate(); got != tc.bitrate {
+			t.Errorf("%s: bitrate = %d, want %d", tc.name, got, tc.bitrate)
+		}
+	}
+}
+
+// TestProfileRoundTrip transcodes a generated tone with each profile, then checks
+// ffmpeg can read it back. it needs ffmpeg on the PATH
+func TestProfileRoundTrip(t *testing.T) {
+	t.Parallel()
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg isn't installed")
+	}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.flac")
+	gen := exec.Command("ffmpeg", "-v", "error", "-f", "lavfi", "-i", "sine=frequency=440:duration=3", in)
+	if out, err := gen.CombinedOutput(); err != nil {
+		t.Fatalf("generate input: %v: %s", err, out)
+	}
+
+	tcs := []struct {
+		name    string
+		profile Profile
+		magic   []byte
+	}{
+		{"opus_128", Opus128, []byte("OggS")},
+		{"opus_96", Opus96, []byte("OggS")},
+		{"aac_256", AAC256, []byte{0xff, 0xf1}}, // adts sync word, mpeg-4
+		{"mp3", MP3, nil},
+		{"hls", WithDuration(WithSeek(HLSSegment, time.Second), time.Second), []byte{0x47}}, // mpeg-ts sync byte
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+			var buf bytes.Buffer
+			is.NoErr(NewFFmpegTranscoder().Transcode(context.Background(), tc.profile, in, &buf))
+			is.True(buf.Len() > 0)
+			is.True(bytes.HasPrefix(buf.Bytes(), tc.magic))
+
+			out := filepath.Join(dir, tc.name+"."+tc.profile.Suffix())
+			is.NoErr(os.WriteFile(out, buf.Bytes(), perm))
+			decode := exec.Command("ffmpeg", "-v", "error", "-i", out, "-f", "null", "-")
+			if out, err := decode.CombinedOutput(); err != nil || len(out) > 0 {
+				t.Fatalf("decode transcoded: %v: %s", err, out)
+			}
+		})
+	}
+}
+
+func TestReplayGain(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	track, album := -6.5, -8.0
+	is.Equal(ReplayGain(ReplayGainOff, &track, &album), Gain{})
+	is.Equal(ReplayGain(ReplayGainTrack, &track, &album), Gain{DB: -6.5})
+	is.Equal(ReplayGain(ReplayGainAlbum, &track, &album), Gain{DB: -8})
+	is.Equal(ReplayGain(ReplayGainAlbum, &track, nil), Gain{DB: -6.5})
+	is.Equal(ReplayGain(ReplayGainTrack, nil, &album), Gain{Loudnorm: true})
+
+	mp3 := WithGain(MP3, Gain{DB: -6.5})
+	is.Equal(mp3.Gain(), Gain{DB: -6.5})
+}
+
+func TestProfileGainArgs(t *testing.T) {
+	t.Parallel()
+	filters := func(profile Profile) string {
+		parts, err := shlex.Split(profile.exec)
+		if err != nil {
+			t.Fatalf("split: %v", err)
+		}
+		args := profileArgs(profile, parts[1:], "in")
+		for i, arg := range args {
+			if arg == "-af" {
+				return args[i+1]
+			}
+		}
+		return ""
+	}
+	tcs := []struct {
+		name    string
+		profile Profile
+		gain    Gain
+		exp     string
+	}{
+		{"mp3 own gain", MP3, Gain{}, "volume=replaygain=track:replaygain_preamp=6dB:replaygain_noclip=0, alimiter=level=disabled, asidedata=mode=delete:type=REPLAYGAIN"},
+		{"mp3 with preamp", MP3, Gain{DB: -8}, "volume=-2.00dB, alimiter=level=disabled, asidedata=mode=delete:type=REPLAYGAIN"},
+		{"mp3 loudnorm", MP3, Gain{Loudnorm: true}, "loudnorm=I=-18:TP=-1.5:LRA=11, aresample=48000, alimiter=level=disabled, asidedata=mode=delete:type=REPLAYGAIN"},
+		{"opus car", OpusCar, Gain{DB: -8}, "aresample=96000:resampler=soxr, volume=7.00dB, alimiter=level=disabled, asidedata=mode=delete:type=REPLAYGAIN"},
+		{"no own gain", Opus128, Gain{DB: -6.5}, "volume=-6.50dB"},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			is.New(t).Equal(filters(WithGain(tc.profile, tc.gain)), tc.exp)
+		})
+	}
+}
+
+func TestAddGainFilter(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		name string
+		args []string
+		gain Gain
+		exp  []string
+	}{
+		{"no gain", []string{"-i", "in", "-"}, Gain{}, []string{"-i", "in", "-"}},
+		{"no filters", []string{"-i", "in", "-f", "ogg", "-"}, Gain{DB: -6.5}, []string{"-i", "in", "-f", "ogg", "-af", "volume=-6.50dB", "-"}},
+		{"own filters", []string{"-i", "in", "-af", "aresample=96000", "-"}, Gain{DB: 2}, []string{"-i", "in", "-af", "volume=2.00dB, aresample=96000", "-"}},
+		{"loudnorm", []string{"-i", "in", "-"}, Gain{Loudnorm: true}, []string{"-i", "in", "-af", "loudnorm=I=-18:TP=-1.5:LRA=11, aresample=48000", "-"}},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			is.New(t).Equal(addGainFilter(tc.args, tc.gain), tc.exp)
+		})
+	}
+}
+
+func TestGainCacheKey(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	key := func(gain Gain) string {
+		name, args, err := parseProfile(WithGain(catProfile, gain), "in")
+		is.NoErr(err)
+		return cacheKey(name, args)
+	}
+	is.True(key(Gain{}) != key(Gain{DB: -6}))
+	is.True(key(Gain{DB: -6}) != key(Gain{DB: -3}))
+	is.True(key(Gain{DB: -6}) != key(Gain{Loudnorm: true}))
+	is.Equal(key(Gain{DB: -6}), key(Gain{DB: -6}))
+}
@@ -1,59 +1,342 @@
 package transcode
 
 import (
+	"container/list"
 	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 const perm = 0644
 
+// partSuffix is on cache files while they're being written, so that ones left
+// behind by a crash aren't mistaken for whole transcodes
+const partSuffix = ".part"
+
+// ErrYielded is returned by Warm when a stream needed a transcode while it was
+// warming, so it stopped to leave the stream to it
+var ErrYielded = errors.New("yielded to a stream")
+
+// CachingTranscoder keeps transcodes on disk so that they're only done once.
+// when the cache is over its limit, the least recently used transcodes are
+// removed, apart from ones which are being written or read. a file's mod time
+// is when it was last used, so the order survives restarts
 type CachingTranscoder struct {
 	cachePath  string
 	transcoder Transcoder
+	limit      int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used first
+	live    int        // streams which are transcoding
+	warming map[*cacheEntry]context.CancelFunc
+}
+
+type cacheEntry struct {
+	key     string
+	size    int64
+	writing bool
+	readers int
 }
 
 var _ Transcoder = (*CachingTranscoder)(nil)
 
-func NewCachingTranscoder(t Transcoder, cachePath string) *CachingTranscoder {
-	return &CachingTranscoder{transcoder: t, cachePath: cachePath}
+// NewCachingTranscoder caches t's transcodes in cachePath, up to limit bytes.
+// a limit of 0 keeps everything. what's already in the cache is counted first
+func NewCachingTranscoder(t Transcoder, cachePath string, limit int64) (*CachingTranscoder, error) {
+	ct := &CachingTranscoder{
+		transcoder: t,
+		cachePath:  cachePath,
+		limit:      limit,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+		warming:    map[*cacheEntry]context.CancelFunc{},
+	}
+	if err := ct.load(); err != nil {
+		return nil, fmt.Errorf("load cache: %w", err)
+	}
+	return ct, nil
 }
 
-func (t *CachingTranscoder) Transcode(ctx context.Context, profile Profile, in string, out io.Writer) error {
+func (t *CachingTranscoder) load() error {
 	if err := os.MkdirAll(t.cachePath, perm^0111); err != nil {
 		return fmt.Errorf("make cache path: %w", err)
 	}
+	items, err := os.ReadDir(t.cachePath)
+	if err != nil {
+		return fmt.Errorf("read cache path: %w", err)
+	}
+	var infos []os.FileInfo
+	for _, item := range items {
+		if item.IsDir() {
+			continue
+		}
+		info, err := item.Info()
+		if err != nil {
+			continue
+		}
+		if info.Size() == 0 || strings.HasSuffix(item.Name(), partSuffix) {
+			_ = os.Remove(filepath.Join(t.cachePath, item.Name()))
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, info := range infos {
+		entry := &cacheEntry{key: info.Name(), size: info.Size()}
+		t.entries[entry.key] = t.lru.PushFront(entry)
+		t.size += entry.size
+	}
+	t.evict()
+	return nil
+}
 
+func (t *CachingTranscoder) Transcode(ctx context.Context, profile Profile, in string, out io.Writer) error {
 	name, args, err := parseProfile(profile, in)
 	if err != nil {
 		return fmt.Errorf("split command: %w", err)
 	}
-
 	key := cacheKey(name, args)
-	path := filepath.Join(t.cachePath, key)
 
-	cf, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	t.mu.Lock()
+	elem, ok := t.entries[key]
+	if !ok {
+		entry := &cacheEntry{key: key, writing: true}
+		t.entries[key] = t.lru.PushFront(entry)
+		t.startLive()
+		t.mu.Unlock()
+		defer t.endLive()
+		return t.write(ctx, entry, profile, in, out)
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.writing {
+		// rather than wait for the other request, transcode again without caching
+		t.startLive()
+		t.mu.Unlock()
+		defer t.endLive()
+		return t.transcoder.Transcode(ctx, profile, in, out)
+	}
+	entry.readers++
+	t.lru.MoveToFront(elem)
+	t.mu.Unlock()
+	defer t.release(entry)
+
+	path := filepath.Join(t.cachePath, key)
+	cf, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// removed from under us, but we can still transcode
+		t.forget(entry)
+		t.mu.Lock()
+		t.startLive()
+		t.mu.Unlock()
+		defer t.endLive()
+		return t.transcoder.Transcode(ctx, profile, in, out)
+	}
 	if err != nil {
 		return fmt.Errorf("open cache file: %w", err)
 	}
 	defer cf.Close()
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	_, _ = io.Copy(out, cf)
+	return nil
+}
+
+// Warm transcodes in into the cache, unless it's already there. if a stream
+// needs a transcode meanwhile, or there's no room for another, it stops and
+// returns ErrYielded
+func (t *CachingTranscoder) Warm(ctx context.Context, profile Profile, in string) error {
+	name, args, err := parseProfile(profile, in)
+	if err != nil {
+		return fmt.Errorf("split command: %w", err)
+	}
+	key := cacheKey(name, args)
 
-	if i, err := cf.Stat(); err == nil && i.Size() > 0 {
-		_, _ = io.Copy(out, cf)
+	t.mu.Lock()
+	if _, ok := t.entries[key]; ok {
+		t.mu.Unlock()
 		return nil
 	}
+	entry := &cacheEntry{key: key, writing: true}
+	t.entries[key] = t.lru.PushFront(entry)
+	warmCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	t.warming[entry] = cancel
+	t.mu.Unlock()
 
+	err = t.write(warmCtx, entry, profile, in, io.Discard)
+
+	t.mu.Lock()
+	delete(t.warming, entry)
+	t.mu.Unlock()
+	if err != nil && warmCtx.Err() != nil && ctx.Err() == nil {
+		return ErrYielded
+	}
+	if errors.Is(err, ErrBusy) {
+		// streams are using every transcode, so try again later
+		return ErrYielded
+	}
+	return err
+}
+
+// Live returns how many streams are transcoding
+func (t *CachingTranscoder) Live() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.live
+}
+
+// startLive counts a stream's transcode, and stops any warming so that the
+// stream doesn't have to share. t.mu must be held
+func (t *CachingTranscoder) startLive() {
+	t.live++
+	for _, cancel := range t.warming {
+		cancel()
+	}
+}
+
+func (t *CachingTranscoder) endLive() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.live--
+}
+
+func (t *CachingTranscoder) write(ctx context.Context, entry *cacheEntry, profile Profile, in string, out io.Writer) error {
+	path := filepath.Join(t.cachePath, entry.key)
+	partPath := path + partSuffix
+	cf, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		t.forget(entry)
+		return fmt.Errorf("create cache file: %w", err)
+	}
+	fail := func(err error) error {
+		cf.Close()
+		os.Remove(partPath)
+		t.forget(entry)
+		return err
+	}
 	if err := t.transcoder.Transcode(ctx, profile, in, io.MultiWriter(out, cf)); err != nil {
-		os.Remove(path)
-		return fmt.Errorf("internal transcode: %w", err)
+		return fail(fmt.Errorf("internal transcode: %w", err))
+	}
+	// a killed transcoder doesn't always return an error, but its output is cut short
+	if err := ctx.Err(); err != nil {
+		return fail(fmt.Errorf("internal transcode: %w", err))
+	}
+	info, err := cf.Stat()
+	if err != nil {
+		return fail(fmt.Errorf("stat cache file: %w", err))
+	}
+	if info.Size() == 0 {
+		return fail(nil)
+	}
+	if err := cf.Close(); err != nil {
+		return fail(fmt.Errorf("close cache file: %w", err))
+	}
+	if err := os.Rename(partPath, path); err != nil {
+		return fail(fmt.Errorf("rename cache file: %w", err))
 	}
 
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry.writing = false
+	entry.size = info.Size()
+	t.size += entry.size
+	t.evict()
 	return nil
 }
 
+func (t *CachingTranscoder) release(entry *cacheEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry.readers--
+	t.evict()
+}
+
+func (t *CachingTranscoder) forget(entry *cacheEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if elem, ok := t.entries[entry.key]; ok && elem.Value == entry {
+		t.remove(elem)
+	}
+}
+
+// remove drops an entry, and its file if it's done. t.mu must be held
+func (t *CachingTranscoder) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	if !entry.writing {
+		err := os.Remove(filepath.Join(t.cachePath, entry.key))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("error removing cached transcode: %v", err)
+		}
+	}
+	t.lru.Remove(elem)
+	delete(t.entries, entry.key)
+	t.size -= entry.size
+}
+
+func (entry *cacheEntry) inUse() bool {
+	return entry.writing || entry.readers > 0
+}
+
+// evict removes the least recently used entries until the cache is under its
+// limit, skipping ones in use. t.mu must be held
+func (t *CachingTranscoder) evict() {
+	if t.limit <= 0 {
+		return
+	}
+	for elem := t.lru.Back(); elem != nil && t.size > t.limit; {
+		prev := elem.Prev()
+		if !elem.Value.(*cacheEntry).inUse() {
+			t.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+// Purge removes every transcode which isn't in use, and returns how many bytes
+// that freed
+func (t *CachingTranscoder) Purge() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	before := t.size
+	for elem := t.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if !elem.Value.(*cacheEntry).inUse() {
+			t.remove(elem)
+		}
+		elem = prev
+	}
+	return before - t.size
+}
+
+// Size returns the bytes of finished transcodes in the cache
+func (t *CachingTranscoder) Size() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.size
+}
+
+// Limit returns the most bytes the cache may use, or 0 for no limit
+func (t *CachingTranscoder) Limit() int64 {
+	return t.limit
+}
+
 func cacheKey(cmd string, args []string) string {
 	// the cache is invalid whenever transcode command (which includes the
 	// absolute filepath, bit rate args, replay gain args, etc.) changes
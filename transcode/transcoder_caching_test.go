@@ -0,0 +1,190 @@
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+var catProfile = NewProfile("audio/mpeg", "mp3", 128, "cat <file>")
+
+// countTranscoder copies the input, and counts how many times it was asked to.
+// if wait is set, it doesn't finish until wait is closed
+type countTranscoder struct {
+	calls   int
+	started chan struct{}
+	wait    chan struct{}
+}
+
+func (t *countTranscoder) Transcode(ctx context.Context, profile Profile, in string, out io.Writer) error {
+	t.calls++
+	if t.wait != nil {
+		close(t.started)
+		<-t.wait
+	}
+	return NewNoneTranscoder().Transcode(ctx, profile, in, out)
+}
+
+func makeInput(t *testing.T, dir, name string, size int) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, bytes.Repeat([]byte{'x'}, size), perm); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	return path
+}
+
+func cached(t *testing.T, cachePath, in string) bool {
+	t.Helper()
+	name, args, err := parseProfile(catProfile, in)
+	if err != nil {
+		t.Fatalf("parse profile: %v", err)
+	}
+	_, err = os.Stat(filepath.Join(cachePath, cacheKey(name, args)))
+	return err == nil
+}
+
+func TestCachingTranscoderEvict(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dir, cachePath := t.TempDir(), t.TempDir()
+	a := makeInput(t, dir, "a", 100)
+	b := makeInput(t, dir, "b", 100)
+	c := makeInput(t, dir, "c", 100)
+
+	inner := &countTranscoder{}
+	ct, err := NewCachingTranscoder(inner, cachePath, 250)
+	is.NoErr(err)
+	for _, in := range []string{a, b, a, c} {
+		var out bytes.Buffer
+		is.NoErr(ct.Transcode(context.Background(), catProfile, in, &out))
+		is.Equal(out.Len(), 100)
+	}
+	is.Equal(inner.calls, 3) // the second a was from the cache
+
+	// b was used least recently
+	is.True(cached(t, cachePath, a))
+	is.True(!cached(t, cachePath, b))
+	is.True(cached(t, cachePath, c))
+	is.Equal(ct.Size(), int64(200))
+
+	is.Equal(ct.Purge(), int64(200))
+	is.Equal(ct.Size(), int64(0))
+	is.True(!cached(t, cachePath, a))
+}
+
+func TestCachingTranscoderInUse(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dir, cachePath := t.TempDir(), t.TempDir()
+	a := makeInput(t, dir, "a", 100)
+	b := makeInput(t, dir, "b", 100)
+
+	inner := &countTranscoder{}
+	ct, err := NewCachingTranscoder(inner, cachePath, 150)
+	is.NoErr(err)
+	is.NoErr(ct.Transcode(context.Background(), catProfile, a, io.Discard))
+
+	inner.started, inner.wait = make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- ct.Transcode(context.Background(), catProfile, b, io.Discard)
+	}()
+	<-inner.started
+
+	// b isn't finished, so it isn't counted or purged
+	is.Equal(ct.Size(), int64(100))
+	is.Equal(ct.Purge(), int64(100))
+	close(inner.wait)
+	is.NoErr(<-done)
+	is.True(cached(t, cachePath, b))
+	is.Equal(ct.Size(), int64(100))
+}
+
+func TestCachingTranscoderLoad(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dir, cachePath := t.TempDir(), t.TempDir()
+	a := makeInput(t, dir, "a", 100)
+	b := makeInput(t, dir, "b", 100)
+
+	ct, err := NewCachingTranscoder(&countTranscoder{}, cachePath, 0)
+	is.NoErr(err)
+	is.NoErr(ct.Transcode(context.Background(), catProfile, b, io.Discard))
+	is.NoErr(ct.Transcode(context.Background(), catProfile, a, io.Discard))
+	makeInput(t, cachePath, "left-by-a-crash"+partSuffix, 100)
+
+	// b is older, so goes first
+	name, args, _ := parseProfile(catProfile, b)
+	old := time.Now().Add(-time.Hour)
+	is.NoErr(os.Chtimes(filepath.Join(cachePath, cacheKey(name, args)), old, old))
+
+	ct, err = NewCachingTranscoder(&countTranscoder{}, cachePath, 150)
+	is.NoErr(err)
+	is.Equal(ct.Size(), int64(100))
+	is.True(cached(t, cachePath, a))
+	is.True(!cached(t, cachePath, b))
+	_, err = os.Stat(filepath.Join(cachePath, "left-by-a-crash"+partSuffix))
+	is.True(os.IsNotExist(err))
+}
+
+// slowTranscoder copies the input once ctx is done or release is closed,
+// like a killed ffmpeg which exits without an error
+type slowTranscoder struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (t *slowTranscoder) Transcode(ctx context.Context, profile Profile, in string, out io.Writer) error {
+	select {
+	case t.started <- struct{}{}:
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		_, _ = out.Write([]byte("cut short"))
+		return nil
+	case <-t.release:
+	}
+	return NewNoneTranscoder().Transcode(ctx, profile, in, out)
+}
+
+func TestCachingTranscoderWarmYields(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	dir, cachePath := t.TempDir(), t.TempDir()
+	a := makeInput(t, dir, "a", 100)
+	b := makeInput(t, dir, "b", 100)
+
+	inner := &slowTranscoder{started: make(chan struct{}, 1), release: make(chan struct{})}
+	ct, err := NewCachingTranscoder(inner, cachePath, 0)
+	is.NoErr(err)
+
+	warmed := make(chan error)
+	go func() {
+		warmed <- ct.Warm(context.Background(), catProfile, a)
+	}()
+	<-inner.started
+
+	// a stream starting stops the warm, which doesn't leave anything behind
+	streamed := make(chan error)
+	go func() {
+		streamed <- ct.Transcode(context.Background(), catProfile, b, io.Discard)
+	}()
+	is.Equal(<-warmed, ErrYielded)
+	is.True(!cached(t, cachePath, a))
+	is.Equal(ct.Live(), 1)
+	close(inner.release)
+	is.NoErr(<-streamed)
+	is.Equal(ct.Live(), 0)
+
+	is.NoErr(ct.Warm(context.Background(), catProfile, a))
+	is.True(cached(t, cachePath, a))
+	is.Equal(ct.Size(), int64(200))
+}
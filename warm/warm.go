@@ -0,0 +1,303 @@
+// Package warm transcodes tracks ahead of time, so that they're already in the
+// transcode cache when they're streamed. tracks are warmed for each profile
+// which a transcode preference has warming enabled for, unless an always raw
+// rule matches them
+package warm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/transcode"
+)
+
+// SettingLastTrack is the id of the newest track which has been queued
+const SettingLastTrack = "warm_last_track_id"
+
+// yieldWait is how long to wait before checking again whether streams are
+// still transcoding
+var yieldWait = 5 * time.Second
+
+// Cache is where tracks are warmed. see transcode.CachingTranscoder
+type Cache interface {
+	Warm(ctx context.Context, profile transcode.Profile, in string) error
+	Live() int
+}
+
+type job struct {
+	profile string
+	gain    transcode.Gain
+	absPath string
+}
+
+type Warmer struct {
+	db      *db.DB
+	cache   Cache
+	workers int
+
+	mu     sync.Mutex
+	queue  []job
+	queued map[job]struct{}
+	wake   chan struct{}
+}
+
+// New makes a Warmer which runs up to workers transcodes at a time
+func New(dbc *db.DB, cache Cache, workers int) *Warmer {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Warmer{
+		db:      dbc,
+		cache:   cache,
+		workers: workers,
+		queued:  map[job]struct{}{},
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Queued returns how many transcodes are waiting
+func (w *Warmer) Queued() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.queue)
+}
+
+// QueueNew queues the tracks added since it last ran. the first time it runs
+// it only remembers the newest track, rather than warming the whole library
+func (w *Warmer) QueueNew() (int, error) {
+	last, err := w.db.GetSetting(SettingLastTrack)
+	if err != nil {
+		return 0, fmt.Errorf("get last track: %w", err)
+	}
+	var newest struct{ ID int }
+	if err := w.db.Table("tracks").Select("max(id) AS id").Scan(&newest).Error; err != nil {
+		return 0, fmt.Errorf("find newest track: %w", err)
+	}
+	var n int
+	if last != "" {
+		lastID, _ := strconv.Atoi(last)
+		var tracks []*db.Track
+		err := w.db.
+			Where("id>? AND id<=?", lastID, newest.ID).
+			Preload("Album").
+			Order("id").
+			Find(&tracks).
+			Error
+		if err != nil {
+			return 0, fmt.Errorf("find new tracks: %w", err)
+		}
+		if n, err = w.queueTracks(tracks); err != nil {
+			return 0, err
+		}
+	}
+	if err := w.db.SetSetting(SettingLastTrack, strconv.Itoa(newest.ID)); err != nil {
+		return 0, fmt.Errorf("set last track: %w", err)
+	}
+	return n, nil
+}
+
+// QueueAlbum queues an album's tracks
+func (w *Warmer) QueueAlbum(albumID int) (int, error) {
+	var tracks []*db.Track
+	err := w.db.
+		Where("album_id=?", albumID).
+		Preload("Album").
+		Order("tag_disc_number, tag_track_number, filename").
+		Find(&tracks).
+		Error
+	if err != nil {
+		return 0, fmt.Errorf("find tracks: %w", err)
+	}
+	return w.queueTracks(tracks)
+}
+
+// QueuePlaylist queues a playlist's tracks, in playlist order
+func (w *Warmer) QueuePlaylist(playlistID int) (int, error) {
+	var playlist db.Playlist
+	if err := w.db.First(&playlist, playlistID).Error; err != nil {
+		return 0, fmt.Errorf("find playlist: %w", err)
+	}
+	trackIDs := playlist.GetItems()
+	var found []*db.Track
+	if err := w.db.Where("id IN (?)", trackIDs).Preload("Album").Find(&found).Error; err != nil {
+		return 0, fmt.Errorf("find tracks: %w", err)
+	}
+	byID := make(map[int]*db.Track, len(found))
+	for _, track := range found {
+		byID[track.ID] = track
+	}
+	tracks := make([]*db.Track, 0, len(trackIDs))
+	for _, id := range trackIDs {
+		if track, ok := byID[id]; ok {
+			tracks = append(tracks, track)
+		}
+	}
+	return w.queueTracks(tracks)
+}
+
+// queueTracks queues each track for each profile with warming enabled, with
+// the replay gain of each user who warms it. tracks must have their album
+// preloaded
+func (w *Warmer) queueTracks(tracks []*db.Track) (int, error) {
+	var profiles []struct {
+		Profile    string
+		ReplayGain string
+	}
+	err := w.db.
+		Table("transcode_preferences").
+		Select("DISTINCT transcode_preferences.profile, coalesce(users.replay_gain, '') AS replay_gain").
+		Joins("JOIN users ON users.id=transcode_preferences.user_id").
+		Where("transcode_preferences.warm").
+		Order("transcode_preferences.profile, replay_gain").
+		Scan(&profiles).
+		Error
+	if err != nil {
+		return 0, fmt.Errorf("find profiles: %w", err)
+	}
+	if len(profiles) == 0 {
+		return 0, nil
+	}
+	var rules []*db.RawRule
+	if err := w.db.Find(&rules).Error; err != nil {
+		return 0, fmt.Errorf("find always raw rules: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var n int
+	for _, track := range tracks {
+		if isRaw(rules, track.RelPath()) {
+			continue
+		}
+		for _, profile := range profiles {
+			gain := transcode.ReplayGain(transcode.ReplayGainMode(profile.ReplayGain), track.TagReplayGainTrack, track.TagReplayGainAlbum)
+			j := job{profile: profile.Profile, gain: gain, absPath: track.AbsPath()}
+			if _, ok := w.queued[j]; ok {
+				continue
+			}
+			w.queued[j] = struct{}{}
+			w.queue = append(w.queue, j)
+			n++
+		}
+	}
+	if n > 0 {
+		w.signal()
+	}
+	return n, nil
+}
+
+// signal wakes a worker. w.mu must be held
+func (w *Warmer) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func isRaw(rules []*db.RawRule, relPath string) bool {
+	for _, rule := range rules {
+		if rule.Matches(relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run warms queued tracks until ctx is done
+func (w *Warmer) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < w.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (w *Warmer) work(ctx context.Context) {
+	for {
+		j, ok := w.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.wake:
+				continue
+			}
+		}
+		if !w.waitIdle(ctx) {
+			return
+		}
+		err := w.warm(ctx, j)
+		switch {
+		case errors.Is(err, transcode.ErrYielded):
+			w.requeue(j)
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			log.Printf("error warming %q with %q: %v", j.absPath, j.profile, err)
+		}
+	}
+}
+
+func (w *Warmer) warm(ctx context.Context, j job) error {
+	defer w.done(j)
+	profile, ok := transcode.UserProfiles[j.profile]
+	if !ok {
+		return fmt.Errorf("unknown transcode user profile %q", j.profile)
+	}
+	return w.cache.Warm(ctx, transcode.WithGain(profile, j.gain), j.absPath)
+}
+
+// waitIdle waits until no streams are transcoding, and returns false if ctx
+// was done first
+func (w *Warmer) waitIdle(ctx context.Context) bool {
+	for w.cache.Live() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(yieldWait):
+		}
+	}
+	return ctx.Err() == nil
+}
+
+func (w *Warmer) next() (job, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.queue) == 0 {
+		return job{}, false
+	}
+	j := w.queue[0]
+	w.queue = w.queue[1:]
+	if len(w.queue) > 0 {
+		// there's more for the other workers
+		w.signal()
+	}
+	return j, true
+}
+
+func (w *Warmer) done(j job) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.queued, j)
+}
+
+func (w *Warmer) requeue(j job) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.queued[j]; ok {
+		return
+	}
+	w.queued[j] = struct{}{}
+	w.queue = append(w.queue, j)
+	w.signal()
+}
@@ -0,0 +1,192 @@
+package warm
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/matryer/is"
+
+	"go.senan.xyz/gonic/db"
+	"go.senan.xyz/gonic/transcode"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	yieldWait = time.Millisecond
+	os.Exit(m.Run())
+}
+
+type library struct {
+	*db.DB
+	user   *db.User
+	artist *db.Artist
+	album  *db.Album
+}
+
+func newLibrary(t *testing.T) *library {
+	t.Helper()
+	is := is.New(t)
+	dbc, err := db.NewMock()
+	is.NoErr(err)
+	is.NoErr(dbc.Migrate(db.MigrationContext{}))
+	t.Cleanup(func() { dbc.Close() })
+
+	lib := &library{DB: dbc}
+	lib.user = &db.User{Name: "user", Password: "password"}
+	is.NoErr(dbc.Create(lib.user).Error)
+	lib.artist = &db.Artist{Name: "artist"}
+	is.NoErr(dbc.Create(lib.artist).Error)
+	lib.album = &db.Album{RootDir: "/music", RightPath: "album", TagArtistID: lib.artist.ID}
+	is.NoErr(dbc.Create(lib.album).Error)
+	return lib
+}
+
+func (l *library) addTrack(t *testing.T, filename string) *db.Track {
+	t.Helper()
+	track := &db.Track{Filename: filename, AlbumID: l.album.ID, ArtistID: l.artist.ID}
+	if err := l.Create(track).Error; err != nil {
+		t.Fatalf("create track: %v", err)
+	}
+	return track
+}
+
+func (l *library) addPref(t *testing.T, client, profile string, warm bool) {
+	t.Helper()
+	pref := &db.TranscodePreference{UserID: l.user.ID, Client: client, Profile: profile, Warm: warm}
+	if err := l.Create(pref).Error; err != nil {
+		t.Fatalf("create pref: %v", err)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	lib := newLibrary(t)
+	lib.addTrack(t, "old.flac")
+	lib.addPref(t, "phone", "mp3", true)
+	lib.addPref(t, "desktop", "opus", false)
+	is.NoErr(lib.Create(&db.RawRule{Kind: db.RawRuleExtension, Pattern: "dsf"}).Error)
+
+	w := New(lib.DB, nil, 1)
+	// the library is there before the warmer, so isn't warmed
+	n, err := w.QueueNew()
+	is.NoErr(err)
+	is.Equal(n, 0)
+
+	lib.addTrack(t, "new.flac")
+	lib.addTrack(t, "new.dsf") // always raw
+	n, err = w.QueueNew()
+	is.NoErr(err)
+	is.Equal(n, 1)
+	n, err = w.QueueNew()
+	is.NoErr(err)
+	is.Equal(n, 0)
+
+	// new.flac is already queued for mp3
+	lib.addPref(t, "car", "opus", true)
+	n, err = w.QueueAlbum(lib.album.ID)
+	is.NoErr(err)
+	is.Equal(n, 3)
+	is.Equal(w.Queued(), 4)
+}
+
+func TestQueueReplayGain(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	lib := newLibrary(t)
+	gain := -6.5
+	track := lib.addTrack(t, "a.flac")
+	is.NoErr(lib.Model(track).Update("tag_replay_gain_track", gain).Error)
+	lib.addPref(t, "phone", "opus_128", true)
+
+	// another user with the same profile, who has replay gain on
+	other := &db.User{Name: "other", Password: "password", ReplayGain: string(transcode.ReplayGainTrack)}
+	is.NoErr(lib.Create(other).Error)
+	is.NoErr(lib.Create(&db.TranscodePreference{UserID: other.ID, Client: "phone", Profile: "opus_128", Warm: true}).Error)
+
+	w := New(lib.DB, nil, 1)
+	n, err := w.QueueAlbum(lib.album.ID)
+	is.NoErr(err)
+	is.Equal(n, 2)
+	is.Equal(w.queue[0].gain, transcode.Gain{})
+	is.Equal(w.queue[1].gain, transcode.Gain{DB: gain})
+}
+
+// yieldCache yields the first time each track is warmed, and has streams
+// transcoding for the first few checks
+type yieldCache struct {
+	mu     sync.Mutex
+	live   int
+	tried  map[string]bool
+	warmed chan string
+}
+
+func (c *yieldCache) Warm(ctx context.Context, profile transcode.Profile, in string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.tried[in] {
+		c.tried[in] = true
+		return transcode.ErrYielded
+	}
+	c.warmed <- in
+	return nil
+}
+
+func (c *yieldCache) Live() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.live > 0 {
+		c.live--
+		return c.live + 1
+	}
+	return 0
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+	is := is.New(t)
+	lib := newLibrary(t)
+	lib.addPref(t, "phone", "mp3", true)
+	tracks := []*db.Track{lib.addTrack(t, "a.flac"), lib.addTrack(t, "b.flac")}
+	is.NoErr(lib.Preload("Album").Find(&tracks).Error)
+
+	cache := &yieldCache{live: 3, tried: map[string]bool{}, warmed: make(chan string, 2)}
+	w := New(lib.DB, cache, 2)
+	n, err := w.QueueAlbum(lib.album.ID)
+	is.NoErr(err)
+	is.Equal(n, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+
+	// both are warmed after yielding once
+	warmed := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case path := <-cache.warmed:
+			warmed[path] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for warming")
+		}
+	}
+	is.True(warmed[tracks[0].AbsPath()])
+	is.True(warmed[tracks[1].AbsPath()])
+	is.Equal(w.Queued(), 0)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run didn't stop")
+	}
+}